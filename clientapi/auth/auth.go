@@ -45,6 +45,14 @@ type AccountDatabase interface {
 	GetAccountByPassword(ctx context.Context, localpart, password string) (*api.Account, error)
 }
 
+// SoftLogoutError is an M_UNKNOWN_TOKEN or M_USER_LOCKED error which tells the
+// client whether it can get a new access token without logging in again, e.g.
+// because the access token has expired and the client has a refresh token.
+type SoftLogoutError struct {
+	spec.MatrixError
+	SoftLogout bool `json:"soft_logout"`
+}
+
 // VerifyUserFromRequest authenticates the HTTP request,
 // on success returns Device of the requester.
 // Finds local user or an application service user.
@@ -81,12 +89,31 @@ func VerifyUserFromRequest(
 			}
 		}
 	}
+	if res.Expired {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: SoftLogoutError{
+				MatrixError: spec.UnknownToken("Access token has expired"),
+				SoftLogout:  true,
+			},
+		}
+	}
 	if res.Device == nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusUnauthorized,
 			JSON: spec.UnknownToken("Unknown token"),
 		}
 	}
+	// Locked users can still log out, but can't do anything else.
+	if res.Locked && !isLogoutRequest(req) {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: SoftLogoutError{
+				MatrixError: spec.UserLocked("This account has been locked"),
+				SoftLogout:  true,
+			},
+		}
+	}
 	return res.Device, nil
 }
 
@@ -125,3 +152,7 @@ func ExtractAccessToken(req *http.Request) (string, error) {
 
 	return "", fmt.Errorf("missing access token")
 }
+
+func isLogoutRequest(req *http.Request) bool {
+	return strings.HasSuffix(req.URL.Path, "/logout") || strings.HasSuffix(req.URL.Path, "/logout/all")
+}
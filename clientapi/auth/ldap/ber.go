@@ -0,0 +1,174 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The subset of BER (X.690) which is needed for LDAP messages. Only tags with
+// a number below 31 are supported, which covers all of the LDAP operations.
+
+const (
+	classUniversal   = 0x00
+	classApplication = 0x40
+	classContext     = 0x80
+	constructed      = 0x20
+
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = constructed | 0x10
+	tagSet         = constructed | 0x11
+)
+
+// maxMessageSize is the largest LDAP message that is accepted from a server.
+const maxMessageSize = 1 << 20
+
+var errMalformed = errors.New("malformed BER element")
+
+// berElement encodes a single element with the given tag and contents.
+func berElement(tag byte, contents ...[]byte) []byte {
+	length := 0
+	for _, c := range contents {
+		length += len(c)
+	}
+	b := append([]byte{tag}, berLength(length)...)
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func berLength(length int) []byte {
+	if length < 0x80 {
+		return []byte{byte(length)}
+	}
+	var b []byte
+	for l := length; l > 0; l >>= 8 {
+		b = append([]byte{byte(l)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func berInteger(tag byte, v int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(v)}, b...)
+		v >>= 8
+		if (v == 0 && b[0]&0x80 == 0) || (v == -1 && b[0]&0x80 != 0) {
+			break
+		}
+	}
+	return berElement(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return berElement(tag, []byte(s))
+}
+
+func berBoolean(v bool) []byte {
+	if v {
+		return berElement(tagBoolean, []byte{0xff})
+	}
+	return berElement(tagBoolean, []byte{0x00})
+}
+
+// berParse splits the first element off b, returning its tag, its contents and
+// the remaining bytes.
+func berParse(b []byte) (tag byte, contents, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errMalformed
+	}
+	tag = b[0]
+	if tag&0x1f == 0x1f {
+		return 0, nil, nil, fmt.Errorf("unsupported BER tag %#x", tag)
+	}
+	length, n, err := berParseLength(b[1:])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	start := 1 + n
+	if length > len(b)-start {
+		return 0, nil, nil, errMalformed
+	}
+	return tag, b[start : start+length], b[start+length:], nil
+}
+
+func berParseLength(b []byte) (length, n int, err error) {
+	if len(b) == 0 {
+		return 0, 0, errMalformed
+	}
+	if b[0] < 0x80 {
+		return int(b[0]), 1, nil
+	}
+	octets := int(b[0] & 0x7f)
+	if octets == 0 || octets > 3 || len(b) < 1+octets {
+		return 0, 0, errMalformed
+	}
+	for _, o := range b[1 : 1+octets] {
+		length = length<<8 | int(o)
+	}
+	return length, 1 + octets, nil
+}
+
+func berParseInteger(b []byte) (int, error) {
+	if len(b) == 0 || len(b) > 4 {
+		return 0, errMalformed
+	}
+	v := int(int8(b[0]))
+	for _, o := range b[1:] {
+		v = v<<8 | int(o)
+	}
+	return v, nil
+}
+
+// berReadElement reads a whole element from the reader, returning its tag and
+// its contents.
+func berReadElement(r *bufio.Reader) (byte, []byte, error) {
+	header := make([]byte, 2, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if header[0]&0x1f == 0x1f {
+		return 0, nil, fmt.Errorf("unsupported BER tag %#x", header[0])
+	}
+	if header[1] >= 0x80 {
+		octets := int(header[1] & 0x7f)
+		if octets == 0 || octets > 3 {
+			return 0, nil, errMalformed
+		}
+		header = header[:2+octets]
+		if _, err := io.ReadFull(r, header[2:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	length, _, err := berParseLength(header[1:])
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > maxMessageSize {
+		return 0, nil, fmt.Errorf("LDAP message of %d bytes is too large", length)
+	}
+	contents := make([]byte, length)
+	if _, err = io.ReadFull(r, contents); err != nil {
+		return 0, nil, err
+	}
+	return header[0], contents, nil
+}
@@ -0,0 +1,384 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ldap implements password authentication against an LDAP directory.
+// It contains a minimal LDAPv3 client, which only supports the simple bind,
+// search and StartTLS operations.
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Protocol operations from RFC 4511 section 4.
+const (
+	opBindRequest       = classApplication | constructed | 0
+	opBindResponse      = classApplication | constructed | 1
+	opUnbindRequest     = classApplication | 2
+	opSearchRequest     = classApplication | constructed | 3
+	opSearchResultEntry = classApplication | constructed | 4
+	opSearchResultDone  = classApplication | constructed | 5
+	opSearchResultRef   = classApplication | constructed | 19
+	opExtendedRequest   = classApplication | constructed | 23
+	opExtendedResponse  = classApplication | constructed | 24
+)
+
+const (
+	resultSuccess            = 0
+	resultSizeLimitExceeded  = 4
+	resultNoSuchObject       = 32
+	resultInvalidCredentials = 49
+
+	startTLSOID = "1.3.6.1.4.1.1466.20037"
+)
+
+// Search scopes.
+const (
+	ScopeBaseObject   = 0
+	ScopeSingleLevel  = 1
+	ScopeWholeSubtree = 2
+)
+
+// defaultTimeout is used for connections when the context has no deadline.
+const defaultTimeout = 10 * time.Second
+
+// ErrInvalidCredentials is returned by Bind when the DN or password is wrong.
+var ErrInvalidCredentials = errors.New("invalid LDAP credentials")
+
+// ResultError is an unsuccessful result of an LDAP operation.
+type ResultError struct {
+	Code    int
+	Message string
+}
+
+func (e *ResultError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("LDAP result code %d", e.Code)
+	}
+	return fmt.Sprintf("LDAP result code %d: %s", e.Code, e.Message)
+}
+
+// Entry is an entry which was returned by a search.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Attribute returns the first value of the attribute, matching the attribute
+// name case-insensitively, or an empty string if there isn't one.
+func (e *Entry) Attribute(name string) string {
+	for attr, values := range e.Attributes {
+		if strings.EqualFold(attr, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// Conn is a connection to an LDAP server. It isn't safe for concurrent use.
+type Conn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	nextID int
+}
+
+// Dial connects to the server at the ldap:// or ldaps:// URI. If startTLS is
+// set then a plain ldap:// connection is upgraded to TLS before it is used.
+// The connection has to be finished by the deadline of the context.
+func Dial(ctx context.Context, uri string, startTLS bool, tlsConfig *tls.Config) (*Conn, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP URI: %w", err)
+	}
+	host := u.Hostname()
+	port := u.Port()
+	useTLS := false
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+	case "ldaps":
+		if port == "" {
+			port = "636"
+		}
+		useTLS = true
+	default:
+		return nil, fmt.Errorf("unsupported LDAP URI scheme %q", u.Scheme)
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	dialer := &net.Dialer{Timeout: defaultTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultTimeout)
+	}
+	_ = conn.SetDeadline(deadline)
+	if useTLS {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	c := &Conn{conn: conn, r: bufio.NewReader(conn), nextID: 1}
+	if startTLS && !useTLS {
+		if err = c.startTLS(tlsConfig); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close unbinds and closes the connection.
+func (c *Conn) Close() error {
+	_ = c.send(c.nextID, berElement(opUnbindRequest))
+	return c.conn.Close()
+}
+
+// Bind authenticates the connection with a simple bind. Returns
+// ErrInvalidCredentials if the DN or password is wrong. Binds with an empty
+// password are refused, as servers treat them as unauthenticated binds which
+// always succeed.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return ErrInvalidCredentials
+	}
+	id, err := c.request(berElement(opBindRequest,
+		berInteger(tagInteger, 3),
+		berString(tagOctetString, dn),
+		berString(classContext|0, password),
+	))
+	if err != nil {
+		return err
+	}
+	op, contents, err := c.response(id)
+	if err != nil {
+		return err
+	}
+	if op != opBindResponse {
+		return fmt.Errorf("unexpected LDAP response %#x to bind", op)
+	}
+	if err = parseResult(contents); err != nil {
+		var resultErr *ResultError
+		if errors.As(err, &resultErr) && resultErr.Code == resultInvalidCredentials {
+			return ErrInvalidCredentials
+		}
+		return err
+	}
+	return nil
+}
+
+// SearchRequest describes a search. The filter is the encoding returned by
+// CompileFilter.
+type SearchRequest struct {
+	BaseDN     string
+	Scope      int
+	Filter     []byte
+	Attributes []string
+	SizeLimit  int
+}
+
+// Search returns the entries matching the search request. A base DN which
+// doesn't exist results in no entries rather than an error, and the entries
+// up to the size limit are returned if there are more.
+func (c *Conn) Search(req *SearchRequest) ([]*Entry, error) {
+	attrs := make([][]byte, 0, len(req.Attributes))
+	for _, attr := range req.Attributes {
+		attrs = append(attrs, berString(tagOctetString, attr))
+	}
+	id, err := c.request(berElement(opSearchRequest,
+		berString(tagOctetString, req.BaseDN),
+		berInteger(tagEnumerated, req.Scope),
+		berInteger(tagEnumerated, 0), // never dereference aliases
+		berInteger(tagInteger, req.SizeLimit),
+		berInteger(tagInteger, 0), // no time limit
+		berBoolean(false),
+		req.Filter,
+		berElement(tagSequence, attrs...),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for {
+		op, contents, err := c.response(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opSearchResultEntry:
+			entry, err := parseEntry(contents)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case opSearchResultRef:
+			// Referrals to other servers aren't followed.
+		case opSearchResultDone:
+			if err = parseResult(contents); err != nil {
+				var resultErr *ResultError
+				switch {
+				case !errors.As(err, &resultErr):
+				case resultErr.Code == resultNoSuchObject:
+					return nil, nil
+				case resultErr.Code == resultSizeLimitExceeded:
+					return entries, nil
+				}
+				return nil, err
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("unexpected LDAP response %#x to search", op)
+		}
+	}
+}
+
+func (c *Conn) startTLS(tlsConfig *tls.Config) error {
+	id, err := c.request(berElement(opExtendedRequest, berString(classContext|0, startTLSOID)))
+	if err != nil {
+		return err
+	}
+	op, contents, err := c.response(id)
+	if err != nil {
+		return err
+	}
+	if op != opExtendedResponse {
+		return fmt.Errorf("unexpected LDAP response %#x to StartTLS", op)
+	}
+	if err = parseResult(contents); err != nil {
+		return fmt.Errorf("StartTLS failed: %w", err)
+	}
+	tlsConn := tls.Client(c.conn, tlsConfig)
+	if err = tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	c.r = bufio.NewReader(tlsConn)
+	return nil
+}
+
+// request sends the protocol operation in a new message, returning the ID of
+// the message.
+func (c *Conn) request(op []byte) (int, error) {
+	id := c.nextID
+	c.nextID++
+	return id, c.send(id, op)
+}
+
+func (c *Conn) send(id int, op []byte) error {
+	_, err := c.conn.Write(berElement(tagSequence, berInteger(tagInteger, id), op))
+	return err
+}
+
+// response reads the next message, which must be a response to the message
+// with the given ID, and returns its protocol operation.
+func (c *Conn) response(id int) (byte, []byte, error) {
+	tag, message, err := berReadElement(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != tagSequence {
+		return 0, nil, errMalformed
+	}
+	_, idBytes, rest, err := berParse(message)
+	if err != nil {
+		return 0, nil, err
+	}
+	messageID, err := berParseInteger(idBytes)
+	if err != nil {
+		return 0, nil, err
+	}
+	if messageID != id {
+		return 0, nil, fmt.Errorf("unexpected LDAP message ID %d, expected %d", messageID, id)
+	}
+	op, contents, _, err := berParse(rest)
+	return op, contents, err
+}
+
+// parseResult returns a ResultError if the LDAPResult isn't successful.
+func parseResult(b []byte) error {
+	_, code, rest, err := berParse(b)
+	if err != nil {
+		return err
+	}
+	resultCode, err := berParseInteger(code)
+	if err != nil {
+		return err
+	}
+	if resultCode == resultSuccess {
+		return nil
+	}
+	_, _, rest, err = berParse(rest) // matchedDN
+	if err != nil {
+		return &ResultError{Code: resultCode}
+	}
+	_, message, _, err := berParse(rest)
+	if err != nil {
+		return &ResultError{Code: resultCode}
+	}
+	return &ResultError{Code: resultCode, Message: string(message)}
+}
+
+func parseEntry(b []byte) (*Entry, error) {
+	_, dn, rest, err := berParse(b)
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{DN: string(dn), Attributes: map[string][]string{}}
+	_, attrs, _, err := berParse(rest)
+	if err != nil {
+		return nil, err
+	}
+	for len(attrs) > 0 {
+		var attr []byte
+		if _, attr, attrs, err = berParse(attrs); err != nil {
+			return nil, err
+		}
+		_, name, vals, err := berParse(attr)
+		if err != nil {
+			return nil, err
+		}
+		_, vals, _, err = berParse(vals)
+		if err != nil {
+			return nil, err
+		}
+		var values []string
+		for len(vals) > 0 {
+			var value []byte
+			if _, value, vals, err = berParse(vals); err != nil {
+				return nil, err
+			}
+			values = append(values, string(value))
+		}
+		entry.Attributes[string(name)] = values
+	}
+	return entry, nil
+}
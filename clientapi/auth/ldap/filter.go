@@ -0,0 +1,156 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Filter choices from RFC 4511 section 4.5.1.7.
+const (
+	filterAnd      = classContext | constructed | 0
+	filterOr       = classContext | constructed | 1
+	filterNot      = classContext | constructed | 2
+	filterEquality = classContext | constructed | 3
+	filterPresent  = classContext | 7
+)
+
+// CompileFilter encodes a search filter in the string representation of
+// RFC 4515. Only the and, or, not, equality and presence filters are
+// supported, which is enough to restrict logins to a group or an object class.
+func CompileFilter(filter string) ([]byte, error) {
+	b, rest, err := compileFilter(filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LDAP filter %q: %w", filter, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid LDAP filter %q: unexpected %q", filter, rest)
+	}
+	return b, nil
+}
+
+func compileFilter(filter string) ([]byte, string, error) {
+	if !strings.HasPrefix(filter, "(") {
+		return nil, "", fmt.Errorf("expected '('")
+	}
+	filter = filter[1:]
+	if filter == "" {
+		return nil, "", fmt.Errorf("unexpected end of filter")
+	}
+
+	switch filter[0] {
+	case '&', '|':
+		tag := byte(filterAnd)
+		if filter[0] == '|' {
+			tag = filterOr
+		}
+		filter = filter[1:]
+		var children [][]byte
+		for strings.HasPrefix(filter, "(") {
+			child, rest, err := compileFilter(filter)
+			if err != nil {
+				return nil, "", err
+			}
+			children = append(children, child)
+			filter = rest
+		}
+		if len(children) == 0 || !strings.HasPrefix(filter, ")") {
+			return nil, "", fmt.Errorf("expected a list of filters")
+		}
+		return berElement(tag, children...), filter[1:], nil
+
+	case '!':
+		child, rest, err := compileFilter(filter[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", fmt.Errorf("expected ')'")
+		}
+		return berElement(filterNot, child), rest[1:], nil
+	}
+
+	end := strings.IndexByte(filter, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("expected ')'")
+	}
+	item, rest := filter[:end], filter[end+1:]
+	attr, value, ok := strings.Cut(item, "=")
+	if !ok || attr == "" {
+		return nil, "", fmt.Errorf("expected an attribute assertion")
+	}
+	if strings.ContainsAny(attr, "<>~:") {
+		return nil, "", fmt.Errorf("unsupported filter type in %q", item)
+	}
+	if value == "*" {
+		return berString(filterPresent, attr), rest, nil
+	}
+	if strings.Contains(value, "*") {
+		return nil, "", fmt.Errorf("substring filters are not supported")
+	}
+	unescaped, err := unescapeFilterValue(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return equalityFilter(attr, unescaped), rest, nil
+}
+
+func equalityFilter(attr, value string) []byte {
+	return berElement(filterEquality, berString(tagOctetString, attr), berString(tagOctetString, value))
+}
+
+// unescapeFilterValue decodes the \XX escapes of a filter value.
+func unescapeFilterValue(value string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if len(value)-i < 3 {
+			return "", fmt.Errorf("invalid escape in %q", value)
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", value)
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// EscapeDN escapes a value for use in a distinguished name, as described in
+// RFC 4514 section 2.4.
+func EscapeDN(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(`"+,;<>\=`, c) >= 0,
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(value)-1):
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,147 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+// berWalk parses every element of b, descending into constructed elements,
+// and fails the test if anything is left over.
+func berWalk(t *testing.T, b []byte) {
+	t.Helper()
+	for len(b) > 0 {
+		tag, contents, rest, err := berParse(b)
+		if err != nil {
+			t.Fatalf("failed to parse %x: %v", b, err)
+		}
+		if tag&constructed != 0 {
+			berWalk(t, contents)
+		}
+		b = rest
+	}
+}
+
+func FuzzBERParse(f *testing.F) {
+	f.Add(berElement(tagSequence, berInteger(tagInteger, 1), berString(tagOctetString, "uid=alice")))
+	f.Add(berElement(tagOctetString, bytes.Repeat([]byte{'a'}, 300)))
+	f.Add([]byte{tagOctetString, 0x83, 0xff, 0xff, 0xff})
+	f.Add([]byte{tagOctetString, 0x80})
+	f.Add([]byte{0x1f, 0x00})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		tag, contents, rest, err := berParse(b)
+		if err != nil {
+			return
+		}
+		if tag&0x1f == 0x1f {
+			t.Fatalf("accepted unsupported tag %#x", tag)
+		}
+		if len(contents)+len(rest) >= len(b) {
+			t.Fatalf("element of %d bytes has %d bytes of contents and %d remaining", len(b), len(contents), len(rest))
+		}
+		if !bytes.HasSuffix(b, rest) || !bytes.Contains(b[:len(b)-len(rest)], contents) {
+			t.Fatalf("contents and remaining bytes aren't part of the element")
+		}
+		_, _ = berParseInteger(contents)
+	})
+}
+
+func FuzzBERReadElement(f *testing.F) {
+	f.Add(berElement(tagSequence, berInteger(tagInteger, 1), berString(tagOctetString, "uid=alice")))
+	f.Add([]byte{tagSequence, 0x83, 0x10, 0x00, 0x01})
+	f.Add([]byte{tagSequence, 0x84, 0x00, 0x00, 0x00, 0x01, 0x00})
+	f.Add([]byte{tagSequence})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		tag, contents, err := berReadElement(bufio.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			return
+		}
+		if len(contents) > maxMessageSize || len(contents) > len(b) {
+			t.Fatalf("read %d bytes of contents from %d bytes", len(contents), len(b))
+		}
+		// Anything that can be read must also be parseable.
+		parsedTag, parsed, _, err := berParse(b)
+		if err != nil {
+			t.Fatalf("read an element that can't be parsed: %v", err)
+		}
+		if parsedTag != tag || !bytes.Equal(parsed, contents) {
+			t.Fatalf("read and parsed elements differ")
+		}
+	})
+}
+
+func FuzzBERRoundTrip(f *testing.F) {
+	f.Add(byte(tagOctetString), []byte("alice"), int32(0))
+	f.Add(byte(tagSequence), bytes.Repeat([]byte{0}, 0x100), int32(-129))
+	f.Add(byte(classApplication|constructed|3), []byte{}, int32(1<<31-1))
+	f.Fuzz(func(t *testing.T, tag byte, contents []byte, v int32) {
+		if tag&0x1f != 0x1f {
+			parsedTag, parsed, rest, err := berParse(berElement(tag, contents))
+			if err != nil {
+				t.Fatalf("failed to parse element: %v", err)
+			}
+			if parsedTag != tag || !bytes.Equal(parsed, contents) || len(rest) != 0 {
+				t.Fatalf("element didn't round trip")
+			}
+		}
+		_, integer, _, err := berParse(berInteger(tagInteger, int(v)))
+		if err != nil {
+			t.Fatalf("failed to parse integer: %v", err)
+		}
+		parsed, err := berParseInteger(integer)
+		if err != nil {
+			t.Fatalf("failed to parse integer %d: %v", v, err)
+		}
+		if parsed != int(v) {
+			t.Fatalf("integer %d parsed as %d", v, parsed)
+		}
+	})
+}
+
+func FuzzParseMessages(f *testing.F) {
+	f.Add(berElement(tagEnumerated, []byte{0}))
+	f.Add(append(berInteger(tagEnumerated, 49), append(berString(tagOctetString, ""), berString(tagOctetString, "invalid credentials")...)...))
+	f.Add(append(berString(tagOctetString, "uid=alice,dc=example"), berElement(tagSequence,
+		berElement(tagSequence, berString(tagOctetString, "cn"), berElement(tagSet, berString(tagOctetString, "Alice"))),
+	)...))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		_ = parseResult(b)
+		entry, err := parseEntry(b)
+		if err == nil && entry == nil {
+			t.Fatal("no entry and no error")
+		}
+	})
+}
+
+func FuzzCompileFilter(f *testing.F) {
+	for _, filter := range []string{
+		"(objectClass=*)",
+		"(&(uid=alice)(objectClass=*))",
+		"(|(uid=alice)(!(uid=bob)))",
+		`(cn=Alice \28Admin\29)`,
+		"(memberOf=cn=matrix,dc=example)",
+		"(&)",
+		`(cn=\2)`,
+	} {
+		f.Add(filter)
+	}
+	f.Fuzz(func(t *testing.T, filter string) {
+		b, err := CompileFilter(filter)
+		if err != nil {
+			return
+		}
+		tag, _, rest, err := berParse(b)
+		if err != nil {
+			t.Fatalf("compiled filter %q can't be parsed: %v", filter, err)
+		}
+		if len(rest) != 0 {
+			t.Fatalf("compiled filter %q has trailing bytes", filter)
+		}
+		switch tag {
+		case filterAnd, filterOr, filterNot, filterEquality, filterPresent:
+		default:
+			t.Fatalf("compiled filter %q has unexpected tag %#x", filter, tag)
+		}
+		berWalk(t, b)
+	})
+}
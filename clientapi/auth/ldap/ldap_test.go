@@ -0,0 +1,466 @@
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/userapi/api"
+)
+
+type directoryEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// ldapStandIn is a minimal LDAP server which supports simple binds and
+// searches with equality, presence and and filters.
+type ldapStandIn struct {
+	listener net.Listener
+	entries  []*directoryEntry
+}
+
+func newLDAPStandIn(t *testing.T, entries ...*directoryEntry) *ldapStandIn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &ldapStandIn{listener: l, entries: entries}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return s
+}
+
+func (s *ldapStandIn) uri() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+func (s *ldapStandIn) serve(conn net.Conn) {
+	defer conn.Close() // nolint: errcheck
+	r := bufio.NewReader(conn)
+	for {
+		_, message, err := berReadElement(r)
+		if err != nil {
+			return
+		}
+		_, idBytes, rest, _ := berParse(message)
+		id, _ := berParseInteger(idBytes)
+		op, contents, _, _ := berParse(rest)
+		respond := func(op []byte) {
+			_, _ = conn.Write(berElement(tagSequence, berInteger(tagInteger, id), op))
+		}
+		result := func(tag byte, code int) []byte {
+			return berElement(tag, berInteger(tagEnumerated, code), berString(tagOctetString, ""), berString(tagOctetString, ""))
+		}
+
+		switch op {
+		case opBindRequest:
+			_, _, rest, _ := berParse(contents) // version
+			_, dn, rest, _ := berParse(rest)
+			_, password, _, _ := berParse(rest)
+			code := resultInvalidCredentials
+			for _, e := range s.entries {
+				if strings.EqualFold(e.dn, string(dn)) && e.password == string(password) {
+					code = resultSuccess
+				}
+			}
+			respond(result(opBindResponse, code))
+		case opSearchRequest:
+			_, baseDN, rest, _ := berParse(contents)
+			_, scopeBytes, rest, _ := berParse(rest)
+			scope, _ := berParseInteger(scopeBytes)
+			for i := 0; i < 4; i++ { // deref, size limit, time limit, types only
+				_, _, rest, _ = berParse(rest)
+			}
+			filterTag, filter, _, _ := berParse(rest)
+			for _, e := range s.entries {
+				inScope := strings.EqualFold(e.dn, string(baseDN))
+				if scope == ScopeWholeSubtree {
+					inScope = inScope || strings.HasSuffix(strings.ToLower(e.dn), ","+strings.ToLower(string(baseDN)))
+				}
+				if !inScope || !e.matches(filterTag, filter) {
+					continue
+				}
+				var attrs [][]byte
+				for name, values := range e.attributes {
+					var vals [][]byte
+					for _, v := range values {
+						vals = append(vals, berString(tagOctetString, v))
+					}
+					attrs = append(attrs, berElement(tagSequence, berString(tagOctetString, name), berElement(tagSet, vals...)))
+				}
+				respond(berElement(opSearchResultEntry, berString(tagOctetString, e.dn), berElement(tagSequence, attrs...)))
+			}
+			respond(result(opSearchResultDone, resultSuccess))
+		case opUnbindRequest:
+			return
+		}
+	}
+}
+
+func (e *directoryEntry) matches(tag byte, filter []byte) bool {
+	switch tag {
+	case filterAnd:
+		for len(filter) > 0 {
+			childTag, child, rest, _ := berParse(filter)
+			if !e.matches(childTag, child) {
+				return false
+			}
+			filter = rest
+		}
+		return true
+	case filterEquality:
+		_, attr, rest, _ := berParse(filter)
+		_, value, _, _ := berParse(rest)
+		for _, v := range e.attributes[string(attr)] {
+			if strings.EqualFold(v, string(value)) {
+				return true
+			}
+		}
+		return false
+	case filterPresent:
+		return strings.EqualFold(string(filter), "objectClass") || len(e.attributes[string(filter)]) > 0
+	default:
+		return false
+	}
+}
+
+type fakeUserAPI struct {
+	sync.Mutex
+	accounts     map[string]*api.Account
+	links        map[string]string
+	displayNames map[string]string
+}
+
+func newFakeUserAPI() *fakeUserAPI {
+	return &fakeUserAPI{
+		accounts:     map[string]*api.Account{},
+		links:        map[string]string{},
+		displayNames: map[string]string{},
+	}
+}
+
+func (f *fakeUserAPI) QueryAccountByLocalpart(ctx context.Context, req *api.QueryAccountByLocalpartRequest, res *api.QueryAccountByLocalpartResponse) error {
+	f.Lock()
+	defer f.Unlock()
+	account, ok := f.accounts[req.Localpart]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	res.Account = account
+	return nil
+}
+
+func (f *fakeUserAPI) QueryExternalID(ctx context.Context, req *api.QueryExternalIDRequest, res *api.QueryExternalIDResponse) error {
+	f.Lock()
+	defer f.Unlock()
+	if localpart, ok := f.links[req.AuthProvider+"|"+req.ExternalID]; ok {
+		res.Localpart, res.ServerName = localpart, "test"
+	}
+	return nil
+}
+
+func (f *fakeUserAPI) PerformExternalIDLink(ctx context.Context, req *api.PerformExternalIDLinkRequest, res *struct{}) error {
+	f.Lock()
+	defer f.Unlock()
+	f.links[req.AuthProvider+"|"+req.ExternalID] = req.Localpart
+	return nil
+}
+
+func (f *fakeUserAPI) PerformAccountCreation(ctx context.Context, req *api.PerformAccountCreationRequest, res *api.PerformAccountCreationResponse) error {
+	f.Lock()
+	defer f.Unlock()
+	if _, ok := f.accounts[req.Localpart]; ok {
+		return fmt.Errorf("account %q already exists", req.Localpart)
+	}
+	res.AccountCreated = true
+	res.Account = &api.Account{
+		Localpart:  req.Localpart,
+		ServerName: req.ServerName,
+		UserID:     "@" + req.Localpart + ":" + string(req.ServerName),
+	}
+	f.accounts[req.Localpart] = res.Account
+	return nil
+}
+
+func (f *fakeUserAPI) SetDisplayName(ctx context.Context, localpart string, serverName spec.ServerName, displayName string) (*authtypes.Profile, bool, error) {
+	f.Lock()
+	defer f.Unlock()
+	f.displayNames[localpart] = displayName
+	return &authtypes.Profile{Localpart: localpart, DisplayName: displayName}, true, nil
+}
+
+var testEntries = []*directoryEntry{
+	{
+		dn:       "cn=admin,dc=example,dc=com",
+		password: "adminpass",
+	},
+	{
+		dn:       "uid=alice,ou=users,dc=example,dc=com",
+		password: "alicepass",
+		attributes: map[string][]string{
+			"uid":      {"alice"},
+			"cn":       {"Alice Liddell"},
+			"memberOf": {"cn=matrix,ou=groups,dc=example,dc=com"},
+		},
+	},
+	{
+		dn:       "uid=bob,ou=staff,ou=users,dc=example,dc=com",
+		password: "bobpass",
+		attributes: map[string][]string{
+			"uid": {"bob"},
+			"cn":  {"Bob"},
+		},
+	},
+}
+
+func TestProviderBindAsUser(t *testing.T) {
+	s := newLDAPStandIn(t, testEntries...)
+	userAPI := newFakeUserAPI()
+	p, err := NewProvider(&config.LDAP{
+		Enabled:              true,
+		URI:                  s.uri(),
+		BaseDN:               "ou=users,dc=example,dc=com",
+		UIDAttribute:         "uid",
+		DisplayNameAttribute: "cn",
+	}, userAPI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	res := &api.QueryAccountByPasswordResponse{}
+	if err = p.QueryAccountByPassword(ctx, &api.QueryAccountByPasswordRequest{
+		Localpart: "alice", ServerName: "test", PlaintextPassword: "alicepass",
+	}, res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.Exists || res.Account.UserID != "@alice:test" {
+		t.Fatalf("expected alice to log in, got %+v", res)
+	}
+	if userAPI.accounts["alice"] == nil {
+		t.Fatalf("expected an account to be created for alice")
+	}
+	if userAPI.displayNames["alice"] != "Alice Liddell" {
+		t.Fatalf("expected the display name to be synced, got %q", userAPI.displayNames["alice"])
+	}
+
+	for _, req := range []*api.QueryAccountByPasswordRequest{
+		{Localpart: "alice", ServerName: "test", PlaintextPassword: "wrong"},
+		{Localpart: "alice", ServerName: "test", PlaintextPassword: ""},
+		{Localpart: "carol", ServerName: "test", PlaintextPassword: "alicepass"},
+		// bob isn't directly below the base DN, so can't be found without a search
+		{Localpart: "bob", ServerName: "test", PlaintextPassword: "bobpass"},
+	} {
+		res = &api.QueryAccountByPasswordResponse{}
+		if err = p.QueryAccountByPassword(ctx, req, res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Exists {
+			t.Fatalf("expected %s with password %q not to log in", req.Localpart, req.PlaintextPassword)
+		}
+	}
+}
+
+func TestProviderSearchThenBind(t *testing.T) {
+	s := newLDAPStandIn(t, testEntries...)
+	ctx := context.Background()
+	cfg := &config.LDAP{
+		Enabled:              true,
+		URI:                  s.uri(),
+		BaseDN:               "ou=users,dc=example,dc=com",
+		UIDAttribute:         "uid",
+		DisplayNameAttribute: "cn",
+		BindDN:               "cn=admin,dc=example,dc=com",
+		BindPassword:         "adminpass",
+	}
+
+	t.Run("users anywhere below the base DN can log in", func(t *testing.T) {
+		userAPI := newFakeUserAPI()
+		p, err := NewProvider(cfg, userAPI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := &api.QueryAccountByPasswordResponse{}
+		if err = p.QueryAccountByPassword(ctx, &api.QueryAccountByPasswordRequest{
+			Localpart: "bob", ServerName: "test", PlaintextPassword: "bobpass",
+		}, res); err != nil {
+			t.Fatal(err)
+		}
+		if !res.Exists || userAPI.displayNames["bob"] != "Bob" {
+			t.Fatalf("expected bob to log in, got %+v", res)
+		}
+	})
+
+	t.Run("users must match the filter", func(t *testing.T) {
+		filtered := *cfg
+		filtered.Filter = "(memberOf=cn=matrix,ou=groups,dc=example,dc=com)"
+		userAPI := newFakeUserAPI()
+		p, err := NewProvider(&filtered, userAPI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for localpart, want := range map[string]bool{"alice": true, "bob": false} {
+			res := &api.QueryAccountByPasswordResponse{}
+			if err = p.QueryAccountByPassword(ctx, &api.QueryAccountByPasswordRequest{
+				Localpart: localpart, ServerName: "test", PlaintextPassword: localpart + "pass",
+			}, res); err != nil {
+				t.Fatal(err)
+			}
+			if res.Exists != want {
+				t.Fatalf("expected %s logging in to be %v", localpart, want)
+			}
+		}
+	})
+
+	t.Run("wrong service account credentials are an error", func(t *testing.T) {
+		wrong := *cfg
+		wrong.BindPassword = "wrong"
+		p, err := NewProvider(&wrong, newFakeUserAPI())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = p.QueryAccountByPassword(ctx, &api.QueryAccountByPasswordRequest{
+			Localpart: "alice", ServerName: "test", PlaintextPassword: "alicepass",
+		}, &api.QueryAccountByPasswordResponse{}); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestCompileFilter(t *testing.T) {
+	for filter, valid := range map[string]bool{
+		"(objectClass=*)":                 true,
+		"(uid=alice)":                     true,
+		"(&(uid=alice)(objectClass=*))":   true,
+		"(|(uid=alice)(!(uid=bob)))":      true,
+		`(cn=Alice \28Admin\29)`:          true,
+		"(uid=al*ce)":                     false,
+		"(uid>=alice)":                    false,
+		"uid=alice":                       false,
+		"(uid=alice":                      false,
+		"(&)":                             false,
+		"(uid=alice)(uid=bob)":            false,
+		`(cn=\2)`:                         false,
+		"(&(uid=alice)(objectClass=*)":    false,
+		"(!(uid=alice)(uid=bob))":         false,
+		"(memberOf=cn=matrix,dc=example)": true,
+	} {
+		_, err := CompileFilter(filter)
+		if valid && err != nil {
+			t.Errorf("expected %q to be valid, got %v", filter, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("expected %q to be invalid", filter)
+		}
+	}
+
+	b, err := CompileFilter(`(cn=Alice \28Admin\29)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag, contents, _, _ := berParse(b)
+	e := &directoryEntry{attributes: map[string][]string{"cn": {"Alice (Admin)"}}}
+	if !e.matches(tag, contents) {
+		t.Fatalf("expected escaped filter value to match")
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	for value, want := range map[string]string{
+		"alice":       "alice",
+		"a,b":         `a\,b`,
+		"#alice":      `\#alice`,
+		" alice ":     `\ alice\ `,
+		`a+b=c"d\e;f`: `a\+b\=c\"d\\e\;f`,
+	} {
+		if got := EscapeDN(value); got != want {
+			t.Errorf("EscapeDN(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestProviderExistingAccounts(t *testing.T) {
+	s := newLDAPStandIn(t, testEntries...)
+	ctx := context.Background()
+	cfg := &config.LDAP{
+		Enabled:      true,
+		URI:          s.uri(),
+		BaseDN:       "ou=users,dc=example,dc=com",
+		UIDAttribute: "uid",
+	}
+	login := func(p *Provider) *api.QueryAccountByPasswordResponse {
+		res := &api.QueryAccountByPasswordResponse{}
+		if err := p.QueryAccountByPassword(ctx, &api.QueryAccountByPasswordRequest{
+			Localpart: "alice", ServerName: "test", PlaintextPassword: "alicepass",
+		}, res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	t.Run("accounts created by LDAP can log in again", func(t *testing.T) {
+		userAPI := newFakeUserAPI()
+		p, err := NewProvider(cfg, userAPI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !login(p).Exists || !login(p).Exists {
+			t.Fatal("expected alice to log in twice")
+		}
+	})
+
+	t.Run("deactivated accounts can't log in", func(t *testing.T) {
+		userAPI := newFakeUserAPI()
+		p, err := NewProvider(cfg, userAPI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !login(p).Exists {
+			t.Fatal("expected alice to log in")
+		}
+		userAPI.accounts["alice"].Deactivated = true
+		if login(p).Exists {
+			t.Fatal("expected deactivated alice not to log in")
+		}
+	})
+
+	t.Run("local accounts aren't taken over", func(t *testing.T) {
+		userAPI := newFakeUserAPI()
+		userAPI.accounts["alice"] = &api.Account{Localpart: "alice", ServerName: "test", UserID: "@alice:test"}
+		p, err := NewProvider(cfg, userAPI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if login(p).Exists {
+			t.Fatal("expected LDAP alice not to log in as local alice")
+		}
+
+		allowed := *cfg
+		allowed.AllowExistingUsers = true
+		if p, err = NewProvider(&allowed, userAPI); err != nil {
+			t.Fatal(err)
+		}
+		if res := login(p); !res.Exists || res.Account.UserID != "@alice:test" {
+			t.Fatalf("expected LDAP alice to log in as local alice, got %+v", res)
+		}
+	})
+}
@@ -0,0 +1,237 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/matrix-org/util"
+
+	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/userapi/api"
+)
+
+// AuthProvider is the identity provider that LDAP accounts are linked to with
+// their user ID as the external ID. This is how the accounts of LDAP users are
+// told apart from local accounts with the same localpart.
+const AuthProvider = "ldap"
+
+// UserAPI contains the aspects of the user API which are needed to create the
+// accounts of LDAP users and to sync their profiles.
+type UserAPI interface {
+	QueryAccountByLocalpart(ctx context.Context, req *api.QueryAccountByLocalpartRequest, res *api.QueryAccountByLocalpartResponse) error
+	QueryExternalID(ctx context.Context, req *api.QueryExternalIDRequest, res *api.QueryExternalIDResponse) error
+	PerformExternalIDLink(ctx context.Context, req *api.PerformExternalIDLinkRequest, res *struct{}) error
+	PerformAccountCreation(ctx context.Context, req *api.PerformAccountCreationRequest, res *api.PerformAccountCreationResponse) error
+	SetDisplayName(ctx context.Context, localpart string, serverName spec.ServerName, displayName string) (*authtypes.Profile, bool, error)
+}
+
+// Provider checks passwords by binding to the LDAP directory as the user. It
+// can be used wherever the password of a user is checked through
+// QueryAccountByPassword.
+type Provider struct {
+	cfg     *config.LDAP
+	userAPI UserAPI
+	filter  []byte
+}
+
+// NewProvider creates a new LDAP password provider.
+func NewProvider(cfg *config.LDAP, userAPI UserAPI) (*Provider, error) {
+	p := &Provider{
+		cfg:     cfg,
+		userAPI: userAPI,
+	}
+	if cfg.Filter != "" {
+		var err error
+		if p.filter, err = CompileFilter(cfg.Filter); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// QueryAccountByPassword checks the password against the LDAP directory. The
+// account of the user is created if this is their first login, and the display
+// name is copied from the directory. res.Exists is false if the directory
+// doesn't know the user or the password is wrong, if the account has been
+// deactivated, or if the localpart belongs to a local account which LDAP
+// users aren't allowed to take over.
+func (p *Provider) QueryAccountByPassword(ctx context.Context, req *api.QueryAccountByPasswordRequest, res *api.QueryAccountByPasswordResponse) error {
+	// Usernames in the directory which aren't valid localparts can't log in.
+	if internal.ValidateUsername(req.Localpart, req.ServerName) != nil {
+		return nil
+	}
+	entry, err := p.authenticate(ctx, req.Localpart, req.PlaintextPassword)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	account, err := p.accountFor(ctx, req.Localpart, req.ServerName)
+	if err != nil || account == nil {
+		return err
+	}
+
+	if p.cfg.DisplayNameAttribute != "" {
+		if displayName := entry.Attribute(p.cfg.DisplayNameAttribute); displayName != "" {
+			if _, _, err = p.userAPI.SetDisplayName(ctx, req.Localpart, req.ServerName, displayName); err != nil {
+				util.GetLogger(ctx).WithError(err).Warn("Failed to sync display name from LDAP")
+			}
+		}
+	}
+
+	res.Exists = true
+	res.Account = account
+	return nil
+}
+
+// accountFor returns the account of the LDAP user, creating it if this is
+// their first login, or nil if they aren't allowed to use the account.
+func (p *Provider) accountFor(ctx context.Context, localpart string, serverName spec.ServerName) (*api.Account, error) {
+	logger := util.GetLogger(ctx).WithField("localpart", localpart)
+	externalID := fmt.Sprintf("@%s:%s", localpart, serverName)
+
+	var accountRes api.QueryAccountByLocalpartResponse
+	err := p.userAPI.QueryAccountByLocalpart(ctx, &api.QueryAccountByLocalpartRequest{
+		Localpart:  localpart,
+		ServerName: serverName,
+	}, &accountRes)
+	switch {
+	case err == nil && accountRes.Account != nil:
+		if accountRes.Account.Deactivated {
+			logger.Info("Refusing LDAP login to deactivated account")
+			return nil, nil
+		}
+		var linkRes api.QueryExternalIDResponse
+		if err = p.userAPI.QueryExternalID(ctx, &api.QueryExternalIDRequest{
+			AuthProvider: AuthProvider,
+			ExternalID:   externalID,
+		}, &linkRes); err != nil {
+			return nil, fmt.Errorf("p.userAPI.QueryExternalID: %w", err)
+		}
+		if linkRes.Localpart == localpart && linkRes.ServerName == serverName {
+			return accountRes.Account, nil
+		}
+		if !p.cfg.AllowExistingUsers {
+			logger.Warn("Refusing LDAP login to an existing local account")
+			return nil, nil
+		}
+		return accountRes.Account, p.link(ctx, externalID, localpart, serverName)
+	case err != nil && !errors.Is(err, sql.ErrNoRows):
+		return nil, fmt.Errorf("p.userAPI.QueryAccountByLocalpart: %w", err)
+	}
+
+	var createRes api.PerformAccountCreationResponse
+	if err = p.userAPI.PerformAccountCreation(ctx, &api.PerformAccountCreationRequest{
+		AccountType: api.AccountTypeUser,
+		Localpart:   localpart,
+		ServerName:  serverName,
+		OnConflict:  api.ConflictAbort,
+	}, &createRes); err != nil {
+		return nil, fmt.Errorf("p.userAPI.PerformAccountCreation: %w", err)
+	}
+	return createRes.Account, p.link(ctx, externalID, localpart, serverName)
+}
+
+func (p *Provider) link(ctx context.Context, externalID, localpart string, serverName spec.ServerName) error {
+	if err := p.userAPI.PerformExternalIDLink(ctx, &api.PerformExternalIDLinkRequest{
+		AuthProvider: AuthProvider,
+		ExternalID:   externalID,
+		Localpart:    localpart,
+		ServerName:   serverName,
+	}, &struct{}{}); err != nil {
+		return fmt.Errorf("p.userAPI.PerformExternalIDLink: %w", err)
+	}
+	return nil
+}
+
+// authenticate binds as the user, returning their entry in the directory, or
+// nil if the user is unknown or the password is wrong.
+func (p *Provider) authenticate(ctx context.Context, username, password string) (*Entry, error) {
+	if username == "" || password == "" {
+		return nil, nil
+	}
+	conn, err := Dial(ctx, p.cfg.URI, p.cfg.StartTLS, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to LDAP server: %w", err)
+	}
+	defer conn.Close() // nolint: errcheck
+
+	attributes := []string{p.cfg.UIDAttribute}
+	if p.cfg.DisplayNameAttribute != "" {
+		attributes = append(attributes, p.cfg.DisplayNameAttribute)
+	}
+
+	var userDN string
+	var entry *Entry
+	if p.cfg.BindDN != "" {
+		// Search for the user with the service account, so that users can be
+		// anywhere below the base DN and have to match the filter.
+		if err = conn.Bind(p.cfg.BindDN, p.cfg.BindPassword); err != nil {
+			return nil, fmt.Errorf("failed to bind to LDAP server as %q: %w", p.cfg.BindDN, err)
+		}
+		filter := equalityFilter(p.cfg.UIDAttribute, username)
+		if p.filter != nil {
+			filter = berElement(filterAnd, filter, p.filter)
+		}
+		entries, err := conn.Search(&SearchRequest{
+			BaseDN:     p.cfg.BaseDN,
+			Scope:      ScopeWholeSubtree,
+			Filter:     filter,
+			Attributes: attributes,
+			SizeLimit:  2,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to search LDAP directory: %w", err)
+		}
+		if len(entries) != 1 {
+			// Either the user doesn't exist, or the username is ambiguous.
+			return nil, nil
+		}
+		entry = entries[0]
+		userDN = entry.DN
+	} else {
+		userDN = EscapeDN(p.cfg.UIDAttribute) + "=" + EscapeDN(username) + "," + p.cfg.BaseDN
+	}
+
+	if err = conn.Bind(userDN, password); err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to bind to LDAP server: %w", err)
+	}
+
+	if entry == nil {
+		// Read the attributes of the user now that we are bound as them.
+		entries, err := conn.Search(&SearchRequest{
+			BaseDN:     userDN,
+			Scope:      ScopeBaseObject,
+			Filter:     berString(filterPresent, "objectClass"),
+			Attributes: attributes,
+			SizeLimit:  1,
+		})
+		if err != nil || len(entries) == 0 {
+			util.GetLogger(ctx).WithError(err).Warn("Failed to read LDAP attributes of user")
+			return &Entry{DN: userDN}, nil
+		}
+		entry = entries[0]
+	}
+	return entry, nil
+}
@@ -63,6 +63,7 @@ func LoginFromJSONReader(
 		typ = &LoginTypePassword{
 			GetAccountByPassword: useraccountAPI.QueryAccountByPassword,
 			Config:               cfg,
+			ServerName:           cfg.Matrix.ServerNameForHTTPHost(spec.ServerName(req.Host)),
 		}
 	case authtypes.LoginTypeToken:
 		typ = &LoginTypeToken{
@@ -21,6 +21,7 @@ import (
 
 	"github.com/matrix-org/util"
 	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
+	"github.com/neilalexander/harmony/clientapi/auth/ldap"
 	"github.com/neilalexander/harmony/clientapi/httputil"
 	"github.com/neilalexander/harmony/clientapi/userutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -30,6 +31,52 @@ import (
 
 type GetAccountByPassword func(ctx context.Context, req *api.QueryAccountByPasswordRequest, res *api.QueryAccountByPasswordResponse) error
 
+// PasswordProviderUserAPI contains the aspects of the user API which are needed
+// by the password providers.
+type PasswordProviderUserAPI interface {
+	api.UserLoginAPI
+	ldap.UserAPI
+}
+
+// PasswordProviders is a chain of password providers, which are asked in turn
+// until one of them accepts the password. It can be used anywhere that the
+// user API is used to check passwords.
+type PasswordProviders []api.UserLoginAPI
+
+// NewPasswordProviders creates the chain of password providers from the config.
+// The passwords of local accounts are always checked last.
+func NewPasswordProviders(cfg *config.ClientAPI, userAPI PasswordProviderUserAPI) (PasswordProviders, error) {
+	var providers PasswordProviders
+	if cfg.LDAP.Enabled {
+		p, err := ldap.NewProvider(&cfg.LDAP, userAPI)
+		if err != nil {
+			return nil, err
+		}
+		providers = append(providers, p)
+	}
+	return append(providers, userAPI), nil
+}
+
+// QueryAccountByPassword asks each provider in turn. A provider which fails
+// doesn't stop the others from being asked, but its error is returned if none
+// of them accept the password.
+func (p PasswordProviders) QueryAccountByPassword(ctx context.Context, req *api.QueryAccountByPasswordRequest, res *api.QueryAccountByPasswordResponse) error {
+	var firstErr error
+	for _, provider := range p {
+		if err := provider.QueryAccountByPassword(ctx, req, res); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Password provider failed")
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if res.Exists {
+			return nil
+		}
+	}
+	return firstErr
+}
+
 type PasswordRequest struct {
 	Login
 	Password string `json:"password"`
@@ -39,6 +86,9 @@ type PasswordRequest struct {
 type LoginTypePassword struct {
 	GetAccountByPassword GetAccountByPassword
 	Config               *config.ClientAPI
+	// ServerName is the server name that a bare localpart belongs to. If it
+	// is not set then the main server name is used.
+	ServerName spec.ServerName
 }
 
 func (t *LoginTypePassword) Name() string {
@@ -74,7 +124,7 @@ func (t *LoginTypePassword) Login(ctx context.Context, req interface{}) (*Login,
 			JSON: spec.BadJSON("A password must be supplied."),
 		}
 	}
-	localpart, domain, err := userutil.ParseUsernameParam(username, t.Config.Matrix)
+	localpart, domain, err := userutil.ParseUsernameParamForServer(username, t.Config.Matrix, t.ServerName)
 	if err != nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusUnauthorized,
@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/neilalexander/harmony/userapi/api"
+)
+
+// staticPasswordProvider accepts a single password, or fails with err.
+type staticPasswordProvider struct {
+	password string
+	account  *api.Account
+	err      error
+	calls    int
+}
+
+func (p *staticPasswordProvider) QueryAccountByPassword(ctx context.Context, req *api.QueryAccountByPasswordRequest, res *api.QueryAccountByPasswordResponse) error {
+	p.calls++
+	if p.err != nil {
+		return p.err
+	}
+	if req.PlaintextPassword == p.password {
+		res.Exists = true
+		res.Account = p.account
+	}
+	return nil
+}
+
+func TestPasswordProviders(t *testing.T) {
+	alice := &api.Account{UserID: "@alice:example.com"}
+	failErr := errors.New("directory unavailable")
+
+	for name, tc := range map[string]struct {
+		providers  []*staticPasswordProvider
+		password   string
+		wantExists bool
+		wantErr    bool
+		wantCalls  []int
+	}{
+		"first provider accepts": {
+			providers:  []*staticPasswordProvider{{password: "a", account: alice}, {password: "b", account: alice}},
+			password:   "a",
+			wantExists: true,
+			wantCalls:  []int{1, 0},
+		},
+		"second provider accepts": {
+			providers:  []*staticPasswordProvider{{password: "a", account: alice}, {password: "b", account: alice}},
+			password:   "b",
+			wantExists: true,
+			wantCalls:  []int{1, 1},
+		},
+		"no provider accepts": {
+			providers: []*staticPasswordProvider{{password: "a", account: alice}, {password: "b", account: alice}},
+			password:  "c",
+			wantCalls: []int{1, 1},
+		},
+		"failing provider doesn't stop the chain": {
+			providers:  []*staticPasswordProvider{{err: failErr}, {password: "b", account: alice}},
+			password:   "b",
+			wantExists: true,
+			wantCalls:  []int{1, 1},
+		},
+		"failure is returned if no provider accepts": {
+			providers: []*staticPasswordProvider{{err: failErr}, {password: "b", account: alice}},
+			password:  "c",
+			wantErr:   true,
+			wantCalls: []int{1, 1},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var chain PasswordProviders
+			for _, p := range tc.providers {
+				chain = append(chain, p)
+			}
+			res := &api.QueryAccountByPasswordResponse{}
+			err := chain.QueryAccountByPassword(ctx, &api.QueryAccountByPasswordRequest{
+				Localpart:         "alice",
+				ServerName:        serverName,
+				PlaintextPassword: tc.password,
+			}, res)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if res.Exists != tc.wantExists {
+				t.Fatalf("expected Exists to be %v", tc.wantExists)
+			}
+			for i, p := range tc.providers {
+				if p.calls != tc.wantCalls[i] {
+					t.Fatalf("expected provider %d to be called %d times, got %d", i, tc.wantCalls[i], p.calls)
+				}
+			}
+		})
+	}
+}
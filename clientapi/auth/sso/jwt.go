@@ -0,0 +1,155 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-jose/go-jose/v3"
+	"github.com/go-jose/go-jose/v3/jwt"
+)
+
+// clockSkew is how far the clocks of the identity provider and this server may
+// be apart when checking the validity period of ID tokens.
+const clockSkew = time.Minute
+
+// signatureAlgorithms are the algorithms that ID tokens may be signed with.
+// Only asymmetric algorithms are accepted, as the signature is checked with
+// the public keys of the provider.
+var signatureAlgorithms = map[jose.SignatureAlgorithm]struct{}{
+	jose.RS256: {}, jose.RS384: {}, jose.RS512: {},
+	jose.PS256: {}, jose.PS384: {}, jose.PS512: {},
+	jose.ES256: {}, jose.ES384: {}, jose.ES512: {},
+	jose.EdDSA: {},
+}
+
+type jsonWebKeySet struct {
+	Keys []json.RawMessage `json:"keys"`
+}
+
+// keySet holds the signing keys of an identity provider.
+type keySet struct {
+	fetched time.Time
+	keys    []jose.JSONWebKey
+}
+
+// keySet parses the signing keys, skipping the ones which are of an unsupported
+// type or aren't public keys meant for signatures.
+func (s *jsonWebKeySet) keySet() *keySet {
+	keys := &keySet{fetched: time.Now()}
+	for _, raw := range s.Keys {
+		var jwk jose.JSONWebKey
+		if err := json.Unmarshal(raw, &jwk); err != nil {
+			continue
+		}
+		if (jwk.Use != "" && jwk.Use != "sig") || !jwk.IsPublic() {
+			continue
+		}
+		keys.keys = append(keys.keys, jwk)
+	}
+	return keys
+}
+
+// find returns the keys which may have made a signature with the given key ID
+// and algorithm. If the ID token doesn't name a key then all of them are
+// candidates.
+func (s *keySet) find(keyID, algorithm string) []jose.JSONWebKey {
+	var keys []jose.JSONWebKey
+	for _, k := range s.keys {
+		if keyID != "" && k.KeyID != keyID {
+			continue
+		}
+		if k.Algorithm != "" && k.Algorithm != algorithm {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// verifyIDToken checks the signature of the ID token against the signing keys
+// of the provider, and checks its issuer, audience, validity period and nonce.
+func (p *Provider) verifyIDToken(ctx context.Context, discovery *discoveryDocument, token, nonce string) (Claims, error) {
+	parsed, err := jwt.ParseSigned(token)
+	if err != nil {
+		return nil, fmt.Errorf("malformed ID token: %w", err)
+	}
+	if len(parsed.Headers) != 1 {
+		return nil, fmt.Errorf("ID token must have exactly one signature")
+	}
+	header := parsed.Headers[0]
+	if _, ok := signatureAlgorithms[jose.SignatureAlgorithm(header.Algorithm)]; !ok {
+		return nil, fmt.Errorf("ID token is signed with unsupported algorithm %q", header.Algorithm)
+	}
+
+	var registered jwt.Claims
+	var claims Claims
+	verified := false
+	for _, refresh := range []bool{false, true} {
+		keys, err := p.getKeys(ctx, discovery, refresh)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys.find(header.KeyID, header.Algorithm) {
+			if err = parsed.Claims(key.Key, &registered, &claims); err == nil {
+				verified = true
+				break
+			}
+		}
+		if verified {
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("ID token signature is invalid")
+	}
+
+	if registered.Expiry == nil {
+		return nil, fmt.Errorf("ID token has no expiry")
+	}
+	if err = registered.ValidateWithLeeway(jwt.Expected{
+		Issuer:   discovery.Issuer,
+		Audience: jwt.Audience{p.cfg.ClientID},
+		Time:     time.Now(),
+	}, clockSkew); err != nil {
+		switch {
+		case errors.Is(err, jwt.ErrInvalidIssuer):
+			return nil, fmt.Errorf("ID token has issuer %q, expected %q", registered.Issuer, discovery.Issuer)
+		case errors.Is(err, jwt.ErrInvalidAudience):
+			return nil, fmt.Errorf("ID token isn't meant for this client")
+		default:
+			return nil, fmt.Errorf("ID token isn't valid: %w", err)
+		}
+	}
+	// An ID token for several clients must name the one it was issued to.
+	if azp, ok := claims["azp"]; ok {
+		if azp != p.cfg.ClientID {
+			return nil, fmt.Errorf("ID token was issued to another client")
+		}
+	} else if len(registered.Audience) > 1 {
+		return nil, fmt.Errorf("ID token has several audiences but no authorized party")
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, fmt.Errorf("ID token nonce doesn't match")
+	}
+	if claims.Subject() == "" {
+		return nil, fmt.Errorf("ID token has no subject")
+	}
+	return claims, nil
+}
@@ -0,0 +1,257 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sso implements single sign-on through OpenID Connect identity
+// providers, using the authorization code flow.
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+// maxResponseSize is the maximum size of the responses that are read from an
+// identity provider.
+const maxResponseSize = 1 << 20
+
+// Claims are the claims of a verified ID token.
+type Claims map[string]interface{}
+
+// Subject returns the ID of the user at the identity provider.
+func (c Claims) Subject() string {
+	sub, _ := c["sub"].(string)
+	return sub
+}
+
+// discoveryDocument is the subset of the OpenID provider metadata that is
+// needed for the authorization code flow.
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// A Provider is an OpenID Connect identity provider. The provider metadata and
+// signing keys are fetched when they are first needed.
+type Provider struct {
+	cfg         *config.IdentityProvider
+	client      *http.Client
+	localpart   *template.Template
+	displayName *template.Template
+
+	mu        sync.Mutex
+	discovery *discoveryDocument
+	keys      *keySet
+}
+
+// NewProvider creates a new identity provider from the config. Requests to the
+// identity provider are made with the given HTTP client.
+func NewProvider(cfg *config.IdentityProvider, client *http.Client) (*Provider, error) {
+	p := &Provider{
+		cfg:    cfg,
+		client: client,
+	}
+	var err error
+	p.localpart, err = template.New("localpart").Option("missingkey=error").Parse(cfg.LocalpartTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid localpart template for identity provider %q: %w", cfg.ID, err)
+	}
+	if cfg.DisplayNameTemplate != "" {
+		p.displayName, err = template.New("displayname").Option("missingkey=error").Parse(cfg.DisplayNameTemplate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid display name template for identity provider %q: %w", cfg.ID, err)
+		}
+	}
+	return p, nil
+}
+
+// ID returns the ID of the identity provider from the config.
+func (p *Provider) ID() string {
+	return p.cfg.ID
+}
+
+// Name returns the human readable name of the identity provider.
+func (p *Provider) Name() string {
+	return p.cfg.Name
+}
+
+// AllowExistingUsers returns whether users of the identity provider can log in
+// as existing accounts.
+func (p *Provider) AllowExistingUsers() bool {
+	return p.cfg.AllowExistingUsers
+}
+
+// AuthorizationURL returns the URL that the user is sent to in order to log in
+// at the identity provider. The identity provider redirects the user back to
+// the callback URL with the state and an authorization code afterwards.
+func (p *Provider) AuthorizationURL(ctx context.Context, callbackURL, state, nonce string) (string, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(discovery.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("invalid authorization endpoint: %w", err)
+	}
+	query := u.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.cfg.ClientID)
+	query.Set("redirect_uri", callbackURL)
+	query.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", nonce)
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// Exchange exchanges the authorization code for an ID token and returns its
+// claims, once the token has been verified. The nonce must be the one that was
+// passed to AuthorizationURL.
+func (p *Provider) Exchange(ctx context.Context, callbackURL, code, nonce string) (Claims, error) {
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {callbackURL},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+
+	var tokenRes struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err = p.do(req, &tokenRes); err != nil && tokenRes.Error == "" {
+		return nil, fmt.Errorf("token request failed: %w", err)
+	}
+	if tokenRes.Error != "" {
+		return nil, fmt.Errorf("token request failed: %s: %s", tokenRes.Error, tokenRes.ErrorDescription)
+	}
+	if tokenRes.IDToken == "" {
+		return nil, fmt.Errorf("token response doesn't contain an ID token")
+	}
+	return p.verifyIDToken(ctx, discovery, tokenRes.IDToken, nonce)
+}
+
+// Localpart derives the localpart of a new user from the claims.
+func (p *Provider) Localpart(claims Claims) (string, error) {
+	var b strings.Builder
+	if err := p.localpart.Execute(&b, map[string]interface{}(claims)); err != nil {
+		return "", fmt.Errorf("failed to derive localpart: %w", err)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// DisplayName derives the display name of a new user from the claims. Returns
+// an empty string if there's no display name template, or if the claims it
+// needs are missing.
+func (p *Provider) DisplayName(claims Claims) string {
+	if p.displayName == nil {
+		return ""
+	}
+	var b strings.Builder
+	if err := p.displayName.Execute(&b, map[string]interface{}(claims)); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// getDiscovery returns the provider metadata, fetching it on first use.
+func (p *Provider) getDiscovery(ctx context.Context) (*discoveryDocument, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	wellKnown := strings.TrimSuffix(p.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return nil, err
+	}
+	discovery := &discoveryDocument{}
+	if err = p.do(req, discovery); err != nil {
+		return nil, fmt.Errorf("failed to fetch OpenID configuration: %w", err)
+	}
+	// The issuer in the metadata must be identical to the one that was used to
+	// find it, so that one provider can't pretend to be another.
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(p.cfg.Issuer, "/") {
+		return nil, fmt.Errorf("OpenID configuration has issuer %q, expected %q", discovery.Issuer, p.cfg.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("OpenID configuration is missing endpoints")
+	}
+	p.discovery = discovery
+	return discovery, nil
+}
+
+// do performs the request and decodes the JSON response into res. The body of
+// error responses is decoded as well, as OAuth2 errors are JSON objects.
+func (p *Provider) do(req *http.Request, res interface{}) error {
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return err
+	}
+	decodeErr := json.Unmarshal(body, res)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return decodeErr
+}
+
+// getKeys returns the signing keys of the provider. The keys are fetched again
+// if refresh is set, which happens when a token is signed with an unknown key
+// because the provider has rotated its keys.
+func (p *Provider) getKeys(ctx context.Context, discovery *discoveryDocument, refresh bool) (*keySet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keys != nil && (!refresh || time.Since(p.keys.fetched) < time.Minute) {
+		return p.keys, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discovery.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+	var jwks jsonWebKeySet
+	if err = p.do(req, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %w", err)
+	}
+	keys := jwks.keySet()
+	p.keys = keys
+	return keys, nil
+}
@@ -0,0 +1,348 @@
+package sso
+
+import (
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+// mockOIDCServer is a minimal OpenID Connect provider which issues ID tokens
+// with the claims of the test for any authorization code.
+type mockOIDCServer struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	keyID  string
+	claims map[string]interface{}
+	code   string
+	issuer string // overrides the issuer in the discovery document
+}
+
+func newMockOIDCServer(t *testing.T) *mockOIDCServer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &mockOIDCServer{key: key, keyID: "key1", code: "abc"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := s.URL
+		if s.issuer != "" {
+			issuer = s.issuer
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 issuer,
+			"authorization_endpoint": s.URL + "/authorize",
+			"token_endpoint":         s.URL + "/token",
+			"jwks_uri":               s.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": s.keyID,
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, ok := r.BasicAuth()
+		if !ok || clientID != "harmony" || clientSecret != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+			return
+		}
+		if r.PostFormValue("grant_type") != "authorization_code" || r.PostFormValue("code") != s.code {
+			w.WriteHeader(http.StatusBadRequest)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     s.sign(t, s.claims),
+		})
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *mockOIDCServer) sign(t *testing.T, claims map[string]interface{}) string {
+	return signToken(t, map[string]string{"alg": "RS256", "typ": "JWT", "kid": s.keyID}, claims, func(signed []byte) []byte {
+		digest := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	})
+}
+
+// signToken creates a compact JWS with the given header and claims, signed by
+// the signing function.
+func signToken(t *testing.T, header map[string]string, claims map[string]interface{}, sign func(signed []byte) []byte) string {
+	t.Helper()
+	encodedHeader, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(encodedHeader) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func (s *mockOIDCServer) validClaims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                s.URL,
+		"sub":                "1234",
+		"aud":                "harmony",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"nonce":              nonce,
+		"preferred_username": "Alice",
+		"name":               "Alice Liddell",
+	}
+}
+
+func newTestProvider(t *testing.T, s *mockOIDCServer) *Provider {
+	t.Helper()
+	p, err := NewProvider(&config.IdentityProvider{
+		ID:                  "mock",
+		Issuer:              s.URL,
+		ClientID:            "harmony",
+		ClientSecret:        "secret",
+		Scopes:              []string{"openid", "profile"},
+		LocalpartTemplate:   "{{ .preferred_username }}",
+		DisplayNameTemplate: "{{ .name }}",
+	}, s.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestAuthorizationURL(t *testing.T) {
+	s := newMockOIDCServer(t)
+	p := newTestProvider(t, s)
+
+	authURL, err := p.AuthorizationURL(context.Background(), "https://matrix.example.com/callback", "state", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, s.URL+"/authorize?") {
+		t.Fatalf("unexpected authorization URL %s", authURL)
+	}
+	for key, want := range map[string]string{
+		"response_type": "code",
+		"client_id":     "harmony",
+		"redirect_uri":  "https://matrix.example.com/callback",
+		"scope":         "openid profile",
+		"state":         "state",
+		"nonce":         "nonce",
+	} {
+		if got := u.Query().Get(key); got != want {
+			t.Errorf("expected %s to be %q, got %q", key, want, got)
+		}
+	}
+}
+
+func TestExchange(t *testing.T) {
+	s := newMockOIDCServer(t)
+	p := newTestProvider(t, s)
+	ctx := context.Background()
+
+	t.Run("valid ID token", func(t *testing.T) {
+		s.claims = s.validClaims("nonce")
+		claims, err := p.Exchange(ctx, "https://matrix.example.com/callback", s.code, "nonce")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Subject() != "1234" {
+			t.Fatalf("unexpected subject %q", claims.Subject())
+		}
+		localpart, err := p.Localpart(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if localpart != "Alice" {
+			t.Fatalf("unexpected localpart %q", localpart)
+		}
+		if displayName := p.DisplayName(claims); displayName != "Alice Liddell" {
+			t.Fatalf("unexpected display name %q", displayName)
+		}
+	})
+
+	t.Run("audience array", func(t *testing.T) {
+		s.claims = s.validClaims("nonce")
+		s.claims["aud"] = []string{"other", "harmony"}
+		s.claims["azp"] = "harmony"
+		if _, err := p.Exchange(ctx, "https://matrix.example.com/callback", s.code, "nonce"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("missing template claim", func(t *testing.T) {
+		s.claims = s.validClaims("nonce")
+		delete(s.claims, "preferred_username")
+		delete(s.claims, "name")
+		claims, err := p.Exchange(ctx, "https://matrix.example.com/callback", s.code, "nonce")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = p.Localpart(claims); err == nil {
+			t.Fatal("expected an error for a missing claim")
+		}
+		if displayName := p.DisplayName(claims); displayName != "" {
+			t.Fatalf("expected no display name, got %q", displayName)
+		}
+	})
+
+	for name, modify := range map[string]func(claims map[string]interface{}){
+		"wrong nonce":    func(claims map[string]interface{}) { claims["nonce"] = "other" },
+		"wrong issuer":   func(claims map[string]interface{}) { claims["iss"] = "https://evil.example.com" },
+		"wrong audience": func(claims map[string]interface{}) { claims["aud"] = "other" },
+		"expired":        func(claims map[string]interface{}) { claims["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"no expiry":      func(claims map[string]interface{}) { delete(claims, "exp") },
+		"not yet valid":  func(claims map[string]interface{}) { claims["nbf"] = time.Now().Add(time.Hour).Unix() },
+		"issued in the future": func(claims map[string]interface{}) {
+			claims["iat"] = time.Now().Add(time.Hour).Unix()
+		},
+		"no subject": func(claims map[string]interface{}) { delete(claims, "sub") },
+		"several audiences without authorized party": func(claims map[string]interface{}) {
+			claims["aud"] = []string{"other", "harmony"}
+		},
+		"issued to another client": func(claims map[string]interface{}) {
+			claims["aud"] = []string{"other", "harmony"}
+			claims["azp"] = "other"
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s.claims = s.validClaims("nonce")
+			modify(s.claims)
+			if _, err := p.Exchange(ctx, "https://matrix.example.com/callback", s.code, "nonce"); err == nil {
+				t.Fatal("expected the ID token to be rejected")
+			}
+		})
+	}
+
+	t.Run("invalid code", func(t *testing.T) {
+		s.claims = s.validClaims("nonce")
+		if _, err := p.Exchange(ctx, "https://matrix.example.com/callback", "wrong", "nonce"); err == nil {
+			t.Fatal("expected an error for an invalid code")
+		}
+	})
+
+	t.Run("signed by another key", func(t *testing.T) {
+		s.claims = s.validClaims("nonce")
+		otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := (&mockOIDCServer{key: otherKey, keyID: s.keyID}).sign(t, s.claims)
+		discovery, err := p.getDiscovery(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = p.verifyIDToken(ctx, discovery, token, "nonce"); err == nil {
+			t.Fatal("expected the signature to be rejected")
+		}
+	})
+}
+
+func TestVerifyIDTokenSignature(t *testing.T) {
+	s := newMockOIDCServer(t)
+	p := newTestProvider(t, s)
+	ctx := context.Background()
+	discovery, err := p.getDiscovery(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := s.validClaims("nonce")
+
+	t.Run("valid signature", func(t *testing.T) {
+		if _, err := p.verifyIDToken(ctx, discovery, s.sign(t, claims), "nonce"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("no key ID", func(t *testing.T) {
+		token := (&mockOIDCServer{key: s.key}).sign(t, claims)
+		if _, err := p.verifyIDToken(ctx, discovery, token, "nonce"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	rsaPublicKey, err := x509.MarshalPKIXPublicKey(&s.key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPublicKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: rsaPublicKey})
+
+	for name, token := range map[string]string{
+		"unsigned": signToken(t, map[string]string{"alg": "none", "kid": s.keyID}, claims, func([]byte) []byte {
+			return nil
+		}),
+		"HS256 with the RSA public key": signToken(t, map[string]string{"alg": "HS256", "kid": s.keyID}, claims, func(signed []byte) []byte {
+			mac := hmac.New(sha256.New, rsaPublicKeyPEM)
+			mac.Write(signed) // nolint: errcheck
+			return mac.Sum(nil)
+		}),
+		"HS256 with the RSA modulus": signToken(t, map[string]string{"alg": "HS256", "kid": s.keyID}, claims, func(signed []byte) []byte {
+			mac := hmac.New(sha256.New, s.key.N.Bytes())
+			mac.Write(signed) // nolint: errcheck
+			return mac.Sum(nil)
+		}),
+		"unknown key ID": (&mockOIDCServer{key: s.key, keyID: "other"}).sign(t, claims),
+		"malformed":      "not.a.token",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := p.verifyIDToken(ctx, discovery, token, "nonce"); err == nil {
+				t.Fatal("expected the ID token to be rejected")
+			}
+		})
+	}
+}
+
+func TestDiscoveryIssuerMismatch(t *testing.T) {
+	s := newMockOIDCServer(t)
+	s.issuer = "https://evil.example.com"
+	p := newTestProvider(t, s)
+	if _, err := p.AuthorizationURL(context.Background(), "https://matrix.example.com/callback", "state", "nonce"); err == nil {
+		t.Fatal("expected an error for a discovery document from another issuer")
+	}
+}
+
+func TestNewProviderInvalidTemplate(t *testing.T) {
+	if _, err := NewProvider(&config.IdentityProvider{
+		ID:                "mock",
+		LocalpartTemplate: "{{ .preferred_username",
+	}, http.DefaultClient); err == nil {
+		t.Fatal("expected an error for an invalid template")
+	}
+}
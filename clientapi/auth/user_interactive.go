@@ -15,17 +15,25 @@
 package auth
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"sync"
 
 	"github.com/matrix-org/util"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/userapi/api"
 	"github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+	"golang.org/x/exp/slices"
 )
 
 // Type represents an auth type
@@ -71,6 +79,9 @@ type Login struct {
 	// Thus a pointer is needed to differentiate between the two
 	InitialDisplayName *string `json:"initial_device_display_name"`
 	DeviceID           *string `json:"device_id"`
+
+	// RefreshToken is set if the client supports refresh tokens.
+	RefreshToken bool `json:"refresh_token"`
 }
 
 // Username returns the user localpart/user_id in this request, if it exists.
@@ -95,11 +106,12 @@ type UserInteractive struct {
 	Flows []userInteractiveFlow
 	// Map of login type to implementation
 	Types map[string]Type
-	// Map of session ID to completed login types, will need to be extended in future
-	Sessions map[string][]string
+	// Sessions stores the sessions and their completed stages, so that they
+	// survive restarts and can be shared between instances.
+	Sessions api.UIASessionAPI
 }
 
-func NewUserInteractive(userAccountAPI api.UserLoginAPI, cfg *config.ClientAPI) *UserInteractive {
+func NewUserInteractive(userAccountAPI api.UserLoginAPI, sessions api.UIASessionAPI, cfg *config.ClientAPI) *UserInteractive {
 	typePassword := &LoginTypePassword{
 		GetAccountByPassword: userAccountAPI.QueryAccountByPassword,
 		Config:               cfg,
@@ -113,7 +125,7 @@ func NewUserInteractive(userAccountAPI api.UserLoginAPI, cfg *config.ClientAPI)
 		Types: map[string]Type{
 			typePassword.Name(): typePassword,
 		},
-		Sessions: make(map[string][]string),
+		Sessions: sessions,
 	}
 }
 
@@ -128,11 +140,28 @@ func (u *UserInteractive) IsSingleStageFlow(authType string) bool {
 	return false
 }
 
-func (u *UserInteractive) AddCompletedStage(sessionID, authType string) {
-	u.Lock()
-	// TODO: Handle multi-stage flows
-	delete(u.Sessions, sessionID)
-	u.Unlock()
+// isFlowCompleted returns whether all of the stages of any flow have been completed.
+func (u *UserInteractive) isFlowCompleted(completed []string) bool {
+	u.RLock()
+	defer u.RUnlock()
+	for _, f := range u.Flows {
+		done := true
+		for _, stage := range f.Stages {
+			if !slices.Contains(completed, stage) {
+				done = false
+				break
+			}
+		}
+		if done {
+			return true
+		}
+	}
+	return false
+}
+
+// AddCompletedStage records that the session has completed the given auth type.
+func (u *UserInteractive) AddCompletedStage(ctx context.Context, sessionID, authType string) error {
+	return u.Sessions.PerformUIASessionStageCompletion(ctx, sessionID, authType)
 }
 
 type Challenge struct {
@@ -144,11 +173,13 @@ type Challenge struct {
 }
 
 // Challenge returns an HTTP 401 with the supported flows for authenticating
-func (u *UserInteractive) challenge(sessionID string) *util.JSONResponse {
+func (u *UserInteractive) challenge(sessionID string, completed []string) *util.JSONResponse {
 	u.RLock()
-	completed := u.Sessions[sessionID]
 	flows := u.Flows
 	u.RUnlock()
+	if completed == nil {
+		completed = []string{}
+	}
 
 	return &util.JSONResponse{
 		Code: 401,
@@ -161,8 +192,9 @@ func (u *UserInteractive) challenge(sessionID string) *util.JSONResponse {
 	}
 }
 
-// NewSession returns a challenge with a new session ID and remembers the session ID
-func (u *UserInteractive) NewSession() *util.JSONResponse {
+// NewSession returns a challenge with a new session ID and remembers the session ID,
+// along with the hash of the request that the session can be used to complete.
+func (u *UserInteractive) NewSession(ctx context.Context, requestHash string) *util.JSONResponse {
 	sessionID, err := GenerateAccessToken()
 	if err != nil {
 		logrus.WithError(err).Error("failed to generate session ID")
@@ -171,15 +203,22 @@ func (u *UserInteractive) NewSession() *util.JSONResponse {
 			JSON: spec.InternalServerError{},
 		}
 	}
-	u.Lock()
-	u.Sessions[sessionID] = []string{}
-	u.Unlock()
-	return u.challenge(sessionID)
+	if err = u.Sessions.PerformUIASessionCreation(ctx, &api.UIASession{
+		SessionID:   sessionID,
+		RequestHash: requestHash,
+	}); err != nil {
+		logrus.WithError(err).Error("failed to store session")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return u.challenge(sessionID, nil)
 }
 
 // ResponseWithChallenge mixes together a JSON body (e.g an error with errcode/message) with the
 // standard challenge response.
-func (u *UserInteractive) ResponseWithChallenge(sessionID string, response interface{}) *util.JSONResponse {
+func (u *UserInteractive) ResponseWithChallenge(sessionID string, completed []string, response interface{}) *util.JSONResponse {
 	mixedObjects := make(map[string]interface{})
 	b, err := json.Marshal(response)
 	if err != nil {
@@ -189,7 +228,7 @@ func (u *UserInteractive) ResponseWithChallenge(sessionID string, response inter
 		}
 	}
 	_ = json.Unmarshal(b, &mixedObjects)
-	challenge := u.challenge(sessionID)
+	challenge := u.challenge(sessionID, completed)
 	b, err = json.Marshal(challenge.JSON)
 	if err != nil {
 		return &util.JSONResponse{
@@ -205,17 +244,37 @@ func (u *UserInteractive) ResponseWithChallenge(sessionID string, response inter
 	}
 }
 
+// RequestHash identifies the request that a session is started for: the method, the
+// path and the body without the auth dict. A session can only be used to complete the
+// request that it was started for, so that a client can't start a session for one
+// request and then use it to authorise a different one.
+func RequestHash(req *http.Request, bodyBytes []byte) string {
+	body, err := sjson.DeleteBytes(bodyBytes, "auth")
+	if err != nil || len(bytes.TrimSpace(body)) == 0 {
+		body = []byte("{}")
+	}
+	if canonical, err := gomatrixserverlib.CanonicalJSON(body); err == nil {
+		body = canonical
+	}
+	h := sha256.New()
+	_, _ = h.Write([]byte(req.Method + " " + req.URL.Path + "\n"))
+	_, _ = h.Write(body)
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil))
+}
+
 // Verify returns an error/challenge response to send to the client, or nil if the user is authenticated.
 // `bodyBytes` is the HTTP request body which must contain an `auth` key.
 // Returns the login that was verified for additional checks if required.
-func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *api.Device) (*Login, *util.JSONResponse) {
+func (u *UserInteractive) Verify(req *http.Request, bodyBytes []byte, device *api.Device) (*Login, *util.JSONResponse) {
 	// TODO: rate limit
+	ctx := req.Context()
+	requestHash := RequestHash(req, bodyBytes)
 
 	// "A client should first make a request with no auth parameter. The homeserver returns an HTTP 401 response, with a JSON body"
 	// https://matrix.org/docs/spec/client_server/r0.6.1#user-interactive-api-in-the-rest-api
 	hasResponse := gjson.GetBytes(bodyBytes, "auth").Exists()
 	if !hasResponse {
-		return nil, u.NewSession()
+		return nil, u.NewSession(ctx, requestHash)
 	}
 
 	// extract the type so we know which login type to use
@@ -231,15 +290,34 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 			JSON: spec.BadJSON("Unknown auth.type: " + authType),
 		}
 	}
+	// Bare localparts belong to the server name of the authenticated user,
+	// which may be a virtual host rather than the main server name.
+	if typePassword, ok := loginType.(*LoginTypePassword); ok && device != nil {
+		if _, domain, err := gomatrixserverlib.SplitID('@', device.UserID); err == nil {
+			hostTypePassword := *typePassword
+			hostTypePassword.ServerName = domain
+			loginType = &hostTypePassword
+		}
+	}
 
 	// retrieve the session
 	sessionID := gjson.GetBytes(bodyBytes, "auth.session").Str
 
-	u.RLock()
-	_, ok = u.Sessions[sessionID]
-	u.RUnlock()
+	var session *api.UIASession
+	if sessionID != "" {
+		var err error
+		if session, err = u.Sessions.QueryUIASession(ctx, sessionID); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("failed to query session")
+			return nil, &util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	}
 
-	if !ok {
+	var completed []string
+	switch {
+	case session == nil:
 		// if the login type is part of a single stage flow then allow them to omit the session ID
 		if !u.IsSingleStageFlow(authType) {
 			return nil, &util.JSONResponse{
@@ -247,15 +325,54 @@ func (u *UserInteractive) Verify(ctx context.Context, bodyBytes []byte, device *
 				JSON: spec.Unknown("The auth.session is missing or unknown."),
 			}
 		}
+	case session.RequestHash != requestHash:
+		return nil, &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("The request has changed during the user-interactive auth session."),
+		}
+	default:
+		completed = session.CompletedStages()
 	}
 
 	login, cleanup, resErr := loginType.LoginFromJSON(ctx, []byte(gjson.GetBytes(bodyBytes, "auth").Raw))
 	if resErr != nil {
-		return nil, u.ResponseWithChallenge(sessionID, resErr.JSON)
+		return nil, u.ResponseWithChallenge(sessionID, completed, resErr.JSON)
 	}
 
-	u.AddCompletedStage(sessionID, authType)
+	if session != nil {
+		if err := u.AddCompletedStage(ctx, sessionID, authType); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("failed to record completed stage")
+			cleanup(ctx, &util.JSONResponse{Code: http.StatusInternalServerError})
+			return nil, &util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		if !slices.Contains(completed, authType) {
+			completed = append(completed, authType)
+		}
+		if !u.isFlowCompleted(completed) {
+			cleanup(ctx, nil)
+			return nil, u.challenge(sessionID, completed)
+		}
+		// The session has been used up, so it can't be replayed. If another
+		// request got to remove the session first, then that request is the
+		// one authorised by it.
+		if err := u.Sessions.PerformUIASessionDeletion(ctx, sessionID); errors.Is(err, sql.ErrNoRows) {
+			cleanup(ctx, &util.JSONResponse{Code: http.StatusUnauthorized})
+			return nil, &util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: spec.Forbidden("The user-interactive auth session has already been used."),
+			}
+		} else if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("failed to delete completed session")
+			cleanup(ctx, &util.JSONResponse{Code: http.StatusInternalServerError})
+			return nil, &util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	}
 	cleanup(ctx, nil)
-	// TODO: Check if there's more stages to go and return an error
 	return login, nil
 }
@@ -1,10 +1,16 @@
 package auth
 
 import (
+	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/util"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
@@ -45,7 +51,96 @@ func (d *fakeAccountDatabase) QueryAccountByPassword(ctx context.Context, req *a
 	return nil
 }
 
+// fakeSessionStore is shared between UserInteractive instances, like the
+// sessions stored by the user API are.
+type fakeSessionStore struct {
+	sync.Mutex
+	sessions map[string]*api.UIASession
+}
+
+func (s *fakeSessionStore) PerformUIASessionCreation(ctx context.Context, session *api.UIASession) error {
+	s.Lock()
+	defer s.Unlock()
+	session.CreatedAt = time.Now()
+	session.Expiration = session.CreatedAt.Add(api.DefaultUIASessionLifetime)
+	s.sessions[session.SessionID] = session
+	return nil
+}
+
+func (s *fakeSessionStore) PerformUIASessionStageCompletion(ctx context.Context, sessionID, stage string) error {
+	s.Lock()
+	defer s.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok {
+		return fmt.Errorf("unknown session")
+	}
+	for _, c := range session.Completed {
+		if c.Stage == stage {
+			return nil
+		}
+	}
+	session.Completed = append(session.Completed, api.UIACompletedStage{Stage: stage, CompletedAt: time.Now()})
+	return nil
+}
+
+func (s *fakeSessionStore) PerformUIASessionDataUpdate(ctx context.Context, sessionID string, data json.RawMessage) error {
+	s.Lock()
+	defer s.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok {
+		return fmt.Errorf("unknown session")
+	}
+	session.Data = data
+	return nil
+}
+
+func (s *fakeSessionStore) PerformUIASessionDeletion(ctx context.Context, sessionID string) error {
+	s.Lock()
+	defer s.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok || time.Now().After(session.Expiration) {
+		return sql.ErrNoRows
+	}
+	delete(s.sessions, sessionID)
+	return nil
+}
+
+func (s *fakeSessionStore) QueryUIASession(ctx context.Context, sessionID string) (*api.UIASession, error) {
+	s.Lock()
+	defer s.Unlock()
+	session, ok := s.sessions[sessionID]
+	if !ok || time.Now().After(session.Expiration) {
+		return nil, nil
+	}
+	copied := *session
+	copied.Completed = append([]api.UIACompletedStage{}, session.Completed...)
+	return &copied, nil
+}
+
+// racingSessionStore lets another request run just before a session is
+// deleted, as if it was handled concurrently by another instance.
+type racingSessionStore struct {
+	*fakeSessionStore
+	beforeDeletion func()
+}
+
+func (s *racingSessionStore) PerformUIASessionDeletion(ctx context.Context, sessionID string) error {
+	if f := s.beforeDeletion; f != nil {
+		s.beforeDeletion = nil
+		f()
+	}
+	return s.fakeSessionStore.PerformUIASessionDeletion(ctx, sessionID)
+}
+
+func newRequest(method, path string, body []byte) *http.Request {
+	return httptest.NewRequest(method, path, bytes.NewReader(body))
+}
+
 func setup() *UserInteractive {
+	return setupWithSessions(&fakeSessionStore{sessions: map[string]*api.UIASession{}})
+}
+
+func setupWithSessions(sessions api.UIASessionAPI) *UserInteractive {
 	cfg := &config.ClientAPI{
 		Matrix: &config.Global{
 			SigningIdentity: fclient.SigningIdentity{
@@ -53,13 +148,13 @@ func setup() *UserInteractive {
 			},
 		},
 	}
-	return NewUserInteractive(&fakeAccountDatabase{}, cfg)
+	return NewUserInteractive(&fakeAccountDatabase{}, sessions, cfg)
 }
 
 func TestUserInteractiveChallenge(t *testing.T) {
 	uia := setup()
 	// no auth key results in a challenge
-	_, errRes := uia.Verify(ctx, []byte(`{}`), device)
+	_, errRes := uia.Verify(newRequest("POST", "/delete_devices", []byte(`{}`)), []byte(`{}`), device)
 	if errRes == nil {
 		t.Fatalf("Verify succeeded with {} but expected failure")
 	}
@@ -99,7 +194,7 @@ func TestUserInteractivePasswordLogin(t *testing.T) {
 		}`),
 	}
 	for _, tc := range testCases {
-		_, errRes := uia.Verify(ctx, tc, device)
+		_, errRes := uia.Verify(newRequest("POST", "/delete_devices", tc), tc, device)
 		if errRes != nil {
 			t.Errorf("Verify failed but expected success for request: %s - got %+v", string(tc), errRes)
 		}
@@ -180,7 +275,7 @@ func TestUserInteractivePasswordBadLogin(t *testing.T) {
 		},
 	}
 	for _, tc := range testCases {
-		_, errRes := uia.Verify(ctx, tc.body, device)
+		_, errRes := uia.Verify(newRequest("POST", "/delete_devices", tc.body), tc.body, device)
 		if errRes == nil {
 			t.Errorf("Verify succeeded but expected failure for request: %s", string(tc.body))
 			continue
@@ -213,7 +308,7 @@ func TestUserInteractive_AddCompletedStage(t *testing.T) {
 	ctx := context.Background()
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, resp := u.Verify(ctx, []byte("{}"), nil)
+			_, resp := u.Verify(newRequest("POST", "/delete_devices", []byte("{}")), []byte("{}"), nil)
 			challenge, ok := resp.JSON.(Challenge)
 			if !ok {
 				t.Fatalf("expected a Challenge, got %T", resp.JSON)
@@ -221,7 +316,132 @@ func TestUserInteractive_AddCompletedStage(t *testing.T) {
 			if len(challenge.Completed) > 0 {
 				t.Fatalf("expected 0 completed stages, got %d", len(challenge.Completed))
 			}
-			u.AddCompletedStage(tt.sessionID, "")
+			if err := u.AddCompletedStage(ctx, challenge.Session, "m.login.password"); err != nil {
+				t.Fatalf("failed to add completed stage: %s", err)
+			}
+			session, err := u.Sessions.QueryUIASession(ctx, challenge.Session)
+			if err != nil || session == nil {
+				t.Fatalf("expected session to exist, got %v", err)
+			}
+			if stages := session.CompletedStages(); len(stages) != 1 || stages[0] != "m.login.password" {
+				t.Fatalf("expected the completed stage to be recorded, got %v", stages)
+			}
 		})
 	}
 }
+
+func TestUserInteractiveSessions(t *testing.T) {
+	lookup["carol herpassword"] = &api.Account{
+		Localpart:  "carol",
+		ServerName: serverName,
+		UserID:     fmt.Sprintf("@carol:%s", serverName),
+	}
+	// Two instances sharing the same sessions, e.g. behind a load balancer.
+	sessions := &fakeSessionStore{sessions: map[string]*api.UIASession{}}
+	first, second := setupWithSessions(sessions), setupWithSessions(sessions)
+	// Make the password a stage of a two stage flow, so that the session
+	// has to be known to complete it.
+	for _, u := range []*UserInteractive{first, second} {
+		u.Flows = []userInteractiveFlow{{Stages: []string{"m.login.password", "m.login.other"}}}
+	}
+
+	start := []byte(`{"devices":["A"]}`)
+	_, resp := first.Verify(newRequest("POST", "/delete_devices", start), start, device)
+	challenge, ok := resp.JSON.(Challenge)
+	if !ok {
+		t.Fatalf("expected a Challenge, got %T", resp.JSON)
+	}
+
+	withAuth := func(body string) []byte {
+		return []byte(fmt.Sprintf(`{%s"auth":{"type":"m.login.password","session":%q,"user":"carol","password":"herpassword"}}`, body, challenge.Session))
+	}
+
+	// The session can't be used for a different request.
+	swapped := withAuth(`"devices":["A","B"],`)
+	_, resp = second.Verify(newRequest("POST", "/delete_devices", swapped), swapped, device)
+	if resp == nil || resp.Code != http.StatusForbidden {
+		t.Fatalf("expected HTTP 403 for a different request body, got %+v", resp)
+	}
+	same := withAuth(`"devices":["A"],`)
+	_, resp = second.Verify(newRequest("POST", "/devices/other", same), same, device)
+	if resp == nil || resp.Code != http.StatusForbidden {
+		t.Fatalf("expected HTTP 403 for a different request path, got %+v", resp)
+	}
+
+	// The other instance knows about the session, and records the completed stage.
+	_, resp = second.Verify(newRequest("POST", "/delete_devices", same), same, device)
+	if resp == nil || resp.Code != http.StatusUnauthorized {
+		t.Fatalf("expected HTTP 401 as the flow isn't complete, got %+v", resp)
+	}
+	if challenge = resp.JSON.(Challenge); len(challenge.Completed) != 1 || challenge.Completed[0] != "m.login.password" {
+		t.Fatalf("expected the password stage to be completed, got %v", challenge.Completed)
+	}
+	session, _ := sessions.QueryUIASession(ctx, challenge.Session)
+	if session == nil || len(session.Completed) != 1 || session.Completed[0].CompletedAt.IsZero() {
+		t.Fatalf("expected the completed stage to be stored with a timestamp, got %+v", session)
+	}
+
+	// Unknown sessions are rejected for multi-stage flows.
+	unknown := []byte(`{"devices":["A"],"auth":{"type":"m.login.password","session":"unknown","user":"carol","password":"herpassword"}}`)
+	_, resp = first.Verify(newRequest("POST", "/delete_devices", unknown), unknown, device)
+	if resp == nil || resp.Code != http.StatusBadRequest {
+		t.Fatalf("expected HTTP 400 for an unknown session, got %+v", resp)
+	}
+}
+
+func TestUserInteractiveSessionDeletedOnCompletion(t *testing.T) {
+	lookup["dave hispassword"] = &api.Account{
+		Localpart:  "dave",
+		ServerName: serverName,
+		UserID:     fmt.Sprintf("@dave:%s", serverName),
+	}
+	sessions := &fakeSessionStore{sessions: map[string]*api.UIASession{}}
+	u := setupWithSessions(sessions)
+
+	start := []byte(`{"devices":["A"]}`)
+	_, resp := u.Verify(newRequest("POST", "/delete_devices", start), start, device)
+	challenge, ok := resp.JSON.(Challenge)
+	if !ok {
+		t.Fatalf("expected a Challenge, got %T", resp.JSON)
+	}
+
+	body := []byte(fmt.Sprintf(`{"devices":["A"],"auth":{"type":"m.login.password","session":%q,"user":"dave","password":"hispassword"}}`, challenge.Session))
+	if _, resp = u.Verify(newRequest("POST", "/delete_devices", body), body, device); resp != nil {
+		t.Fatalf("expected the flow to complete, got %+v", resp)
+	}
+	if session, _ := sessions.QueryUIASession(ctx, challenge.Session); session != nil {
+		t.Fatalf("expected the completed session to be deleted, got %+v", session)
+	}
+}
+
+func TestUserInteractiveSessionCompletedOnce(t *testing.T) {
+	lookup["erin herpassword"] = &api.Account{
+		Localpart:  "erin",
+		ServerName: serverName,
+		UserID:     fmt.Sprintf("@erin:%s", serverName),
+	}
+	sessions := &racingSessionStore{fakeSessionStore: &fakeSessionStore{sessions: map[string]*api.UIASession{}}}
+	u := setupWithSessions(sessions)
+
+	start := []byte(`{"devices":["A"]}`)
+	_, resp := u.Verify(newRequest("POST", "/delete_devices", start), start, device)
+	challenge, ok := resp.JSON.(Challenge)
+	if !ok {
+		t.Fatalf("expected a Challenge, got %T", resp.JSON)
+	}
+
+	// Both requests complete the flow, but the second one removes the
+	// session first, so only that one is authorised.
+	body := []byte(fmt.Sprintf(`{"devices":["A"],"auth":{"type":"m.login.password","session":%q,"user":"erin","password":"herpassword"}}`, challenge.Session))
+	var concurrentResp *util.JSONResponse
+	sessions.beforeDeletion = func() {
+		_, concurrentResp = u.Verify(newRequest("POST", "/delete_devices", body), body, device)
+	}
+	_, resp = u.Verify(newRequest("POST", "/delete_devices", body), body, device)
+	if concurrentResp != nil {
+		t.Fatalf("expected the concurrent request to be authorised, got %+v", concurrentResp)
+	}
+	if resp == nil || resp.Code != http.StatusUnauthorized {
+		t.Fatalf("expected HTTP 401 as the session was already used, got %+v", resp)
+	}
+}
@@ -2,6 +2,7 @@ package routing
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -23,8 +24,10 @@ import (
 	clientapi "github.com/neilalexander/harmony/clientapi/api"
 	"github.com/neilalexander/harmony/internal/httputil"
 	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/types"
 	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/setup/jetstream"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
 	"github.com/neilalexander/harmony/userapi/api"
 	userapi "github.com/neilalexander/harmony/userapi/api"
 )
@@ -495,3 +498,925 @@ func AdminDownloadState(req *http.Request, device *api.Device, rsAPI roomserverA
 		JSON: struct{}{},
 	}
 }
+
+// AdminListReports implements GET /_dendrite/admin/reports
+func AdminListReports(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	query := req.URL.Query()
+	listReq := &roomserverAPI.QueryAdminReportsRequest{
+		Limit:     100,
+		Backwards: query.Get("dir") != "f",
+		RoomID:    query.Get("room_id"),
+		UserID:    query.Get("user_id"),
+	}
+	var err error
+	if from := query.Get("from"); from != "" {
+		if listReq.From, err = strconv.ParseInt(from, 10, 64); err != nil || listReq.From < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("from must be a non-negative integer"),
+			}
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if listReq.Limit, err = strconv.ParseInt(limit, 10, 64); err != nil || listReq.Limit < 1 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("limit must be a positive integer"),
+			}
+		}
+	}
+	if resolved := query.Get("resolved"); resolved != "" {
+		value, err := strconv.ParseBool(resolved)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("invalid 'resolved' query parameter"),
+			}
+		}
+		listReq.Resolved = &value
+	}
+
+	reports, total, err := rsAPI.QueryAdminReports(req.Context(), listReq)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryAdminReports failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if reports == nil {
+		reports = []roomserverAPI.Report{}
+	}
+	res := map[string]interface{}{
+		"reports": reports,
+		"total":   total,
+	}
+	if next := listReq.From + int64(len(reports)); next < total {
+		res["next_token"] = next
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminGetReport implements GET /_dendrite/admin/reports/{reportID}
+func AdminGetReport(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	reportID, resErr := reportIDFromRequest(req)
+	if resErr != nil {
+		return *resErr
+	}
+	report, err := rsAPI.QueryAdminReport(req.Context(), reportID)
+	return reportResponse(req.Context(), report, err)
+}
+
+// AdminResolveReport implements POST /_dendrite/admin/reports/{reportID}/resolve
+func AdminResolveReport(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	reportID, resErr := reportIDFromRequest(req)
+	if resErr != nil {
+		return *resErr
+	}
+	report, err := rsAPI.PerformAdminResolveReport(req.Context(), reportID, device.UserID)
+	if err == nil && report != nil {
+		logrus.WithFields(logrus.Fields{
+			"report_id": reportID,
+			"user_id":   device.UserID,
+		}).Info("Report resolved")
+	}
+	return reportResponse(req.Context(), report, err)
+}
+
+func reportIDFromRequest(req *http.Request) (int64, *util.JSONResponse) {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		res := util.ErrorResponse(err)
+		return 0, &res
+	}
+	reportID, err := strconv.ParseInt(vars["reportID"], 10, 64)
+	if err != nil {
+		return 0, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("invalid report ID"),
+		}
+	}
+	return reportID, nil
+}
+
+func reportResponse(ctx context.Context, report *roomserverAPI.Report, err error) util.JSONResponse {
+	switch {
+	case err != nil:
+		util.GetLogger(ctx).WithError(err).Error("failed to query report")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	case report == nil:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("report not found"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: report,
+	}
+}
+
+type adminUser struct {
+	UserID       string `json:"user_id"`
+	DisplayName  string `json:"display_name,omitempty"`
+	AvatarURL    string `json:"avatar_url,omitempty"`
+	CreatedTS    int64  `json:"created_ts"`
+	Admin        bool   `json:"admin"`
+	Guest        bool   `json:"guest"`
+	AppServiceID string `json:"appservice_id,omitempty"`
+	Deactivated  bool   `json:"deactivated"`
+	Locked       bool   `json:"locked"`
+	ShadowBanned bool   `json:"shadow_banned"`
+}
+
+type adminUserDevice struct {
+	DeviceID    string `json:"device_id"`
+	DisplayName string `json:"display_name,omitempty"`
+	LastSeenIP  string `json:"last_seen_ip,omitempty"`
+	LastSeenTS  int64  `json:"last_seen_ts,omitempty"`
+	UserAgent   string `json:"user_agent,omitempty"`
+}
+
+type adminUserDetails struct {
+	adminUser
+	LastSeenIP string            `json:"last_seen_ip,omitempty"`
+	LastSeenTS int64             `json:"last_seen_ts,omitempty"`
+	Devices    []adminUserDevice `json:"devices"`
+	Rooms      []string          `json:"rooms"`
+}
+
+func newAdminUser(acc *userapi.Account, displayName, avatarURL string) adminUser {
+	return adminUser{
+		UserID:       acc.UserID,
+		DisplayName:  displayName,
+		AvatarURL:    avatarURL,
+		CreatedTS:    acc.CreatedTS,
+		Admin:        acc.AccountType == userapi.AccountTypeAdmin,
+		Guest:        acc.AccountType == userapi.AccountTypeGuest,
+		AppServiceID: acc.AppServiceID,
+		Deactivated:  acc.Deactivated,
+		Locked:       acc.Locked,
+		ShadowBanned: acc.ShadowBanned,
+	}
+}
+
+// AdminListUsers implements GET /_dendrite/admin/users
+func AdminListUsers(req *http.Request, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	query := req.URL.Query()
+	listReq := &userapi.QueryAdminAccountsRequest{
+		Search: query.Get("search"),
+		Limit:  100,
+	}
+	var err error
+	if from := query.Get("from"); from != "" {
+		if listReq.From, err = strconv.ParseInt(from, 10, 64); err != nil || listReq.From < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("from must be a non-negative integer"),
+			}
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if listReq.Limit, err = strconv.ParseInt(limit, 10, 64); err != nil || listReq.Limit < 1 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("limit must be a positive integer"),
+			}
+		}
+	}
+	if deactivated := query.Get("deactivated"); deactivated != "" {
+		if listReq.IncludeDeactivated, err = strconv.ParseBool(deactivated); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("invalid 'deactivated' query parameter"),
+			}
+		}
+	}
+
+	var listRes userapi.QueryAdminAccountsResponse
+	if err = userAPI.QueryAdminAccounts(req.Context(), listReq, &listRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAdminAccounts failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	users := make([]adminUser, 0, len(listRes.Accounts))
+	for i := range listRes.Accounts {
+		acc := &listRes.Accounts[i]
+		users = append(users, newAdminUser(&acc.Account, acc.DisplayName, acc.AvatarURL))
+	}
+	res := map[string]interface{}{
+		"users": users,
+		"total": listRes.Total,
+	}
+	if next := listReq.From + int64(len(users)); next < listRes.Total {
+		res["next_token"] = next
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminGetUser implements GET /_dendrite/admin/users/{userID}
+func AdminGetUser(req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	acc, resErr := adminLookupAccount(req, cfg, userAPI)
+	if resErr != nil {
+		return *resErr
+	}
+	profile, err := userAPI.QueryProfile(req.Context(), acc.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryProfile failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	var devicesRes userapi.QueryDevicesResponse
+	if err = userAPI.QueryDevices(req.Context(), &userapi.QueryDevicesRequest{UserID: acc.UserID}, &devicesRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryDevices failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	userID, err := spec.NewUserID(acc.UserID, true)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	rooms, err := rsAPI.QueryRoomsForUser(req.Context(), *userID, spec.Join)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRoomsForUser failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	details := adminUserDetails{
+		adminUser: newAdminUser(acc, profile.DisplayName, profile.AvatarURL),
+		Devices:   make([]adminUserDevice, 0, len(devicesRes.Devices)),
+		Rooms:     make([]string, 0, len(rooms)),
+	}
+	for _, dev := range devicesRes.Devices {
+		details.Devices = append(details.Devices, adminUserDevice{
+			DeviceID:    dev.ID,
+			DisplayName: dev.DisplayName,
+			LastSeenIP:  dev.LastSeenIP,
+			LastSeenTS:  dev.LastSeenTS,
+			UserAgent:   dev.UserAgent,
+		})
+		if dev.LastSeenTS > details.LastSeenTS {
+			details.LastSeenTS = dev.LastSeenTS
+			details.LastSeenIP = dev.LastSeenIP
+		}
+	}
+	for _, roomID := range rooms {
+		details.Rooms = append(details.Rooms, roomID.String())
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: details,
+	}
+}
+
+// AdminUpdateUser implements PUT /_dendrite/admin/users/{userID}, which
+// changes whether the user is an admin, is locked or is shadow-banned.
+func AdminUpdateUser(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	acc, resErr := adminLookupAccount(req, cfg, userAPI)
+	if resErr != nil {
+		return *resErr
+	}
+	var request struct {
+		Admin        *bool `json:"admin"`
+		Locked       *bool `json:"locked"`
+		ShadowBanned *bool `json:"shadow_banned"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown("Failed to decode request body: " + err.Error()),
+		}
+	}
+	// Admins can't lock themselves out of the admin API.
+	if acc.UserID == device.UserID && ((request.Admin != nil && !*request.Admin) || (request.Locked != nil && *request.Locked)) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("You cannot remove admin from or lock your own account"),
+		}
+	}
+	if request.Admin != nil && acc.AccountType != userapi.AccountTypeUser && acc.AccountType != userapi.AccountTypeAdmin {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Only user accounts can be made admins"),
+		}
+	}
+
+	if err := userAPI.PerformAdminUpdateAccount(req.Context(), &userapi.PerformAdminUpdateAccountRequest{
+		Localpart:    acc.Localpart,
+		ServerName:   acc.ServerName,
+		Admin:        request.Admin,
+		Locked:       request.Locked,
+		ShadowBanned: request.ShadowBanned,
+	}, &struct{}{}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformAdminUpdateAccount failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"user_id":       acc.UserID,
+		"admin":         request.Admin,
+		"locked":        request.Locked,
+		"shadow_banned": request.ShadowBanned,
+		"updated_by":    device.UserID,
+	}).Info("Updated user account")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminDeactivateUser implements POST /_dendrite/admin/deactivateUser/{userID}.
+// The user leaves all of their rooms and is logged out of all devices. Erasing
+// the user also removes their display name and avatar.
+func AdminDeactivateUser(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	acc, resErr := adminLookupAccount(req, cfg, userAPI)
+	if resErr != nil {
+		return *resErr
+	}
+	if acc.UserID == device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("You cannot deactivate your own account"),
+		}
+	}
+	var request struct {
+		Erase bool `json:"erase"`
+	}
+	if req.ContentLength != 0 {
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.Unknown("Failed to decode request body: " + err.Error()),
+			}
+		}
+	}
+
+	var deactivateRes userapi.PerformAccountDeactivationResponse
+	if err := userAPI.PerformAccountDeactivation(req.Context(), &userapi.PerformAccountDeactivationRequest{
+		Localpart:  acc.Localpart,
+		ServerName: acc.ServerName,
+		Erase:      request.Erase,
+	}, &deactivateRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformAccountDeactivation failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	logrus.WithFields(logrus.Fields{
+		"user_id":        acc.UserID,
+		"erase":          request.Erase,
+		"deactivated_by": device.UserID,
+	}).Info("Deactivated user account")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			Deactivated bool `json:"deactivated"`
+		}{
+			Deactivated: deactivateRes.AccountDeactivated,
+		},
+	}
+}
+
+// adminLookupAccount returns the local account of the user ID in the path.
+func adminLookupAccount(req *http.Request, cfg *config.ClientAPI, userAPI userapi.ClientUserAPI) (*userapi.Account, *util.JSONResponse) {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		res := util.ErrorResponse(err)
+		return nil, &res
+	}
+	localpart, serverName, err := cfg.Matrix.SplitLocalID('@', vars["userID"])
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	var accRes userapi.QueryAccountByLocalpartResponse
+	err = userAPI.QueryAccountByLocalpart(req.Context(), &userapi.QueryAccountByLocalpartRequest{
+		Localpart:  localpart,
+		ServerName: serverName,
+	}, &accRes)
+	if err == sql.ErrNoRows || (err == nil && accRes.Account == nil) {
+		return nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("User does not exist"),
+		}
+	}
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryAccountByLocalpart failed")
+		return nil, &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return accRes.Account, nil
+}
+
+// AdminListRooms implements GET /_dendrite/admin/rooms
+func AdminListRooms(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	query := req.URL.Query()
+	listReq := &roomserverAPI.QueryAdminRoomsRequest{
+		Limit: 100,
+	}
+	var err error
+	if from := query.Get("from"); from != "" {
+		if listReq.From, err = strconv.ParseInt(from, 10, 64); err != nil || listReq.From < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("from must be a non-negative integer"),
+			}
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if listReq.Limit, err = strconv.ParseInt(limit, 10, 64); err != nil || listReq.Limit < 1 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("limit must be a positive integer"),
+			}
+		}
+	}
+	switch query.Get("order_by") {
+	case "":
+	case "forward_extremities":
+		listReq.OrderByForwardExtremities = true
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("invalid 'order_by' query parameter"),
+		}
+	}
+
+	rooms, total, err := rsAPI.QueryAdminRooms(req.Context(), listReq)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryAdminRooms failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if rooms == nil {
+		rooms = []roomserverAPI.AdminRoom{}
+	}
+	res := map[string]interface{}{
+		"rooms": rooms,
+		"total": total,
+	}
+	if next := listReq.From + int64(len(rooms)); next < total {
+		res["next_token"] = next
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminGetRoom implements GET /_dendrite/admin/rooms/{roomID}
+func AdminGetRoom(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	room, err := rsAPI.QueryAdminRoom(req.Context(), vars["roomID"])
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryAdminRoom failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if room == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Room not found"),
+		}
+	}
+	members, err := rsAPI.QueryAdminRoomMembers(req.Context(), room.RoomID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryAdminRoomMembers failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			*roomserverAPI.AdminRoom
+			LocalMembers []string `json:"local_members"`
+		}{
+			AdminRoom:    room,
+			LocalMembers: members,
+		},
+	}
+}
+
+// AdminGetRoomState implements GET /_dendrite/admin/rooms/{roomID}/state
+func AdminGetRoomState(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	stateEvents, err := rsAPI.QueryAdminRoomState(req.Context(), vars["roomID"])
+	switch err.(type) {
+	case nil:
+	case eventutil.ErrRoomNoExists:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(err.Error()),
+		}
+	default:
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryAdminRoomState failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	state := make([]synctypes.ClientEvent, 0, len(stateEvents))
+	for _, ev := range stateEvents {
+		clientEvent, err := synctypes.ToClientEvent(ev, synctypes.FormatAll, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+			return rsAPI.QueryUserIDForSender(req.Context(), roomID, senderID)
+		})
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed converting to ClientEvent")
+			continue
+		}
+		state = append(state, *clientEvent)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"state": state,
+		},
+	}
+}
+
+// AdminForwardExtremities implements GET and DELETE /_dendrite/admin/rooms/{roomID}/forwardExtremities.
+// Deleting resets the forward extremities of the room down to the most recent one.
+func AdminForwardExtremities(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	roomID := vars["roomID"]
+
+	var res interface{}
+	switch req.Method {
+	case http.MethodDelete:
+		var removed int
+		removed, err = rsAPI.PerformAdminResetForwardExtremities(req.Context(), roomID)
+		if err == nil {
+			logrus.WithFields(logrus.Fields{
+				"room_id":  roomID,
+				"removed":  removed,
+				"reset_by": device.UserID,
+			}).Info("Reset forward extremities")
+		}
+		res = map[string]interface{}{
+			"removed": removed,
+		}
+	default:
+		var extremities []roomserverAPI.ForwardExtremity
+		extremities, err = rsAPI.QueryAdminForwardExtremities(req.Context(), roomID)
+		res = map[string]interface{}{
+			"count":               len(extremities),
+			"forward_extremities": extremities,
+		}
+	}
+	switch err.(type) {
+	case nil:
+	case eventutil.ErrRoomNoExists:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(err.Error()),
+		}
+	default:
+		util.GetLogger(req.Context()).WithError(err).WithField("room_id", roomID).Error("Failed to handle forward extremities")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminBlockRoom implements GET and PUT /_dendrite/admin/rooms/{roomID}/block
+func AdminBlockRoom(req *http.Request, device *userapi.Device, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	roomID := vars["roomID"]
+
+	if req.Method == http.MethodPut {
+		request := struct {
+			Block bool `json:"block"`
+		}{}
+		if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.Unknown("Failed to decode request body: " + err.Error()),
+			}
+		}
+		switch e := rsAPI.PerformAdminBlockRoom(req.Context(), roomID, device.UserID, request.Block).(type) {
+		case nil:
+		case roomserverAPI.ErrInvalidID:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam(e.Error()),
+			}
+		default:
+			util.GetLogger(req.Context()).WithError(e).Error("rsAPI.PerformAdminBlockRoom failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	}
+
+	blocked, err := rsAPI.QueryAdminBlockedRoom(req.Context(), roomID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryAdminBlockedRoom failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	res := map[string]interface{}{
+		"block": blocked != nil,
+	}
+	if blocked != nil {
+		res["blocked_by"] = blocked.BlockedBy
+		res["blocked_ts"] = blocked.BlockedTS
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminListBlockedRooms implements GET /_dendrite/admin/blockedRooms
+func AdminListBlockedRooms(req *http.Request, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	rooms, err := rsAPI.QueryAdminBlockedRooms(req.Context())
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryAdminBlockedRooms failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if rooms == nil {
+		rooms = []roomserverAPI.BlockedRoom{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"rooms": rooms,
+		},
+	}
+}
+
+const (
+	defaultShutdownRoomName    = "Content Violation Notification"
+	defaultShutdownRoomMessage = "Sharing illegal content on this server is not permitted and rooms in violation will be blocked."
+)
+
+// AdminShutdownRoom implements POST /_dendrite/admin/shutdownRoom/{roomID}.
+// The local users in the room are moved into a new room, in which they are
+// told why, and the room is blocked, removed from the room directory and has
+// its local aliases removed. The new room is created by new_room_user_id,
+// or by the admin if that isn't given.
+func AdminShutdownRoom(req *http.Request, cfg *config.ClientAPI, device *userapi.Device, userAPI userapi.ClientUserAPI, rsAPI roomserverAPI.ClientRoomserverAPI) util.JSONResponse {
+	ctx := req.Context()
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	roomID := vars["roomID"]
+
+	request := struct {
+		NewRoomUserID string `json:"new_room_user_id"`
+		RoomName      string `json:"room_name"`
+		Message       string `json:"message"`
+		Block         *bool  `json:"block"`
+	}{}
+	if req.ContentLength != 0 {
+		if err = json.NewDecoder(req.Body).Decode(&request); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.Unknown("Failed to decode request body: " + err.Error()),
+			}
+		}
+	}
+	if request.RoomName == "" {
+		request.RoomName = defaultShutdownRoomName
+	}
+	if request.Message == "" {
+		request.Message = defaultShutdownRoomMessage
+	}
+
+	senderDevice := device
+	if request.NewRoomUserID != "" && request.NewRoomUserID != device.UserID {
+		localpart, serverName, err := cfg.Matrix.SplitLocalID('@', request.NewRoomUserID)
+		if err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam(err.Error()),
+			}
+		}
+		var accRes userapi.QueryAccountByLocalpartResponse
+		err = userAPI.QueryAccountByLocalpart(ctx, &userapi.QueryAccountByLocalpartRequest{
+			Localpart:  localpart,
+			ServerName: serverName,
+		}, &accRes)
+		if err != nil || accRes.Account == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("new_room_user_id must be an existing local user"),
+			}
+		}
+		senderDevice = &userapi.Device{
+			UserID:      accRes.Account.UserID,
+			AccountType: accRes.Account.AccountType,
+		}
+	}
+
+	members, err := rsAPI.QueryAdminRoomMembers(ctx, roomID)
+	switch err.(type) {
+	case nil:
+	case eventutil.ErrRoomNoExists:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(err.Error()),
+		}
+	default:
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryAdminRoomMembers failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	// Block the room first so that nobody can rejoin it while they are being moved.
+	if request.Block == nil || *request.Block {
+		if err = rsAPI.PerformAdminBlockRoom(ctx, roomID, device.UserID, true); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rsAPI.PerformAdminBlockRoom failed")
+			return util.ErrorResponse(err)
+		}
+	}
+
+	newRoomID, resErr := createShutdownRoom(ctx, request.RoomName, request.Message, members, senderDevice, cfg, userAPI, rsAPI)
+	if resErr != nil {
+		return *resErr
+	}
+
+	kicked := make([]string, 0, len(members))
+	failed := make([]string, 0)
+	for _, member := range members {
+		userID, err := spec.NewUserID(member, true)
+		if err != nil {
+			failed = append(failed, member)
+			continue
+		}
+		if err = rsAPI.PerformLeave(ctx, &roomserverAPI.PerformLeaveRequest{
+			RoomID: roomID,
+			Leaver: *userID,
+		}, &roomserverAPI.PerformLeaveResponse{}); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("user_id", member).Error("Failed to remove user from room")
+			failed = append(failed, member)
+			continue
+		}
+		kicked = append(kicked, member)
+		if member == senderDevice.UserID {
+			continue
+		}
+		if _, _, err = rsAPI.PerformJoin(ctx, &roomserverAPI.PerformJoinRequest{
+			RoomIDOrAlias: newRoomID,
+			UserID:        member,
+			Content:       map[string]interface{}{},
+		}); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("user_id", member).Error("Failed to join user to the new room")
+		}
+	}
+
+	aliases, err := rsAPI.PerformAdminRemoveRoomAliases(ctx, roomID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.PerformAdminRemoveRoomAliases failed")
+		return util.ErrorResponse(err)
+	}
+	if err = rsAPI.PerformPublish(ctx, &roomserverAPI.PerformPublishRequest{
+		RoomID:     roomID,
+		Visibility: "private",
+	}); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.PerformPublish failed")
+		return util.ErrorResponse(err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"room_id":     roomID,
+		"new_room_id": newRoomID,
+		"kicked":      len(kicked),
+		"failed":      len(failed),
+		"shutdown_by": device.UserID,
+	}).Warn("Shut down room")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"kicked_users":         kicked,
+			"failed_to_kick_users": failed,
+			"local_aliases":        aliases,
+			"new_room_id":          newRoomID,
+		},
+	}
+}
+
+// createShutdownRoom creates the room which users of a shut down room are
+// moved into, inviting them and sending the message. Only the creator of the
+// room can send messages in it.
+func createShutdownRoom(
+	ctx context.Context, name, message string, members []string, senderDevice *userapi.Device,
+	cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, rsAPI roomserverAPI.ClientRoomserverAPI,
+) (string, *util.JSONResponse) {
+	powerLevelContent := eventutil.InitialPowerLevelsContent(senderDevice.UserID)
+	powerLevelContent.UsersDefault = -10
+	pl, err := json.Marshal(powerLevelContent)
+	if err != nil {
+		res := util.ErrorResponse(err)
+		return "", &res
+	}
+	cc, err := json.Marshal(map[string]interface{}{
+		"m.federate": false,
+	})
+	if err != nil {
+		res := util.ErrorResponse(err)
+		return "", &res
+	}
+	invite := make([]string, 0, len(members))
+	for _, member := range members {
+		if member != senderDevice.UserID {
+			invite = append(invite, member)
+		}
+	}
+
+	roomRes := createRoom(ctx, createRoomRequest{
+		Invite:                    invite,
+		Name:                      name,
+		Visibility:                "private",
+		Preset:                    spec.PresetPrivateChat,
+		CreationContent:           cc,
+		RoomVersion:               rsAPI.DefaultRoomVersion(),
+		PowerLevelContentOverride: pl,
+	}, senderDevice, cfg, userAPI, rsAPI, time.Now())
+	data, ok := roomRes.JSON.(createRoomResponse)
+	if !ok {
+		return "", &roomRes
+	}
+
+	e, resErr := generateSendEvent(ctx, map[string]interface{}{
+		"msgtype": "m.text",
+		"body":    message,
+	}, senderDevice, data.RoomID, "m.room.message", nil, rsAPI, time.Now())
+	if resErr != nil {
+		return "", resErr
+	}
+	if err = roomserverAPI.SendEvents(
+		ctx, rsAPI,
+		roomserverAPI.KindNew,
+		[]*types.HeaderedEvent{{PDU: e}},
+		senderDevice.UserDomain(),
+		cfg.Matrix.ServerName,
+		cfg.Matrix.ServerName,
+		nil,
+		false,
+	); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("SendEvents failed")
+		return "", &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	return data.RoomID, nil
+}
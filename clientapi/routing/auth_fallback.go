@@ -15,6 +15,8 @@
 package routing
 
 import (
+	"database/sql"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -22,6 +24,7 @@ import (
 	"github.com/matrix-org/util"
 	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
 	"github.com/neilalexander/harmony/setup/config"
+	userapi "github.com/neilalexander/harmony/userapi/api"
 )
 
 // recaptchaTemplate is an HTML webpage template for recaptcha auth
@@ -100,7 +103,7 @@ func serveTemplate(w http.ResponseWriter, templateHTML string, data map[string]s
 // AuthFallback implements GET and POST /auth/{authType}/fallback/web?session={sessionID}
 func AuthFallback(
 	w http.ResponseWriter, req *http.Request, authType string,
-	cfg *config.ClientAPI,
+	cfg *config.ClientAPI, userAPI userapi.ClientUserAPI,
 ) {
 	// We currently only support "m.login.recaptcha", so fail early if that's not requested
 	if authType == authtypes.LoginTypeRecaptcha {
@@ -176,7 +179,16 @@ func AuthFallback(
 		}
 
 		// Success. Add recaptcha as a completed login flow
-		sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypeRecaptcha)
+		err = userAPI.PerformUIASessionStageCompletion(req.Context(), sessionID, authtypes.LoginTypeRecaptcha)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			writeHTTPMessage(w, req, "Unknown session", http.StatusBadRequest)
+			return
+		case err != nil:
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformUIASessionStageCompletion failed")
+			writeHTTPMessage(w, req, "Internal server error", http.StatusInternalServerError)
+			return
+		}
 
 		serveSuccess()
 		return
@@ -202,6 +202,12 @@ func createRoom(
 	keyID := cfg.Matrix.KeyID
 	privateKey := cfg.Matrix.PrivateKey
 
+	// Rooms created by shadow-banned users are created as normal, but nobody
+	// is invited to them.
+	if device.ShadowBanned {
+		createRequest.Invite = nil
+	}
+
 	req := roomserverAPI.PerformCreateRoomRequest{
 		InvitedUsers:              createRequest.Invite,
 		RoomName:                  createRequest.Name,
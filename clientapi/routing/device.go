@@ -26,7 +26,6 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/userapi/api"
-	"github.com/tidwall/gjson"
 )
 
 // https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-devices
@@ -168,15 +167,6 @@ func DeleteDeviceById(
 	req *http.Request, userInteractiveAuth *auth.UserInteractive, userAPI api.ClientUserAPI, device *api.Device,
 	deviceID string,
 ) util.JSONResponse {
-	var (
-		deleteOK  bool
-		sessionID string
-	)
-	defer func() {
-		if deleteOK {
-			sessions.deleteSession(sessionID)
-		}
-	}()
 	ctx := req.Context()
 	defer req.Body.Close() // nolint:errcheck
 	bodyBytes, err := io.ReadAll(req.Body)
@@ -187,28 +177,10 @@ func DeleteDeviceById(
 		}
 	}
 
-	// check that we know this session, and it matches with the device to delete
-	s := gjson.GetBytes(bodyBytes, "auth.session").Str
-	if dev, ok := sessions.getDeviceToDelete(s); ok {
-		if dev != deviceID {
-			return util.JSONResponse{
-				Code: http.StatusForbidden,
-				JSON: spec.Forbidden("session and device mismatch"),
-			}
-		}
-	}
-
-	if s != "" {
-		sessionID = s
-	}
-
-	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	// The session is tied to the path of the request, so a session that was
+	// started to delete one device can't be used to delete another.
+	login, errRes := userInteractiveAuth.Verify(req, bodyBytes, device)
 	if errRes != nil {
-		switch data := errRes.JSON.(type) {
-		case auth.Challenge:
-			sessions.addDeviceToDelete(data.Session, deviceID)
-		default:
-		}
 		return *errRes
 	}
 
@@ -242,8 +214,6 @@ func DeleteDeviceById(
 		}
 	}
 
-	deleteOK = true
-
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: struct{}{},
@@ -266,7 +236,7 @@ func DeleteDevices(
 	defer req.Body.Close() // nolint:errcheck
 
 	// initiate UIA
-	login, errRes := userInteractiveAuth.Verify(ctx, bodyBytes, device)
+	login, errRes := userInteractiveAuth.Verify(req, bodyBytes, device)
 	if errRes != nil {
 		return *errRes
 	}
@@ -74,7 +74,7 @@ func GetPostPublicRooms(
 	serverName := spec.ServerName(request.Server)
 	if serverName != "" && !cfg.Matrix.IsLocalServerName(serverName) {
 		res, err := federation.GetPublicRoomsFiltered(
-			req.Context(), cfg.Matrix.ServerName, serverName,
+			req.Context(), cfg.Matrix.ServerNameForHTTPHost(spec.ServerName(req.Host)), serverName,
 			int(request.Limit), request.Since,
 			request.Filter.SearchTerms, false,
 			"",
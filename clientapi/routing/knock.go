@@ -0,0 +1,143 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/util"
+	"github.com/neilalexander/harmony/clientapi/httputil"
+	"github.com/neilalexander/harmony/internal/eventutil"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/userapi/api"
+)
+
+func KnockRoomByIDOrAlias(
+	req *http.Request,
+	device *api.Device,
+	rsAPI roomserverAPI.ClientRoomserverAPI,
+	roomIDOrAlias string,
+) util.JSONResponse {
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+
+	// Knocks from shadow-banned users look successful but are never sent.
+	if device.ShadowBanned {
+		return shadowBannedKnock(req, rsAPI, roomIDOrAlias)
+	}
+
+	knockReq := roomserverAPI.PerformKnockRequest{
+		RoomIDOrAlias: roomIDOrAlias,
+		UserID:        device.UserID,
+		Reason:        body.Reason,
+	}
+
+	// Check to see if any ?server_name= or ?via= query parameters were
+	// given in the request.
+	query := req.URL.Query()
+	for _, serverName := range append(query["server_name"], query["via"]...) {
+		knockReq.ServerNames = append(
+			knockReq.ServerNames,
+			spec.ServerName(serverName),
+		)
+	}
+
+	// Ask the roomserver to perform the knock.
+	roomID, err := rsAPI.PerformKnock(req.Context(), &knockReq)
+	switch e := err.(type) {
+	case nil: // success case
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				RoomID string `json:"room_id"`
+			}{roomID},
+		}
+	case roomserverAPI.ErrInvalidID:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown(e.Error()),
+		}
+	case roomserverAPI.ErrNotAllowed:
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden(e.Error()),
+		}
+	case *gomatrix.HTTPError: // this ensures we proxy responses over federation to the client
+		return util.JSONResponse{
+			Code: e.Code,
+			JSON: json.RawMessage(e.Message),
+		}
+	case eventutil.ErrRoomNoExists:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(e.Error()),
+		}
+	default:
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformKnock failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+}
+
+// shadowBannedKnock pretends that a shadow-banned user knocked on a room.
+// Aliases are only resolved locally, as nothing should go over federation.
+func shadowBannedKnock(
+	req *http.Request,
+	rsAPI roomserverAPI.ClientRoomserverAPI,
+	roomIDOrAlias string,
+) util.JSONResponse {
+	roomID := roomIDOrAlias
+	if strings.HasPrefix(roomIDOrAlias, "#") {
+		aliasReq := roomserverAPI.GetRoomIDForAliasRequest{Alias: roomIDOrAlias}
+		aliasRes := roomserverAPI.GetRoomIDForAliasResponse{}
+		if err := rsAPI.GetRoomIDForAlias(req.Context(), &aliasReq, &aliasRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("rsAPI.GetRoomIDForAlias failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		if aliasRes.RoomID == "" {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound("Room alias not found"),
+			}
+		}
+		roomID = aliasRes.RoomID
+	} else if _, err := spec.NewRoomID(roomIDOrAlias); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.Unknown(err.Error()),
+		}
+	}
+
+	util.GetLogger(req.Context()).WithField("room_id", roomID).Info("Dropping knock from shadow-banned user")
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			RoomID string `json:"room_id"`
+		}{roomID},
+	}
+}
@@ -17,6 +17,7 @@ package routing
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/matrix-org/util"
 	"github.com/neilalexander/harmony/clientapi/auth"
@@ -28,9 +29,11 @@ import (
 )
 
 type loginResponse struct {
-	UserID      string `json:"user_id"`
-	AccessToken string `json:"access_token"`
-	DeviceID    string `json:"device_id"`
+	UserID       string `json:"user_id"`
+	AccessToken  string `json:"access_token"`
+	DeviceID     string `json:"device_id"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
 type flows struct {
@@ -38,24 +41,39 @@ type flows struct {
 }
 
 type flow struct {
-	Type string `json:"type"`
+	Type              string             `json:"type"`
+	IdentityProviders []identityProvider `json:"identity_providers,omitempty"`
 }
 
-// Login implements GET and POST /login
+type identityProvider struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Login implements GET and POST /login. Passwords are checked with
+// passwordAuth.
 func Login(
 	req *http.Request, userAPI userapi.ClientUserAPI,
-	cfg *config.ClientAPI,
+	passwordAuth userapi.UserLoginAPI, cfg *config.ClientAPI,
 ) util.JSONResponse {
 	if req.Method == http.MethodGet {
-		// TODO: support other forms of login, depending on config options
+		loginFlows := []flow{{Type: authtypes.LoginTypePassword}}
+		if cfg.SSO.Enabled {
+			// Clients finish single sign-on with the login token that they
+			// are given by the callback.
+			loginFlows = append(loginFlows,
+				flow{Type: authtypes.LoginTypeSSO, IdentityProviders: identityProviders(&cfg.SSO)},
+				flow{Type: authtypes.LoginTypeToken},
+			)
+		}
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: flows{
-				Flows: []flow{{Type: authtypes.LoginTypePassword}},
+				Flows: loginFlows,
 			},
 		}
 	} else if req.Method == http.MethodPost {
-		login, cleanup, authErr := auth.LoginFromJSONReader(req, userAPI, userAPI, cfg)
+		login, cleanup, authErr := auth.LoginFromJSONReader(req, passwordAuth, userAPI, cfg)
 		if authErr != nil {
 			return *authErr
 		}
@@ -92,6 +110,28 @@ func completeAuth(
 		}
 	}
 
+	var accountRes userapi.QueryAccountByLocalpartResponse
+	if err = userAPI.QueryAccountByLocalpart(ctx, &userapi.QueryAccountByLocalpartRequest{
+		Localpart:  localpart,
+		ServerName: serverName,
+	}, &accountRes); err == nil && accountRes.Account != nil {
+		switch {
+		case accountRes.Account.Deactivated:
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden("This account has been deactivated"),
+			}
+		case accountRes.Account.Locked:
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: auth.SoftLogoutError{
+					MatrixError: spec.UserLocked("This account has been locked"),
+					SoftLogout:  true,
+				},
+			}
+		}
+	}
+
 	var performRes userapi.PerformDeviceCreationResponse
 	err = userAPI.PerformDeviceCreation(ctx, &userapi.PerformDeviceCreationRequest{
 		DeviceDisplayName: login.InitialDisplayName,
@@ -101,6 +141,7 @@ func completeAuth(
 		ServerName:        serverName,
 		IPAddr:            ipAddr,
 		UserAgent:         userAgent,
+		RefreshToken:      login.RefreshToken,
 	}, &performRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -112,9 +153,23 @@ func completeAuth(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: loginResponse{
-			UserID:      performRes.Device.UserID,
-			AccessToken: performRes.Device.AccessToken,
-			DeviceID:    performRes.Device.ID,
+			UserID:       performRes.Device.UserID,
+			AccessToken:  performRes.Device.AccessToken,
+			DeviceID:     performRes.Device.ID,
+			RefreshToken: performRes.RefreshToken,
+			ExpiresInMS:  expiresInMS(performRes.Device),
 		},
 	}
 }
+
+// expiresInMS returns how long the access token of the device is valid for, or
+// 0 if it never expires.
+func expiresInMS(dev *userapi.Device) int64 {
+	if dev.AccessTokenExpiresTS == 0 {
+		return 0
+	}
+	if ms := dev.AccessTokenExpiresTS - time.Now().UnixMilli(); ms > 0 {
+		return ms
+	}
+	return 1
+}
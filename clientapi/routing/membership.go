@@ -112,6 +112,16 @@ func sendMembership(ctx context.Context, profileAPI userapi.ClientUserAPI, devic
 		}
 	}
 
+	// Kicks, bans and unbans of shadow-banned users look successful but are
+	// never sent.
+	if device.ShadowBanned {
+		util.GetLogger(ctx).WithField("room_id", roomID).Info("Dropping membership change from shadow-banned user")
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
 	serverName := device.UserDomain()
 	if err = roomserverAPI.SendEvents(
 		ctx, rsAPI,
@@ -304,6 +314,14 @@ func SendInvite(
 		return *errRes
 	}
 
+	// Invites from shadow-banned users look successful but are never sent.
+	if device.ShadowBanned {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
 	// We already received the return value, so no need to check for an error here.
 	response, _ := sendInvite(req.Context(), device, roomID, body.UserID, body.Reason, cfg, rsAPI, evTime)
 	return response
@@ -1,24 +1,22 @@
 package routing
 
 import (
+	"io"
 	"net/http"
 
 	"github.com/matrix-org/util"
 	"github.com/neilalexander/harmony/clientapi/auth"
-	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
 	"github.com/neilalexander/harmony/clientapi/httputil"
 	"github.com/neilalexander/harmony/internal"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
-	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/userapi/api"
 	"github.com/sirupsen/logrus"
 )
 
 type newPasswordRequest struct {
-	NewPassword   string          `json:"new_password"`
-	LogoutDevices bool            `json:"logout_devices"`
-	Auth          newPasswordAuth `json:"auth"`
+	NewPassword   string `json:"new_password"`
+	LogoutDevices bool   `json:"logout_devices"`
 }
 
 type newPasswordAuth struct {
@@ -30,10 +28,9 @@ type newPasswordAuth struct {
 func Password(
 	req *http.Request,
 	userAPI api.ClientUserAPI,
+	userInteractiveAuth *auth.UserInteractive,
 	device *api.Device,
-	cfg *config.ClientAPI,
 ) util.JSONResponse {
-	// Check that the existing password is right.
 	var r newPasswordRequest
 	r.LogoutDevices = true
 
@@ -42,48 +39,24 @@ func Password(
 		"userId":    device.UserID,
 	}).Debug("Changing password")
 
-	// Unmarshal the request.
-	resErr := httputil.UnmarshalJSONRequest(req, &r)
-	if resErr != nil {
-		return *resErr
-	}
-
-	// Retrieve or generate the sessionID
-	sessionID := r.Auth.Session
-	if sessionID == "" {
-		// Generate a new, random session ID
-		sessionID = util.RandomString(sessionIDLength)
-	}
-
-	// Require password auth to change the password.
-	if r.Auth.Type != authtypes.LoginTypePassword {
+	defer req.Body.Close() // nolint:errcheck
+	bodyBytes, err := io.ReadAll(req.Body)
+	if err != nil {
 		return util.JSONResponse{
-			Code: http.StatusUnauthorized,
-			JSON: newUserInteractiveResponse(
-				sessionID,
-				[]authtypes.Flow{
-					{
-						Stages: []authtypes.LoginType{authtypes.LoginTypePassword},
-					},
-				},
-				nil,
-			),
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The request body could not be read: " + err.Error()),
 		}
 	}
 
-	// Check if the existing password is correct.
-	typePassword := auth.LoginTypePassword{
-		GetAccountByPassword: userAPI.QueryAccountByPassword,
-		Config:               cfg,
-	}
-	if _, authErr := typePassword.Login(req.Context(), &r.Auth.PasswordRequest); authErr != nil {
-		return *authErr
+	// Unmarshal the request.
+	if resErr := httputil.UnmarshalJSON(bodyBytes, &r); resErr != nil {
+		return *resErr
 	}
-	sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypePassword)
 
-	// Check the new password strength.
-	if err := internal.ValidatePassword(r.NewPassword); err != nil {
-		return *internal.PasswordResponse(err)
+	// Require the existing password to change the password.
+	login, errRes := userInteractiveAuth.Verify(req, bodyBytes, device)
+	if errRes != nil {
+		return *errRes
 	}
 
 	// Get the local part.
@@ -96,6 +69,21 @@ func Password(
 		}
 	}
 
+	// Make sure that the existing password belongs to the user whose password
+	// is being changed, else one compromised access token could be used to
+	// take over the account.
+	if login.Username() != localpart && login.Username() != device.UserID {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("Cannot change another user's password"),
+		}
+	}
+
+	// Check the new password strength.
+	if err = internal.ValidatePassword(r.NewPassword); err != nil {
+		return *internal.PasswordResponse(err)
+	}
+
 	// Ask the user API to perform the password change.
 	passwordReq := &api.PerformPasswordUpdateRequest{
 		Localpart:  localpart,
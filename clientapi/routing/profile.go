@@ -42,7 +42,7 @@ func GetProfile(
 	userID string,
 	federation fclient.FederationClient,
 ) util.JSONResponse {
-	profile, err := getProfile(req.Context(), profileAPI, cfg, userID, federation)
+	profile, err := getProfile(req.Context(), profileAPI, cfg, cfg.Matrix.ServerNameForHTTPHost(spec.ServerName(req.Host)), userID, federation)
 	if err != nil {
 		if err == usertypes.ErrProfileNotExists {
 			return util.JSONResponse{
@@ -297,6 +297,13 @@ func updateProfile(
 		}, e
 	}
 
+	// The profile of a shadow-banned user is updated, but the change isn't
+	// sent into their rooms.
+	if device.ShadowBanned {
+		util.GetLogger(ctx).Info("Dropping profile membership events from shadow-banned user")
+		return util.JSONResponse{}, nil
+	}
+
 	if err := api.SendEvents(ctx, rsAPI, api.KindNew, events, device.UserDomain(), domain, domain, nil, false); err != nil {
 		util.GetLogger(ctx).WithError(err).Error("SendEvents failed")
 		return util.JSONResponse{
@@ -310,10 +317,11 @@ func updateProfile(
 // getProfile gets the full profile of a user by querying the database or a
 // remote homeserver.
 // Returns an error when something goes wrong or specifically
-// eventutil.ErrProfileNotExists when the profile doesn't exist.
+// eventutil.ErrProfileNotExists when the profile doesn't exist. Remote
+// profiles are requested from the given origin server name.
 func getProfile(
 	ctx context.Context, profileAPI userapi.ProfileAPI, cfg *config.ClientAPI,
-	userID string, federation fclient.FederationClient,
+	origin spec.ServerName, userID string, federation fclient.FederationClient,
 ) (*authtypes.Profile, error) {
 	localpart, domain, err := gomatrixserverlib.SplitID('@', userID)
 	if err != nil {
@@ -321,7 +329,7 @@ func getProfile(
 	}
 
 	if !cfg.Matrix.IsLocalServerName(domain) {
-		profile, fedErr := federation.LookupProfile(ctx, cfg.Matrix.ServerName, domain, userID, "")
+		profile, fedErr := federation.LookupProfile(ctx, origin, domain, userID, "")
 		if fedErr != nil {
 			if x, ok := fedErr.(gomatrix.HTTPError); ok {
 				if x.Code == http.StatusNotFound {
@@ -16,12 +16,14 @@ package routing
 
 import (
 	"net/http"
+	"net/mail"
 	"net/url"
 
 	"github.com/matrix-org/util"
 	"github.com/neilalexander/harmony/clientapi/httputil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/setup/config"
 	userapi "github.com/neilalexander/harmony/userapi/api"
 )
 
@@ -64,7 +66,7 @@ func GetPushers(
 // The behaviour of this endpoint varies depending on the values in the JSON body.
 func SetPusher(
 	req *http.Request, device *userapi.Device,
-	userAPI userapi.ClientUserAPI,
+	userAPI userapi.ClientUserAPI, emailCfg *config.EmailNotifications,
 ) util.JSONResponse {
 	localpart, domain, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -84,6 +86,20 @@ func SetPusher(
 	if len(body.PushKey) > 512 {
 		return invalidParam("length of pushkey must be no more than 512 bytes")
 	}
+	if body.Kind == userapi.EmailKind {
+		// We have no way of verifying that the address belongs to the user,
+		// so email pushers are only allowed if the server admin trusts users
+		// not to send notifications to addresses they don't own.
+		if !emailCfg.Enabled || !emailCfg.AllowEmailPushers {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: spec.Forbidden("Email pushers are not enabled on this server"),
+			}
+		}
+		if addr, err := mail.ParseAddress(body.PushKey); err != nil || addr.Address != body.PushKey {
+			return invalidParam("pushkey must be an email address")
+		}
+	}
 	uInt := body.Data["url"]
 	if uInt != nil {
 		u, ok := uInt.(string)
@@ -0,0 +1,48 @@
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neilalexander/harmony/setup/config"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+type fakePusherUserAPI struct {
+	userapi.ClientUserAPI
+	pushers []*userapi.PerformPusherSetRequest
+}
+
+func (a *fakePusherUserAPI) PerformPusherSet(ctx context.Context, req *userapi.PerformPusherSetRequest, res *struct{}) error {
+	a.pushers = append(a.pushers, req)
+	return nil
+}
+
+func TestSetEmailPusher(t *testing.T) {
+	device := &userapi.Device{UserID: "@alice:test", SessionID: 1}
+	setPusher := func(userAPI userapi.ClientUserAPI, cfg *config.EmailNotifications, pushKey string) int {
+		body := `{"kind":"email","app_id":"m.email","pushkey":"` + pushKey + `","data":{}}`
+		req := httptest.NewRequest(http.MethodPost, "/_matrix/client/v3/pushers/set", strings.NewReader(body))
+		return SetPusher(req, device, userAPI, cfg).Code
+	}
+
+	userAPI := &fakePusherUserAPI{}
+	cfg := &config.EmailNotifications{Enabled: true}
+	assert.Equal(t, http.StatusForbidden, setPusher(userAPI, cfg, "alice@example.com"))
+	assert.Empty(t, userAPI.pushers)
+
+	cfg.AllowEmailPushers = true
+	assert.Equal(t, http.StatusBadRequest, setPusher(userAPI, cfg, "not an address"))
+	assert.Equal(t, http.StatusBadRequest, setPusher(userAPI, cfg, "Eve <eve@example.com>"))
+	assert.Empty(t, userAPI.pushers)
+
+	assert.Equal(t, http.StatusOK, setPusher(userAPI, cfg, "alice@example.com"))
+	if assert.Len(t, userAPI.pushers, 1) {
+		assert.Equal(t, "alice@example.com", userAPI.pushers[0].PushKey)
+	}
+}
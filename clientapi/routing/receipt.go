@@ -15,12 +15,17 @@
 package routing
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/neilalexander/harmony/clientapi/httputil"
 	"github.com/neilalexander/harmony/clientapi/producers"
+	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 
 	"github.com/matrix-org/util"
@@ -28,23 +33,70 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func SetReceipt(req *http.Request, userAPI userapi.ClientUserAPI, syncProducer *producers.SyncAPIProducer, device *userapi.Device, roomID, receiptType, eventID string) util.JSONResponse {
+// receiptRequest is the optional request body of
+// POST /rooms/{roomId}/receipt/{receiptType}/{eventId}
+type receiptRequest struct {
+	ThreadID string `json:"thread_id"`
+}
+
+// ParseReceiptThreadID returns the thread ID from the request body of a
+// receipt request, or an empty string if the receipt is unthreaded. The
+// request body is optional, so an empty body is not an error.
+func ParseReceiptThreadID(req *http.Request) (string, *util.JSONResponse) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("io.ReadAll failed")
+		return "", &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return "", nil
+	}
+	var r receiptRequest
+	if resErr := httputil.UnmarshalJSON(body, &r); resErr != nil {
+		return "", resErr
+	}
+	return r.ThreadID, nil
+}
+
+// SetReceipt sets a receipt of the given type for the user. A non-empty thread
+// ID makes the receipt a threaded receipt, which must either be for the main
+// timeline or for a thread root.
+// https://spec.matrix.org/v1.11/client-server-api/#threaded-read-receipts
+func SetReceipt(req *http.Request, userAPI userapi.ClientUserAPI, syncProducer *producers.SyncAPIProducer, device *userapi.Device, roomID, receiptType, eventID, threadID string) util.JSONResponse {
 	timestamp := spec.AsTimestamp(time.Now())
 	logrus.WithFields(logrus.Fields{
 		"roomID":      roomID,
 		"receiptType": receiptType,
 		"eventID":     eventID,
+		"threadID":    threadID,
 		"userId":      device.UserID,
 		"timestamp":   timestamp,
 	}).Debug("Setting receipt")
 
+	if threadID != "" && threadID != eventutil.MainThreadID && !strings.HasPrefix(threadID, "$") {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("thread_id must be either 'main' or the event ID of a thread root"),
+		}
+	}
+
 	switch receiptType {
 	case "m.read", "m.read.private":
-		if err := syncProducer.SendReceipt(req.Context(), device.UserID, roomID, eventID, receiptType, timestamp); err != nil {
+		if err := syncProducer.SendReceipt(req.Context(), device.UserID, roomID, eventID, receiptType, threadID, timestamp); err != nil {
 			return util.ErrorResponse(err)
 		}
 
 	case "m.fully_read":
+		if threadID != "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("thread_id is not allowed for m.fully_read"),
+			}
+		}
+
 		data, err := json.Marshal(fullyReadEvent{EventID: eventID})
 		if err != nil {
 			return util.JSONResponse{
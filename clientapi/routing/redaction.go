@@ -182,6 +182,19 @@ func SendRedaction(
 			JSON: spec.NotFound("Room does not exist"),
 		}
 	}
+	if device.ShadowBanned {
+		util.GetLogger(req.Context()).WithField("room_id", roomID).Info("Dropping redaction from shadow-banned user")
+		res := util.JSONResponse{
+			Code: 200,
+			JSON: redactionResponse{
+				EventID: e.EventID(),
+			},
+		}
+		if txnID != nil {
+			txnCache.AddTransaction(device.AccessToken, *txnID, req.URL, &res)
+		}
+		return res
+	}
 	domain := device.UserDomain()
 	if err = roomserverAPI.SendEvents(context.Background(), rsAPI, roomserverAPI.KindNew, []*types.HeaderedEvent{e}, device.UserDomain(), domain, domain, nil, false); err != nil {
 		util.GetLogger(req.Context()).WithError(err).Errorf("failed to SendEvents")
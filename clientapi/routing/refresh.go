@@ -0,0 +1,90 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/util"
+	"github.com/neilalexander/harmony/clientapi/auth"
+	"github.com/neilalexander/harmony/clientapi/httputil"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type refreshResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresInMS  int64  `json:"expires_in_ms"`
+}
+
+// Refresh implements POST /refresh
+// https://spec.matrix.org/v1.12/client-server-api/#post_matrixclientv3refresh
+// Both the access token and the refresh token are replaced, and the old
+// refresh token can't be used again.
+func Refresh(req *http.Request, userAPI userapi.ClientUserAPI) util.JSONResponse {
+	var r refreshRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.RefreshToken == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("Missing refresh_token"),
+		}
+	}
+
+	accessToken, err := auth.GenerateAccessToken()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("auth.GenerateAccessToken failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	var res userapi.PerformTokenRefreshResponse
+	if err = userAPI.PerformTokenRefresh(req.Context(), &userapi.PerformTokenRefreshRequest{
+		RefreshToken: r.RefreshToken,
+		AccessToken:  accessToken,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformTokenRefresh failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if res.Device == nil {
+		return util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: auth.SoftLogoutError{
+				MatrixError: spec.UnknownToken("Unknown refresh token"),
+			},
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: refreshResponse{
+			AccessToken:  res.Device.AccessToken,
+			RefreshToken: res.RefreshToken,
+			ExpiresInMS:  expiresInMS(res.Device),
+		},
+	}
+}
@@ -17,6 +17,7 @@ package routing
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,11 +28,11 @@ import (
 	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/neilalexander/harmony/internal"
 	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 
 	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/setup/config"
@@ -42,6 +43,7 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/tokens"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
 
 	"github.com/neilalexander/harmony/clientapi/auth"
 	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
@@ -62,142 +64,67 @@ var (
 
 const sessionIDLength = 24
 
-// sessionsDict keeps track of completed auth stages for each session.
-// It shouldn't be passed by value because it contains a mutex.
-type sessionsDict struct {
-	sync.RWMutex
-	sessions               map[string][]authtypes.LoginType
-	sessionCompletedResult map[string]registerResponse
-	params                 map[string]registerRequest
-	timer                  map[string]*time.Timer
-	// deleteSessionToDeviceID protects requests to DELETE /devices/{deviceID} from being abused.
-	// If a UIA session is started by trying to delete device1, and then UIA is completed by deleting device2,
-	// the delete request will fail for device2 since the UIA was initiated by trying to delete device1.
-	deleteSessionToDeviceID map[string]string
+// registrationRequestHash is the request hash of the user-interactive auth
+// sessions of registrations. Clients may leave out the registration parameters
+// after the first request of a session, so the parameters are pinned by the
+// ParamsHash of the registrationSession instead.
+const registrationRequestHash = "register"
+
+// registrationSession is the data stored with the user-interactive auth
+// session of a registration.
+type registrationSession struct {
+	// Params are the registration parameters of the last request, which are
+	// used as the defaults for later requests in the session. The password
+	// isn't stored, so clients have to send it with every request.
+	Params registrationParams `json:"params"`
+	// ParamsHash is the registrationParamsHash of the request that supplied
+	// the Params. Once a stage has been completed, the parameters can't be
+	// changed anymore.
+	ParamsHash string `json:"params_hash"`
 }
 
-// defaultTimeout is the timeout used to clean up sessions
-const defaultTimeOut = time.Minute * 5
-
-// getCompletedStages returns the completed stages for a session.
-func (d *sessionsDict) getCompletedStages(sessionID string) []authtypes.LoginType {
-	d.RLock()
-	defer d.RUnlock()
-
-	if completedStages, ok := d.sessions[sessionID]; ok {
-		return completedStages
-	}
-	// Ensure that a empty slice is returned and not nil. See #399.
-	return make([]authtypes.LoginType, 0)
-}
-
-// addParams adds a registerRequest to a sessionID and starts a timer to delete that registerRequest
-func (d *sessionsDict) addParams(sessionID string, r registerRequest) {
-	d.startTimer(defaultTimeOut, sessionID)
-	d.Lock()
-	defer d.Unlock()
-	d.params[sessionID] = r
-}
-
-func (d *sessionsDict) getParams(sessionID string) (registerRequest, bool) {
-	d.RLock()
-	defer d.RUnlock()
-	r, ok := d.params[sessionID]
-	return r, ok
+type registrationParams struct {
+	Username           string                `json:"username"`
+	ServerName         spec.ServerName       `json:"server_name"`
+	DeviceID           *string               `json:"device_id,omitempty"`
+	InitialDisplayName *string               `json:"initial_device_display_name,omitempty"`
+	InhibitLogin       eventutil.WeakBoolean `json:"inhibit_login"`
+	RefreshToken       bool                  `json:"refresh_token"`
 }
 
-// deleteSession cleans up a given session, either because the registration completed
-// successfully, or because a given timeout (default: 5min) was reached.
-func (d *sessionsDict) deleteSession(sessionID string) {
-	d.Lock()
-	defer d.Unlock()
-	delete(d.params, sessionID)
-	delete(d.sessions, sessionID)
-	delete(d.deleteSessionToDeviceID, sessionID)
-	delete(d.sessionCompletedResult, sessionID)
-	// stop the timer, e.g. because the registration was completed
-	if t, ok := d.timer[sessionID]; ok {
-		if !t.Stop() {
-			select {
-			case <-t.C:
-			default:
-			}
-		}
-		delete(d.timer, sessionID)
+// registrationParamsHash identifies the registration parameters of the request,
+// which is the body without the auth dict and the password. Returns an empty
+// string if the request doesn't supply any parameters.
+func registrationParamsHash(req *http.Request, reqBody []byte) string {
+	body, err := sjson.DeleteBytes(reqBody, "password")
+	if err != nil {
+		body = reqBody
 	}
-}
-
-func newSessionsDict() *sessionsDict {
-	return &sessionsDict{
-		sessions:                make(map[string][]authtypes.LoginType),
-		sessionCompletedResult:  make(map[string]registerResponse),
-		params:                  make(map[string]registerRequest),
-		timer:                   make(map[string]*time.Timer),
-		deleteSessionToDeviceID: make(map[string]string),
+	if params := gjson.ParseBytes(body).Map(); len(params) == 0 || (len(params) == 1 && params["auth"].Exists()) {
+		return ""
 	}
+	return auth.RequestHash(req, body)
 }
 
-func (d *sessionsDict) startTimer(duration time.Duration, sessionID string) {
-	d.Lock()
-	defer d.Unlock()
-	t, ok := d.timer[sessionID]
-	if ok {
-		if !t.Stop() {
-			<-t.C
-		}
-		t.Reset(duration)
-		return
-	}
-	d.timer[sessionID] = time.AfterFunc(duration, func() {
-		d.deleteSession(sessionID)
+// storeRegistrationSession replaces the data of the registration session.
+func storeRegistrationSession(ctx context.Context, userAPI userapi.ClientUserAPI, sessionID string, r registerRequest) error {
+	data, err := json.Marshal(registrationSession{
+		Params: registrationParams{
+			Username:           r.Username,
+			ServerName:         r.ServerName,
+			DeviceID:           r.DeviceID,
+			InitialDisplayName: r.InitialDisplayName,
+			InhibitLogin:       r.InhibitLogin,
+			RefreshToken:       r.RefreshToken,
+		},
+		ParamsHash: r.paramsHash,
 	})
-}
-
-// addCompletedSessionStage records that a session has completed an auth stage
-// also starts a timer to delete the session once done.
-func (d *sessionsDict) addCompletedSessionStage(sessionID string, stage authtypes.LoginType) {
-	d.startTimer(defaultTimeOut, sessionID)
-	d.Lock()
-	defer d.Unlock()
-	for _, completedStage := range d.sessions[sessionID] {
-		if completedStage == stage {
-			return
-		}
+	if err != nil {
+		return err
 	}
-	d.sessions[sessionID] = append(d.sessions[sessionID], stage)
-}
-
-func (d *sessionsDict) addDeviceToDelete(sessionID, deviceID string) {
-	d.startTimer(defaultTimeOut, sessionID)
-	d.Lock()
-	defer d.Unlock()
-	d.deleteSessionToDeviceID[sessionID] = deviceID
-}
-
-func (d *sessionsDict) addCompletedRegistration(sessionID string, response registerResponse) {
-	d.Lock()
-	defer d.Unlock()
-	d.sessionCompletedResult[sessionID] = response
+	return userAPI.PerformUIASessionDataUpdate(ctx, sessionID, data)
 }
 
-func (d *sessionsDict) getCompletedRegistration(sessionID string) (registerResponse, bool) {
-	d.RLock()
-	defer d.RUnlock()
-	result, ok := d.sessionCompletedResult[sessionID]
-	return result, ok
-}
-
-func (d *sessionsDict) getDeviceToDelete(sessionID string) (string, bool) {
-	d.RLock()
-	defer d.RUnlock()
-	deviceID, ok := d.deleteSessionToDeviceID[sessionID]
-	return deviceID, ok
-}
-
-var (
-	sessions = newSessionsDict()
-)
-
 // registerRequest represents the submitted registration request.
 // It can be broken down into 2 sections: the auth dictionary and registration parameters.
 // Registration parameters vary depending on the request, and will need to remembered across
@@ -221,9 +148,16 @@ type registerRequest struct {
 	// Prevent this user from logging in
 	InhibitLogin eventutil.WeakBoolean `json:"inhibit_login"`
 
+	// Whether the client supports refresh tokens
+	RefreshToken bool `json:"refresh_token"`
+
 	// Application Services place Type in the root of their registration
 	// request, whereas clients place it in the authDict struct.
 	Type authtypes.LoginType `json:"type"`
+
+	// The registrationParamsHash of the parameters, which is stored with the
+	// session.
+	paramsHash string
 }
 
 type authDict struct {
@@ -248,19 +182,26 @@ type userInteractiveResponse struct {
 // during registration.
 func newUserInteractiveResponse(
 	sessionID string,
+	completed []authtypes.LoginType,
 	fs []authtypes.Flow,
 	params map[string]interface{},
 ) userInteractiveResponse {
+	// Ensure that a empty slice is returned and not nil. See #399.
+	if completed == nil {
+		completed = []authtypes.LoginType{}
+	}
 	return userInteractiveResponse{
-		fs, sessions.getCompletedStages(sessionID), params, sessionID,
+		fs, completed, params, sessionID,
 	}
 }
 
 // https://spec.matrix.org/v1.7/client-server-api/#post_matrixclientv3register
 type registerResponse struct {
-	UserID      string `json:"user_id"`
-	AccessToken string `json:"access_token,omitempty"`
-	DeviceID    string `json:"device_id,omitempty"`
+	UserID       string `json:"user_id"`
+	AccessToken  string `json:"access_token,omitempty"`
+	DeviceID     string `json:"device_id,omitempty"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresInMS  int64  `json:"expires_in_ms,omitempty"`
 }
 
 // recaptchaResponse represents the HTTP response from a Google Recaptcha server
@@ -343,33 +284,63 @@ func Register(
 	}
 
 	var r registerRequest
-	host := spec.ServerName(req.Host)
-	if v := cfg.Matrix.VirtualHostForHTTPHost(host); v != nil {
-		r.ServerName = v.ServerName
-	} else {
-		r.ServerName = cfg.Matrix.ServerName
-	}
+	var completed []authtypes.LoginType
+	r.ServerName = cfg.Matrix.ServerNameForHTTPHost(spec.ServerName(req.Host))
+	r.paramsHash = registrationParamsHash(req, reqBody)
 	sessionID := gjson.GetBytes(reqBody, "auth.session").String()
-	if sessionID == "" {
-		// Generate a new, random session ID
+	newSession := sessionID == ""
+	if newSession {
+		// Generate a new, random session ID. The session is only stored
+		// once the request reaches the registration flow.
 		sessionID = util.RandomString(sessionIDLength)
-	} else if data, ok := sessions.getParams(sessionID); ok {
-		// Use the parameters from the session as our defaults.
-		// Some of these might end up being overwritten if the
-		// values are specified again in the request body.
-		r.Username = data.Username
-		r.ServerName = data.ServerName
-		r.Password = data.Password
-		r.DeviceID = data.DeviceID
-		r.InitialDisplayName = data.InitialDisplayName
-		r.InhibitLogin = data.InhibitLogin
-		// Check if the user already registered using this session, if so, return that result
-		if response, ok := sessions.getCompletedRegistration(sessionID); ok {
+	} else {
+		session, err := userAPI.QueryUIASession(req.Context(), sessionID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.QueryUIASession failed")
 			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: response,
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		if session == nil || session.RequestHash != registrationRequestHash {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.Unknown("The auth.session is missing or unknown."),
 			}
 		}
+		for _, stage := range session.CompletedStages() {
+			completed = append(completed, authtypes.LoginType(stage))
+		}
+		if len(session.Data) > 0 {
+			var data registrationSession
+			if err = json.Unmarshal(session.Data, &data); err != nil {
+				util.GetLogger(req.Context()).WithError(err).Error("failed to unmarshal registration session")
+				return util.JSONResponse{
+					Code: http.StatusInternalServerError,
+					JSON: spec.InternalServerError{},
+				}
+			}
+			// Once a stage has been completed, the session can only be used
+			// to register with the parameters that the stage was completed for.
+			switch {
+			case r.paramsHash == "":
+				r.paramsHash = data.ParamsHash
+			case r.paramsHash != data.ParamsHash && len(completed) > 0:
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: spec.Forbidden("The request has changed during the user-interactive auth session."),
+				}
+			}
+			// Use the parameters from the session as our defaults.
+			// Some of these might end up being overwritten if the
+			// values are specified again in the request body.
+			r.Username = data.Params.Username
+			r.ServerName = data.Params.ServerName
+			r.DeviceID = data.Params.DeviceID
+			r.InitialDisplayName = data.Params.InitialDisplayName
+			r.InhibitLogin = data.Params.InhibitLogin
+			r.RefreshToken = data.Params.RefreshToken
+		}
 	}
 	if resErr := httputil.UnmarshalJSON(reqBody, &r); resErr != nil {
 		return *resErr
@@ -433,7 +404,20 @@ func Register(
 		"session_id": r.Auth.Session,
 	}).Info("Processing registration request")
 
-	return handleRegistrationFlow(req, r, sessionID, cfg, userAPI)
+	if newSession {
+		if err = userAPI.PerformUIASessionCreation(req.Context(), &userapi.UIASession{
+			SessionID:   sessionID,
+			RequestHash: registrationRequestHash,
+		}); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformUIASessionCreation failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+	}
+
+	return handleRegistrationFlow(req, r, sessionID, completed, cfg, userAPI)
 }
 
 func handleGuestRegistration(
@@ -490,6 +474,7 @@ func handleGuestRegistration(
 		IPAddr:            req.RemoteAddr,
 		UserAgent:         req.UserAgent(),
 		FromRegistration:  true,
+		RefreshToken:      r.RefreshToken,
 	}, &devRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -500,9 +485,11 @@ func handleGuestRegistration(
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: registerResponse{
-			UserID:      devRes.Device.UserID,
-			AccessToken: devRes.Device.AccessToken,
-			DeviceID:    devRes.Device.ID,
+			UserID:       devRes.Device.UserID,
+			AccessToken:  devRes.Device.AccessToken,
+			DeviceID:     devRes.Device.ID,
+			RefreshToken: devRes.RefreshToken,
+			ExpiresInMS:  expiresInMS(devRes.Device),
 		},
 	}
 }
@@ -514,15 +501,13 @@ func handleRegistrationFlow(
 	req *http.Request,
 	r registerRequest,
 	sessionID string,
+	completed []authtypes.LoginType,
 	cfg *config.ClientAPI,
 	userAPI userapi.ClientUserAPI,
 ) util.JSONResponse {
 	// TODO: Enable registration config flag
 	// TODO: Guest account upgrading
 
-	// TODO: Handle loading of previous session parameters from database.
-	// TODO: Handle mapping registrationRequest parameters into session parameters
-
 	// TODO: email / msisdn auth types.
 
 	// Appservices are special and are not affected by disabled
@@ -566,13 +551,8 @@ func handleRegistrationFlow(
 			return util.JSONResponse{Code: http.StatusInternalServerError, JSON: spec.InternalServerError{}}
 		}
 
-		// Add Recaptcha to the list of completed registration stages
-		sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypeRecaptcha)
-
 	case authtypes.LoginTypeDummy:
 		// there is nothing to do
-		// Add Dummy to the list of completed registration stages
-		sessions.addCompletedSessionStage(sessionID, authtypes.LoginTypeDummy)
 
 	case "":
 		// An empty auth type means that we want to fetch the available
@@ -585,11 +565,24 @@ func handleRegistrationFlow(
 		}
 	}
 
+	// Add the stage to the list of completed registration stages
+	if r.Auth.Type != "" {
+		if err := userAPI.PerformUIASessionStageCompletion(req.Context(), sessionID, string(r.Auth.Type)); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformUIASessionStageCompletion failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		if !slices.Contains(completed, r.Auth.Type) {
+			completed = append(completed, r.Auth.Type)
+		}
+	}
+
 	// Check if the user's registration flow has been completed successfully
 	// A response with current registration flow and remaining available methods
 	// will be returned if a flow has not been successfully completed yet
-	return checkAndCompleteFlow(sessions.getCompletedStages(sessionID),
-		req, r, sessionID, cfg, userAPI)
+	return checkAndCompleteFlow(completed, req, r, sessionID, cfg, userAPI)
 }
 
 // checkAndCompleteFlow checks if a given registration flow is completed given
@@ -604,19 +597,38 @@ func checkAndCompleteFlow(
 	userAPI userapi.ClientUserAPI,
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
-		// This flow was completed, registration can continue
+		// This flow was completed, so the session is used up. Removing it
+		// makes sure that only one request registers with the session.
+		if err := userAPI.PerformUIASessionDeletion(req.Context(), sessionID); errors.Is(err, sql.ErrNoRows) {
+			return util.JSONResponse{
+				Code: http.StatusUnauthorized,
+				JSON: spec.Forbidden("The user-interactive auth session has already been used."),
+			}
+		} else if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformUIASessionDeletion failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
 		return completeRegistration(
 			req.Context(), userAPI, r.Username, r.ServerName, "", r.Password, "", req.RemoteAddr,
-			req.UserAgent(), sessionID, r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+			req.UserAgent(), r.InhibitLogin, r.RefreshToken, r.InitialDisplayName, r.DeviceID,
 			userapi.AccountTypeUser,
 		)
 	}
-	sessions.addParams(sessionID, r)
+	if err := storeRegistrationSession(req.Context(), userAPI, sessionID, r); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("failed to store registration session")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
 	// There are still more stages to complete.
 	// Return the flows and those that have been completed.
 	return util.JSONResponse{
 		Code: http.StatusUnauthorized,
-		JSON: newUserInteractiveResponse(sessionID,
+		JSON: newUserInteractiveResponse(sessionID, flow,
 			cfg.Derived.Registration.Flows, cfg.Derived.Registration.Params),
 	}
 }
@@ -631,8 +643,8 @@ func completeRegistration(
 	ctx context.Context,
 	userAPI userapi.ClientUserAPI,
 	username string, serverName spec.ServerName, displayName string,
-	password, appserviceID, ipAddr, userAgent, sessionID string,
-	inhibitLogin eventutil.WeakBoolean,
+	password, appserviceID, ipAddr, userAgent string,
+	inhibitLogin eventutil.WeakBoolean, refreshToken bool,
 	deviceDisplayName, deviceID *string,
 	accType userapi.AccountType,
 ) util.JSONResponse {
@@ -713,6 +725,7 @@ func completeRegistration(
 		IPAddr:            ipAddr,
 		UserAgent:         userAgent,
 		FromRegistration:  true,
+		RefreshToken:      refreshToken,
 	}, &devRes)
 	if err != nil {
 		return util.JSONResponse{
@@ -722,12 +735,12 @@ func completeRegistration(
 	}
 
 	result := registerResponse{
-		UserID:      devRes.Device.UserID,
-		AccessToken: devRes.Device.AccessToken,
-		DeviceID:    devRes.Device.ID,
+		UserID:       devRes.Device.UserID,
+		AccessToken:  devRes.Device.AccessToken,
+		DeviceID:     devRes.Device.ID,
+		RefreshToken: devRes.RefreshToken,
+		ExpiresInMS:  expiresInMS(devRes.Device),
 	}
-	sessions.addCompletedRegistration(sessionID, result)
-
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: result,
@@ -800,11 +813,7 @@ func RegisterAvailable(
 
 	// Squash username to all lowercase letters
 	username = strings.ToLower(username)
-	domain := cfg.Matrix.ServerName
-	host := spec.ServerName(req.Host)
-	if v := cfg.Matrix.VirtualHostForHTTPHost(host); v != nil {
-		domain = v.ServerName
-	}
+	domain := cfg.Matrix.ServerNameForHTTPHost(spec.ServerName(req.Host))
 	if u, l, err := cfg.Matrix.SplitLocalID('@', username); err == nil {
 		username, domain = u, l
 	}
@@ -871,7 +880,8 @@ func handleSharedSecretRegistration(cfg *config.ClientAPI, userAPI userapi.Clien
 	// downcase capitals
 	ssrr.User = strings.ToLower(ssrr.User)
 
-	if err = internal.ValidateUsername(ssrr.User, cfg.Matrix.ServerName); err != nil {
+	serverName := cfg.Matrix.ServerNameForHTTPHost(spec.ServerName(req.Host))
+	if err = internal.ValidateUsername(ssrr.User, serverName); err != nil {
 		return *internal.UsernameResponse(err)
 	}
 	if err = internal.ValidatePassword(ssrr.Password); err != nil {
@@ -883,5 +893,5 @@ func handleSharedSecretRegistration(cfg *config.ClientAPI, userAPI userapi.Clien
 	if ssrr.Admin {
 		accType = userapi.AccountTypeAdmin
 	}
-	return completeRegistration(req.Context(), userAPI, ssrr.User, cfg.Matrix.ServerName, ssrr.DisplayName, ssrr.Password, "", req.RemoteAddr, req.UserAgent(), "", false, &ssrr.User, &deviceID, accType)
+	return completeRegistration(req.Context(), userAPI, ssrr.User, serverName, ssrr.DisplayName, ssrr.Password, "", req.RemoteAddr, req.UserAgent(), false, false, &ssrr.User, &deviceID, accType)
 }
@@ -16,6 +16,8 @@ package routing
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -23,6 +25,7 @@ import (
 	"net/http/httptest"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -30,9 +33,11 @@ import (
 	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
 	"github.com/neilalexander/harmony/internal"
 	"github.com/neilalexander/harmony/internal/caching"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/roomserver"
+	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/setup/jetstream"
 	"github.com/neilalexander/harmony/test"
 	"github.com/neilalexander/harmony/test/testrig"
@@ -40,6 +45,7 @@ import (
 	"github.com/neilalexander/harmony/userapi/api"
 	"github.com/patrickmn/go-cache"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/exp/slices"
 )
 
 var (
@@ -155,69 +161,192 @@ func TestFlowCheckingExtraneousIncorrectInput(t *testing.T) {
 	}
 }
 
-// Completed flows stages should always be a valid slice header.
-// TestEmptyCompletedFlows checks that sessionsDict returns a slice & not nil.
-func TestEmptyCompletedFlows(t *testing.T) {
-	fakeEmptySessions := newSessionsDict()
-	fakeSessionID := "aRandomSessionIDWhichDoesNotExist"
-	ret := fakeEmptySessions.getCompletedStages(fakeSessionID)
+// fakeRegistrationUserAPI stores user-interactive auth sessions in memory, and
+// creates accounts and devices without a database.
+type fakeRegistrationUserAPI struct {
+	api.ClientUserAPI
+	sync.Mutex
+	sessions map[string]*api.UIASession
+	accounts map[string]string // localpart -> password
+}
 
-	// check for []
-	if ret == nil || len(ret) != 0 {
-		t.Error("Empty Completed Flow Stages should be a empty slice: returned ", ret, ". Should be []")
+func newFakeRegistrationUserAPI() *fakeRegistrationUserAPI {
+	return &fakeRegistrationUserAPI{
+		sessions: map[string]*api.UIASession{},
+		accounts: map[string]string{},
 	}
 }
 
-func TestSessionCleanUp(t *testing.T) {
-	s := newSessionsDict()
-
-	t.Run("session is cleaned up after a while", func(t *testing.T) {
-		// t.Parallel()
-		dummySession := "helloWorld"
-		// manually added, as s.addParams() would start the timer with the default timeout
-		s.params[dummySession] = registerRequest{Username: "Testing"}
-		s.startTimer(time.Millisecond, dummySession)
-		time.Sleep(time.Millisecond * 50)
-		if data, ok := s.getParams(dummySession); ok {
-			t.Errorf("expected session to be deleted: %+v", data)
-		}
-	})
+func (a *fakeRegistrationUserAPI) PerformUIASessionCreation(ctx context.Context, session *api.UIASession) error {
+	a.Lock()
+	defer a.Unlock()
+	a.sessions[session.SessionID] = session
+	return nil
+}
 
-	t.Run("session is deleted, once the registration completed", func(t *testing.T) {
-		// t.Parallel()
-		dummySession := "helloWorld2"
-		s.startTimer(time.Minute, dummySession)
-		s.deleteSession(dummySession)
-		if data, ok := s.getParams(dummySession); ok {
-			t.Errorf("expected session to be deleted: %+v", data)
-		}
-	})
+func (a *fakeRegistrationUserAPI) PerformUIASessionStageCompletion(ctx context.Context, sessionID, stage string) error {
+	a.Lock()
+	defer a.Unlock()
+	session, ok := a.sessions[sessionID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	if !slices.Contains(session.CompletedStages(), stage) {
+		session.Completed = append(session.Completed, api.UIACompletedStage{Stage: stage, CompletedAt: time.Now()})
+	}
+	return nil
+}
 
-	t.Run("session timer is restarted after second call", func(t *testing.T) {
-		// t.Parallel()
-		dummySession := "helloWorld3"
-		// the following will start a timer with the default timeout of 5min
-		s.addParams(dummySession, registerRequest{Username: "Testing"})
-		s.addCompletedSessionStage(dummySession, authtypes.LoginTypeRecaptcha)
-		s.addCompletedSessionStage(dummySession, authtypes.LoginTypeDummy)
-		s.addDeviceToDelete(dummySession, "dummyDevice")
-		s.getCompletedStages(dummySession)
-		// reset the timer with a lower timeout
-		s.startTimer(time.Millisecond, dummySession)
-		time.Sleep(time.Millisecond * 50)
-		if data, ok := s.getParams(dummySession); ok {
-			t.Errorf("expected session to be deleted: %+v", data)
-		}
-		if _, ok := s.timer[dummySession]; ok {
-			t.Error("expected timer to be delete")
-		}
-		if _, ok := s.sessions[dummySession]; ok {
-			t.Error("expected session to be delete")
-		}
-		if _, ok := s.getDeviceToDelete(dummySession); ok {
-			t.Error("expected session to device to be delete")
-		}
-	})
+func (a *fakeRegistrationUserAPI) PerformUIASessionDataUpdate(ctx context.Context, sessionID string, data json.RawMessage) error {
+	a.Lock()
+	defer a.Unlock()
+	session, ok := a.sessions[sessionID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	session.Data = data
+	return nil
+}
+
+func (a *fakeRegistrationUserAPI) PerformUIASessionDeletion(ctx context.Context, sessionID string) error {
+	a.Lock()
+	defer a.Unlock()
+	if _, ok := a.sessions[sessionID]; !ok {
+		return sql.ErrNoRows
+	}
+	delete(a.sessions, sessionID)
+	return nil
+}
+
+func (a *fakeRegistrationUserAPI) QueryUIASession(ctx context.Context, sessionID string) (*api.UIASession, error) {
+	a.Lock()
+	defer a.Unlock()
+	session, ok := a.sessions[sessionID]
+	if !ok {
+		return nil, nil
+	}
+	copied := *session
+	return &copied, nil
+}
+
+func (a *fakeRegistrationUserAPI) PerformAccountCreation(ctx context.Context, req *api.PerformAccountCreationRequest, res *api.PerformAccountCreationResponse) error {
+	a.Lock()
+	defer a.Unlock()
+	if _, ok := a.accounts[req.Localpart]; ok {
+		return &api.ErrorConflict{Message: "user already exists"}
+	}
+	a.accounts[req.Localpart] = req.Password
+	res.AccountCreated = true
+	res.Account = &api.Account{Localpart: req.Localpart, ServerName: req.ServerName}
+	return nil
+}
+
+func (a *fakeRegistrationUserAPI) PerformDeviceCreation(ctx context.Context, req *api.PerformDeviceCreationRequest, res *api.PerformDeviceCreationResponse) error {
+	deviceID := "DEVICE"
+	if req.DeviceID != nil {
+		deviceID = *req.DeviceID
+	}
+	res.Device = &api.Device{
+		ID:          deviceID,
+		UserID:      fmt.Sprintf("@%s:%s", req.Localpart, req.ServerName),
+		AccessToken: req.AccessToken,
+	}
+	return nil
+}
+
+func TestRegistrationSessions(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			SigningIdentity: fclient.SigningIdentity{ServerName: "test"},
+		},
+		Derived: &config.Derived{},
+	}
+	cfg.Derived.Registration.Flows = []authtypes.Flow{
+		{Stages: []authtypes.LoginType{authtypes.LoginTypeDummy}},
+	}
+	userAPI := newFakeRegistrationUserAPI()
+	register := func(body string) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		return Register(req, userAPI, cfg)
+	}
+
+	// The first request starts a session, which remembers the parameters
+	// except for the password.
+	resp := register(`{"username":"alice","password":"someRandomPassword","device_id":"DEVICE"}`)
+	uia, ok := resp.JSON.(userInteractiveResponse)
+	if !ok {
+		t.Fatalf("expected a userInteractiveResponse, got %+v", resp)
+	}
+	assert.Equal(t, []authtypes.LoginType{}, uia.Completed)
+	session, _ := userAPI.QueryUIASession(context.Background(), uia.Session)
+	if assert.NotNil(t, session) {
+		assert.Equal(t, registrationRequestHash, session.RequestHash)
+		assert.Contains(t, string(session.Data), `"username":"alice"`)
+		assert.NotContains(t, string(session.Data), "someRandomPassword")
+	}
+
+	// The parameters can still be replaced, as no stage has been completed.
+	resp = register(fmt.Sprintf(`{"username":"alice","password":"someRandomPassword","device_id":"DEVICE","auth":{"session":%q}}`, uia.Session))
+	assert.Equal(t, http.StatusUnauthorized, resp.Code)
+
+	// Unknown sessions are rejected.
+	resp = register(`{"password":"someRandomPassword","auth":{"type":"m.login.dummy","session":"unknown"}}`)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+
+	// Completing the flow registers the user with the remembered parameters.
+	final := fmt.Sprintf(`{"password":"someRandomPassword","auth":{"type":"m.login.dummy","session":%q}}`, uia.Session)
+	resp = register(final)
+	result, ok := resp.JSON.(registerResponse)
+	if !ok {
+		t.Fatalf("expected a registerResponse, got %+v", resp)
+	}
+	assert.Equal(t, "@alice:test", result.UserID)
+	assert.Equal(t, "DEVICE", result.DeviceID)
+
+	// The completed session is used up, so it can't be used again.
+	resp = register(final)
+	assert.Equal(t, http.StatusBadRequest, resp.Code)
+	assert.Empty(t, userAPI.sessions)
+}
+
+func TestRegistrationSessionPinsParameters(t *testing.T) {
+	cfg := &config.ClientAPI{
+		Matrix: &config.Global{
+			SigningIdentity: fclient.SigningIdentity{ServerName: "test"},
+		},
+		Derived: &config.Derived{},
+	}
+	cfg.Derived.Registration.Flows = []authtypes.Flow{
+		{Stages: []authtypes.LoginType{authtypes.LoginTypeRecaptcha, authtypes.LoginTypeDummy}},
+	}
+	userAPI := newFakeRegistrationUserAPI()
+	register := func(body string) util.JSONResponse {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		return Register(req, userAPI, cfg)
+	}
+
+	resp := register(`{"username":"bob","password":"someRandomPassword"}`)
+	uia, ok := resp.JSON.(userInteractiveResponse)
+	if !ok {
+		t.Fatalf("expected a userInteractiveResponse, got %+v", resp)
+	}
+	// Complete the captcha for the parameters of the first request.
+	assert.NoError(t, userAPI.PerformUIASessionStageCompletion(context.Background(), uia.Session, string(authtypes.LoginTypeRecaptcha)))
+
+	// Other parameters can't be swapped in after a stage was completed.
+	resp = register(fmt.Sprintf(`{"username":"mallory","password":"someRandomPassword","auth":{"type":"m.login.dummy","session":%q}}`, uia.Session))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	resp = register(fmt.Sprintf(`{"username":"bob","password":"someRandomPassword","inhibit_login":true,"auth":{"type":"m.login.dummy","session":%q}}`, uia.Session))
+	assert.Equal(t, http.StatusForbidden, resp.Code)
+	assert.Empty(t, userAPI.accounts)
+
+	// The session can be finished with the same parameters.
+	resp = register(fmt.Sprintf(`{"username":"bob","password":"someRandomPassword","auth":{"type":"m.login.dummy","session":%q}}`, uia.Session))
+	result, ok := resp.JSON.(registerResponse)
+	if !ok {
+		t.Fatalf("expected a registerResponse, got %+v", resp)
+	}
+	assert.Equal(t, "@bob:test", result.UserID)
 }
 
 func Test_register(t *testing.T) {
@@ -547,7 +676,7 @@ func TestRegisterUserWithDisplayName(t *testing.T) {
 			"",
 			"localhost",
 			"user agent",
-			"session",
+			false,
 			false,
 			&deviceName,
 			&deviceID,
@@ -0,0 +1,196 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/util"
+
+	"github.com/neilalexander/harmony/clientapi/httputil"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/setup/config"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+type reportRequest struct {
+	Reason string `json:"reason"`
+	Score  *int64 `json:"score,omitempty"`
+}
+
+// ReportEvent implements POST /rooms/{roomID}/report/{eventID}
+func ReportEvent(
+	req *http.Request, device *userapi.Device, roomID, eventID string,
+	cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI, userAPI userapi.ClientUserAPI,
+) util.JSONResponse {
+	var r reportRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Score != nil && (*r.Score < -100 || *r.Score > 0) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("score must be between -100 and 0"),
+		}
+	}
+	return performReport(req.Context(), device, &roomserverAPI.PerformReportRequest{
+		RoomID:  roomID,
+		EventID: eventID,
+		Reason:  r.Reason,
+		Score:   r.Score,
+	}, cfg, rsAPI, userAPI)
+}
+
+// ReportRoom implements POST /rooms/{roomID}/report
+func ReportRoom(
+	req *http.Request, device *userapi.Device, roomID string,
+	cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI, userAPI userapi.ClientUserAPI,
+) util.JSONResponse {
+	var r reportRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.Reason == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("missing reason"),
+		}
+	}
+	return performReport(req.Context(), device, &roomserverAPI.PerformReportRequest{
+		RoomID: roomID,
+		Reason: r.Reason,
+	}, cfg, rsAPI, userAPI)
+}
+
+func performReport(
+	ctx context.Context, device *userapi.Device, reportReq *roomserverAPI.PerformReportRequest,
+	cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI, userAPI userapi.ClientUserAPI,
+) util.JSONResponse {
+	userID, err := spec.NewUserID(device.UserID, true)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("invalid user ID"),
+		}
+	}
+	reportReq.UserID = *userID
+
+	report, err := rsAPI.PerformReport(ctx, reportReq)
+	switch e := err.(type) {
+	case nil:
+	case roomserverAPI.ErrInvalidID:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(e.Error()),
+		}
+	case roomserverAPI.ErrRoomUnknownOrNotAllowed:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("The room or event was not found, or you are not joined to the room"),
+		}
+	default:
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.PerformReport failed")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	if cfg.ReportModeratorRoom != "" {
+		if err = notifyModerators(ctx, report, cfg, rsAPI, userAPI); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("report_id", report.ID).Error("Failed to post report into the moderator room")
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// notifyModerators posts the report into the moderator room as the server
+// notices user, joining the room first if the user has been invited.
+func notifyModerators(
+	ctx context.Context, report *roomserverAPI.Report,
+	cfg *config.ClientAPI, rsAPI roomserverAPI.ClientRoomserverAPI, userAPI userapi.ClientUserAPI,
+) error {
+	senderDevice, err := getSenderDevice(ctx, rsAPI, userAPI, cfg)
+	if err != nil {
+		return fmt.Errorf("getSenderDevice: %w", err)
+	}
+	senderUserID, err := spec.NewUserID(senderDevice.UserID, true)
+	if err != nil {
+		return err
+	}
+
+	var membershipRes roomserverAPI.QueryMembershipForUserResponse
+	if err = rsAPI.QueryMembershipForUser(ctx, &roomserverAPI.QueryMembershipForUserRequest{
+		RoomID: cfg.ReportModeratorRoom,
+		UserID: *senderUserID,
+	}, &membershipRes); err != nil {
+		return fmt.Errorf("rsAPI.QueryMembershipForUser: %w", err)
+	}
+	if !membershipRes.IsInRoom {
+		if _, _, err = rsAPI.PerformJoin(ctx, &roomserverAPI.PerformJoinRequest{
+			RoomIDOrAlias: cfg.ReportModeratorRoom,
+			UserID:        senderDevice.UserID,
+			Content:       map[string]interface{}{},
+		}); err != nil {
+			return fmt.Errorf("rsAPI.PerformJoin: %w", err)
+		}
+	}
+
+	content := map[string]interface{}{
+		"msgtype": "m.notice",
+		"body":    reportNotice(report),
+	}
+	e, resErr := generateSendEvent(ctx, content, senderDevice, cfg.ReportModeratorRoom, "m.room.message", nil, rsAPI, time.Now())
+	if resErr != nil {
+		return fmt.Errorf("generateSendEvent: %+v", resErr.JSON)
+	}
+	return roomserverAPI.SendEvents(
+		ctx, rsAPI,
+		roomserverAPI.KindNew,
+		[]*types.HeaderedEvent{{PDU: e}},
+		senderDevice.UserDomain(),
+		cfg.Matrix.ServerName,
+		cfg.Matrix.ServerName,
+		nil,
+		false,
+	)
+}
+
+// reportNotice returns the text of the moderator room message for the report.
+func reportNotice(report *roomserverAPI.Report) string {
+	var b strings.Builder
+	if report.EventID != "" {
+		fmt.Fprintf(&b, "Report %d: %s reported event %s sent by %s in room %s", report.ID, report.ReportingUserID, report.EventID, report.EventSender, report.RoomID)
+	} else {
+		fmt.Fprintf(&b, "Report %d: %s reported room %s", report.ID, report.ReportingUserID, report.RoomID)
+	}
+	if report.Score != nil {
+		fmt.Fprintf(&b, " with score %d", *report.Score)
+	}
+	if report.Reason != "" {
+		fmt.Fprintf(&b, "\nReason: %s", report.Reason)
+	}
+	return b.String()
+}
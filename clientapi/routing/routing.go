@@ -18,6 +18,7 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/util"
@@ -85,11 +86,16 @@ func Setup(
 	}
 
 	rateLimits := httputil.NewRateLimits(&cfg.RateLimiting)
-	userInteractiveAuth := auth.NewUserInteractive(userAPI, cfg)
+	passwordAuth, err := auth.NewPasswordProviders(cfg, userAPI)
+	if err != nil {
+		logrus.WithError(err).Fatal("unable to set up password authentication")
+	}
+	userInteractiveAuth := auth.NewUserInteractive(passwordAuth, userAPI, cfg)
 
 	unstableFeatures := map[string]bool{
-		"org.matrix.e2e_cross_signing": true,
-		"org.matrix.msc2285.stable":    true,
+		"org.matrix.e2e_cross_signing":  true,
+		"org.matrix.msc2285.stable":     true,
+		"org.matrix.simplified_msc3575": true,
 	}
 	for _, msc := range cfg.MSCs.MSCs {
 		unstableFeatures["org.matrix."+msc] = true
@@ -108,22 +114,31 @@ func Setup(
 		if cfg.Matrix.WellKnownSlidingSyncProxy != "" {
 			logrus.Infof("Setting org.matrix.msc3575.proxy url as %s at /.well-known/matrix/client", cfg.Matrix.WellKnownSlidingSyncProxy)
 		}
-		wkMux.Handle("/client", httputil.MakeExternalAPI("wellknown", func(r *http.Request) util.JSONResponse {
-			response := WellKnownClientResponse{
-				Homeserver: WellKnownClientHomeserver{cfg.Matrix.WellKnownClientName},
+	}
+	// Virtual hosts may advertise their own base URL, so the handler is
+	// registered even if there is no global value.
+	wkMux.Handle("/client", httputil.MakeExternalAPI("wellknown", func(r *http.Request) util.JSONResponse {
+		clientName := cfg.Matrix.WellKnownClientNameForHTTPHost(spec.ServerName(r.Host))
+		if clientName == "" {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound("No client well-known is configured for this host"),
 			}
-			if cfg.Matrix.WellKnownSlidingSyncProxy != "" {
-				response.SlidingSyncProxy = &WellKnownSlidingSyncProxy{
-					Url: cfg.Matrix.WellKnownSlidingSyncProxy,
-				}
+		}
+		response := WellKnownClientResponse{
+			Homeserver: WellKnownClientHomeserver{clientName},
+		}
+		if cfg.Matrix.WellKnownSlidingSyncProxy != "" {
+			response.SlidingSyncProxy = &WellKnownSlidingSyncProxy{
+				Url: cfg.Matrix.WellKnownSlidingSyncProxy,
 			}
+		}
 
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: response,
-			}
-		})).Methods(http.MethodGet, http.MethodOptions)
-	}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: response,
+		}
+	})).Methods(http.MethodGet, http.MethodOptions)
 
 	publicAPIMux.Handle("/versions",
 		httputil.MakeExternalAPI("versions", func(req *http.Request) util.JSONResponse {
@@ -252,6 +267,95 @@ func Setup(
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	dendriteAdminRouter.Handle("/admin/reports",
+		httputil.MakeAdminAPI("admin_list_reports", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListReports(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/reports/{reportID}",
+		httputil.MakeAdminAPI("admin_get_report", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminGetReport(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/reports/{reportID}/resolve",
+		httputil.MakeAdminAPI("admin_resolve_report", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminResolveReport(req, device, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/users",
+		httputil.MakeAdminAPI("admin_list_users", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListUsers(req, userAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/users/{userID}",
+		httputil.MakeAdminAPI("admin_user", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			switch req.Method {
+			case http.MethodGet:
+				return AdminGetUser(req, cfg, userAPI, rsAPI)
+			case http.MethodPut:
+				return AdminUpdateUser(req, cfg, device, userAPI)
+			default:
+				return util.MatrixErrorResponse(
+					404,
+					string(spec.ErrorNotFound),
+					"unknown method",
+				)
+			}
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/deactivateUser/{userID}",
+		httputil.MakeAdminAPI("admin_deactivate_user", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminDeactivateUser(req, cfg, device, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rooms",
+		httputil.MakeAdminAPI("admin_list_rooms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListRooms(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rooms/{roomID}",
+		httputil.MakeAdminAPI("admin_get_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminGetRoom(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rooms/{roomID}/state",
+		httputil.MakeAdminAPI("admin_get_room_state", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminGetRoomState(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rooms/{roomID}/forwardExtremities",
+		httputil.MakeAdminAPI("admin_forward_extremities", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminForwardExtremities(req, device, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/rooms/{roomID}/block",
+		httputil.MakeAdminAPI("admin_block_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminBlockRoom(req, device, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/blockedRooms",
+		httputil.MakeAdminAPI("admin_list_blocked_rooms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminListBlockedRooms(req, rsAPI)
+		}),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/shutdownRoom/{roomID}",
+		httputil.MakeAdminAPI("admin_shutdown_room", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminShutdownRoom(req, cfg, device, userAPI, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	// server notifications
 	if cfg.Matrix.ServerNotices.Enabled {
 		logrus.Info("Enabling server notices at /_synapse/admin/v1/send_server_notice")
@@ -337,6 +441,19 @@ func Setup(
 		}, httputil.WithAllowGuests()),
 	).Methods(http.MethodPost, http.MethodOptions)
 
+	v3mux.Handle("/knock/{roomIDOrAlias}",
+		httputil.MakeAuthAPI(spec.Knock, userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return KnockRoomByIDOrAlias(req, device, rsAPI, vars["roomIDOrAlias"])
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
 	v3mux.Handle("/joined_rooms",
 		httputil.MakeAuthAPI("joined_rooms", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			return GetJoinedRooms(req, device, rsAPI)
@@ -623,6 +740,30 @@ func Setup(
 			return SendTyping(req, device, vars["roomID"], vars["userID"], rsAPI, syncProducer)
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
+	v3mux.Handle("/rooms/{roomID}/report/{eventID}",
+		httputil.MakeAuthAPI("rooms_report_event", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ReportEvent(req, device, vars["roomID"], vars["eventID"], cfg, rsAPI, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+	v3mux.Handle("/rooms/{roomID}/report",
+		httputil.MakeAuthAPI("rooms_report", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return ReportRoom(req, device, vars["roomID"], cfg, rsAPI, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/rooms/{roomID}/redact/{eventID}",
 		httputil.MakeAuthAPI("rooms_redact", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
 			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
@@ -682,7 +823,7 @@ func Setup(
 			if r := rateLimits.Limit(req, device); r != nil {
 				return *r
 			}
-			return Password(req, userAPI, device, cfg)
+			return Password(req, userAPI, userInteractiveAuth, device)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -702,14 +843,57 @@ func Setup(
 			if r := rateLimits.Limit(req, nil); r != nil {
 				return *r
 			}
-			return Login(req, userAPI, cfg)
+			return Login(req, userAPI, passwordAuth, cfg)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
+	v3mux.Handle("/refresh",
+		httputil.MakeExternalAPI("refresh", func(req *http.Request) util.JSONResponse {
+			if r := rateLimits.Limit(req, nil); r != nil {
+				return *r
+			}
+			return Refresh(req, userAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	if cfg.SSO.Enabled {
+		ssoLogin, err := NewSSOLogin(cfg, userAPI, &http.Client{Timeout: 30 * time.Second})
+		if err != nil {
+			logrus.WithError(err).Fatal("unable to set up single sign-on")
+		}
+		v3mux.Handle("/login/sso/redirect",
+			httputil.MakeHTMLAPI("login_sso_redirect", enableMetrics, func(w http.ResponseWriter, req *http.Request) {
+				if r := rateLimits.Limit(req, nil); r != nil {
+					writeHTTPMessage(w, req, "Too many requests", r.Code)
+					return
+				}
+				ssoLogin.SSORedirect(w, req, "")
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+		v3mux.Handle("/login/sso/redirect/{idpID}",
+			httputil.MakeHTMLAPI("login_sso_redirect", enableMetrics, func(w http.ResponseWriter, req *http.Request) {
+				if r := rateLimits.Limit(req, nil); r != nil {
+					writeHTTPMessage(w, req, "Too many requests", r.Code)
+					return
+				}
+				ssoLogin.SSORedirect(w, req, mux.Vars(req)["idpID"])
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+		v3mux.Handle("/login/sso/callback",
+			httputil.MakeHTMLAPI("login_sso_callback", enableMetrics, func(w http.ResponseWriter, req *http.Request) {
+				if r := rateLimits.Limit(req, nil); r != nil {
+					writeHTTPMessage(w, req, "Too many requests", r.Code)
+					return
+				}
+				ssoLogin.SSOCallback(w, req)
+			}),
+		).Methods(http.MethodGet, http.MethodOptions)
+	}
+
 	v3mux.Handle("/auth/{authType}/fallback/web",
 		httputil.MakeHTMLAPI("auth_fallback", enableMetrics, func(w http.ResponseWriter, req *http.Request) {
 			vars := mux.Vars(req)
-			AuthFallback(w, req, vars["authType"], cfg)
+			AuthFallback(w, req, vars["authType"], cfg, userAPI)
 		}),
 	).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
 
@@ -1101,7 +1285,7 @@ func Setup(
 			if r := rateLimits.Limit(req, device); r != nil {
 				return *r
 			}
-			return SetPusher(req, device, userAPI)
+			return SetPusher(req, device, userAPI, &dendriteCfg.UserAPI.Email)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 
@@ -1336,7 +1520,7 @@ func Setup(
 	// Cross-signing device keys
 
 	postDeviceSigningKeys := httputil.MakeAuthAPI("post_device_signing_keys", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
-		return UploadCrossSigningDeviceKeys(req, userInteractiveAuth, userAPI, device, userAPI, cfg)
+		return UploadCrossSigningDeviceKeys(req, userInteractiveAuth, userAPI, device, passwordAuth, cfg)
 	})
 
 	postDeviceSigningSignatures := httputil.MakeAuthAPI("post_device_signing_signatures", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
@@ -1379,8 +1563,12 @@ func Setup(
 			if err != nil {
 				return util.ErrorResponse(err)
 			}
+			threadID, resErr := ParseReceiptThreadID(req)
+			if resErr != nil {
+				return *resErr
+			}
 
-			return SetReceipt(req, userAPI, syncProducer, device, vars["roomId"], vars["receiptType"], vars["eventId"])
+			return SetReceipt(req, userAPI, syncProducer, device, vars["roomId"], vars["receiptType"], vars["eventId"], threadID)
 		}),
 	).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/presence/{userId}/status",
@@ -209,6 +209,20 @@ func SendEvent(
 		}
 	}
 
+	// Events of shadow-banned users are built as normal, so that they get the
+	// same errors as everyone else, but are never sent to the roomserver.
+	if device.ShadowBanned {
+		util.GetLogger(req.Context()).WithField("room_id", roomID).Info("Dropping event from shadow-banned user")
+		res := util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: sendEventResponse{e.EventID()},
+		}
+		if txnID != nil {
+			txnCache.AddTransaction(device.AccessToken, *txnID, req.URL, &res)
+		}
+		return res
+	}
+
 	var txnAndSessionID *api.TransactionID
 	if txnID != nil {
 		txnAndSessionID = &api.TransactionID{
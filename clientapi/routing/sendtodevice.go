@@ -48,6 +48,10 @@ func SendToDevice(
 	}
 
 	for userID, byUser := range httpReq.Messages {
+		// Shadow-banned users can only send to their own devices.
+		if device.ShadowBanned && userID != device.UserID {
+			continue
+		}
 		for deviceID, message := range byUser {
 			if err := syncProducer.SendToDevice(
 				req.Context(), device.UserID, userID, deviceID, eventType, message,
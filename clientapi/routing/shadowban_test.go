@@ -0,0 +1,172 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/clientapi/auth/authtypes"
+	"github.com/neilalexander/harmony/clientapi/producers"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/transactions"
+	rsapi "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
+	uapi "github.com/neilalexander/harmony/userapi/api"
+	"gotest.tools/v3/assert"
+)
+
+// shadowBanTestRoomserverAPI fails the test if anything from a shadow-banned
+// user reaches the roomserver.
+type shadowBanTestRoomserverAPI struct {
+	sendEventTestRoomserverAPI
+	aliases map[string]string
+}
+
+func (s *shadowBanTestRoomserverAPI) QueryMembershipForUser(ctx context.Context, req *rsapi.QueryMembershipForUserRequest, res *rsapi.QueryMembershipForUserResponse) error {
+	res.IsInRoom = req.RoomID == s.roomIDStr
+	return nil
+}
+
+func (s *shadowBanTestRoomserverAPI) QueryRoomsForUser(ctx context.Context, userID spec.UserID, desiredMembership string) ([]spec.RoomID, error) {
+	roomID, err := spec.NewRoomID(s.roomIDStr)
+	if err != nil {
+		return nil, err
+	}
+	return []spec.RoomID{*roomID}, nil
+}
+
+func (s *shadowBanTestRoomserverAPI) GetRoomIDForAlias(ctx context.Context, req *rsapi.GetRoomIDForAliasRequest, res *rsapi.GetRoomIDForAliasResponse) error {
+	res.RoomID = s.aliases[req.Alias]
+	return nil
+}
+
+func (s *shadowBanTestRoomserverAPI) InputRoomEvents(ctx context.Context, req *rsapi.InputRoomEventsRequest, res *rsapi.InputRoomEventsResponse) {
+	s.t.Errorf("unexpected InputRoomEvents with %d events", len(req.InputRoomEvents))
+}
+
+func (s *shadowBanTestRoomserverAPI) PerformKnock(ctx context.Context, req *rsapi.PerformKnockRequest) (string, error) {
+	s.t.Errorf("unexpected PerformKnock for %s", req.RoomIDOrAlias)
+	return "", fmt.Errorf("unexpected PerformKnock")
+}
+
+func (s *shadowBanTestRoomserverAPI) PerformRoomUpgrade(ctx context.Context, roomID string, userID spec.UserID, roomVersion gomatrixserverlib.RoomVersion) (string, error) {
+	s.t.Errorf("unexpected PerformRoomUpgrade for %s", roomID)
+	return "", fmt.Errorf("unexpected PerformRoomUpgrade")
+}
+
+type shadowBanTestUserAPI struct {
+	uapi.ClientUserAPI
+}
+
+func (u *shadowBanTestUserAPI) QueryProfile(ctx context.Context, userID string) (*authtypes.Profile, error) {
+	return &authtypes.Profile{}, nil
+}
+
+func TestShadowBannedUsers(t *testing.T) {
+	roomVersion := gomatrixserverlib.RoomVersionV10
+	roomIDStr := "!id:domain"
+	aliceUserID := "@alice:domain"
+	bobUserID := "@bob:domain"
+
+	roomState, err := createEvents([]string{
+		fmt.Sprintf(`{"type":"m.room.create","state_key":"","room_id":"%v","sender":"%v","content":{"creator":"%v","room_version":"%v"}}`, roomIDStr, aliceUserID, aliceUserID, roomVersion),
+		fmt.Sprintf(`{"type":"m.room.member","state_key":"%v","room_id":"%v","sender":"%v","content":{"membership":"join"}}`, aliceUserID, roomIDStr, aliceUserID),
+		fmt.Sprintf(`{"type":"m.room.member","state_key":"%v","room_id":"%v","sender":"%v","content":{"membership":"join"}}`, bobUserID, roomIDStr, bobUserID),
+	}, roomVersion)
+	if err != nil {
+		t.Fatalf("failed to prepare state events: %s", err)
+	}
+
+	rsAPI := &shadowBanTestRoomserverAPI{
+		sendEventTestRoomserverAPI: sendEventTestRoomserverAPI{
+			t:           t,
+			roomIDStr:   roomIDStr,
+			roomVersion: roomVersion,
+			roomState:   roomState,
+		},
+		aliases: map[string]string{"#room:domain": roomIDStr},
+	}
+	userAPI := &shadowBanTestUserAPI{}
+	cfg := &config.ClientAPI{Matrix: &config.Global{}}
+	cfg.Matrix.ServerName = "domain"
+
+	// The producer has no JetStream, so anything sent through it panics.
+	syncProducer := &producers.SyncAPIProducer{}
+
+	device := &uapi.Device{
+		UserID:       aliceUserID,
+		AccessToken:  "token",
+		ShadowBanned: true,
+	}
+
+	newRequest := func(method, body string) *http.Request {
+		return httptest.NewRequest(method, "https://domain/", strings.NewReader(body))
+	}
+
+	for _, membership := range []string{spec.Ban, spec.Leave} {
+		t.Run("membership "+membership, func(t *testing.T) {
+			resp := sendMembership(context.Background(), userAPI, device, roomIDStr, membership, "reason", cfg, bobUserID, time.Now(), rsAPI)
+			assert.Equal(t, resp.Code, http.StatusOK)
+		})
+	}
+
+	t.Run("profile", func(t *testing.T) {
+		resp, err := updateProfile(context.Background(), rsAPI, device, &authtypes.Profile{DisplayName: "Alice"}, aliceUserID, time.Now())
+		assert.NilError(t, err)
+		assert.Equal(t, resp.Code, 0)
+	})
+
+	t.Run("typing", func(t *testing.T) {
+		resp := SendTyping(newRequest(http.MethodPut, `{"typing":true,"timeout":30000}`), device, roomIDStr, aliceUserID, rsAPI, syncProducer)
+		assert.Equal(t, resp.Code, http.StatusOK)
+	})
+
+	t.Run("typing in a room the user isn't in", func(t *testing.T) {
+		resp := SendTyping(newRequest(http.MethodPut, `{"typing":true}`), device, "!other:domain", aliceUserID, rsAPI, syncProducer)
+		assert.Equal(t, resp.Code, http.StatusForbidden)
+	})
+
+	t.Run("to-device", func(t *testing.T) {
+		txnID := "txn"
+		txnCache := transactions.New()
+		body := fmt.Sprintf(`{"messages":{%q:{"DEVICE":{"body":"hello"}}}}`, bobUserID)
+		resp := SendToDevice(newRequest(http.MethodPut, body), device, syncProducer, txnCache, "m.test", &txnID)
+		assert.Equal(t, resp.Code, http.StatusOK)
+	})
+
+	t.Run("knock by room ID", func(t *testing.T) {
+		resp := KnockRoomByIDOrAlias(newRequest(http.MethodPost, `{}`), device, rsAPI, roomIDStr)
+		assert.Equal(t, resp.Code, http.StatusOK)
+	})
+
+	t.Run("knock by alias", func(t *testing.T) {
+		resp := KnockRoomByIDOrAlias(newRequest(http.MethodPost, `{}`), device, rsAPI, "#room:domain")
+		assert.Equal(t, resp.Code, http.StatusOK)
+		assert.DeepEqual(t, resp.JSON, struct {
+			RoomID string `json:"room_id"`
+		}{roomIDStr})
+	})
+
+	t.Run("knock by unknown alias", func(t *testing.T) {
+		resp := KnockRoomByIDOrAlias(newRequest(http.MethodPost, `{}`), device, rsAPI, "#unknown:domain")
+		assert.Equal(t, resp.Code, http.StatusNotFound)
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		resp := UpgradeRoom(newRequest(http.MethodPost, `{"new_version":"10"}`), device, cfg, roomIDStr, userAPI, rsAPI)
+		assert.Equal(t, resp.Code, http.StatusOK)
+		replacement, ok := resp.JSON.(upgradeRoomResponse)
+		assert.Assert(t, ok)
+		assert.Assert(t, replacement.ReplacementRoom != roomIDStr)
+	})
+
+	t.Run("upgrade to an unsupported version", func(t *testing.T) {
+		resp := UpgradeRoom(newRequest(http.MethodPost, `{"new_version":"unknown"}`), device, cfg, roomIDStr, userAPI, rsAPI)
+		assert.Equal(t, resp.Code, http.StatusBadRequest)
+	})
+}
@@ -0,0 +1,413 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/util"
+
+	"github.com/neilalexander/harmony/clientapi/auth/sso"
+	"github.com/neilalexander/harmony/clientapi/userutil"
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/setup/config"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+const (
+	// ssoSessionLifetime is how long a user has to log in at the identity
+	// provider after being redirected to it.
+	ssoSessionLifetime = 10 * time.Minute
+
+	// ssoSessionCookie binds the login to the browser which started it, so
+	// that a user can't be tricked into completing someone else's login.
+	ssoSessionCookie = "harmony_sso_session"
+)
+
+// ssoSession is a login which is in progress at an identity provider, keyed by
+// the state parameter.
+type ssoSession struct {
+	providerID  string
+	redirectURL string
+	nonce       string
+	expires     time.Time
+}
+
+// SSOLogin implements single sign-on through OpenID Connect identity
+// providers. Users are sent to the identity provider by SSORedirect and come
+// back to SSOCallback, which hands a login token to the client.
+type SSOLogin struct {
+	cfg       *config.ClientAPI
+	userAPI   userapi.ClientUserAPI
+	providers []*sso.Provider
+	mu        sync.Mutex
+	sessions  map[string]*ssoSession
+}
+
+// NewSSOLogin creates the identity providers from the config.
+func NewSSOLogin(cfg *config.ClientAPI, userAPI userapi.ClientUserAPI, client *http.Client) (*SSOLogin, error) {
+	l := &SSOLogin{
+		cfg:      cfg,
+		userAPI:  userAPI,
+		sessions: map[string]*ssoSession{},
+	}
+	for i := range cfg.SSO.Providers {
+		p, err := sso.NewProvider(&cfg.SSO.Providers[i], client)
+		if err != nil {
+			return nil, err
+		}
+		l.providers = append(l.providers, p)
+	}
+	return l, nil
+}
+
+func (l *SSOLogin) provider(id string) *sso.Provider {
+	for _, p := range l.providers {
+		if p.ID() == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// SSORedirect implements GET /login/sso/redirect and
+// GET /login/sso/redirect/{idpId}. If no identity provider is given then the
+// first one in the config is used.
+func (l *SSOLogin) SSORedirect(w http.ResponseWriter, req *http.Request, idpID string) {
+	redirectURL := req.URL.Query().Get("redirectUrl")
+	if !l.isAllowedRedirectURL(redirectURL) {
+		writeHTTPMessage(w, req, "Missing or invalid redirectUrl", http.StatusBadRequest)
+		return
+	}
+	if idpID == "" {
+		idpID = l.providers[0].ID()
+	}
+	provider := l.provider(idpID)
+	if provider == nil {
+		writeHTTPMessage(w, req, "Unknown identity provider", http.StatusNotFound)
+		return
+	}
+
+	state, err := randomString()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("randomString failed")
+		writeHTTPMessage(w, req, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	nonce, err := randomString()
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("randomString failed")
+		writeHTTPMessage(w, req, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	authURL, err := provider.AuthorizationURL(req.Context(), l.cfg.SSO.CallbackURL, state, nonce)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("idp_id", idpID).Error("Failed to build authorization URL")
+		writeHTTPMessage(w, req, "Failed to contact the identity provider", http.StatusBadGateway)
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	for s, session := range l.sessions {
+		if now.After(session.expires) {
+			delete(l.sessions, s)
+		}
+	}
+	l.sessions[state] = &ssoSession{
+		providerID:  idpID,
+		redirectURL: redirectURL,
+		nonce:       nonce,
+		expires:     now.Add(ssoSessionLifetime),
+	}
+	l.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     ssoSessionCookie,
+		Value:    state,
+		Path:     "/_matrix/client/",
+		MaxAge:   int(ssoSessionLifetime.Seconds()),
+		Secure:   strings.HasPrefix(l.cfg.SSO.CallbackURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, req, authURL, http.StatusFound)
+}
+
+// SSOCallback implements GET /login/sso/callback, which the identity provider
+// redirects users back to. Users who haven't logged in before get a new
+// account, and the client receives a login token for the account.
+func (l *SSOLogin) SSOCallback(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	state := query.Get("state")
+	cookie, err := req.Cookie(ssoSessionCookie)
+	if err != nil || state == "" || cookie.Value != state {
+		writeHTTPMessage(w, req, "Unknown or expired login session", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:   ssoSessionCookie,
+		Path:   "/_matrix/client/",
+		MaxAge: -1,
+	})
+
+	l.mu.Lock()
+	session, ok := l.sessions[state]
+	delete(l.sessions, state)
+	l.mu.Unlock()
+	if !ok || time.Now().After(session.expires) {
+		writeHTTPMessage(w, req, "Unknown or expired login session", http.StatusBadRequest)
+		return
+	}
+	if errCode := query.Get("error"); errCode != "" {
+		util.GetLogger(req.Context()).WithField("error", errCode).WithField("description", query.Get("error_description")).Warn("Identity provider returned an error")
+		writeHTTPMessage(w, req, "Login at the identity provider failed", http.StatusUnauthorized)
+		return
+	}
+	provider := l.provider(session.providerID)
+	if provider == nil {
+		writeHTTPMessage(w, req, "Unknown identity provider", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := provider.Exchange(req.Context(), l.cfg.SSO.CallbackURL, query.Get("code"), session.nonce)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("idp_id", provider.ID()).Warn("Failed to verify login at identity provider")
+		writeHTTPMessage(w, req, "Failed to verify the login at the identity provider", http.StatusUnauthorized)
+		return
+	}
+
+	userID, errMsg, code := l.accountForClaims(req, provider, claims)
+	if errMsg != "" {
+		writeHTTPMessage(w, req, errMsg, code)
+		return
+	}
+
+	var tokenRes userapi.PerformLoginTokenCreationResponse
+	if err = l.userAPI.PerformLoginTokenCreation(req.Context(), &userapi.PerformLoginTokenCreationRequest{
+		Data: userapi.LoginTokenData{UserID: userID},
+	}, &tokenRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("userAPI.PerformLoginTokenCreation failed")
+		writeHTTPMessage(w, req, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	redirectURL, err := url.Parse(session.redirectURL)
+	if err != nil {
+		writeHTTPMessage(w, req, "Invalid redirectUrl", http.StatusBadRequest)
+		return
+	}
+	redirectQuery := redirectURL.Query()
+	redirectQuery.Set("loginToken", tokenRes.Metadata.Token)
+	redirectURL.RawQuery = redirectQuery.Encode()
+	if l.isWhitelistedRedirectURL(session.redirectURL) {
+		http.Redirect(w, req, redirectURL.String(), http.StatusFound)
+		return
+	}
+
+	// Anyone can send a link to start logging in with any redirectUrl, so the
+	// user has to confirm that they trust the client before it gets the login
+	// token, unless the client is whitelisted.
+	target := redirectURL.Host
+	if target == "" {
+		target = redirectURL.Scheme
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err = ssoConfirmTemplate.Execute(w, struct {
+		ServerName spec.ServerName
+		Target     string
+		URL        template.URL
+	}{
+		ServerName: l.cfg.Matrix.ServerName,
+		Target:     target,
+		URL:        template.URL(redirectURL.String()), // nolint: gosec
+	}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("ssoConfirmTemplate.Execute failed")
+	}
+}
+
+// ssoConfirmTemplate asks the user to confirm that they want to log in to a
+// client which isn't in the client whitelist.
+var ssoConfirmTemplate = template.Must(template.New("sso_confirm").Parse(`
+<html>
+<head>
+<title>Continue login</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+</head>
+<body>
+    <div>
+        <p>You are about to give <b>{{.Target}}</b> access to your account on {{.ServerName}}.</p>
+        <p>If you didn't start logging in to {{.Target}}, close this page.</p>
+        <p><a href="{{.URL}}">Continue to {{.Target}}</a></p>
+    </div>
+</body>
+</html>
+`))
+
+// accountForClaims returns the user ID of the account that the user of the
+// identity provider logs in as, creating the account if this is their first
+// login. Returns an error message and status code if the login isn't possible.
+func (l *SSOLogin) accountForClaims(req *http.Request, provider *sso.Provider, claims sso.Claims) (string, string, int) {
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithField("idp_id", provider.ID()).WithField("subject", claims.Subject())
+
+	var externalRes userapi.QueryExternalIDResponse
+	if err := l.userAPI.QueryExternalID(ctx, &userapi.QueryExternalIDRequest{
+		AuthProvider: provider.ID(),
+		ExternalID:   claims.Subject(),
+	}, &externalRes); err != nil {
+		logger.WithError(err).Error("userAPI.QueryExternalID failed")
+		return "", "Internal server error", http.StatusInternalServerError
+	}
+	if externalRes.Localpart != "" {
+		if errMsg, code := l.checkNotDeactivated(ctx, externalRes.Localpart, externalRes.ServerName); errMsg != "" {
+			return "", errMsg, code
+		}
+		return userutil.MakeUserID(externalRes.Localpart, externalRes.ServerName), "", 0
+	}
+
+	localpart, err := provider.Localpart(claims)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to derive localpart from ID token claims")
+		return "", "The identity provider didn't provide a username", http.StatusBadRequest
+	}
+	localpart = strings.ToLower(localpart)
+	serverName := l.cfg.Matrix.ServerName
+	if err = internal.ValidateUsername(localpart, serverName); err != nil {
+		logger.WithError(err).WithField("localpart", localpart).Warn("Derived localpart is invalid")
+		return "", "The username from the identity provider isn't a valid Matrix username", http.StatusBadRequest
+	}
+
+	var availabilityRes userapi.QueryAccountAvailabilityResponse
+	if err = l.userAPI.QueryAccountAvailability(ctx, &userapi.QueryAccountAvailabilityRequest{
+		Localpart:  localpart,
+		ServerName: serverName,
+	}, &availabilityRes); err != nil {
+		logger.WithError(err).Error("userAPI.QueryAccountAvailability failed")
+		return "", "Internal server error", http.StatusInternalServerError
+	}
+	if !availabilityRes.Available {
+		if !provider.AllowExistingUsers() {
+			return "", "The username from the identity provider is already taken", http.StatusConflict
+		}
+		if errMsg, code := l.checkNotDeactivated(ctx, localpart, serverName); errMsg != "" {
+			return "", errMsg, code
+		}
+	}
+
+	if availabilityRes.Available {
+		var accountRes userapi.PerformAccountCreationResponse
+		if err = l.userAPI.PerformAccountCreation(ctx, &userapi.PerformAccountCreationRequest{
+			AccountType: userapi.AccountTypeUser,
+			Localpart:   localpart,
+			ServerName:  serverName,
+			OnConflict:  userapi.ConflictAbort,
+		}, &accountRes); err != nil {
+			if _, ok := err.(*userapi.ErrorConflict); ok {
+				return "", "The username from the identity provider is already taken", http.StatusConflict
+			}
+			logger.WithError(err).Error("userAPI.PerformAccountCreation failed")
+			return "", "Internal server error", http.StatusInternalServerError
+		}
+		amtRegUsers.Inc()
+		if displayName := provider.DisplayName(claims); displayName != "" {
+			if _, _, err = l.userAPI.SetDisplayName(ctx, localpart, serverName, displayName); err != nil {
+				logger.WithError(err).Warn("userAPI.SetDisplayName failed")
+			}
+		}
+	}
+
+	if err = l.userAPI.PerformExternalIDLink(ctx, &userapi.PerformExternalIDLinkRequest{
+		AuthProvider: provider.ID(),
+		ExternalID:   claims.Subject(),
+		Localpart:    localpart,
+		ServerName:   serverName,
+	}, &struct{}{}); err != nil {
+		logger.WithError(err).Error("userAPI.PerformExternalIDLink failed")
+		return "", "Internal server error", http.StatusInternalServerError
+	}
+	return userutil.MakeUserID(localpart, serverName), "", 0
+}
+
+// checkNotDeactivated returns an error message and status code if the account
+// has been deactivated.
+func (l *SSOLogin) checkNotDeactivated(ctx context.Context, localpart string, serverName spec.ServerName) (string, int) {
+	var accountRes userapi.QueryAccountByLocalpartResponse
+	if err := l.userAPI.QueryAccountByLocalpart(ctx, &userapi.QueryAccountByLocalpartRequest{
+		Localpart:  localpart,
+		ServerName: serverName,
+	}, &accountRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("userAPI.QueryAccountByLocalpart failed")
+		return "Internal server error", http.StatusInternalServerError
+	}
+	if accountRes.Account.Deactivated {
+		return "This account has been deactivated", http.StatusForbidden
+	}
+	return "", 0
+}
+
+// isAllowedRedirectURL returns whether the client may be redirected to the URL
+// after logging in. Clients which aren't whitelisted can only get the login
+// token once the user has confirmed it.
+func (l *SSOLogin) isAllowedRedirectURL(redirectURL string) bool {
+	u, err := url.Parse(redirectURL)
+	if err != nil || !u.IsAbs() {
+		return false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "javascript", "data", "vbscript":
+		return false
+	}
+	return true
+}
+
+// isWhitelistedRedirectURL returns whether the client may be redirected to the
+// URL without the user confirming it first.
+func (l *SSOLogin) isWhitelistedRedirectURL(redirectURL string) bool {
+	for _, prefix := range l.cfg.SSO.ClientWhitelist {
+		if strings.HasPrefix(redirectURL, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// identityProviders returns the identity providers to advertise in the
+// m.login.sso flow of GET /login.
+func identityProviders(cfg *config.SSO) []identityProvider {
+	idps := make([]identityProvider, 0, len(cfg.Providers))
+	for _, p := range cfg.Providers {
+		idps = append(idps, identityProvider{ID: p.ID, Name: p.Name})
+	}
+	return idps
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
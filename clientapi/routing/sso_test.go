@@ -0,0 +1,30 @@
+package routing
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+func TestSSORedirectURLs(t *testing.T) {
+	l := &SSOLogin{cfg: &config.ClientAPI{}}
+	for redirectURL, allowed := range map[string]bool{
+		"https://app.example.com/":  true,
+		"im.example.app://callback": true,
+		"/relative":                 false,
+		"javascript:alert(1)":       false,
+		"data:text/html,hello":      false,
+		"":                          false,
+	} {
+		assert.Equal(t, allowed, l.isAllowedRedirectURL(redirectURL), redirectURL)
+	}
+
+	// Nothing is whitelisted by default, so users always confirm the client.
+	assert.False(t, l.isWhitelistedRedirectURL("https://app.example.com/"))
+
+	l.cfg.SSO.ClientWhitelist = []string{"https://app.example.com/"}
+	assert.True(t, l.isWhitelistedRedirectURL("https://app.example.com/login"))
+	assert.False(t, l.isWhitelistedRedirectURL("https://app.example.com.attacker.com/"))
+}
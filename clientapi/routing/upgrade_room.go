@@ -16,6 +16,7 @@ package routing
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
 
 	"github.com/matrix-org/util"
@@ -65,6 +66,18 @@ func UpgradeRoom(
 			JSON: spec.InternalServerError{},
 		}
 	}
+
+	// Upgrades by shadow-banned users look successful, but the replacement
+	// room doesn't exist.
+	if device.ShadowBanned {
+		util.GetLogger(req.Context()).WithField("room_id", roomID).Info("Dropping room upgrade from shadow-banned user")
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: upgradeRoomResponse{
+				ReplacementRoom: fmt.Sprintf("!%s:%s", util.RandomString(16), userID.Domain()),
+			},
+		}
+	}
 	newRoomID, err := rsAPI.PerformRoomUpgrade(req.Context(), roomID, *userID, gomatrixserverlib.RoomVersion(r.NewVersion))
 	switch e := err.(type) {
 	case nil:
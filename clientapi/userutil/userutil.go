@@ -27,6 +27,13 @@ import (
 // If serverName is passed, it is verified against the domain obtained from usernameParam (if present)
 // Returns error in case of invalid usernameParam.
 func ParseUsernameParam(usernameParam string, cfg *config.Global) (string, spec.ServerName, error) {
+	return ParseUsernameParamForServer(usernameParam, cfg, cfg.ServerName)
+}
+
+// ParseUsernameParamForServer works like ParseUsernameParam, but a bare
+// localpart is assumed to belong to the given server name instead of the
+// main server name. This is used to respect virtual hosts.
+func ParseUsernameParamForServer(usernameParam string, cfg *config.Global, serverName spec.ServerName) (string, spec.ServerName, error) {
 	localpart := usernameParam
 
 	if strings.HasPrefix(usernameParam, "@") {
@@ -42,7 +49,10 @@ func ParseUsernameParam(usernameParam string, cfg *config.Global) (string, spec.
 
 		return lp, domain, nil
 	}
-	return localpart, cfg.ServerName, nil
+	if serverName == "" {
+		serverName = cfg.ServerName
+	}
+	return localpart, serverName, nil
 }
 
 // MakeUserID generates user ID from localpart & server name
@@ -95,3 +95,32 @@ func TestBadUserID(t *testing.T) {
 		t.Error("Illegal User ID should return an error")
 	}
 }
+
+// TestVirtualHostLocalpart checks that a localpart belongs to the given virtual
+// host and that user IDs for any local server name are accepted.
+func TestVirtualHostLocalpart(t *testing.T) {
+	virtualHost := spec.ServerName("virtualhost")
+	cfg := &config.Global{
+		SigningIdentity: fclient.SigningIdentity{
+			ServerName: serverName,
+		},
+		VirtualHosts: []*config.VirtualHost{
+			{SigningIdentity: fclient.SigningIdentity{ServerName: virtualHost}},
+		},
+	}
+
+	for _, host := range []spec.ServerName{serverName, virtualHost} {
+		lp, domain, err := ParseUsernameParamForServer(localpart, cfg, host)
+		if err != nil {
+			t.Fatal("Localpart parsing failed for ", host, " with error: ", err.Error())
+		}
+		if lp != localpart || domain != host {
+			t.Error("Incorrect user, returned: ", lp, ":", domain, " should be: ", localpart, ":", host)
+		}
+
+		userID := "@" + localpart + ":" + string(host)
+		if _, domain, err = ParseUsernameParamForServer(userID, cfg, serverName); err != nil || domain != host {
+			t.Error("User ID parsing failed for ", userID, ", returned domain: ", domain)
+		}
+	}
+}
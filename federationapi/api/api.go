@@ -38,6 +38,8 @@ type FederationInternalAPI interface {
 		request *PerformWakeupServersRequest,
 		response *PerformWakeupServersResponse,
 	) error
+	// Marks the servers as alive and retries anything queued for them.
+	MarkServersAlive(destinations []spec.ServerName)
 }
 
 type ClientFederationAPI interface {
@@ -59,6 +61,8 @@ type RoomserverFederationAPI interface {
 	PerformJoin(ctx context.Context, request *PerformJoinRequest, response *PerformJoinResponse)
 	// Handle an instruction to make_leave & send_leave with a remote server.
 	PerformLeave(ctx context.Context, request *PerformLeaveRequest, response *PerformLeaveResponse) error
+	// Handle an instruction to make_knock & send_knock with a remote server.
+	PerformKnock(ctx context.Context, request *PerformKnockRequest, response *PerformKnockResponse) error
 	// Handle sending an invite to a remote server.
 	SendInvite(ctx context.Context, event gomatrixserverlib.PDU, strippedState []gomatrixserverlib.InviteStrippedState) (gomatrixserverlib.PDU, error)
 	// Handle sending an invite to a remote server.
@@ -156,6 +160,20 @@ type PerformLeaveRequest struct {
 type PerformLeaveResponse struct {
 }
 
+type PerformKnockRequest struct {
+	RoomID string `json:"room_id"`
+	UserID string `json:"user_id"`
+	// The sorted list of servers to try. Servers will be tried sequentially, after de-duplication.
+	ServerNames types.ServerNames      `json:"server_names"`
+	Content     map[string]interface{} `json:"content"`
+}
+
+type PerformKnockResponse struct {
+	KnockedVia     spec.ServerName
+	Event          *rstypes.HeaderedEvent
+	KnockRoomState []gomatrixserverlib.InviteStrippedState
+}
+
 type PerformInviteRequest struct {
 	RoomVersion     gomatrixserverlib.RoomVersion           `json:"room_version"`
 	Event           *rstypes.HeaderedEvent                  `json:"event"`
@@ -338,6 +338,131 @@ func (r *FederationInternalAPI) PerformLeave(
 	)
 }
 
+// PerformKnock implements api.FederationInternalAPI
+func (r *FederationInternalAPI) PerformKnock(
+	ctx context.Context,
+	request *api.PerformKnockRequest,
+	response *api.PerformKnockResponse,
+) (err error) {
+	userID, err := spec.NewUserID(request.UserID, true)
+	if err != nil {
+		return err
+	}
+
+	// Only ask for room versions that actually support knocking, since
+	// there's no point in the remote side sending us a template for a
+	// room that we won't be able to knock on anyway.
+	supportedVersions := []gomatrixserverlib.RoomVersion{
+		gomatrixserverlib.RoomVersionV7,
+		gomatrixserverlib.RoomVersionV8,
+		gomatrixserverlib.RoomVersionV9,
+		gomatrixserverlib.RoomVersionV10,
+		gomatrixserverlib.RoomVersionV11,
+	}
+
+	// Deduplicate the server names we were provided.
+	util.SortAndUnique(request.ServerNames)
+
+	// Try each server that we were provided until we land on one that
+	// successfully completes the make-knock send-knock dance.
+	var lastErr error
+	for _, serverName := range request.ServerNames {
+		// Try to perform a make_knock using the information supplied in the
+		// request.
+		respMakeKnock, err := r.federation.MakeKnock(
+			ctx,
+			userID.Domain(),
+			serverName,
+			request.RoomID,
+			request.UserID,
+			supportedVersions,
+		)
+		if err != nil {
+			logrus.WithError(err).Warnf("r.federation.MakeKnock failed")
+			r.statistics.ForServer(serverName).Failure()
+			lastErr = err
+			continue
+		}
+
+		// Work out if we support the room version that has been supplied in
+		// the make_knock response.
+		verImpl, err := gomatrixserverlib.GetRoomVersion(respMakeKnock.RoomVersion)
+		if err != nil {
+			logrus.WithError(err).Warnf("make_knock returned an unsupported room version")
+			lastErr = err
+			continue
+		}
+		if verImpl.Version() == gomatrixserverlib.RoomVersionPseudoIDs {
+			lastErr = fmt.Errorf("knocking is not supported in room version %q", verImpl.Version())
+			continue
+		}
+
+		// Set all the fields to be what they should be, this should be a no-op
+		// but it's possible that the remote server returned us something "odd"
+		senderIDString := userID.String()
+		respMakeKnock.KnockEvent.Type = spec.MRoomMember
+		respMakeKnock.KnockEvent.SenderID = senderIDString
+		respMakeKnock.KnockEvent.StateKey = &senderIDString
+		respMakeKnock.KnockEvent.RoomID = request.RoomID
+		respMakeKnock.KnockEvent.Redacts = ""
+		knockEB := verImpl.NewEventBuilderFromProtoEvent(&respMakeKnock.KnockEvent)
+
+		if request.Content == nil {
+			request.Content = map[string]interface{}{}
+		}
+		request.Content["membership"] = spec.Knock
+		if err = knockEB.SetContent(request.Content); err != nil {
+			logrus.WithError(err).Warnf("respMakeKnock.KnockEvent.SetContent failed")
+			continue
+		}
+		if err = knockEB.SetUnsigned(struct{}{}); err != nil {
+			logrus.WithError(err).Warnf("respMakeKnock.KnockEvent.SetUnsigned failed")
+			continue
+		}
+
+		// Build the knock event.
+		event, err := knockEB.Build(
+			time.Now(),
+			userID.Domain(),
+			r.cfg.Matrix.KeyID,
+			r.cfg.Matrix.PrivateKey,
+		)
+		if err != nil {
+			logrus.WithError(err).Warnf("respMakeKnock.KnockEvent.Build failed")
+			continue
+		}
+
+		// Try to perform a send_knock using the newly built event.
+		respSendKnock, err := r.federation.SendKnock(
+			ctx,
+			userID.Domain(),
+			serverName,
+			event,
+		)
+		if err != nil {
+			logrus.WithError(err).Warnf("r.federation.SendKnock failed")
+			r.statistics.ForServer(serverName).Failure()
+			lastErr = err
+			continue
+		}
+
+		r.statistics.ForServer(serverName).Success()
+		response.KnockedVia = serverName
+		response.Event = &types.HeaderedEvent{PDU: event}
+		response.KnockRoomState = respSendKnock.KnockRoomState
+		return nil
+	}
+
+	// If we reach here then we didn't complete a knock for some reason.
+	if lastErr != nil {
+		return lastErr
+	}
+	return fmt.Errorf(
+		"failed to knock on room %q through %d server(s)",
+		request.RoomID, len(request.ServerNames),
+	)
+}
+
 // SendInvite implements api.FederationInternalAPI
 func (r *FederationInternalAPI) SendInvite(
 	ctx context.Context,
@@ -313,6 +313,10 @@ func handleInviteResult(ctx context.Context, inviteEvent gomatrixserverlib.PDU,
 		}
 	}
 
+	if resErr := checkRoomNotBlocked(ctx, rsAPI, inviteEvent.RoomID()); resErr != nil {
+		return nil, resErr
+	}
+
 	headeredInvite := &types.HeaderedEvent{PDU: inviteEvent}
 	if err = rsAPI.HandleInvite(ctx, headeredInvite); err != nil {
 		util.GetLogger(ctx).WithError(err).Error("HandleInvite failed")
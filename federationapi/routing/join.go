@@ -42,6 +42,10 @@ func MakeJoin(
 	roomID spec.RoomID, userID spec.UserID,
 	remoteVersions []gomatrixserverlib.RoomVersion,
 ) util.JSONResponse {
+	if resErr := checkRoomNotBlocked(httpReq.Context(), rsAPI, roomID); resErr != nil {
+		return *resErr
+	}
+
 	roomVersion, err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), roomID.String())
 	if err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("failed obtaining room version")
@@ -199,6 +203,10 @@ func SendJoin(
 	roomID spec.RoomID,
 	eventID string,
 ) util.JSONResponse {
+	if resErr := checkRoomNotBlocked(httpReq.Context(), rsAPI, roomID); resErr != nil {
+		return *resErr
+	}
+
 	roomVersion, err := rsAPI.QueryRoomVersionForRoom(httpReq.Context(), roomID.String())
 	if err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("rsAPI.QueryRoomVersionForRoom failed")
@@ -364,3 +372,23 @@ func (e eventsByDepth) Swap(i, j int) {
 func (e eventsByDepth) Less(i, j int) bool {
 	return e[i].Depth() < e[j].Depth()
 }
+
+// checkRoomNotBlocked returns an error response if an admin has blocked the
+// room, so that remote users can't join it through this server.
+func checkRoomNotBlocked(ctx context.Context, rsAPI api.FederationRoomserverAPI, roomID spec.RoomID) *util.JSONResponse {
+	blocked, err := rsAPI.QueryRoomBlocked(ctx, roomID.String())
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryRoomBlocked failed")
+		return &util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if blocked {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("This room has been blocked on this server"),
+		}
+	}
+	return nil
+}
@@ -206,8 +206,12 @@ func NotaryKeys(
 	fsAPI federationAPI.FederationInternalAPI,
 	req *gomatrixserverlib.PublicKeyNotaryLookupRequest,
 ) util.JSONResponse {
-	serverName := spec.ServerName(httpReq.Host) // TODO: this is not ideal
-	if !cfg.Matrix.IsLocalServerName(serverName) {
+	// The response is signed by whichever of our server names the request
+	// arrived for, so that virtual hosts can act as notaries too.
+	identity, err := cfg.Matrix.SigningIdentityFor(
+		cfg.Matrix.ServerNameForHTTPHost(spec.ServerName(httpReq.Host)),
+	)
+	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: spec.NotFound("Server name not known"),
@@ -227,7 +231,7 @@ func NotaryKeys(
 
 	for serverName, kidToCriteria := range req.ServerKeys {
 		var keyList []gomatrixserverlib.ServerKeys
-		if serverName == cfg.Matrix.ServerName {
+		if cfg.Matrix.IsLocalServerName(serverName) {
 			if k, err := localKeys(cfg, serverName); err == nil {
 				keyList = append(keyList, *k)
 			} else {
@@ -259,7 +263,7 @@ func NotaryKeys(
 			}
 
 			js, err := gomatrixserverlib.SignJSON(
-				string(cfg.Matrix.ServerName), cfg.Matrix.KeyID, cfg.Matrix.PrivateKey, j,
+				string(identity.ServerName), identity.KeyID, identity.PrivateKey, j,
 			)
 			if err != nil {
 				logrus.WithError(err).Errorf("Failed to sign %q response", serverName)
@@ -0,0 +1,296 @@
+package routing
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/test"
+)
+
+const (
+	knockTestRemote      = spec.ServerName("remote")
+	knockTestRemoteKeyID = gomatrixserverlib.KeyID("ed25519:remote")
+)
+
+// knockTestRoomserverAPI serves a single room, which this server is joined to.
+type knockTestRoomserverAPI struct {
+	api.FederationRoomserverAPI
+	room   *test.Room
+	inputs []api.InputRoomEvent
+}
+
+func (r *knockTestRoomserverAPI) QueryServerJoinedToRoom(ctx context.Context, req *api.QueryServerJoinedToRoomRequest, res *api.QueryServerJoinedToRoomResponse) error {
+	if req.RoomID == r.room.ID {
+		res.RoomExists = true
+		res.IsInRoom = true
+		res.RoomVersion = r.room.Version
+	}
+	return nil
+}
+
+func (r *knockTestRoomserverAPI) QueryRoomVersionForRoom(ctx context.Context, roomID string) (gomatrixserverlib.RoomVersion, error) {
+	if roomID != r.room.ID {
+		return "", fmt.Errorf("missing room info for room %s", roomID)
+	}
+	return r.room.Version, nil
+}
+
+func (r *knockTestRoomserverAPI) QueryLatestEventsAndState(ctx context.Context, req *api.QueryLatestEventsAndStateRequest, res *api.QueryLatestEventsAndStateResponse) error {
+	if req.RoomID != r.room.ID {
+		return nil
+	}
+	res.RoomExists = true
+	res.RoomVersion = r.room.Version
+	res.StateEvents = r.room.CurrentState()
+	res.LatestEvents = r.room.ForwardExtremities()
+	res.Depth = int64(len(r.room.Events()) + 1)
+	return nil
+}
+
+func (r *knockTestRoomserverAPI) QuerySenderIDForUser(ctx context.Context, roomID spec.RoomID, userID spec.UserID) (*spec.SenderID, error) {
+	senderID := spec.SenderIDFromUserID(userID)
+	return &senderID, nil
+}
+
+func (r *knockTestRoomserverAPI) QueryUserIDForSender(ctx context.Context, roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	return senderID.ToUserID(), nil
+}
+
+func (r *knockTestRoomserverAPI) InputRoomEvents(ctx context.Context, req *api.InputRoomEventsRequest, res *api.InputRoomEventsResponse) {
+	r.inputs = append(r.inputs, req.InputRoomEvents...)
+}
+
+func (r *knockTestRoomserverAPI) StateQuerier() gomatrixserverlib.StateQuerier {
+	return r
+}
+
+func (r *knockTestRoomserverAPI) GetAuthEvents(ctx context.Context, event gomatrixserverlib.PDU) (gomatrixserverlib.AuthEventProvider, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (r *knockTestRoomserverAPI) GetState(ctx context.Context, roomID spec.RoomID, stateWanted []gomatrixserverlib.StateKeyTuple) ([]gomatrixserverlib.PDU, error) {
+	var state []gomatrixserverlib.PDU
+	for _, ev := range r.room.CurrentState() {
+		for _, tuple := range stateWanted {
+			if ev.Type() == tuple.EventType && ev.StateKeyEquals(tuple.StateKey) {
+				state = append(state, ev.PDU)
+			}
+		}
+	}
+	return state, nil
+}
+
+// knockTestKeyRing knows the key of the remote server.
+type knockTestKeyRing struct{}
+
+func (k knockTestKeyRing) VerifyJSONs(ctx context.Context, requests []gomatrixserverlib.VerifyJSONRequest) ([]gomatrixserverlib.VerifyJSONResult, error) {
+	results := make([]gomatrixserverlib.VerifyJSONResult, len(requests))
+	for i, req := range requests {
+		if req.ServerName != knockTestRemote {
+			results[i].Error = fmt.Errorf("unknown server %s", req.ServerName)
+			continue
+		}
+		results[i].Error = gomatrixserverlib.VerifyJSON(string(req.ServerName), knockTestRemoteKeyID, test.PrivateKeyA.Public().(ed25519.PublicKey), req.Message)
+	}
+	return results, nil
+}
+
+func newKnockTestConfig() *config.FederationAPI {
+	return &config.FederationAPI{
+		Matrix: &config.Global{
+			SigningIdentity: fclient.SigningIdentity{
+				ServerName: "test",
+				KeyID:      "ed25519:test",
+				PrivateKey: test.PrivateKeyB,
+			},
+			VirtualHosts: []*config.VirtualHost{{
+				SigningIdentity: fclient.SigningIdentity{
+					ServerName: "vh1",
+					KeyID:      "ed25519:vh1",
+					PrivateKey: test.PrivateKeyB,
+				},
+			}},
+		},
+	}
+}
+
+// buildMembershipEvent builds a membership event for the sender without
+// checking whether it is allowed, so that invalid events can be sent too.
+func buildMembershipEvent(t *testing.T, room *test.Room, sender *test.User, membership string, privateKey ed25519.PrivateKey) gomatrixserverlib.PDU {
+	t.Helper()
+	proto := gomatrixserverlib.ProtoEvent{
+		SenderID:   sender.ID,
+		RoomID:     room.ID,
+		Type:       spec.MRoomMember,
+		StateKey:   &sender.ID,
+		Depth:      int64(len(room.Events()) + 1),
+		PrevEvents: room.ForwardExtremities(),
+	}
+	if err := proto.SetContent(gomatrixserverlib.MemberContent{Membership: membership}); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	needed, err := gomatrixserverlib.StateNeededForProtoEvent(&proto)
+	if err != nil {
+		t.Fatalf("failed to get the state needed: %s", err)
+	}
+	proto.AuthEvents = room.MustGetAuthEventRefsForEvent(t, needed)
+	ev, err := gomatrixserverlib.MustGetRoomVersion(room.Version).NewEventBuilderFromProtoEvent(&proto).Build(
+		time.Now(), knockTestRemote, knockTestRemoteKeyID, privateKey,
+	)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev
+}
+
+func newKnockTestRoom(t *testing.T, joinRule string) (*test.Room, *test.User) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t, test.WithSigningServer(knockTestRemote, knockTestRemoteKeyID, test.PrivateKeyA))
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{
+		"join_rule": joinRule,
+	}, test.WithStateKey(""))
+	return room, bob
+}
+
+func TestMakeKnock(t *testing.T) {
+	room, bob := newKnockTestRoom(t, spec.Knock)
+	rsAPI := &knockTestRoomserverAPI{room: room}
+	cfg := newKnockTestConfig()
+	roomID, err := spec.NewRoomID(room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := spec.NewUserID(bob.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownRoomID, err := spec.NewRoomID("!unknown:test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherUserID, err := spec.NewUserID("@charlie:other", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := []gomatrixserverlib.RoomVersion{room.Version}
+
+	for _, tc := range []struct {
+		name        string
+		destination spec.ServerName
+		roomID      spec.RoomID
+		userID      spec.UserID
+		versions    []gomatrixserverlib.RoomVersion
+		wantCode    int
+	}{
+		{name: "success", destination: "test", roomID: *roomID, userID: *userID, versions: versions, wantCode: http.StatusOK},
+		{name: "success on a virtual host", destination: "vh1", roomID: *roomID, userID: *userID, versions: versions, wantCode: http.StatusOK},
+		{name: "unknown server name", destination: "other", roomID: *roomID, userID: *userID, versions: versions, wantCode: http.StatusNotFound},
+		{name: "unknown room", destination: "test", roomID: *unknownRoomID, userID: *userID, versions: versions, wantCode: http.StatusNotFound},
+		{name: "unsupported room version", destination: "test", roomID: *roomID, userID: *userID, versions: []gomatrixserverlib.RoomVersion{"1"}, wantCode: http.StatusBadRequest},
+		{name: "user from another server", destination: "test", roomID: *roomID, userID: *otherUserID, versions: versions, wantCode: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			request := fclient.NewFederationRequest(http.MethodGet, knockTestRemote, tc.destination, "/make_knock")
+			httpReq := httptest.NewRequest(http.MethodGet, "/make_knock", nil)
+			res := MakeKnock(httpReq, &request, cfg, rsAPI, tc.roomID, tc.userID, tc.versions)
+			if res.Code != tc.wantCode {
+				t.Fatalf("got %d, want %d: %+v", res.Code, tc.wantCode, res.JSON)
+			}
+		})
+	}
+
+	t.Run("join rules don't allow knocking", func(t *testing.T) {
+		publicRoom, _ := newKnockTestRoom(t, spec.Public)
+		publicRoomID, err := spec.NewRoomID(publicRoom.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := fclient.NewFederationRequest(http.MethodGet, knockTestRemote, "test", "/make_knock")
+		httpReq := httptest.NewRequest(http.MethodGet, "/make_knock", nil)
+		res := MakeKnock(httpReq, &request, cfg, &knockTestRoomserverAPI{room: publicRoom}, *publicRoomID, *userID, versions)
+		if res.Code != http.StatusForbidden {
+			t.Fatalf("got %d, want %d: %+v", res.Code, http.StatusForbidden, res.JSON)
+		}
+	})
+}
+
+func TestSendKnock(t *testing.T) {
+	room, bob := newKnockTestRoom(t, spec.Knock)
+	cfg := newKnockTestConfig()
+	roomID, err := spec.NewRoomID(room.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sendKnock := func(t *testing.T, rsAPI *knockTestRoomserverAPI, origin, destination spec.ServerName, ev gomatrixserverlib.PDU) int {
+		t.Helper()
+		request := fclient.NewFederationRequest(http.MethodPut, origin, destination, "/send_knock")
+		if err := request.SetContent(json.RawMessage(ev.JSON())); err != nil {
+			t.Fatalf("failed to set content: %s", err)
+		}
+		httpReq := httptest.NewRequest(http.MethodPut, "/send_knock", nil)
+		res := SendKnock(httpReq, &request, cfg, rsAPI, knockTestKeyRing{}, *roomID, ev.EventID())
+		return res.Code
+	}
+
+	t.Run("success on a virtual host", func(t *testing.T) {
+		rsAPI := &knockTestRoomserverAPI{room: room}
+		ev := buildMembershipEvent(t, room, bob, spec.Knock, test.PrivateKeyA)
+		if code := sendKnock(t, rsAPI, knockTestRemote, "vh1", ev); code != http.StatusOK {
+			t.Fatalf("got %d, want %d", code, http.StatusOK)
+		}
+		if len(rsAPI.inputs) != 1 {
+			t.Fatalf("got %d input events, want 1", len(rsAPI.inputs))
+		}
+		if rsAPI.inputs[0].SendAsServer != "vh1" {
+			t.Fatalf("knock sent as %q, want %q", rsAPI.inputs[0].SendAsServer, "vh1")
+		}
+	})
+
+	for _, tc := range []struct {
+		name       string
+		membership string
+		origin     spec.ServerName
+		privateKey ed25519.PrivateKey
+		wantCode   int
+	}{
+		{name: "wrong membership", membership: spec.Join, origin: knockTestRemote, privateKey: test.PrivateKeyA, wantCode: http.StatusBadRequest},
+		{name: "sender from another server", membership: spec.Knock, origin: "other", privateKey: test.PrivateKeyA, wantCode: http.StatusForbidden},
+		{name: "bad signature", membership: spec.Knock, origin: knockTestRemote, privateKey: test.PrivateKeyB, wantCode: http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rsAPI := &knockTestRoomserverAPI{room: room}
+			ev := buildMembershipEvent(t, room, bob, tc.membership, tc.privateKey)
+			if code := sendKnock(t, rsAPI, tc.origin, "test", ev); code != tc.wantCode {
+				t.Fatalf("got %d, want %d", code, tc.wantCode)
+			}
+			if len(rsAPI.inputs) != 0 {
+				t.Fatalf("got %d input events, want none", len(rsAPI.inputs))
+			}
+		})
+	}
+
+	t.Run("unknown room", func(t *testing.T) {
+		otherRoom, _ := newKnockTestRoom(t, spec.Knock)
+		rsAPI := &knockTestRoomserverAPI{room: otherRoom}
+		ev := buildMembershipEvent(t, room, bob, spec.Knock, test.PrivateKeyA)
+		if code := sendKnock(t, rsAPI, knockTestRemote, "test", ev); code == http.StatusOK {
+			t.Fatal("expected the knock to be rejected")
+		}
+		if len(rsAPI.inputs) != 0 {
+			t.Fatalf("got %d input events, want none", len(rsAPI.inputs))
+		}
+	})
+}
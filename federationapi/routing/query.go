@@ -55,7 +55,7 @@ func RoomAliasToID(
 
 	var resp fclient.RespDirectory
 
-	if domain == cfg.Matrix.ServerName {
+	if cfg.Matrix.IsLocalServerName(domain) {
 		queryReq := &roomserverAPI.GetRoomIDForAliasRequest{
 			Alias:              roomAlias,
 			IncludeAppservices: true,
@@ -18,8 +18,6 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"sync"
-	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/util"
@@ -30,6 +28,7 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/httputil"
+	"github.com/neilalexander/harmony/internal/transactions"
 	"github.com/neilalexander/harmony/roomserver/api"
 	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/setup/config"
@@ -61,7 +60,8 @@ func Setup(
 	federation fclient.FederationClient,
 	userAPI userapi.FederationUserAPI,
 	mscCfg *config.MSCs,
-	producer *producers.SyncAPIProducer, enableMetrics bool,
+	producer *producers.SyncAPIProducer,
+	txnCache *transactions.Cache, enableMetrics bool,
 ) {
 	fedMux := routers.Federation
 	keyMux := routers.Keys
@@ -79,7 +79,7 @@ func Setup(
 	v2fedmux := fedMux.PathPrefix("/v2").Subrouter()
 	v3fedmux := fedMux.PathPrefix("/v3").Subrouter()
 
-	wakeup := &FederationWakeups{
+	wakeup := &httputil.FederationWakeups{
 		FsAPI: fsAPI,
 	}
 
@@ -109,18 +109,27 @@ func Setup(
 
 	if cfg.Matrix.WellKnownServerName != "" {
 		logrus.Infof("Setting m.server as %s at /.well-known/matrix/server", cfg.Matrix.WellKnownServerName)
-		wkMux.Handle("/server", httputil.MakeExternalAPI("wellknown", func(req *http.Request) util.JSONResponse {
+	}
+	// Virtual hosts may advertise their own delegated server name, so the
+	// handler is registered even if there is no global value.
+	wkMux.Handle("/server", httputil.MakeExternalAPI("wellknown", func(req *http.Request) util.JSONResponse {
+		serverName := cfg.Matrix.WellKnownServerNameForHTTPHost(spec.ServerName(req.Host))
+		if serverName == "" {
 			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: struct {
-					ServerName string `json:"m.server"`
-				}{
-					ServerName: cfg.Matrix.WellKnownServerName,
-				},
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound("No server well-known is configured for this host"),
 			}
-		}),
-		).Methods(http.MethodGet, http.MethodOptions)
-	}
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct {
+				ServerName string `json:"m.server"`
+			}{
+				ServerName: serverName,
+			},
+		}
+	}),
+	).Methods(http.MethodGet, http.MethodOptions)
 
 	// Ignore the {keyID} argument as we only have a single server key so we always
 	// return that key.
@@ -133,17 +142,17 @@ func Setup(
 	v2keysmux.Handle("/query/{serverName}/{keyID}", notaryKeys).Methods(http.MethodGet)
 
 	mu := internal.NewMutexByRoom()
-	v1fedmux.Handle("/send/{txnID}", MakeFedAPI(
+	v1fedmux.Handle("/send/{txnID}", httputil.MakeFedAPI(
 		"federation_send", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return Send(
 				httpReq, request, gomatrixserverlib.TransactionID(vars["txnID"]),
-				cfg, rsAPI, userAPI, keys, federation, mu, producer,
+				cfg, rsAPI, userAPI, keys, federation, mu, producer, txnCache,
 			)
 		},
 	)).Methods(http.MethodPut, http.MethodOptions).Name(SendRouteName)
 
-	v1fedmux.Handle("/invite/{roomID}/{eventID}", MakeFedAPI(
+	v1fedmux.Handle("/invite/{roomID}/{eventID}", httputil.MakeFedAPI(
 		"federation_invite", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
@@ -167,7 +176,7 @@ func Setup(
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
 
-	v2fedmux.Handle("/invite/{roomID}/{eventID}", MakeFedAPI(
+	v2fedmux.Handle("/invite/{roomID}/{eventID}", httputil.MakeFedAPI(
 		"federation_invite", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
@@ -191,7 +200,7 @@ func Setup(
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
 
-	v3fedmux.Handle("/invite/{roomID}/{userID}", MakeFedAPI(
+	v3fedmux.Handle("/invite/{roomID}/{userID}", httputil.MakeFedAPI(
 		"federation_invite", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
@@ -222,7 +231,7 @@ func Setup(
 		},
 	)).Methods(http.MethodPut, http.MethodOptions)
 
-	v1fedmux.Handle("/event/{eventID}", MakeFedAPI(
+	v1fedmux.Handle("/event/{eventID}", httputil.MakeFedAPI(
 		"federation_get_event", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return GetEvent(
@@ -231,7 +240,7 @@ func Setup(
 		},
 	)).Methods(http.MethodGet)
 
-	v1fedmux.Handle("/state/{roomID}", MakeFedAPI(
+	v1fedmux.Handle("/state/{roomID}", httputil.MakeFedAPI(
 		"federation_get_state", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
@@ -246,7 +255,7 @@ func Setup(
 		},
 	)).Methods(http.MethodGet)
 
-	v1fedmux.Handle("/state_ids/{roomID}", MakeFedAPI(
+	v1fedmux.Handle("/state_ids/{roomID}", httputil.MakeFedAPI(
 		"federation_get_state_ids", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
@@ -261,7 +270,7 @@ func Setup(
 		},
 	)).Methods(http.MethodGet)
 
-	v1fedmux.Handle("/event_auth/{roomID}/{eventID}", MakeFedAPI(
+	v1fedmux.Handle("/event_auth/{roomID}/{eventID}", httputil.MakeFedAPI(
 		"federation_get_event_auth", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
@@ -276,7 +285,7 @@ func Setup(
 		},
 	)).Methods(http.MethodGet)
 
-	v1fedmux.Handle("/query/directory", MakeFedAPI(
+	v1fedmux.Handle("/query/directory", httputil.MakeFedAPI(
 		"federation_query_room_alias", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return RoomAliasToID(
@@ -285,7 +294,7 @@ func Setup(
 		},
 	)).Methods(http.MethodGet).Name(QueryDirectoryRouteName)
 
-	v1fedmux.Handle("/query/profile", MakeFedAPI(
+	v1fedmux.Handle("/query/profile", httputil.MakeFedAPI(
 		"federation_query_profile", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return GetProfile(
@@ -294,7 +303,7 @@ func Setup(
 		},
 	)).Methods(http.MethodGet).Name(QueryProfileRouteName)
 
-	v1fedmux.Handle("/user/devices/{userID}", MakeFedAPI(
+	v1fedmux.Handle("/user/devices/{userID}", httputil.MakeFedAPI(
 		"federation_user_devices", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return GetUserDevices(
@@ -303,7 +312,7 @@ func Setup(
 		},
 	)).Methods(http.MethodGet)
 
-	v1fedmux.Handle("/make_join/{roomID}/{userID}", MakeFedAPI(
+	v1fedmux.Handle("/make_join/{roomID}/{userID}", httputil.MakeFedAPI(
 		"federation_make_join", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
@@ -349,7 +358,7 @@ func Setup(
 		},
 	)).Methods(http.MethodGet)
 
-	v1fedmux.Handle("/send_join/{roomID}/{eventID}", MakeFedAPI(
+	v1fedmux.Handle("/send_join/{roomID}/{eventID}", httputil.MakeFedAPI(
 		"federation_send_join", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
@@ -388,7 +397,7 @@ func Setup(
 		},
 	)).Methods(http.MethodPut)
 
-	v2fedmux.Handle("/send_join/{roomID}/{eventID}", MakeFedAPI(
+	v2fedmux.Handle("/send_join/{roomID}/{eventID}", httputil.MakeFedAPI(
 		"federation_send_join", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
@@ -412,7 +421,7 @@ func Setup(
 		},
 	)).Methods(http.MethodPut)
 
-	v1fedmux.Handle("/make_leave/{roomID}/{userID}", MakeFedAPI(
+	v1fedmux.Handle("/make_leave/{roomID}/{userID}", httputil.MakeFedAPI(
 		"federation_make_leave", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
@@ -441,7 +450,7 @@ func Setup(
 		},
 	)).Methods(http.MethodGet)
 
-	v1fedmux.Handle("/send_leave/{roomID}/{eventID}", MakeFedAPI(
+	v1fedmux.Handle("/send_leave/{roomID}/{eventID}", httputil.MakeFedAPI(
 		"federation_send_leave", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
@@ -473,7 +482,7 @@ func Setup(
 		},
 	)).Methods(http.MethodPut)
 
-	v2fedmux.Handle("/send_leave/{roomID}/{eventID}", MakeFedAPI(
+	v2fedmux.Handle("/send_leave/{roomID}/{eventID}", httputil.MakeFedAPI(
 		"federation_send_leave", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
@@ -490,6 +499,66 @@ func Setup(
 		},
 	)).Methods(http.MethodPut)
 
+	v1fedmux.Handle("/make_knock/{roomID}/{userID}", httputil.MakeFedAPI(
+		"federation_make_knock", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
+			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: spec.Forbidden("Forbidden by server ACLs"),
+				}
+			}
+			// Unlike make_join, the ?ver= parameter is required for make_knock,
+			// so there is no need to fall back to room version 1 here.
+			remoteVersions := []gomatrixserverlib.RoomVersion{}
+			for _, v := range httpReq.URL.Query()["ver"] {
+				remoteVersions = append(remoteVersions, gomatrixserverlib.RoomVersion(v))
+			}
+
+			userID, err := spec.NewUserID(vars["userID"], true)
+			if err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: spec.InvalidParam("Invalid UserID"),
+				}
+			}
+			roomID, err := spec.NewRoomID(vars["roomID"])
+			if err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: spec.InvalidParam("Invalid RoomID"),
+				}
+			}
+
+			logrus.Debugf("Processing make_knock for user %s, room %s", userID.String(), roomID.String())
+			return MakeKnock(
+				httpReq, request, cfg, rsAPI, *roomID, *userID, remoteVersions,
+			)
+		},
+	)).Methods(http.MethodGet)
+
+	v1fedmux.Handle("/send_knock/{roomID}/{eventID}", httputil.MakeFedAPI(
+		"federation_send_knock", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
+		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
+			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
+				return util.JSONResponse{
+					Code: http.StatusForbidden,
+					JSON: spec.Forbidden("Forbidden by server ACLs"),
+				}
+			}
+			roomID, err := spec.NewRoomID(vars["roomID"])
+			if err != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: spec.InvalidParam("Invalid RoomID"),
+				}
+			}
+			return SendKnock(
+				httpReq, request, cfg, rsAPI, keys, *roomID, vars["eventID"],
+			)
+		},
+	)).Methods(http.MethodPut)
+
 	v1fedmux.Handle("/version", httputil.MakeExternalAPI(
 		"federation_version",
 		func(httpReq *http.Request) util.JSONResponse {
@@ -497,7 +566,7 @@ func Setup(
 		},
 	)).Methods(http.MethodGet)
 
-	v1fedmux.Handle("/get_missing_events/{roomID}", MakeFedAPI(
+	v1fedmux.Handle("/get_missing_events/{roomID}", httputil.MakeFedAPI(
 		"federation_get_missing_events", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
@@ -510,7 +579,7 @@ func Setup(
 		},
 	)).Methods(http.MethodPost)
 
-	v1fedmux.Handle("/backfill/{roomID}", MakeFedAPI(
+	v1fedmux.Handle("/backfill/{roomID}", httputil.MakeFedAPI(
 		"federation_backfill", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			if roomserverAPI.IsServerBannedFromRoom(httpReq.Context(), rsAPI, vars["roomID"], request.Origin()) {
@@ -529,21 +598,21 @@ func Setup(
 		}),
 	).Methods(http.MethodGet, http.MethodPost)
 
-	v1fedmux.Handle("/user/keys/claim", MakeFedAPI(
+	v1fedmux.Handle("/user/keys/claim", httputil.MakeFedAPI(
 		"federation_keys_claim", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
-			return ClaimOneTimeKeys(httpReq, request, userAPI, cfg.Matrix.ServerName)
+			return ClaimOneTimeKeys(httpReq, request, userAPI, request.Destination())
 		},
 	)).Methods(http.MethodPost)
 
-	v1fedmux.Handle("/user/keys/query", MakeFedAPI(
+	v1fedmux.Handle("/user/keys/query", httputil.MakeFedAPI(
 		"federation_keys_query", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
-			return QueryDeviceKeys(httpReq, request, userAPI, cfg.Matrix.ServerName)
+			return QueryDeviceKeys(httpReq, request, userAPI, request.Destination())
 		},
 	)).Methods(http.MethodPost)
 
-	v1fedmux.Handle("/hierarchy/{roomID}", MakeFedAPI(
+	v1fedmux.Handle("/hierarchy/{roomID}", httputil.MakeFedAPI(
 		"federation_room_hierarchy", cfg.Matrix.ServerName, cfg.Matrix.IsLocalServerName, keys, wakeup,
 		func(httpReq *http.Request, request *fclient.FederationRequest, vars map[string]string) util.JSONResponse {
 			return QueryRoomHierarchy(httpReq, request, vars["roomID"], rsAPI)
@@ -574,46 +643,3 @@ func ErrorIfLocalServerNotInRoom(
 	}
 	return nil
 }
-
-// MakeFedAPI makes an http.Handler that checks matrix federation authentication.
-func MakeFedAPI(
-	metricsName string, serverName spec.ServerName,
-	isLocalServerName func(spec.ServerName) bool,
-	keyRing gomatrixserverlib.JSONVerifier,
-	wakeup *FederationWakeups,
-	f func(*http.Request, *fclient.FederationRequest, map[string]string) util.JSONResponse,
-) http.Handler {
-	h := func(req *http.Request) util.JSONResponse {
-		fedReq, errResp := fclient.VerifyHTTPRequest(
-			req, time.Now(), serverName, isLocalServerName, keyRing,
-		)
-		if fedReq == nil {
-			return errResp
-		}
-		go wakeup.Wakeup(req.Context(), fedReq.Origin())
-		vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
-		if err != nil {
-			return util.MatrixErrorResponse(400, string(spec.ErrorUnrecognized), "badly encoded query params")
-		}
-
-		return f(req, fedReq, vars)
-	}
-	return httputil.MakeExternalAPI(metricsName, h)
-}
-
-type FederationWakeups struct {
-	FsAPI   *fedInternal.FederationInternalAPI
-	origins sync.Map
-}
-
-func (f *FederationWakeups) Wakeup(ctx context.Context, origin spec.ServerName) {
-	key, keyok := f.origins.Load(origin)
-	if keyok {
-		lastTime, ok := key.(time.Time)
-		if ok && time.Since(lastTime) < time.Minute {
-			return
-		}
-	}
-	f.FsAPI.MarkServersAlive([]spec.ServerName{origin})
-	f.origins.Store(origin, time.Now())
-}
@@ -28,6 +28,7 @@ import (
 	"github.com/neilalexander/harmony/federationapi/producers"
 	"github.com/neilalexander/harmony/internal"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/transactions"
 	"github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/setup/config"
 	userAPI "github.com/neilalexander/harmony/userapi/api"
@@ -64,8 +65,15 @@ func Send(
 	federation fclient.FederationClient,
 	mu *internal.MutexByRoom,
 	producer *producers.SyncAPIProducer,
+	txnCache *transactions.Cache,
 ) util.JSONResponse {
-	// First we should check if this origin has already submitted this
+	// If this transaction has already been processed, possibly by another
+	// instance or before a restart, then return the same response again.
+	if res, ok := txnCache.FetchFederationTransaction(request.Origin(), string(txnID)); ok {
+		return *res
+	}
+
+	// Next we should check if this origin has already submitted this
 	// txn ID to us. If they have and the txnIDs map contains an entry,
 	// the transaction is still being worked on. The new client can wait
 	// for it to complete rather than creating more work.
@@ -146,6 +154,7 @@ func Send(
 		Code: http.StatusOK,
 		JSON: resp,
 	}
+	txnCache.AddFederationTransaction(request.Origin(), string(txnID), &res)
 	ch <- res
 	return res
 }
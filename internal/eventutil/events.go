@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/tidwall/gjson"
+
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/roomserver/api"
@@ -192,3 +194,21 @@ func RedactEvent(ctx context.Context, redactionEvent, redactedEvent gomatrixserv
 	}
 	return nil
 }
+
+// MainThreadID is the thread ID of the main timeline of a room, used for
+// threaded read receipts and notification counts.
+const MainThreadID = "main"
+
+// ThreadID returns the ID of the thread that an event with the given content
+// belongs to. This is the event ID of the thread root for events with an
+// "m.thread" relation, otherwise MainThreadID.
+func ThreadID(content []byte) string {
+	relatesTo := gjson.GetBytes(content, `m\.relates_to`)
+	if relatesTo.Get("rel_type").Str != "m.thread" {
+		return MainThreadID
+	}
+	if eventID := relatesTo.Get("event_id").Str; eventID != "" {
+		return eventID
+	}
+	return MainThreadID
+}
@@ -49,6 +49,18 @@ type NotificationData struct {
 	// UnreadNotificationCount is the total number of unread
 	// notifications.
 	UnreadNotificationCount int `json:"unread_notification_count"`
+
+	// Threads contains the unread notification counts split by thread
+	// ID, including the main timeline as MainThreadID. Threads without
+	// any unread notifications are omitted.
+	Threads map[string]ThreadNotificationData `json:"threads,omitempty"`
+}
+
+// ThreadNotificationData contains the notification statistics for a
+// single thread in a room.
+type ThreadNotificationData struct {
+	UnreadHighlightCount    int `json:"unread_highlight_count"`
+	UnreadNotificationCount int `json:"unread_notification_count"`
 }
 
 // UserProfile is a struct containing all known user profile data
@@ -43,6 +43,7 @@ type FederationClient interface {
 	ClaimKeys(ctx context.Context, origin, s spec.ServerName, oneTimeKeys map[string]map[string]string) (RespClaimKeys, error)
 	QueryKeys(ctx context.Context, origin, s spec.ServerName, keys map[string][]string) (RespQueryKeys, error)
 	Backfill(ctx context.Context, origin, s spec.ServerName, roomID string, limit int, eventIDs []string) (res gomatrixserverlib.Transaction, err error)
+	LookupTimestampToEvent(ctx context.Context, origin, s spec.ServerName, roomID string, timestamp spec.Timestamp, dir string) (res RespTimestampToEvent, err error)
 	MSC2836EventRelationships(ctx context.Context, origin, dst spec.ServerName, r MSC2836EventRelationshipsRequest, roomVersion gomatrixserverlib.RoomVersion) (res MSC2836EventRelationshipsResponse, err error)
 	RoomHierarchy(ctx context.Context, origin, dst spec.ServerName, roomID string, suggestedOnly bool) (res RoomHierarchyResponse, err error)
 
@@ -64,6 +65,8 @@ type FederationClient interface {
 		ctx context.Context, origin, s spec.ServerName, userID string, field string,
 	) (res RespProfile, err error)
 
+	DownloadMedia(ctx context.Context, origin, s spec.ServerName, mediaID string) (*http.Response, error)
+
 	P2PSendTransactionToRelay(ctx context.Context, u spec.UserID, t gomatrixserverlib.Transaction, forwardingServer spec.ServerName) (res EmptyResp, err error)
 	P2PGetTransactionFromRelay(ctx context.Context, u spec.UserID, prev RelayEntry, relayServer spec.ServerName) (res RespGetRelayTransaction, err error)
 }
@@ -103,6 +106,17 @@ func (ac *federationClient) DoRequestAndParseResponse(ctx context.Context, req *
 }
 
 func (ac *federationClient) doRequest(ctx context.Context, r FederationRequest, resBody interface{}) error {
+	req, err := ac.signedHTTPRequest(r)
+	if err != nil {
+		return err
+	}
+
+	return ac.Client.DoRequestAndParseResponse(ctx, req, resBody)
+}
+
+// signedHTTPRequest signs the federation request using the identity that
+// matches the origin of the request and returns the resulting http.Request.
+func (ac *federationClient) signedHTTPRequest(r FederationRequest) (*http.Request, error) {
 	var identity *SigningIdentity
 	for _, id := range ac.identities {
 		if id.ServerName == r.Origin() {
@@ -111,18 +125,13 @@ func (ac *federationClient) doRequest(ctx context.Context, r FederationRequest,
 		}
 	}
 	if identity == nil {
-		return fmt.Errorf("no signing identity for server name %q", r.Origin())
+		return nil, fmt.Errorf("no signing identity for server name %q", r.Origin())
 	}
 	if err := r.Sign(identity.ServerName, identity.KeyID, identity.PrivateKey); err != nil {
-		return err
-	}
-
-	req, err := r.HTTPRequest()
-	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return ac.Client.DoRequestAndParseResponse(ctx, req, resBody)
+	return r.HTTPRequest()
 }
 
 var federationPathPrefixV1 = "/_matrix/federation/v1"
@@ -604,6 +613,22 @@ func (ac *federationClient) LookupProfile(
 	return
 }
 
+// DownloadMedia requests a piece of media from a remote server using the
+// authenticated federation media endpoint. The response is returned as-is,
+// as the body is a multipart/mixed response which the caller must parse.
+// The caller is responsible for closing the response body.
+// Spec: https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1mediadownloadmediaid
+func (ac *federationClient) DownloadMedia(
+	ctx context.Context, origin, s spec.ServerName, mediaID string,
+) (*http.Response, error) {
+	path := federationPathPrefixV1 + "/media/download/" + url.PathEscape(mediaID)
+	req, err := ac.signedHTTPRequest(NewFederationRequest("GET", origin, s, path))
+	if err != nil {
+		return nil, err
+	}
+	return ac.Client.DoHTTPRequest(ctx, req)
+}
+
 // ClaimKeys claims E2E one-time keys from a remote server.
 // `oneTimeKeys` are the keys to be claimed. A map from user ID, to a map from device ID to algorithm name. E.g:
 //
@@ -700,6 +725,21 @@ func (ac *federationClient) Backfill(
 	return
 }
 
+// LookupTimestampToEvent asks a homeserver for the event in the room which is
+// closest to the given timestamp, in the direction given by dir ("f" or "b").
+// See https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1timestamp_to_eventroomid
+func (ac *federationClient) LookupTimestampToEvent(
+	ctx context.Context, origin, s spec.ServerName, roomID string, timestamp spec.Timestamp, dir string,
+) (res RespTimestampToEvent, err error) {
+	query := url.Values{}
+	query.Set("ts", strconv.FormatUint(uint64(timestamp), 10))
+	query.Set("dir", dir)
+	path := federationPathPrefixV1 + "/timestamp_to_event/" + url.PathEscape(roomID) + "?" + query.Encode()
+	req := NewFederationRequest("GET", origin, s, path)
+	err = ac.doRequest(ctx, req, &res)
+	return
+}
+
 // MSC2836EventRelationships performs an MSC2836 /event_relationships request.
 func (ac *federationClient) MSC2836EventRelationships(
 	ctx context.Context, origin, dst spec.ServerName, r MSC2836EventRelationshipsRequest, roomVersion gomatrixserverlib.RoomVersion,
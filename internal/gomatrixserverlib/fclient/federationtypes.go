@@ -98,6 +98,14 @@ type RespMissingEvents struct {
 	Events gomatrixserverlib.EventJSONs `json:"events"`
 }
 
+// A RespTimestampToEvent is the content of a response to GET /_matrix/federation/v1/timestamp_to_event/{roomID}
+type RespTimestampToEvent struct {
+	// The ID of the event closest to the requested timestamp.
+	EventID string `json:"event_id"`
+	// The origin_server_ts of the event.
+	OriginServerTS spec.Timestamp `json:"origin_server_ts"`
+}
+
 // RespPublicRooms is the content of a response to GET /_matrix/federation/v1/publicRooms
 type RespPublicRooms struct {
 	// A paginated chunk of public rooms.
@@ -0,0 +1,187 @@
+package gomatrixserverlib
+
+import (
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestHandleMakeKnock(t *testing.T) {
+	validUser, err := spec.NewUserID("@user:remote", true)
+	assert.Nil(t, err)
+	validRoom, err := spec.NewRoomID("!room:remote")
+	assert.Nil(t, err)
+	creator, err := spec.NewUserID("@creator:local", true)
+	assert.Nil(t, err)
+
+	_, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed generating key: %v", err)
+	}
+	keyID := KeyID("ed25519:1234")
+
+	buildEvent := func(proto ProtoEvent) PDU {
+		proto.RoomID = validRoom.String()
+		proto.Unsigned = spec.RawJSON("")
+		eb := MustGetRoomVersion(RoomVersionV10).NewEventBuilderFromProtoEvent(&proto)
+		ev, buildErr := eb.Build(time.Now(), creator.Domain(), keyID, sk)
+		if buildErr != nil {
+			t.Fatalf("Failed building %s event: %v", proto.Type, buildErr)
+		}
+		return ev
+	}
+
+	emptyStateKey := ""
+	createEvent := buildEvent(ProtoEvent{
+		SenderID:   creator.String(),
+		Type:       spec.MRoomCreate,
+		StateKey:   &emptyStateKey,
+		PrevEvents: []interface{}{},
+		AuthEvents: []interface{}{},
+		Depth:      0,
+		Content:    spec.RawJSON(`{"creator":"@creator:local","m.federate":true,"room_version":"10"}`),
+	})
+	knockJoinRulesEvent := buildEvent(ProtoEvent{
+		SenderID:   creator.String(),
+		Type:       spec.MRoomJoinRules,
+		StateKey:   &emptyStateKey,
+		PrevEvents: []interface{}{createEvent.EventID()},
+		AuthEvents: []interface{}{createEvent.EventID()},
+		Depth:      1,
+		Content:    spec.RawJSON(`{"join_rule":"knock"}`),
+	})
+	inviteJoinRulesEvent := buildEvent(ProtoEvent{
+		SenderID:   creator.String(),
+		Type:       spec.MRoomJoinRules,
+		StateKey:   &emptyStateKey,
+		PrevEvents: []interface{}{createEvent.EventID()},
+		AuthEvents: []interface{}{createEvent.EventID()},
+		Depth:      1,
+		Content:    spec.RawJSON(`{"join_rule":"invite"}`),
+	})
+	userStateKey := validUser.String()
+	knockEvent := buildEvent(ProtoEvent{
+		SenderID:   validUser.String(),
+		Type:       spec.MRoomMember,
+		StateKey:   &userStateKey,
+		PrevEvents: []interface{}{knockJoinRulesEvent.EventID()},
+		AuthEvents: []interface{}{createEvent.EventID(), knockJoinRulesEvent.EventID()},
+		Depth:      2,
+		Content:    spec.RawJSON(`{"membership":"knock"}`),
+	})
+
+	tests := []struct {
+		name    string
+		input   HandleMakeKnockInput
+		wantErr assert.ErrorAssertionFunc
+	}{
+		{
+			name: "unsupported remote room version",
+			input: HandleMakeKnockInput{
+				UserID:         *validUser,
+				RoomVersion:    RoomVersionV10,
+				RemoteVersions: []RoomVersion{RoomVersionV9},
+				RequestOrigin:  "remote",
+			},
+			wantErr: assert.Error,
+		},
+		{
+			name: "wrong destination",
+			input: HandleMakeKnockInput{
+				UserID:         *validUser,
+				RoomVersion:    RoomVersionV10,
+				RemoteVersions: []RoomVersion{RoomVersionV10},
+				RequestOrigin:  "notRemote",
+			},
+			wantErr: assert.Error,
+		},
+		{
+			name: "localhost not in room",
+			input: HandleMakeKnockInput{
+				UserID:            *validUser,
+				RoomVersion:       RoomVersionV10,
+				RemoteVersions:    []RoomVersion{RoomVersionV10},
+				RequestOrigin:     "remote",
+				LocalServerInRoom: false,
+			},
+			wantErr: assert.Error,
+		},
+		{
+			name: "template error",
+			input: HandleMakeKnockInput{
+				RoomID:            *validRoom,
+				UserID:            *validUser,
+				RoomVersion:       RoomVersionV10,
+				RemoteVersions:    []RoomVersion{RoomVersionV10},
+				RequestOrigin:     "remote",
+				LocalServerInRoom: true,
+				UserIDQuerier:     UserIDForSenderTest,
+				BuildEventTemplate: func(protoEvent *ProtoEvent) (PDU, []PDU, error) {
+					return nil, nil, fmt.Errorf("error")
+				},
+			},
+			wantErr: assert.Error,
+		},
+		{
+			name: "template error - not a membership event",
+			input: HandleMakeKnockInput{
+				RoomID:            *validRoom,
+				UserID:            *validUser,
+				RoomVersion:       RoomVersionV10,
+				RemoteVersions:    []RoomVersion{RoomVersionV10},
+				RequestOrigin:     "remote",
+				LocalServerInRoom: true,
+				UserIDQuerier:     UserIDForSenderTest,
+				BuildEventTemplate: func(protoEvent *ProtoEvent) (PDU, []PDU, error) {
+					return createEvent, []PDU{createEvent}, nil
+				},
+			},
+			wantErr: assert.Error,
+		},
+		{
+			name: "not allowed to knock, room is invite only",
+			input: HandleMakeKnockInput{
+				RoomID:            *validRoom,
+				UserID:            *validUser,
+				RoomVersion:       RoomVersionV10,
+				RemoteVersions:    []RoomVersion{RoomVersionV10},
+				RequestOrigin:     "remote",
+				LocalServerInRoom: true,
+				UserIDQuerier:     UserIDForSenderTest,
+				BuildEventTemplate: func(protoEvent *ProtoEvent) (PDU, []PDU, error) {
+					return knockEvent, []PDU{createEvent, inviteJoinRulesEvent}, nil
+				},
+			},
+			wantErr: assert.Error,
+		},
+		{
+			name: "allowed to knock",
+			input: HandleMakeKnockInput{
+				RoomID:            *validRoom,
+				UserID:            *validUser,
+				RoomVersion:       RoomVersionV10,
+				RemoteVersions:    []RoomVersion{RoomVersionV10},
+				RequestOrigin:     "remote",
+				LocalServerInRoom: true,
+				UserIDQuerier:     UserIDForSenderTest,
+				BuildEventTemplate: func(protoEvent *ProtoEvent) (PDU, []PDU, error) {
+					return knockEvent, []PDU{createEvent, knockJoinRulesEvent}, nil
+				},
+			},
+			wantErr: assert.NoError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := HandleMakeKnock(tt.input)
+			if !tt.wantErr(t, err, fmt.Sprintf("HandleMakeKnock(%v)", tt.input)) {
+				return
+			}
+		})
+	}
+}
@@ -30,6 +30,7 @@ const (
 	ErrorNotFound                    MatrixErrorCode = "M_NOT_FOUND"
 	ErrorMissingToken                MatrixErrorCode = "M_MISSING_TOKEN"
 	ErrorUnknownToken                MatrixErrorCode = "M_UNKNOWN_TOKEN"
+	ErrorUserLocked                  MatrixErrorCode = "M_USER_LOCKED"
 	ErrorWeakPassword                MatrixErrorCode = "M_WEAK_PASSWORD"
 	ErrorInvalidUsername             MatrixErrorCode = "M_INVALID_USERNAME"
 	ErrorUserInUse                   MatrixErrorCode = "M_USER_IN_USE"
@@ -49,6 +50,9 @@ const (
 	ErrorSessionNotValidated         MatrixErrorCode = "M_SESSION_NOT_VALIDATED"
 	ErrorThreePIDInUse               MatrixErrorCode = "M_THREEPID_IN_USE"
 	ErrorThreePIDAuthFailed          MatrixErrorCode = "M_THREEPID_AUTH_FAILED"
+	ErrorResourceLimitExceeded       MatrixErrorCode = "M_RESOURCE_LIMIT_EXCEEDED"
+	ErrorNotYetUploaded              MatrixErrorCode = "M_NOT_YET_UPLOADED"
+	ErrorCannotOverwriteMedia        MatrixErrorCode = "M_CANNOT_OVERWRITE_MEDIA"
 )
 
 // MatrixError represents the "standard error response" in Matrix.
@@ -126,6 +130,12 @@ func UnknownToken(msg string) MatrixError {
 	return MatrixError{ErrorUnknownToken, msg}
 }
 
+// UserLocked is an error when the account of the user has been locked by a
+// server admin.
+func UserLocked(msg string) MatrixError {
+	return MatrixError{ErrorUserLocked, msg}
+}
+
 // WeakPassword is an error which is returned when the client tries to register
 // using a weak password. http://matrix.org/docs/spec/client_server/r0.2.0.html#password-based
 func WeakPassword(msg string) MatrixError {
@@ -182,6 +192,24 @@ func MissingParam(msg string) MatrixError {
 	return MatrixError{ErrorMissingParam, msg}
 }
 
+// ResourceLimitExceeded is an error that is returned when the request would
+// take the user over a limit that the server places on them, e.g. a quota.
+func ResourceLimitExceeded(msg string) MatrixError {
+	return MatrixError{ErrorResourceLimitExceeded, msg}
+}
+
+// NotYetUploaded is an error that is returned when media has been created
+// with an MXC URI but its content has not been uploaded yet.
+func NotYetUploaded(msg string) MatrixError {
+	return MatrixError{ErrorNotYetUploaded, msg}
+}
+
+// CannotOverwriteMedia is an error that is returned when trying to upload
+// content to an MXC URI which already has content.
+func CannotOverwriteMedia(msg string) MatrixError {
+	return MatrixError{ErrorCannotOverwriteMedia, msg}
+}
+
 // UnableToAuthoriseJoin is an error that is returned when a server can't
 // determine whether to allow a restricted join or not.
 func UnableToAuthoriseJoin(msg string) MatrixError {
@@ -0,0 +1,142 @@
+package mailer
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+// smtpStandIn is a minimal SMTP server which accepts a single message and
+// records the envelope and the data.
+type smtpStandIn struct {
+	listener net.Listener
+	from     string
+	to       []string
+	data     chan string
+}
+
+func newSMTPStandIn(t *testing.T) *smtpStandIn {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &smtpStandIn{listener: l, data: make(chan string, 1)}
+	go s.serve()
+	t.Cleanup(func() { _ = l.Close() })
+	return s
+}
+
+func (s *smtpStandIn) serve() {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close() // nolint: errcheck
+	tp := textproto.NewConn(conn)
+	_ = tp.PrintfLine("220 localhost ESMTP stand-in")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO", "HELO":
+			_ = tp.PrintfLine("250 localhost")
+		case "MAIL":
+			s.from = strings.TrimSuffix(strings.TrimPrefix(line, "MAIL FROM:<"), ">")
+			_ = tp.PrintfLine("250 OK")
+		case "RCPT":
+			s.to = append(s.to, strings.TrimSuffix(strings.TrimPrefix(line, "RCPT TO:<"), ">"))
+			_ = tp.PrintfLine("250 OK")
+		case "DATA":
+			_ = tp.PrintfLine("354 Go ahead")
+			data, err := tp.ReadDotLines()
+			if err != nil {
+				return
+			}
+			s.data <- strings.Join(data, "\n")
+			_ = tp.PrintfLine("250 OK")
+		case "QUIT":
+			_ = tp.PrintfLine("221 Bye")
+			return
+		default:
+			_ = tp.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func TestSMTPClient(t *testing.T) {
+	s := newSMTPStandIn(t)
+	client, err := NewSMTPClient(&config.EmailNotifications{
+		SMTPServer: s.listener.Addr().String(),
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = client.Send(ctx, &Message{
+		From:    "Matrix <noreply@example.com>",
+		To:      []string{"alice@example.com"},
+		Subject: "Hello ✨",
+		Text:    "Plain text body",
+		HTML:    "<p>HTML body</p>",
+	})
+	if err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	data := <-s.data
+	if s.from != "noreply@example.com" {
+		t.Fatalf("unexpected MAIL FROM %q", s.from)
+	}
+	if len(s.to) != 1 || s.to[0] != "alice@example.com" {
+		t.Fatalf("unexpected RCPT TO %v", s.to)
+	}
+	for _, want := range []string{
+		"From: Matrix <noreply@example.com>",
+		"To: alice@example.com",
+		"Subject: =?utf-8?q?Hello_=E2=9C=A8?=",
+		"Content-Type: multipart/alternative; boundary=",
+		"Content-Type: text/plain; charset=utf-8",
+		"Plain text body",
+		"Content-Type: text/html; charset=utf-8",
+		"<p>HTML body</p>",
+	} {
+		if !strings.Contains(data, want) {
+			t.Fatalf("message doesn't contain %q:\n%s", want, data)
+		}
+	}
+}
+
+func TestSMTPClientRequireTLS(t *testing.T) {
+	s := newSMTPStandIn(t)
+	client, err := NewSMTPClient(&config.EmailNotifications{
+		SMTPServer:     s.listener.Addr().String(),
+		SMTPRequireTLS: true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	err = client.Send(context.Background(), &Message{
+		From: "noreply@example.com",
+		To:   []string{"alice@example.com"},
+	})
+	if err != ErrTLSRequired {
+		t.Fatalf("expected ErrTLSRequired, got %v", err)
+	}
+}
+
+func TestNewSMTPClientInvalidServer(t *testing.T) {
+	if _, err := NewSMTPClient(&config.EmailNotifications{SMTPServer: "localhost"}); err == nil {
+		t.Fatalf("expected an error for a server without a port")
+	}
+}
@@ -1,5 +1,7 @@
 package pushrules
 
+import "encoding/json"
+
 // A Condition dictates extra conditions for a matching rules. See
 // ConditionKind.
 type Condition struct {
@@ -8,14 +10,31 @@ type Condition struct {
 	Kind ConditionKind `json:"kind"`
 
 	// Key indicates the dot-separated path of Event fields to
-	// match. Required for EventMatchCondition and
+	// match. Dots and backslashes which are part of a field name are
+	// escaped with a backslash. Required for EventMatchCondition,
+	// EventPropertyIsCondition, EventPropertyContainsCondition,
+	// RelatedEventMatchCondition and
 	// SenderNotificationPermissionCondition.
 	Key string `json:"key,omitempty"`
 
 	// Pattern indicates the value pattern that must match. Required
-	// for EventMatchCondition.
+	// for EventMatchCondition and RelatedEventMatchCondition.
 	Pattern *string `json:"pattern,omitempty"`
 
+	// Value is the exact value that must match. It can be a string,
+	// an integer, a boolean or null. Required for
+	// EventPropertyIsCondition and EventPropertyContainsCondition.
+	Value json.RawMessage `json:"value,omitempty"`
+
+	// RelType is the relation type of the related event to match
+	// against. Required for RelatedEventMatchCondition.
+	RelType string `json:"rel_type,omitempty"`
+
+	// IncludeFallbacks indicates whether replies which are only
+	// fallbacks for threads are considered. Optional for
+	// RelatedEventMatchCondition.
+	IncludeFallbacks *bool `json:"include_fallbacks,omitempty"`
+
 	// Is indicates the condition that must be fulfilled. Required for
 	// RoomMemberCountCondition.
 	Is string `json:"is,omitempty"`
@@ -46,4 +65,18 @@ const (
 	// SenderNotificationPermissionCondition compares power level for
 	// the sender in the event's room.
 	SenderNotificationPermissionCondition ConditionKind = "sender_notification_permission"
+
+	// EventPropertyIsCondition indicates the condition looks for a
+	// key path and matches its value exactly, including its type.
+	EventPropertyIsCondition ConditionKind = "event_property_is"
+
+	// EventPropertyContainsCondition indicates the condition looks
+	// for a key path to an array and matches if any of its values is
+	// exactly the given value.
+	EventPropertyContainsCondition ConditionKind = "event_property_contains"
+
+	// RelatedEventMatchCondition is like EventMatchCondition, but
+	// matches against the event that the event relates to with the
+	// given relation type.
+	RelatedEventMatchCondition ConditionKind = "related_event_match"
 )
@@ -19,3 +19,36 @@ func DefaultGlobalRuleSet(localpart string, serverName spec.ServerName) *RuleSet
 		Underride: defaultUnderrideRules,
 	}
 }
+
+// AddMissingDefaults adds the default rules that the rule set doesn't
+// have yet, e.g. because they were introduced after the account was
+// created. A missing rule is placed after the default rule which
+// precedes it in the default rule set, so that the relative priority
+// of the default rules is kept.
+func (rs *RuleSet) AddMissingDefaults(localpart string, serverName spec.ServerName) {
+	defaults := DefaultGlobalRuleSet(localpart, serverName)
+	rs.Override = addMissingRules(rs.Override, defaults.Override)
+	rs.Content = addMissingRules(rs.Content, defaults.Content)
+	rs.Underride = addMissingRules(rs.Underride, defaults.Underride)
+}
+
+func addMissingRules(rules, defaults []*Rule) []*Rule {
+	insertAt := 0
+	for _, def := range defaults {
+		found := false
+		for i, rule := range rules {
+			if rule.RuleID == def.RuleID {
+				found = true
+				insertAt = i + 1
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		rule := *def
+		rules = append(rules[:insertAt], append([]*Rule{&rule}, rules[insertAt:]...)...)
+		insertAt++
+	}
+	return rules
+}
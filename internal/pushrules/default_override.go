@@ -1,12 +1,16 @@
 package pushrules
 
+import "encoding/json"
+
 func defaultOverrideRules(userID string) []*Rule {
 	return []*Rule{
 		&mRuleMasterDefinition,
 		&mRuleSuppressNoticesDefinition,
 		mRuleInviteForMeDefinition(userID),
 		&mRuleMemberEventDefinition,
+		mRuleIsUserMentionDefinition(userID),
 		&mRuleContainsDisplayNameDefinition,
+		&mRuleIsRoomMentionDefinition,
 		&mRuleRoomNotifDefinition,
 		&mRuleTombstoneDefinition,
 		&mRuleReactionDefinition,
@@ -19,6 +23,8 @@ const (
 	MRuleSuppressNotices     = ".m.rule.suppress_notices"
 	MRuleInviteForMe         = ".m.rule.invite_for_me"
 	MRuleMemberEvent         = ".m.rule.member_event"
+	MRuleIsUserMention       = ".m.rule.is_user_mention"
+	MRuleIsRoomMention       = ".m.rule.is_room_mention"
 	MRuleContainsDisplayName = ".m.rule.contains_display_name"
 	MRuleTombstone           = ".m.rule.tombstone"
 	MRuleRoomNotif           = ".m.rule.roomnotif"
@@ -26,6 +32,15 @@ const (
 	MRuleRoomACLs            = ".m.rule.room.server_acl"
 )
 
+// legacyMentionRules are the default rules which match mentions in the
+// body of an event. They don't match events with the m.mentions
+// property, which are handled by the intentional mention rules.
+var legacyMentionRules = map[string]bool{
+	MRuleContainsDisplayName: true,
+	MRuleContainsUserName:    true,
+	MRuleRoomNotif:           true,
+}
+
 var (
 	mRuleMasterDefinition = Rule{
 		RuleID:  MRuleMaster,
@@ -77,6 +92,29 @@ var (
 			},
 		},
 	}
+	mRuleIsRoomMentionDefinition = Rule{
+		RuleID:  MRuleIsRoomMention,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:  EventPropertyIsCondition,
+				Key:   `content.m\.mentions.room`,
+				Value: json.RawMessage(`true`),
+			},
+			{
+				Kind: SenderNotificationPermissionCondition,
+				Key:  "room",
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+			},
+		},
+	}
 	mRuleTombstoneDefinition = Rule{
 		RuleID:  MRuleTombstone,
 		Default: true,
@@ -157,6 +195,34 @@ var (
 	}
 )
 
+func mRuleIsUserMentionDefinition(userID string) *Rule {
+	value, _ := json.Marshal(userID)
+	return &Rule{
+		RuleID:  MRuleIsUserMention,
+		Default: true,
+		Enabled: true,
+		Conditions: []*Condition{
+			{
+				Kind:  EventPropertyContainsCondition,
+				Key:   `content.m\.mentions.user_ids`,
+				Value: value,
+			},
+		},
+		Actions: []*Action{
+			{Kind: NotifyAction},
+			{
+				Kind:  SetTweakAction,
+				Tweak: SoundTweak,
+				Value: "default",
+			},
+			{
+				Kind:  SetTweakAction,
+				Tweak: HighlightTweak,
+			},
+		},
+	}
+}
+
 func mRuleInviteForMeDefinition(userID string) *Rule {
 	return &Rule{
 		RuleID:  MRuleInviteForMe,
@@ -39,6 +39,16 @@ func TestDefaultRules(t *testing.T) {
 			inputBytes: []byte(`{"rule_id":".m.rule.member_event","default":true,"enabled":true,"conditions":[{"kind":"event_match","key":"type","pattern":"m.room.member"}],"actions":[]}`),
 			want:       mRuleMemberEventDefinition,
 		},
+		{
+			name:       ".m.rule.is_user_mention",
+			inputBytes: []byte(`{"rule_id":".m.rule.is_user_mention","default":true,"enabled":true,"conditions":[{"kind":"event_property_contains","key":"content.m\\.mentions.user_ids","value":"@test:localhost"}],"actions":["notify",{"set_tweak":"sound","value":"default"},{"set_tweak":"highlight"}]}`),
+			want:       *mRuleIsUserMentionDefinition("@test:localhost"),
+		},
+		{
+			name:       ".m.rule.is_room_mention",
+			inputBytes: []byte(`{"rule_id":".m.rule.is_room_mention","default":true,"enabled":true,"conditions":[{"kind":"event_property_is","key":"content.m\\.mentions.room","value":true},{"kind":"sender_notification_permission","key":"room"}],"actions":["notify",{"set_tweak":"highlight"}]}`),
+			want:       mRuleIsRoomMentionDefinition,
+		},
 		{
 			name:       ".m.rule.contains_display_name",
 			inputBytes: []byte(`{"rule_id":".m.rule.contains_display_name","default":true,"enabled":true,"conditions":[{"kind":"contains_display_name"}],"actions":["notify",{"set_tweak":"sound","value":"default"},{"set_tweak":"highlight"}]}`),
@@ -109,3 +119,29 @@ func TestDefaultRules(t *testing.T) {
 
 	}
 }
+
+func TestAddMissingDefaults(t *testing.T) {
+	// A rule set as it was stored before the intentional mention rules
+	// were introduced, with a user rule on top.
+	userRule := &Rule{RuleID: "user.rule", Enabled: true}
+	rs := DefaultGlobalRuleSet("test", "localhost")
+	var override []*Rule
+	for _, rule := range rs.Override {
+		if rule.RuleID != MRuleIsUserMention && rule.RuleID != MRuleIsRoomMention {
+			override = append(override, rule)
+		}
+	}
+	rs.Override = append([]*Rule{userRule}, override...)
+
+	rs.AddMissingDefaults("test", "localhost")
+
+	want := []string{userRule.RuleID}
+	for _, rule := range DefaultGlobalRuleSet("test", "localhost").Override {
+		want = append(want, rule.RuleID)
+	}
+	var got []string
+	for _, rule := range rs.Override {
+		got = append(got, rule.RuleID)
+	}
+	assert.Equal(t, want, got)
+}
@@ -3,7 +3,8 @@ package pushrules
 import (
 	"encoding/json"
 	"fmt"
-	"strings"
+
+	"github.com/tidwall/gjson"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
@@ -29,6 +30,10 @@ type EvaluationContext interface {
 	// HasPowerLevel returns whether the user has at least the given
 	// power in the room of the current event.
 	HasPowerLevel(senderID spec.SenderID, levelKey string) (bool, error)
+
+	// RelatedEvent returns the event with the given ID in the room
+	// of the current event, or nil if it isn't known.
+	RelatedEvent(eventID string) (gomatrixserverlib.PDU, error)
 }
 
 // A kindAndRules is just here to simplify iteration of the (ordered)
@@ -89,6 +94,15 @@ func ruleMatches(rule *Rule, kind Kind, event gomatrixserverlib.PDU, ec Evaluati
 		return false, nil
 	}
 
+	// Clients which send intentional mentions add the m.mentions
+	// property, in which case the legacy mention rules are ignored so
+	// that mentions which only appear in the body don't notify.
+	if rule.Default && legacyMentionRules[rule.RuleID] {
+		if _, err := lookupEventPath(`content.m\.mentions`, event); err == nil {
+			return false, nil
+		}
+	}
+
 	switch kind {
 	case OverrideKind, UnderrideKind:
 		for _, cond := range rule.Conditions {
@@ -151,6 +165,41 @@ func conditionMatches(cond *Condition, event gomatrixserverlib.PDU, ec Evaluatio
 	case SenderNotificationPermissionCondition:
 		return ec.HasPowerLevel(event.SenderID(), cond.Key)
 
+	case EventPropertyIsCondition:
+		want, err := conditionValue(cond)
+		if err != nil {
+			return false, err
+		}
+		v, err := lookupEventPath(cond.Key, event)
+		if err != nil {
+			// An unknown path is just a non-match.
+			return false, nil
+		}
+		return want == v, nil
+
+	case EventPropertyContainsCondition:
+		want, err := conditionValue(cond)
+		if err != nil {
+			return false, err
+		}
+		v, err := lookupEventPath(cond.Key, event)
+		if err != nil {
+			return false, nil
+		}
+		vs, ok := v.([]interface{})
+		if !ok {
+			return false, nil
+		}
+		for _, v := range vs {
+			if want == v {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case RelatedEventMatchCondition:
+		return relatedEventMatches(cond, event, ec)
+
 	default:
 		return false, nil
 	}
@@ -167,15 +216,11 @@ func patternMatches(key, pattern string, event gomatrixserverlib.PDU) (bool, err
 		return false, err
 	}
 
-	var eventMap map[string]interface{}
-	if err = json.Unmarshal(event.JSON(), &eventMap); err != nil {
-		return false, fmt.Errorf("parsing event: %w", err)
-	}
 	// From the spec:
 	// "If the property specified by key is completely absent from
 	// the event, or does not have a string value, then the condition
 	// will not match, even if pattern is *."
-	v, err := lookupMapPath(strings.Split(key, "."), eventMap)
+	v, err := lookupEventPath(key, event)
 	if err != nil {
 		// An unknown path is a benign error that shouldn't stop rule
 		// processing. It's just a non-match.
@@ -188,3 +233,75 @@ func patternMatches(key, pattern string, event gomatrixserverlib.PDU) (bool, err
 
 	return re.MatchString(fmt.Sprint(v)), nil
 }
+
+// relatedEventMatches matches the pattern of the condition against the
+// event that the event relates to with the condition's relation type.
+// Replies are expressed with m.in_reply_to rather than a rel_type, and
+// replies which only exist as a fallback for clients without thread
+// support are ignored unless the condition includes fallbacks.
+func relatedEventMatches(cond *Condition, event gomatrixserverlib.PDU, ec EvaluationContext) (bool, error) {
+	if cond.RelType == "" {
+		return false, fmt.Errorf("missing condition rel_type")
+	}
+
+	relatesTo := gjson.GetBytes(event.Content(), `m\.relates_to`)
+	var relatedID string
+	if cond.RelType == "m.in_reply_to" {
+		if relatesTo.Get("is_falling_back").Bool() && (cond.IncludeFallbacks == nil || !*cond.IncludeFallbacks) {
+			return false, nil
+		}
+		relatedID = relatesTo.Get(`m\.in_reply_to.event_id`).Str
+	} else if relatesTo.Get("rel_type").Str == cond.RelType {
+		relatedID = relatesTo.Get("event_id").Str
+	}
+	if relatedID == "" {
+		return false, nil
+	}
+
+	related, err := ec.RelatedEvent(relatedID)
+	if err != nil {
+		return false, fmt.Errorf("RelatedEvent failed: %w", err)
+	}
+	if related == nil {
+		return false, nil
+	}
+
+	// Without key and pattern the condition only checks that the
+	// relation exists.
+	if cond.Key == "" && cond.Pattern == nil {
+		return true, nil
+	}
+	if cond.Key == "" || cond.Pattern == nil {
+		return false, fmt.Errorf("related_event_match requires both key and pattern")
+	}
+	return patternMatches(cond.Key, *cond.Pattern, related)
+}
+
+// lookupEventPath returns the value of the event property with the
+// given key path, which uses the escaping described for Condition.Key.
+func lookupEventPath(key string, event gomatrixserverlib.PDU) (interface{}, error) {
+	var eventMap map[string]interface{}
+	if err := json.Unmarshal(event.JSON(), &eventMap); err != nil {
+		return nil, fmt.Errorf("parsing event: %w", err)
+	}
+	return lookupMapPath(splitKeyPath(key), eventMap)
+}
+
+// conditionValue decodes the value of an event_property_is or
+// event_property_contains condition. Only primitive values are
+// allowed.
+func conditionValue(cond *Condition) (interface{}, error) {
+	if len(cond.Value) == 0 {
+		return nil, fmt.Errorf("missing condition value")
+	}
+	var v interface{}
+	if err := json.Unmarshal(cond.Value, &v); err != nil {
+		return nil, fmt.Errorf("parsing condition value: %w", err)
+	}
+	switch v.(type) {
+	case nil, bool, float64, string:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("condition value must be a string, number, boolean or null, got %s", cond.Value)
+	}
+}
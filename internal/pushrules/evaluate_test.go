@@ -46,6 +46,11 @@ func TestRuleSetEvaluatorMatchEvent(t *testing.T) {
 		{"overrideUnderride", RuleSet{Override: []*Rule{userEnabled}, Underride: []*Rule{userEnabled2}}, userEnabled, ev},
 		{"reactions don't notify", *defaultRuleset, &mRuleReactionDefinition, mustEventFromJSON(t, `{"room_id":"!room:a","type":"m.reaction"}`)},
 		{"receipts don't notify", *defaultRuleset, nil, mustEventFromJSON(t, `{"room_id":"!room:a","type":"m.receipt"}`)},
+		{"user mention", *defaultRuleset, defaultRuleset.Override[4], mustEventFromJSON(t, `{"room_id":"!room:a","type":"m.room.message","content":{"body":"hi","m.mentions":{"user_ids":["@test:test"]}}}`)},
+		{"room mention", *defaultRuleset, &mRuleIsRoomMentionDefinition, mustEventFromJSON(t, `{"room_id":"!room:a","sender":"@poweruser:example.com","type":"m.room.message","content":{"body":"hi","m.mentions":{"room":true}}}`)},
+		{"legacy room mention", *defaultRuleset, &mRuleRoomNotifDefinition, mustEventFromJSON(t, `{"room_id":"!room:a","sender":"@poweruser:example.com","type":"m.room.message","content":{"body":"@room hi"}}`)},
+		{"legacy room mention with m.mentions", *defaultRuleset, &mRuleMessageDefinition, mustEventFromJSON(t, `{"room_id":"!room:a","sender":"@poweruser:example.com","type":"m.room.message","content":{"body":"@room hi","m.mentions":{}}}`)},
+		{"legacy display name mention with m.mentions", *defaultRuleset, &mRuleMessageDefinition, mustEventFromJSON(t, `{"room_id":"!room:a","type":"m.room.message","content":{"body":"hello Dear User","m.mentions":{}}}`)},
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
@@ -139,6 +144,29 @@ func TestConditionMatches(t *testing.T) {
 
 		{Name: "senderNotificationPermissionMatch", Cond: Condition{Kind: SenderNotificationPermissionCondition, Key: "powerlevel"}, EventJSON: `{"room_id":"!room:example.com","sender":"@poweruser:example.com"}`, WantMatch: true, WantErr: false},
 		{Name: "senderNotificationPermissionNoMatch", Cond: Condition{Kind: SenderNotificationPermissionCondition, Key: "powerlevel"}, EventJSON: `{"room_id":"!room:example.com","sender":"@nobody:example.com"}`, WantMatch: false, WantErr: false},
+
+		{Name: "eventPropertyIsBoolMatch", Cond: Condition{Kind: EventPropertyIsCondition, Key: `content.m\.mentions.room`, Value: []byte(`true`)}, EventJSON: `{"room_id":"!room:example.com","content":{"m.mentions":{"room":true}}}`, WantMatch: true, WantErr: false},
+		{Name: "eventPropertyIsTypeNoMatch", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content.value", Value: []byte(`"1"`)}, EventJSON: `{"room_id":"!room:example.com","content":{"value":1}}`, WantMatch: false, WantErr: false},
+		{Name: "eventPropertyIsNumberMatch", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content.value", Value: []byte(`1`)}, EventJSON: `{"room_id":"!room:example.com","content":{"value":1}}`, WantMatch: true, WantErr: false},
+		{Name: "eventPropertyIsNullMatch", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content.value", Value: []byte(`null`)}, EventJSON: `{"room_id":"!room:example.com","content":{"value":null}}`, WantMatch: true, WantErr: false},
+		{Name: "eventPropertyIsNullMissingNoMatch", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content.value", Value: []byte(`null`)}, EventJSON: `{"room_id":"!room:example.com","content":{}}`, WantMatch: false, WantErr: false},
+		{Name: "eventPropertyIsSubstringNoMatch", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content.body", Value: []byte(`"hello"`)}, EventJSON: `{"room_id":"!room:example.com","content":{"body":"hello world"}}`, WantMatch: false, WantErr: false},
+		{Name: "eventPropertyIsMissingValue", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content.body"}, EventJSON: `{"room_id":"!room:example.com","content":{"body":"hello"}}`, WantMatch: false, WantErr: true},
+		{Name: "eventPropertyIsObjectValue", Cond: Condition{Kind: EventPropertyIsCondition, Key: "content", Value: []byte(`{}`)}, EventJSON: `{"room_id":"!room:example.com","content":{}}`, WantMatch: false, WantErr: true},
+
+		{Name: "eventPropertyContainsMatch", Cond: Condition{Kind: EventPropertyContainsCondition, Key: `content.m\.mentions.user_ids`, Value: []byte(`"@user:example.com"`)}, EventJSON: `{"room_id":"!room:example.com","content":{"m.mentions":{"user_ids":["@other:example.com","@user:example.com"]}}}`, WantMatch: true, WantErr: false},
+		{Name: "eventPropertyContainsNoMatch", Cond: Condition{Kind: EventPropertyContainsCondition, Key: `content.m\.mentions.user_ids`, Value: []byte(`"@user:example.com"`)}, EventJSON: `{"room_id":"!room:example.com","content":{"m.mentions":{"user_ids":["@other:example.com"]}}}`, WantMatch: false, WantErr: false},
+		{Name: "eventPropertyContainsNotArray", Cond: Condition{Kind: EventPropertyContainsCondition, Key: "content.body", Value: []byte(`"@user:example.com"`)}, EventJSON: `{"room_id":"!room:example.com","content":{"body":"@user:example.com"}}`, WantMatch: false, WantErr: false},
+
+		{Name: "relatedEventMatchThread", Cond: Condition{Kind: RelatedEventMatchCondition, RelType: "m.thread", Key: "sender", Pattern: pointer("@poweruser:example.com")}, EventJSON: `{"room_id":"!room:example.com","content":{"m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}}`, WantMatch: true, WantErr: false},
+		{Name: "relatedEventMatchThreadNoMatch", Cond: Condition{Kind: RelatedEventMatchCondition, RelType: "m.thread", Key: "sender", Pattern: pointer("@nobody:example.com")}, EventJSON: `{"room_id":"!room:example.com","content":{"m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}}`, WantMatch: false, WantErr: false},
+		{Name: "relatedEventMatchOtherRelType", Cond: Condition{Kind: RelatedEventMatchCondition, RelType: "m.thread", Key: "sender", Pattern: pointer("@poweruser:example.com")}, EventJSON: `{"room_id":"!room:example.com","content":{"m.relates_to":{"rel_type":"m.reference","event_id":"$root"}}}`, WantMatch: false, WantErr: false},
+		{Name: "relatedEventMatchUnknownEvent", Cond: Condition{Kind: RelatedEventMatchCondition, RelType: "m.thread", Key: "sender", Pattern: pointer("@poweruser:example.com")}, EventJSON: `{"room_id":"!room:example.com","content":{"m.relates_to":{"rel_type":"m.thread","event_id":"$unknown"}}}`, WantMatch: false, WantErr: false},
+		{Name: "relatedEventMatchWithoutPattern", Cond: Condition{Kind: RelatedEventMatchCondition, RelType: "m.thread"}, EventJSON: `{"room_id":"!room:example.com","content":{"m.relates_to":{"rel_type":"m.thread","event_id":"$root"}}}`, WantMatch: true, WantErr: false},
+		{Name: "relatedEventMatchReply", Cond: Condition{Kind: RelatedEventMatchCondition, RelType: "m.in_reply_to", Key: "sender", Pattern: pointer("@poweruser:example.com")}, EventJSON: `{"room_id":"!room:example.com","content":{"m.relates_to":{"m.in_reply_to":{"event_id":"$root"}}}}`, WantMatch: true, WantErr: false},
+		{Name: "relatedEventMatchReplyFallback", Cond: Condition{Kind: RelatedEventMatchCondition, RelType: "m.in_reply_to", Key: "sender", Pattern: pointer("@poweruser:example.com")}, EventJSON: `{"room_id":"!room:example.com","content":{"m.relates_to":{"rel_type":"m.thread","event_id":"$root","is_falling_back":true,"m.in_reply_to":{"event_id":"$root"}}}}`, WantMatch: false, WantErr: false},
+		{Name: "relatedEventMatchReplyIncludeFallbacks", Cond: Condition{Kind: RelatedEventMatchCondition, RelType: "m.in_reply_to", Key: "sender", Pattern: pointer("@poweruser:example.com"), IncludeFallbacks: pointer(true)}, EventJSON: `{"room_id":"!room:example.com","content":{"m.relates_to":{"rel_type":"m.thread","event_id":"$root","is_falling_back":true,"m.in_reply_to":{"event_id":"$root"}}}}`, WantMatch: true, WantErr: false},
+		{Name: "relatedEventMatchMissingRelType", Cond: Condition{Kind: RelatedEventMatchCondition, Key: "sender", Pattern: pointer("@poweruser:example.com")}, EventJSON: `{"room_id":"!room:example.com"}`, WantMatch: false, WantErr: true},
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
@@ -158,7 +186,13 @@ type fakeEvaluationContext struct{ memberCount int }
 func (fakeEvaluationContext) UserDisplayName() string         { return "Dear User" }
 func (f fakeEvaluationContext) RoomMemberCount() (int, error) { return f.memberCount, nil }
 func (fakeEvaluationContext) HasPowerLevel(senderID spec.SenderID, levelKey string) (bool, error) {
-	return senderID == "@poweruser:example.com" && levelKey == "powerlevel", nil
+	return senderID == "@poweruser:example.com" && (levelKey == "powerlevel" || levelKey == "room"), nil
+}
+func (fakeEvaluationContext) RelatedEvent(eventID string) (gomatrixserverlib.PDU, error) {
+	if eventID != "$root" {
+		return nil, nil
+	}
+	return gomatrixserverlib.MustGetRoomVersion(gomatrixserverlib.RoomVersionV7).NewEventFromTrustedJSON([]byte(`{"room_id":"!room:example.com","sender":"@poweruser:example.com"}`), false)
 }
 
 func TestPatternMatches(t *testing.T) {
@@ -178,6 +212,7 @@ func TestPatternMatches(t *testing.T) {
 		{"singlePattern", "content.creator", "acr?ator", `{"room_id":"!room:a","content":{"creator":"acreator"}}`, true},
 		{"multiPattern", "content.creator", "a*ea*r", `{"room_id":"!room:a","content":{"creator":"acreator"}}`, true},
 		{"patternNoSubstring", "content.creator", "r*t", `{"room_id":"!room:a","content":{"creator":"acreator"}}`, false},
+		{"escapedDot", `content.m\.creator`, "acreator", `{"room_id":"!room:a","content":{"m.creator":"acreator"}}`, true},
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
@@ -94,6 +94,28 @@ func lookupMapPath(path []string, m map[string]interface{}) (interface{}, error)
 	return v, nil
 }
 
+// splitKeyPath splits a dot-separated key path into its fields. A
+// backslash escapes a dot or a backslash which is part of a field
+// name, e.g. "content.m\.mentions" is the m.mentions field of the
+// content. Other backslashes are kept as they are.
+func splitKeyPath(key string) []string {
+	var path []string
+	var field strings.Builder
+	for i := 0; i < len(key); i++ {
+		switch c := key[i]; {
+		case c == '\\' && i+1 < len(key) && (key[i+1] == '.' || key[i+1] == '\\'):
+			i++
+			field.WriteByte(key[i])
+		case c == '.':
+			path = append(path, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(c)
+		}
+	}
+	return append(path, field.String())
+}
+
 // parseRoomMemberCountCondition parses a string like "2", "==2", "<2"
 // into a function that checks if the argument to it fulfils the
 // condition.
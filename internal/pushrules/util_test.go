@@ -135,6 +135,28 @@ func TestLookupMapPathInvalid(t *testing.T) {
 	}
 }
 
+func TestSplitKeyPath(t *testing.T) {
+	tsts := []struct {
+		Input string
+		Want  []string
+	}{
+		{"", []string{""}},
+		{"content", []string{"content"}},
+		{"content.body", []string{"content", "body"}},
+		{`content.m\.mentions.room`, []string{"content", "m.mentions", "room"}},
+		{`content.a\\.b`, []string{"content", `a\`, "b"}},
+		{`content.a\b`, []string{"content", `a\b`}},
+	}
+	for _, tst := range tsts {
+		t.Run(tst.Input, func(t *testing.T) {
+			got := splitKeyPath(tst.Input)
+			if diff := cmp.Diff(tst.Want, got); diff != "" {
+				t.Errorf("+got -want:\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestParseRoomMemberCountCondition(t *testing.T) {
 	tsts := []struct {
 		Input     string
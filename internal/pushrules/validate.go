@@ -81,9 +81,14 @@ func validateCondition(cond *Condition) []error {
 	var errs []error
 
 	switch cond.Kind {
-	case EventMatchCondition, ContainsDisplayNameCondition, RoomMemberCountCondition, SenderNotificationPermissionCondition:
+	case EventMatchCondition, ContainsDisplayNameCondition, RoomMemberCountCondition, SenderNotificationPermissionCondition, RelatedEventMatchCondition:
 		// Do nothing.
 
+	case EventPropertyIsCondition, EventPropertyContainsCondition:
+		if _, err := conditionValue(cond); err != nil {
+			errs = append(errs, err)
+		}
+
 	default:
 		errs = append(errs, fmt.Errorf("invalid rule condition kind: %s", cond.Kind))
 	}
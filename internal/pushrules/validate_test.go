@@ -124,6 +124,8 @@ func TestValidateConditionNegatives(t *testing.T) {
 	}{
 		{"emptyKind", Condition{}, "invalid rule condition kind"},
 		{"invalidKind", Condition{Kind: ConditionKind("something else")}, "invalid rule condition kind"},
+		{"missingValue", Condition{Kind: EventPropertyIsCondition, Key: "content.body"}, "missing condition value"},
+		{"objectValue", Condition{Kind: EventPropertyContainsCondition, Key: "content.body", Value: []byte(`{}`)}, "condition value must be"},
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
@@ -149,6 +151,8 @@ func TestValidateConditionPositives(t *testing.T) {
 		WantNoErrString string
 	}{
 		{"invalidKind", Condition{Kind: EventMatchCondition}, "invalid rule condition kind"},
+		{"eventPropertyIs", Condition{Kind: EventPropertyIsCondition, Key: "content.body", Value: []byte(`null`)}, "condition value"},
+		{"relatedEventMatch", Condition{Kind: RelatedEventMatchCondition, RelType: "m.thread"}, "invalid rule condition kind"},
 	}
 	for _, tst := range tsts {
 		t.Run(tst.Name, func(t *testing.T) {
@@ -0,0 +1,117 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transactions
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/matrix-org/util"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// jetStreamBackend stores response entries in a NATS JetStream key-value
+// bucket, so that they are shared between instances and survive restarts.
+// Entries are evicted by NATS once the TTL of the bucket has passed.
+type jetStreamBackend struct {
+	kv nats.KeyValue
+}
+
+// storedResponse is how a response is encoded in the bucket.
+type storedResponse struct {
+	Code    int               `json:"code"`
+	JSON    json.RawMessage   `json:"json,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// NewJetStream creates a new Cache which stores entries in the given
+// key-value bucket, creating the bucket if it doesn't exist yet. Entries
+// are kept for DefaultCleanupPeriod.
+func NewJetStream(js nats.JetStreamContext, bucket string, inMemory bool) (*Cache, error) {
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		storage := nats.FileStorage
+		if inMemory {
+			storage = nats.MemoryStorage
+		}
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{
+			Bucket:  bucket,
+			TTL:     DefaultCleanupPeriod,
+			Storage: storage,
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewWithBackend(&jetStreamBackend{kv: kv}), nil
+}
+
+// jetStreamKey hashes the cache key, as the keys in a bucket are limited in
+// the characters they can contain. This also means that access tokens aren't
+// stored in the bucket.
+func jetStreamKey(key CacheKey) string {
+	hash := sha256.Sum256([]byte(key.AccessToken + "\000" + key.TxnID + "\000" + key.Endpoint))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// Fetch treats any failure to get the entry as a cache miss, so the
+// transaction is processed again rather than failing the request.
+func (t *jetStreamBackend) Fetch(key CacheKey) (*util.JSONResponse, bool) {
+	entry, err := t.kv.Get(jetStreamKey(key))
+	if err != nil {
+		if !errors.Is(err, nats.ErrKeyNotFound) {
+			logrus.WithError(err).Warn("Failed to fetch transaction from cache")
+		}
+		return nil, false
+	}
+	var stored storedResponse
+	if err = json.Unmarshal(entry.Value(), &stored); err != nil {
+		logrus.WithError(err).Warn("Failed to decode cached transaction")
+		return nil, false
+	}
+	res := &util.JSONResponse{
+		Code:    stored.Code,
+		Headers: stored.Headers,
+	}
+	if stored.JSON != nil {
+		res.JSON = stored.JSON
+	}
+	return res, true
+}
+
+func (t *jetStreamBackend) Store(key CacheKey, res *util.JSONResponse) {
+	stored := storedResponse{
+		Code:    res.Code,
+		Headers: res.Headers,
+	}
+	if res.JSON != nil {
+		var err error
+		if stored.JSON, err = json.Marshal(res.JSON); err != nil {
+			logrus.WithError(err).Warn("Failed to encode transaction for cache")
+			return
+		}
+	}
+	value, err := json.Marshal(stored)
+	if err != nil {
+		logrus.WithError(err).Warn("Failed to encode transaction for cache")
+		return
+	}
+	if _, err = t.kv.Put(jetStreamKey(key), value); err != nil {
+		logrus.WithError(err).Warn("Failed to store transaction in cache")
+	}
+}
@@ -19,11 +19,17 @@ import (
 	"time"
 
 	"github.com/matrix-org/util"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 )
 
 // DefaultCleanupPeriod represents the default time duration after which cacheCleanService runs.
 const DefaultCleanupPeriod time.Duration = 30 * time.Minute
 
+// federationSendEndpoint is the endpoint used in the cache keys of federation
+// transactions. No client endpoint has this path, so the keys can't clash.
+const federationSendEndpoint = "/_matrix/federation/v1/send"
+
 type txnsMap map[CacheKey]*util.JSONResponse
 
 // CacheKey is the type for the key in a transactions cache.
@@ -34,13 +40,20 @@ type CacheKey struct {
 	Endpoint    string
 }
 
-// Cache represents a temporary store for response entries.
-// Entries are evicted after a certain period, defined by cleanupPeriod.
-// This works by keeping two maps of entries, and cycling the maps after the cleanupPeriod.
+// Backend stores the responses to transactions, so that retries of the same
+// transaction get the same response without being processed again.
+type Backend interface {
+	// Fetch returns the response stored for the key, if there is one.
+	Fetch(key CacheKey) (*util.JSONResponse, bool)
+	// Store stores the response for the key.
+	Store(key CacheKey, res *util.JSONResponse)
+}
+
+// Cache deduplicates transactions using a Backend. The backend returned by
+// New is only local to this process, whereas the one returned by NewJetStream
+// is shared with other instances using the same NATS deployment.
 type Cache struct {
-	sync.RWMutex
-	txnsMaps      [2]txnsMap
-	cleanupPeriod time.Duration
+	backend Backend
 }
 
 // New is a wrapper which calls NewWithCleanupPeriod with DefaultCleanupPeriod as argument.
@@ -48,26 +61,61 @@ func New() *Cache {
 	return NewWithCleanupPeriod(DefaultCleanupPeriod)
 }
 
-// NewWithCleanupPeriod creates a new Cache object, starts cacheCleanService.
-// Takes cleanupPeriod as argument.
+// NewWithCleanupPeriod creates a new Cache which stores entries in memory, and
+// starts cacheCleanService. Takes cleanupPeriod as argument.
 // Returns a reference to newly created Cache.
 func NewWithCleanupPeriod(cleanupPeriod time.Duration) *Cache {
-	t := Cache{txnsMaps: [2]txnsMap{make(txnsMap), make(txnsMap)}}
+	t := memoryBackend{txnsMaps: [2]txnsMap{make(txnsMap), make(txnsMap)}}
 	t.cleanupPeriod = cleanupPeriod
 
 	// Start clean service as the Cache is created
 	go cacheCleanService(&t)
-	return &t
+	return NewWithBackend(&t)
+}
+
+// NewWithBackend creates a new Cache which stores entries in the given backend.
+func NewWithBackend(backend Backend) *Cache {
+	return &Cache{backend: backend}
 }
 
 // FetchTransaction looks up an entry for the (accessToken, txnID, req.URL) tuple in Cache.
-// Looks in both the txnMaps.
 // Returns (JSON response, true) if txnID is found, else the returned bool is false.
 func (t *Cache) FetchTransaction(accessToken, txnID string, u *url.URL) (*util.JSONResponse, bool) {
+	return t.backend.Fetch(CacheKey{accessToken, txnID, filepath.Dir(u.Path)})
+}
+
+// AddTransaction adds an entry for the (accessToken, txnID, req.URL) tuple in Cache.
+func (t *Cache) AddTransaction(accessToken, txnID string, u *url.URL, res *util.JSONResponse) {
+	t.backend.Store(CacheKey{accessToken, txnID, filepath.Dir(u.Path)}, res)
+}
+
+// FetchFederationTransaction looks up an entry for a federation transaction in
+// Cache. Federation transaction IDs are scoped to the origin server rather than
+// an access token.
+func (t *Cache) FetchFederationTransaction(origin spec.ServerName, txnID string) (*util.JSONResponse, bool) {
+	return t.backend.Fetch(CacheKey{string(origin), txnID, federationSendEndpoint})
+}
+
+// AddFederationTransaction adds an entry for a federation transaction in Cache.
+func (t *Cache) AddFederationTransaction(origin spec.ServerName, txnID string, res *util.JSONResponse) {
+	t.backend.Store(CacheKey{string(origin), txnID, federationSendEndpoint}, res)
+}
+
+// memoryBackend represents a temporary store for response entries.
+// Entries are evicted after a certain period, defined by cleanupPeriod.
+// This works by keeping two maps of entries, and cycling the maps after the cleanupPeriod.
+type memoryBackend struct {
+	sync.RWMutex
+	txnsMaps      [2]txnsMap
+	cleanupPeriod time.Duration
+}
+
+// Fetch looks in both the txnMaps.
+func (t *memoryBackend) Fetch(key CacheKey) (*util.JSONResponse, bool) {
 	t.RLock()
 	defer t.RUnlock()
 	for _, txns := range t.txnsMaps {
-		res, ok := txns[CacheKey{accessToken, txnID, filepath.Dir(u.Path)}]
+		res, ok := txns[key]
 		if ok {
 			return res, true
 		}
@@ -75,18 +123,17 @@ func (t *Cache) FetchTransaction(accessToken, txnID string, u *url.URL) (*util.J
 	return nil, false
 }
 
-// AddTransaction adds an entry for the (accessToken, txnID, req.URL) tuple in Cache.
-// Adds to the front txnMap.
-func (t *Cache) AddTransaction(accessToken, txnID string, u *url.URL, res *util.JSONResponse) {
+// Store adds to the front txnMap.
+func (t *memoryBackend) Store(key CacheKey, res *util.JSONResponse) {
 	t.Lock()
 	defer t.Unlock()
-	t.txnsMaps[0][CacheKey{accessToken, txnID, filepath.Dir(u.Path)}] = res
+	t.txnsMaps[0][key] = res
 }
 
 // cacheCleanService is responsible for cleaning up entries after cleanupPeriod.
 // It guarantees that an entry will be present in cache for at least cleanupPeriod & at most 2 * cleanupPeriod.
 // This cycles the txnMaps forward, i.e. back map is assigned the front and front is assigned an empty map.
-func cacheCleanService(t *Cache) {
+func cacheCleanService(t *memoryBackend) {
 	ticker := time.NewTicker(t.cleanupPeriod).C
 	for range ticker {
 		t.Lock()
@@ -13,14 +13,18 @@
 package transactions
 
 import (
+	"encoding/json"
 	"net/http"
 	"net/url"
 	"path/filepath"
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/matrix-org/util"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
 )
 
 type fakeType struct {
@@ -104,3 +108,66 @@ func TestCacheScope(t *testing.T) {
 		t.Errorf("Wrong cache entry for (%s, %s). Expected: %v; got: %v", fakeAccessToken, fakeTxnID, fakeResponse2.JSON, res.JSON)
 	}
 }
+
+// TestJetStreamCache ensures that transactions stored by one Cache can be
+// fetched by another one using the same bucket, e.g. on another instance.
+func TestJetStreamCache(t *testing.T) {
+	server, err := natsserver.NewServer(&natsserver.Options{
+		DontListen: true,
+		JetStream:  true,
+		StoreDir:   t.TempDir(),
+		NoSigs:     true,
+		NoLog:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Start()
+	defer server.Shutdown()
+	if !server.ReadyForConnections(time.Second * 10) {
+		t.Fatal("NATS did not start in time")
+	}
+	nc, err := nats.Connect("", nats.InProcessServer(server))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := NewJetStream(js, "TestTransactionCache", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewJetStream(js, "TestTransactionCache", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sendEndpoint, _ := url.Parse("/send/1")
+	first.AddTransaction(fakeAccessToken, fakeTxnID, sendEndpoint, fakeResponse)
+	first.AddFederationTransaction("remote", fakeTxnID, fakeResponse2)
+
+	res, ok := second.FetchTransaction(fakeAccessToken, fakeTxnID, sendEndpoint)
+	if !ok {
+		t.Fatalf("failed to retrieve entry for (%s, %s)", fakeAccessToken, fakeTxnID)
+	}
+	if body, _ := json.Marshal(res.JSON); res.Code != http.StatusOK || string(body) != `{"ID":"0"}` {
+		t.Errorf("Wrong cache entry. Expected: %v; got: %d %s", fakeResponse.JSON, res.Code, body)
+	}
+	if res, ok = second.FetchFederationTransaction("remote", fakeTxnID); !ok {
+		t.Fatalf("failed to retrieve federation entry for %s", fakeTxnID)
+	} else if body, _ := json.Marshal(res.JSON); string(body) != `{"ID":"1"}` {
+		t.Errorf("Wrong federation cache entry. Expected: %v; got: %s", fakeResponse2.JSON, body)
+	}
+
+	// The scopes are still kept apart.
+	if _, ok = second.FetchTransaction(fakeAccessToken2, fakeTxnID, sendEndpoint); ok {
+		t.Errorf("unexpected entry for (%s, %s)", fakeAccessToken2, fakeTxnID)
+	}
+	if _, ok = second.FetchFederationTransaction("other", fakeTxnID); ok {
+		t.Errorf("unexpected federation entry for %s", fakeTxnID)
+	}
+}
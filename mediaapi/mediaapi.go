@@ -15,11 +15,18 @@
 package mediaapi
 
 import (
-	"github.com/gorilla/mux"
+	"context"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/httputil"
 	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/mediaapi/mediastore"
 	"github.com/neilalexander/harmony/mediaapi/routing"
 	"github.com/neilalexander/harmony/mediaapi/storage"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/setup/config"
 	userapi "github.com/neilalexander/harmony/userapi/api"
 	"github.com/sirupsen/logrus"
@@ -27,18 +34,70 @@ import (
 
 // AddPublicRoutes sets up and registers HTTP handlers for the MediaAPI component.
 func AddPublicRoutes(
-	mediaRouter *mux.Router,
+	routers httputil.Routers,
 	cm *sqlutil.Connections,
 	cfg *config.Dendrite,
 	userAPI userapi.MediaUserAPI,
+	rsAPI roomserverAPI.MediaRoomserverAPI,
 	client *fclient.Client,
+	fedClient fclient.FederationClient,
+	keyRing gomatrixserverlib.JSONVerifier,
 ) {
 	mediaDB, err := storage.NewMediaAPIDatasource(cm, &cfg.MediaAPI.Database)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to media db")
 	}
 
+	mediaStore, err := mediastore.NewMediaStore(&cfg.MediaAPI)
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to create media store")
+	}
+
 	routing.Setup(
-		mediaRouter, cfg, mediaDB, userAPI, client,
+		routers, cfg, mediaDB, mediaStore, userAPI, rsAPI, client, fedClient, keyRing,
 	)
+
+	if retention := cfg.MediaAPI.Retention; retention.Enabled() {
+		var purgeOldMedia func()
+		purgeOldMedia = func() {
+			logrus.Infof("Purging old media")
+			ctx := context.Background()
+			if days := retention.RemoteMediaLifetimeDays; days > 0 {
+				before := time.Now().AddDate(0, 0, -days)
+				if _, err := routing.PurgeMediaBefore(ctx, &cfg.MediaAPI, mediaDB, mediaStore, before, false); err != nil {
+					logrus.WithError(err).Error("Failed to purge old remote media")
+				}
+			}
+			if days := retention.LocalMediaLifetimeDays; days > 0 {
+				before := time.Now().AddDate(0, 0, -days)
+				if _, err := routing.PurgeMediaBefore(ctx, &cfg.MediaAPI, mediaDB, mediaStore, before, true); err != nil {
+					logrus.WithError(err).Error("Failed to purge old local media")
+				}
+			}
+			time.AfterFunc(time.Hour, purgeOldMedia)
+		}
+		time.AfterFunc(time.Minute, purgeOldMedia)
+	}
+
+	if cfg.MediaAPI.URLPreviews.Enabled {
+		var cleanExpiredURLPreviews func()
+		cleanExpiredURLPreviews = func() {
+			logrus.Infof("Cleaning expired URL previews")
+			if err := mediaDB.DeleteExpiredURLPreviews(context.Background(), spec.AsTimestamp(time.Now())); err != nil {
+				logrus.WithError(err).Error("Failed to clean expired URL previews")
+			}
+			time.AfterFunc(time.Hour, cleanExpiredURLPreviews)
+		}
+		time.AfterFunc(time.Minute, cleanExpiredURLPreviews)
+	}
+
+	var cleanExpiredPendingMedia func()
+	cleanExpiredPendingMedia = func() {
+		logrus.Infof("Cleaning expired pending media")
+		if err := mediaDB.DeleteExpiredPendingMedia(context.Background(), spec.AsTimestamp(time.Now())); err != nil {
+			logrus.WithError(err).Error("Failed to clean expired pending media")
+		}
+		time.AfterFunc(time.Hour, cleanExpiredPendingMedia)
+	}
+	time.AfterFunc(time.Minute, cleanExpiredPendingMedia)
 }
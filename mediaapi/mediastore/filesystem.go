@@ -0,0 +1,212 @@
+// Copyright 2017 Vector Creations Ltd
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mediastore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/matrix-org/util"
+	"github.com/neilalexander/harmony/mediaapi/fileutils"
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+// fileSystemStore stores media files beneath a base path on the local
+// filesystem, which must be shared between all instances.
+type fileSystemStore struct {
+	absBasePath config.Path
+}
+
+// NewFileSystemStore creates a media store that keeps files beneath the given
+// absolute base path.
+func NewFileSystemStore(absBasePath config.Path) MediaStore {
+	return &fileSystemStore{
+		absBasePath: absBasePath,
+	}
+}
+
+// dirFromHash evaluates the directory holding a media file and its thumbnails
+// from its Base64Hash. For example, if Base64Hash is 'qwerty', the file will
+// be stored at 'q/w/erty/file'.
+func (s *fileSystemStore) dirFromHash(hash types.Base64Hash) (string, error) {
+	parts, err := hashDir(hash)
+	if err != nil {
+		return "", err
+	}
+	dirPath, err := filepath.Abs(filepath.Join(
+		append([]string{string(s.absBasePath)}, parts...)...,
+	))
+	if err != nil {
+		return "", fmt.Errorf("unable to construct filePath: %w", err)
+	}
+
+	// check if the absolute absBasePath is a prefix of the absolute filePath
+	// if so, no directory escape has occurred and the filePath is valid
+	// Note: absBasePath is already absolute
+	if !strings.HasPrefix(dirPath, string(s.absBasePath)) {
+		return "", fmt.Errorf("invalid filePath (not within absBasePath %v): %v", s.absBasePath, dirPath)
+	}
+	return dirPath, nil
+}
+
+func (s *fileSystemStore) filePath(hash types.Base64Hash) (string, error) {
+	dirPath, err := s.dirFromHash(hash)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dirPath, "file"), nil
+}
+
+func (s *fileSystemStore) thumbnailPath(hash types.Base64Hash, size types.ThumbnailSize) (string, error) {
+	dirPath, err := s.dirFromHash(hash)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dirPath, ThumbnailName(size)), nil
+}
+
+// StoreFile checks for hash collisions when moving a temporary file to its
+// final path. If the final path exists and the file size matches, the file
+// does not need to be moved.
+func (s *fileSystemStore) StoreFile(ctx context.Context, tmpDir types.Path, metadata *types.MediaMetadata) (bool, error) {
+	// Note: in all error and success cases, we need to remove the temporary directory
+	defer fileutils.RemoveDir(tmpDir, util.GetLogger(ctx))
+	finalPath, err := s.filePath(metadata.Base64Hash)
+	if err != nil {
+		return false, fmt.Errorf("failed to get file path from metadata: %w", err)
+	}
+
+	var stat os.FileInfo
+	// Note: The double-negative is intentional as os.IsExist(err) != !os.IsNotExist(err).
+	// The functions are error checkers to be used in different cases.
+	if stat, err = os.Stat(finalPath); !os.IsNotExist(err) {
+		if err == nil && stat.Size() == int64(metadata.FileSizeBytes) {
+			return true, nil
+		}
+		return true, fmt.Errorf("downloaded file with hash collision but different file size (%v)", finalPath)
+	}
+	if err = moveFile(filepath.Join(string(tmpDir), "content"), finalPath); err != nil {
+		return false, fmt.Errorf("failed to move file to final destination (%v): %w", finalPath, err)
+	}
+	return false, nil
+}
+
+func (s *fileSystemStore) OpenFile(ctx context.Context, hash types.Base64Hash) (io.ReadCloser, types.FileSizeBytes, error) {
+	filePath, err := s.filePath(hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	return openFile(filePath)
+}
+
+func (s *fileSystemStore) StatFile(ctx context.Context, hash types.Base64Hash) (types.FileSizeBytes, error) {
+	filePath, err := s.filePath(hash)
+	if err != nil {
+		return 0, err
+	}
+	return statFile(filePath)
+}
+
+func (s *fileSystemStore) DeleteFile(ctx context.Context, hash types.Base64Hash) error {
+	dirPath, err := s.dirFromHash(hash)
+	if err != nil {
+		return err
+	}
+	if err = os.RemoveAll(dirPath); err != nil {
+		return fmt.Errorf("os.RemoveAll: %w", err)
+	}
+	return nil
+}
+
+func (s *fileSystemStore) StoreThumbnail(ctx context.Context, hash types.Base64Hash, size types.ThumbnailSize, r io.Reader, _ int64) (err error) {
+	thumbPath, err := s.thumbnailPath(hash, size)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(thumbPath)
+	if err != nil {
+		return fmt.Errorf("os.Create: %w", err)
+	}
+	defer func() {
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	if _, err = io.Copy(out, r); err != nil {
+		return fmt.Errorf("io.Copy: %w", err)
+	}
+	return nil
+}
+
+func (s *fileSystemStore) OpenThumbnail(ctx context.Context, hash types.Base64Hash, size types.ThumbnailSize) (io.ReadCloser, types.FileSizeBytes, error) {
+	thumbPath, err := s.thumbnailPath(hash, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	return openFile(thumbPath)
+}
+
+func (s *fileSystemStore) StatThumbnail(ctx context.Context, hash types.Base64Hash, size types.ThumbnailSize) (types.FileSizeBytes, error) {
+	thumbPath, err := s.thumbnailPath(hash, size)
+	if err != nil {
+		return 0, err
+	}
+	return statFile(thumbPath)
+}
+
+func openFile(filePath string) (io.ReadCloser, types.FileSizeBytes, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, 0, ErrNotFound
+	} else if err != nil {
+		return nil, 0, fmt.Errorf("os.Open: %w", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close() // nolint: errcheck
+		return nil, 0, fmt.Errorf("file.Stat: %w", err)
+	}
+	return file, types.FileSizeBytes(stat.Size()), nil
+}
+
+func statFile(filePath string) (types.FileSizeBytes, error) {
+	stat, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("os.Stat: %w", err)
+	}
+	return types.FileSizeBytes(stat.Size()), nil
+}
+
+// moveFile attempts to move the file src to dst
+func moveFile(src, dst string) error {
+	dstDir := filepath.Dir(dst)
+
+	err := os.MkdirAll(dstDir, 0770)
+	if err != nil {
+		return fmt.Errorf("failed to make directory: %w", err)
+	}
+	err = os.Rename(src, dst)
+	if err != nil {
+		return fmt.Errorf("failed to move directory: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mediastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+// ErrNotFound is returned when the requested file or thumbnail does not exist
+// in the media store.
+var ErrNotFound = errors.New("media not found in store")
+
+// MediaStore stores the contents of media files and their thumbnails. Files are
+// addressed by the Base64Hash of their contents, so that the same file uploaded
+// under several media IDs is only stored once. Metadata about the files is kept
+// in the media API database and not in the store.
+type MediaStore interface {
+	// StoreFile moves the "content" file in tmpDir, as written by
+	// fileutils.WriteTempFile, into the store under the Base64Hash in the
+	// metadata. If a file with that hash is already stored then duplicate will
+	// be true. The temporary directory is always removed.
+	StoreFile(ctx context.Context, tmpDir types.Path, metadata *types.MediaMetadata) (duplicate bool, err error)
+	// OpenFile opens a stored file for reading. The caller must close it.
+	OpenFile(ctx context.Context, hash types.Base64Hash) (io.ReadCloser, types.FileSizeBytes, error)
+	// StatFile returns the size of a stored file.
+	StatFile(ctx context.Context, hash types.Base64Hash) (types.FileSizeBytes, error)
+	// DeleteFile removes a stored file along with all of its thumbnails.
+	DeleteFile(ctx context.Context, hash types.Base64Hash) error
+
+	// StoreThumbnail stores a thumbnail of the file with the given hash.
+	StoreThumbnail(ctx context.Context, hash types.Base64Hash, size types.ThumbnailSize, r io.Reader, length int64) error
+	// OpenThumbnail opens a stored thumbnail for reading. The caller must close it.
+	OpenThumbnail(ctx context.Context, hash types.Base64Hash, size types.ThumbnailSize) (io.ReadCloser, types.FileSizeBytes, error)
+	// StatThumbnail returns the size of a stored thumbnail.
+	StatThumbnail(ctx context.Context, hash types.Base64Hash, size types.ThumbnailSize) (types.FileSizeBytes, error)
+}
+
+// NewMediaStore creates the media store that is selected in the config.
+func NewMediaStore(cfg *config.MediaAPI) (MediaStore, error) {
+	switch cfg.StorageBackend {
+	case config.MediaStorageFilesystem, "":
+		return NewFileSystemStore(cfg.AbsBasePath), nil
+	case config.MediaStorageS3:
+		return NewS3Store(&cfg.S3)
+	default:
+		return nil, fmt.Errorf("unknown media storage backend %q", cfg.StorageBackend)
+	}
+}
+
+// thumbnailTemplate is the filename template for thumbnails
+const thumbnailTemplate = "thumbnail-%vx%v-%v"
+
+// ThumbnailName returns the name that a thumbnail of the given size is stored
+// under, alongside the original file.
+func ThumbnailName(size types.ThumbnailSize) string {
+	return fmt.Sprintf(thumbnailTemplate, size.Width, size.Height, size.ResizeMethod)
+}
+
+// hashDir splits the Base64Hash into the directory that holds the file and
+// its thumbnails. 2 levels of subdirectories are created for more manageable
+// browsing and the remainder is used as the final directory name. For example,
+// if the Base64Hash is 'qwerty', the directory will be 'q/w/erty'.
+func hashDir(hash types.Base64Hash) ([]string, error) {
+	if len(hash) < 3 {
+		return nil, fmt.Errorf("invalid hash (Base64Hash too short - min 3 characters): %q", hash)
+	}
+	if len(hash) > 255 {
+		return nil, fmt.Errorf("invalid hash (Base64Hash too long - max 255 characters): %q", hash)
+	}
+	return []string{string(hash[0:1]), string(hash[1:2]), string(hash[2:])}, nil
+}
@@ -0,0 +1,441 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mediastore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/util"
+	"github.com/neilalexander/harmony/mediaapi/fileutils"
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3Service         = "s3"
+	s3UnsignedBody    = "UNSIGNED-PAYLOAD"
+	s3TimeFormat      = "20060102T150405Z"
+	s3ShortDateFormat = "20060102"
+	s3Timeout         = 30 * time.Second
+)
+
+// s3Store stores media files as objects in a bucket using the S3 API. Requests
+// are signed with AWS Signature Version 4, which is understood by Amazon S3 and
+// by the common self-hosted implementations.
+type s3Store struct {
+	cfg      *config.S3MediaStorage
+	endpoint *url.URL
+	client   *http.Client
+	now      func() time.Time
+}
+
+// NewS3Store creates a media store that keeps files in an S3 bucket.
+func NewS3Store(cfg *config.S3MediaStorage) (MediaStore, error) {
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: %w", cfg.Endpoint, err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q: scheme must be http or https", cfg.Endpoint)
+	}
+	// Objects can be large, so only connecting and waiting for the response
+	// to start are limited. Otherwise requests last as long as their context.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   s3Timeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = s3Timeout
+	transport.ResponseHeaderTimeout = s3Timeout
+	return &s3Store{
+		cfg:      cfg,
+		endpoint: endpoint,
+		client:   &http.Client{Transport: transport},
+		now:      time.Now,
+	}, nil
+}
+
+// objectKey returns the key of an object in the bucket. The layout matches the
+// filesystem store, e.g. 'prefix/q/w/erty/file'.
+func (s *s3Store) objectKey(hash types.Base64Hash, name string) (string, error) {
+	parts, err := hashDir(hash)
+	if err != nil {
+		return "", err
+	}
+	if prefix := strings.Trim(s.cfg.Prefix, "/"); prefix != "" {
+		parts = append([]string{prefix}, parts...)
+	}
+	if name != "" {
+		parts = append(parts, name)
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// objectURL returns the URL of an object, or of the bucket itself if the key
+// is empty, taking into account whether path-style addressing is in use.
+func (s *s3Store) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	basePath := strings.TrimSuffix(u.Path, "/")
+	if s.cfg.UsePathStyle {
+		basePath += "/" + s.cfg.Bucket
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	u.Path = basePath + "/" + key
+	u.RawPath = s3EscapePath(u.Path)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+func (s *s3Store) do(ctx context.Context, method, key string, query url.Values, body io.Reader, length int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key, query).String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	if body != nil {
+		// S3 requires a Content-Length on uploads, and Go would otherwise
+		// send an empty body with chunked encoding.
+		req.ContentLength = length
+		if length == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedBody)
+	s.signRequest(req, s.now())
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s.client.Do: %w", err)
+	}
+	return res, nil
+}
+
+// signRequest adds an AWS Signature Version 4 Authorization header to the
+// request, signing the host and all headers that are already set.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *s3Store) signRequest(req *http.Request, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{
+		now.Format(s3ShortDateFormat), s.cfg.Region, s3Service, "aws4_request",
+	}, "/")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.Format(s3TimeFormat),
+		scope,
+		hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+
+	signingKey := s3HMAC([]byte("AWS4"+s.cfg.SecretAccessKey), now.Format(s3ShortDateFormat))
+	signingKey = s3HMAC(signingKey, s.cfg.Region)
+	signingKey = s3HMAC(signingKey, s3Service)
+	signingKey = s3HMAC(signingKey, "aws4_request")
+	signature := hex.EncodeToString(s3HMAC(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, s.cfg.AccessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func (s *s3Store) StoreFile(ctx context.Context, tmpDir types.Path, metadata *types.MediaMetadata) (bool, error) {
+	// Note: in all error and success cases, we need to remove the temporary directory
+	defer fileutils.RemoveDir(tmpDir, util.GetLogger(ctx))
+	key, err := s.objectKey(metadata.Base64Hash, "file")
+	if err != nil {
+		return false, fmt.Errorf("failed to get object key from metadata: %w", err)
+	}
+
+	size, err := s.stat(ctx, key)
+	switch err {
+	case nil:
+		if size == metadata.FileSizeBytes {
+			return true, nil
+		}
+		return true, fmt.Errorf("downloaded file with hash collision but different file size (%v)", key)
+	case ErrNotFound:
+	default:
+		return false, err
+	}
+
+	file, err := os.Open(filepath.Join(string(tmpDir), "content"))
+	if err != nil {
+		return false, fmt.Errorf("os.Open: %w", err)
+	}
+	defer file.Close() // nolint: errcheck
+	stat, err := file.Stat()
+	if err != nil {
+		return false, fmt.Errorf("file.Stat: %w", err)
+	}
+	if err = s.put(ctx, key, file, stat.Size()); err != nil {
+		return false, fmt.Errorf("failed to upload file to S3 (%v): %w", key, err)
+	}
+	return false, nil
+}
+
+func (s *s3Store) OpenFile(ctx context.Context, hash types.Base64Hash) (io.ReadCloser, types.FileSizeBytes, error) {
+	key, err := s.objectKey(hash, "file")
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.get(ctx, key)
+}
+
+func (s *s3Store) StatFile(ctx context.Context, hash types.Base64Hash) (types.FileSizeBytes, error) {
+	key, err := s.objectKey(hash, "file")
+	if err != nil {
+		return 0, err
+	}
+	return s.stat(ctx, key)
+}
+
+// DeleteFile deletes every object beneath the directory for the hash, which
+// includes the file itself and all of its thumbnails.
+func (s *s3Store) DeleteFile(ctx context.Context, hash types.Base64Hash) error {
+	dir, err := s.objectKey(hash, "")
+	if err != nil {
+		return err
+	}
+	keys, err := s.list(ctx, dir+"/")
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = s.delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *s3Store) StoreThumbnail(ctx context.Context, hash types.Base64Hash, size types.ThumbnailSize, r io.Reader, length int64) error {
+	key, err := s.objectKey(hash, ThumbnailName(size))
+	if err != nil {
+		return err
+	}
+	return s.put(ctx, key, r, length)
+}
+
+func (s *s3Store) OpenThumbnail(ctx context.Context, hash types.Base64Hash, size types.ThumbnailSize) (io.ReadCloser, types.FileSizeBytes, error) {
+	key, err := s.objectKey(hash, ThumbnailName(size))
+	if err != nil {
+		return nil, 0, err
+	}
+	return s.get(ctx, key)
+}
+
+func (s *s3Store) StatThumbnail(ctx context.Context, hash types.Base64Hash, size types.ThumbnailSize) (types.FileSizeBytes, error) {
+	key, err := s.objectKey(hash, ThumbnailName(size))
+	if err != nil {
+		return 0, err
+	}
+	return s.stat(ctx, key)
+}
+
+func (s *s3Store) put(ctx context.Context, key string, body io.Reader, length int64) error {
+	res, err := s.do(ctx, http.MethodPut, key, nil, body, length)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return s3Error(http.MethodPut, key, res)
+	}
+	return nil
+}
+
+func (s *s3Store) get(ctx context.Context, key string) (io.ReadCloser, types.FileSizeBytes, error) {
+	res, err := s.do(ctx, http.MethodGet, key, nil, nil, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, types.FileSizeBytes(res.ContentLength), nil
+	case http.StatusNotFound:
+		res.Body.Close() // nolint: errcheck
+		return nil, 0, ErrNotFound
+	default:
+		defer res.Body.Close() // nolint: errcheck
+		return nil, 0, s3Error(http.MethodGet, key, res)
+	}
+}
+
+func (s *s3Store) stat(ctx context.Context, key string) (types.FileSizeBytes, error) {
+	res, err := s.do(ctx, http.MethodHead, key, nil, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	switch res.StatusCode {
+	case http.StatusOK:
+		return types.FileSizeBytes(res.ContentLength), nil
+	case http.StatusNotFound:
+		return 0, ErrNotFound
+	default:
+		return 0, s3Error(http.MethodHead, key, res)
+	}
+}
+
+func (s *s3Store) delete(ctx context.Context, key string) error {
+	res, err := s.do(ctx, http.MethodDelete, key, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return s3Error(http.MethodDelete, key, res)
+	}
+	return nil
+}
+
+// s3ListBucketResult is the response body of a ListObjectsV2 request.
+// https://docs.aws.amazon.com/AmazonS3/latest/API/API_ListObjectsV2.html
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list returns the keys of all objects in the bucket starting with prefix.
+func (s *s3Store) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	query := url.Values{
+		"list-type": []string{"2"},
+		"prefix":    []string{prefix},
+	}
+	for {
+		res, err := s.do(ctx, http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			err = s3Error(http.MethodGet, prefix, res)
+			res.Body.Close() // nolint: errcheck
+			return nil, err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close() // nolint: errcheck
+		if err != nil {
+			return nil, fmt.Errorf("xml.Decode: %w", err)
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func s3Error(method, key string, res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("S3 %s %q failed with HTTP %d: %s", method, key, res.StatusCode, strings.TrimSpace(string(body)))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data)) // nolint: errcheck
+	return mac.Sum(nil)
+}
+
+// s3Escape escapes a string as required by Signature Version 4, where only
+// the unreserved characters from RFC 3986 are left as they are.
+func s3Escape(str string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(path string) string {
+	return s3Escape(path, true)
+}
+
+// s3CanonicalQuery encodes the query parameters sorted by name, as required
+// by Signature Version 4.
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := make([]string, 0, len(query))
+	for _, name := range names {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3Escape(name, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package preview
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// maxDescriptionLength is the length that descriptions are truncated to.
+const maxDescriptionLength = 500
+
+// ParseHTML extracts the OpenGraph metadata from an HTML document. Where the
+// document has no OpenGraph title, description or image then they are taken
+// from the <title>, the description <meta> tag and the first <img> instead.
+// Image URLs are resolved relative to the given base URL.
+func ParseHTML(r io.Reader, base *url.URL) (types.OpenGraph, error) {
+	og := types.OpenGraph{}
+	var title, description, firstImage string
+	inTitle := false
+
+	z := html.NewTokenizer(r)
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if err := z.Err(); !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			setDefault(og, "og:title", title)
+			setDefault(og, "og:description", description)
+			setDefault(og, "og:image", resolveURL(base, firstImage))
+			if d, ok := og["og:description"].(string); ok && len([]rune(d)) > maxDescriptionLength {
+				og["og:description"] = string([]rune(d)[:maxDescriptionLength]) + "…"
+			}
+			return og, nil
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			tok := z.Token()
+			switch tok.DataAtom {
+			case atom.Title:
+				inTitle = title == "" && tt == html.StartTagToken
+			case atom.Meta:
+				key := attr(tok, "property")
+				if key == "" {
+					key = attr(tok, "name")
+				}
+				content := strings.TrimSpace(attr(tok, "content"))
+				switch {
+				case content == "":
+				case strings.HasPrefix(key, "og:"):
+					if key == "og:image" || key == "og:image:url" || key == "og:image:secure_url" {
+						key, content = "og:image", resolveURL(base, content)
+					}
+					setDefault(og, key, content)
+				case key == "description":
+					description = content
+				}
+			case atom.Img:
+				if firstImage == "" {
+					firstImage = attr(tok, "src")
+				}
+			}
+
+		case html.EndTagToken:
+			if z.Token().DataAtom == atom.Title {
+				inTitle = false
+			}
+
+		case html.TextToken:
+			if inTitle {
+				title += strings.TrimSpace(string(z.Text()))
+			}
+		}
+	}
+}
+
+// setDefault sets the key to the value unless the key is already set or the
+// value is empty. The first occurrence of a tag in a document wins.
+func setDefault(og types.OpenGraph, key, value string) {
+	if value == "" {
+		return
+	}
+	if _, ok := og[key]; !ok {
+		og[key] = value
+	}
+}
+
+func attr(tok html.Token, key string) string {
+	for _, a := range tok.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// resolveURL resolves a possibly relative URL against the base URL. Returns
+// an empty string if the URL is invalid or is not an http or https URL.
+func resolveURL(base *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := base.Parse(ref)
+	if err != nil || ValidateURL(u) != nil {
+		return ""
+	}
+	return u.String()
+}
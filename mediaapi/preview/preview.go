@@ -0,0 +1,250 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package preview fetches web pages on behalf of clients and extracts their
+// OpenGraph metadata for the /preview_url endpoint.
+package preview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/neilalexander/harmony/setup/config"
+	"golang.org/x/net/html/charset"
+)
+
+// ErrBlockedIP is returned when a URL resolves to an IP address that is
+// covered by the IP range blacklist.
+var ErrBlockedIP = errors.New("IP address blocked by the IP range blacklist")
+
+// maxRedirects is the maximum number of redirects that are followed when
+// fetching a URL.
+const maxRedirects = 5
+
+// userAgent is sent with all requests made to fetch URL previews.
+const userAgent = "Harmony URL preview (+https://github.com/neilalexander/harmony)"
+
+// Previewer fetches URLs and parses their OpenGraph metadata. All connections
+// are checked against the configured IP range blacklist and whitelist, after
+// DNS resolution has taken place, to prevent server-side request forgery.
+type Previewer struct {
+	cfg    *config.URLPreviews
+	client *http.Client
+}
+
+// NewPreviewer creates a new previewer from the URL preview configuration.
+func NewPreviewer(cfg *config.URLPreviews) (*Previewer, error) {
+	client, err := NewRestrictedClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &Previewer{
+		cfg:    cfg,
+		client: client,
+	}, nil
+}
+
+// NewRestrictedClient creates an HTTP client for fetching URLs supplied by
+// users or remote servers. Connections to IP addresses covered by the IP range
+// blacklist, and not by the whitelist, fail with ErrBlockedIP. This is checked
+// after DNS resolution and for every redirect.
+func NewRestrictedClient(cfg *config.URLPreviews) (*http.Client, error) {
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	transport, err := newRestrictedTransport(cfg.IPRangeBlacklist, cfg.IPRangeWhitelist, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Timeout:       timeout,
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+	}, nil
+}
+
+// NewRestrictedDownloadClient creates an HTTP client like NewRestrictedClient
+// for following redirects to remote media. The timeout only applies until the
+// response headers are received, so that large files can still be downloaded.
+func NewRestrictedDownloadClient(cfg *config.RemoteMediaDownloads) (*http.Client, error) {
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	transport, err := newRestrictedTransport(cfg.IPRangeBlacklist, cfg.IPRangeWhitelist, timeout)
+	if err != nil {
+		return nil, err
+	}
+	transport.ResponseHeaderTimeout = timeout
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: checkRedirect,
+	}, nil
+}
+
+func newRestrictedTransport(blacklistCIDRs, whitelistCIDRs []string, timeout time.Duration) (*http.Transport, error) {
+	blacklist, err := parseCIDRs(blacklistCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("ip_range_blacklist: %w", err)
+	}
+	whitelist, err := parseCIDRs(whitelistCIDRs)
+	if err != nil {
+		return nil, fmt.Errorf("ip_range_whitelist: %w", err)
+	}
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !ipAllowed(ip, blacklist, whitelist) {
+				return ErrBlockedIP
+			}
+			return nil
+		},
+	}
+	return &http.Transport{
+		// Proxies are deliberately not used, as they would bypass the
+		// IP range checks that are made when dialling.
+		Proxy:               nil,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: timeout,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     time.Minute,
+	}, nil
+}
+
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxRedirects)
+	}
+	return ValidateURL(req.URL)
+}
+
+// Fetch makes a GET request for the URL. The caller must close the body of
+// the response. Responses with a status other than 200 are returned as errors.
+func (p *Previewer) Fetch(ctx context.Context, rawURL string) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("url.Parse: %w", err)
+	}
+	if err = ValidateURL(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("http.NewRequest: %w", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "text/html, application/xhtml+xml, image/*;q=0.9, */*;q=0.8")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// Preview fetches the URL and returns its OpenGraph metadata. If the URL is an
+// HTML page then the metadata is parsed from it, falling back to the title and
+// other tags where OpenGraph tags are missing. If the URL is an image then it
+// is returned as the "og:image". Any "og:image" is returned as an absolute
+// URL, which the caller is expected to fetch and store if it wants to.
+func (p *Previewer) Preview(ctx context.Context, rawURL string) (types.OpenGraph, error) {
+	resp, err := p.Fetch(ctx, rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	contentType := resp.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		body := io.LimitReader(resp.Body, int64(p.cfg.MaxPageSizeBytes))
+		reader, err := charset.NewReader(body, contentType)
+		if err != nil {
+			return nil, fmt.Errorf("charset.NewReader: %w", err)
+		}
+		og, err := ParseHTML(reader, resp.Request.URL)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := og["og:url"]; !ok {
+			og["og:url"] = resp.Request.URL.String()
+		}
+		return og, nil
+	case strings.HasPrefix(mediaType, "image/"):
+		return types.OpenGraph{
+			"og:url":   resp.Request.URL.String(),
+			"og:image": resp.Request.URL.String(),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported content type %q", mediaType)
+	}
+}
+
+// ValidateURL checks that the URL can be fetched by a restricted client. Only
+// http and https URLs are allowed.
+func ValidateURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("URL has no host")
+	}
+	return nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// ipAllowed returns whether a connection to the IP address is allowed. The
+// whitelist takes precedence over the blacklist.
+func ipAllowed(ip net.IP, blacklist, whitelist []*net.IPNet) bool {
+	// Check IPv4-mapped IPv6 addresses against the IPv4 ranges too.
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, ipNet := range whitelist {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	for _, ipNet := range blacklist {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
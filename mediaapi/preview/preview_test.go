@@ -0,0 +1,188 @@
+package preview
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+const testPage = `<!DOCTYPE html>
+<html>
+<head>
+	<title>Fallback title</title>
+	<meta property="og:title" content="The title">
+	<meta property="og:title" content="A later title">
+	<meta property="og:image" content="/image.png">
+	<meta name="description" content="A description">
+	<meta property="og:site_name" content="Example">
+</head>
+<body><img src="/other.png"></body>
+</html>`
+
+func mustCreatePreviewer(t *testing.T, cfg *config.URLPreviews) *Previewer {
+	t.Helper()
+	p, err := NewPreviewer(cfg)
+	if err != nil {
+		t.Fatalf("failed to create previewer: %v", err)
+	}
+	return p
+}
+
+func testConfig(whitelist ...string) *config.URLPreviews {
+	return &config.URLPreviews{
+		Enabled:              true,
+		MaxPageSizeBytes:     1024 * 1024,
+		TimeoutSeconds:       5,
+		CacheLifetimeMinutes: 1,
+		IPRangeBlacklist:     config.DefaultIPRangeBlacklist,
+		IPRangeWhitelist:     whitelist,
+	}
+}
+
+func TestPreview(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte(testPage))
+		case "/redirect":
+			http.Redirect(w, req, "/page", http.StatusFound)
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			_, _ = w.Write([]byte("not really a png"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	// httptest listens on the loopback address, which is blacklisted by default.
+	p := mustCreatePreviewer(t, testConfig("127.0.0.0/8", "::1/128"))
+	ctx := context.Background()
+
+	t.Run("parses OpenGraph tags", func(t *testing.T) {
+		og, err := p.Preview(ctx, srv.URL+"/redirect")
+		if err != nil {
+			t.Fatalf("failed to preview: %v", err)
+		}
+		want := types.OpenGraph{
+			"og:title":       "The title",
+			"og:description": "A description",
+			"og:image":       srv.URL + "/image.png",
+			"og:site_name":   "Example",
+			"og:url":         srv.URL + "/page",
+		}
+		if len(og) != len(want) {
+			t.Fatalf("got %+v, want %+v", og, want)
+		}
+		for k, v := range want {
+			if og[k] != v {
+				t.Fatalf("got %s = %v, want %v", k, og[k], v)
+			}
+		}
+	})
+
+	t.Run("previews images", func(t *testing.T) {
+		og, err := p.Preview(ctx, srv.URL+"/image.png")
+		if err != nil {
+			t.Fatalf("failed to preview: %v", err)
+		}
+		if og["og:image"] != srv.URL+"/image.png" {
+			t.Fatalf("got og:image %v", og["og:image"])
+		}
+	})
+
+	t.Run("fails on error status", func(t *testing.T) {
+		if _, err := p.Preview(ctx, srv.URL+"/missing"); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+
+	t.Run("rejects other schemes", func(t *testing.T) {
+		if _, err := p.Preview(ctx, "file:///etc/passwd"); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+
+	t.Run("blocks blacklisted IPs", func(t *testing.T) {
+		blocked := mustCreatePreviewer(t, testConfig())
+		if _, err := blocked.Preview(ctx, srv.URL+"/page"); !errors.Is(err, ErrBlockedIP) {
+			t.Fatalf("expected ErrBlockedIP, got %v", err)
+		}
+	})
+}
+
+func TestRestrictedDownloadClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("first half, "))
+		w.(http.Flusher).Flush()
+		time.Sleep(1500 * time.Millisecond)
+		_, _ = w.Write([]byte("second half"))
+	}))
+	defer srv.Close()
+
+	cfg := &config.RemoteMediaDownloads{
+		TimeoutSeconds:   1,
+		IPRangeBlacklist: config.DefaultIPRangeBlacklist,
+	}
+
+	t.Run("blocks blacklisted IPs", func(t *testing.T) {
+		client, err := NewRestrictedDownloadClient(cfg)
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		if _, err = client.Get(srv.URL); !errors.Is(err, ErrBlockedIP) {
+			t.Fatalf("expected ErrBlockedIP, got %v", err)
+		}
+	})
+
+	t.Run("downloads take longer than the timeout", func(t *testing.T) {
+		whitelisted := *cfg
+		whitelisted.IPRangeWhitelist = []string{"127.0.0.0/8", "::1/128"}
+		client, err := NewRestrictedDownloadClient(&whitelisted)
+		if err != nil {
+			t.Fatalf("failed to create client: %v", err)
+		}
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("failed to download: %v", err)
+		}
+		defer resp.Body.Close() // nolint: errcheck
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("failed to read body: %v", err)
+		}
+		if string(body) != "first half, second half" {
+			t.Fatalf("unexpected body %q", body)
+		}
+	})
+}
+
+func TestParseHTMLFallbacks(t *testing.T) {
+	base, _ := url.Parse("https://example.com/articles/1")
+	og, err := ParseHTML(strings.NewReader(`<html><head>
+		<title>Page &amp; title</title>
+		<meta name="description" content="`+strings.Repeat("a", maxDescriptionLength+10)+`">
+		</head><body><img src="pic.jpg"><img src="other.jpg"></body></html>`), base)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if og["og:title"] != "Page & title" {
+		t.Fatalf("got og:title %v", og["og:title"])
+	}
+	if og["og:image"] != "https://example.com/articles/pic.jpg" {
+		t.Fatalf("got og:image %v", og["og:image"])
+	}
+	if d := og["og:description"].(string); len([]rune(d)) != maxDescriptionLength+1 {
+		t.Fatalf("expected description to be truncated, got %d characters", len([]rune(d)))
+	}
+}
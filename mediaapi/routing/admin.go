@@ -0,0 +1,362 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/matrix-org/util"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/httputil"
+	"github.com/neilalexander/harmony/mediaapi/mediastore"
+	"github.com/neilalexander/harmony/mediaapi/storage"
+	"github.com/neilalexander/harmony/mediaapi/types"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/sirupsen/logrus"
+)
+
+// purgeBatchSize is the number of media items that are looked up at a time
+// when purging old media.
+const purgeBatchSize = 500
+
+// AdminQuarantineMedia marks a single MXC URI as quarantined, or removes the
+// quarantine if quarantined is false. Any other media with the same file is
+// affected too. Media from remote servers which has not been cached here yet
+// is quarantined as soon as it is fetched.
+func AdminQuarantineMedia(req *http.Request, cfg *config.MediaAPI, db storage.Database, quarantined bool) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	mediaID, origin := types.MediaID(vars["mediaID"]), spec.ServerName(vars["serverName"])
+
+	if cfg.Matrix.IsLocalServerName(origin) {
+		mediaMetadata, err := db.GetMediaMetadata(req.Context(), mediaID, origin)
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		if mediaMetadata == nil {
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: spec.NotFound("Media not found"),
+			}
+		}
+	}
+
+	affected, err := db.SetMediaQuarantined(req.Context(), mediaID, origin, quarantined)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"affected": affected,
+		},
+	}
+}
+
+// AdminQuarantineUserMedia quarantines all media uploaded by the given user,
+// along with any other media with the same files.
+func AdminQuarantineUserMedia(req *http.Request, db storage.Database) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	userID, err := spec.NewUserID(vars["userID"], true)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+
+	affected, err := db.SetUserMediaQuarantined(req.Context(), types.MatrixUserID(userID.String()), true)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"affected": affected,
+		},
+	}
+}
+
+// AdminQuarantineRoomMedia quarantines all media that is referenced by events
+// in the given room. Media from remote servers which has not been cached here
+// yet is quarantined as soon as it is fetched.
+func AdminQuarantineRoomMedia(req *http.Request, db storage.Database, rsAPI roomserverAPI.MediaRoomserverAPI) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	roomID := vars["roomID"]
+	if _, err = spec.NewRoomID(roomID); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+
+	uris, err := rsAPI.QueryMediaURIsForRoom(req.Context(), roomID)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	var affected int64
+	for _, uri := range uris {
+		origin, mediaID, ok := parseMXCURI(uri)
+		if !ok {
+			continue
+		}
+		n, err := db.SetMediaQuarantined(req.Context(), mediaID, origin, true)
+		if err != nil {
+			logrus.WithError(err).WithField("mxc", uri).Error("Failed to quarantine media")
+			return util.ErrorResponse(err)
+		}
+		affected += n
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"affected": affected,
+		},
+	}
+}
+
+// AdminDeleteMedia deletes a single piece of local media, along with its
+// thumbnails. The file itself is only removed from the media store once no
+// other media refers to it.
+func AdminDeleteMedia(req *http.Request, cfg *config.MediaAPI, db storage.Database, store mediastore.MediaStore) util.JSONResponse {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	origin := spec.ServerName(vars["serverName"])
+	if !cfg.Matrix.IsLocalServerName(origin) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Only local media can be deleted"),
+		}
+	}
+
+	mediaMetadata, err := db.GetMediaMetadata(req.Context(), types.MediaID(vars["mediaID"]), origin)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	if mediaMetadata == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Media not found"),
+		}
+	}
+	if err = deleteMedia(req.Context(), db, store, mediaMetadata); err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"affected": []string{mxcURI(mediaMetadata)},
+		},
+	}
+}
+
+// AdminPurgeRemoteMedia deletes all media cached from remote servers that is
+// older than the number of days given in the "days" query parameter.
+func AdminPurgeRemoteMedia(req *http.Request, cfg *config.MediaAPI, db storage.Database, store mediastore.MediaStore) util.JSONResponse {
+	days, err := strconv.Atoi(req.URL.Query().Get("days"))
+	if err != nil || days < 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("days must be a non-negative integer"),
+		}
+	}
+
+	before := time.Now().AddDate(0, 0, -days)
+	affected, err := PurgeMediaBefore(req.Context(), cfg, db, store, before, false)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"affected": affected,
+		},
+	}
+}
+
+// AdminGetUserMediaQuota returns the media quota of a local user and how much
+// of it they have used.
+func AdminGetUserMediaQuota(req *http.Request, cfg *config.MediaAPI, db storage.Database) util.JSONResponse {
+	userID, resErr := localUserIDFromRequest(req, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	override, err := db.GetUserMediaQuota(req.Context(), userID)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+	quota, used, err := userQuota(req.Context(), cfg, db, userID)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"user_id":     userID,
+			"quota_bytes": quota,
+			"used_bytes":  used,
+			"is_default":  override == nil,
+		},
+	}
+}
+
+// AdminSetUserMediaQuota overrides the default media quota of a local user. A
+// quota of 0 allows the user to upload without limit.
+func AdminSetUserMediaQuota(req *http.Request, cfg *config.MediaAPI, db storage.Database) util.JSONResponse {
+	userID, resErr := localUserIDFromRequest(req, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	request := struct {
+		QuotaBytes *types.FileSizeBytes `json:"quota_bytes"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON(fmt.Sprintf("Failed to decode request body: %s", err)),
+		}
+	}
+	if request.QuotaBytes == nil || *request.QuotaBytes < 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("quota_bytes must be a non-negative integer"),
+		}
+	}
+	if err := db.SetUserMediaQuota(req.Context(), userID, *request.QuotaBytes); err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminDeleteUserMediaQuota removes the media quota override of a local user,
+// so that the default quota applies to them again.
+func AdminDeleteUserMediaQuota(req *http.Request, cfg *config.MediaAPI, db storage.Database) util.JSONResponse {
+	userID, resErr := localUserIDFromRequest(req, cfg)
+	if resErr != nil {
+		return *resErr
+	}
+	if err := db.DeleteUserMediaQuota(req.Context(), userID); err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func localUserIDFromRequest(req *http.Request, cfg *config.MediaAPI) (types.MatrixUserID, *util.JSONResponse) {
+	vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+	if err != nil {
+		resErr := util.ErrorResponse(err)
+		return "", &resErr
+	}
+	userID := vars["userID"]
+	if _, _, err = cfg.Matrix.SplitLocalID('@', userID); err != nil {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	return types.MatrixUserID(userID), nil
+}
+
+// PurgeMediaBefore deletes all media that was created before the given time,
+// either media uploaded to this server if local is true, or media cached from
+// remote servers otherwise. Returns the MXC URIs of the deleted media.
+func PurgeMediaBefore(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, store mediastore.MediaStore,
+	before time.Time, local bool,
+) ([]string, error) {
+	localOrigins := []spec.ServerName{cfg.Matrix.ServerName}
+	for _, v := range cfg.Matrix.VirtualHosts {
+		localOrigins = append(localOrigins, v.ServerName)
+	}
+
+	affected := []string{}
+	for {
+		media, err := db.GetMediaBefore(ctx, spec.AsTimestamp(before), localOrigins, local, purgeBatchSize)
+		if err != nil {
+			return affected, fmt.Errorf("db.GetMediaBefore: %w", err)
+		}
+		for _, mediaMetadata := range media {
+			if err = deleteMedia(ctx, db, store, mediaMetadata); err != nil {
+				return affected, err
+			}
+			affected = append(affected, mxcURI(mediaMetadata))
+		}
+		if len(media) < purgeBatchSize {
+			return affected, nil
+		}
+	}
+}
+
+// deleteMedia removes the media and its thumbnails from the database, and then
+// removes the file from the media store if nothing else refers to it.
+func deleteMedia(ctx context.Context, db storage.Database, store mediastore.MediaStore, mediaMetadata *types.MediaMetadata) error {
+	hashInUse, err := db.DeleteMedia(ctx, mediaMetadata.MediaID, mediaMetadata.Origin)
+	if err != nil {
+		return fmt.Errorf("db.DeleteMedia: %w", err)
+	}
+	if hashInUse {
+		return nil
+	}
+	if err = store.DeleteFile(ctx, mediaMetadata.Base64Hash); err != nil {
+		return fmt.Errorf("store.DeleteFile: %w", err)
+	}
+	return nil
+}
+
+func mxcURI(mediaMetadata *types.MediaMetadata) string {
+	return "mxc://" + string(mediaMetadata.Origin) + "/" + string(mediaMetadata.MediaID)
+}
+
+// parseMXCURI splits an MXC URI of the form mxc://<server-name>/<media-id>.
+func parseMXCURI(uri string) (spec.ServerName, types.MediaID, bool) {
+	origin, mediaID, ok := strings.Cut(strings.TrimPrefix(uri, "mxc://"), "/")
+	if !ok || origin == "" || mediaID == "" || !strings.HasPrefix(uri, "mxc://") {
+		return "", "", false
+	}
+	return spec.ServerName(origin), types.MediaID(mediaID), true
+}
@@ -0,0 +1,176 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/util"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/mediaapi/mediastore"
+	"github.com/neilalexander/harmony/mediaapi/storage"
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/neilalexander/harmony/setup/config"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+// createResponse defines the format of the JSON response
+// https://spec.matrix.org/v1.11/client-server-api/#post_matrixmediav1create
+type createResponse struct {
+	ContentURI      string         `json:"content_uri"`
+	UnusedExpiresAt spec.Timestamp `json:"unused_expires_at"`
+}
+
+// CreateMedia implements POST /_matrix/media/v1/create
+// It reserves an MXC URI which the user can upload content to later with
+// PUT /upload/{serverName}/{mediaId}, so that the MXC URI can be sent to a
+// room before the upload has finished.
+func CreateMedia(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database) util.JSONResponse {
+	ctx := req.Context()
+	now := time.Now()
+	userID := types.MatrixUserID(dev.UserID)
+	logger := util.GetLogger(ctx).WithField("Origin", cfg.Matrix.ServerName)
+
+	count, err := db.GetPendingMediaCount(ctx, userID, spec.AsTimestamp(now))
+	if err != nil {
+		logger.WithError(err).Error("Failed to count pending media")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if count >= cfg.AsyncUploads.MaxPendingUploads {
+		return util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: spec.LimitExceeded("Too many pending uploads, upload content to the existing MXC URIs first", 0),
+		}
+	}
+
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin: cfg.Matrix.ServerName,
+		},
+		Logger: logger,
+	}
+	mediaID, err := r.generateMediaID(ctx, db)
+	if err != nil {
+		logger.WithError(err).Error("Failed to generate media ID for pending media")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	pending := &types.PendingMedia{
+		MediaID:           mediaID,
+		Origin:            cfg.Matrix.ServerName,
+		UserID:            userID,
+		CreationTimestamp: spec.AsTimestamp(now),
+		ExpiresTimestamp:  spec.AsTimestamp(now.Add(time.Duration(cfg.AsyncUploads.UnusedExpiryMinutes) * time.Minute)),
+	}
+	if err = db.StorePendingMedia(ctx, pending); err != nil {
+		logger.WithError(err).Error("Failed to store pending media")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: createResponse{
+			ContentURI:      fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, mediaID),
+			UnusedExpiresAt: pending.ExpiresTimestamp,
+		},
+	}
+}
+
+// UploadPendingMedia implements PUT /upload/{serverName}/{mediaId}
+// It uploads content to an MXC URI which was previously reserved by the same
+// user with /create. Content can only be uploaded to each MXC URI once.
+// https://spec.matrix.org/v1.11/client-server-api/#put_matrixmediav3uploadservernamemediaid
+func UploadPendingMedia(
+	req *http.Request,
+	cfg *config.MediaAPI,
+	dev *userapi.Device,
+	db storage.Database,
+	store mediastore.MediaStore,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	serverName spec.ServerName,
+	mediaID types.MediaID,
+) util.JSONResponse {
+	ctx := req.Context()
+	if serverName != cfg.Matrix.ServerName {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Unknown media ID"),
+		}
+	}
+
+	existingMetadata, err := db.GetMediaMetadata(ctx, mediaID, serverName)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to query media metadata")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if existingMetadata != nil {
+		return util.JSONResponse{
+			Code: http.StatusConflict,
+			JSON: spec.CannotOverwriteMedia("Content has already been uploaded to this media ID"),
+		}
+	}
+
+	pending, err := db.GetPendingMedia(ctx, mediaID, serverName, spec.AsTimestamp(time.Now()))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to query pending media")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if pending == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound("Unknown or expired media ID"),
+		}
+	}
+	if pending.UserID != types.MatrixUserID(dev.UserID) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("Media ID was created by another user"),
+		}
+	}
+
+	r, resErr := parseAndValidateRequest(req, cfg, dev)
+	if resErr != nil {
+		return *resErr
+	}
+	r.MediaMetadata.MediaID = mediaID
+	r.Pending = true
+	r.Logger = r.Logger.WithField("media_id", mediaID)
+
+	if resErr = r.doUpload(ctx, req.Body, cfg, db, store, activeThumbnailGeneration); resErr != nil {
+		return *resErr
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
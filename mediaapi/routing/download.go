@@ -21,20 +21,23 @@ import (
 	"io"
 	"io/fs"
 	"mime"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
-	"os"
-	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 	"unicode"
 
 	"github.com/matrix-org/util"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/mediaapi/fileutils"
+	"github.com/neilalexander/harmony/mediaapi/mediastore"
+	"github.com/neilalexander/harmony/mediaapi/preview"
 	"github.com/neilalexander/harmony/mediaapi/storage"
 	"github.com/neilalexander/harmony/mediaapi/thumbnailer"
 	"github.com/neilalexander/harmony/mediaapi/types"
@@ -48,6 +51,25 @@ const mediaIDCharacters = "A-Za-z0-9_=-"
 // Note: unfortunately regex.MustCompile() cannot be assigned to a const
 var mediaIDRegex = regexp.MustCompile("^[" + mediaIDCharacters + "]+$")
 
+// The default and maximum amount of time that a download will wait for content
+// to be uploaded to an MXC URI that was created with /create.
+const (
+	defaultDownloadTimeout = 20 * time.Second
+	maxDownloadTimeout     = 60 * time.Second
+)
+
+// thumbnailGenerationTimeout limits how long thumbnails are generated for in
+// the background after a file is stored, as there is no request to cancel it.
+const thumbnailGenerationTimeout = 5 * time.Minute
+
+// pendingMediaPollInterval is how often the database is checked for content
+// while waiting for it to be uploaded.
+const pendingMediaPollInterval = 500 * time.Millisecond
+
+// errNotYetUploaded is returned when the content of a pending MXC URI was not
+// uploaded before the download timed out.
+var errNotYetUploaded = errors.New("media has not been uploaded yet")
+
 // Regular expressions to help us cope with Content-Disposition parsing
 var rfc2183 = regexp.MustCompile(`filename\=utf-8\"(.*)\"`)
 var rfc6266 = regexp.MustCompile(`filename\*\=utf-8\'\'(.*)`)
@@ -61,6 +83,12 @@ type downloadRequest struct {
 	ThumbnailSize      types.ThumbnailSize
 	Logger             *log.Entry
 	DownloadFilename   string
+	MultipartResponse  bool
+	// How long to wait for content to be uploaded to a pending MXC URI.
+	Timeout time.Duration
+	// The client used to follow redirects to remote media, which can't
+	// connect to blacklisted IP ranges.
+	redirectClient *http.Client
 }
 
 // Taken from: https://github.com/matrix-org/synapse/blob/c3627d0f99ed5a23479305dc2bd0e71ca25ce2b1/synapse/media/_base.py#L53C1-L84
@@ -103,6 +131,8 @@ var allowInlineTypes = map[types.ContentType]struct{}{
 // If they are present in the cache, they are served directly.
 // If they are not present in the cache, they are obtained from the remote server and
 // simultaneously served back to the client and written into the cache.
+// If multipartResponse is set then the file is sent in the multipart format used
+// by the federation media endpoints.
 func Download(
 	w http.ResponseWriter,
 	req *http.Request,
@@ -110,11 +140,15 @@ func Download(
 	mediaID types.MediaID,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.MediaStore,
 	client *fclient.Client,
+	fedClient fclient.FederationClient,
+	redirectClient *http.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	isThumbnailRequest bool,
 	customFilename string,
+	multipartResponse bool,
 ) {
 	dReq := &downloadRequest{
 		MediaMetadata: &types.MediaMetadata{
@@ -126,7 +160,24 @@ func Download(
 			"Origin":  origin,
 			"MediaID": mediaID,
 		}),
-		DownloadFilename: customFilename,
+		DownloadFilename:  customFilename,
+		MultipartResponse: multipartResponse,
+		Timeout:           defaultDownloadTimeout,
+		redirectClient:    redirectClient,
+	}
+
+	if timeoutMS := req.FormValue("timeout_ms"); timeoutMS != "" {
+		ms, err := strconv.ParseInt(timeoutMS, 10, 64)
+		if err != nil || ms < 0 {
+			dReq.jsonErrorResponse(w, util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("timeout_ms must be a non-negative integer"),
+			})
+			return
+		}
+		if dReq.Timeout = time.Duration(ms) * time.Millisecond; dReq.Timeout > maxDownloadTimeout {
+			dReq.Timeout = maxDownloadTimeout
+		}
 	}
 
 	if dReq.IsThumbnailRequest {
@@ -157,14 +208,22 @@ func Download(
 	}
 
 	metadata, err := dReq.doDownload(
-		req.Context(), w, cfg, db, client,
+		req.Context(), w, cfg, db, store, client, fedClient,
 		activeRemoteRequests, activeThumbnailGeneration,
 	)
+	if errors.Is(err, errNotYetUploaded) {
+		dReq.jsonErrorResponse(w, util.JSONResponse{
+			Code: http.StatusGatewayTimeout,
+			JSON: spec.NotYetUploaded("Media has not been uploaded yet"),
+		})
+		return
+	}
 	if err != nil {
-		// If we bubbled up a os.PathError, e.g. no such file or directory, don't send
-		// it to the client, be more generic.
+		// If we bubbled up a os.PathError, e.g. no such file or directory, or the
+		// file is missing from the media store, don't send it to the client, be
+		// more generic.
 		var perr *fs.PathError
-		if errors.As(err, &perr) {
+		if errors.As(err, &perr) || errors.Is(err, mediastore.ErrNotFound) {
 			dReq.Logger.WithError(err).Error("failed to open file")
 			dReq.jsonErrorResponse(w, util.JSONResponse{
 				Code: http.StatusNotFound,
@@ -251,7 +310,9 @@ func (r *downloadRequest) doDownload(
 	w http.ResponseWriter,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.MediaStore,
 	client *fclient.Client,
+	fedClient fclient.FederationClient,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) (*types.MediaMetadata, error) {
@@ -262,14 +323,28 @@ func (r *downloadRequest) doDownload(
 	if err != nil {
 		return nil, fmt.Errorf("db.GetMediaMetadata: %w", err)
 	}
+	if mediaMetadata == nil && cfg.Matrix.IsLocalServerName(r.MediaMetadata.Origin) {
+		// If we do not have a record and the origin is local, the file may still be
+		// being uploaded to an MXC URI that was created with /create. Otherwise the
+		// file is not found
+		mediaMetadata, err = r.waitForPendingMedia(ctx, db)
+		if err != nil || mediaMetadata == nil {
+			return nil, err
+		}
+	}
 	if mediaMetadata == nil {
-		if r.MediaMetadata.Origin == cfg.Matrix.ServerName {
-			// If we do not have a record and the origin is local, the file is not found
+		// Don't bother fetching remote media which has already been quarantined
+		quarantined, err := db.IsMediaQuarantined(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+		if err != nil {
+			return nil, fmt.Errorf("db.IsMediaQuarantined: %w", err)
+		}
+		if quarantined {
+			r.Logger.Info("Refusing to fetch quarantined media")
 			return nil, nil
 		}
 		// If we do not have a record and the origin is remote, we need to fetch it and respond with that file
 		resErr := r.getRemoteFile(
-			ctx, client, cfg, db, activeRemoteRequests, activeThumbnailGeneration,
+			ctx, client, fedClient, cfg, db, store, activeRemoteRequests, activeThumbnailGeneration,
 		)
 		if resErr != nil {
 			return nil, resErr
@@ -279,51 +354,78 @@ func (r *downloadRequest) doDownload(
 		r.MediaMetadata = mediaMetadata
 	}
 	return r.respondFromLocalFile(
-		ctx, w, cfg.AbsBasePath, activeThumbnailGeneration,
+		ctx, w, store, activeThumbnailGeneration,
 		cfg.MaxThumbnailGenerators, db,
 		cfg.DynamicThumbnails, cfg.ThumbnailSizes,
 	)
 }
 
-// respondFromLocalFile reads a file from local storage and writes it to the http.ResponseWriter
-// If no file was found then returns nil, nil
+// waitForPendingMedia waits for content to be uploaded to a local MXC URI that
+// was created with /create, for up to the timeout of the request. Returns nil
+// if the MXC URI is unknown or has expired, or errNotYetUploaded if nothing was
+// uploaded before the timeout.
+func (r *downloadRequest) waitForPendingMedia(ctx context.Context, db storage.Database) (*types.MediaMetadata, error) {
+	deadline := time.Now().Add(r.Timeout)
+	for {
+		pending, err := db.GetPendingMedia(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin, spec.AsTimestamp(time.Now()))
+		if err != nil {
+			return nil, fmt.Errorf("db.GetPendingMedia: %w", err)
+		}
+		// The upload may have completed since the media metadata was last
+		// checked, in which case the pending media will have gone too.
+		mediaMetadata, err := db.GetMediaMetadata(ctx, r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+		if err != nil {
+			return nil, fmt.Errorf("db.GetMediaMetadata: %w", err)
+		}
+		if mediaMetadata != nil || pending == nil {
+			return mediaMetadata, nil
+		}
+		if !time.Now().Before(deadline) {
+			return nil, errNotYetUploaded
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(pendingMediaPollInterval):
+		}
+	}
+}
+
+// respondFromLocalFile reads a file from the media store and writes it to the http.ResponseWriter
+// If no file was found, or the media has been quarantined, then returns nil, nil
 func (r *downloadRequest) respondFromLocalFile(
 	ctx context.Context,
 	w http.ResponseWriter,
-	absBasePath config.Path,
+	store mediastore.MediaStore,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
 ) (*types.MediaMetadata, error) {
-	filePath, err := fileutils.GetPathFromBase64Hash(r.MediaMetadata.Base64Hash, absBasePath)
-	if err != nil {
-		return nil, fmt.Errorf("fileutils.GetPathFromBase64Hash: %w", err)
-	}
-	file, err := os.Open(filePath)
-	defer file.Close() // nolint: errcheck, staticcheck, megacheck
-	if err != nil {
-		return nil, fmt.Errorf("os.Open: %w", err)
+	if r.MediaMetadata.Quarantined {
+		r.Logger.Info("Refusing to serve quarantined media")
+		return nil, nil
 	}
-	stat, err := file.Stat()
+	file, fileSize, err := store.OpenFile(ctx, r.MediaMetadata.Base64Hash)
 	if err != nil {
-		return nil, fmt.Errorf("file.Stat: %w", err)
+		return nil, fmt.Errorf("store.OpenFile: %w", err)
 	}
+	defer file.Close() // nolint: errcheck
 
-	if r.MediaMetadata.FileSizeBytes > 0 && int64(r.MediaMetadata.FileSizeBytes) != stat.Size() {
+	if r.MediaMetadata.FileSizeBytes > 0 && r.MediaMetadata.FileSizeBytes != fileSize {
 		r.Logger.WithFields(log.Fields{
 			"fileSizeDatabase": r.MediaMetadata.FileSizeBytes,
-			"fileSizeDisk":     stat.Size(),
-		}).Warn("File size in database and on-disk differ.")
-		return nil, errors.New("file size in database and on-disk differ")
+			"fileSizeStore":    fileSize,
+		}).Warn("File size in database and in media store differ.")
+		return nil, errors.New("file size in database and in media store differ")
 	}
 
-	var responseFile *os.File
+	var responseFile io.Reader
 	var responseMetadata *types.MediaMetadata
 	if r.IsThumbnailRequest {
 		thumbFile, thumbMetadata, resErr := r.getThumbnailFile(
-			ctx, types.Path(filePath), activeThumbnailGeneration, maxThumbnailGenerators,
+			ctx, store, activeThumbnailGeneration, maxThumbnailGenerators,
 			db, dynamicThumbnails, thumbnailSizes,
 		)
 		if thumbFile != nil {
@@ -355,13 +457,16 @@ func (r *downloadRequest) respondFromLocalFile(
 		}).Trace("Responding with file")
 		responseFile = file
 		responseMetadata = r.MediaMetadata
-		if err := r.addDownloadFilenameToHeaders(w, responseMetadata); err != nil {
+	}
+
+	fileHeader := http.Header{}
+	if !r.IsThumbnailRequest {
+		if err := r.addDownloadFilenameToHeaders(fileHeader, responseMetadata); err != nil {
 			return nil, err
 		}
 	}
+	fileHeader.Set("Content-Type", string(responseMetadata.ContentType))
 
-	w.Header().Set("Content-Type", string(responseMetadata.ContentType))
-	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
 	contentSecurityPolicy := "default-src 'none';" +
 		" script-src 'none';" +
 		" plugin-types application/pdf;" +
@@ -369,14 +474,59 @@ func (r *downloadRequest) respondFromLocalFile(
 		" object-src 'self';"
 	w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
 
+	if r.MultipartResponse {
+		if err := r.respondWithMultipart(w, fileHeader, responseFile); err != nil {
+			return nil, err
+		}
+		return responseMetadata, nil
+	}
+
+	for key, values := range fileHeader {
+		w.Header()[key] = values
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(responseMetadata.FileSizeBytes), 10))
+
 	if _, err := io.Copy(w, responseFile); err != nil {
 		return nil, fmt.Errorf("io.Copy: %w", err)
 	}
 	return responseMetadata, nil
 }
 
-func (r *downloadRequest) addDownloadFilenameToHeaders(
+// respondWithMultipart writes the file to the http.ResponseWriter in the
+// multipart/mixed format used by the federation media endpoints. The first
+// part contains JSON metadata about the file, which is currently empty, and
+// the second part contains the file itself.
+// https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1mediadownloadmediaid
+func (r *downloadRequest) respondWithMultipart(
 	w http.ResponseWriter,
+	fileHeader http.Header,
+	responseFile io.Reader,
+) error {
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+
+	metadataPart, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": []string{"application/json"},
+	})
+	if err != nil {
+		return fmt.Errorf("mw.CreatePart: %w", err)
+	}
+	if _, err = metadataPart.Write([]byte("{}")); err != nil {
+		return fmt.Errorf("metadataPart.Write: %w", err)
+	}
+
+	filePart, err := mw.CreatePart(textproto.MIMEHeader(fileHeader))
+	if err != nil {
+		return fmt.Errorf("mw.CreatePart: %w", err)
+	}
+	if _, err = io.Copy(filePart, responseFile); err != nil {
+		return fmt.Errorf("io.Copy: %w", err)
+	}
+	return mw.Close()
+}
+
+func (r *downloadRequest) addDownloadFilenameToHeaders(
+	header http.Header,
 	responseMetadata *types.MediaMetadata,
 ) error {
 	// If the requestor supplied a filename to name the download then
@@ -387,7 +537,7 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 	}
 
 	if len(filename) == 0 {
-		w.Header().Set("Content-Disposition", contentDispositionFor(""))
+		header.Set("Content-Disposition", contentDispositionFor(""))
 		return nil
 	}
 
@@ -423,13 +573,13 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 		// it needs to be done, e.g. it contains a space or a character
 		// that would otherwise be parsed as a control character in the
 		// Content-Disposition header
-		w.Header().Set("Content-Disposition", fmt.Sprintf(
+		header.Set("Content-Disposition", fmt.Sprintf(
 			`%s; filename=%s%s%s`,
 			disposition, quote, unescaped, quote,
 		))
 	} else {
 		// For UTF-8 filenames, we quote always, as that's the standard
-		w.Header().Set("Content-Disposition", fmt.Sprintf(
+		header.Set("Content-Disposition", fmt.Sprintf(
 			`%s; filename*=utf-8''%s`,
 			disposition, url.QueryEscape(unescaped),
 		))
@@ -442,19 +592,19 @@ func (r *downloadRequest) addDownloadFilenameToHeaders(
 // If no thumbnail was found then returns nil, nil, nil
 func (r *downloadRequest) getThumbnailFile(
 	ctx context.Context,
-	filePath types.Path,
+	store mediastore.MediaStore,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 	db storage.Database,
 	dynamicThumbnails bool,
 	thumbnailSizes []config.ThumbnailSize,
-) (*os.File, *types.ThumbnailMetadata, error) {
+) (io.ReadCloser, *types.ThumbnailMetadata, error) {
 	var thumbnail *types.ThumbnailMetadata
 	var err error
 
 	if dynamicThumbnails {
 		thumbnail, err = r.generateThumbnail(
-			ctx, filePath, r.ThumbnailSize, activeThumbnailGeneration,
+			ctx, store, r.ThumbnailSize, activeThumbnailGeneration,
 			maxThumbnailGenerators, db,
 		)
 		if err != nil {
@@ -485,7 +635,7 @@ func (r *downloadRequest) getThumbnailFile(
 				"ResizeMethod": thumbnailSize.ResizeMethod,
 			}).Debug("Pre-generating thumbnail for immediate response.")
 			thumbnail, err = r.generateThumbnail(
-				ctx, filePath, *thumbnailSize, activeThumbnailGeneration,
+				ctx, store, *thumbnailSize, activeThumbnailGeneration,
 				maxThumbnailGenerators, db,
 			)
 			if err != nil {
@@ -503,27 +653,20 @@ func (r *downloadRequest) getThumbnailFile(
 		"FileSizeBytes": thumbnail.MediaMetadata.FileSizeBytes,
 		"ContentType":   thumbnail.MediaMetadata.ContentType,
 	})
-	thumbPath := string(thumbnailer.GetThumbnailPath(types.Path(filePath), thumbnail.ThumbnailSize))
-	thumbFile, err := os.Open(string(thumbPath))
+	thumbFile, thumbSize, err := store.OpenThumbnail(ctx, r.MediaMetadata.Base64Hash, thumbnail.ThumbnailSize)
 	if err != nil {
-		thumbFile.Close() // nolint: errcheck
-		return nil, nil, fmt.Errorf("os.Open: %w", err)
+		return nil, nil, fmt.Errorf("store.OpenThumbnail: %w", err)
 	}
-	thumbStat, err := thumbFile.Stat()
-	if err != nil {
-		thumbFile.Close() // nolint: errcheck
-		return nil, nil, fmt.Errorf("thumbFile.Stat: %w", err)
-	}
-	if types.FileSizeBytes(thumbStat.Size()) != thumbnail.MediaMetadata.FileSizeBytes {
+	if thumbSize != thumbnail.MediaMetadata.FileSizeBytes {
 		thumbFile.Close() // nolint: errcheck
-		return nil, nil, errors.New("thumbnail file sizes on disk and in database differ")
+		return nil, nil, errors.New("thumbnail file sizes in media store and in database differ")
 	}
 	return thumbFile, thumbnail, nil
 }
 
 func (r *downloadRequest) generateThumbnail(
 	ctx context.Context,
-	filePath types.Path,
+	store mediastore.MediaStore,
 	thumbnailSize types.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
@@ -535,9 +678,12 @@ func (r *downloadRequest) generateThumbnail(
 		"ResizeMethod": thumbnailSize.ResizeMethod,
 	})
 	busy, err := thumbnailer.GenerateThumbnail(
-		ctx, filePath, thumbnailSize, r.MediaMetadata,
+		ctx, store, thumbnailSize, r.MediaMetadata,
 		activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 	)
+	if errors.Is(err, thumbnailer.ErrQuarantined) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, fmt.Errorf("thumbnailer.GenerateThumbnail: %w", err)
 	}
@@ -562,8 +708,10 @@ func (r *downloadRequest) generateThumbnail(
 func (r *downloadRequest) getRemoteFile(
 	ctx context.Context,
 	client *fclient.Client,
+	fedClient fclient.FederationClient,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.MediaStore,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) (errorResponse error) {
@@ -597,8 +745,8 @@ func (r *downloadRequest) getRemoteFile(
 		if mediaMetadata == nil {
 			// If we do not have a record, we need to fetch the remote file first and then respond from the local file
 			err := r.fetchRemoteFileAndStoreMetadata(
-				ctx, client,
-				cfg.AbsBasePath, cfg.MaxFileSizeBytes, db,
+				ctx, client, fedClient, cfg.Matrix.ServerName,
+				cfg.AbsBasePath, cfg.MaxFileSizeBytes, db, store,
 				cfg.ThumbnailSizes, activeThumbnailGeneration,
 				cfg.MaxThumbnailGenerators,
 			)
@@ -664,15 +812,18 @@ func (r *downloadRequest) broadcastMediaMetadata(activeRemoteRequests *types.Act
 func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	ctx context.Context,
 	client *fclient.Client,
+	fedClient fclient.FederationClient,
+	localServerName spec.ServerName,
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
 	db storage.Database,
+	store mediastore.MediaStore,
 	thumbnailSizes []config.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) error {
-	finalPath, duplicate, err := r.fetchRemoteFile(
-		ctx, client, absBasePath, maxFileSizeBytes,
+	duplicate, err := r.fetchRemoteFile(
+		ctx, client, fedClient, localServerName, absBasePath, maxFileSizeBytes, store,
 	)
 	if err != nil {
 		return err
@@ -691,8 +842,9 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 		// there is valid metadata in the database for that file. As such we only
 		// remove the file if it is not a duplicate.
 		if !duplicate {
-			finalDir := filepath.Dir(string(finalPath))
-			fileutils.RemoveDir(types.Path(finalDir), r.Logger)
+			if err = store.DeleteFile(ctx, r.MediaMetadata.Base64Hash); err != nil {
+				r.Logger.WithError(err).Warn("Failed to remove stored file")
+			}
 		}
 		// NOTE: It should really not be possible to fail the uniqueness test here so
 		// there is no need to handle that separately
@@ -700,8 +852,10 @@ func (r *downloadRequest) fetchRemoteFileAndStoreMetadata(
 	}
 
 	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), thumbnailGenerationTimeout)
+		defer cancel()
 		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
+			ctx, store, thumbnailSizes, r.MediaMetadata,
 			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 		)
 		if err != nil {
@@ -762,18 +916,28 @@ func (r *downloadRequest) GetContentLengthAndReader(contentLengthHeader string,
 func (r *downloadRequest) fetchRemoteFile(
 	ctx context.Context,
 	client *fclient.Client,
+	fedClient fclient.FederationClient,
+	localServerName spec.ServerName,
 	absBasePath config.Path,
 	maxFileSizeBytes config.FileSizeBytes,
-) (types.Path, bool, error) {
+	store mediastore.MediaStore,
+) (bool, error) {
 	r.Logger.Debug("Fetching remote file")
 
-	// create request for remote file
-	resp, err := client.CreateMediaDownloadRequest(ctx, r.MediaMetadata.Origin, string(r.MediaMetadata.MediaID))
-	if err != nil || (resp != nil && resp.StatusCode != http.StatusOK) {
-		if resp != nil && resp.StatusCode == http.StatusNotFound {
-			return "", false, fmt.Errorf("File with media ID %q does not exist on %s", r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+	// Try the authenticated federation media endpoint first. If the remote
+	// server doesn't support it yet, fall back to the legacy endpoint.
+	resp, err := r.fetchRemoteFileAuthenticated(ctx, fedClient, localServerName)
+	if err != nil {
+		r.Logger.WithError(err).Debug("Failed to fetch remote file using authenticated media, trying legacy endpoint")
+
+		// create request for remote file
+		resp, err = client.CreateMediaDownloadRequest(ctx, r.MediaMetadata.Origin, string(r.MediaMetadata.MediaID))
+		if err != nil || (resp != nil && resp.StatusCode != http.StatusOK) {
+			if resp != nil && resp.StatusCode == http.StatusNotFound {
+				return false, fmt.Errorf("File with media ID %q does not exist on %s", r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
+			}
+			return false, fmt.Errorf("file with media ID %q could not be downloaded from %s", r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
 		}
-		return "", false, fmt.Errorf("file with media ID %q could not be downloaded from %s", r.MediaMetadata.MediaID, r.MediaMetadata.Origin)
 	}
 	defer resp.Body.Close() // nolint: errcheck
 
@@ -781,12 +945,12 @@ func (r *downloadRequest) fetchRemoteFile(
 	// and/or the configured maximum media size.
 	contentLength, reader, parseErr := r.GetContentLengthAndReader(resp.Header.Get("Content-Length"), &resp.Body, maxFileSizeBytes)
 	if parseErr != nil {
-		return "", false, parseErr
+		return false, parseErr
 	}
 
 	if maxFileSizeBytes > 0 && contentLength > int64(maxFileSizeBytes) {
 		// TODO: Bubble up this as a 413
-		return "", false, fmt.Errorf("remote file is too large (%v > %v bytes)", contentLength, maxFileSizeBytes)
+		return false, fmt.Errorf("remote file is too large (%v > %v bytes)", contentLength, maxFileSizeBytes)
 	}
 
 	r.MediaMetadata.FileSizeBytes = types.FileSizeBytes(contentLength)
@@ -820,7 +984,7 @@ func (r *downloadRequest) fetchRemoteFile(
 		r.Logger.WithError(err).WithFields(log.Fields{
 			"MaxFileSizeBytes": maxFileSizeBytes,
 		}).Warn("Error while downloading file from remote server")
-		return "", false, errors.New("file could not be downloaded from remote server")
+		return false, errors.New("file could not be downloaded from remote server")
 	}
 
 	r.Logger.Trace("Remote file transferred")
@@ -832,16 +996,97 @@ func (r *downloadRequest) fetchRemoteFile(
 	r.MediaMetadata.Base64Hash = hash
 
 	// The database is the source of truth so we need to have moved the file first
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+	duplicate, err := store.StoreFile(ctx, tmpDir, r.MediaMetadata)
 	if err != nil {
-		return "", false, fmt.Errorf("fileutils.MoveFileWithHashCheck: %w", err)
+		return false, fmt.Errorf("store.StoreFile: %w", err)
 	}
 	if duplicate {
-		r.Logger.WithField("dst", finalPath).Trace("File was stored previously - discarding duplicate")
+		r.Logger.WithField("Base64Hash", r.MediaMetadata.Base64Hash).Trace("File was stored previously - discarding duplicate")
 		// Continue on to store the metadata in the database
 	}
 
-	return types.Path(finalPath), duplicate, nil
+	return duplicate, nil
+}
+
+// fetchRemoteFileAuthenticated fetches the remote file using the authenticated
+// federation media endpoint. The multipart response is unwrapped so that the
+// returned response looks like one from the legacy download endpoint, with the
+// headers and body of the file part. If the remote server redirects us to the
+// file using a Location header then that is followed instead, using a client
+// which can't connect to blacklisted IP ranges, as the remote server chooses
+// the URL.
+func (r *downloadRequest) fetchRemoteFileAuthenticated(
+	ctx context.Context,
+	fedClient fclient.FederationClient,
+	localServerName spec.ServerName,
+) (*http.Response, error) {
+	resp, err := fedClient.DownloadMedia(ctx, localServerName, r.MediaMetadata.Origin, string(r.MediaMetadata.MediaID))
+	if err != nil {
+		return nil, fmt.Errorf("fedClient.DownloadMedia: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		resp.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("unexpected content type %q", resp.Header.Get("Content-Type"))
+	}
+	reader := multipart.NewReader(resp.Body, params["boundary"])
+
+	// The first part contains JSON metadata about the file, which we don't
+	// currently use for anything.
+	metadataPart, err := reader.NextPart()
+	if err != nil {
+		resp.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("reader.NextPart: %w", err)
+	}
+	if _, err = io.Copy(io.Discard, metadataPart); err != nil {
+		resp.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("io.Copy: %w", err)
+	}
+
+	// The second part contains either the file itself or a Location header
+	// that tells us where to download the file from.
+	filePart, err := reader.NextPart()
+	if err != nil {
+		resp.Body.Close() // nolint: errcheck
+		return nil, fmt.Errorf("reader.NextPart: %w", err)
+	}
+	if location := filePart.Header.Get("Location"); location != "" {
+		resp.Body.Close() // nolint: errcheck
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, fmt.Errorf("url.Parse: %w", err)
+		}
+		if err = preview.ValidateURL(u); err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, fmt.Errorf("http.NewRequestWithContext: %w", err)
+		}
+		redirected, err := r.redirectClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("r.redirectClient.Do: %w", err)
+		}
+		if redirected.StatusCode != http.StatusOK {
+			redirected.Body.Close() // nolint: errcheck
+			return nil, fmt.Errorf("unexpected status code %d from %q", redirected.StatusCode, location)
+		}
+		return redirected, nil
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header(filePart.Header),
+		Body: struct {
+			io.Reader
+			io.Closer
+		}{filePart, resp.Body},
+	}, nil
 }
 
 // contentDispositionFor returns the Content-Disposition for a given
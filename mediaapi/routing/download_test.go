@@ -1,9 +1,24 @@
 package routing
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/mediaapi/preview"
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/neilalexander/harmony/setup/config"
 )
 
 func Test_dispositionFor(t *testing.T) {
@@ -11,3 +26,80 @@ func Test_dispositionFor(t *testing.T) {
 	assert.Equal(t, "attachment", contentDispositionFor("image/svg"), "image/svg")
 	assert.Equal(t, "inline", contentDispositionFor("image/jpeg"), "image/jpg")
 }
+
+func Test_respondWithMultipart(t *testing.T) {
+	r := &downloadRequest{}
+	w := httptest.NewRecorder()
+	fileHeader := http.Header{}
+	fileHeader.Set("Content-Type", "text/plain")
+	fileHeader.Set("Content-Disposition", "inline; filename=test.txt")
+
+	err := r.respondWithMultipart(w, fileHeader, strings.NewReader("hello world"))
+	assert.NoError(t, err)
+
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/mixed", mediaType)
+
+	reader := multipart.NewReader(w.Body, params["boundary"])
+	metadataPart, err := reader.NextPart()
+	assert.NoError(t, err)
+	assert.Equal(t, "application/json", metadataPart.Header.Get("Content-Type"))
+	metadata, err := io.ReadAll(metadataPart)
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(metadata))
+
+	filePart, err := reader.NextPart()
+	assert.NoError(t, err)
+	assert.Equal(t, "text/plain", filePart.Header.Get("Content-Type"))
+	assert.Equal(t, "inline; filename=test.txt", filePart.Header.Get("Content-Disposition"))
+	file, err := io.ReadAll(filePart)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(file))
+
+	_, err = reader.NextPart()
+	assert.Equal(t, io.EOF, err)
+}
+
+type redirectingFedClient struct {
+	fclient.FederationClient
+	location string
+}
+
+func (c *redirectingFedClient) DownloadMedia(ctx context.Context, origin, s spec.ServerName, mediaID string) (*http.Response, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	metadataPart, _ := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	_, _ = metadataPart.Write([]byte("{}"))
+	_, _ = writer.CreatePart(textproto.MIMEHeader{"Location": {c.location}})
+	_ = writer.Close()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {writer.FormDataContentType()}},
+		Body:       io.NopCloser(body),
+	}, nil
+}
+
+func Test_fetchRemoteFileAuthenticatedRedirect(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = w.Write([]byte("internal"))
+	}))
+	defer srv.Close()
+
+	redirectClient, err := preview.NewRestrictedDownloadClient(&config.RemoteMediaDownloads{
+		TimeoutSeconds:   10,
+		IPRangeBlacklist: config.DefaultIPRangeBlacklist,
+	})
+	assert.NoError(t, err)
+	r := &downloadRequest{
+		MediaMetadata:  &types.MediaMetadata{Origin: "remote", MediaID: "media"},
+		redirectClient: redirectClient,
+	}
+
+	// Redirects to blacklisted addresses aren't followed.
+	_, err = r.fetchRemoteFileAuthenticated(context.Background(), &redirectingFedClient{location: srv.URL}, "local")
+	assert.ErrorIs(t, err, preview.ErrBlockedIP)
+
+	_, err = r.fetchRemoteFileAuthenticated(context.Background(), &redirectingFedClient{location: "file:///etc/passwd"}, "local")
+	assert.Error(t, err)
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/matrix-org/util"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/mediaapi/storage"
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+// userQuota returns the media quota that applies to the user, which is either
+// their override or the configured default, along with how much of it they
+// have used. A quota of 0 means that the user can upload without limit.
+func userQuota(
+	ctx context.Context, cfg *config.MediaAPI, db storage.Database, userID types.MatrixUserID,
+) (quota, used types.FileSizeBytes, err error) {
+	quota = types.FileSizeBytes(cfg.DefaultUserQuotaBytes)
+	override, err := db.GetUserMediaQuota(ctx, userID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("db.GetUserMediaQuota: %w", err)
+	}
+	if override != nil {
+		quota = *override
+	}
+	used, err = db.GetUserMediaUsage(ctx, userID)
+	if err != nil {
+		return 0, 0, fmt.Errorf("db.GetUserMediaUsage: %w", err)
+	}
+	return quota, used, nil
+}
+
+// remainingQuota returns how many more bytes the user may upload, or nil if
+// the user can upload without limit.
+func remainingQuota(quota, used types.FileSizeBytes) *types.FileSizeBytes {
+	if quota == 0 {
+		return nil
+	}
+	remaining := quota - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return &remaining
+}
+
+func quotaExceededJSONResponse(quota types.FileSizeBytes) *util.JSONResponse {
+	return &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: spec.ResourceLimitExceeded(fmt.Sprintf("Upload would exceed your media quota (%v bytes).", quota)),
+	}
+}
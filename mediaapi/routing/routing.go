@@ -18,25 +18,35 @@ import (
 	"encoding/json"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/util"
+	"github.com/neilalexander/harmony/clientapi/auth"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/httputil"
+	"github.com/neilalexander/harmony/mediaapi/mediastore"
+	"github.com/neilalexander/harmony/mediaapi/preview"
 	"github.com/neilalexander/harmony/mediaapi/storage"
 	"github.com/neilalexander/harmony/mediaapi/types"
+	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/setup/config"
 	userapi "github.com/neilalexander/harmony/userapi/api"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 // configResponse is the response to GET /_matrix/media/r0/config
 // https://matrix.org/docs/spec/client_server/latest#get-matrix-media-r0-config
 type configResponse struct {
 	UploadSize *config.FileSizeBytes `json:"m.upload.size,omitempty"`
+	// The number of bytes that the user may still upload before reaching
+	// their media quota. Omitted if the user has no quota.
+	QuotaRemaining *types.FileSizeBytes `json:"org.matrix.dendrite.upload.quota_remaining,omitempty"`
 }
 
 // Setup registers the media API HTTP handlers
@@ -45,15 +55,21 @@ type configResponse struct {
 // applied:
 // nolint: gocyclo
 func Setup(
-	publicAPIMux *mux.Router,
+	routers httputil.Routers,
 	cfg *config.Dendrite,
 	db storage.Database,
+	store mediastore.MediaStore,
 	userAPI userapi.MediaUserAPI,
+	rsAPI roomserverAPI.MediaRoomserverAPI,
 	client *fclient.Client,
+	fedClient fclient.FederationClient,
+	keyRing gomatrixserverlib.JSONVerifier,
 ) {
 	rateLimits := httputil.NewRateLimits(&cfg.ClientAPI.RateLimiting)
 
-	v3mux := publicAPIMux.PathPrefix("/{apiversion:(?:r0|v1|v3)}/").Subrouter()
+	v3mux := routers.Media.PathPrefix("/{apiversion:(?:r0|v1|v3)}/").Subrouter()
+	v1ClientMux := routers.Client.PathPrefix("/v1/media/").Subrouter()
+	v1FedMux := routers.Federation.PathPrefix("/v1/media/").Subrouter()
 
 	activeThumbnailGeneration := &types.ActiveThumbnailGeneration{
 		PathToResult: map[string]*types.ThumbnailGenerationResult{},
@@ -65,7 +81,34 @@ func Setup(
 			if r := rateLimits.Limit(req, dev); r != nil {
 				return *r
 			}
-			return Upload(req, &cfg.MediaAPI, dev, db, activeThumbnailGeneration)
+			return Upload(req, &cfg.MediaAPI, dev, db, store, activeThumbnailGeneration)
+		},
+	)
+
+	createHandler := httputil.MakeAuthAPI(
+		"create", userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, dev); r != nil {
+				return *r
+			}
+			return CreateMedia(req, &cfg.MediaAPI, dev, db)
+		},
+	)
+
+	uploadPendingHandler := httputil.MakeAuthAPI(
+		"upload_pending", userAPI,
+		func(req *http.Request, dev *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, dev); r != nil {
+				return *r
+			}
+			vars, err := httputil.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return UploadPendingMedia(
+				req, &cfg.MediaAPI, dev, db, store, activeThumbnailGeneration,
+				spec.ServerName(vars["serverName"]), types.MediaID(vars["mediaId"]),
+			)
 		},
 	)
 
@@ -77,37 +120,160 @@ func Setup(
 		if cfg.MediaAPI.MaxFileSizeBytes == 0 {
 			respondSize = nil
 		}
+		quota, used, err := userQuota(req.Context(), &cfg.MediaAPI, db, types.MatrixUserID(device.UserID))
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("Failed to look up media quota")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: configResponse{UploadSize: respondSize},
+			JSON: configResponse{
+				UploadSize:     respondSize,
+				QuotaRemaining: remainingQuota(quota, used),
+			},
 		}
 	})
 
 	v3mux.Handle("/upload", uploadHandler).Methods(http.MethodPost, http.MethodOptions)
+	v3mux.Handle("/upload/{serverName}/{mediaId}", uploadPendingHandler).Methods(http.MethodPut, http.MethodOptions)
+	routers.Media.Handle("/v1/create", createHandler).Methods(http.MethodPost, http.MethodOptions)
 	v3mux.Handle("/config", configHandler).Methods(http.MethodGet, http.MethodOptions)
+	v1ClientMux.Handle("/config", configHandler).Methods(http.MethodGet, http.MethodOptions)
+
+	if cfg.MediaAPI.URLPreviews.Enabled {
+		previewer, err := preview.NewPreviewer(&cfg.MediaAPI.URLPreviews)
+		if err != nil {
+			logrus.WithError(err).Panic("failed to create URL previewer")
+		}
+		previewHandler := httputil.MakeAuthAPI("preview_url", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			if r := rateLimits.Limit(req, device); r != nil {
+				return *r
+			}
+			return URLPreview(req, &cfg.MediaAPI, db, store, previewer, activeThumbnailGeneration)
+		})
+		v3mux.Handle("/preview_url", previewHandler).Methods(http.MethodGet, http.MethodOptions)
+		v1ClientMux.Handle("/preview_url", previewHandler).Methods(http.MethodGet, http.MethodOptions)
+	}
 
 	activeRemoteRequests := &types.ActiveRemoteRequests{
 		MXCToResult: map[string]*types.RemoteRequestResult{},
 	}
 
-	downloadHandler := makeDownloadAPI("download", &cfg.MediaAPI, rateLimits, db, userAPI, client, activeRemoteRequests, activeThumbnailGeneration)
+	// Remote servers can redirect us to their media using any URL, so the
+	// redirects are only followed to addresses that aren't blacklisted.
+	redirectClient, err := preview.NewRestrictedDownloadClient(&cfg.MediaAPI.RemoteDownloads)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to create media redirect client")
+	}
+
+	// Legacy unauthenticated endpoints at /_matrix/media/v3.
+	downloadHandler := makeDownloadAPI("download", &cfg.MediaAPI, rateLimits, db, store, nil, client, fedClient, redirectClient, activeRemoteRequests, activeThumbnailGeneration, nil)
 	v3mux.Handle("/download/{serverName}/{mediaId}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 	v3mux.Handle("/download/{serverName}/{mediaId}/{downloadName}", downloadHandler).Methods(http.MethodGet, http.MethodOptions)
 
 	v3mux.Handle("/thumbnail/{serverName}/{mediaId}",
-		makeDownloadAPI("thumbnail", &cfg.MediaAPI, rateLimits, db, userAPI, client, activeRemoteRequests, activeThumbnailGeneration),
+		makeDownloadAPI("thumbnail", &cfg.MediaAPI, rateLimits, db, store, nil, client, fedClient, redirectClient, activeRemoteRequests, activeThumbnailGeneration, nil),
 	).Methods(http.MethodGet, http.MethodOptions)
+
+	// Authenticated client endpoints at /_matrix/client/v1/media.
+	// https://spec.matrix.org/v1.11/client-server-api/#content-repository
+	authedDownloadHandler := makeDownloadAPI("download_authed_client", &cfg.MediaAPI, rateLimits, db, store, userAPI, client, fedClient, redirectClient, activeRemoteRequests, activeThumbnailGeneration, nil)
+	v1ClientMux.Handle("/download/{serverName}/{mediaId}", authedDownloadHandler).Methods(http.MethodGet, http.MethodOptions)
+	v1ClientMux.Handle("/download/{serverName}/{mediaId}/{downloadName}", authedDownloadHandler).Methods(http.MethodGet, http.MethodOptions)
+
+	v1ClientMux.Handle("/thumbnail/{serverName}/{mediaId}",
+		makeDownloadAPI("thumbnail_authed_client", &cfg.MediaAPI, rateLimits, db, store, userAPI, client, fedClient, redirectClient, activeRemoteRequests, activeThumbnailGeneration, nil),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	// Authenticated federation endpoints at /_matrix/federation/v1/media. These
+	// only ever serve media that originated on this server.
+	// https://spec.matrix.org/v1.11/server-server-api/#content-repository
+	v1FedMux.Handle("/download/{mediaId}",
+		makeDownloadAPI("download_authed_federation", &cfg.MediaAPI, rateLimits, db, store, nil, client, fedClient, redirectClient, activeRemoteRequests, activeThumbnailGeneration, keyRing),
+	).Methods(http.MethodGet, http.MethodOptions)
+	v1FedMux.Handle("/thumbnail/{mediaId}",
+		makeDownloadAPI("thumbnail_authed_federation", &cfg.MediaAPI, rateLimits, db, store, nil, client, fedClient, redirectClient, activeRemoteRequests, activeThumbnailGeneration, keyRing),
+	).Methods(http.MethodGet, http.MethodOptions)
+
+	dendriteAdminRouter := routers.DendriteAdmin
+
+	dendriteAdminRouter.Handle("/admin/quarantineMedia/{serverName}/{mediaID}",
+		httputil.MakeAdminAPI("admin_quarantine_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminQuarantineMedia(req, &cfg.MediaAPI, db, true)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/unquarantineMedia/{serverName}/{mediaID}",
+		httputil.MakeAdminAPI("admin_unquarantine_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminQuarantineMedia(req, &cfg.MediaAPI, db, false)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/quarantineUserMedia/{userID}",
+		httputil.MakeAdminAPI("admin_quarantine_user_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminQuarantineUserMedia(req, db)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/quarantineRoomMedia/{roomID}",
+		httputil.MakeAdminAPI("admin_quarantine_room_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminQuarantineRoomMedia(req, db, rsAPI)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/deleteMedia/{serverName}/{mediaID}",
+		httputil.MakeAdminAPI("admin_delete_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminDeleteMedia(req, &cfg.MediaAPI, db, store)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/mediaQuota/{userID}",
+		httputil.MakeAdminAPI("admin_media_quota", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			switch req.Method {
+			case http.MethodGet:
+				return AdminGetUserMediaQuota(req, &cfg.MediaAPI, db)
+			case http.MethodPut:
+				return AdminSetUserMediaQuota(req, &cfg.MediaAPI, db)
+			case http.MethodDelete:
+				return AdminDeleteUserMediaQuota(req, &cfg.MediaAPI, db)
+			default:
+				return util.MatrixErrorResponse(
+					404,
+					string(spec.ErrorNotFound),
+					"unknown method",
+				)
+			}
+		}),
+	).Methods(http.MethodGet, http.MethodPut, http.MethodDelete, http.MethodOptions)
+
+	dendriteAdminRouter.Handle("/admin/purgeRemoteMedia",
+		httputil.MakeAdminAPI("admin_purge_remote_media", userAPI, func(req *http.Request, device *userapi.Device) util.JSONResponse {
+			return AdminPurgeRemoteMedia(req, &cfg.MediaAPI, db, store)
+		}),
+	).Methods(http.MethodPost, http.MethodOptions)
 }
 
+// makeDownloadAPI returns a handler for the download and thumbnail endpoints.
+// If a userAPI is supplied then the request must be authenticated as a local
+// user. If a keyRing is supplied then the request must be a signed federation
+// request, only local media will be served and the response will be sent in
+// the multipart format.
 func makeDownloadAPI(
 	name string,
 	cfg *config.MediaAPI,
 	rateLimits *httputil.RateLimits,
 	db storage.Database,
-	_ userapi.MediaUserAPI,
+	store mediastore.MediaStore,
+	userAPI userapi.MediaUserAPI,
 	client *fclient.Client,
+	fedClient fclient.FederationClient,
+	redirectClient *http.Client,
 	activeRemoteRequests *types.ActiveRemoteRequests,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+	keyRing gomatrixserverlib.JSONVerifier,
 ) http.HandlerFunc {
 	var counterVec *prometheus.CounterVec
 	if cfg.Matrix.Metrics.Enabled {
@@ -119,6 +285,8 @@ func makeDownloadAPI(
 			[]string{"code"},
 		)
 	}
+	forFederation := keyRing != nil
+	isThumbnail := strings.HasPrefix(name, "thumbnail")
 	httpHandler := func(w http.ResponseWriter, req *http.Request) {
 		req = util.RequestWithLogging(req)
 
@@ -128,27 +296,49 @@ func makeDownloadAPI(
 		// Content-Type will be overridden in case of returning file data, else we respond with JSON-formatted errors
 		w.Header().Set("Content-Type", "application/json")
 
+		var device *userapi.Device
+		var fedReq *fclient.FederationRequest
+		switch {
+		case userAPI != nil:
+			var resErr *util.JSONResponse
+			if device, resErr = auth.VerifyUserFromRequest(req, userAPI); resErr != nil {
+				writeJSONResponse(w, *resErr)
+				return
+			}
+		case forFederation:
+			var resErr util.JSONResponse
+			fedReq, resErr = fclient.VerifyHTTPRequest(
+				req, time.Now(), cfg.Matrix.ServerNameForHTTPHost(spec.ServerName(req.Host)),
+				cfg.Matrix.IsLocalServerName, keyRing,
+			)
+			if fedReq == nil {
+				writeJSONResponse(w, resErr)
+				return
+			}
+		}
+
 		// Ratelimit requests
 		// NOTSPEC: The spec says everything at /media/ should be rate limited, but this causes issues with thumbnails (#2243)
-		if name != "thumbnail" {
-			if r := rateLimits.Limit(req, nil); r != nil {
-				if err := json.NewEncoder(w).Encode(r); err != nil {
-					w.WriteHeader(http.StatusInternalServerError)
-					return
-				}
-				w.WriteHeader(http.StatusTooManyRequests)
+		if !isThumbnail && !forFederation {
+			if r := rateLimits.Limit(req, device); r != nil {
+				writeJSONResponse(w, *r)
 				return
 			}
 		}
 
 		vars, _ := httputil.URLDecodeMapValues(mux.Vars(req))
 		serverName := spec.ServerName(vars["serverName"])
+		if forFederation {
+			// Federation requests can only ask for our own media, which
+			// is the media of whichever local server name they were sent to.
+			serverName = fedReq.Destination()
+		}
 
 		// For the purposes of loop avoidance, we will return a 404 if allow_remote is set to
 		// false in the query string and the target server name isn't our own.
 		// https://github.com/matrix-org/matrix-doc/pull/1265
 		if allowRemote := req.URL.Query().Get("allow_remote"); strings.ToLower(allowRemote) == "false" {
-			if serverName != cfg.Matrix.ServerName {
+			if !cfg.Matrix.IsLocalServerName(serverName) {
 				w.WriteHeader(http.StatusNotFound)
 				return
 			}
@@ -164,11 +354,15 @@ func makeDownloadAPI(
 			types.MediaID(vars["mediaId"]),
 			cfg,
 			db,
+			store,
 			client,
+			fedClient,
+			redirectClient,
 			activeRemoteRequests,
 			activeThumbnailGeneration,
-			name == "thumbnail",
+			isThumbnail,
 			vars["downloadName"],
+			forFederation,
 		)
 	}
 
@@ -180,3 +374,11 @@ func makeDownloadAPI(
 	}
 	return handlerFunc
 }
+
+// writeJSONResponse writes a JSON error response for handlers which are not
+// wrapped with util.MakeJSONAPI.
+func writeJSONResponse(w http.ResponseWriter, res util.JSONResponse) {
+	w.WriteHeader(res.Code)
+	// we don't really care that much if we fail to write the error response
+	_ = json.NewEncoder(w).Encode(res.JSON)
+}
@@ -22,14 +22,14 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
-	"path"
 	"strings"
+	"time"
 
 	"github.com/matrix-org/util"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/mediaapi/fileutils"
+	"github.com/neilalexander/harmony/mediaapi/mediastore"
 	"github.com/neilalexander/harmony/mediaapi/storage"
 	"github.com/neilalexander/harmony/mediaapi/thumbnailer"
 	"github.com/neilalexander/harmony/mediaapi/types"
@@ -44,6 +44,9 @@ import (
 type uploadRequest struct {
 	MediaMetadata *types.MediaMetadata
 	Logger        *log.Entry
+	// Pending is set when uploading to an MXC URI which was reserved with
+	// /create, in which case the media ID is already known.
+	Pending bool
 }
 
 // uploadResponse defines the format of the JSON response
@@ -57,13 +60,13 @@ type uploadResponse struct {
 // This implementation supports a configurable maximum file size limit in bytes. If a user tries to upload more than this, they will receive an error that their upload is too large.
 // Uploaded files are processed piece-wise to avoid DoS attacks which would starve the server of memory.
 // TODO: We should time out requests if they have not received any data within a configured timeout period.
-func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
+func Upload(req *http.Request, cfg *config.MediaAPI, dev *userapi.Device, db storage.Database, store mediastore.MediaStore, activeThumbnailGeneration *types.ActiveThumbnailGeneration) util.JSONResponse {
 	r, resErr := parseAndValidateRequest(req, cfg, dev)
 	if resErr != nil {
 		return *resErr
 	}
 
-	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, activeThumbnailGeneration); resErr != nil {
+	if resErr = r.doUpload(req.Context(), req.Body, cfg, db, store, activeThumbnailGeneration); resErr != nil {
 		return *resErr
 	}
 
@@ -119,16 +122,35 @@ func (r *uploadRequest) generateMediaID(ctx context.Context, db storage.Database
 			// and generate a new one instead.
 			continue
 		}
+		// The media ID may also have been reserved for an upload
+		// which hasn't happened yet.
+		pending, err := db.GetPendingMedia(ctx, mediaID, r.MediaMetadata.Origin, spec.AsTimestamp(time.Now()))
+		if err != nil {
+			return "", fmt.Errorf("db.GetPendingMedia: %w", err)
+		}
+		if pending != nil {
+			continue
+		}
 		// The media ID was not already used - let's return that.
 		return mediaID, nil
 	}
 }
 
+// uploadMediaID returns the media ID to store the upload under, which is the
+// reserved media ID when uploading to an MXC URI created with /create.
+func (r *uploadRequest) uploadMediaID(ctx context.Context, db storage.Database) (types.MediaID, error) {
+	if r.Pending {
+		return r.MediaMetadata.MediaID, nil
+	}
+	return r.generateMediaID(ctx, db)
+}
+
 func (r *uploadRequest) doUpload(
 	ctx context.Context,
 	reqReader io.Reader,
 	cfg *config.MediaAPI,
 	db storage.Database,
+	store mediastore.MediaStore,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 ) *util.JSONResponse {
 	r.Logger.WithFields(log.Fields{
@@ -158,6 +180,23 @@ func (r *uploadRequest) doUpload(
 		reqReader = io.LimitReader(reqReader, int64(cfg.MaxFileSizeBytes)+1)
 	}
 
+	// Uploads by local users count towards their quota. Media stored on behalf
+	// of the server, e.g. for URL previews, has no user and no quota.
+	var quota, used types.FileSizeBytes
+	if r.MediaMetadata.UserID != "" {
+		var err error
+		if quota, used, err = userQuota(ctx, cfg, db, r.MediaMetadata.UserID); err != nil {
+			r.Logger.WithError(err).Error("Failed to look up media quota")
+			return &util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		if quota > 0 && r.MediaMetadata.FileSizeBytes > 0 && used+r.MediaMetadata.FileSizeBytes > quota {
+			return quotaExceededJSONResponse(quota)
+		}
+	}
+
 	hash, bytesWritten, tmpDir, err := fileutils.WriteTempFile(ctx, reqReader, cfg.AbsBasePath)
 	if err != nil {
 		r.Logger.WithError(err).WithFields(log.Fields{
@@ -175,6 +214,12 @@ func (r *uploadRequest) doUpload(
 		return requestEntityTooLargeJSONResponse(cfg.MaxFileSizeBytes)
 	}
 
+	// Check the actual size against the quota, as Content-Length may not have been given
+	if quota > 0 && used+bytesWritten > quota {
+		fileutils.RemoveDir(tmpDir, r.Logger) // delete temp file
+		return quotaExceededJSONResponse(quota)
+	}
+
 	// Look up the media by the file hash. If we already have the file but under a
 	// different media ID then we won't upload the file again - instead we'll just
 	// add a new metadata entry that refers to the same file.
@@ -193,7 +238,7 @@ func (r *uploadRequest) doUpload(
 		// The file already exists, delete the uploaded temporary file.
 		defer fileutils.RemoveDir(tmpDir, r.Logger)
 		// The file already exists. Make a new media ID up for it.
-		mediaID, merr := r.generateMediaID(ctx, db)
+		mediaID, merr := r.uploadMediaID(ctx, db)
 		if merr != nil {
 			r.Logger.WithError(merr).Error("Failed to generate media ID for existing file")
 			return &util.JSONResponse{
@@ -217,7 +262,7 @@ func (r *uploadRequest) doUpload(
 		// The file doesn't exist. Update the request metadata.
 		r.MediaMetadata.FileSizeBytes = bytesWritten
 		r.MediaMetadata.Base64Hash = hash
-		r.MediaMetadata.MediaID, err = r.generateMediaID(ctx, db)
+		r.MediaMetadata.MediaID, err = r.uploadMediaID(ctx, db)
 		if err != nil {
 			fileutils.RemoveDir(tmpDir, r.Logger)
 			r.Logger.WithError(err).Error("Failed to generate media ID for new upload")
@@ -237,7 +282,7 @@ func (r *uploadRequest) doUpload(
 	}).Info("File uploaded")
 
 	return r.storeFileAndMetadata(
-		ctx, tmpDir, cfg.AbsBasePath, db, cfg.ThumbnailSizes,
+		ctx, tmpDir, db, store, cfg.ThumbnailSizes,
 		activeThumbnailGeneration, cfg.MaxThumbnailGenerators,
 	)
 }
@@ -277,39 +322,45 @@ func (r *uploadRequest) Validate(maxFileSizeBytes config.FileSizeBytes) *util.JS
 	return nil
 }
 
-// storeFileAndMetadata moves the temporary file to its final path based on metadata and stores the metadata in the database
-// See getPathFromMediaMetadata in fileutils for details of the final path.
+// storeFileAndMetadata moves the temporary file into the media store and stores the metadata in the database
 // The order of operations is important as it avoids metadata entering the database before the file
 // is ready, and if we fail to move the file, it never gets added to the database.
 // Returns a util.JSONResponse error and cleans up directories in case of error.
 func (r *uploadRequest) storeFileAndMetadata(
 	ctx context.Context,
 	tmpDir types.Path,
-	absBasePath config.Path,
 	db storage.Database,
+	store mediastore.MediaStore,
 	thumbnailSizes []config.ThumbnailSize,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
 	maxThumbnailGenerators int,
 ) *util.JSONResponse {
-	finalPath, duplicate, err := fileutils.MoveFileWithHashCheck(tmpDir, r.MediaMetadata, absBasePath, r.Logger)
+	duplicate, err := store.StoreFile(ctx, tmpDir, r.MediaMetadata)
 	if err != nil {
-		r.Logger.WithError(err).Error("Failed to move file.")
+		r.Logger.WithError(err).Error("Failed to store file.")
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: spec.Unknown("Failed to upload"),
 		}
 	}
 	if duplicate {
-		r.Logger.WithField("dst", finalPath).Info("File was stored previously - discarding duplicate")
+		r.Logger.WithField("Base64Hash", r.MediaMetadata.Base64Hash).Info("File was stored previously - discarding duplicate")
 	}
 
-	if err = db.StoreMediaMetadata(ctx, r.MediaMetadata); err != nil {
+	if r.Pending {
+		err = db.CompletePendingMedia(ctx, r.MediaMetadata)
+	} else {
+		err = db.StoreMediaMetadata(ctx, r.MediaMetadata)
+	}
+	if err != nil {
 		r.Logger.WithError(err).Warn("Failed to store metadata")
 		// If the file is a duplicate (has the same hash as an existing file) then
 		// there is valid metadata in the database for that file. As such we only
 		// remove the file if it is not a duplicate.
 		if !duplicate {
-			fileutils.RemoveDir(types.Path(path.Dir(string(finalPath))), r.Logger)
+			if err = store.DeleteFile(ctx, r.MediaMetadata.Base64Hash); err != nil {
+				r.Logger.WithError(err).Warn("Failed to remove stored file")
+			}
 		}
 		return &util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -318,28 +369,30 @@ func (r *uploadRequest) storeFileAndMetadata(
 	}
 
 	go func() {
-		file, err := os.Open(string(finalPath))
+		ctx, cancel := context.WithTimeout(context.Background(), thumbnailGenerationTimeout)
+		defer cancel()
+		file, _, err := store.OpenFile(ctx, r.MediaMetadata.Base64Hash)
 		if err != nil {
 			r.Logger.WithError(err).Error("unable to open file")
 			return
 		}
-		defer file.Close() // nolint: errcheck
 		// http.DetectContentType only needs 512 bytes
 		buf := make([]byte, 512)
-		_, err = file.Read(buf)
-		if err != nil {
+		n, err := io.ReadFull(file, buf)
+		file.Close() // nolint: errcheck
+		if err != nil && err != io.ErrUnexpectedEOF {
 			r.Logger.WithError(err).Error("unable to read file")
 			return
 		}
 		// Check if we need to generate thumbnails
-		fileType := http.DetectContentType(buf)
+		fileType := http.DetectContentType(buf[:n])
 		if !strings.HasPrefix(fileType, "image") {
 			r.Logger.WithField("contentType", fileType).Debugf("uploaded file is not an image or can not be thumbnailed, not generating thumbnails")
 			return
 		}
 
 		busy, err := thumbnailer.GenerateThumbnails(
-			context.Background(), finalPath, thumbnailSizes, r.MediaMetadata,
+			ctx, store, thumbnailSizes, r.MediaMetadata,
 			activeThumbnailGeneration, maxThumbnailGenerators, db, r.Logger,
 		)
 		if err != nil {
@@ -12,6 +12,7 @@ import (
 	"github.com/matrix-org/util"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/mediaapi/fileutils"
+	"github.com/neilalexander/harmony/mediaapi/mediastore"
 	"github.com/neilalexander/harmony/mediaapi/storage"
 	"github.com/neilalexander/harmony/mediaapi/types"
 	"github.com/neilalexander/harmony/setup/config"
@@ -30,6 +31,7 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 		reqReader                 io.Reader
 		cfg                       *config.MediaAPI
 		db                        storage.Database
+		store                     mediastore.MediaStore
 		activeThumbnailGeneration *types.ActiveThumbnailGeneration
 	}
 
@@ -52,6 +54,7 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 	// create testdata folder and remove when done
 	_ = os.Mkdir(testdataPath, os.ModePerm)
 	defer fileutils.RemoveDir(types.Path(testdataPath), nil)
+	store := mediastore.NewFileSystemStore(cfg.AbsBasePath)
 	cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
 	db, err := storage.NewMediaAPIDatasource(cm, &config.DatabaseOptions{
 		ConnectionString:       "file::memory:?cache=shared",
@@ -76,6 +79,7 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 				reqReader: strings.NewReader("test"),
 				cfg:       cfg,
 				db:        db,
+				store:     store,
 			},
 			fields: fields{
 				Logger: logger,
@@ -93,6 +97,7 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 				reqReader: strings.NewReader("testtest"),
 				cfg:       cfg,
 				db:        db,
+				store:     store,
 			},
 			fields: fields{
 				Logger: logger,
@@ -110,6 +115,7 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 				reqReader: strings.NewReader("test test test"),
 				cfg:       cfg,
 				db:        db,
+				store:     store,
 			},
 			fields: fields{
 				Logger: logger,
@@ -148,7 +154,7 @@ func Test_uploadRequest_doUpload(t *testing.T) {
 				MediaMetadata: tt.fields.MediaMetadata,
 				Logger:        tt.fields.Logger,
 			}
-			if got := r.doUpload(tt.args.ctx, tt.args.reqReader, tt.args.cfg, tt.args.db, tt.args.activeThumbnailGeneration); !reflect.DeepEqual(got, tt.want) {
+			if got := r.doUpload(tt.args.ctx, tt.args.reqReader, tt.args.cfg, tt.args.db, tt.args.store, tt.args.activeThumbnailGeneration); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("doUpload() = %+v, want %+v", got, tt.want)
 			}
 		})
@@ -0,0 +1,182 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // Register the GIF decoder for image.DecodeConfig
+	_ "image/jpeg" // Register the JPEG decoder for image.DecodeConfig
+	_ "image/png"  // Register the PNG decoder for image.DecodeConfig
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/matrix-org/util"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/mediaapi/mediastore"
+	"github.com/neilalexander/harmony/mediaapi/preview"
+	"github.com/neilalexander/harmony/mediaapi/storage"
+	"github.com/neilalexander/harmony/mediaapi/types"
+	"github.com/neilalexander/harmony/setup/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// URLPreview implements GET /preview_url
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1mediapreview_url
+// Previews are cached for the configured lifetime. The "ts" parameter is not
+// supported, so the most recent preview of the URL is always returned.
+func URLPreview(
+	req *http.Request,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	store mediastore.MediaStore,
+	previewer *preview.Previewer,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) util.JSONResponse {
+	rawURL := req.URL.Query().Get("url")
+	if rawURL == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.MissingParam("Missing url parameter"),
+		}
+	}
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("url must be an http or https URL"),
+		}
+	}
+
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithField("url", rawURL)
+	og, err := db.GetURLPreview(ctx, rawURL, spec.AsTimestamp(time.Now()))
+	if err != nil {
+		logger.WithError(err).Error("Failed to query cached URL preview")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if og != nil {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: og,
+		}
+	}
+
+	og, err = previewer.Preview(ctx, rawURL)
+	if errors.Is(err, preview.ErrBlockedIP) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("URL is not allowed to be previewed"),
+		}
+	} else if err != nil {
+		logger.WithError(err).Info("Failed to fetch URL preview")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: spec.Unknown("Failed to fetch URL preview"),
+		}
+	}
+
+	if imageURL, ok := og["og:image"].(string); ok {
+		if err = storePreviewImage(ctx, imageURL, og, cfg, db, store, previewer, activeThumbnailGeneration); err != nil {
+			logger.WithError(err).WithField("image", imageURL).Info("Failed to store URL preview image")
+			delete(og, "og:image")
+		}
+	}
+
+	expires := time.Now().Add(time.Duration(cfg.URLPreviews.CacheLifetimeMinutes) * time.Minute)
+	if err = db.StoreURLPreview(ctx, rawURL, og, spec.AsTimestamp(expires)); err != nil {
+		logger.WithError(err).Warn("Failed to cache URL preview")
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: og,
+	}
+}
+
+// storePreviewImage fetches the "og:image" of a preview and stores it as local
+// media, in the same way as an upload. The "og:image" in the preview is then
+// replaced with the MXC URI of the stored image.
+func storePreviewImage(
+	ctx context.Context,
+	imageURL string,
+	og types.OpenGraph,
+	cfg *config.MediaAPI,
+	db storage.Database,
+	store mediastore.MediaStore,
+	previewer *preview.Previewer,
+	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
+) error {
+	resp, err := previewer.Fetch(ctx, imageURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(contentType); !strings.HasPrefix(mediaType, "image/") {
+		return fmt.Errorf("unexpected content type %q", contentType)
+	}
+	var uploadName types.Filename
+	if name := path.Base(resp.Request.URL.Path); name != "/" && name != "." && !strings.HasPrefix(name, "~") {
+		uploadName = types.Filename(url.PathEscape(name))
+	}
+
+	r := &uploadRequest{
+		MediaMetadata: &types.MediaMetadata{
+			Origin:        cfg.Matrix.ServerName,
+			FileSizeBytes: types.FileSizeBytes(resp.ContentLength),
+			ContentType:   types.ContentType(contentType),
+			UploadName:    uploadName,
+		},
+		Logger: util.GetLogger(ctx).WithField("Origin", cfg.Matrix.ServerName),
+	}
+	if resErr := r.Validate(cfg.MaxFileSizeBytes); resErr != nil {
+		return fmt.Errorf("image is not valid: %v", resErr.JSON)
+	}
+	if resErr := r.doUpload(ctx, resp.Body, cfg, db, store, activeThumbnailGeneration); resErr != nil {
+		return fmt.Errorf("failed to store image: %v", resErr.JSON)
+	}
+
+	og["og:image"] = fmt.Sprintf("mxc://%s/%s", cfg.Matrix.ServerName, r.MediaMetadata.MediaID)
+	og["og:image:type"] = contentType
+	og["matrix:image:size"] = r.MediaMetadata.FileSizeBytes
+	delete(og, "og:image:width")
+	delete(og, "og:image:height")
+
+	file, _, err := store.OpenFile(ctx, r.MediaMetadata.Base64Hash)
+	if err != nil {
+		r.Logger.WithError(err).Warn("Unable to open URL preview image")
+		return nil
+	}
+	defer file.Close() // nolint: errcheck
+	if imgConfig, _, err := image.DecodeConfig(file); err == nil {
+		og["og:image:width"] = imgConfig.Width
+		og["og:image:height"] = imgConfig.Height
+	} else {
+		r.Logger.WithError(err).WithFields(log.Fields{
+			"ContentType": contentType,
+		}).Debug("Unable to determine dimensions of URL preview image")
+	}
+	return nil
+}
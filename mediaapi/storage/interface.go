@@ -24,12 +24,20 @@ import (
 type Database interface {
 	MediaRepository
 	Thumbnails
+	URLPreviews
+	UserQuotas
+	PendingMedia
 }
 
 type MediaRepository interface {
 	StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error
 	GetMediaMetadata(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (*types.MediaMetadata, error)
 	GetMediaMetadataByHash(ctx context.Context, mediaHash types.Base64Hash, mediaOrigin spec.ServerName) (*types.MediaMetadata, error)
+	SetMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, quarantined bool) (int64, error)
+	IsMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (bool, error)
+	SetUserMediaQuarantined(ctx context.Context, userID types.MatrixUserID, quarantined bool) (int64, error)
+	DeleteMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (hashInUse bool, err error)
+	GetMediaBefore(ctx context.Context, before spec.Timestamp, localOrigins []spec.ServerName, local bool, limit int) ([]*types.MediaMetadata, error)
 }
 
 type Thumbnails interface {
@@ -37,3 +45,24 @@ type Thumbnails interface {
 	GetThumbnail(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, width, height int, resizeMethod string) (*types.ThumbnailMetadata, error)
 	GetThumbnails(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) ([]*types.ThumbnailMetadata, error)
 }
+
+type URLPreviews interface {
+	StoreURLPreview(ctx context.Context, url string, og types.OpenGraph, expires spec.Timestamp) error
+	GetURLPreview(ctx context.Context, url string, now spec.Timestamp) (types.OpenGraph, error)
+	DeleteExpiredURLPreviews(ctx context.Context, now spec.Timestamp) error
+}
+
+type UserQuotas interface {
+	GetUserMediaUsage(ctx context.Context, userID types.MatrixUserID) (types.FileSizeBytes, error)
+	GetUserMediaQuota(ctx context.Context, userID types.MatrixUserID) (*types.FileSizeBytes, error)
+	SetUserMediaQuota(ctx context.Context, userID types.MatrixUserID, quota types.FileSizeBytes) error
+	DeleteUserMediaQuota(ctx context.Context, userID types.MatrixUserID) error
+}
+
+type PendingMedia interface {
+	StorePendingMedia(ctx context.Context, pending *types.PendingMedia) error
+	GetPendingMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, now spec.Timestamp) (*types.PendingMedia, error)
+	GetPendingMediaCount(ctx context.Context, userID types.MatrixUserID, now spec.Timestamp) (int, error)
+	CompletePendingMedia(ctx context.Context, mediaMetadata *types.MediaMetadata) error
+	DeleteExpiredPendingMedia(ctx context.Context, now spec.Timestamp) error
+}
@@ -20,8 +20,11 @@ import (
 	"database/sql"
 	"time"
 
+	"github.com/lib/pq"
+	"github.com/neilalexander/harmony/internal"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/mediaapi/storage/postgres/deltas"
 	"github.com/neilalexander/harmony/mediaapi/storage/tables"
 	"github.com/neilalexander/harmony/mediaapi/types"
 )
@@ -47,28 +50,80 @@ CREATE TABLE IF NOT EXISTS mediaapi_media_repository (
     -- Alternate RFC 4648 unpadded base64 encoding string representation of a SHA-256 hash sum of the file data.
     base64hash TEXT NOT NULL,
     -- The user who uploaded the file. Should be a Matrix user ID.
-    user_id TEXT NOT NULL
+    user_id TEXT NOT NULL,
+    -- Whether the media has been quarantined by an administrator.
+    quarantined BOOLEAN NOT NULL DEFAULT FALSE
 );
 CREATE UNIQUE INDEX IF NOT EXISTS mediaapi_media_repository_index ON mediaapi_media_repository (media_id, media_origin);
+CREATE INDEX IF NOT EXISTS mediaapi_media_repository_creation_ts_index ON mediaapi_media_repository (creation_ts);
+CREATE INDEX IF NOT EXISTS mediaapi_media_repository_user_id_index ON mediaapi_media_repository (user_id);
+CREATE INDEX IF NOT EXISTS mediaapi_media_repository_base64hash_index ON mediaapi_media_repository (base64hash);
 `
 
 const insertMediaSQL = `
-INSERT INTO mediaapi_media_repository (media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id)
-    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+INSERT INTO mediaapi_media_repository (media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, quarantined)
+    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 `
 
 const selectMediaSQL = `
-SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+SELECT content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, quarantined FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
 `
 
 const selectMediaByHashSQL = `
-SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2
+SELECT content_type, file_size_bytes, creation_ts, upload_name, media_id, user_id, quarantined FROM mediaapi_media_repository WHERE base64hash = $1 AND media_origin = $2
+`
+
+// Note: media is quarantined by hash, so that the same file can't be served
+// under a different media ID, e.g. by uploading it again.
+const updateMediaQuarantinedByHashSQL = `
+UPDATE mediaapi_media_repository SET quarantined = $2 WHERE base64hash = $1
+`
+
+const updateMediaQuarantinedByUserSQL = `
+UPDATE mediaapi_media_repository SET quarantined = $2
+ WHERE base64hash IN (SELECT base64hash FROM mediaapi_media_repository WHERE user_id = $1)
+`
+
+const selectHashQuarantinedSQL = `
+SELECT EXISTS(SELECT 1 FROM mediaapi_media_repository WHERE base64hash = $1 AND quarantined)
+`
+
+const deleteMediaSQL = `
+DELETE FROM mediaapi_media_repository WHERE media_id = $1 AND media_origin = $2
+`
+
+const selectHashInUseSQL = `
+SELECT EXISTS(SELECT 1 FROM mediaapi_media_repository WHERE base64hash = $1)
+`
+
+// Note: this selects media that was created before a given time, either from
+// the given origins (local media) or from any other origin (remote media).
+const selectLocalMediaBeforeSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, quarantined FROM mediaapi_media_repository
+ WHERE creation_ts < $1 AND media_origin = ANY($2) ORDER BY creation_ts ASC LIMIT $3
+`
+
+const selectRemoteMediaBeforeSQL = `
+SELECT media_id, media_origin, content_type, file_size_bytes, creation_ts, upload_name, base64hash, user_id, quarantined FROM mediaapi_media_repository
+ WHERE creation_ts < $1 AND NOT (media_origin = ANY($2)) ORDER BY creation_ts ASC LIMIT $3
+`
+
+const selectUserMediaSizeSQL = `
+SELECT COALESCE(SUM(file_size_bytes), 0) FROM mediaapi_media_repository WHERE user_id = $1
 `
 
 type mediaStatements struct {
-	insertMediaStmt       *sql.Stmt
-	selectMediaStmt       *sql.Stmt
-	selectMediaByHashStmt *sql.Stmt
+	insertMediaStmt                  *sql.Stmt
+	selectMediaStmt                  *sql.Stmt
+	selectMediaByHashStmt            *sql.Stmt
+	updateMediaQuarantinedByHashStmt *sql.Stmt
+	updateMediaQuarantinedByUserStmt *sql.Stmt
+	selectHashQuarantinedStmt        *sql.Stmt
+	deleteMediaStmt                  *sql.Stmt
+	selectHashInUseStmt              *sql.Stmt
+	selectLocalMediaBeforeStmt       *sql.Stmt
+	selectRemoteMediaBeforeStmt      *sql.Stmt
+	selectUserMediaSizeStmt          *sql.Stmt
 }
 
 func NewPostgresMediaRepositoryTable(db *sql.DB) (tables.MediaRepository, error) {
@@ -78,10 +133,29 @@ func NewPostgresMediaRepositoryTable(db *sql.DB) (tables.MediaRepository, error)
 		return nil, err
 	}
 
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(
+		sqlutil.Migration{
+			Version: "mediaapi: add quarantined column",
+			Up:      deltas.UpAddQuarantined,
+		},
+	)
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
+
 	return s, sqlutil.StatementList{
 		{&s.insertMediaStmt, insertMediaSQL},
 		{&s.selectMediaStmt, selectMediaSQL},
 		{&s.selectMediaByHashStmt, selectMediaByHashSQL},
+		{&s.updateMediaQuarantinedByHashStmt, updateMediaQuarantinedByHashSQL},
+		{&s.updateMediaQuarantinedByUserStmt, updateMediaQuarantinedByUserSQL},
+		{&s.selectHashQuarantinedStmt, selectHashQuarantinedSQL},
+		{&s.deleteMediaStmt, deleteMediaSQL},
+		{&s.selectHashInUseStmt, selectHashInUseSQL},
+		{&s.selectLocalMediaBeforeStmt, selectLocalMediaBeforeSQL},
+		{&s.selectRemoteMediaBeforeStmt, selectRemoteMediaBeforeSQL},
+		{&s.selectUserMediaSizeStmt, selectUserMediaSizeSQL},
 	}.Prepare(db)
 }
 
@@ -99,6 +173,7 @@ func (s *mediaStatements) InsertMedia(
 		mediaMetadata.UploadName,
 		mediaMetadata.Base64Hash,
 		mediaMetadata.UserID,
+		mediaMetadata.Quarantined,
 	)
 	return err
 }
@@ -119,6 +194,7 @@ func (s *mediaStatements) SelectMedia(
 		&mediaMetadata.UploadName,
 		&mediaMetadata.Base64Hash,
 		&mediaMetadata.UserID,
+		&mediaMetadata.Quarantined,
 	)
 	return &mediaMetadata, err
 }
@@ -139,6 +215,108 @@ func (s *mediaStatements) SelectMediaByHash(
 		&mediaMetadata.UploadName,
 		&mediaMetadata.MediaID,
 		&mediaMetadata.UserID,
+		&mediaMetadata.Quarantined,
 	)
 	return &mediaMetadata, err
 }
+
+func (s *mediaStatements) UpdateMediaQuarantinedByHash(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash, quarantined bool,
+) (int64, error) {
+	res, err := sqlutil.TxStmtContext(ctx, txn, s.updateMediaQuarantinedByHashStmt).ExecContext(
+		ctx, mediaHash, quarantined,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *mediaStatements) UpdateMediaQuarantinedByUser(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, quarantined bool,
+) (int64, error) {
+	res, err := sqlutil.TxStmtContext(ctx, txn, s.updateMediaQuarantinedByUserStmt).ExecContext(
+		ctx, userID, quarantined,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *mediaStatements) SelectHashQuarantined(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) (quarantined bool, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectHashQuarantinedStmt).QueryRowContext(
+		ctx, mediaHash,
+	).Scan(&quarantined)
+	return
+}
+
+func (s *mediaStatements) DeleteMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteMediaStmt).ExecContext(
+		ctx, mediaID, mediaOrigin,
+	)
+	return err
+}
+
+func (s *mediaStatements) SelectHashInUse(
+	ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash,
+) (inUse bool, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectHashInUseStmt).QueryRowContext(
+		ctx, mediaHash,
+	).Scan(&inUse)
+	return
+}
+
+func (s *mediaStatements) SelectMediaBefore(
+	ctx context.Context, txn *sql.Tx, before spec.Timestamp,
+	localOrigins []spec.ServerName, local bool, limit int,
+) ([]*types.MediaMetadata, error) {
+	stmt := s.selectRemoteMediaBeforeStmt
+	if local {
+		stmt = s.selectLocalMediaBeforeStmt
+	}
+	origins := make([]string, 0, len(localOrigins))
+	for _, origin := range localOrigins {
+		origins = append(origins, string(origin))
+	}
+	rows, err := sqlutil.TxStmtContext(ctx, txn, stmt).QueryContext(
+		ctx, before, pq.StringArray(origins), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectMediaBefore: rows.close() failed")
+
+	var media []*types.MediaMetadata
+	for rows.Next() {
+		var mediaMetadata types.MediaMetadata
+		if err = rows.Scan(
+			&mediaMetadata.MediaID,
+			&mediaMetadata.Origin,
+			&mediaMetadata.ContentType,
+			&mediaMetadata.FileSizeBytes,
+			&mediaMetadata.CreationTimestamp,
+			&mediaMetadata.UploadName,
+			&mediaMetadata.Base64Hash,
+			&mediaMetadata.UserID,
+			&mediaMetadata.Quarantined,
+		); err != nil {
+			return nil, err
+		}
+		media = append(media, &mediaMetadata)
+	}
+	return media, rows.Err()
+}
+
+func (s *mediaStatements) SelectUserMediaSize(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID,
+) (size types.FileSizeBytes, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectUserMediaSizeStmt).QueryRowContext(
+		ctx, userID,
+	).Scan(&size)
+	return
+}
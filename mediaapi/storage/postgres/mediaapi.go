@@ -33,14 +33,34 @@ func NewDatabase(conMan *sqlutil.Connections, dbProperties *config.DatabaseOptio
 	if err != nil {
 		return nil, err
 	}
+	quarantinedMedia, err := NewPostgresQuarantinedMediaTable(db)
+	if err != nil {
+		return nil, err
+	}
 	thumbnails, err := NewPostgresThumbnailsTable(db)
 	if err != nil {
 		return nil, err
 	}
+	urlPreviews, err := NewPostgresURLPreviewsTable(db)
+	if err != nil {
+		return nil, err
+	}
+	userQuotas, err := NewPostgresUserQuotasTable(db)
+	if err != nil {
+		return nil, err
+	}
+	pendingMedia, err := NewPostgresPendingMediaTable(db)
+	if err != nil {
+		return nil, err
+	}
 	return &shared.Database{
-		MediaRepository: mediaRepo,
-		Thumbnails:      thumbnails,
-		DB:              db,
-		Writer:          writer,
+		MediaRepository:  mediaRepo,
+		QuarantinedMedia: quarantinedMedia,
+		Thumbnails:       thumbnails,
+		URLPreviews:      urlPreviews,
+		UserQuotas:       userQuotas,
+		PendingMedia:     pendingMedia,
+		DB:               db,
+		Writer:           writer,
 	}, nil
 }
@@ -0,0 +1,145 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/mediaapi/storage/tables"
+	"github.com/neilalexander/harmony/mediaapi/types"
+)
+
+const pendingMediaSchema = `
+-- The mediaapi_pending_media table holds MXC URIs which have been created
+-- with /create but which have not had any content uploaded to them yet.
+CREATE TABLE IF NOT EXISTS mediaapi_pending_media (
+    -- The id used to refer to the media.
+    media_id TEXT NOT NULL,
+    -- The origin of the media. Always a local server name.
+    media_origin TEXT NOT NULL,
+    -- The user who created the MXC URI, who is the only one allowed to upload to it.
+    user_id TEXT NOT NULL,
+    -- When the MXC URI was created in UNIX epoch ms.
+    creation_ts BIGINT NOT NULL,
+    -- When the MXC URI expires if nothing has been uploaded to it, in UNIX epoch ms.
+    expires_ts BIGINT NOT NULL,
+    PRIMARY KEY (media_id, media_origin)
+);
+CREATE INDEX IF NOT EXISTS mediaapi_pending_media_user_id_index ON mediaapi_pending_media (user_id);
+CREATE INDEX IF NOT EXISTS mediaapi_pending_media_expires_ts_index ON mediaapi_pending_media (expires_ts);
+`
+
+const insertPendingMediaSQL = `
+INSERT INTO mediaapi_pending_media (media_id, media_origin, user_id, creation_ts, expires_ts)
+    VALUES ($1, $2, $3, $4, $5)
+`
+
+const selectPendingMediaSQL = `
+SELECT user_id, creation_ts, expires_ts FROM mediaapi_pending_media
+ WHERE media_id = $1 AND media_origin = $2 AND expires_ts > $3
+`
+
+const selectPendingMediaCountSQL = `
+SELECT COUNT(*) FROM mediaapi_pending_media WHERE user_id = $1 AND expires_ts > $2
+`
+
+const deletePendingMediaSQL = `
+DELETE FROM mediaapi_pending_media WHERE media_id = $1 AND media_origin = $2
+`
+
+const deleteExpiredPendingMediaSQL = `
+DELETE FROM mediaapi_pending_media WHERE expires_ts <= $1
+`
+
+type pendingMediaStatements struct {
+	insertPendingMediaStmt        *sql.Stmt
+	selectPendingMediaStmt        *sql.Stmt
+	selectPendingMediaCountStmt   *sql.Stmt
+	deletePendingMediaStmt        *sql.Stmt
+	deleteExpiredPendingMediaStmt *sql.Stmt
+}
+
+func NewPostgresPendingMediaTable(db *sql.DB) (tables.PendingMedia, error) {
+	s := &pendingMediaStatements{}
+	_, err := db.Exec(pendingMediaSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertPendingMediaStmt, insertPendingMediaSQL},
+		{&s.selectPendingMediaStmt, selectPendingMediaSQL},
+		{&s.selectPendingMediaCountStmt, selectPendingMediaCountSQL},
+		{&s.deletePendingMediaStmt, deletePendingMediaSQL},
+		{&s.deleteExpiredPendingMediaStmt, deleteExpiredPendingMediaSQL},
+	}.Prepare(db)
+}
+
+func (s *pendingMediaStatements) InsertPendingMedia(
+	ctx context.Context, txn *sql.Tx, pending *types.PendingMedia,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertPendingMediaStmt).ExecContext(
+		ctx,
+		pending.MediaID,
+		pending.Origin,
+		pending.UserID,
+		pending.CreationTimestamp,
+		pending.ExpiresTimestamp,
+	)
+	return err
+}
+
+func (s *pendingMediaStatements) SelectPendingMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName, now spec.Timestamp,
+) (*types.PendingMedia, error) {
+	pending := types.PendingMedia{
+		MediaID: mediaID,
+		Origin:  mediaOrigin,
+	}
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectPendingMediaStmt).QueryRowContext(
+		ctx, mediaID, mediaOrigin, now,
+	).Scan(
+		&pending.UserID,
+		&pending.CreationTimestamp,
+		&pending.ExpiresTimestamp,
+	)
+	return &pending, err
+}
+
+func (s *pendingMediaStatements) SelectPendingMediaCount(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, now spec.Timestamp,
+) (count int, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectPendingMediaCountStmt).QueryRowContext(
+		ctx, userID, now,
+	).Scan(&count)
+	return
+}
+
+func (s *pendingMediaStatements) DeletePendingMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deletePendingMediaStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *pendingMediaStatements) DeleteExpiredPendingMedia(
+	ctx context.Context, txn *sql.Tx, now spec.Timestamp,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteExpiredPendingMediaStmt).ExecContext(ctx, now)
+	return err
+}
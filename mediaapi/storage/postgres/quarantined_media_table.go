@@ -0,0 +1,93 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/mediaapi/storage/tables"
+	"github.com/neilalexander/harmony/mediaapi/types"
+)
+
+const quarantinedMediaSchema = `
+-- The mediaapi_quarantined_media table holds MXC URIs which have been quarantined
+-- by an administrator. This includes media from remote servers which hasn't been
+-- cached yet, or which has since been purged, so that it is quarantined as soon as
+-- it is fetched again.
+CREATE TABLE IF NOT EXISTS mediaapi_quarantined_media (
+    -- The id used to refer to the media.
+    media_id TEXT NOT NULL,
+    -- The origin of the media.
+    media_origin TEXT NOT NULL,
+    PRIMARY KEY (media_id, media_origin)
+);
+`
+
+const insertQuarantinedMediaSQL = `
+INSERT INTO mediaapi_quarantined_media (media_id, media_origin) VALUES ($1, $2)
+	ON CONFLICT (media_id, media_origin) DO NOTHING
+`
+
+const selectQuarantinedMediaSQL = `
+SELECT EXISTS(SELECT 1 FROM mediaapi_quarantined_media WHERE media_id = $1 AND media_origin = $2)
+`
+
+const deleteQuarantinedMediaSQL = `
+DELETE FROM mediaapi_quarantined_media WHERE media_id = $1 AND media_origin = $2
+`
+
+type quarantinedMediaStatements struct {
+	insertQuarantinedMediaStmt *sql.Stmt
+	selectQuarantinedMediaStmt *sql.Stmt
+	deleteQuarantinedMediaStmt *sql.Stmt
+}
+
+func NewPostgresQuarantinedMediaTable(db *sql.DB) (tables.QuarantinedMedia, error) {
+	s := &quarantinedMediaStatements{}
+	_, err := db.Exec(quarantinedMediaSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.insertQuarantinedMediaStmt, insertQuarantinedMediaSQL},
+		{&s.selectQuarantinedMediaStmt, selectQuarantinedMediaSQL},
+		{&s.deleteQuarantinedMediaStmt, deleteQuarantinedMediaSQL},
+	}.Prepare(db)
+}
+
+func (s *quarantinedMediaStatements) InsertQuarantinedMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.insertQuarantinedMediaStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
+
+func (s *quarantinedMediaStatements) SelectQuarantinedMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName,
+) (quarantined bool, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectQuarantinedMediaStmt).QueryRowContext(ctx, mediaID, mediaOrigin).Scan(&quarantined)
+	return
+}
+
+func (s *quarantinedMediaStatements) DeleteQuarantinedMedia(
+	ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteQuarantinedMediaStmt).ExecContext(ctx, mediaID, mediaOrigin)
+	return err
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/mediaapi/storage/tables"
+	"github.com/neilalexander/harmony/mediaapi/types"
+)
+
+const urlPreviewsSchema = `
+-- The mediaapi_url_previews table caches the OpenGraph metadata of URLs
+-- that have been previewed, so that they do not need to be fetched again.
+CREATE TABLE IF NOT EXISTS mediaapi_url_previews (
+    -- The URL that was previewed, as requested by the client.
+    url TEXT NOT NULL PRIMARY KEY,
+    -- The OpenGraph metadata of the URL as JSON.
+    og_json TEXT NOT NULL,
+    -- When the cached preview expires in UNIX epoch ms.
+    expires_ts BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS mediaapi_url_previews_expires_ts_index ON mediaapi_url_previews (expires_ts);
+`
+
+const upsertURLPreviewSQL = `
+INSERT INTO mediaapi_url_previews (url, og_json, expires_ts) VALUES ($1, $2, $3)
+	ON CONFLICT (url) DO UPDATE SET og_json = $2, expires_ts = $3
+`
+
+const selectURLPreviewSQL = `
+SELECT og_json FROM mediaapi_url_previews WHERE url = $1 AND expires_ts > $2
+`
+
+const deleteExpiredURLPreviewsSQL = `
+DELETE FROM mediaapi_url_previews WHERE expires_ts <= $1
+`
+
+type urlPreviewsStatements struct {
+	upsertURLPreviewStmt         *sql.Stmt
+	selectURLPreviewStmt         *sql.Stmt
+	deleteExpiredURLPreviewsStmt *sql.Stmt
+}
+
+func NewPostgresURLPreviewsTable(db *sql.DB) (tables.URLPreviews, error) {
+	s := &urlPreviewsStatements{}
+	_, err := db.Exec(urlPreviewsSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertURLPreviewStmt, upsertURLPreviewSQL},
+		{&s.selectURLPreviewStmt, selectURLPreviewSQL},
+		{&s.deleteExpiredURLPreviewsStmt, deleteExpiredURLPreviewsSQL},
+	}.Prepare(db)
+}
+
+func (s *urlPreviewsStatements) UpsertURLPreview(
+	ctx context.Context, txn *sql.Tx, url string, og types.OpenGraph, expires spec.Timestamp,
+) error {
+	ogJSON, err := json.Marshal(og)
+	if err != nil {
+		return err
+	}
+	_, err = sqlutil.TxStmtContext(ctx, txn, s.upsertURLPreviewStmt).ExecContext(
+		ctx, url, string(ogJSON), expires,
+	)
+	return err
+}
+
+func (s *urlPreviewsStatements) SelectURLPreview(
+	ctx context.Context, txn *sql.Tx, url string, now spec.Timestamp,
+) (types.OpenGraph, error) {
+	var ogJSON string
+	err := sqlutil.TxStmtContext(ctx, txn, s.selectURLPreviewStmt).QueryRowContext(
+		ctx, url, now,
+	).Scan(&ogJSON)
+	if err != nil {
+		return nil, err
+	}
+	var og types.OpenGraph
+	if err = json.Unmarshal([]byte(ogJSON), &og); err != nil {
+		return nil, err
+	}
+	return og, nil
+}
+
+func (s *urlPreviewsStatements) DeleteExpiredURLPreviews(
+	ctx context.Context, txn *sql.Tx, now spec.Timestamp,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteExpiredURLPreviewsStmt).ExecContext(ctx, now)
+	return err
+}
@@ -0,0 +1,89 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/mediaapi/storage/tables"
+	"github.com/neilalexander/harmony/mediaapi/types"
+)
+
+const userQuotasSchema = `
+-- The mediaapi_user_quotas table holds per-user overrides of the default
+-- media upload quota.
+CREATE TABLE IF NOT EXISTS mediaapi_user_quotas (
+    -- The local user that the quota applies to.
+    user_id TEXT NOT NULL PRIMARY KEY,
+    -- The maximum number of bytes of media that the user may store, or 0 for no limit.
+    quota_bytes BIGINT NOT NULL
+);
+`
+
+const upsertUserQuotaSQL = `
+INSERT INTO mediaapi_user_quotas (user_id, quota_bytes) VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE SET quota_bytes = $2
+`
+
+const selectUserQuotaSQL = `
+SELECT quota_bytes FROM mediaapi_user_quotas WHERE user_id = $1
+`
+
+const deleteUserQuotaSQL = `
+DELETE FROM mediaapi_user_quotas WHERE user_id = $1
+`
+
+type userQuotasStatements struct {
+	upsertUserQuotaStmt *sql.Stmt
+	selectUserQuotaStmt *sql.Stmt
+	deleteUserQuotaStmt *sql.Stmt
+}
+
+func NewPostgresUserQuotasTable(db *sql.DB) (tables.UserQuotas, error) {
+	s := &userQuotasStatements{}
+	_, err := db.Exec(userQuotasSchema)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, sqlutil.StatementList{
+		{&s.upsertUserQuotaStmt, upsertUserQuotaSQL},
+		{&s.selectUserQuotaStmt, selectUserQuotaSQL},
+		{&s.deleteUserQuotaStmt, deleteUserQuotaSQL},
+	}.Prepare(db)
+}
+
+func (s *userQuotasStatements) UpsertUserQuota(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, quota types.FileSizeBytes,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.upsertUserQuotaStmt).ExecContext(ctx, userID, quota)
+	return err
+}
+
+func (s *userQuotasStatements) SelectUserQuota(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID,
+) (quota types.FileSizeBytes, err error) {
+	err = sqlutil.TxStmtContext(ctx, txn, s.selectUserQuotaStmt).QueryRowContext(ctx, userID).Scan(&quota)
+	return
+}
+
+func (s *userQuotasStatements) DeleteUserQuota(
+	ctx context.Context, txn *sql.Tx, userID types.MatrixUserID,
+) error {
+	_, err := sqlutil.TxStmtContext(ctx, txn, s.deleteUserQuotaStmt).ExecContext(ctx, userID)
+	return err
+}
@@ -25,20 +25,41 @@ import (
 )
 
 type Database struct {
-	DB              *sql.DB
-	Writer          sqlutil.Writer
-	MediaRepository tables.MediaRepository
-	Thumbnails      tables.Thumbnails
+	DB               *sql.DB
+	Writer           sqlutil.Writer
+	MediaRepository  tables.MediaRepository
+	QuarantinedMedia tables.QuarantinedMedia
+	Thumbnails       tables.Thumbnails
+	URLPreviews      tables.URLPreviews
+	UserQuotas       tables.UserQuotas
+	PendingMedia     tables.PendingMedia
 }
 
 // StoreMediaMetadata inserts the metadata about the uploaded media into the database.
 // Returns an error if the combination of MediaID and Origin are not unique in the table.
 func (d Database) StoreMediaMetadata(ctx context.Context, mediaMetadata *types.MediaMetadata) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		return d.MediaRepository.InsertMedia(ctx, txn, mediaMetadata)
+		return d.insertMedia(ctx, txn, mediaMetadata)
 	})
 }
 
+// insertMedia inserts the media, which is quarantined if its MXC URI or a file
+// with the same hash has been quarantined before.
+func (d Database) insertMedia(ctx context.Context, txn *sql.Tx, mediaMetadata *types.MediaMetadata) error {
+	quarantined, err := d.QuarantinedMedia.SelectQuarantinedMedia(ctx, txn, mediaMetadata.MediaID, mediaMetadata.Origin)
+	if err != nil {
+		return err
+	}
+	if !quarantined {
+		quarantined, err = d.MediaRepository.SelectHashQuarantined(ctx, txn, mediaMetadata.Base64Hash)
+		if err != nil {
+			return err
+		}
+	}
+	mediaMetadata.Quarantined = quarantined
+	return d.MediaRepository.InsertMedia(ctx, txn, mediaMetadata)
+}
+
 // GetMediaMetadata returns metadata about media stored on this server.
 // The media could have been uploaded to this server or fetched from another server and cached here.
 // Returns nil metadata if there is no metadata associated with this media.
@@ -61,6 +82,76 @@ func (d Database) GetMediaMetadataByHash(ctx context.Context, mediaHash types.Ba
 	return mediaMetadata, err
 }
 
+// SetMediaQuarantined marks an MXC URI as quarantined or not, along with all other
+// media stored with the same file. The MXC URI is remembered even if the media
+// hasn't been cached here, so that it is quarantined as soon as it is fetched.
+// Returns the number of stored media items affected.
+func (d Database) SetMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, quarantined bool) (affected int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if quarantined {
+			err = d.QuarantinedMedia.InsertQuarantinedMedia(ctx, txn, mediaID, mediaOrigin)
+		} else {
+			err = d.QuarantinedMedia.DeleteQuarantinedMedia(ctx, txn, mediaID, mediaOrigin)
+		}
+		if err != nil {
+			return err
+		}
+		mediaMetadata, err := d.MediaRepository.SelectMedia(ctx, txn, mediaID, mediaOrigin)
+		if err == sql.ErrNoRows {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		affected, err = d.MediaRepository.UpdateMediaQuarantinedByHash(ctx, txn, mediaMetadata.Base64Hash, quarantined)
+		return err
+	})
+	return
+}
+
+// IsMediaQuarantined returns whether the MXC URI has been quarantined, even if the
+// media hasn't been cached here.
+func (d Database) IsMediaQuarantined(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (bool, error) {
+	return d.QuarantinedMedia.SelectQuarantinedMedia(ctx, nil, mediaID, mediaOrigin)
+}
+
+// SetUserMediaQuarantined marks all media uploaded by the given user as quarantined or not,
+// along with all other media stored with the same files. Returns the number of media items affected.
+func (d Database) SetUserMediaQuarantined(ctx context.Context, userID types.MatrixUserID, quarantined bool) (affected int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		affected, err = d.MediaRepository.UpdateMediaQuarantinedByUser(ctx, txn, userID, quarantined)
+		return err
+	})
+	return
+}
+
+// DeleteMedia removes the metadata about the media and all of its thumbnails from the database.
+// Returns whether the file hash is still used by other media, in which case the file itself
+// must not be removed from the media store.
+func (d Database) DeleteMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName) (hashInUse bool, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		mediaMetadata, err := d.MediaRepository.SelectMedia(ctx, txn, mediaID, mediaOrigin)
+		if err != nil {
+			return err
+		}
+		if err = d.Thumbnails.DeleteThumbnails(ctx, txn, mediaID, mediaOrigin); err != nil {
+			return err
+		}
+		if err = d.MediaRepository.DeleteMedia(ctx, txn, mediaID, mediaOrigin); err != nil {
+			return err
+		}
+		hashInUse, err = d.MediaRepository.SelectHashInUse(ctx, txn, mediaMetadata.Base64Hash)
+		return err
+	})
+	return
+}
+
+// GetMediaBefore returns up to limit media items that were created before the given time.
+// If local is true then only media from the given local origins is returned, otherwise
+// only media cached from remote servers is returned.
+func (d Database) GetMediaBefore(ctx context.Context, before spec.Timestamp, localOrigins []spec.ServerName, local bool, limit int) ([]*types.MediaMetadata, error) {
+	return d.MediaRepository.SelectMediaBefore(ctx, nil, before, localOrigins, local, limit)
+}
+
 // StoreThumbnail inserts the metadata about the thumbnail into the database.
 // Returns an error if the combination of MediaID and Origin are not unique in the table.
 func (d Database) StoreThumbnail(ctx context.Context, thumbnailMetadata *types.ThumbnailMetadata) error {
@@ -96,3 +187,102 @@ func (d Database) GetThumbnails(ctx context.Context, mediaID types.MediaID, medi
 	}
 	return metadatas, err
 }
+
+// StoreURLPreview caches the OpenGraph metadata of a URL until the given expiry time,
+// replacing any previously cached preview of the URL.
+func (d Database) StoreURLPreview(ctx context.Context, url string, og types.OpenGraph, expires spec.Timestamp) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.URLPreviews.UpsertURLPreview(ctx, txn, url, og, expires)
+	})
+}
+
+// GetURLPreview returns the cached OpenGraph metadata of a URL.
+// Returns nil metadata if there is no cached preview that has not yet expired.
+func (d Database) GetURLPreview(ctx context.Context, url string, now spec.Timestamp) (types.OpenGraph, error) {
+	og, err := d.URLPreviews.SelectURLPreview(ctx, nil, url, now)
+	if err != nil && err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return og, err
+}
+
+// DeleteExpiredURLPreviews removes all cached URL previews that have expired.
+func (d Database) DeleteExpiredURLPreviews(ctx context.Context, now spec.Timestamp) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.URLPreviews.DeleteExpiredURLPreviews(ctx, txn, now)
+	})
+}
+
+// GetUserMediaUsage returns the total size in bytes of all media uploaded by the user.
+func (d Database) GetUserMediaUsage(ctx context.Context, userID types.MatrixUserID) (types.FileSizeBytes, error) {
+	return d.MediaRepository.SelectUserMediaSize(ctx, nil, userID)
+}
+
+// GetUserMediaQuota returns the quota override for the user.
+// Returns nil if the user has no override and the default quota applies.
+func (d Database) GetUserMediaQuota(ctx context.Context, userID types.MatrixUserID) (*types.FileSizeBytes, error) {
+	quota, err := d.UserQuotas.SelectUserQuota(ctx, nil, userID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &quota, nil
+}
+
+// SetUserMediaQuota overrides the default quota for the user.
+func (d Database) SetUserMediaQuota(ctx context.Context, userID types.MatrixUserID, quota types.FileSizeBytes) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.UserQuotas.UpsertUserQuota(ctx, txn, userID, quota)
+	})
+}
+
+// DeleteUserMediaQuota removes the quota override for the user, so that the default quota applies.
+func (d Database) DeleteUserMediaQuota(ctx context.Context, userID types.MatrixUserID) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.UserQuotas.DeleteUserQuota(ctx, txn, userID)
+	})
+}
+
+// StorePendingMedia reserves an MXC URI for content which will be uploaded later.
+func (d Database) StorePendingMedia(ctx context.Context, pending *types.PendingMedia) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PendingMedia.InsertPendingMedia(ctx, txn, pending)
+	})
+}
+
+// GetPendingMedia returns a reserved MXC URI which has no content uploaded to it yet.
+// Returns nil if there is no such MXC URI or if it has expired by the given time.
+func (d Database) GetPendingMedia(ctx context.Context, mediaID types.MediaID, mediaOrigin spec.ServerName, now spec.Timestamp) (*types.PendingMedia, error) {
+	pending, err := d.PendingMedia.SelectPendingMedia(ctx, nil, mediaID, mediaOrigin, now)
+	if err != nil && err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return pending, err
+}
+
+// GetPendingMediaCount returns the number of reserved MXC URIs created by the user
+// which have not had content uploaded to them and have not expired by the given time.
+func (d Database) GetPendingMediaCount(ctx context.Context, userID types.MatrixUserID, now spec.Timestamp) (int, error) {
+	return d.PendingMedia.SelectPendingMediaCount(ctx, nil, userID, now)
+}
+
+// CompletePendingMedia stores the metadata of content uploaded to a reserved MXC URI
+// and removes the reservation, so that the MXC URI can't be uploaded to again.
+func (d Database) CompletePendingMedia(ctx context.Context, mediaMetadata *types.MediaMetadata) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.PendingMedia.DeletePendingMedia(ctx, txn, mediaMetadata.MediaID, mediaMetadata.Origin); err != nil {
+			return err
+		}
+		return d.insertMedia(ctx, txn, mediaMetadata)
+	})
+}
+
+// DeleteExpiredPendingMedia removes all reserved MXC URIs which have expired without
+// any content being uploaded to them.
+func (d Database) DeleteExpiredPendingMedia(ctx context.Context, now spec.Timestamp) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.PendingMedia.DeleteExpiredPendingMedia(ctx, txn, now)
+	})
+}
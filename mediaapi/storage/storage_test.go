@@ -2,9 +2,12 @@ package storage_test
 
 import (
 	"context"
+	"fmt"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/mediaapi/storage"
 	"github.com/neilalexander/harmony/mediaapi/types"
@@ -143,3 +146,314 @@ func TestThumbnailsStorage(t *testing.T) {
 		})
 	})
 }
+
+func TestQuarantineAndDeleteMedia(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		// InsertMedia sets the creation timestamp to the current time.
+		before := spec.AsTimestamp(time.Now().Add(-time.Minute))
+		after := spec.AsTimestamp(time.Now().Add(time.Minute))
+		media := []*types.MediaMetadata{
+			{MediaID: "local1", Origin: "localhost", Base64Hash: "aGFzaA==", UserID: "@alice:localhost"},
+			{MediaID: "local2", Origin: "localhost", Base64Hash: "aGFzaA==", UserID: "@bob:localhost"},
+			{MediaID: "remote", Origin: "remote", Base64Hash: "cmVtb3Rl", UserID: "@charlie:remote"},
+		}
+		for _, m := range media {
+			if err := db.StoreMediaMetadata(ctx, m); err != nil {
+				t.Fatalf("unable to store media metadata: %v", err)
+			}
+		}
+
+		t.Run("can quarantine media", func(t *testing.T) {
+			// local1 and local2 are the same file, so both are quarantined.
+			affected, err := db.SetMediaQuarantined(ctx, "local1", "localhost", true)
+			if err != nil || affected != 2 {
+				t.Fatalf("expected 2 media to be quarantined, got %d (%v)", affected, err)
+			}
+			affected, err = db.SetUserMediaQuarantined(ctx, "@bob:localhost", true)
+			if err != nil || affected != 2 {
+				t.Fatalf("expected 2 media to be quarantined, got %d (%v)", affected, err)
+			}
+			for _, m := range media[:2] {
+				gotMetadata, err := db.GetMediaMetadata(ctx, m.MediaID, m.Origin)
+				if err != nil {
+					t.Fatalf("unable to query media metadata: %v", err)
+				}
+				if !gotMetadata.Quarantined {
+					t.Fatalf("expected %s to be quarantined", m.MediaID)
+				}
+			}
+			if _, err = db.SetMediaQuarantined(ctx, "local1", "localhost", false); err != nil {
+				t.Fatalf("unable to unquarantine media: %v", err)
+			}
+		})
+
+		t.Run("can select media by age and origin", func(t *testing.T) {
+			local, err := db.GetMediaBefore(ctx, after, []spec.ServerName{"localhost"}, true, 10)
+			if err != nil {
+				t.Fatalf("unable to query local media: %v", err)
+			}
+			if len(local) != 2 {
+				t.Fatalf("expected 2 local media, got %d", len(local))
+			}
+			remote, err := db.GetMediaBefore(ctx, after, []spec.ServerName{"localhost"}, false, 10)
+			if err != nil {
+				t.Fatalf("unable to query remote media: %v", err)
+			}
+			if len(remote) != 1 || remote[0].MediaID != "remote" {
+				t.Fatalf("expected only remote media, got %+v", remote)
+			}
+			older, err := db.GetMediaBefore(ctx, before, []spec.ServerName{"localhost"}, true, 10)
+			if err != nil {
+				t.Fatalf("unable to query local media: %v", err)
+			}
+			if len(older) != 0 {
+				t.Fatalf("expected no media older than cutoff, got %d", len(older))
+			}
+		})
+
+		t.Run("can delete media", func(t *testing.T) {
+			hashInUse, err := db.DeleteMedia(ctx, "local1", "localhost")
+			if err != nil {
+				t.Fatalf("unable to delete media: %v", err)
+			}
+			if !hashInUse {
+				t.Fatalf("expected hash to still be used by local2")
+			}
+			gotMetadata, err := db.GetMediaMetadata(ctx, "local1", "localhost")
+			if err != nil {
+				t.Fatalf("unable to query media metadata: %v", err)
+			}
+			if gotMetadata != nil {
+				t.Fatalf("expected media to be deleted, got %+v", gotMetadata)
+			}
+			hashInUse, err = db.DeleteMedia(ctx, "local2", "localhost")
+			if err != nil {
+				t.Fatalf("unable to delete media: %v", err)
+			}
+			if hashInUse {
+				t.Fatalf("expected hash to no longer be used")
+			}
+		})
+	})
+}
+
+func TestQuarantineMediaByHash(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+
+		assertQuarantined := func(t *testing.T, mediaID types.MediaID, origin spec.ServerName, want bool) {
+			t.Helper()
+			gotMetadata, err := db.GetMediaMetadata(ctx, mediaID, origin)
+			if err != nil {
+				t.Fatalf("unable to query media metadata: %v", err)
+			}
+			if gotMetadata == nil {
+				t.Fatalf("media %s not found", mediaID)
+			}
+			if gotMetadata.Quarantined != want {
+				t.Fatalf("expected %s to have quarantined=%v", mediaID, want)
+			}
+		}
+
+		if err := db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+			MediaID: "original", Origin: "localhost", Base64Hash: "aGFzaA==", UserID: "@alice:localhost",
+		}); err != nil {
+			t.Fatalf("unable to store media metadata: %v", err)
+		}
+		if _, err := db.SetMediaQuarantined(ctx, "original", "localhost", true); err != nil {
+			t.Fatalf("unable to quarantine media: %v", err)
+		}
+
+		t.Run("the same file is quarantined under a new media ID", func(t *testing.T) {
+			if err := db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+				MediaID: "reupload", Origin: "localhost", Base64Hash: "aGFzaA==", UserID: "@bob:localhost",
+			}); err != nil {
+				t.Fatalf("unable to store media metadata: %v", err)
+			}
+			assertQuarantined(t, "reupload", "localhost", true)
+		})
+
+		t.Run("remote media is quarantined before it is cached", func(t *testing.T) {
+			affected, err := db.SetMediaQuarantined(ctx, "uncached", "remote", true)
+			if err != nil || affected != 0 {
+				t.Fatalf("expected no stored media to be quarantined, got %d (%v)", affected, err)
+			}
+			quarantined, err := db.IsMediaQuarantined(ctx, "uncached", "remote")
+			if err != nil || !quarantined {
+				t.Fatalf("expected uncached media to be quarantined, got %v (%v)", quarantined, err)
+			}
+			if err = db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+				MediaID: "uncached", Origin: "remote", Base64Hash: "cmVtb3Rl", UserID: "@charlie:remote",
+			}); err != nil {
+				t.Fatalf("unable to store media metadata: %v", err)
+			}
+			assertQuarantined(t, "uncached", "remote", true)
+		})
+
+		t.Run("remote media stays quarantined after it is purged", func(t *testing.T) {
+			if _, err := db.DeleteMedia(ctx, "uncached", "remote"); err != nil {
+				t.Fatalf("unable to delete media: %v", err)
+			}
+			if err := db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+				MediaID: "uncached", Origin: "remote", Base64Hash: "cmVtb3Rl", UserID: "@charlie:remote",
+			}); err != nil {
+				t.Fatalf("unable to store media metadata: %v", err)
+			}
+			assertQuarantined(t, "uncached", "remote", true)
+		})
+
+		t.Run("unquarantining removes the quarantine from the same file", func(t *testing.T) {
+			affected, err := db.SetMediaQuarantined(ctx, "reupload", "localhost", false)
+			if err != nil || affected != 2 {
+				t.Fatalf("expected 2 media to be unquarantined, got %d (%v)", affected, err)
+			}
+			assertQuarantined(t, "original", "localhost", false)
+			assertQuarantined(t, "reupload", "localhost", false)
+			if _, err = db.SetMediaQuarantined(ctx, "uncached", "remote", false); err != nil {
+				t.Fatalf("unable to unquarantine media: %v", err)
+			}
+			quarantined, err := db.IsMediaQuarantined(ctx, "uncached", "remote")
+			if err != nil || quarantined {
+				t.Fatalf("expected media to no longer be quarantined, got %v (%v)", quarantined, err)
+			}
+			assertQuarantined(t, "uncached", "remote", false)
+		})
+	})
+}
+
+func TestURLPreviewsStorage(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		now := time.Now()
+		og := types.OpenGraph{"og:title": "Example", "og:url": "https://example.com"}
+		if err := db.StoreURLPreview(ctx, "https://example.com", og, spec.AsTimestamp(now.Add(time.Minute))); err != nil {
+			t.Fatalf("unable to store URL preview: %v", err)
+		}
+		gotOG, err := db.GetURLPreview(ctx, "https://example.com", spec.AsTimestamp(now))
+		if err != nil {
+			t.Fatalf("unable to query URL preview: %v", err)
+		}
+		if !reflect.DeepEqual(og, gotOG) {
+			t.Fatalf("expected preview %+v, got %+v", og, gotOG)
+		}
+		// The preview should not be returned once it has expired.
+		gotOG, err = db.GetURLPreview(ctx, "https://example.com", spec.AsTimestamp(now.Add(time.Hour)))
+		if err != nil {
+			t.Fatalf("unable to query URL preview: %v", err)
+		}
+		if gotOG != nil {
+			t.Fatalf("expected expired preview not to be returned, got %+v", gotOG)
+		}
+		if err = db.DeleteExpiredURLPreviews(ctx, spec.AsTimestamp(now.Add(time.Hour))); err != nil {
+			t.Fatalf("unable to delete expired URL previews: %v", err)
+		}
+	})
+}
+
+func TestUserMediaQuotas(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		userID := types.MatrixUserID("@alice:localhost")
+		for i, size := range []types.FileSizeBytes{10, 32} {
+			if err := db.StoreMediaMetadata(ctx, &types.MediaMetadata{
+				MediaID:       types.MediaID(fmt.Sprintf("media%d", i)),
+				Origin:        "localhost",
+				FileSizeBytes: size,
+				Base64Hash:    "aGFzaA==",
+				UserID:        userID,
+			}); err != nil {
+				t.Fatalf("unable to store media metadata: %v", err)
+			}
+		}
+		used, err := db.GetUserMediaUsage(ctx, userID)
+		if err != nil {
+			t.Fatalf("unable to query media usage: %v", err)
+		}
+		if used != 42 {
+			t.Fatalf("expected 42 bytes used, got %d", used)
+		}
+
+		quota, err := db.GetUserMediaQuota(ctx, userID)
+		if err != nil {
+			t.Fatalf("unable to query media quota: %v", err)
+		}
+		if quota != nil {
+			t.Fatalf("expected no quota override, got %d", *quota)
+		}
+		if err = db.SetUserMediaQuota(ctx, userID, 100); err != nil {
+			t.Fatalf("unable to set media quota: %v", err)
+		}
+		if quota, err = db.GetUserMediaQuota(ctx, userID); err != nil || quota == nil || *quota != 100 {
+			t.Fatalf("expected quota override of 100, got %v (%v)", quota, err)
+		}
+		if err = db.DeleteUserMediaQuota(ctx, userID); err != nil {
+			t.Fatalf("unable to delete media quota: %v", err)
+		}
+		if quota, err = db.GetUserMediaQuota(ctx, userID); err != nil || quota != nil {
+			t.Fatalf("expected no quota override after deleting, got %v (%v)", quota, err)
+		}
+	})
+}
+
+func TestPendingMedia(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateDatabase(t, dbType)
+		defer close()
+		ctx := context.Background()
+		now := time.Now()
+		userID := types.MatrixUserID("@alice:localhost")
+		pending := &types.PendingMedia{
+			MediaID:           "pending",
+			Origin:            "localhost",
+			UserID:            userID,
+			CreationTimestamp: spec.AsTimestamp(now),
+			ExpiresTimestamp:  spec.AsTimestamp(now.Add(time.Minute)),
+		}
+		if err := db.StorePendingMedia(ctx, pending); err != nil {
+			t.Fatalf("unable to store pending media: %v", err)
+		}
+		gotPending, err := db.GetPendingMedia(ctx, pending.MediaID, pending.Origin, spec.AsTimestamp(now))
+		if err != nil {
+			t.Fatalf("unable to query pending media: %v", err)
+		}
+		if !reflect.DeepEqual(pending, gotPending) {
+			t.Fatalf("expected pending media %+v, got %+v", pending, gotPending)
+		}
+		if count, err := db.GetPendingMediaCount(ctx, userID, spec.AsTimestamp(now)); err != nil || count != 1 {
+			t.Fatalf("expected 1 pending media, got %d (%v)", count, err)
+		}
+		// The pending media should not be returned once it has expired.
+		if gotPending, err = db.GetPendingMedia(ctx, pending.MediaID, pending.Origin, spec.AsTimestamp(now.Add(time.Hour))); err != nil || gotPending != nil {
+			t.Fatalf("expected expired pending media not to be returned, got %+v (%v)", gotPending, err)
+		}
+
+		// Completing the upload stores the media and removes the pending media.
+		if err = db.CompletePendingMedia(ctx, &types.MediaMetadata{
+			MediaID:       pending.MediaID,
+			Origin:        pending.Origin,
+			FileSizeBytes: 10,
+			Base64Hash:    "aGFzaA==",
+			UserID:        userID,
+		}); err != nil {
+			t.Fatalf("unable to complete pending media: %v", err)
+		}
+		if gotPending, err = db.GetPendingMedia(ctx, pending.MediaID, pending.Origin, spec.AsTimestamp(now)); err != nil || gotPending != nil {
+			t.Fatalf("expected completed pending media not to be returned, got %+v (%v)", gotPending, err)
+		}
+		if metadata, err := db.GetMediaMetadata(ctx, pending.MediaID, pending.Origin); err != nil || metadata == nil {
+			t.Fatalf("expected completed media to be stored, got %+v (%v)", metadata, err)
+		}
+		if err = db.DeleteExpiredPendingMedia(ctx, spec.AsTimestamp(now.Add(time.Hour))); err != nil {
+			t.Fatalf("unable to delete expired pending media: %v", err)
+		}
+	})
+}
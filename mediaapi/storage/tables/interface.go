@@ -34,6 +34,7 @@ type Thumbnails interface {
 		ctx context.Context, txn *sql.Tx, mediaID types.MediaID,
 		mediaOrigin spec.ServerName,
 	) ([]*types.ThumbnailMetadata, error)
+	DeleteThumbnails(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) error
 }
 
 type MediaRepository interface {
@@ -43,4 +44,49 @@ type MediaRepository interface {
 		ctx context.Context, txn *sql.Tx,
 		mediaHash types.Base64Hash, mediaOrigin spec.ServerName,
 	) (*types.MediaMetadata, error)
+	// UpdateMediaQuarantinedByHash quarantines all media, from any origin, stored with the given hash.
+	UpdateMediaQuarantinedByHash(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash, quarantined bool) (int64, error)
+	// UpdateMediaQuarantinedByUser quarantines all media stored with the same hash as any media uploaded by the user.
+	UpdateMediaQuarantinedByUser(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, quarantined bool) (int64, error)
+	// SelectHashQuarantined returns whether any media stored with the given hash has been quarantined.
+	SelectHashQuarantined(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) (bool, error)
+	DeleteMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) error
+	// SelectHashInUse returns whether any media, from any origin, is still stored with the given hash.
+	SelectHashInUse(ctx context.Context, txn *sql.Tx, mediaHash types.Base64Hash) (bool, error)
+	// SelectMediaBefore returns up to limit media created before the given time. If local is true,
+	// only media from the given origins is returned, otherwise only media from any other origin.
+	SelectMediaBefore(
+		ctx context.Context, txn *sql.Tx, before spec.Timestamp,
+		localOrigins []spec.ServerName, local bool, limit int,
+	) ([]*types.MediaMetadata, error)
+	// SelectUserMediaSize returns the total size of all media uploaded by the user.
+	SelectUserMediaSize(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID) (types.FileSizeBytes, error)
+}
+
+type QuarantinedMedia interface {
+	InsertQuarantinedMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) error
+	SelectQuarantinedMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) (bool, error)
+	DeleteQuarantinedMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) error
+}
+
+type URLPreviews interface {
+	UpsertURLPreview(ctx context.Context, txn *sql.Tx, url string, og types.OpenGraph, expires spec.Timestamp) error
+	SelectURLPreview(ctx context.Context, txn *sql.Tx, url string, now spec.Timestamp) (types.OpenGraph, error)
+	DeleteExpiredURLPreviews(ctx context.Context, txn *sql.Tx, now spec.Timestamp) error
+}
+
+type UserQuotas interface {
+	UpsertUserQuota(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, quota types.FileSizeBytes) error
+	SelectUserQuota(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID) (types.FileSizeBytes, error)
+	DeleteUserQuota(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID) error
+}
+
+type PendingMedia interface {
+	InsertPendingMedia(ctx context.Context, txn *sql.Tx, pending *types.PendingMedia) error
+	// SelectPendingMedia returns the pending media if it has not expired by the given time.
+	SelectPendingMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName, now spec.Timestamp) (*types.PendingMedia, error)
+	// SelectPendingMediaCount returns the number of pending media created by the user which have not expired by the given time.
+	SelectPendingMediaCount(ctx context.Context, txn *sql.Tx, userID types.MatrixUserID, now spec.Timestamp) (int, error)
+	DeletePendingMedia(ctx context.Context, txn *sql.Tx, mediaID types.MediaID, mediaOrigin spec.ServerName) error
+	DeleteExpiredPendingMedia(ctx context.Context, txn *sql.Tx, now spec.Timestamp) error
 }
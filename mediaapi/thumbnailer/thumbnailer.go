@@ -16,18 +16,21 @@ package thumbnailer
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"math"
-	"os"
-	"path/filepath"
 	"sync"
 
+	"github.com/neilalexander/harmony/mediaapi/mediastore"
 	"github.com/neilalexander/harmony/mediaapi/storage"
 	"github.com/neilalexander/harmony/mediaapi/types"
 	"github.com/neilalexander/harmony/setup/config"
 	log "github.com/sirupsen/logrus"
 )
 
+// ErrQuarantined is returned when asked to generate thumbnails for media that
+// has been quarantined by an administrator.
+var ErrQuarantined = errors.New("media is quarantined")
+
 type thumbnailFitness struct {
 	isSmaller      int
 	aspect         float64
@@ -36,16 +39,10 @@ type thumbnailFitness struct {
 	fileSize       types.FileSizeBytes
 }
 
-// thumbnailTemplate is the filename template for thumbnails
-const thumbnailTemplate = "thumbnail-%vx%v-%v"
-
-// GetThumbnailPath returns the path to a thumbnail given the absolute src path and thumbnail size configuration
-func GetThumbnailPath(src types.Path, config types.ThumbnailSize) types.Path {
-	srcDir := filepath.Dir(string(src))
-	return types.Path(filepath.Join(
-		srcDir,
-		fmt.Sprintf(thumbnailTemplate, config.Width, config.Height, config.ResizeMethod),
-	))
+// thumbnailKey returns the key used to track active generation of a thumbnail
+// given the hash of the source file and thumbnail size configuration
+func thumbnailKey(hash types.Base64Hash, config types.ThumbnailSize) string {
+	return string(hash) + "/" + mediastore.ThumbnailName(config)
 }
 
 // SelectThumbnail compares the (potentially) available thumbnails with the desired thumbnail and returns the best match
@@ -89,11 +86,11 @@ func SelectThumbnail(desired types.ThumbnailSize, thumbnails []*types.ThumbnailM
 }
 
 // getActiveThumbnailGeneration checks for active thumbnail generation
-func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeThumbnailGeneration *types.ActiveThumbnailGeneration, maxThumbnailGenerators int, logger *log.Entry) (isActive bool, busy bool, errorReturn error) {
+func getActiveThumbnailGeneration(dst string, _ types.ThumbnailSize, activeThumbnailGeneration *types.ActiveThumbnailGeneration, maxThumbnailGenerators int, logger *log.Entry) (isActive bool, busy bool, errorReturn error) {
 	// Check if there is active thumbnail generation.
 	activeThumbnailGeneration.Lock()
 	defer activeThumbnailGeneration.Unlock()
-	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[string(dst)]; ok {
+	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[dst]; ok {
 		logger.Info("Waiting for another goroutine to generate the thumbnail.")
 
 		// NOTE: Wait unlocks and locks again internally. There is still a deferred Unlock() that will unlock this.
@@ -110,7 +107,7 @@ func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeT
 	}
 
 	// No active thumbnail generation so create one
-	activeThumbnailGeneration.PathToResult[string(dst)] = &types.ThumbnailGenerationResult{
+	activeThumbnailGeneration.PathToResult[dst] = &types.ThumbnailGenerationResult{
 		Cond: &sync.Cond{L: activeThumbnailGeneration},
 	}
 
@@ -119,21 +116,21 @@ func getActiveThumbnailGeneration(dst types.Path, _ types.ThumbnailSize, activeT
 
 // broadcastGeneration broadcasts that thumbnail generation completed and the error to all waiting goroutines
 // Note: This should only be called by the owner of the activeThumbnailGenerationResult
-func broadcastGeneration(dst types.Path, activeThumbnailGeneration *types.ActiveThumbnailGeneration, _ types.ThumbnailSize, errorReturn error, logger *log.Entry) {
+func broadcastGeneration(dst string, activeThumbnailGeneration *types.ActiveThumbnailGeneration, _ types.ThumbnailSize, errorReturn error, logger *log.Entry) {
 	activeThumbnailGeneration.Lock()
 	defer activeThumbnailGeneration.Unlock()
-	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[string(dst)]; ok {
+	if activeThumbnailGenerationResult, ok := activeThumbnailGeneration.PathToResult[dst]; ok {
 		logger.Info("Signalling other goroutines waiting for this goroutine to generate the thumbnail.")
 		// Note: errorReturn is a named return value error that is signalled from here to waiting goroutines
 		activeThumbnailGenerationResult.Err = errorReturn
 		activeThumbnailGenerationResult.Cond.Broadcast()
 	}
-	delete(activeThumbnailGeneration.PathToResult, string(dst))
+	delete(activeThumbnailGeneration.PathToResult, dst)
 }
 
 func isThumbnailExists(
 	ctx context.Context,
-	dst types.Path,
+	store mediastore.MediaStore,
 	config types.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	db storage.Database,
@@ -150,13 +147,17 @@ func isThumbnailExists(
 	if thumbnailMetadata != nil {
 		return true, nil
 	}
-	// Note: The double-negative is intentional as os.IsExist(err) != !os.IsNotExist(err).
-	// The functions are error checkers to be used in different cases.
-	if _, err = os.Stat(string(dst)); !os.IsNotExist(err) {
+	_, err = store.StatThumbnail(ctx, mediaMetadata.Base64Hash, config)
+	switch {
+	case err == nil:
 		// Thumbnail exists
 		return true, nil
+	case errors.Is(err, mediastore.ErrNotFound):
+		return false, nil
+	default:
+		logger.WithError(err).Error("Failed to check media store for thumbnail.")
+		return false, err
 	}
-	return false, nil
 }
 
 // init with worst values
@@ -18,10 +18,12 @@
 package thumbnailer
 
 import (
+	"bytes"
 	"context"
-	"os"
+	"io"
 	"time"
 
+	"github.com/neilalexander/harmony/mediaapi/mediastore"
 	"github.com/neilalexander/harmony/mediaapi/storage"
 	"github.com/neilalexander/harmony/mediaapi/types"
 	"github.com/neilalexander/harmony/setup/config"
@@ -32,7 +34,7 @@ import (
 // GenerateThumbnails generates the configured thumbnail sizes for the source file
 func GenerateThumbnails(
 	ctx context.Context,
-	src types.Path,
+	store mediastore.MediaStore,
 	configs []config.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -40,20 +42,23 @@ func GenerateThumbnails(
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	buffer, err := bimg.Read(string(src))
+	if mediaMetadata.Quarantined {
+		return false, ErrQuarantined
+	}
+	buffer, err := readFile(ctx, store, mediaMetadata.Base64Hash)
 	if err != nil {
-		logger.WithError(err).WithField("src", src).Error("Failed to read src file")
+		logger.WithError(err).WithField("src", mediaMetadata.Base64Hash).Error("Failed to read src file")
 		return false, err
 	}
 	img := bimg.NewImage(buffer)
 	for _, config := range configs {
 		// Note: createThumbnail does locking based on activeThumbnailGeneration
 		busy, err = createThumbnail(
-			ctx, src, img, types.ThumbnailSize(config), mediaMetadata, activeThumbnailGeneration,
+			ctx, store, img, types.ThumbnailSize(config), mediaMetadata, activeThumbnailGeneration,
 			maxThumbnailGenerators, db, logger,
 		)
 		if err != nil {
-			logger.WithError(err).WithField("src", src).Error("Failed to generate thumbnails")
+			logger.WithError(err).WithField("src", mediaMetadata.Base64Hash).Error("Failed to generate thumbnails")
 			return false, err
 		}
 		if busy {
@@ -66,7 +71,7 @@ func GenerateThumbnails(
 // GenerateThumbnail generates the configured thumbnail size for the source file
 func GenerateThumbnail(
 	ctx context.Context,
-	src types.Path,
+	store mediastore.MediaStore,
 	config types.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -74,22 +79,25 @@ func GenerateThumbnail(
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	buffer, err := bimg.Read(string(src))
+	if mediaMetadata.Quarantined {
+		return false, ErrQuarantined
+	}
+	buffer, err := readFile(ctx, store, mediaMetadata.Base64Hash)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
-			"src": src,
+			"src": mediaMetadata.Base64Hash,
 		}).Error("Failed to read src file")
 		return false, err
 	}
 	img := bimg.NewImage(buffer)
 	// Note: createThumbnail does locking based on activeThumbnailGeneration
 	busy, err = createThumbnail(
-		ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
+		ctx, store, img, config, mediaMetadata, activeThumbnailGeneration,
 		maxThumbnailGenerators, db, logger,
 	)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
-			"src": src,
+			"src": mediaMetadata.Base64Hash,
 		}).Error("Failed to generate thumbnails")
 		return false, err
 	}
@@ -99,11 +107,21 @@ func GenerateThumbnail(
 	return false, nil
 }
 
+func readFile(ctx context.Context, store mediastore.MediaStore, hash types.Base64Hash) ([]byte, error) {
+	file, _, err := store.OpenFile(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close() // nolint: errcheck
+
+	return io.ReadAll(file)
+}
+
 // createThumbnail checks if the thumbnail exists, and if not, generates it
 // Thumbnail generation is only done once for each non-existing thumbnail.
 func createThumbnail(
 	ctx context.Context,
-	src types.Path,
+	store mediastore.MediaStore,
 	img *bimg.Image,
 	config types.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
@@ -123,7 +141,7 @@ func createThumbnail(
 		return false, nil
 	}
 
-	dst := GetThumbnailPath(src, config)
+	dst := thumbnailKey(mediaMetadata.Base64Hash, config)
 
 	// Note: getActiveThumbnailGeneration uses mutexes and conditions from activeThumbnailGeneration
 	isActive, busy, err := getActiveThumbnailGeneration(dst, config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
@@ -147,13 +165,14 @@ func createThumbnail(
 		}()
 	}
 
-	exists, err := isThumbnailExists(ctx, dst, config, mediaMetadata, db, logger)
+	exists, err := isThumbnailExists(ctx, store, config, mediaMetadata, db, logger)
 	if err != nil || exists {
 		return false, err
 	}
 
 	start := time.Now()
-	width, height, err := resize(dst, img, config.Width, config.Height, config.ResizeMethod == "crop", logger)
+	var thumbnail bytes.Buffer
+	width, height, err := resize(&thumbnail, img, config.Width, config.Height, config.ResizeMethod == "crop", logger)
 	if err != nil {
 		return false, err
 	}
@@ -163,8 +182,9 @@ func createThumbnail(
 		"processTime":  time.Now().Sub(start),
 	}).Info("Generated thumbnail")
 
-	stat, err := os.Stat(string(dst))
-	if err != nil {
+	fileSize := types.FileSizeBytes(thumbnail.Len())
+	if err = store.StoreThumbnail(ctx, mediaMetadata.Base64Hash, config, &thumbnail, int64(fileSize)); err != nil {
+		logger.WithError(err).Error("Failed to store thumbnail in media store.")
 		return false, err
 	}
 
@@ -174,7 +194,7 @@ func createThumbnail(
 			Origin:  mediaMetadata.Origin,
 			// Note: the code currently always creates a JPEG thumbnail
 			ContentType:   types.ContentType("image/jpeg"),
-			FileSizeBytes: types.FileSizeBytes(stat.Size()),
+			FileSizeBytes: fileSize,
 		},
 		ThumbnailSize: types.ThumbnailSize{
 			Width:        config.Width,
@@ -206,7 +226,7 @@ func isLargerThanOriginal(config types.ThumbnailSize, img *bimg.Image) bool {
 // resize scales an image to fit within the provided width and height
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
-func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+func resize(dst *bytes.Buffer, inImage *bimg.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
 	inSize, err := inImage.Size()
 	if err != nil {
 		return -1, -1, err
@@ -240,7 +260,7 @@ func resize(dst types.Path, inImage *bimg.Image, w, h int, crop bool, logger *lo
 		return -1, -1, err
 	}
 
-	if err = bimg.Write(string(dst), newImage); err != nil {
+	if _, err = dst.Write(newImage); err != nil {
 		logger.WithError(err).Error("Failed to resize image")
 		return -1, -1, err
 	}
@@ -18,6 +18,7 @@
 package thumbnailer
 
 import (
+	"bytes"
 	"context"
 	"image"
 	"image/draw"
@@ -32,9 +33,10 @@ import (
 	// Imported for webp codec
 	_ "golang.org/x/image/webp"
 
-	"os"
+	"io"
 	"time"
 
+	"github.com/neilalexander/harmony/mediaapi/mediastore"
 	"github.com/neilalexander/harmony/mediaapi/storage"
 	"github.com/neilalexander/harmony/mediaapi/types"
 	"github.com/neilalexander/harmony/setup/config"
@@ -45,7 +47,7 @@ import (
 // GenerateThumbnails generates the configured thumbnail sizes for the source file
 func GenerateThumbnails(
 	ctx context.Context,
-	src types.Path,
+	store mediastore.MediaStore,
 	configs []config.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -53,19 +55,22 @@ func GenerateThumbnails(
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	img, err := readFile(string(src))
+	if mediaMetadata.Quarantined {
+		return false, ErrQuarantined
+	}
+	img, err := readFile(ctx, store, mediaMetadata.Base64Hash)
 	if err != nil {
-		logger.WithError(err).WithField("src", src).Error("Failed to read src file")
+		logger.WithError(err).WithField("src", mediaMetadata.Base64Hash).Error("Failed to read src file")
 		return false, err
 	}
 	for _, singleConfig := range configs {
 		// Note: createThumbnail does locking based on activeThumbnailGeneration
 		busy, err = createThumbnail(
-			ctx, src, img, types.ThumbnailSize(singleConfig), mediaMetadata,
+			ctx, store, img, types.ThumbnailSize(singleConfig), mediaMetadata,
 			activeThumbnailGeneration, maxThumbnailGenerators, db, logger,
 		)
 		if err != nil {
-			logger.WithError(err).WithField("src", src).Error("Failed to generate thumbnails")
+			logger.WithError(err).WithField("src", mediaMetadata.Base64Hash).Error("Failed to generate thumbnails")
 			return false, err
 		}
 		if busy {
@@ -78,7 +83,7 @@ func GenerateThumbnails(
 // GenerateThumbnail generates the configured thumbnail size for the source file
 func GenerateThumbnail(
 	ctx context.Context,
-	src types.Path,
+	store mediastore.MediaStore,
 	config types.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
 	activeThumbnailGeneration *types.ActiveThumbnailGeneration,
@@ -86,21 +91,24 @@ func GenerateThumbnail(
 	db storage.Database,
 	logger *log.Entry,
 ) (busy bool, errorReturn error) {
-	img, err := readFile(string(src))
+	if mediaMetadata.Quarantined {
+		return false, ErrQuarantined
+	}
+	img, err := readFile(ctx, store, mediaMetadata.Base64Hash)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
-			"src": src,
+			"src": mediaMetadata.Base64Hash,
 		}).Error("Failed to read src file")
 		return false, err
 	}
 	// Note: createThumbnail does locking based on activeThumbnailGeneration
 	busy, err = createThumbnail(
-		ctx, src, img, config, mediaMetadata, activeThumbnailGeneration,
+		ctx, store, img, config, mediaMetadata, activeThumbnailGeneration,
 		maxThumbnailGenerators, db, logger,
 	)
 	if err != nil {
 		logger.WithError(err).WithFields(log.Fields{
-			"src": src,
+			"src": mediaMetadata.Base64Hash,
 		}).Error("Failed to generate thumbnails")
 		return false, err
 	}
@@ -110,8 +118,8 @@ func GenerateThumbnail(
 	return false, nil
 }
 
-func readFile(src string) (image.Image, error) {
-	file, err := os.Open(src)
+func readFile(ctx context.Context, store mediastore.MediaStore, hash types.Base64Hash) (image.Image, error) {
+	file, _, err := store.OpenFile(ctx, hash)
 	if err != nil {
 		return nil, err
 	}
@@ -125,14 +133,8 @@ func readFile(src string) (image.Image, error) {
 	return img, nil
 }
 
-func writeFile(img image.Image, dst string) (err error) {
-	out, err := os.Create(dst)
-	if err != nil {
-		return err
-	}
-	defer (func() { err = out.Close() })()
-
-	return jpeg.Encode(out, img, &jpeg.Options{
+func writeFile(img image.Image, dst io.Writer) error {
+	return jpeg.Encode(dst, img, &jpeg.Options{
 		Quality: 85,
 	})
 }
@@ -141,7 +143,7 @@ func writeFile(img image.Image, dst string) (err error) {
 // Thumbnail generation is only done once for each non-existing thumbnail.
 func createThumbnail(
 	ctx context.Context,
-	src types.Path,
+	store mediastore.MediaStore,
 	img image.Image,
 	config types.ThumbnailSize,
 	mediaMetadata *types.MediaMetadata,
@@ -161,7 +163,7 @@ func createThumbnail(
 		return false, nil
 	}
 
-	dst := GetThumbnailPath(src, config)
+	dst := thumbnailKey(mediaMetadata.Base64Hash, config)
 
 	// Note: getActiveThumbnailGeneration uses mutexes and conditions from activeThumbnailGeneration
 	isActive, busy, err := getActiveThumbnailGeneration(dst, config, activeThumbnailGeneration, maxThumbnailGenerators, logger)
@@ -185,13 +187,14 @@ func createThumbnail(
 		}()
 	}
 
-	exists, err := isThumbnailExists(ctx, dst, config, mediaMetadata, db, logger)
+	exists, err := isThumbnailExists(ctx, store, config, mediaMetadata, db, logger)
 	if err != nil || exists {
 		return false, err
 	}
 
 	start := time.Now()
-	width, height, err := adjustSize(dst, img, config.Width, config.Height, config.ResizeMethod == types.Crop, logger)
+	var thumbnail bytes.Buffer
+	width, height, err := adjustSize(&thumbnail, img, config.Width, config.Height, config.ResizeMethod == types.Crop, logger)
 	if err != nil {
 		return false, err
 	}
@@ -201,8 +204,9 @@ func createThumbnail(
 		"processTime":  time.Since(start),
 	}).Info("Generated thumbnail")
 
-	stat, err := os.Stat(string(dst))
-	if err != nil {
+	fileSize := types.FileSizeBytes(thumbnail.Len())
+	if err = store.StoreThumbnail(ctx, mediaMetadata.Base64Hash, config, &thumbnail, int64(fileSize)); err != nil {
+		logger.WithError(err).Error("Failed to store thumbnail in media store.")
 		return false, err
 	}
 
@@ -212,7 +216,7 @@ func createThumbnail(
 			Origin:  mediaMetadata.Origin,
 			// Note: the code currently always creates a JPEG thumbnail
 			ContentType:   types.ContentType("image/jpeg"),
-			FileSizeBytes: types.FileSizeBytes(stat.Size()),
+			FileSizeBytes: fileSize,
 		},
 		ThumbnailSize: types.ThumbnailSize{
 			Width:        config.Width,
@@ -236,7 +240,7 @@ func createThumbnail(
 // adjustSize scales an image to fit within the provided width and height
 // If the source aspect ratio is different to the target dimensions, one edge will be smaller than requested
 // If crop is set to true, the image will be scaled to fill the width and height with any excess being cropped off
-func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
+func adjustSize(dst io.Writer, img image.Image, w, h int, crop bool, logger *log.Entry) (int, int, error) {
 	var out image.Image
 	var err error
 	if crop {
@@ -267,7 +271,7 @@ func adjustSize(dst types.Path, img image.Image, w, h int, crop bool, logger *lo
 		out = resize.Thumbnail(uint(w), uint(h), img, resize.Lanczos3)
 	}
 
-	if err = writeFile(out, string(dst)); err != nil {
+	if err = writeFile(out, dst); err != nil {
 		logger.WithError(err).Error("Failed to encode and write image")
 		return -1, -1, err
 	}
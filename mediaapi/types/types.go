@@ -55,6 +55,19 @@ type MediaMetadata struct {
 	UploadName        Filename
 	Base64Hash        Base64Hash
 	UserID            MatrixUserID
+	// Quarantined media is not served to clients or other servers.
+	Quarantined bool
+}
+
+// PendingMedia is an MXC URI which has been created by a local user with
+// /create, but which has no content uploaded to it yet.
+type PendingMedia struct {
+	MediaID           MediaID
+	Origin            spec.ServerName
+	UserID            MatrixUserID
+	CreationTimestamp spec.Timestamp
+	// The time after which the MXC URI can no longer be uploaded to.
+	ExpiresTimestamp spec.Timestamp
 }
 
 // RemoteRequestResult is used for broadcasting the result of a request for a remote file to routines waiting on the condition
@@ -100,6 +113,11 @@ type ActiveThumbnailGeneration struct {
 	PathToResult map[string]*ThumbnailGenerationResult
 }
 
+// OpenGraph is the OpenGraph metadata of a URL, as returned by /preview_url,
+// e.g. "og:title" and "og:image". Values are usually strings, except for
+// "matrix:image:size" and image dimensions, which are numbers.
+type OpenGraph map[string]interface{}
+
 // Crop indicates we should crop the thumbnail on resize
 const Crop = "crop"
 
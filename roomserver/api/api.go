@@ -68,6 +68,7 @@ type RoomserverInternalAPI interface {
 	QuerySenderIDAPI
 	UserRoomPrivateKeyCreator
 	DefaultRoomVersionAPI
+	MediaRoomserverAPI
 
 	// needed to avoid chicken and egg scenario when setting up the
 	// interdependencies between the roomserver and other input APIs
@@ -239,9 +240,40 @@ type ClientRoomserverAPI interface {
 	PerformAdminEvacuateUser(ctx context.Context, userID string) (affected []string, err error)
 	PerformAdminPurgeRoom(ctx context.Context, roomID string) error
 	PerformAdminDownloadState(ctx context.Context, roomID, userID string, serverName spec.ServerName) error
+	// PerformReport stores a report of a room or an event. Returns ErrRoomUnknownOrNotAllowed
+	// if the room or event doesn't exist, or if the user isn't joined to the room of the event.
+	PerformReport(ctx context.Context, req *PerformReportRequest) (*Report, error)
+	// QueryAdminReports returns a page of reports and the total number of reports matching the filters.
+	QueryAdminReports(ctx context.Context, req *QueryAdminReportsRequest) (reports []Report, total int64, err error)
+	// QueryAdminReport returns the report with the given ID, or nil if there isn't one.
+	QueryAdminReport(ctx context.Context, reportID int64) (*Report, error)
+	// PerformAdminResolveReport marks the report as resolved, returning the report or nil if there isn't one.
+	PerformAdminResolveReport(ctx context.Context, reportID int64, resolvedBy string) (*Report, error)
+	// QueryAdminRooms returns a page of rooms and the total number of rooms that the server is joined to.
+	QueryAdminRooms(ctx context.Context, req *QueryAdminRoomsRequest) (rooms []AdminRoom, total int64, err error)
+	// QueryAdminRoom returns a summary of the room, or nil if the room is unknown.
+	QueryAdminRoom(ctx context.Context, roomID string) (*AdminRoom, error)
+	// QueryAdminRoomState returns the current state of the room.
+	QueryAdminRoomState(ctx context.Context, roomID string) ([]*types.HeaderedEvent, error)
+	// QueryAdminRoomMembers returns the user IDs of the local users joined to the room.
+	QueryAdminRoomMembers(ctx context.Context, roomID string) ([]string, error)
+	// QueryAdminForwardExtremities returns the forward extremities of the room.
+	QueryAdminForwardExtremities(ctx context.Context, roomID string) ([]ForwardExtremity, error)
+	// PerformAdminResetForwardExtremities removes all but the most recent forward extremity
+	// of the room, returning the number of extremities that were removed.
+	PerformAdminResetForwardExtremities(ctx context.Context, roomID string) (removed int, err error)
+	// PerformAdminBlockRoom adds the room to the block list, or removes it if blocked is false.
+	PerformAdminBlockRoom(ctx context.Context, roomID, blockedBy string, blocked bool) error
+	// QueryAdminBlockedRoom returns the block of the room, or nil if the room isn't blocked.
+	QueryAdminBlockedRoom(ctx context.Context, roomID string) (*BlockedRoom, error)
+	// QueryAdminBlockedRooms returns all blocked rooms.
+	QueryAdminBlockedRooms(ctx context.Context) ([]BlockedRoom, error)
+	// PerformAdminRemoveRoomAliases removes all local aliases of the room, returning the removed aliases.
+	PerformAdminRemoveRoomAliases(ctx context.Context, roomID string) ([]string, error)
 	PerformInvite(ctx context.Context, req *PerformInviteRequest) error
 	PerformJoin(ctx context.Context, req *PerformJoinRequest) (roomID string, joinedVia spec.ServerName, err error)
 	PerformLeave(ctx context.Context, req *PerformLeaveRequest, res *PerformLeaveResponse) error
+	PerformKnock(ctx context.Context, req *PerformKnockRequest) (roomID string, err error)
 	PerformPublish(ctx context.Context, req *PerformPublishRequest) error
 	// PerformForget forgets a rooms history for a specific user
 	PerformForget(ctx context.Context, req *PerformForgetRequest, resp *PerformForgetResponse) error
@@ -267,6 +299,7 @@ type UserRoomserverAPI interface {
 	KeyserverRoomserverAPI
 	QueryCurrentState(ctx context.Context, req *QueryCurrentStateRequest, res *QueryCurrentStateResponse) error
 	QueryMembershipsForRoom(ctx context.Context, req *QueryMembershipsForRoomRequest, res *QueryMembershipsForRoomResponse) error
+	QueryEventsByID(ctx context.Context, req *QueryEventsByIDRequest, res *QueryEventsByIDResponse) error
 	PerformAdminEvacuateUser(ctx context.Context, userID string) (affected []string, err error)
 	PerformJoin(ctx context.Context, req *PerformJoinRequest) (roomID string, joinedVia spec.ServerName, err error)
 	JoinedUserCount(ctx context.Context, roomID string) (int, error)
@@ -285,6 +318,8 @@ type FederationRoomserverAPI interface {
 	SigningIdentityFor(ctx context.Context, roomID spec.RoomID, senderID spec.UserID) (fclient.SigningIdentity, error)
 	// QueryServerBannedFromRoom returns whether a server is banned from a room by server ACLs.
 	QueryServerBannedFromRoom(ctx context.Context, req *QueryServerBannedFromRoomRequest, res *QueryServerBannedFromRoomResponse) error
+	// QueryRoomBlocked returns whether the room has been blocked by an admin.
+	QueryRoomBlocked(ctx context.Context, roomID string) (bool, error)
 	GetRoomIDForAlias(ctx context.Context, req *GetRoomIDForAliasRequest, res *GetRoomIDForAliasResponse) error
 	// QueryEventsByID queries a list of events by event ID for one room. If no room is specified, it will try to determine
 	// which room to use by querying the first events roomID.
@@ -310,6 +345,12 @@ type FederationRoomserverAPI interface {
 	StateQuerier() gomatrixserverlib.StateQuerier
 }
 
+// MediaRoomserverAPI is used by the media API to find media referenced in rooms.
+type MediaRoomserverAPI interface {
+	// QueryMediaURIsForRoom returns all MXC URIs referenced by events in the room
+	QueryMediaURIsForRoom(ctx context.Context, roomID string) ([]string, error)
+}
+
 type KeyserverRoomserverAPI interface {
 	QueryLeftUsers(ctx context.Context, req *QueryLeftUsersRequest, res *QueryLeftUsersResponse) error
 }
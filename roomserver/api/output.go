@@ -32,6 +32,10 @@ const (
 	OutputTypeNewInviteEvent OutputType = "new_invite_event"
 	// OutputTypeRetireInviteEvent indicates that the event is an OutputRetireInviteEvent
 	OutputTypeRetireInviteEvent OutputType = "retire_invite_event"
+	// OutputTypeNewKnockEvent indicates that the event is an OutputNewKnockEvent
+	OutputTypeNewKnockEvent OutputType = "new_knock_event"
+	// OutputTypeRetireKnockEvent indicates that the event is an OutputRetireKnockEvent
+	OutputTypeRetireKnockEvent OutputType = "retire_knock_event"
 	// OutputTypeRedactedEvent indicates that the event is an OutputRedactedEvent
 	//
 	// This event is emitted when a redaction has been 'validated' (meaning both the redaction and the event to redact are known).
@@ -68,6 +72,10 @@ type OutputEvent struct {
 	NewInviteEvent *OutputNewInviteEvent `json:"new_invite_event,omitempty"`
 	// The content of event with type OutputTypeRetireInviteEvent
 	RetireInviteEvent *OutputRetireInviteEvent `json:"retire_invite_event,omitempty"`
+	// The content of event with type OutputTypeNewKnockEvent
+	NewKnockEvent *OutputNewKnockEvent `json:"new_knock_event,omitempty"`
+	// The content of event with type OutputTypeRetireKnockEvent
+	RetireKnockEvent *OutputRetireKnockEvent `json:"retire_knock_event,omitempty"`
 	// The content of event with type OutputTypeRedactedEvent
 	RedactedEvent *OutputRedactedEvent `json:"redacted_event,omitempty"`
 	// The content of the event with type OutputPurgeRoom
@@ -216,6 +224,33 @@ type OutputRetireInviteEvent struct {
 	Membership string
 }
 
+// An OutputNewKnockEvent is written whenever a knock becomes active. Like
+// invites, knocks can happen on rooms that the server is not joined to so
+// have to be tracked separately from the room events themselves.
+type OutputNewKnockEvent struct {
+	// The room version of the knocked room.
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	// The "m.room.member" knock event.
+	Event *types.HeaderedEvent `json:"event"`
+}
+
+// An OutputRetireKnockEvent is written whenever an existing knock is no longer
+// active. A knock stops being active if the user is invited, joins the room,
+// rescinds the knock or if the knock is denied.
+type OutputRetireKnockEvent struct {
+	// The room ID of the "m.room.member" knock event.
+	RoomID string
+	// The target sender ID of the "m.room.member" knock event that was retired.
+	TargetSenderID spec.SenderID
+	// Optional event ID of the event that replaced the knock.
+	// This can be empty if the knock was rescinded locally and we were unable
+	// to reach the server that the knock was sent to.
+	RetiredByEventID string
+	// The "membership" of the user after retiring the knock. One of "invite",
+	// "join", "leave" or "ban".
+	Membership string
+}
+
 // An OutputRedactedEvent is written whenever a redaction has been /validated/.
 // Downstream components MUST redact the given event ID if they have stored the
 // event JSON. It is guaranteed that this event ID has been seen before.
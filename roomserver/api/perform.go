@@ -39,6 +39,13 @@ type PerformJoinRequest struct {
 	Unsigned      map[string]interface{} `json:"unsigned"`
 }
 
+type PerformKnockRequest struct {
+	RoomIDOrAlias string            `json:"room_id_or_alias"`
+	UserID        string            `json:"user_id"`
+	Reason        string            `json:"reason"`
+	ServerNames   []spec.ServerName `json:"server_names"`
+}
+
 type PerformLeaveRequest struct {
 	RoomID string
 	Leaver spec.UserID
@@ -142,3 +149,38 @@ type PerformForgetRequest struct {
 }
 
 type PerformForgetResponse struct{}
+
+// PerformReportRequest is a request to PerformReport. The room is reported if
+// the event ID is empty.
+type PerformReportRequest struct {
+	RoomID  string
+	EventID string
+	UserID  spec.UserID
+	Reason  string
+	Score   *int64
+}
+
+// Report is a report of a room, or of an event in it, made by a local user.
+// BlockedRoom is a room which local users may not join or be invited to, and
+// which remote servers may not join through this server.
+type BlockedRoom struct {
+	RoomID    string         `json:"room_id"`
+	BlockedBy string         `json:"blocked_by"`
+	BlockedTS spec.Timestamp `json:"blocked_ts"`
+}
+
+type Report struct {
+	ID              int64  `json:"id"`
+	RoomID          string `json:"room_id"`
+	EventID         string `json:"event_id,omitempty"`
+	ReportingUserID string `json:"user_id"`
+	EventSender     string `json:"sender,omitempty"`
+	Reason          string `json:"reason,omitempty"`
+	Score           *int64 `json:"score,omitempty"`
+	// EventJSON is the event as it was when it was reported, so that it is
+	// kept if the event is redacted later on.
+	EventJSON  json.RawMessage `json:"event_json,omitempty"`
+	ReceivedTS spec.Timestamp  `json:"received_ts"`
+	ResolvedBy string          `json:"resolved_by,omitempty"`
+	ResolvedTS spec.Timestamp  `json:"resolved_ts,omitempty"`
+}
@@ -555,3 +555,45 @@ func (s RoomSet) Copy() RoomSet {
 	}
 	return copied
 }
+
+// QueryAdminReportsRequest is a request to QueryAdminReports. The filters are
+// ignored if they are empty.
+type QueryAdminReportsRequest struct {
+	From      int64
+	Limit     int64
+	Backwards bool // newest reports first
+	RoomID    string
+	UserID    string
+	Resolved  *bool
+}
+
+// QueryAdminRoomsRequest is a request to QueryAdminRooms.
+type QueryAdminRoomsRequest struct {
+	From  int64
+	Limit int64
+	// List the rooms with the most forward extremities first
+	OrderByForwardExtremities bool
+}
+
+// AdminRoom is a summary of a room known to the roomserver.
+type AdminRoom struct {
+	RoomID             string                        `json:"room_id"`
+	RoomVersion        gomatrixserverlib.RoomVersion `json:"version"`
+	Name               string                        `json:"name,omitempty"`
+	CanonicalAlias     string                        `json:"canonical_alias,omitempty"`
+	Creator            string                        `json:"creator"`
+	Federatable        bool                          `json:"federatable"`
+	JoinedMembers      int64                         `json:"joined_members"`
+	JoinedLocalMembers int64                         `json:"joined_local_members"`
+	ForwardExtremities int64                         `json:"forward_extremities"`
+}
+
+// ForwardExtremity is one of the latest events in a room, i.e. an event which
+// isn't referenced by any other event.
+type ForwardExtremity struct {
+	EventID        string         `json:"event_id"`
+	Type           string         `json:"type"`
+	Sender         string         `json:"sender"`
+	Depth          int64          `json:"depth"`
+	OriginServerTS spec.Timestamp `json:"origin_server_ts"`
+}
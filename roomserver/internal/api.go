@@ -34,12 +34,14 @@ type RoomserverInternalAPI struct {
 	*perform.Inviter
 	*perform.Joiner
 	*perform.Leaver
+	*perform.Knocker
 	*perform.Publisher
 	*perform.Backfiller
 	*perform.Forgetter
 	*perform.Upgrader
 	*perform.Admin
 	*perform.Creator
+	*perform.Reporter
 	ProcessContext         *process.ProcessContext
 	DB                     storage.Database
 	Cfg                    *config.Dendrite
@@ -149,6 +151,14 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 		RSAPI:   r,
 		Inputer: r.Inputer,
 	}
+	r.Knocker = &perform.Knocker{
+		Cfg:     &r.Cfg.RoomServer,
+		DB:      r.DB,
+		FSAPI:   r.fsAPI,
+		RSAPI:   r,
+		Inputer: r.Inputer,
+		Queryer: r.Queryer,
+	}
 	r.Publisher = &perform.Publisher{
 		DB: r.DB,
 	}
@@ -182,6 +192,10 @@ func (r *RoomserverInternalAPI) SetFederationAPI(fsAPI fsAPI.RoomserverFederatio
 		Cfg:   &r.Cfg.RoomServer,
 		RSAPI: r,
 	}
+	r.Reporter = &perform.Reporter{
+		DB:      r.DB,
+		Queryer: r.Queryer,
+	}
 
 	if err := r.Inputer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start roomserver input API")
@@ -243,6 +257,20 @@ func (r *RoomserverInternalAPI) PerformLeave(
 	return r.OutputProducer.ProduceRoomEvents(req.RoomID, outputEvents)
 }
 
+func (r *RoomserverInternalAPI) PerformKnock(
+	ctx context.Context,
+	req *api.PerformKnockRequest,
+) (string, error) {
+	roomID, outputEvents, err := r.Knocker.PerformKnock(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if len(outputEvents) == 0 {
+		return roomID, nil
+	}
+	return roomID, r.OutputProducer.ProduceRoomEvents(roomID, outputEvents)
+}
+
 func (r *RoomserverInternalAPI) PerformForget(
 	ctx context.Context,
 	req *api.PerformForgetRequest,
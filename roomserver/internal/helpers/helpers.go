@@ -35,6 +35,7 @@ func UpdateToInviteMembership(
 	if err != nil {
 		return nil, err
 	}
+	updates = RetireKnockMembership(mu, add, spec.Invite, updates)
 	if needsSending {
 		// We notify the consumers using a special event even though we will
 		// notify them about the change in current state as part of the normal
@@ -64,6 +65,63 @@ func UpdateToInviteMembership(
 	return updates, nil
 }
 
+func UpdateToKnockMembership(
+	mu *shared.MembershipUpdater, add *types.Event, updates []api.OutputEvent,
+	roomVersion gomatrixserverlib.RoomVersion,
+) ([]api.OutputEvent, error) {
+	// As with invites, we may have already told the consumers about this knock,
+	// either because we are reprocessing this event, or because we knocked on
+	// the room over federation. In those cases we don't need to send the event.
+	needsSending, retired, err := mu.Update(tables.MembershipStateKnock, add)
+	if err != nil {
+		return nil, err
+	}
+	if needsSending {
+		updates = append(updates, api.OutputEvent{
+			Type: api.OutputTypeNewKnockEvent,
+			NewKnockEvent: &api.OutputNewKnockEvent{
+				Event:       &types.HeaderedEvent{PDU: add.PDU},
+				RoomVersion: roomVersion,
+			},
+		})
+	}
+	for _, eventID := range retired {
+		updates = append(updates, api.OutputEvent{
+			Type: api.OutputTypeRetireInviteEvent,
+			RetireInviteEvent: &api.OutputRetireInviteEvent{
+				EventID:          eventID,
+				RoomID:           add.RoomID().String(),
+				Membership:       spec.Knock,
+				RetiredByEventID: add.EventID(),
+				TargetSenderID:   spec.SenderID(*add.StateKey()),
+			},
+		})
+	}
+	return updates, nil
+}
+
+// RetireKnockMembership notifies the consumers that a knock is no longer
+// active if the membership updater shows that the user had previously
+// knocked on the room. This must be called with the membership that replaced
+// the knock.
+func RetireKnockMembership(
+	mu *shared.MembershipUpdater, add *types.Event,
+	newMembership string, updates []api.OutputEvent,
+) []api.OutputEvent {
+	if !mu.IsKnock() || newMembership == spec.Knock {
+		return updates
+	}
+	return append(updates, api.OutputEvent{
+		Type: api.OutputTypeRetireKnockEvent,
+		RetireKnockEvent: &api.OutputRetireKnockEvent{
+			RoomID:           add.RoomID().String(),
+			Membership:       newMembership,
+			RetiredByEventID: add.EventID(),
+			TargetSenderID:   spec.SenderID(*add.StateKey()),
+		},
+	})
+}
+
 // IsServerCurrentlyInRoom checks if a server is in a given room, based on the room
 // memberships. If the servername is not supplied then the local server will be
 // checked instead using a faster code path.
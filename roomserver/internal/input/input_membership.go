@@ -124,7 +124,7 @@ func (r *Inputer) updateMembership(
 	case spec.Leave, spec.Ban:
 		return updateToLeaveMembership(mu, add, newMembership, updates)
 	case spec.Knock:
-		return updateToKnockMembership(mu, add, updates)
+		return helpers.UpdateToKnockMembership(mu, add, updates, updater.RoomVersion())
 	default:
 		panic(fmt.Errorf(
 			"input: membership %q is not one of the allowed values", newMembership,
@@ -155,6 +155,7 @@ func updateToJoinMembership(
 	if err != nil {
 		return nil, err
 	}
+	updates = helpers.RetireKnockMembership(mu, add, spec.Join, updates)
 	for _, eventID := range retired {
 		updates = append(updates, api.OutputEvent{
 			Type: api.OutputTypeRetireInviteEvent,
@@ -182,6 +183,7 @@ func updateToLeaveMembership(
 	if err != nil {
 		return nil, err
 	}
+	updates = helpers.RetireKnockMembership(mu, add, newMembership, updates)
 	for _, eventID := range retired {
 		updates = append(updates, api.OutputEvent{
 			Type: api.OutputTypeRetireInviteEvent,
@@ -197,15 +199,6 @@ func updateToLeaveMembership(
 	return updates, nil
 }
 
-func updateToKnockMembership(
-	mu *shared.MembershipUpdater, add *types.Event, updates []api.OutputEvent,
-) ([]api.OutputEvent, error) {
-	if _, _, err := mu.Update(tables.MembershipStateKnock, add); err != nil {
-		return nil, err
-	}
-	return updates, nil
-}
-
 // membershipChanges pairs up the membership state changes.
 func membershipChanges(removed, added []types.StateEntry) []stateChange {
 	changes := pairUpChanges(removed, added)
@@ -19,6 +19,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/neilalexander/harmony/internal/eventutil"
@@ -354,3 +355,291 @@ func (r *Admin) PerformAdminDownloadState(
 
 	return nil
 }
+
+// QueryAdminRooms returns a page of the rooms that the roomserver knows the
+// state of and the total number of those rooms.
+func (r *Admin) QueryAdminRooms(
+	ctx context.Context,
+	req *api.QueryAdminRoomsRequest,
+) ([]api.AdminRoom, int64, error) {
+	rooms, total, err := r.DB.GetAdminRooms(ctx, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = r.describeRooms(ctx, rooms); err != nil {
+		return nil, 0, err
+	}
+	return rooms, total, nil
+}
+
+// QueryAdminRoom returns a summary of the given room, or nil if the room is unknown.
+func (r *Admin) QueryAdminRoom(
+	ctx context.Context,
+	roomID string,
+) (*api.AdminRoom, error) {
+	room, err := r.DB.GetAdminRoom(ctx, roomID)
+	if err != nil || room == nil {
+		return nil, err
+	}
+	rooms := []api.AdminRoom{*room}
+	if err = r.describeRooms(ctx, rooms); err != nil {
+		return nil, err
+	}
+	return &rooms[0], nil
+}
+
+// describeRooms fills in the parts of the room summaries which come from the
+// current state of the rooms.
+func (r *Admin) describeRooms(ctx context.Context, rooms []api.AdminRoom) error {
+	if len(rooms) == 0 {
+		return nil
+	}
+	roomIDs := make([]string, 0, len(rooms))
+	roomIndexes := make(map[string]int, len(rooms))
+	for i := range rooms {
+		roomIDs = append(roomIDs, rooms[i].RoomID)
+		roomIndexes[rooms[i].RoomID] = i
+	}
+	stateContent, err := r.DB.GetBulkStateContent(ctx, roomIDs, []gomatrixserverlib.StateKeyTuple{
+		{EventType: spec.MRoomName, StateKey: ""},
+		{EventType: spec.MRoomCanonicalAlias, StateKey: ""},
+	}, false)
+	if err != nil {
+		return err
+	}
+	for _, content := range stateContent {
+		room := &rooms[roomIndexes[content.RoomID]]
+		switch content.EventType {
+		case spec.MRoomName:
+			room.Name = content.ContentValue
+		case spec.MRoomCanonicalAlias:
+			room.CanonicalAlias = content.ContentValue
+		}
+	}
+
+	for i := range rooms {
+		room := &rooms[i]
+		createEvent, err := r.DB.GetStateEvent(ctx, room.RoomID, spec.MRoomCreate, "")
+		if err != nil {
+			return err
+		}
+		if createEvent == nil {
+			continue
+		}
+		var createContent gomatrixserverlib.CreateContent
+		if err = json.Unmarshal(createEvent.Content(), &createContent); err != nil {
+			return err
+		}
+		room.Federatable = createContent.Federate == nil || *createContent.Federate
+		room.Creator = string(createEvent.SenderID())
+		if creator, err := r.Queryer.QueryUserIDForSender(ctx, createEvent.RoomID(), createEvent.SenderID()); err == nil && creator != nil {
+			room.Creator = creator.String()
+		}
+	}
+	return nil
+}
+
+// QueryAdminRoomState returns the current state of the given room.
+func (r *Admin) QueryAdminRoomState(
+	ctx context.Context,
+	roomID string,
+) ([]*types.HeaderedEvent, error) {
+	latestRes := &api.QueryLatestEventsAndStateResponse{}
+	if err := r.Queryer.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+	}, latestRes); err != nil {
+		return nil, err
+	}
+	if !latestRes.RoomExists {
+		return nil, eventutil.ErrRoomNoExists{}
+	}
+	return latestRes.StateEvents, nil
+}
+
+// QueryAdminRoomMembers returns the local users who are joined to the given room.
+func (r *Admin) QueryAdminRoomMembers(
+	ctx context.Context,
+	roomID string,
+) ([]string, error) {
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return nil, eventutil.ErrRoomNoExists{}
+	}
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	memberNIDs, err := r.DB.GetMembershipEventNIDsForRoom(ctx, roomInfo.RoomNID, true, true)
+	if err != nil {
+		return nil, err
+	}
+	memberEvents, err := r.DB.Events(ctx, roomInfo.RoomVersion, memberNIDs)
+	if err != nil {
+		return nil, err
+	}
+	members := make([]string, 0, len(memberEvents))
+	for _, memberEvent := range memberEvents {
+		if memberEvent.StateKey() == nil {
+			continue
+		}
+		userID, err := r.Queryer.QueryUserIDForSender(ctx, *validRoomID, spec.SenderID(*memberEvent.StateKey()))
+		if err != nil || userID == nil {
+			continue
+		}
+		members = append(members, userID.String())
+	}
+	return members, nil
+}
+
+// QueryAdminForwardExtremities returns the forward extremities of the given
+// room, with the deepest and most recently received ones first.
+func (r *Admin) QueryAdminForwardExtremities(
+	ctx context.Context,
+	roomID string,
+) ([]api.ForwardExtremity, error) {
+	_, events, err := r.forwardExtremities(ctx, roomID)
+	if err != nil {
+		return nil, err
+	}
+	extremities := make([]api.ForwardExtremity, 0, len(events))
+	for _, event := range events {
+		extremity := api.ForwardExtremity{
+			EventID:        event.EventID(),
+			Type:           event.Type(),
+			Sender:         string(event.SenderID()),
+			Depth:          event.Depth(),
+			OriginServerTS: event.OriginServerTS(),
+		}
+		if sender, err := r.Queryer.QueryUserIDForSender(ctx, event.RoomID(), event.SenderID()); err == nil && sender != nil {
+			extremity.Sender = sender.String()
+		}
+		extremities = append(extremities, extremity)
+	}
+	return extremities, nil
+}
+
+// PerformAdminResetForwardExtremities removes all but the first forward
+// extremity of the given room, as ordered by QueryAdminForwardExtremities.
+// This is useful for rooms which have built up so many forward extremities
+// that sending new events into them has become slow. The current state of
+// the room is kept, so the next event in the room will be sent with the state
+// after the remaining forward extremity.
+func (r *Admin) PerformAdminResetForwardExtremities(
+	ctx context.Context,
+	roomID string,
+) (int, error) {
+	roomInfo, events, err := r.forwardExtremities(ctx, roomID)
+	if err != nil {
+		return 0, err
+	}
+	if len(events) < 2 {
+		return 0, nil
+	}
+	remove := make([]types.EventNID, 0, len(events)-1)
+	for _, event := range events[1:] {
+		remove = append(remove, event.EventNID)
+	}
+	removed, err := r.DB.RemoveForwardExtremities(ctx, roomInfo.RoomNID, remove)
+	if err != nil {
+		return 0, fmt.Errorf("r.DB.RemoveForwardExtremities: %w", err)
+	}
+	logrus.WithFields(logrus.Fields{
+		"room_id": roomID,
+		"kept":    events[0].EventID(),
+		"removed": removed,
+	}).Warn("Reset forward extremities of room")
+	return removed, nil
+}
+
+// forwardExtremities returns the forward extremities of the room, ordered by
+// depth and then by the order in which they were received, newest first.
+func (r *Admin) forwardExtremities(
+	ctx context.Context,
+	roomID string,
+) (*types.RoomInfo, []types.Event, error) {
+	roomInfo, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return nil, nil, eventutil.ErrRoomNoExists{}
+	}
+	eventIDs, _, _, err := r.DB.LatestEventIDs(ctx, roomInfo.RoomNID)
+	if err != nil {
+		return nil, nil, err
+	}
+	events, err := r.DB.EventsFromIDs(ctx, roomInfo, eventIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Depth() != events[j].Depth() {
+			return events[i].Depth() > events[j].Depth()
+		}
+		return events[i].EventNID > events[j].EventNID
+	})
+	return roomInfo, events, nil
+}
+
+// PerformAdminBlockRoom blocks or unblocks the given room. Local users can't
+// join or be invited to blocked rooms, and remote servers can't join blocked
+// rooms through this server. Users who are already in the room aren't removed.
+func (r *Admin) PerformAdminBlockRoom(
+	ctx context.Context,
+	roomID, blockedBy string,
+	blocked bool,
+) error {
+	if _, err := spec.NewRoomID(roomID); err != nil {
+		return api.ErrInvalidID{Err: err}
+	}
+	if err := r.DB.BlockRoom(ctx, roomID, blockedBy, blocked); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"room_id":    roomID,
+		"blocked":    blocked,
+		"changed_by": blockedBy,
+	}).Warn("Changed room block")
+	return nil
+}
+
+// QueryAdminBlockedRoom returns the block of the given room, or nil if the
+// room isn't blocked.
+func (r *Admin) QueryAdminBlockedRoom(
+	ctx context.Context,
+	roomID string,
+) (*api.BlockedRoom, error) {
+	return r.DB.GetBlockedRoom(ctx, roomID)
+}
+
+// QueryAdminBlockedRooms returns all blocked rooms.
+func (r *Admin) QueryAdminBlockedRooms(
+	ctx context.Context,
+) ([]api.BlockedRoom, error) {
+	return r.DB.GetBlockedRooms(ctx)
+}
+
+// PerformAdminRemoveRoomAliases removes all of the local aliases which point
+// to the given room. Unlike RemoveRoomAlias this doesn't check the power level
+// of the sender or update the canonical alias of the room.
+func (r *Admin) PerformAdminRemoveRoomAliases(
+	ctx context.Context,
+	roomID string,
+) ([]string, error) {
+	aliases, err := r.DB.GetAliasesForRoomID(ctx, roomID)
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.GetAliasesForRoomID: %w", err)
+	}
+	removed := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		if err = r.DB.RemoveRoomAlias(ctx, alias); err != nil {
+			return removed, fmt.Errorf("r.DB.RemoveRoomAlias: %w", err)
+		}
+		removed = append(removed, alias)
+	}
+	return removed, nil
+}
@@ -136,6 +136,13 @@ func (r *Inviter) PerformInvite(
 	if err != nil {
 		return err
 	}
+	blocked, err := r.DB.GetBlockedRoom(ctx, req.InviteInput.RoomID.String())
+	if err != nil {
+		return err
+	}
+	if blocked != nil {
+		return api.ErrNotAllowed{Err: fmt.Errorf("room %s has been blocked on this server", req.InviteInput.RoomID)}
+	}
 
 	proto := gomatrixserverlib.ProtoEvent{
 		SenderID: string(*senderID),
@@ -168,6 +168,15 @@ func (r *Joiner) performJoinRoomByID(
 		return "", "", rsAPI.ErrInvalidID{Err: fmt.Errorf("room ID %q is invalid: %w", req.RoomIDOrAlias, err)}
 	}
 
+	// Local users can't join rooms which have been blocked by an admin.
+	blocked, err := r.DB.GetBlockedRoom(ctx, roomID.String())
+	if err != nil {
+		return "", "", fmt.Errorf("r.DB.GetBlockedRoom: %w", err)
+	}
+	if blocked != nil {
+		return "", "", rsAPI.ErrNotAllowed{Err: fmt.Errorf("room %s has been blocked on this server", roomID)}
+	}
+
 	// If the server name in the room ID isn't ours then it's a
 	// possible candidate for finding the room via federation. Add
 	// it to the list of servers to try.
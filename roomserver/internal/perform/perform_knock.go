@@ -0,0 +1,285 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/sirupsen/logrus"
+
+	fsAPI "github.com/neilalexander/harmony/federationapi/api"
+	"github.com/neilalexander/harmony/internal/eventutil"
+	rsAPI "github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/internal/helpers"
+	"github.com/neilalexander/harmony/roomserver/internal/input"
+	"github.com/neilalexander/harmony/roomserver/internal/query"
+	"github.com/neilalexander/harmony/roomserver/storage"
+	"github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/setup/config"
+)
+
+type Knocker struct {
+	Cfg   *config.RoomServer
+	FSAPI fsAPI.RoomserverFederationAPI
+	RSAPI rsAPI.RoomserverInternalAPI
+	DB    storage.Database
+
+	Inputer *input.Inputer
+	Queryer *query.Queryer
+}
+
+// PerformKnock handles knocking on matrix rooms, including over federation by talking to the federationapi.
+func (r *Knocker) PerformKnock(
+	ctx context.Context,
+	req *rsAPI.PerformKnockRequest,
+) (roomID string, outputEvents []rsAPI.OutputEvent, err error) {
+	logger := logrus.WithContext(ctx).WithFields(logrus.Fields{
+		"room_id": req.RoomIDOrAlias,
+		"user_id": req.UserID,
+		"servers": req.ServerNames,
+	})
+	logger.Info("User requested to knock on room")
+	roomID, outputEvents, err = r.performKnock(context.Background(), req)
+	if err != nil {
+		logger.WithError(err).Error("Failed to knock on room")
+		return "", nil, err
+	}
+	logger.Info("User knocked on room successfully")
+
+	return roomID, outputEvents, nil
+}
+
+func (r *Knocker) performKnock(
+	ctx context.Context,
+	req *rsAPI.PerformKnockRequest,
+) (string, []rsAPI.OutputEvent, error) {
+	userID, err := spec.NewUserID(req.UserID, true)
+	if err != nil {
+		return "", nil, rsAPI.ErrInvalidID{Err: fmt.Errorf("supplied user ID %q in incorrect format", req.UserID)}
+	}
+	if !r.Cfg.Matrix.IsLocalServerName(userID.Domain()) {
+		return "", nil, rsAPI.ErrInvalidID{Err: fmt.Errorf("user %q does not belong to this homeserver", req.UserID)}
+	}
+	if strings.HasPrefix(req.RoomIDOrAlias, "#") {
+		if err = r.resolveRoomAlias(ctx, req); err != nil {
+			return "", nil, err
+		}
+	}
+	if !strings.HasPrefix(req.RoomIDOrAlias, "!") {
+		return "", nil, rsAPI.ErrInvalidID{Err: fmt.Errorf("room ID or alias %q is invalid", req.RoomIDOrAlias)}
+	}
+	return r.performKnockRoomByID(ctx, req, *userID)
+}
+
+func (r *Knocker) resolveRoomAlias(
+	ctx context.Context,
+	req *rsAPI.PerformKnockRequest,
+) error {
+	// Get the domain part of the room alias.
+	_, domain, err := gomatrixserverlib.SplitID('#', req.RoomIDOrAlias)
+	if err != nil {
+		return rsAPI.ErrInvalidID{Err: fmt.Errorf("alias %q is not in the correct format", req.RoomIDOrAlias)}
+	}
+	req.ServerNames = append(req.ServerNames, domain)
+
+	var roomID string
+	if !r.Cfg.Matrix.IsLocalServerName(domain) {
+		// The alias isn't owned by us, so ask the server that owns it.
+		dirReq := fsAPI.PerformDirectoryLookupRequest{
+			RoomAlias:  req.RoomIDOrAlias, // the room alias to lookup
+			ServerName: domain,            // the server to ask
+		}
+		dirRes := fsAPI.PerformDirectoryLookupResponse{}
+		if err = r.FSAPI.PerformDirectoryLookup(ctx, &dirReq, &dirRes); err != nil {
+			return fmt.Errorf("looking up alias %q over federation failed: %w", req.RoomIDOrAlias, err)
+		}
+		roomID = dirRes.RoomID
+		req.ServerNames = append(req.ServerNames, dirRes.ServerNames...)
+	} else {
+		getRoomReq := rsAPI.GetRoomIDForAliasRequest{
+			Alias:              req.RoomIDOrAlias,
+			IncludeAppservices: true,
+		}
+		getRoomRes := rsAPI.GetRoomIDForAliasResponse{}
+		if err = r.RSAPI.GetRoomIDForAlias(ctx, &getRoomReq, &getRoomRes); err != nil {
+			return fmt.Errorf("lookup room alias %q failed: %w", req.RoomIDOrAlias, err)
+		}
+		roomID = getRoomRes.RoomID
+	}
+
+	// If the room ID is empty then we failed to look up the alias.
+	if roomID == "" {
+		return fmt.Errorf("alias %q not found", req.RoomIDOrAlias)
+	}
+	req.RoomIDOrAlias = roomID
+	return nil
+}
+
+func (r *Knocker) performKnockRoomByID(
+	ctx context.Context,
+	req *rsAPI.PerformKnockRequest,
+	userID spec.UserID,
+) (string, []rsAPI.OutputEvent, error) {
+	roomID, err := spec.NewRoomID(req.RoomIDOrAlias)
+	if err != nil {
+		return "", nil, rsAPI.ErrInvalidID{Err: fmt.Errorf("room ID %q is invalid: %w", req.RoomIDOrAlias, err)}
+	}
+
+	// The client may have supplied this server in ?server_name=, so filter
+	// that out so we don't attempt to make_knock with ourselves. Then add the
+	// server from the room ID as a candidate if it isn't ours.
+	serverNames := make([]spec.ServerName, 0, len(req.ServerNames)+1)
+	for _, serverName := range req.ServerNames {
+		if !r.Cfg.Matrix.IsLocalServerName(serverName) {
+			serverNames = append(serverNames, serverName)
+		}
+	}
+	if !r.Cfg.Matrix.IsLocalServerName(roomID.Domain()) {
+		serverNames = append(serverNames, roomID.Domain())
+	}
+	req.ServerNames = serverNames
+
+	inRoomReq := &rsAPI.QueryServerJoinedToRoomRequest{
+		RoomID: roomID.String(),
+	}
+	inRoomRes := &rsAPI.QueryServerJoinedToRoomResponse{}
+	if err = r.Queryer.QueryServerJoinedToRoom(ctx, inRoomReq, inRoomRes); err != nil {
+		return "", nil, fmt.Errorf("r.Queryer.QueryServerJoinedToRoom: %w", err)
+	}
+
+	content := map[string]interface{}{
+		"membership": spec.Knock,
+	}
+	if req.Reason != "" {
+		content["reason"] = req.Reason
+	}
+
+	// If we aren't in the room then we will need to knock over federation.
+	if !inRoomRes.IsInRoom {
+		if len(req.ServerNames) == 0 {
+			return "", nil, eventutil.ErrRoomNoExists{}
+		}
+		outputEvents, ferr := r.performFederatedKnockRoomByID(ctx, req, content)
+		return roomID.String(), outputEvents, ferr
+	}
+
+	if inRoomRes.RoomVersion == gomatrixserverlib.RoomVersionPseudoIDs {
+		return "", nil, rsAPI.ErrNotAllowed{Err: fmt.Errorf("knocking is not supported in room version %q", inRoomRes.RoomVersion)}
+	}
+
+	// The room is known locally, so we can build and send the knock
+	// event ourselves. Include some stripped state in the unsigned section
+	// so that the sync API can tell the user what they have knocked on.
+	knockRoomState, err := gomatrixserverlib.GenerateStrippedState(ctx, *roomID, r.RSAPI.StateQuerier())
+	if err != nil {
+		return "", nil, fmt.Errorf("gomatrixserverlib.GenerateStrippedState: %w", err)
+	}
+
+	senderIDString := userID.String()
+	proto := gomatrixserverlib.ProtoEvent{
+		Type:     spec.MRoomMember,
+		SenderID: senderIDString,
+		StateKey: &senderIDString,
+		RoomID:   roomID.String(),
+	}
+	if err = proto.SetContent(content); err != nil {
+		return "", nil, fmt.Errorf("eb.SetContent: %w", err)
+	}
+	if err = proto.SetUnsigned(map[string]interface{}{"knock_room_state": knockRoomState}); err != nil {
+		return "", nil, fmt.Errorf("eb.SetUnsigned: %w", err)
+	}
+
+	identity, err := r.RSAPI.SigningIdentityFor(ctx, *roomID, userID)
+	if err != nil {
+		return "", nil, fmt.Errorf("SigningIdentityFor: %w", err)
+	}
+	var buildRes rsAPI.QueryLatestEventsAndStateResponse
+	event, err := eventutil.QueryAndBuildEvent(ctx, &proto, &identity, time.Now(), r.RSAPI, &buildRes)
+	if err != nil {
+		return "", nil, fmt.Errorf("eventutil.QueryAndBuildEvent: %w", err)
+	}
+
+	// Send the knock event into the roomserver. The roomserver will update
+	// the membership and notify downstream components about the knock.
+	inputReq := rsAPI.InputRoomEventsRequest{
+		InputRoomEvents: []rsAPI.InputRoomEvent{
+			{
+				Kind:         rsAPI.KindNew,
+				Event:        event,
+				Origin:       userID.Domain(),
+				SendAsServer: string(userID.Domain()),
+			},
+		},
+	}
+	inputRes := rsAPI.InputRoomEventsResponse{}
+	r.Inputer.InputRoomEvents(ctx, &inputReq, &inputRes)
+	if err = inputRes.Err(); err != nil {
+		return "", nil, rsAPI.ErrNotAllowed{Err: err}
+	}
+
+	return roomID.String(), nil, nil
+}
+
+func (r *Knocker) performFederatedKnockRoomByID(
+	ctx context.Context,
+	req *rsAPI.PerformKnockRequest,
+	content map[string]interface{},
+) ([]rsAPI.OutputEvent, error) {
+	// Try knocking by all of the supplied server names.
+	fedReq := fsAPI.PerformKnockRequest{
+		RoomID:      req.RoomIDOrAlias, // the room ID to knock on
+		UserID:      req.UserID,        // the user ID knocking on the room
+		ServerNames: req.ServerNames,   // the servers to try knocking with
+		Content:     content,           // the membership event content
+	}
+	fedRes := fsAPI.PerformKnockResponse{}
+	if err := r.FSAPI.PerformKnock(ctx, &fedReq, &fedRes); err != nil {
+		return nil, err
+	}
+
+	// Keep hold of the stripped state that the remote server gave us so that
+	// the sync API can tell the user what they have knocked on.
+	event, err := fedRes.Event.SetUnsigned(map[string]interface{}{
+		"knock_room_state": fedRes.KnockRoomState,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("event.SetUnsigned: %w", err)
+	}
+
+	// We aren't in the room so the knock won't arrive through the input
+	// stream. Instead, update the membership ourselves, in the same way
+	// that we would for an invite received over federation.
+	updater, err := r.DB.MembershipUpdater(ctx, req.RoomIDOrAlias, *event.StateKey(), true, event.Version())
+	if err != nil {
+		return nil, fmt.Errorf("r.DB.MembershipUpdater: %w", err)
+	}
+	outputEvents, err := helpers.UpdateToKnockMembership(updater, &types.Event{
+		EventNID: 0,
+		PDU:      event,
+	}, nil, event.Version())
+	if err != nil {
+		_ = updater.Rollback()
+		return nil, fmt.Errorf("helpers.UpdateToKnockMembership: %w", err)
+	}
+	if err = updater.Commit(); err != nil {
+		return nil, fmt.Errorf("updater.Commit: %w", err)
+	}
+	return outputEvents, nil
+}
@@ -136,6 +136,13 @@ func (r *Leaver) performLeaveRoomByID(
 		}
 	}
 
+	// If the user has knocked on a room that we aren't joined to then
+	// the knock needs to be rescinded through the server that owns the room.
+	isKnockPending, roomVersion, err := r.isRemoteKnockPending(ctx, req.RoomID, *leaver)
+	if err == nil && isKnockPending {
+		return r.performFederatedRescindKnock(ctx, req, roomID.Domain(), *leaver, roomVersion)
+	}
+
 	// There's no invite pending, so first of all we want to find out
 	// if the room exists and if the user is actually in it.
 	latestReq := api.QueryLatestEventsAndStateRequest{
@@ -163,7 +170,7 @@ func (r *Leaver) performLeaveRoomByID(
 	if err != nil {
 		return nil, fmt.Errorf("error getting membership: %w", err)
 	}
-	if membership != spec.Join && membership != spec.Invite {
+	if membership != spec.Join && membership != spec.Invite && membership != spec.Knock {
 		return nil, fmt.Errorf("user %q is not joined to the room (membership is %q)", req.Leaver.String(), membership)
 	}
 
@@ -281,3 +288,80 @@ func (r *Leaver) performFederatedRejectInvite(
 		},
 	}, nil
 }
+
+// isRemoteKnockPending returns true if the user has an outstanding knock on
+// a room that the local server is not joined to.
+func (r *Leaver) isRemoteKnockPending(
+	ctx context.Context, roomID string, leaver spec.SenderID,
+) (bool, gomatrixserverlib.RoomVersion, error) {
+	info, err := r.DB.RoomInfo(ctx, roomID)
+	if err != nil || info == nil {
+		return false, "", err
+	}
+	if !info.IsStub() {
+		inRoom, ierr := r.DB.GetLocalServerInRoom(ctx, info.RoomNID)
+		if ierr != nil || inRoom {
+			return false, "", ierr
+		}
+	}
+	updater, err := r.DB.MembershipUpdater(ctx, roomID, string(leaver), true, info.RoomVersion)
+	if err != nil {
+		return false, "", err
+	}
+	isKnock := updater.IsKnock()
+	if err = updater.Rollback(); err != nil {
+		return false, "", err
+	}
+	return isKnock, info.RoomVersion, nil
+}
+
+func (r *Leaver) performFederatedRescindKnock(
+	ctx context.Context,
+	req *api.PerformLeaveRequest,
+	knockDomain spec.ServerName,
+	leaver spec.SenderID,
+	roomVersion gomatrixserverlib.RoomVersion,
+) ([]api.OutputEvent, error) {
+	// Ask the federation sender to perform a federated leave for us.
+	leaveReq := fsAPI.PerformLeaveRequest{
+		RoomID:      req.RoomID,
+		UserID:      req.Leaver.String(),
+		ServerNames: []spec.ServerName{knockDomain},
+	}
+	leaveRes := fsAPI.PerformLeaveResponse{}
+	if err := r.FSAPI.PerformLeave(ctx, &leaveReq, &leaveRes); err != nil {
+		// As with invites, failures in PerformLeave should not stop us from
+		// telling the sync API that the knock was rescinded.
+		util.GetLogger(ctx).WithError(err).Errorf("failed to PerformLeave, still retiring knock event")
+	}
+
+	updater, err := r.DB.MembershipUpdater(ctx, req.RoomID, string(leaver), true, roomVersion)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Errorf("failed to get MembershipUpdater, still retiring knock event")
+	}
+	if updater != nil {
+		if err = updater.Delete(); err != nil {
+			util.GetLogger(ctx).WithError(err).Errorf("failed to delete membership, still retiring knock event")
+			if err = updater.Rollback(); err != nil {
+				util.GetLogger(ctx).WithError(err).Errorf("failed to rollback deleting membership, still retiring knock event")
+			}
+		} else {
+			if err = updater.Commit(); err != nil {
+				util.GetLogger(ctx).WithError(err).Errorf("failed to commit deleting membership, still retiring knock event")
+			}
+		}
+	}
+
+	// Withdraw the knock, so that the sync API etc are
+	// notified that we rescinded it.
+	return []api.OutputEvent{
+		{
+			Type: api.OutputTypeRetireKnockEvent,
+			RetireKnockEvent: &api.OutputRetireKnockEvent{
+				RoomID:         req.RoomID,
+				Membership:     spec.Leave,
+				TargetSenderID: leaver,
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package perform
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/internal/query"
+	"github.com/neilalexander/harmony/roomserver/storage"
+)
+
+type Reporter struct {
+	DB      storage.Database
+	Queryer *query.Queryer
+}
+
+// PerformReport stores a report of a room or an event. Events can only be
+// reported by users who are joined to the room, whereas rooms can be reported
+// by anyone, e.g. after seeing the room in the room directory.
+func (r *Reporter) PerformReport(
+	ctx context.Context,
+	req *api.PerformReportRequest,
+) (*api.Report, error) {
+	roomID, err := spec.NewRoomID(req.RoomID)
+	if err != nil {
+		return nil, api.ErrInvalidID{Err: err}
+	}
+	roomInfo, err := r.DB.RoomInfo(ctx, req.RoomID)
+	if err != nil {
+		return nil, err
+	}
+	if roomInfo == nil || roomInfo.IsStub() {
+		return nil, api.ErrRoomUnknownOrNotAllowed{Err: fmt.Errorf("room %s is unknown", req.RoomID)}
+	}
+
+	report := &api.Report{
+		RoomID:          req.RoomID,
+		EventID:         req.EventID,
+		ReportingUserID: req.UserID.String(),
+		Reason:          req.Reason,
+		Score:           req.Score,
+		ReceivedTS:      spec.AsTimestamp(time.Now()),
+	}
+
+	if req.EventID != "" {
+		var membership api.QueryMembershipForUserResponse
+		if err = r.Queryer.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+			RoomID: req.RoomID,
+			UserID: req.UserID,
+		}, &membership); err != nil {
+			return nil, err
+		}
+		if !membership.IsInRoom {
+			return nil, api.ErrRoomUnknownOrNotAllowed{Err: fmt.Errorf("user is not joined to room %s", req.RoomID)}
+		}
+
+		events, err := r.DB.EventsFromIDs(ctx, roomInfo, []string{req.EventID})
+		if err != nil {
+			return nil, err
+		}
+		if len(events) == 0 || events[0].RoomID().String() != req.RoomID {
+			return nil, api.ErrRoomUnknownOrNotAllowed{Err: fmt.Errorf("event %s is unknown", req.EventID)}
+		}
+		event := events[0]
+		report.EventJSON = event.JSON()
+		report.EventSender = string(event.SenderID())
+		if sender, err := r.Queryer.QueryUserIDForSender(ctx, *roomID, event.SenderID()); err == nil && sender != nil {
+			report.EventSender = sender.String()
+		}
+	}
+
+	if report.ID, err = r.DB.InsertReport(ctx, report); err != nil {
+		return nil, fmt.Errorf("r.DB.InsertReport: %w", err)
+	}
+	return report, nil
+}
+
+// QueryAdminReports returns a page of reports and the total number of reports
+// matching the filters. The event JSON is left out of the reports.
+func (r *Reporter) QueryAdminReports(
+	ctx context.Context,
+	req *api.QueryAdminReportsRequest,
+) ([]api.Report, int64, error) {
+	reports, total, err := r.DB.GetReports(ctx, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range reports {
+		reports[i].EventJSON = nil
+	}
+	return reports, total, nil
+}
+
+// QueryAdminReport returns the report with the given ID, or nil if there isn't one.
+func (r *Reporter) QueryAdminReport(
+	ctx context.Context,
+	reportID int64,
+) (*api.Report, error) {
+	return r.DB.GetReport(ctx, reportID)
+}
+
+// PerformAdminResolveReport marks the report as resolved by the given admin.
+// Resolving a report again doesn't change who resolved it.
+func (r *Reporter) PerformAdminResolveReport(
+	ctx context.Context,
+	reportID int64,
+	resolvedBy string,
+) (*api.Report, error) {
+	if err := r.DB.ResolveReport(ctx, reportID, resolvedBy); err != nil {
+		return nil, err
+	}
+	return r.DB.GetReport(ctx, reportID)
+}
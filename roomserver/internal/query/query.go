@@ -958,6 +958,15 @@ func (r *Queryer) QueryServerBannedFromRoom(ctx context.Context, req *api.QueryS
 	return nil
 }
 
+// QueryRoomBlocked returns whether the room has been blocked by an admin.
+func (r *Queryer) QueryRoomBlocked(ctx context.Context, roomID string) (bool, error) {
+	blocked, err := r.DB.GetBlockedRoom(ctx, roomID)
+	if err != nil {
+		return false, err
+	}
+	return blocked != nil, nil
+}
+
 func (r *Queryer) QueryAuthChain(ctx context.Context, req *api.QueryAuthChainRequest, res *api.QueryAuthChainResponse) error {
 	chain, err := GetAuthChain(ctx, r.DB.EventsFromIDs, nil, req.EventIDs)
 	if err != nil {
@@ -1104,3 +1113,8 @@ func (r *Queryer) QueryUserIDForSender(ctx context.Context, roomID spec.RoomID,
 func (r *Queryer) RoomsWithACLs(ctx context.Context) ([]string, error) {
 	return r.DB.RoomsWithACLs(ctx)
 }
+
+// QueryMediaURIsForRoom returns all MXC URIs referenced by events in the room
+func (r *Queryer) QueryMediaURIsForRoom(ctx context.Context, roomID string) ([]string, error) {
+	return r.DB.MediaURIsForRoom(ctx, roomID)
+}
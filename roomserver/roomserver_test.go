@@ -3,11 +3,14 @@ package roomserver_test
 import (
 	"context"
 	"crypto/ed25519"
+	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	fsapi "github.com/neilalexander/harmony/federationapi/api"
 	"github.com/neilalexander/harmony/federationapi/statistics"
 	"github.com/neilalexander/harmony/internal/caching"
 	"github.com/neilalexander/harmony/internal/eventutil"
@@ -267,7 +270,7 @@ func TestPurgeRoom(t *testing.T) {
 		rsAPI.SetFederationAPI(fsAPI, nil)
 
 		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, fsAPI.IsBlacklistedOrBackingOff)
-		syncapi.AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, userAPI, rsAPI, caches, caching.DisableMetrics)
+		syncapi.AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, userAPI, rsAPI, caches, nil, nil, nil, caching.DisableMetrics)
 
 		// Create the room
 		if err = api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
@@ -1318,3 +1321,177 @@ func TestRoomsWithACLs(t *testing.T) {
 		assert.Equal(t, []string{aclRoom.ID}, roomsWithACLs)
 	})
 }
+
+// knockTestFederationAPI knocks on remote rooms by returning a prepared event.
+type knockTestFederationAPI struct {
+	fsapi.RoomserverFederationAPI
+	event *types.HeaderedEvent
+}
+
+func (f *knockTestFederationAPI) PerformKnock(ctx context.Context, req *fsapi.PerformKnockRequest, res *fsapi.PerformKnockResponse) error {
+	if f.event == nil || req.RoomID != f.event.RoomID().String() {
+		return fmt.Errorf("unable to knock on room %s", req.RoomID)
+	}
+	res.KnockedVia = req.ServerNames[0]
+	res.Event = f.event
+	res.KnockRoomState = []gomatrixserverlib.InviteStrippedState{}
+	return nil
+}
+
+func TestPerformKnock(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	charlie := test.NewUser(t, test.WithSigningServer("remote", "ed25519:remote", test.PrivateKeyB))
+	ctx := context.Background()
+
+	newRoom := func(joinRule string) *test.Room {
+		room := test.NewRoom(t, alice)
+		room.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{
+			"join_rule": joinRule,
+		}, test.WithStateKey(""))
+		return room
+	}
+	knockRoom := newRoom(spec.Knock)
+	publicRoom := newRoom(spec.Public)
+
+	// The remote room is only known to the remote server, which hands us
+	// Bob's knock event.
+	remoteRoom := test.NewRoom(t, charlie)
+	remoteRoom.CreateAndInsert(t, charlie, spec.MRoomJoinRules, map[string]interface{}{
+		"join_rule": spec.Knock,
+	}, test.WithStateKey(""))
+	remoteKnock := remoteRoom.CreateEvent(t, bob, spec.MRoomMember, map[string]interface{}{
+		"membership": spec.Knock,
+	}, test.WithStateKey(bob.ID))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		natsInstance := jetstream.NATSInstance{}
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(&knockTestFederationAPI{event: remoteKnock}, nil)
+
+		for _, room := range []*test.Room{knockRoom, publicRoom} {
+			if err := api.SendEvents(ctx, rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+		}
+		if _, err := rsAPI.SetRoomAlias(ctx, spec.SenderID(alice.ID), *mustRoomID(t, knockRoom.ID), "#knock:test"); err != nil {
+			t.Fatalf("failed to set room alias: %v", err)
+		}
+
+		bobUserID, err := spec.NewUserID(bob.ID, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		knockedRooms := func(t *testing.T) []spec.RoomID {
+			t.Helper()
+			roomIDs, err := rsAPI.QueryRoomsForUser(ctx, *bobUserID, spec.Knock)
+			if err != nil {
+				t.Fatalf("failed to query knocked rooms: %v", err)
+			}
+			return roomIDs
+		}
+
+		testCases := []struct {
+			name          string
+			req           api.PerformKnockRequest
+			wantErr       bool
+			wantErrAs     interface{}
+			wantRoomID    string
+			wantKnockedOn []spec.RoomID
+		}{
+			{
+				name:    "remote user",
+				req:     api.PerformKnockRequest{RoomIDOrAlias: knockRoom.ID, UserID: charlie.ID},
+				wantErr: true, wantErrAs: &api.ErrInvalidID{},
+			},
+			{
+				name:    "invalid room ID",
+				req:     api.PerformKnockRequest{RoomIDOrAlias: "room:test", UserID: bob.ID},
+				wantErr: true, wantErrAs: &api.ErrInvalidID{},
+			},
+			{
+				name:    "unknown local alias",
+				req:     api.PerformKnockRequest{RoomIDOrAlias: "#unknown:test", UserID: bob.ID},
+				wantErr: true,
+			},
+			{
+				name:    "unknown local room",
+				req:     api.PerformKnockRequest{RoomIDOrAlias: "!unknown:test", UserID: bob.ID},
+				wantErr: true, wantErrAs: &eventutil.ErrRoomNoExists{},
+			},
+			{
+				name:    "join rules don't allow knocking",
+				req:     api.PerformKnockRequest{RoomIDOrAlias: publicRoom.ID, UserID: bob.ID},
+				wantErr: true, wantErrAs: &api.ErrNotAllowed{},
+			},
+			{
+				name:          "local room by alias",
+				req:           api.PerformKnockRequest{RoomIDOrAlias: "#knock:test", UserID: bob.ID, Reason: "let me in"},
+				wantRoomID:    knockRoom.ID,
+				wantKnockedOn: []spec.RoomID{*mustRoomID(t, knockRoom.ID)},
+			},
+			{
+				name:          "remote room",
+				req:           api.PerformKnockRequest{RoomIDOrAlias: remoteRoom.ID, UserID: bob.ID},
+				wantRoomID:    remoteRoom.ID,
+				wantKnockedOn: []spec.RoomID{*mustRoomID(t, knockRoom.ID), *mustRoomID(t, remoteRoom.ID)},
+			},
+		}
+
+		for _, tc := range testCases {
+			t.Run(tc.name, func(t *testing.T) {
+				roomID, err := rsAPI.PerformKnock(processCtx.Context(), &tc.req)
+				if tc.wantErr {
+					if err == nil {
+						t.Fatalf("expected an error, got room %q", roomID)
+					}
+					if tc.wantErrAs != nil && !errors.As(err, tc.wantErrAs) {
+						t.Fatalf("got error %T (%v), want %T", err, err, tc.wantErrAs)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("failed to knock: %v", err)
+				}
+				if roomID != tc.wantRoomID {
+					t.Fatalf("knocked on %q, want %q", roomID, tc.wantRoomID)
+				}
+				assert.ElementsMatch(t, tc.wantKnockedOn, knockedRooms(t))
+			})
+		}
+
+		// The local knock must carry stripped state for the sync API and
+		// the reason that the user gave.
+		stateRes := &api.QueryCurrentStateResponse{}
+		tuple := gomatrixserverlib.StateKeyTuple{EventType: spec.MRoomMember, StateKey: bob.ID}
+		if err = rsAPI.QueryCurrentState(ctx, &api.QueryCurrentStateRequest{
+			RoomID:      knockRoom.ID,
+			StateTuples: []gomatrixserverlib.StateKeyTuple{tuple},
+		}, stateRes); err != nil {
+			t.Fatal(err)
+		}
+		ev, ok := stateRes.StateEvents[tuple]
+		if !ok {
+			t.Fatalf("no knock event in the room state")
+		}
+		if reason := gjson.GetBytes(ev.Content(), "reason").Str; reason != "let me in" {
+			t.Fatalf("got reason %q, want %q", reason, "let me in")
+		}
+		if !gjson.GetBytes(ev.Unsigned(), "knock_room_state").IsArray() {
+			t.Fatalf("knock event has no stripped state: %s", ev.Unsigned())
+		}
+	})
+}
+
+func mustRoomID(t *testing.T, roomID string) *spec.RoomID {
+	t.Helper()
+	id, err := spec.NewRoomID(roomID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
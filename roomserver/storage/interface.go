@@ -177,6 +177,27 @@ type Database interface {
 	GetLeftUsers(ctx context.Context, userIDs []string) ([]string, error)
 	PurgeRoom(ctx context.Context, roomID string) error
 	UpgradeRoom(ctx context.Context, oldRoomID, newRoomID, eventSender string) error
+	// InsertReport stores a report of a room or event, returning the ID of the report.
+	InsertReport(ctx context.Context, report *api.Report) (int64, error)
+	// GetReports returns a page of reports and the total number of reports matching the filters.
+	GetReports(ctx context.Context, req *api.QueryAdminReportsRequest) ([]api.Report, int64, error)
+	// GetReport returns the report with the given ID, or nil if there isn't one.
+	GetReport(ctx context.Context, reportID int64) (*api.Report, error)
+	// ResolveReport marks the report as resolved, unless it has already been resolved.
+	ResolveReport(ctx context.Context, reportID int64, resolvedBy string) error
+	// GetAdminRooms returns a page of rooms and the total number of rooms, not including stub rooms.
+	GetAdminRooms(ctx context.Context, req *api.QueryAdminRoomsRequest) ([]api.AdminRoom, int64, error)
+	// GetAdminRoom returns a summary of the room, or nil if the room is unknown or a stub.
+	GetAdminRoom(ctx context.Context, roomID string) (*api.AdminRoom, error)
+	// RemoveForwardExtremities removes the given events from the latest events of the room,
+	// always keeping at least one. Returns the number of forward extremities that were removed.
+	RemoveForwardExtremities(ctx context.Context, roomNID types.RoomNID, eventNIDs []types.EventNID) (int, error)
+	// BlockRoom adds the room to the block list, or removes it if blocked is false.
+	BlockRoom(ctx context.Context, roomID, blockedBy string, blocked bool) error
+	// GetBlockedRoom returns the block of the room, or nil if the room isn't blocked.
+	GetBlockedRoom(ctx context.Context, roomID string) (*api.BlockedRoom, error)
+	// GetBlockedRooms returns all blocked rooms.
+	GetBlockedRooms(ctx context.Context) ([]api.BlockedRoom, error)
 
 	// GetMembershipForHistoryVisibility queries the membership events for the given eventIDs.
 	// Returns a map from (input) eventID -> membership event. If no membership event is found, returns an empty event, resulting in
@@ -194,6 +215,8 @@ type Database interface {
 
 	// RoomsWithACLs returns all room IDs for rooms with ACLs
 	RoomsWithACLs(ctx context.Context) ([]string, error)
+	// MediaURIsForRoom returns all MXC URIs referenced by events in the room
+	MediaURIsForRoom(ctx context.Context, roomID string) ([]string, error)
 }
 
 type UserRoomKeys interface {
@@ -0,0 +1,125 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/storage/tables"
+)
+
+const blockedRoomsSchema = `
+-- Stores the rooms which local users may not join and which remote servers
+-- may not join through this server.
+CREATE TABLE IF NOT EXISTS roomserver_blocked_rooms (
+    room_id TEXT NOT NULL PRIMARY KEY,
+    -- The admin who blocked the room
+    blocked_by TEXT NOT NULL,
+    blocked_ts BIGINT NOT NULL
+);
+`
+
+const insertBlockedRoomSQL = "" +
+	"INSERT INTO roomserver_blocked_rooms (room_id, blocked_by, blocked_ts) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (room_id) DO NOTHING"
+
+const deleteBlockedRoomSQL = "" +
+	"DELETE FROM roomserver_blocked_rooms WHERE room_id = $1"
+
+const selectBlockedRoomSQL = "" +
+	"SELECT room_id, blocked_by, blocked_ts FROM roomserver_blocked_rooms WHERE room_id = $1"
+
+const selectBlockedRoomsSQL = "" +
+	"SELECT room_id, blocked_by, blocked_ts FROM roomserver_blocked_rooms ORDER BY blocked_ts ASC"
+
+type blockedRoomsStatements struct {
+	insertBlockedRoomStmt  *sql.Stmt
+	deleteBlockedRoomStmt  *sql.Stmt
+	selectBlockedRoomStmt  *sql.Stmt
+	selectBlockedRoomsStmt *sql.Stmt
+}
+
+func CreateBlockedRoomsTable(db *sql.DB) error {
+	_, err := db.Exec(blockedRoomsSchema)
+	return err
+}
+
+func PrepareBlockedRoomsTable(db *sql.DB) (tables.BlockedRooms, error) {
+	s := &blockedRoomsStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertBlockedRoomStmt, insertBlockedRoomSQL},
+		{&s.deleteBlockedRoomStmt, deleteBlockedRoomSQL},
+		{&s.selectBlockedRoomStmt, selectBlockedRoomSQL},
+		{&s.selectBlockedRoomsStmt, selectBlockedRoomsSQL},
+	}.Prepare(db)
+}
+
+func (s *blockedRoomsStatements) InsertBlockedRoom(
+	ctx context.Context, txn *sql.Tx, roomID, blockedBy string, blockedTS spec.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertBlockedRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID, blockedBy, blockedTS)
+	return err
+}
+
+func (s *blockedRoomsStatements) DeleteBlockedRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteBlockedRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
+
+func (s *blockedRoomsStatements) SelectBlockedRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (*api.BlockedRoom, error) {
+	var room api.BlockedRoom
+	stmt := sqlutil.TxStmt(txn, s.selectBlockedRoomStmt)
+	err := stmt.QueryRowContext(ctx, roomID).Scan(&room.RoomID, &room.BlockedBy, &room.BlockedTS)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
+
+func (s *blockedRoomsStatements) SelectBlockedRooms(
+	ctx context.Context, txn *sql.Tx,
+) ([]api.BlockedRoom, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectBlockedRoomsStmt)
+	rows, err := stmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectBlockedRoomsStmt: rows.close() failed")
+
+	var rooms []api.BlockedRoom
+	for rows.Next() {
+		var room api.BlockedRoom
+		if err = rows.Scan(&room.RoomID, &room.BlockedBy, &room.BlockedTS); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
@@ -54,9 +54,18 @@ const bulkSelectEventJSONSQL = "" +
 	" WHERE event_nid = ANY($1)" +
 	" ORDER BY event_nid ASC"
 
+// Finds all distinct MXC URIs referenced anywhere in the JSON of the events
+// in a room, e.g. in the content of m.room.message or m.room.avatar events.
+const selectMediaURIsForRoomSQL = "" +
+	"SELECT DISTINCT (regexp_matches(j.event_json, 'mxc://[^/\"\\\\]+/[A-Za-z0-9_=-]+', 'g'))[1]" +
+	" FROM roomserver_event_json j" +
+	" JOIN roomserver_events e ON e.event_nid = j.event_nid" +
+	" WHERE e.room_nid = $1"
+
 type eventJSONStatements struct {
-	insertEventJSONStmt     *sql.Stmt
-	bulkSelectEventJSONStmt *sql.Stmt
+	insertEventJSONStmt        *sql.Stmt
+	bulkSelectEventJSONStmt    *sql.Stmt
+	selectMediaURIsForRoomStmt *sql.Stmt
 }
 
 func CreateEventJSONTable(db *sql.DB) error {
@@ -70,6 +79,7 @@ func PrepareEventJSONTable(db *sql.DB) (tables.EventJSON, error) {
 	return s, sqlutil.StatementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
+		{&s.selectMediaURIsForRoomStmt, selectMediaURIsForRoomSQL},
 	}.Prepare(db)
 }
 
@@ -107,3 +117,23 @@ func (s *eventJSONStatements) BulkSelectEventJSON(
 	}
 	return results[:i], rows.Err()
 }
+
+func (s *eventJSONStatements) SelectMediaURIsForRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID,
+) ([]string, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectMediaURIsForRoomStmt).QueryContext(ctx, int64(roomNID))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectMediaURIsForRoom: rows.close() failed")
+
+	var uris []string
+	for rows.Next() {
+		var uri string
+		if err = rows.Scan(&uri); err != nil {
+			return nil, err
+		}
+		uris = append(uris, uri)
+	}
+	return uris, rows.Err()
+}
@@ -0,0 +1,191 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/storage/tables"
+)
+
+const reportsSchema = `
+-- Stores reports of rooms and events made by local users
+CREATE TABLE IF NOT EXISTS roomserver_reports (
+    id BIGSERIAL PRIMARY KEY,
+    room_id TEXT NOT NULL,
+    -- The reported event, or empty if the room was reported
+    event_id TEXT NOT NULL DEFAULT '',
+    reporting_user_id TEXT NOT NULL,
+    -- The user ID of the sender of the reported event
+    event_sender TEXT NOT NULL DEFAULT '',
+    reason TEXT NOT NULL DEFAULT '',
+    score BIGINT,
+    -- The reported event as it was when the report was received
+    event_json TEXT NOT NULL DEFAULT '',
+    received_ts BIGINT NOT NULL,
+    resolved_by TEXT NOT NULL DEFAULT '',
+    resolved_ts BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS roomserver_reports_room_id_idx ON roomserver_reports(room_id);
+`
+
+const insertReportSQL = "" +
+	"INSERT INTO roomserver_reports (room_id, event_id, reporting_user_id, event_sender, reason, score, event_json, received_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id"
+
+// The filters of the reports list are ignored if the parameters are empty.
+const reportsFilterSQL = "" +
+	" WHERE ($1 = '' OR room_id = $1) AND ($2 = '' OR reporting_user_id = $2)" +
+	" AND ($3::BOOLEAN IS NULL OR (resolved_ts <> 0) = $3)"
+
+const reportColumnsSQL = "" +
+	"id, room_id, event_id, reporting_user_id, event_sender, reason, score, event_json, received_ts, resolved_by, resolved_ts"
+
+const selectReportsSQL = "" +
+	"SELECT " + reportColumnsSQL + " FROM roomserver_reports" + reportsFilterSQL +
+	" ORDER BY id ASC OFFSET $4 LIMIT $5"
+
+const selectReportsBackwardsSQL = "" +
+	"SELECT " + reportColumnsSQL + " FROM roomserver_reports" + reportsFilterSQL +
+	" ORDER BY id DESC OFFSET $4 LIMIT $5"
+
+const selectReportCountSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_reports" + reportsFilterSQL
+
+const selectReportSQL = "" +
+	"SELECT " + reportColumnsSQL + " FROM roomserver_reports WHERE id = $1"
+
+const updateReportResolvedSQL = "" +
+	"UPDATE roomserver_reports SET resolved_by = $2, resolved_ts = $3 WHERE id = $1 AND resolved_ts = 0"
+
+type reportsStatements struct {
+	insertReportStmt           *sql.Stmt
+	selectReportsStmt          *sql.Stmt
+	selectReportsBackwardsStmt *sql.Stmt
+	selectReportCountStmt      *sql.Stmt
+	selectReportStmt           *sql.Stmt
+	updateReportResolvedStmt   *sql.Stmt
+}
+
+func CreateReportsTable(db *sql.DB) error {
+	_, err := db.Exec(reportsSchema)
+	return err
+}
+
+func PrepareReportsTable(db *sql.DB) (tables.Reports, error) {
+	s := &reportsStatements{}
+
+	return s, sqlutil.StatementList{
+		{&s.insertReportStmt, insertReportSQL},
+		{&s.selectReportsStmt, selectReportsSQL},
+		{&s.selectReportsBackwardsStmt, selectReportsBackwardsSQL},
+		{&s.selectReportCountStmt, selectReportCountSQL},
+		{&s.selectReportStmt, selectReportSQL},
+		{&s.updateReportResolvedStmt, updateReportResolvedSQL},
+	}.Prepare(db)
+}
+
+func (s *reportsStatements) InsertReport(
+	ctx context.Context, txn *sql.Tx, report *api.Report,
+) (reportID int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.insertReportStmt)
+	err = stmt.QueryRowContext(
+		ctx, report.RoomID, report.EventID, report.ReportingUserID, report.EventSender,
+		report.Reason, report.Score, string(report.EventJSON), report.ReceivedTS,
+	).Scan(&reportID)
+	return
+}
+
+func (s *reportsStatements) SelectReports(
+	ctx context.Context, txn *sql.Tx, req *api.QueryAdminReportsRequest,
+) ([]api.Report, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectReportsStmt)
+	if req.Backwards {
+		stmt = sqlutil.TxStmt(txn, s.selectReportsBackwardsStmt)
+	}
+	rows, err := stmt.QueryContext(ctx, req.RoomID, req.UserID, resolvedFilter(req.Resolved), req.From, req.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectReportsStmt: rows.close() failed")
+
+	var reports []api.Report
+	for rows.Next() {
+		report, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, *report)
+	}
+	return reports, rows.Err()
+}
+
+func (s *reportsStatements) SelectReportCount(
+	ctx context.Context, txn *sql.Tx, req *api.QueryAdminReportsRequest,
+) (count int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectReportCountStmt)
+	err = stmt.QueryRowContext(ctx, req.RoomID, req.UserID, resolvedFilter(req.Resolved)).Scan(&count)
+	return
+}
+
+func (s *reportsStatements) SelectReport(
+	ctx context.Context, txn *sql.Tx, reportID int64,
+) (*api.Report, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectReportStmt)
+	report, err := scanReport(stmt.QueryRowContext(ctx, reportID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return report, err
+}
+
+func (s *reportsStatements) UpdateReportResolved(
+	ctx context.Context, txn *sql.Tx, reportID int64, resolvedBy string, resolvedTS spec.Timestamp,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateReportResolvedStmt)
+	_, err := stmt.ExecContext(ctx, reportID, resolvedBy, resolvedTS)
+	return err
+}
+
+func resolvedFilter(resolved *bool) sql.NullBool {
+	if resolved == nil {
+		return sql.NullBool{}
+	}
+	return sql.NullBool{Bool: *resolved, Valid: true}
+}
+
+func scanReport(row interface{ Scan(...interface{}) error }) (*api.Report, error) {
+	var report api.Report
+	var score sql.NullInt64
+	var eventJSON string
+	if err := row.Scan(
+		&report.ID, &report.RoomID, &report.EventID, &report.ReportingUserID, &report.EventSender,
+		&report.Reason, &score, &eventJSON, &report.ReceivedTS, &report.ResolvedBy, &report.ResolvedTS,
+	); err != nil {
+		return nil, err
+	}
+	if score.Valid {
+		report.Score = &score.Int64
+	}
+	if eventJSON != "" {
+		report.EventJSON = []byte(eventJSON)
+	}
+	return &report, nil
+}
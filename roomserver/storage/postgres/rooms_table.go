@@ -18,11 +18,13 @@ package postgres
 import (
 	"context"
 	"database/sql"
+	"fmt"
 
 	"github.com/lib/pq"
 	"github.com/neilalexander/harmony/internal"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/roomserver/storage/tables"
 	"github.com/neilalexander/harmony/roomserver/types"
 )
@@ -82,6 +84,28 @@ const bulkSelectRoomIDsSQL = "" +
 const bulkSelectRoomNIDsSQL = "" +
 	"SELECT room_nid FROM roomserver_rooms WHERE room_id = ANY($1)"
 
+// Rooms which only have a stub entry, e.g. because we were invited over
+// federation, have no latest events and aren't listed.
+var adminRoomColumnsSQL = "" +
+	"room_id, room_version, CARDINALITY(latest_event_nids)," +
+	" (SELECT COUNT(*) FROM roomserver_membership m WHERE m.room_nid = r.room_nid AND m.membership_nid = " + fmt.Sprintf("%d", tables.MembershipStateJoin) + ")," +
+	" (SELECT COUNT(*) FROM roomserver_membership m WHERE m.room_nid = r.room_nid AND m.membership_nid = " + fmt.Sprintf("%d", tables.MembershipStateJoin) + " AND m.target_local)" +
+	" FROM roomserver_rooms r"
+
+var selectAdminRoomsSQL = "" +
+	"SELECT " + adminRoomColumnsSQL + " WHERE CARDINALITY(latest_event_nids) > 0" +
+	" ORDER BY room_nid ASC OFFSET $1 LIMIT $2"
+
+var selectAdminRoomsByExtremitiesSQL = "" +
+	"SELECT " + adminRoomColumnsSQL + " WHERE CARDINALITY(latest_event_nids) > 0" +
+	" ORDER BY CARDINALITY(latest_event_nids) DESC, room_nid ASC OFFSET $1 LIMIT $2"
+
+var selectAdminRoomSQL = "" +
+	"SELECT " + adminRoomColumnsSQL + " WHERE room_id = $1 AND CARDINALITY(latest_event_nids) > 0"
+
+const selectAdminRoomCountSQL = "" +
+	"SELECT COUNT(*) FROM roomserver_rooms WHERE CARDINALITY(latest_event_nids) > 0"
+
 type roomStatements struct {
 	insertRoomNIDStmt                  *sql.Stmt
 	selectRoomNIDStmt                  *sql.Stmt
@@ -93,6 +117,10 @@ type roomStatements struct {
 	selectRoomInfoStmt                 *sql.Stmt
 	bulkSelectRoomIDsStmt              *sql.Stmt
 	bulkSelectRoomNIDsStmt             *sql.Stmt
+	selectAdminRoomsStmt               *sql.Stmt
+	selectAdminRoomsByExtremitiesStmt  *sql.Stmt
+	selectAdminRoomStmt                *sql.Stmt
+	selectAdminRoomCountStmt           *sql.Stmt
 }
 
 func CreateRoomsTable(db *sql.DB) error {
@@ -114,6 +142,10 @@ func PrepareRoomsTable(db *sql.DB) (tables.Rooms, error) {
 		{&s.selectRoomInfoStmt, selectRoomInfoSQL},
 		{&s.bulkSelectRoomIDsStmt, bulkSelectRoomIDsSQL},
 		{&s.bulkSelectRoomNIDsStmt, bulkSelectRoomNIDsSQL},
+		{&s.selectAdminRoomsStmt, selectAdminRoomsSQL},
+		{&s.selectAdminRoomsByExtremitiesStmt, selectAdminRoomsByExtremitiesSQL},
+		{&s.selectAdminRoomStmt, selectAdminRoomSQL},
+		{&s.selectAdminRoomCountStmt, selectAdminRoomCountSQL},
 	}.Prepare(db)
 }
 
@@ -287,3 +319,57 @@ func roomNIDsAsArray(roomNIDs []types.RoomNID) pq.Int64Array {
 	}
 	return nids
 }
+
+func (s *roomStatements) SelectAdminRooms(
+	ctx context.Context, txn *sql.Tx, req *api.QueryAdminRoomsRequest,
+) ([]api.AdminRoom, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectAdminRoomsStmt)
+	if req.OrderByForwardExtremities {
+		stmt = sqlutil.TxStmt(txn, s.selectAdminRoomsByExtremitiesStmt)
+	}
+	rows, err := stmt.QueryContext(ctx, req.From, req.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAdminRoomsStmt: rows.close() failed")
+
+	var rooms []api.AdminRoom
+	for rows.Next() {
+		room, err := scanAdminRoom(rows)
+		if err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, *room)
+	}
+	return rooms, rows.Err()
+}
+
+func (s *roomStatements) SelectAdminRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) (*api.AdminRoom, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectAdminRoomStmt)
+	room, err := scanAdminRoom(stmt.QueryRowContext(ctx, roomID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return room, err
+}
+
+func (s *roomStatements) SelectAdminRoomCount(
+	ctx context.Context, txn *sql.Tx,
+) (count int64, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectAdminRoomCountStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&count)
+	return
+}
+
+func scanAdminRoom(row interface{ Scan(...interface{}) error }) (*api.AdminRoom, error) {
+	var room api.AdminRoom
+	if err := row.Scan(
+		&room.RoomID, &room.RoomVersion, &room.ForwardExtremities,
+		&room.JoinedMembers, &room.JoinedLocalMembers,
+	); err != nil {
+		return nil, err
+	}
+	return &room, nil
+}
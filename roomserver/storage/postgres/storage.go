@@ -134,6 +134,12 @@ func (d *Database) create(db *sql.DB) error {
 	if err := CreateUserRoomKeysTable(db); err != nil {
 		return err
 	}
+	if err := CreateReportsTable(db); err != nil {
+		return err
+	}
+	if err := CreateBlockedRoomsTable(db); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -199,6 +205,14 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 	if err != nil {
 		return err
 	}
+	reports, err := PrepareReportsTable(db)
+	if err != nil {
+		return err
+	}
+	blockedRooms, err := PrepareBlockedRoomsTable(db)
+	if err != nil {
+		return err
+	}
 
 	d.Database = shared.Database{
 		DB: db,
@@ -224,6 +238,8 @@ func (d *Database) prepare(db *sql.DB, writer sqlutil.Writer, cache caching.Room
 		PublishedTable:     published,
 		Purge:              purge,
 		UserRoomKeyTable:   userRoomKeys,
+		ReportsTable:       reports,
+		BlockedRoomsTable:  blockedRooms,
 	}
 	return nil
 }
@@ -8,6 +8,7 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"time"
 
 	"github.com/matrix-org/util"
 	"github.com/neilalexander/harmony/internal/eventutil"
@@ -47,6 +48,8 @@ type Database struct {
 	PublishedTable     tables.Published
 	Purge              tables.Purge
 	UserRoomKeyTable   tables.UserRoomKeys
+	ReportsTable       tables.Reports
+	BlockedRoomsTable  tables.BlockedRooms
 	GetRoomUpdaterFn   func(ctx context.Context, roomInfo *types.RoomInfo) (*RoomUpdater, error)
 }
 
@@ -1355,6 +1358,8 @@ func (d *Database) GetRoomsByMembership(ctx context.Context, userID spec.UserID,
 		membershipState = tables.MembershipStateLeaveOrBan
 	case "ban":
 		membershipState = tables.MembershipStateLeaveOrBan
+	case "knock":
+		membershipState = tables.MembershipStateKnock
 	default:
 		return nil, fmt.Errorf("GetRoomsByMembership: invalid membership %s", membership)
 	}
@@ -1624,6 +1629,19 @@ func (d *Database) GetKnownUsers(ctx context.Context, userID, searchString strin
 	return d.MembershipTable.SelectKnownUsers(ctx, nil, stateKeyNID, searchString, limit)
 }
 
+// MediaURIsForRoom returns all MXC URIs referenced by events in the room.
+// Returns no URIs if the room is not known.
+func (d *Database) MediaURIsForRoom(ctx context.Context, roomID string) ([]string, error) {
+	roomInfo, err := d.roomInfo(ctx, nil, roomID)
+	if err != nil {
+		return nil, err
+	}
+	if roomInfo == nil {
+		return nil, nil
+	}
+	return d.EventJSONTable.SelectMediaURIsForRoom(ctx, nil, roomInfo.RoomNID)
+}
+
 func (d *Database) RoomsWithACLs(ctx context.Context) ([]string, error) {
 
 	eventTypeNID, err := d.GetOrCreateEventTypeNID(ctx, "m.room.server_acl")
@@ -1678,6 +1696,109 @@ func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
 	})
 }
 
+// InsertReport stores a report of a room or event, returning the ID of the report.
+func (d *Database) InsertReport(ctx context.Context, report *api.Report) (reportID int64, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		reportID, err = d.ReportsTable.InsertReport(ctx, txn, report)
+		return err
+	})
+	return
+}
+
+// GetReports returns a page of reports and the total number of reports matching the filters.
+func (d *Database) GetReports(ctx context.Context, req *api.QueryAdminReportsRequest) ([]api.Report, int64, error) {
+	reports, err := d.ReportsTable.SelectReports(ctx, nil, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := d.ReportsTable.SelectReportCount(ctx, nil, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	return reports, total, nil
+}
+
+// GetReport returns the report with the given ID, or nil if there isn't one.
+func (d *Database) GetReport(ctx context.Context, reportID int64) (*api.Report, error) {
+	return d.ReportsTable.SelectReport(ctx, nil, reportID)
+}
+
+// ResolveReport marks the report as resolved, unless it has already been resolved.
+func (d *Database) ResolveReport(ctx context.Context, reportID int64, resolvedBy string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.ReportsTable.UpdateReportResolved(ctx, txn, reportID, resolvedBy, spec.AsTimestamp(time.Now()))
+	})
+}
+
+// GetAdminRooms returns a page of rooms and the total number of rooms, not including stub rooms.
+func (d *Database) GetAdminRooms(ctx context.Context, req *api.QueryAdminRoomsRequest) ([]api.AdminRoom, int64, error) {
+	rooms, err := d.RoomsTable.SelectAdminRooms(ctx, nil, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := d.RoomsTable.SelectAdminRoomCount(ctx, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rooms, total, nil
+}
+
+// GetAdminRoom returns a summary of the room, or nil if the room is unknown or a stub.
+func (d *Database) GetAdminRoom(ctx context.Context, roomID string) (*api.AdminRoom, error) {
+	return d.RoomsTable.SelectAdminRoom(ctx, nil, roomID)
+}
+
+// RemoveForwardExtremities removes the given events from the latest events of
+// the room. Events which are no longer forward extremities are ignored, and at
+// least one forward extremity is always kept. The current state of the room is
+// left alone. Returns the number of forward extremities that were removed.
+func (d *Database) RemoveForwardExtremities(ctx context.Context, roomNID types.RoomNID, eventNIDs []types.EventNID) (removed int, err error) {
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		latest, lastEventSentNID, stateSnapshotNID, err := d.RoomsTable.SelectLatestEventsNIDsForUpdate(ctx, txn, roomNID)
+		if err != nil {
+			return err
+		}
+		remove := make(map[types.EventNID]struct{}, len(eventNIDs))
+		for _, eventNID := range eventNIDs {
+			remove[eventNID] = struct{}{}
+		}
+		keep := make([]types.EventNID, 0, len(latest))
+		for _, eventNID := range latest {
+			if _, ok := remove[eventNID]; !ok {
+				keep = append(keep, eventNID)
+			}
+		}
+		if len(keep) == 0 {
+			return fmt.Errorf("cannot remove all forward extremities")
+		}
+		if removed = len(latest) - len(keep); removed == 0 {
+			return nil
+		}
+		return d.RoomsTable.UpdateLatestEventNIDs(ctx, txn, roomNID, keep, lastEventSentNID, stateSnapshotNID)
+	})
+	return
+}
+
+// BlockRoom adds the room to the block list, or removes it if blocked is false.
+func (d *Database) BlockRoom(ctx context.Context, roomID, blockedBy string, blocked bool) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if !blocked {
+			return d.BlockedRoomsTable.DeleteBlockedRoom(ctx, txn, roomID)
+		}
+		return d.BlockedRoomsTable.InsertBlockedRoom(ctx, txn, roomID, blockedBy, spec.AsTimestamp(time.Now()))
+	})
+}
+
+// GetBlockedRoom returns the block of the room, or nil if the room isn't blocked.
+func (d *Database) GetBlockedRoom(ctx context.Context, roomID string) (*api.BlockedRoom, error) {
+	return d.BlockedRoomsTable.SelectBlockedRoom(ctx, nil, roomID)
+}
+
+// GetBlockedRooms returns all blocked rooms.
+func (d *Database) GetBlockedRooms(ctx context.Context) ([]api.BlockedRoom, error) {
+	return d.BlockedRoomsTable.SelectBlockedRooms(ctx, nil)
+}
+
 func (d *Database) UpgradeRoom(ctx context.Context, oldRoomID, newRoomID, eventSender string) error {
 
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
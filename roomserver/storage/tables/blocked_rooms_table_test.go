@@ -0,0 +1,71 @@
+package tables_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/storage/postgres"
+	"github.com/neilalexander/harmony/roomserver/storage/tables"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/test"
+)
+
+func mustCreateBlockedRoomsTable(t *testing.T, dbType test.DBType) (tab tables.BlockedRooms, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypePostgres:
+		err = postgres.CreateBlockedRoomsTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PrepareBlockedRoomsTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, close
+}
+
+func TestBlockedRoomsTable(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateBlockedRoomsTable(t, dbType)
+		defer close()
+
+		room := test.NewRoom(t, alice)
+		blocked, err := tab.SelectBlockedRoom(ctx, nil, room.ID)
+		assert.NoError(t, err)
+		assert.Nil(t, blocked)
+
+		err = tab.InsertBlockedRoom(ctx, nil, room.ID, alice.ID, 1)
+		assert.NoError(t, err)
+		// Blocking the room again keeps the original block
+		err = tab.InsertBlockedRoom(ctx, nil, room.ID, bob.ID, 2)
+		assert.NoError(t, err)
+
+		blocked, err = tab.SelectBlockedRoom(ctx, nil, room.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, alice.ID, blocked.BlockedBy)
+		assert.Equal(t, spec.Timestamp(1), blocked.BlockedTS)
+
+		rooms, err := tab.SelectBlockedRooms(ctx, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(rooms))
+		assert.Equal(t, room.ID, rooms[0].RoomID)
+
+		err = tab.DeleteBlockedRoom(ctx, nil, room.ID)
+		assert.NoError(t, err)
+		blocked, err = tab.SelectBlockedRoom(ctx, nil, room.ID)
+		assert.NoError(t, err)
+		assert.Nil(t, blocked)
+	})
+}
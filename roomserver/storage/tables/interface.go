@@ -10,6 +10,7 @@ import (
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/tidwall/gjson"
 
+	"github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/roomserver/types"
 )
 
@@ -24,6 +25,8 @@ type EventJSON interface {
 	// Insert the event JSON. On conflict, replace the event JSON with the new value (for redactions).
 	InsertEventJSON(ctx context.Context, tx *sql.Tx, eventNID types.EventNID, eventJSON []byte) error
 	BulkSelectEventJSON(ctx context.Context, tx *sql.Tx, eventNIDs []types.EventNID) ([]EventJSONPair, error)
+	// SelectMediaURIsForRoom returns all distinct MXC URIs referenced by events in the room.
+	SelectMediaURIsForRoom(ctx context.Context, tx *sql.Tx, roomNID types.RoomNID) ([]string, error)
 }
 
 type EventTypes interface {
@@ -84,6 +87,10 @@ type Rooms interface {
 	SelectRoomInfo(ctx context.Context, txn *sql.Tx, roomID string) (*types.RoomInfo, error)
 	BulkSelectRoomIDs(ctx context.Context, txn *sql.Tx, roomNIDs []types.RoomNID) ([]string, error)
 	BulkSelectRoomNIDs(ctx context.Context, txn *sql.Tx, roomIDs []string) ([]types.RoomNID, error)
+	SelectAdminRooms(ctx context.Context, txn *sql.Tx, req *api.QueryAdminRoomsRequest) ([]api.AdminRoom, error)
+	// SelectAdminRoom returns nil if the room is unknown or only a stub.
+	SelectAdminRoom(ctx context.Context, txn *sql.Tx, roomID string) (*api.AdminRoom, error)
+	SelectAdminRoomCount(ctx context.Context, txn *sql.Tx) (int64, error)
 }
 
 type StateSnapshot interface {
@@ -160,6 +167,24 @@ type Published interface {
 	SelectAllPublishedRooms(ctx context.Context, txn *sql.Tx, networkdID string, published, includeAllNetworks bool) ([]string, error)
 }
 
+type Reports interface {
+	InsertReport(ctx context.Context, txn *sql.Tx, report *api.Report) (int64, error)
+	SelectReports(ctx context.Context, txn *sql.Tx, req *api.QueryAdminReportsRequest) ([]api.Report, error)
+	SelectReportCount(ctx context.Context, txn *sql.Tx, req *api.QueryAdminReportsRequest) (int64, error)
+	// SelectReport returns the report with the given ID, or nil if there isn't one.
+	SelectReport(ctx context.Context, txn *sql.Tx, reportID int64) (*api.Report, error)
+	// UpdateReportResolved resolves the report, unless it has already been resolved.
+	UpdateReportResolved(ctx context.Context, txn *sql.Tx, reportID int64, resolvedBy string, resolvedTS spec.Timestamp) error
+}
+
+type BlockedRooms interface {
+	InsertBlockedRoom(ctx context.Context, txn *sql.Tx, roomID, blockedBy string, blockedTS spec.Timestamp) error
+	DeleteBlockedRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+	// SelectBlockedRoom returns nil if the room isn't blocked.
+	SelectBlockedRoom(ctx context.Context, txn *sql.Tx, roomID string) (*api.BlockedRoom, error)
+	SelectBlockedRooms(ctx context.Context, txn *sql.Tx) ([]api.BlockedRoom, error)
+}
+
 type RedactionInfo struct {
 	// whether this redaction is validated (we have both events)
 	Validated bool
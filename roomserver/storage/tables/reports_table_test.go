@@ -0,0 +1,123 @@
+package tables_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/roomserver/storage/postgres"
+	"github.com/neilalexander/harmony/roomserver/storage/tables"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/test"
+)
+
+func mustCreateReportsTable(t *testing.T, dbType test.DBType) (tab tables.Reports, close func()) {
+	t.Helper()
+	connStr, close := test.PrepareDBConnectionString(t, dbType)
+	db, err := sqlutil.Open(&config.DatabaseOptions{
+		ConnectionString: config.DataSource(connStr),
+	}, sqlutil.NewExclusiveWriter())
+	assert.NoError(t, err)
+	switch dbType {
+	case test.DBTypePostgres:
+		err = postgres.CreateReportsTable(db)
+		assert.NoError(t, err)
+		tab, err = postgres.PrepareReportsTable(db)
+	}
+	assert.NoError(t, err)
+
+	return tab, close
+}
+
+func TestReportsTable(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, close := mustCreateReportsTable(t, dbType)
+		defer close()
+
+		room := test.NewRoom(t, alice)
+		ev := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "spam"})
+		score := int64(-100)
+
+		eventReport := &api.Report{
+			RoomID:          room.ID,
+			EventID:         ev.EventID(),
+			ReportingUserID: bob.ID,
+			EventSender:     alice.ID,
+			Reason:          "spam",
+			Score:           &score,
+			EventJSON:       ev.JSON(),
+			ReceivedTS:      spec.AsTimestamp(time.Now()),
+		}
+		eventReportID, err := tab.InsertReport(ctx, nil, eventReport)
+		assert.NoError(t, err)
+
+		roomReportID, err := tab.InsertReport(ctx, nil, &api.Report{
+			RoomID:          room.ID,
+			ReportingUserID: alice.ID,
+			Reason:          "the whole room",
+			ReceivedTS:      spec.AsTimestamp(time.Now()),
+		})
+		assert.NoError(t, err)
+		assert.Greater(t, roomReportID, eventReportID)
+
+		report, err := tab.SelectReport(ctx, nil, eventReportID)
+		assert.NoError(t, err)
+		assert.Equal(t, ev.EventID(), report.EventID)
+		assert.Equal(t, alice.ID, report.EventSender)
+		assert.Equal(t, score, *report.Score)
+		assert.JSONEq(t, string(ev.JSON()), string(report.EventJSON))
+
+		report, err = tab.SelectReport(ctx, nil, roomReportID)
+		assert.NoError(t, err)
+		assert.Empty(t, report.EventID)
+		assert.Nil(t, report.Score)
+		assert.Nil(t, report.EventJSON)
+
+		// Unknown reports are returned as nil
+		report, err = tab.SelectReport(ctx, nil, roomReportID+1)
+		assert.NoError(t, err)
+		assert.Nil(t, report)
+
+		// Newest reports come first when paginating backwards
+		all := &api.QueryAdminReportsRequest{Limit: 10, Backwards: true}
+		reports, err := tab.SelectReports(ctx, nil, all)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(reports))
+		assert.Equal(t, roomReportID, reports[0].ID)
+		count, err := tab.SelectReportCount(ctx, nil, all)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), count)
+
+		byBob := &api.QueryAdminReportsRequest{Limit: 10, UserID: bob.ID}
+		reports, err = tab.SelectReports(ctx, nil, byBob)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(reports))
+		assert.Equal(t, eventReportID, reports[0].ID)
+
+		// Resolving a report a second time keeps the first resolution
+		err = tab.UpdateReportResolved(ctx, nil, eventReportID, alice.ID, 1)
+		assert.NoError(t, err)
+		err = tab.UpdateReportResolved(ctx, nil, eventReportID, bob.ID, 2)
+		assert.NoError(t, err)
+		report, err = tab.SelectReport(ctx, nil, eventReportID)
+		assert.NoError(t, err)
+		assert.Equal(t, alice.ID, report.ResolvedBy)
+		assert.Equal(t, spec.Timestamp(1), report.ResolvedTS)
+
+		resolved := false
+		unresolved := &api.QueryAdminReportsRequest{Limit: 10, Resolved: &resolved}
+		reports, err = tab.SelectReports(ctx, nil, unresolved)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(reports))
+		assert.Equal(t, roomReportID, reports[0].ID)
+	})
+}
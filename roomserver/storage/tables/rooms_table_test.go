@@ -6,6 +6,7 @@ import (
 
 	"github.com/matrix-org/util"
 	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/roomserver/storage/postgres"
 	"github.com/neilalexander/harmony/roomserver/storage/tables"
 	"github.com/neilalexander/harmony/roomserver/types"
@@ -116,3 +117,72 @@ func TestRoomsTable(t *testing.T) {
 		assert.Equal(t, types.StateSnapshotNID(1), snapshotNID)
 	})
 }
+
+func TestRoomsTableAdminRooms(t *testing.T) {
+	alice := test.NewUser(t)
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, close := test.PrepareDBConnectionString(t, dbType)
+		defer close()
+		db, err := sqlutil.Open(&config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		}, sqlutil.NewExclusiveWriter())
+		assert.NoError(t, err)
+		assert.NoError(t, postgres.CreateRoomsTable(db))
+		assert.NoError(t, postgres.CreateMembershipTable(db))
+		tab, err := postgres.PrepareRoomsTable(db)
+		assert.NoError(t, err)
+		membershipTab, err := postgres.PrepareMembershipTable(db)
+		assert.NoError(t, err)
+
+		room1 := test.NewRoom(t, alice)
+		room2 := test.NewRoom(t, alice)
+		room1NID, err := tab.InsertRoomNID(ctx, nil, room1.ID, room1.Version)
+		assert.NoError(t, err)
+		room2NID, err := tab.InsertRoomNID(ctx, nil, room2.ID, room2.Version)
+		assert.NoError(t, err)
+		// Stub rooms aren't listed
+		_, err = tab.InsertRoomNID(ctx, nil, util.RandomString(16), room1.Version)
+		assert.NoError(t, err)
+
+		err = tab.UpdateLatestEventNIDs(ctx, nil, room1NID, []types.EventNID{1}, 1, 1)
+		assert.NoError(t, err)
+		err = tab.UpdateLatestEventNIDs(ctx, nil, room2NID, []types.EventNID{2, 3, 4}, 4, 2)
+		assert.NoError(t, err)
+
+		// One local and one remote user are joined to the first room
+		for userNID, local := range map[types.EventStateKeyNID]bool{1: true, 2: false} {
+			err = membershipTab.InsertMembership(ctx, nil, room1NID, userNID, local)
+			assert.NoError(t, err)
+			_, err = membershipTab.UpdateMembership(ctx, nil, room1NID, userNID, userNID, tables.MembershipStateJoin, 1, false)
+			assert.NoError(t, err)
+		}
+
+		rooms, err := tab.SelectAdminRooms(ctx, nil, &api.QueryAdminRoomsRequest{Limit: 10})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, len(rooms))
+		assert.Equal(t, room1.ID, rooms[0].RoomID)
+		assert.Equal(t, room1.Version, rooms[0].RoomVersion)
+		assert.Equal(t, int64(1), rooms[0].ForwardExtremities)
+		assert.Equal(t, int64(2), rooms[0].JoinedMembers)
+		assert.Equal(t, int64(1), rooms[0].JoinedLocalMembers)
+
+		rooms, err = tab.SelectAdminRooms(ctx, nil, &api.QueryAdminRoomsRequest{Limit: 1, OrderByForwardExtremities: true})
+		assert.NoError(t, err)
+		assert.Equal(t, 1, len(rooms))
+		assert.Equal(t, room2.ID, rooms[0].RoomID)
+		assert.Equal(t, int64(3), rooms[0].ForwardExtremities)
+		assert.Equal(t, int64(0), rooms[0].JoinedMembers)
+
+		count, err := tab.SelectAdminRoomCount(ctx, nil)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), count)
+
+		room, err := tab.SelectAdminRoom(ctx, nil, room2.ID)
+		assert.NoError(t, err)
+		assert.Equal(t, room2.ID, room.RoomID)
+		room, err = tab.SelectAdminRoom(ctx, nil, "!doesnotexist:localhost")
+		assert.NoError(t, err)
+		assert.Nil(t, room)
+	})
+}
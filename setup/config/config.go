@@ -174,7 +174,7 @@ func loadConfig(
 		if v.KeyValidityPeriod == 0 {
 			v.KeyValidityPeriod = c.Global.KeyValidityPeriod
 		}
-		if v.PrivateKeyPath == "" || v.PrivateKey == nil || v.KeyID == "" {
+		if v.PrivateKeyPath == "" {
 			v.KeyID = c.Global.KeyID
 			v.PrivateKey = c.Global.PrivateKey
 			continue
@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"strings"
 	"time"
 )
 
@@ -55,6 +56,16 @@ type ClientAPI struct {
 	// Rate-limiting options
 	RateLimiting RateLimiting `yaml:"rate_limiting"`
 
+	// Single sign-on options
+	SSO SSO `yaml:"sso"`
+
+	// LDAP password authentication options
+	LDAP LDAP `yaml:"ldap"`
+
+	// If set, new reports of rooms and events are posted into this room
+	// by the server notices user.
+	ReportModeratorRoom string `yaml:"report_moderator_room"`
+
 	MSCs *MSCs `yaml:"-"`
 }
 
@@ -69,11 +80,26 @@ func (c *ClientAPI) Defaults(opts DefaultOpts) {
 	c.RegistrationDisabled = true
 	c.OpenRegistrationWithoutVerificationEnabled = false
 	c.RateLimiting.Defaults()
+	c.SSO.Defaults()
+	c.LDAP.Defaults()
 }
 
 func (c *ClientAPI) Verify(configErrs *ConfigErrors) {
 	c.TURN.Verify(configErrs)
 	c.RateLimiting.Verify(configErrs)
+	if c.SSO.CallbackURL == "" && c.Matrix != nil && c.Matrix.WellKnownClientName != "" {
+		c.SSO.CallbackURL = strings.TrimSuffix(c.Matrix.WellKnownClientName, "/") + "/_matrix/client/v3/login/sso/callback"
+	}
+	c.SSO.Verify(configErrs)
+	c.LDAP.Verify(configErrs)
+	if c.ReportModeratorRoom != "" {
+		if !strings.HasPrefix(c.ReportModeratorRoom, "!") {
+			configErrs.Add(fmt.Sprintf("invalid room ID for config key %q: %s", "client_api.report_moderator_room", c.ReportModeratorRoom))
+		}
+		if c.Matrix != nil && !c.Matrix.ServerNotices.Enabled {
+			configErrs.Add("client_api.report_moderator_room requires global.server_notices to be enabled")
+		}
+	}
 	if c.RecaptchaEnabled {
 		if c.RecaptchaSiteVerifyAPI == "" {
 			c.RecaptchaSiteVerifyAPI = "https://www.google.com/recaptcha/api/siteverify"
@@ -162,3 +188,154 @@ func (r *RateLimiting) Defaults() {
 	r.Threshold = 5
 	r.CooloffMS = 500
 }
+
+type SSO struct {
+	// Is single sign-on through the identity providers enabled?
+	Enabled bool `yaml:"enabled"`
+
+	// The URL that the identity providers redirect users back to after they
+	// have logged in. This has to be registered with the identity providers.
+	// Defaults to /_matrix/client/v3/login/sso/callback under the
+	// well_known_client_name.
+	CallbackURL string `yaml:"callback_url"`
+
+	// A list of URL prefixes that clients are redirected back to straight
+	// away after logging in. Users are asked to confirm that they trust any
+	// other client before it gets a login token.
+	ClientWhitelist []string `yaml:"client_whitelist"`
+
+	// The OpenID Connect identity providers that users can log in with.
+	Providers []IdentityProvider `yaml:"providers"`
+}
+
+type IdentityProvider struct {
+	// A unique ID for the identity provider, which is shown to clients and
+	// used to link users to local accounts. Don't change it once users have
+	// logged in.
+	ID string `yaml:"id"`
+
+	// The human readable name of the identity provider.
+	Name string `yaml:"name"`
+
+	// The issuer URL of the OpenID Connect provider, under which the
+	// /.well-known/openid-configuration discovery document is found.
+	Issuer string `yaml:"issuer"`
+
+	// The client credentials registered with the identity provider.
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+
+	// The scopes to request. Must include "openid".
+	Scopes []string `yaml:"scopes"`
+
+	// A Go template which derives the localpart of new users from the claims
+	// of their ID token, e.g. "{{ .preferred_username }}".
+	LocalpartTemplate string `yaml:"localpart_template"`
+
+	// A Go template which derives the display name of new users from the
+	// claims of their ID token, e.g. "{{ .name }}". Optional.
+	DisplayNameTemplate string `yaml:"display_name_template"`
+
+	// If set, users of the identity provider can log in as existing accounts
+	// which have the same localpart. Otherwise logging in fails if the
+	// localpart is already taken.
+	AllowExistingUsers bool `yaml:"allow_existing_users"`
+}
+
+func (c *SSO) Defaults() {
+	c.Enabled = false
+}
+
+func (c *SSO) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "client_api.sso.callback_url", c.CallbackURL)
+	if len(c.Providers) == 0 {
+		configErrs.Add("client_api.sso.providers must contain at least one identity provider")
+	}
+	ids := map[string]struct{}{}
+	for i := range c.Providers {
+		p := &c.Providers[i]
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "profile"}
+		}
+		if p.LocalpartTemplate == "" {
+			p.LocalpartTemplate = "{{ .preferred_username }}"
+		}
+		checkNotEmpty(configErrs, "client_api.sso.providers.id", p.ID)
+		checkNotEmpty(configErrs, "client_api.sso.providers.issuer", p.Issuer)
+		checkNotEmpty(configErrs, "client_api.sso.providers.client_id", p.ClientID)
+		if _, ok := ids[p.ID]; ok {
+			configErrs.Add(fmt.Sprintf("duplicate identity provider ID %q in client_api.sso.providers", p.ID))
+		}
+		if p.ID == "ldap" {
+			// LDAP accounts are linked to this identity provider ID.
+			configErrs.Add("identity provider ID \"ldap\" in client_api.sso.providers is reserved")
+		}
+		ids[p.ID] = struct{}{}
+		if p.Name == "" {
+			p.Name = p.ID
+		}
+	}
+}
+
+type LDAP struct {
+	// Are passwords checked against the LDAP directory? Passwords of local
+	// accounts are still checked if the LDAP directory doesn't accept them.
+	Enabled bool `yaml:"enabled"`
+
+	// The URI of the LDAP server, e.g. ldaps://ldap.example.com.
+	URI string `yaml:"uri"`
+
+	// Upgrade ldap:// connections to TLS with StartTLS.
+	StartTLS bool `yaml:"start_tls"`
+
+	// The DN under which the users are found.
+	BaseDN string `yaml:"base_dn"`
+
+	// The attribute which contains the username, which is used as the
+	// localpart of the user.
+	UIDAttribute string `yaml:"uid_attribute"`
+
+	// The attribute which contains the display name, which is copied to the
+	// profile of the user every time that they log in. Optional.
+	DisplayNameAttribute string `yaml:"display_name_attribute"`
+
+	// If set, the server binds with these credentials to search the base DN
+	// for the user, and then binds as the user that it found. Otherwise the
+	// server binds as <uid_attribute>=<username>,<base_dn> directly.
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+
+	// An additional search filter which users must match in order to log in,
+	// e.g. "(memberOf=cn=matrix,ou=groups,dc=example,dc=com)". Only used when
+	// searching for users.
+	Filter string `yaml:"filter"`
+
+	// If set, LDAP users can log in as existing local accounts which have the
+	// same localpart. Otherwise only accounts which were created by an LDAP
+	// login can be used.
+	AllowExistingUsers bool `yaml:"allow_existing_users"`
+}
+
+func (c *LDAP) Defaults() {
+	c.Enabled = false
+	c.UIDAttribute = "uid"
+	c.DisplayNameAttribute = "cn"
+}
+
+func (c *LDAP) Verify(configErrs *ConfigErrors) {
+	if !c.Enabled {
+		return
+	}
+	checkNotEmpty(configErrs, "client_api.ldap.uri", c.URI)
+	checkNotEmpty(configErrs, "client_api.ldap.base_dn", c.BaseDN)
+	checkNotEmpty(configErrs, "client_api.ldap.uid_attribute", c.UIDAttribute)
+	if !strings.HasPrefix(c.URI, "ldap://") && !strings.HasPrefix(c.URI, "ldaps://") {
+		configErrs.Add(fmt.Sprintf("invalid URI for config key %q: %s", "client_api.ldap.uri", c.URI))
+	}
+	if c.BindDN == "" && c.Filter != "" {
+		configErrs.Add("client_api.ldap.filter can only be used with client_api.ldap.bind_dn")
+	}
+}
@@ -19,7 +19,7 @@ type Global struct {
 	fclient.SigningIdentity `yaml:",inline"`
 
 	// The secondary server names, used for virtual hosting.
-	VirtualHosts []*VirtualHost `yaml:"-"`
+	VirtualHosts []*VirtualHost `yaml:"virtual_hosts"`
 
 	// Path to the private key which will be used to sign requests and events.
 	PrivateKeyPath Path `yaml:"private_key"`
@@ -49,7 +49,8 @@ type Global struct {
 	WellKnownClientName string `yaml:"well_known_client_name"`
 
 	// The server name to delegate sliding sync communications to, with optional port.
-	// Requires `well_known_client_name` to also be configured.
+	// Requires `well_known_client_name` to also be configured. This is only needed
+	// for clients which don't support the native simplified sliding sync API.
 	WellKnownSlidingSyncProxy string `yaml:"well_known_sliding_sync_proxy"`
 
 	// Disables federation. Dendrite will not be able to make any outbound HTTP requests
@@ -102,8 +103,13 @@ func (c *Global) Verify(configErrs *ConfigErrors) {
 		configErrs.Add("The configuration for well_known_client_name does not have a proper format, consider adding http:// or https://. Some clients may fail to connect.")
 	}
 
+	seen := map[spec.ServerName]struct{}{c.ServerName: {}}
 	for _, v := range c.VirtualHosts {
 		v.Verify(configErrs)
+		if _, ok := seen[v.ServerName]; ok {
+			configErrs.Add(fmt.Sprintf("duplicate server name %q in virtual_hosts", v.ServerName))
+		}
+		seen[v.ServerName] = struct{}{}
 	}
 
 	c.JetStream.Verify(configErrs)
@@ -159,6 +165,36 @@ func (c *Global) VirtualHostForHTTPHost(serverName spec.ServerName) *VirtualHost
 	return nil
 }
 
+// ServerNameForHTTPHost returns the server name that requests arriving with
+// the given HTTP Host header are for. This is the server name of the matching
+// virtual host, or the main server name if no virtual host matches.
+func (c *Global) ServerNameForHTTPHost(host spec.ServerName) spec.ServerName {
+	if v := c.VirtualHostForHTTPHost(host); v != nil {
+		return v.ServerName
+	}
+	return c.ServerName
+}
+
+// WellKnownServerNameForHTTPHost returns the m.server value to advertise at
+// /.well-known/matrix/server for the given HTTP Host header, falling back to
+// the global value if the virtual host doesn't set one.
+func (c *Global) WellKnownServerNameForHTTPHost(host spec.ServerName) string {
+	if v := c.VirtualHostForHTTPHost(host); v != nil && v.WellKnownServerName != "" {
+		return v.WellKnownServerName
+	}
+	return c.WellKnownServerName
+}
+
+// WellKnownClientNameForHTTPHost returns the m.homeserver base URL to advertise
+// at /.well-known/matrix/client for the given HTTP Host header, falling back to
+// the global value if the virtual host doesn't set one.
+func (c *Global) WellKnownClientNameForHTTPHost(host spec.ServerName) string {
+	if v := c.VirtualHostForHTTPHost(host); v != nil && v.WellKnownClientName != "" {
+		return v.WellKnownClientName
+	}
+	return c.WellKnownClientName
+}
+
 func (c *Global) SigningIdentityFor(serverName spec.ServerName) (*fclient.SigningIdentity, error) {
 	for _, id := range c.SigningIdentities() {
 		if id.ServerName == serverName {
@@ -203,10 +239,21 @@ type VirtualHost struct {
 
 	// Is guest registration enabled on this virtual host?
 	AllowGuests bool `yaml:"allow_guests"`
+
+	// The server name to delegate server-server communications to, with optional
+	// port. If not specified, the global well_known_server_name is used.
+	WellKnownServerName string `yaml:"well_known_server_name"`
+
+	// The server name to delegate client-server communications to, with optional
+	// port. If not specified, the global well_known_client_name is used.
+	WellKnownClientName string `yaml:"well_known_client_name"`
 }
 
 func (v *VirtualHost) Verify(configErrs *ConfigErrors) {
-	checkNotEmpty(configErrs, "virtual_host.*.server_name", string(v.ServerName))
+	checkNotEmpty(configErrs, "virtual_hosts.*.server_name", string(v.ServerName))
+	if v.WellKnownClientName != "" && !strings.HasPrefix(v.WellKnownClientName, "http://") && !strings.HasPrefix(v.WellKnownClientName, "https://") {
+		configErrs.Add(fmt.Sprintf("The configuration for well_known_client_name of virtual host %q does not have a proper format, consider adding http:// or https://. Some clients may fail to connect.", v.ServerName))
+	}
 }
 
 // RegistrationAllowed returns two bools, the first states whether registration
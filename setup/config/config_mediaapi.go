@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"net"
 )
 
 type MediaAPI struct {
@@ -22,6 +23,11 @@ type MediaAPI struct {
 	// Note: if max_file_size_bytes is not set, it will default to 10485760 (10MB)
 	MaxFileSizeBytes FileSizeBytes `yaml:"max_file_size_bytes,omitempty"`
 
+	// The default maximum number of bytes of media that each local user may
+	// store on this server, which can be overridden per user with the admin API.
+	// Note: if default_user_quota_bytes is 0 or not set, the quota is unlimited.
+	DefaultUserQuotaBytes FileSizeBytes `yaml:"default_user_quota_bytes,omitempty"`
+
 	// Whether to dynamically generate thumbnails on-the-fly if the requested resolution is not already generated
 	DynamicThumbnails bool `yaml:"dynamic_thumbnails"`
 
@@ -30,6 +36,140 @@ type MediaAPI struct {
 
 	// A list of thumbnail sizes to be pre-generated for downloaded remote / uploaded content
 	ThumbnailSizes []ThumbnailSize `yaml:"thumbnail_sizes"`
+
+	// Where media files and thumbnails are stored. Either "filesystem" (the
+	// default), which stores them under the base path, or "s3". The base path
+	// is still used for temporary files when using S3.
+	StorageBackend MediaStorageBackend `yaml:"storage_backend"`
+
+	// The configuration for the S3 storage backend.
+	S3 S3MediaStorage `yaml:"s3"`
+
+	// How long to keep media for before it is deleted by the retention job.
+	Retention MediaRetention `yaml:"retention"`
+
+	// The configuration for generating previews of URLs.
+	URLPreviews URLPreviews `yaml:"url_previews"`
+
+	// The configuration for downloading media from remote servers.
+	RemoteDownloads RemoteMediaDownloads `yaml:"remote_downloads"`
+
+	// The configuration for asynchronous uploads, where an MXC URI is created
+	// before the content is uploaded.
+	AsyncUploads AsyncUploads `yaml:"async_uploads"`
+}
+
+// AsyncUploads configures the /create endpoint, which reserves an MXC URI for
+// content which will be uploaded later.
+type AsyncUploads struct {
+	// The maximum number of reserved MXC URIs that a user may have which have
+	// not had content uploaded yet.
+	MaxPendingUploads int `yaml:"max_pending_uploads"`
+	// How long a reserved MXC URI is kept for if no content is uploaded to it.
+	UnusedExpiryMinutes int `yaml:"unused_expiry_minutes"`
+}
+
+// URLPreviews configures the /preview_url endpoint, which fetches web pages on
+// behalf of clients and returns their OpenGraph metadata.
+type URLPreviews struct {
+	// Whether URL previews are enabled.
+	Enabled bool `yaml:"enabled"`
+	// The maximum number of bytes of a page that will be downloaded and parsed.
+	MaxPageSizeBytes FileSizeBytes `yaml:"max_page_size_bytes"`
+	// How long to wait for a page to be fetched before giving up.
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+	// How long to cache a preview of a URL for.
+	CacheLifetimeMinutes int `yaml:"cache_lifetime_minutes"`
+	// IP ranges, in CIDR notation, that URL previews will never connect to.
+	// This should include any private ranges to prevent server-side request
+	// forgery against services on the local network.
+	IPRangeBlacklist []string `yaml:"ip_range_blacklist"`
+	// IP ranges, in CIDR notation, that are allowed even if they are covered
+	// by the blacklist.
+	IPRangeWhitelist []string `yaml:"ip_range_whitelist"`
+}
+
+// RemoteMediaDownloads configures how media is downloaded from remote servers.
+// Remote servers can redirect downloads to any URL, so the same IP range
+// restrictions as for URL previews apply.
+type RemoteMediaDownloads struct {
+	// How long to wait to connect to a server that media is redirected to,
+	// and for it to start responding. The download itself isn't limited.
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+	// IP ranges, in CIDR notation, that media downloads will never be
+	// redirected to.
+	IPRangeBlacklist []string `yaml:"ip_range_blacklist"`
+	// IP ranges, in CIDR notation, that are allowed even if they are covered
+	// by the blacklist.
+	IPRangeWhitelist []string `yaml:"ip_range_whitelist"`
+}
+
+// DefaultIPRangeBlacklist contains the loopback, private, link-local and other
+// special-purpose address ranges.
+var DefaultIPRangeBlacklist = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"169.254.0.0/16",
+	"192.88.99.0/24",
+	"198.18.0.0/15",
+	"192.0.2.0/24",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"0.0.0.0/8",
+	"255.255.255.255/32",
+	"::1/128",
+	"::/128",
+	"fe80::/10",
+	"fc00::/7",
+	"2001:db8::/32",
+	"ff00::/8",
+	"fec0::/10",
+}
+
+// MediaRetention configures the background job that deletes old media.
+// A lifetime of 0 means that media is kept forever.
+type MediaRetention struct {
+	// The number of days after which media cached from remote servers is deleted.
+	// It will be fetched again from the remote server if it is requested later.
+	RemoteMediaLifetimeDays int `yaml:"remote_media_lifetime_days"`
+	// The number of days after which media uploaded by local users is deleted.
+	LocalMediaLifetimeDays int `yaml:"local_media_lifetime_days"`
+}
+
+// Enabled returns whether the retention job has anything to do.
+func (c *MediaRetention) Enabled() bool {
+	return c.RemoteMediaLifetimeDays > 0 || c.LocalMediaLifetimeDays > 0
+}
+
+type MediaStorageBackend string
+
+const (
+	MediaStorageFilesystem MediaStorageBackend = "filesystem"
+	MediaStorageS3         MediaStorageBackend = "s3"
+)
+
+// S3MediaStorage configures a storage backend that speaks the S3 API, such as
+// Amazon S3, MinIO or Garage.
+type S3MediaStorage struct {
+	// The endpoint of the S3 service, e.g. https://s3.eu-west-1.amazonaws.com
+	Endpoint string `yaml:"endpoint"`
+	// The region that the bucket is in, e.g. eu-west-1.
+	Region string `yaml:"region"`
+	// The name of the bucket to store media in.
+	Bucket string `yaml:"bucket"`
+	// An optional prefix to prepend to the keys of all stored objects.
+	Prefix string `yaml:"prefix"`
+	// The credentials used to sign requests.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	// Whether to address the bucket as part of the path rather than as part
+	// of the hostname. Most self-hosted S3 implementations require this.
+	UsePathStyle bool `yaml:"use_path_style"`
 }
 
 // DefaultMaxFileSizeBytes defines the default file size allowed in transfers
@@ -38,6 +178,15 @@ var DefaultMaxFileSizeBytes = FileSizeBytes(10485760)
 func (c *MediaAPI) Defaults(opts DefaultOpts) {
 	c.MaxFileSizeBytes = DefaultMaxFileSizeBytes
 	c.MaxThumbnailGenerators = 10
+	c.StorageBackend = MediaStorageFilesystem
+	c.URLPreviews.MaxPageSizeBytes = DefaultMaxFileSizeBytes
+	c.URLPreviews.TimeoutSeconds = 10
+	c.URLPreviews.CacheLifetimeMinutes = 60
+	c.URLPreviews.IPRangeBlacklist = append([]string{}, DefaultIPRangeBlacklist...)
+	c.RemoteDownloads.TimeoutSeconds = 30
+	c.RemoteDownloads.IPRangeBlacklist = append([]string{}, DefaultIPRangeBlacklist...)
+	c.AsyncUploads.MaxPendingUploads = 5
+	c.AsyncUploads.UnusedExpiryMinutes = 24 * 60
 	if opts.Generate {
 		c.ThumbnailSizes = []ThumbnailSize{
 			{
@@ -67,13 +216,58 @@ func (c *MediaAPI) Verify(configErrs *ConfigErrors) {
 	checkNotEmpty(configErrs, "media_api.base_path", string(c.BasePath))
 	checkPositive(configErrs, "media_api.max_file_size_bytes", int64(c.MaxFileSizeBytes))
 	checkPositive(configErrs, "media_api.max_thumbnail_generators", int64(c.MaxThumbnailGenerators))
+	if c.DefaultUserQuotaBytes < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "media_api.default_user_quota_bytes", c.DefaultUserQuotaBytes))
+	}
 
 	for i, size := range c.ThumbnailSizes {
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].width", i), int64(size.Width))
 		checkPositive(configErrs, fmt.Sprintf("media_api.thumbnail_sizes[%d].height", i), int64(size.Height))
 	}
 
+	switch c.StorageBackend {
+	case MediaStorageFilesystem:
+	case MediaStorageS3:
+		checkNotEmpty(configErrs, "media_api.s3.endpoint", c.S3.Endpoint)
+		checkNotEmpty(configErrs, "media_api.s3.region", c.S3.Region)
+		checkNotEmpty(configErrs, "media_api.s3.bucket", c.S3.Bucket)
+		checkNotEmpty(configErrs, "media_api.s3.access_key_id", c.S3.AccessKeyID)
+		checkNotEmpty(configErrs, "media_api.s3.secret_access_key", c.S3.SecretAccessKey)
+	default:
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q", "media_api.storage_backend", c.StorageBackend))
+	}
+
+	if c.Retention.RemoteMediaLifetimeDays < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "media_api.retention.remote_media_lifetime_days", c.Retention.RemoteMediaLifetimeDays))
+	}
+	if c.Retention.LocalMediaLifetimeDays < 0 {
+		configErrs.Add(fmt.Sprintf("invalid value for config key %q: %d", "media_api.retention.local_media_lifetime_days", c.Retention.LocalMediaLifetimeDays))
+	}
+
+	checkPositive(configErrs, "media_api.async_uploads.max_pending_uploads", int64(c.AsyncUploads.MaxPendingUploads))
+	checkPositive(configErrs, "media_api.async_uploads.unused_expiry_minutes", int64(c.AsyncUploads.UnusedExpiryMinutes))
+
+	if c.URLPreviews.Enabled {
+		checkPositive(configErrs, "media_api.url_previews.max_page_size_bytes", int64(c.URLPreviews.MaxPageSizeBytes))
+		checkPositive(configErrs, "media_api.url_previews.timeout_seconds", int64(c.URLPreviews.TimeoutSeconds))
+		checkPositive(configErrs, "media_api.url_previews.cache_lifetime_minutes", int64(c.URLPreviews.CacheLifetimeMinutes))
+		checkCIDRs(configErrs, "media_api.url_previews.ip_range_blacklist", c.URLPreviews.IPRangeBlacklist)
+		checkCIDRs(configErrs, "media_api.url_previews.ip_range_whitelist", c.URLPreviews.IPRangeWhitelist)
+	}
+
+	checkPositive(configErrs, "media_api.remote_downloads.timeout_seconds", int64(c.RemoteDownloads.TimeoutSeconds))
+	checkCIDRs(configErrs, "media_api.remote_downloads.ip_range_blacklist", c.RemoteDownloads.IPRangeBlacklist)
+	checkCIDRs(configErrs, "media_api.remote_downloads.ip_range_whitelist", c.RemoteDownloads.IPRangeWhitelist)
+
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "media_api.database.connection_string", string(c.Database.ConnectionString))
 	}
 }
+
+func checkCIDRs(configErrs *ConfigErrors, key string, cidrs []string) {
+	for i, cidr := range cidrs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			configErrs.Add(fmt.Sprintf("invalid value for config key %q: %q", fmt.Sprintf("%s[%d]", key, i), cidr))
+		}
+	}
+}
@@ -22,11 +22,56 @@ type UserAPI struct {
 	// The number of workers to start for the DeviceListUpdater. Defaults to 8.
 	// This only needs updating if the "InputDeviceListUpdate" stream keeps growing indefinitely.
 	WorkerCount int `yaml:"worker_count"`
+
+	// How long access tokens are valid for, in milliseconds, if the client
+	// asked for a refresh token when logging in or registering. Access tokens
+	// issued without a refresh token never expire.
+	AccessTokenLifetimeMS int64 `yaml:"access_token_lifetime_ms"`
+
+	// Email configures the sending of notification emails to email pushers.
+	Email EmailNotifications `yaml:"email"`
+}
+
+// EmailNotifications configures the SMTP server which is used to send
+// notification emails to users who have set up an email pusher.
+type EmailNotifications struct {
+	// Whether notification emails are sent at all.
+	Enabled bool `yaml:"enabled"`
+	// Whether users can set up email pushers. The addresses of email pushers
+	// aren't verified, so this lets users send notification emails to any
+	// address.
+	AllowEmailPushers bool `yaml:"allow_email_pushers"`
+	// The SMTP server to send emails through, as host:port.
+	SMTPServer string `yaml:"smtp_server"`
+	// The username and password to authenticate to the SMTP server with. If
+	// the username is empty then no authentication is attempted.
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+	// Whether to refuse to send emails if the SMTP server doesn't support
+	// STARTTLS.
+	SMTPRequireTLS bool `yaml:"smtp_require_tls"`
+	// The address that notification emails are sent from.
+	From string `yaml:"from"`
+	// The name of the service, as it appears in notification emails.
+	AppName string `yaml:"app_name"`
+	// The base URL of a web client, used to link to rooms from notification
+	// emails. Links are left out if this is empty.
+	ClientBaseURL string `yaml:"client_base_url"`
+	// How long to wait after the first unread notification before sending a
+	// digest email. No email is sent if the user reads the notifications on
+	// another device in the meantime.
+	DigestDelaySeconds int `yaml:"digest_delay_seconds"`
+	// A directory containing notif_mail.txt and notif_mail.html templates,
+	// which replace the built-in templates if set.
+	TemplateDir Path `yaml:"template_dir"`
 }
 
 func (c *UserAPI) Defaults(opts DefaultOpts) {
 	c.BCryptCost = bcrypt.DefaultCost
 	c.WorkerCount = 8
+	c.AccessTokenLifetimeMS = 5 * 60 * 1000
+	c.Email.AppName = "Matrix"
+	c.Email.DigestDelaySeconds = 600
 	if opts.Generate {
 		if !opts.SingleDatabase {
 			c.AccountDatabase.ConnectionString = "file:userapi_accounts.db"
@@ -38,4 +83,10 @@ func (c *UserAPI) Verify(configErrs *ConfigErrors) {
 	if c.Matrix.DatabaseOptions.ConnectionString == "" {
 		checkNotEmpty(configErrs, "user_api.account_database.connection_string", string(c.AccountDatabase.ConnectionString))
 	}
+	checkPositive(configErrs, "user_api.access_token_lifetime_ms", c.AccessTokenLifetimeMS)
+	if c.Email.Enabled {
+		checkNotEmpty(configErrs, "user_api.email.smtp_server", c.Email.SMTPServer)
+		checkNotEmpty(configErrs, "user_api.email.from", c.Email.From)
+		checkPositive(configErrs, "user_api.email.digest_delay_seconds", int64(c.Email.DigestDelaySeconds))
+	}
 }
@@ -31,6 +31,7 @@ var (
 	RequestPresence         = "GetPresence"
 	OutputPresenceEvent     = "OutputPresenceEvent"
 	InputFulltextReindex    = "InputFulltextReindex"
+	TransactionCache        = "TransactionCache"
 )
 
 var safeCharacters = regexp.MustCompile("[^A-Za-z0-9$]+")
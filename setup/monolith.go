@@ -32,6 +32,7 @@ import (
 	"github.com/neilalexander/harmony/setup/process"
 	"github.com/neilalexander/harmony/syncapi"
 	userapi "github.com/neilalexander/harmony/userapi/api"
+	"github.com/sirupsen/logrus"
 )
 
 // Monolith represents an instantiation of all dependencies required to build
@@ -65,14 +66,24 @@ func (m *Monolith) AddAllPublicRoutes(
 	if userDirectoryProvider == nil {
 		userDirectoryProvider = m.UserAPI
 	}
+	// Transactions are deduplicated using a key-value bucket in NATS, so that
+	// retries which reach another instance or arrive after a restart are
+	// still recognised.
+	js, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+	txnCache, err := transactions.NewJetStream(
+		js, cfg.Global.JetStream.Prefixed(jetstream.TransactionCache), cfg.Global.JetStream.InMemory,
+	)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to create transaction cache")
+	}
 	clientapi.AddPublicRoutes(
-		processCtx, routers, cfg, natsInstance, m.FedClient, m.RoomserverAPI, transactions.New(),
+		processCtx, routers, cfg, natsInstance, m.FedClient, m.RoomserverAPI, txnCache,
 		m.FederationAPI, m.UserAPI, userDirectoryProvider,
 		m.ExtPublicRoomsProvider, enableMetrics,
 	)
 	federationapi.AddPublicRoutes(
-		processCtx, routers, cfg, natsInstance, m.UserAPI, m.FedClient, m.KeyRing, m.RoomserverAPI, m.FederationAPI, enableMetrics,
+		processCtx, routers, cfg, natsInstance, m.UserAPI, m.FedClient, m.KeyRing, m.RoomserverAPI, m.FederationAPI, txnCache, enableMetrics,
 	)
-	mediaapi.AddPublicRoutes(routers.Media, cm, cfg, m.UserAPI, m.Client)
-	syncapi.AddPublicRoutes(processCtx, routers, cfg, cm, natsInstance, m.UserAPI, m.RoomserverAPI, caches, enableMetrics)
+	mediaapi.AddPublicRoutes(routers, cm, cfg, m.UserAPI, m.RoomserverAPI, m.Client, m.FedClient, m.KeyRing)
+	syncapi.AddPublicRoutes(processCtx, routers, cfg, cm, natsInstance, m.UserAPI, m.RoomserverAPI, caches, m.FedClient, m.KeyRing, m.FederationAPI, enableMetrics)
 }
@@ -0,0 +1,250 @@
+package setup
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/neilalexander/harmony/federationapi"
+	"github.com/neilalexander/harmony/internal/caching"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/httputil"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/setup/jetstream"
+	"github.com/neilalexander/harmony/test"
+	"github.com/neilalexander/harmony/test/testrig"
+	"github.com/neilalexander/harmony/userapi"
+)
+
+func TestVirtualHosts(t *testing.T) {
+	const remoteServerName = spec.ServerName("remote")
+	const remoteKeyID = gomatrixserverlib.KeyID("ed25519:remote")
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		defer close()
+		cfg.ClientAPI.RateLimiting.Enabled = false
+		cfg.ClientAPI.RegistrationDisabled = false
+		cfg.Global.VirtualHosts = append(cfg.Global.VirtualHosts, &config.VirtualHost{
+			SigningIdentity: fclient.SigningIdentity{
+				ServerName: "vh1",
+				KeyID:      "ed25519:vh1",
+				PrivateKey: test.PrivateKeyB,
+			},
+			KeyValidityPeriod: time.Hour,
+			AllowRegistration: true,
+		})
+		if err := cfg.Derive(); err != nil {
+			t.Fatalf("failed to derive config: %s", err)
+		}
+
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		routers := httputil.NewRouters()
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		natsInstance := jetstream.NATSInstance{}
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		fsAPI := federationapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, nil, rsAPI, caches, nil, true)
+		keyRing := fsAPI.KeyRing()
+		rsAPI.SetFederationAPI(fsAPI, keyRing)
+		userAPI := userapi.NewInternalAPI(processCtx, cfg, cm, &natsInstance, rsAPI, nil, caching.DisableMetrics, fsAPI.IsBlacklistedOrBackingOff)
+		rsAPI.SetUserAPI(userAPI)
+
+		monolith := Monolith{
+			Config:        cfg,
+			KeyRing:       keyRing,
+			FederationAPI: fsAPI,
+			RoomserverAPI: rsAPI,
+			UserAPI:       userAPI,
+		}
+		monolith.AddAllPublicRoutes(processCtx, cfg, routers, cm, &natsInstance, caches, caching.DisableMetrics)
+
+		// Let the remote server make signed federation requests to us.
+		if err := fsAPI.StoreKeys(context.Background(), map[gomatrixserverlib.PublicKeyLookupRequest]gomatrixserverlib.PublicKeyLookupResult{
+			{ServerName: remoteServerName, KeyID: remoteKeyID}: {
+				VerifyKey:    gomatrixserverlib.VerifyKey{Key: spec.Base64Bytes(test.PrivateKeyA.Public().(ed25519.PublicKey))},
+				ExpiredTS:    gomatrixserverlib.PublicKeyNotExpired,
+				ValidUntilTS: spec.AsTimestamp(time.Now().Add(time.Hour)),
+			},
+		}); err != nil {
+			t.Fatalf("failed to store remote server keys: %s", err)
+		}
+
+		serve := func(router http.Handler, host, method, path, accessToken string, body interface{}) *httptest.ResponseRecorder {
+			t.Helper()
+			var reqBody string
+			if body != nil {
+				b, err := json.Marshal(body)
+				if err != nil {
+					t.Fatalf("failed to marshal request body: %s", err)
+				}
+				reqBody = string(b)
+			}
+			req := httptest.NewRequest(method, path, strings.NewReader(reqBody))
+			req.Host = host
+			if accessToken != "" {
+				req.Header.Set("Authorization", "Bearer "+accessToken)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			return rec
+		}
+
+		serveFederation := func(destination spec.ServerName, method, path string, body interface{}) *httptest.ResponseRecorder {
+			t.Helper()
+			fedReq := fclient.NewFederationRequest(method, remoteServerName, destination, path)
+			if body != nil {
+				if err := fedReq.SetContent(body); err != nil {
+					t.Fatalf("failed to set federation request content: %s", err)
+				}
+			}
+			if err := fedReq.Sign(remoteServerName, remoteKeyID, test.PrivateKeyA); err != nil {
+				t.Fatalf("failed to sign federation request: %s", err)
+			}
+			httpReq, err := fedReq.HTTPRequest()
+			if err != nil {
+				t.Fatalf("failed to create federation request: %s", err)
+			}
+			rec := httptest.NewRecorder()
+			routers.Federation.ServeHTTP(rec, httpReq)
+			return rec
+		}
+
+		hosts := []struct {
+			serverName spec.ServerName
+			keyID      gomatrixserverlib.KeyID
+			publicKey  ed25519.PublicKey
+		}{
+			{serverName: cfg.Global.ServerName, keyID: cfg.Global.KeyID, publicKey: cfg.Global.PrivateKey.Public().(ed25519.PublicKey)},
+			{serverName: "vh1", keyID: "ed25519:vh1", publicKey: test.PrivateKeyB.Public().(ed25519.PublicKey)},
+		}
+
+		// Every host gets a user with the same localpart, so that mixing up
+		// the hosts anywhere shows up as the wrong user.
+		password := "correcthorsebatterystaple"
+		for _, host := range hosts {
+			host := host
+			userID := "@alice:" + string(host.serverName)
+			displayName := "Alice on " + string(host.serverName)
+
+			t.Run(string(host.serverName), func(t *testing.T) {
+				rec := serve(routers.Client, string(host.serverName), http.MethodPost, "/_matrix/client/v3/register", "", map[string]interface{}{
+					"username": "alice",
+					"password": password,
+					"auth":     map[string]string{"type": "m.login.dummy"},
+				})
+				if rec.Code != http.StatusOK {
+					t.Fatalf("failed to register: %d %s", rec.Code, rec.Body.String())
+				}
+				if got := gjson.Get(rec.Body.String(), "user_id").Str; got != userID {
+					t.Fatalf("registered as %q, want %q", got, userID)
+				}
+
+				rec = serve(routers.Client, string(host.serverName), http.MethodPost, "/_matrix/client/v3/login", "", map[string]interface{}{
+					"type":       "m.login.password",
+					"identifier": map[string]string{"type": "m.id.user", "user": "alice"},
+					"password":   password,
+				})
+				if rec.Code != http.StatusOK {
+					t.Fatalf("failed to login: %d %s", rec.Code, rec.Body.String())
+				}
+				if got := gjson.Get(rec.Body.String(), "user_id").Str; got != userID {
+					t.Fatalf("logged in as %q, want %q", got, userID)
+				}
+				accessToken := gjson.Get(rec.Body.String(), "access_token").Str
+				deviceID := gjson.Get(rec.Body.String(), "device_id").Str
+
+				rec = serve(routers.Keys, string(host.serverName), http.MethodGet, "/_matrix/key/v2/server", "", nil)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("failed to get server keys: %d %s", rec.Code, rec.Body.String())
+				}
+				if got := gjson.Get(rec.Body.String(), "server_name").Str; got != string(host.serverName) {
+					t.Fatalf("got server keys for %q, want %q", got, host.serverName)
+				}
+				var keys gomatrixserverlib.ServerKeys
+				if err := json.Unmarshal(rec.Body.Bytes(), &keys); err != nil {
+					t.Fatalf("failed to unmarshal server keys: %s", err)
+				}
+				if key, ok := keys.VerifyKeys[host.keyID]; !ok || !ed25519.PublicKey(key.Key).Equal(host.publicKey) {
+					t.Fatalf("server keys don't contain %q: %s", host.keyID, rec.Body.String())
+				}
+				if err := gomatrixserverlib.VerifyJSON(string(host.serverName), host.keyID, host.publicKey, rec.Body.Bytes()); err != nil {
+					t.Fatalf("server keys aren't signed by %q: %s", host.keyID, err)
+				}
+
+				rec = serve(routers.Client, string(host.serverName), http.MethodPut, "/_matrix/client/v3/profile/"+url.PathEscape(userID)+"/displayname", accessToken, map[string]string{
+					"displayname": displayName,
+				})
+				if rec.Code != http.StatusOK {
+					t.Fatalf("failed to set display name: %d %s", rec.Code, rec.Body.String())
+				}
+
+				rec = serve(routers.Client, string(host.serverName), http.MethodGet, "/_matrix/client/v3/profile/"+url.PathEscape(userID), "", nil)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("failed to get profile: %d %s", rec.Code, rec.Body.String())
+				}
+				if got := gjson.Get(rec.Body.String(), "displayname").Str; got != displayName {
+					t.Fatalf("got display name %q, want %q", got, displayName)
+				}
+
+				rec = serveFederation(host.serverName, http.MethodGet, "/_matrix/federation/v1/query/profile?user_id="+url.QueryEscape(userID), nil)
+				if rec.Code != http.StatusOK {
+					t.Fatalf("failed to query profile over federation: %d %s", rec.Code, rec.Body.String())
+				}
+				if got := gjson.Get(rec.Body.String(), "displayname").Str; got != displayName {
+					t.Fatalf("got display name %q over federation, want %q", got, displayName)
+				}
+
+				keyID := "ed25519:" + deviceID
+				otkID := "signed_curve25519:AAAAAQ"
+				rec = serve(routers.Client, string(host.serverName), http.MethodPost, "/_matrix/client/v3/keys/upload", accessToken, map[string]interface{}{
+					"device_keys": map[string]interface{}{
+						"user_id":    userID,
+						"device_id":  deviceID,
+						"algorithms": []string{"m.olm.v1.curve25519-aes-sha2"},
+						"keys":       map[string]string{keyID: "key-on-" + string(host.serverName)},
+					},
+					"one_time_keys": map[string]interface{}{
+						otkID: map[string]string{"key": "otk-on-" + string(host.serverName)},
+					},
+				})
+				if rec.Code != http.StatusOK {
+					t.Fatalf("failed to upload keys: %d %s", rec.Code, rec.Body.String())
+				}
+
+				rec = serveFederation(host.serverName, http.MethodPost, "/_matrix/federation/v1/user/keys/query", map[string]interface{}{
+					"device_keys": map[string][]string{userID: {}},
+				})
+				if rec.Code != http.StatusOK {
+					t.Fatalf("failed to query device keys over federation: %d %s", rec.Code, rec.Body.String())
+				}
+				keysPath := "device_keys." + gjson.Escape(userID) + "." + gjson.Escape(deviceID) + ".keys." + gjson.Escape(keyID)
+				if got := gjson.Get(rec.Body.String(), keysPath).Str; got != "key-on-"+string(host.serverName) {
+					t.Fatalf("got device key %q over federation: %s", got, rec.Body.String())
+				}
+
+				rec = serveFederation(host.serverName, http.MethodPost, "/_matrix/federation/v1/user/keys/claim", map[string]interface{}{
+					"one_time_keys": map[string]map[string]string{userID: {deviceID: "signed_curve25519"}},
+				})
+				if rec.Code != http.StatusOK {
+					t.Fatalf("failed to claim one-time keys over federation: %d %s", rec.Code, rec.Body.String())
+				}
+				otkPath := "one_time_keys." + gjson.Escape(userID) + "." + gjson.Escape(deviceID) + "." + gjson.Escape(otkID) + ".key"
+				if got := gjson.Get(rec.Body.String(), otkPath).Str; got != "otk-on-"+string(host.serverName) {
+					t.Fatalf("claimed one-time key %q over federation: %s", got, rec.Body.String())
+				}
+			})
+		}
+	})
+}
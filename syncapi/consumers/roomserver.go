@@ -53,6 +53,7 @@ type OutputRoomEventConsumer struct {
 	db           storage.Database
 	pduStream    streams.StreamProvider
 	inviteStream streams.StreamProvider
+	knockStream  streams.StreamProvider
 	notifier     *notifier.Notifier
 	fts          fulltext.Indexer
 	asProducer   *producers.AppserviceEventProducer
@@ -67,6 +68,7 @@ func NewOutputRoomEventConsumer(
 	notifier *notifier.Notifier,
 	pduStream streams.StreamProvider,
 	inviteStream streams.StreamProvider,
+	knockStream streams.StreamProvider,
 	rsAPI api.SyncRoomserverAPI,
 	fts *fulltext.Search,
 ) *OutputRoomEventConsumer {
@@ -80,6 +82,7 @@ func NewOutputRoomEventConsumer(
 		notifier:     notifier,
 		pduStream:    pduStream,
 		inviteStream: inviteStream,
+		knockStream:  knockStream,
 		rsAPI:        rsAPI,
 		fts:          fts,
 	}
@@ -131,6 +134,10 @@ func (s *OutputRoomEventConsumer) onMessage(ctx context.Context, msgs []*nats.Ms
 		s.onNewInviteEvent(s.ctx, *output.NewInviteEvent)
 	case api.OutputTypeRetireInviteEvent:
 		s.onRetireInviteEvent(s.ctx, *output.RetireInviteEvent)
+	case api.OutputTypeNewKnockEvent:
+		s.onNewKnockEvent(s.ctx, *output.NewKnockEvent)
+	case api.OutputTypeRetireKnockEvent:
+		s.onRetireKnockEvent(s.ctx, *output.RetireKnockEvent)
 	case api.OutputTypeRedactedEvent:
 		err = s.onRedactEvent(s.ctx, *output.RedactedEvent)
 	case api.OutputTypePurgeRoom:
@@ -432,6 +439,89 @@ func (s *OutputRoomEventConsumer) onRetireInviteEvent(
 	s.notifier.OnNewInvite(types.StreamingToken{InvitePosition: pduPos}, userID.String())
 }
 
+func (s *OutputRoomEventConsumer) onNewKnockEvent(
+	ctx context.Context, msg api.OutputNewKnockEvent,
+) {
+	if msg.Event.StateKey() == nil {
+		return
+	}
+
+	userID, err := s.rsAPI.QueryUserIDForSender(ctx, msg.Event.RoomID(), spec.SenderID(*msg.Event.StateKey()))
+	if err != nil || userID == nil {
+		return
+	}
+	if !s.cfg.Matrix.IsLocalServerName(userID.Domain()) {
+		return
+	}
+
+	msg.Event.UserID = *userID
+
+	pduPos, err := s.db.AddKnockEvent(ctx, msg.Event)
+	if err != nil {
+		// panic rather than continue with an inconsistent database
+		log.WithFields(log.Fields{
+			"event_id":   msg.Event.EventID(),
+			"event":      string(msg.Event.JSON()),
+			"pdupos":     pduPos,
+			log.ErrorKey: err,
+		}).Errorf("roomserver output log: write knock failure")
+		return
+	}
+
+	s.knockStream.Advance(pduPos)
+	s.notifier.OnNewKnock(types.StreamingToken{KnockPosition: pduPos}, userID.String())
+}
+
+func (s *OutputRoomEventConsumer) onRetireKnockEvent(
+	ctx context.Context, msg api.OutputRetireKnockEvent,
+) {
+	validRoomID, err := spec.NewRoomID(msg.RoomID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"room_id":    msg.RoomID,
+			log.ErrorKey: err,
+		}).Errorf("roomID is invalid")
+		return
+	}
+	userID, err := s.rsAPI.QueryUserIDForSender(ctx, *validRoomID, msg.TargetSenderID)
+	if err != nil || userID == nil {
+		log.WithFields(log.Fields{
+			"room_id":    msg.RoomID,
+			"sender_id":  msg.TargetSenderID,
+			log.ErrorKey: err,
+		}).Errorf("failed to find userID for sender")
+		return
+	}
+	if !s.cfg.Matrix.IsLocalServerName(userID.Domain()) {
+		return
+	}
+
+	pduPos, err := s.db.RetireKnockEvent(ctx, msg.RoomID, userID.String())
+	// It's possible we just haven't heard of this knock yet, so
+	// we should not panic if we try to retire it.
+	if err != nil && err != sql.ErrNoRows {
+		// panic rather than continue with an inconsistent database
+		log.WithFields(log.Fields{
+			"room_id":    msg.RoomID,
+			"user_id":    userID.String(),
+			log.ErrorKey: err,
+		}).Errorf("roomserver output log: remove knock failure")
+		return
+	}
+
+	// Only notify clients about retired knocks if the user wasn't let into
+	// the room. The PDU and invite streams will tell the client about the new
+	// membership, so there should be a "smooth" transition from knock -> invite
+	// or knock -> join, and not knock -> leave -> join.
+	if msg.Membership == spec.Join || msg.Membership == spec.Invite {
+		return
+	}
+
+	// Notify any active sync requests that the knock has been retired.
+	s.knockStream.Advance(pduPos)
+	s.notifier.OnNewKnock(types.StreamingToken{KnockPosition: pduPos}, userID.String())
+}
+
 func (s *OutputRoomEventConsumer) onPurgeRoom(
 	ctx context.Context, req api.OutputPurgeRoom,
 ) error {
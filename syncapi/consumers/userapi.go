@@ -88,7 +88,7 @@ func (s *OutputNotificationDataConsumer) onMessage(ctx context.Context, msgs []*
 		return true
 	}
 
-	streamPos, err := s.db.UpsertRoomUnreadNotificationCounts(ctx, userID, data.RoomID, data.UnreadNotificationCount, data.UnreadHighlightCount)
+	streamPos, err := s.db.UpsertRoomUnreadNotificationCounts(ctx, userID, data.RoomID, data.UnreadNotificationCount, data.UnreadHighlightCount, data.Threads)
 	if err != nil {
 		log.WithFields(log.Fields{
 			"user_id": userID,
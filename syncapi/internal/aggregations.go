@@ -0,0 +1,229 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/syncapi/storage"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
+	"github.com/neilalexander/harmony/syncapi/types"
+)
+
+// Relation types which are bundled into the events they refer to.
+const (
+	RelationTypeThread    = "m.thread"
+	RelationTypeReplace   = "m.replace"
+	RelationTypeReference = "m.reference"
+)
+
+// ThreadAggregation is the bundled "m.thread" aggregation of a thread root.
+// https://spec.matrix.org/v1.11/client-server-api/#server-side-aggregation-of-mthread-relationships
+type ThreadAggregation struct {
+	LatestEvent             synctypes.ClientEvent `json:"latest_event"`
+	Count                   int                   `json:"count"`
+	CurrentUserParticipated bool                  `json:"current_user_participated"`
+}
+
+// ReferenceAggregation is the bundled "m.reference" aggregation of an event.
+// https://spec.matrix.org/v1.11/client-server-api/#server-side-aggregation-of-mreference-relationships
+type ReferenceAggregation struct {
+	Chunk []ReferenceChunk `json:"chunk"`
+}
+
+type ReferenceChunk struct {
+	EventID string `json:"event_id"`
+}
+
+// BundleAggregations adds bundled aggregations to the "unsigned" section of the
+// given client events, all of which must belong to the given room. The
+// aggregations for all of the events are looked up at once. Any latest events
+// and replacements that are bundled are converted using the given event format.
+func BundleAggregations(
+	ctx context.Context, snapshot storage.DatabaseTransaction, rsAPI api.SyncRoomserverAPI,
+	userID spec.UserID, roomID string, events []synctypes.ClientEvent, format synctypes.ClientEventFormat,
+) error {
+	if len(events) == 0 {
+		return nil
+	}
+	validRoomID, err := spec.NewRoomID(roomID)
+	if err != nil {
+		return err
+	}
+
+	// Thread participation is worked out from the senders of events, so we need
+	// to know the sender ID of the user in this room.
+	var senderID string
+	if id, queryErr := rsAPI.QuerySenderIDForUser(ctx, *validRoomID, userID); queryErr == nil && id != nil {
+		senderID = string(*id)
+	}
+
+	eventIDs := make([]string, 0, len(events))
+	for _, ev := range events {
+		eventIDs = append(eventIDs, ev.EventID)
+	}
+	summaries, err := snapshot.ThreadSummaries(ctx, roomID, eventIDs, senderID)
+	if err != nil {
+		return fmt.Errorf("snapshot.ThreadSummaries: %w", err)
+	}
+	relations, err := snapshot.RelationsForEvents(ctx, roomID, eventIDs, []string{RelationTypeReplace, RelationTypeReference})
+	if err != nil {
+		return fmt.Errorf("snapshot.RelationsForEvents: %w", err)
+	}
+	if len(summaries) == 0 && len(relations) == 0 {
+		return nil
+	}
+
+	// Fetch the latest thread events and all of the candidate replacements in
+	// one go, since we need to look at their contents.
+	wantEventIDs := make([]string, 0, len(summaries))
+	for _, summary := range summaries {
+		wantEventIDs = append(wantEventIDs, summary.LatestEventID)
+	}
+	for _, rels := range relations {
+		for _, entry := range rels[RelationTypeReplace] {
+			wantEventIDs = append(wantEventIDs, entry.EventID)
+		}
+	}
+	relatedClientEvents := make(map[string]*synctypes.ClientEvent, len(wantEventIDs))
+	if len(wantEventIDs) > 0 {
+		relatedEvents, eventsErr := snapshot.Events(ctx, wantEventIDs)
+		if eventsErr != nil {
+			return fmt.Errorf("snapshot.Events: %w", eventsErr)
+		}
+		for _, ev := range relatedEvents {
+			clientEvent, convertErr := synctypes.ToClientEvent(ev.PDU, format, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+				return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
+			})
+			if convertErr != nil {
+				return fmt.Errorf("synctypes.ToClientEvent: %w", convertErr)
+			}
+			relatedClientEvents[ev.EventID()] = clientEvent
+		}
+	}
+
+	for i := range events {
+		if summary, ok := summaries[events[i].EventID]; ok {
+			if latestEvent, ok := relatedClientEvents[summary.LatestEventID]; ok {
+				aggregation, err := json.Marshal(ThreadAggregation{
+					LatestEvent:             *latestEvent,
+					Count:                   summary.Count,
+					CurrentUserParticipated: summary.Participated,
+				})
+				if err != nil {
+					return fmt.Errorf("json.Marshal: %w", err)
+				}
+				if err = setBundledAggregation(&events[i], RelationTypeThread, aggregation); err != nil {
+					return err
+				}
+			}
+		}
+
+		rels := relations[events[i].EventID]
+		if replacement := latestReplacement(&events[i], rels[RelationTypeReplace], relatedClientEvents); replacement != nil {
+			aggregation, err := json.Marshal(replacement)
+			if err != nil {
+				return fmt.Errorf("json.Marshal: %w", err)
+			}
+			if err = setBundledAggregation(&events[i], RelationTypeReplace, aggregation); err != nil {
+				return err
+			}
+		}
+		if references := rels[RelationTypeReference]; len(references) > 0 {
+			reference := ReferenceAggregation{
+				Chunk: make([]ReferenceChunk, 0, len(references)),
+			}
+			for _, entry := range references {
+				reference.Chunk = append(reference.Chunk, ReferenceChunk{EventID: entry.EventID})
+			}
+			aggregation, err := json.Marshal(reference)
+			if err != nil {
+				return fmt.Errorf("json.Marshal: %w", err)
+			}
+			if err = setBundledAggregation(&events[i], RelationTypeReference, aggregation); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// latestReplacement returns the most recent valid replacement of the original
+// event, or nil if there isn't one. Replacements are only valid if they were
+// sent by the same sender as the original, with the same type, and neither is
+// a state event. Events which replace other events can't be replaced.
+// https://spec.matrix.org/v1.11/client-server-api/#validity-of-replacement-events
+func latestReplacement(
+	original *synctypes.ClientEvent, entries []types.RelationEntry, events map[string]*synctypes.ClientEvent,
+) *synctypes.ClientEvent {
+	if len(entries) == 0 || original.StateKey != nil {
+		return nil
+	}
+	if gjson.GetBytes(original.Content, `m\.relates_to.rel_type`).Str == RelationTypeReplace {
+		return nil
+	}
+	var latest *synctypes.ClientEvent
+	for _, entry := range entries {
+		ev, ok := events[entry.EventID]
+		if !ok || ev.Sender != original.Sender || ev.Type != original.Type || ev.StateKey != nil {
+			continue
+		}
+		// The contents of encrypted replacements can't be checked.
+		if ev.Type != "m.room.encrypted" && !gjson.GetBytes(ev.Content, `m\.new_content`).IsObject() {
+			continue
+		}
+		// The most recent replacement wins, with ties broken by the event ID.
+		if latest == nil || ev.OriginServerTS > latest.OriginServerTS ||
+			(ev.OriginServerTS == latest.OriginServerTS && ev.EventID > latest.EventID) {
+			latest = ev
+		}
+	}
+	return latest
+}
+
+// setBundledAggregation sets "unsigned.m.relations.<relType>" on the event.
+func setBundledAggregation(ev *synctypes.ClientEvent, relType string, aggregation []byte) error {
+	unsigned := []byte(ev.Unsigned)
+	if len(unsigned) == 0 {
+		unsigned = []byte("{}")
+	}
+	unsigned, err := sjson.SetRawBytes(unsigned, "m\\.relations."+escapePath(relType), aggregation)
+	if err != nil {
+		return fmt.Errorf("sjson.SetRawBytes: %w", err)
+	}
+	ev.Unsigned = unsigned
+	return nil
+}
+
+// escapePath escapes the characters in a key that have a special meaning in
+// gjson/sjson paths.
+func escapePath(key string) string {
+	escaped := make([]byte, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '.', '*', '?', '|', '#', '@', '\\', ':', '!', '=', '<', '>', '%':
+			escaped = append(escaped, '\\')
+		}
+		escaped = append(escaped, key[i])
+	}
+	return string(escaped)
+}
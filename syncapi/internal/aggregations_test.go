@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
+	"github.com/neilalexander/harmony/syncapi/types"
+	"github.com/tidwall/gjson"
+)
+
+func TestSetBundledAggregation(t *testing.T) {
+	ev := synctypes.ClientEvent{
+		Unsigned: []byte(`{"age":10}`),
+	}
+	if err := setBundledAggregation(&ev, RelationTypeThread, []byte(`{"count":2}`)); err != nil {
+		t.Fatal(err)
+	}
+	if age := gjson.GetBytes(ev.Unsigned, "age").Int(); age != 10 {
+		t.Fatalf("expected existing unsigned keys to be kept, got %s", ev.Unsigned)
+	}
+	if count := gjson.GetBytes(ev.Unsigned, `m\.relations.m\.thread.count`).Int(); count != 2 {
+		t.Fatalf("expected bundled aggregation, got %s", ev.Unsigned)
+	}
+
+	// Events without an unsigned section should get one.
+	ev = synctypes.ClientEvent{}
+	if err := setBundledAggregation(&ev, RelationTypeThread, []byte(`{"count":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	if count := gjson.GetBytes(ev.Unsigned, `m\.relations.m\.thread.count`).Int(); count != 1 {
+		t.Fatalf("expected bundled aggregation, got %s", ev.Unsigned)
+	}
+}
+
+func TestLatestReplacement(t *testing.T) {
+	stateKey := ""
+	original := &synctypes.ClientEvent{
+		EventID: "$original",
+		Sender:  "@alice:test",
+		Type:    "m.room.message",
+		Content: []byte(`{"body":"hello"}`),
+	}
+	replacement := func(eventID, sender, evType string, ts spec.Timestamp) *synctypes.ClientEvent {
+		return &synctypes.ClientEvent{
+			EventID:        eventID,
+			Sender:         sender,
+			Type:           evType,
+			OriginServerTS: ts,
+			Content:        []byte(`{"body":"* hi","m.new_content":{"body":"hi"}}`),
+		}
+	}
+	events := map[string]*synctypes.ClientEvent{
+		"$valid":       replacement("$valid", "@alice:test", "m.room.message", 10),
+		"$tiebreak":    replacement("$tiebreak", "@alice:test", "m.room.message", 10),
+		"$old":         replacement("$old", "@alice:test", "m.room.message", 5),
+		"$otherSender": replacement("$otherSender", "@bob:test", "m.room.message", 20),
+		"$otherType":   replacement("$otherType", "@alice:test", "m.sticker", 20),
+		"$noContent": {
+			EventID: "$noContent", Sender: "@alice:test", Type: "m.room.message",
+			OriginServerTS: 20, Content: []byte(`{"body":"* hi"}`),
+		},
+		"$state": {
+			EventID: "$state", Sender: "@alice:test", Type: "m.room.message", StateKey: &stateKey,
+			OriginServerTS: 20, Content: []byte(`{"m.new_content":{"body":"hi"}}`),
+		},
+	}
+	entries := func(eventIDs ...string) (result []types.RelationEntry) {
+		for _, eventID := range eventIDs {
+			result = append(result, types.RelationEntry{EventID: eventID})
+		}
+		return
+	}
+
+	if latest := latestReplacement(original, entries("$old", "$valid", "$otherSender", "$otherType", "$noContent", "$state", "$missing"), events); latest == nil || latest.EventID != "$valid" {
+		t.Fatalf("expected $valid to be the latest replacement, got %+v", latest)
+	}
+	// Replacements with the same timestamp are ordered by event ID.
+	if latest := latestReplacement(original, entries("$tiebreak", "$valid"), events); latest == nil || latest.EventID != "$valid" {
+		t.Fatalf("expected $valid to win the tie, got %+v", latest)
+	}
+	if latest := latestReplacement(original, entries("$otherSender", "$noContent"), events); latest != nil {
+		t.Fatalf("expected no valid replacement, got %+v", latest)
+	}
+
+	// Events which are themselves replacements can't be replaced.
+	edit := *original
+	edit.Content = []byte(`{"m.relates_to":{"rel_type":"m.replace","event_id":"$other"}}`)
+	if latest := latestReplacement(&edit, entries("$valid"), events); latest != nil {
+		t.Fatalf("expected replacements of an edit to be ignored, got %+v", latest)
+	}
+}
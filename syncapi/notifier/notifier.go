@@ -209,6 +209,16 @@ func (n *Notifier) OnNewInvite(
 	n._wakeupUsers([]string{wakeUserID}, n.currPos)
 }
 
+func (n *Notifier) OnNewKnock(
+	posUpdate types.StreamingToken, wakeUserID string,
+) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.currPos.ApplyUpdates(posUpdate)
+	n._wakeupUsers([]string{wakeUserID}, n.currPos)
+}
+
 func (n *Notifier) OnNewNotificationData(
 	userID string,
 	posUpdate types.StreamingToken,
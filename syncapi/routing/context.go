@@ -206,10 +206,11 @@ func Context(
 		}
 	}
 
-	eventsBeforeClient := synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(eventsBeforeFiltered), synctypes.FormatAll, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	eventFormat := synctypes.FormatFor(filter.EventFormat, synctypes.FormatAll)
+	eventsBeforeClient := synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(eventsBeforeFiltered), eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 		return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 	})
-	eventsAfterClient := synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(eventsAfterFiltered), synctypes.FormatAll, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	eventsAfterClient := synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(eventsAfterFiltered), eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 		return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 	})
 
@@ -230,14 +231,28 @@ func Context(
 		}
 	}
 
-	ev := synctypes.ToClientEventDefault(func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	var ev synctypes.ClientEvent
+	if clientEvent, convertErr := synctypes.ToClientEvent(requestedEvent, eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 		return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
-	}, requestedEvent)
+	}); convertErr == nil {
+		ev = *clientEvent
+	}
+
+	// Bundle the aggregations for all of the returned events at once.
+	bundled := append(append([]synctypes.ClientEvent{ev}, eventsBeforeClient...), eventsAfterClient...)
+	if err = internal.BundleAggregations(ctx, snapshot, rsAPI, *userID, roomID, bundled, eventFormat); err != nil {
+		logrus.WithError(err).Warn("unable to bundle aggregations")
+	}
+	synctypes.ApplyEventFields(bundled, filter.EventFields)
+	ev = bundled[0]
+	copy(eventsBeforeClient, bundled[1:1+len(eventsBeforeClient)])
+	copy(eventsAfterClient, bundled[1+len(eventsBeforeClient):])
+
 	response := ContextRespsonse{
 		Event:        &ev,
 		EventsAfter:  eventsAfterClient,
 		EventsBefore: eventsBeforeClient,
-		State: synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(newState), synctypes.FormatAll, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+		State: synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(newState), eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 			return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 		}),
 	}
@@ -245,6 +260,7 @@ func Context(
 	if len(response.State) > filter.Limit {
 		response.State = response.State[len(response.State)-filter.Limit:]
 	}
+	synctypes.ApplyEventFields(response.State, filter.EventFields)
 	start, end, err := getStartEnd(ctx, snapshot, eventsBefore, eventsAfter)
 	if err == nil {
 		response.End = end.String()
@@ -369,6 +385,9 @@ func parseRoomEventFilter(req *http.Request) (*synctypes.RoomEventFilter, error)
 		if err := json.Unmarshal([]byte(f), &filter); err != nil {
 			return nil, err
 		}
+		if err := filter.Validate(); err != nil {
+			return nil, err
+		}
 	}
 
 	return filter, nil
@@ -129,6 +129,11 @@ func GetEvent(
 			JSON: spec.Unknown("internal server error"),
 		}
 	}
+	bundled := []synctypes.ClientEvent{*clientEvent}
+	if err = internal.BundleAggregations(ctx, db, rsAPI, *userID, roomID.String(), bundled, synctypes.FormatAll); err != nil {
+		logger.WithError(err).Warn("GetEvent: internal.BundleAggregations failed")
+	}
+	clientEvent = &bundled[0]
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
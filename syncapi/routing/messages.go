@@ -302,7 +302,7 @@ func OnIncomingMessagesRequest(
 				JSON: spec.InternalServerError{},
 			}
 		}
-		res.State = append(res.State, synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(membershipEvents), synctypes.FormatAll, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+		res.State = append(res.State, synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(membershipEvents), synctypes.FormatFor(filter.EventFormat, synctypes.FormatAll), func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 			return rsAPI.QueryUserIDForSender(req.Context(), roomID, senderID)
 		})...)
 	}
@@ -310,6 +310,8 @@ func OnIncomingMessagesRequest(
 	if fromStream != nil {
 		res.StartStream = fromStream.String()
 	}
+	synctypes.ApplyEventFields(res.Chunk, filter.EventFields)
+	synctypes.ApplyEventFields(res.State, filter.EventFields)
 
 	// Respond with the events.
 	succeeded = true
@@ -426,9 +428,14 @@ func (r *messagesReq) retrieveEvents(ctx context.Context, rsAPI api.SyncRoomserv
 
 	start = *r.from
 
-	return synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(filteredEvents), synctypes.FormatAll, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+	eventFormat := synctypes.FormatFor(r.filter.EventFormat, synctypes.FormatAll)
+	clientEvents = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(filteredEvents), eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 		return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
-	}), start, end, nil
+	})
+	if err = internal.BundleAggregations(ctx, r.snapshot, rsAPI, r.deviceUserID, r.roomID, clientEvents, eventFormat); err != nil {
+		util.GetLogger(ctx).WithError(err).Warn("failed to bundle aggregations")
+	}
+	return clientEvents, start, end, nil
 }
 
 func (r *messagesReq) getStartEnd(events []*rstypes.HeaderedEvent) (start, end types.TopologyToken, err error) {
@@ -565,18 +572,28 @@ func (e eventsByDepth) Less(i, j int) bool {
 // Returns an error if there was an issue with retrieving the list of servers in
 // the room or sending the request.
 func (r *messagesReq) backfill(roomID string, backwardsExtremities map[string][]string, limit int) ([]*rstypes.HeaderedEvent, error) {
+	return backfillEvents(r.ctx, r.db, r.rsAPI, r.cfg.Matrix.ServerName, r.device.UserDomain(), roomID, backwardsExtremities, limit)
+}
+
+// backfillEvents asks the roomserver to backfill events before the given backwards
+// extremities and stores them in the sync API database. Returns at most limit events.
+func backfillEvents(
+	ctx context.Context, db storage.Database, rsAPI api.SyncRoomserverAPI,
+	serverName, virtualHost spec.ServerName, roomID string,
+	backwardsExtremities map[string][]string, limit int,
+) ([]*rstypes.HeaderedEvent, error) {
 	var res api.PerformBackfillResponse
-	err := r.rsAPI.PerformBackfill(context.Background(), &api.PerformBackfillRequest{
+	err := rsAPI.PerformBackfill(context.Background(), &api.PerformBackfillRequest{
 		RoomID:               roomID,
 		BackwardsExtremities: backwardsExtremities,
 		Limit:                limit,
-		ServerName:           r.cfg.Matrix.ServerName,
-		VirtualHost:          r.device.UserDomain(),
+		ServerName:           serverName,
+		VirtualHost:          virtualHost,
 	}, &res)
 	if err != nil {
 		return nil, fmt.Errorf("PerformBackfill failed: %w", err)
 	}
-	util.GetLogger(r.ctx).WithField("new_events", len(res.Events)).Info("Storing new events from backfill")
+	util.GetLogger(ctx).WithField("new_events", len(res.Events)).Info("Storing new events from backfill")
 
 	// TODO: we should only be inserting events into the database from the roomserver's kafka output stream.
 	// Currently, this can race with live events for the room and cause problems. It's also just a bit unclear
@@ -596,7 +613,7 @@ func (r *messagesReq) backfill(roomID string, backwardsExtremities map[string][]
 	events := res.Events
 	for i := range events {
 		events[i].Visibility = res.HistoryVisibility
-		_, err = r.db.WriteEvent(
+		_, err = db.WriteEvent(
 			context.Background(),
 			events[i],
 			[]*rstypes.HeaderedEvent{},
@@ -142,6 +142,9 @@ func Relations(
 			*clientEvent,
 		)
 	}
+	if err = internal.BundleAggregations(req.Context(), snapshot, rsAPI, *userID, roomID.String(), res.Chunk, synctypes.FormatAll); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Warn("Failed to bundle aggregations")
+	}
 
 	succeeded = true
 	return util.JSONResponse{
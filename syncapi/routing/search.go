@@ -33,6 +33,7 @@ import (
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	roomserverAPI "github.com/neilalexander/harmony/roomserver/api"
 	"github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/syncapi/internal"
 	"github.com/neilalexander/harmony/syncapi/storage"
 	"github.com/neilalexander/harmony/syncapi/synctypes"
 	"github.com/neilalexander/harmony/userapi/api"
@@ -63,6 +64,16 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 		}
 	}
 
+	if err = searchReq.SearchCategories.RoomEvents.Filter.Validate(); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam(err.Error()),
+		}
+	}
+	eventFormat := synctypes.FormatFor(searchReq.SearchCategories.RoomEvents.Filter.EventFormat, synctypes.FormatAll)
+	contextFormat := synctypes.FormatFor(searchReq.SearchCategories.RoomEvents.Filter.EventFormat, synctypes.FormatSync)
+	eventFields := searchReq.SearchCategories.RoomEvents.Filter.EventFields
+
 	if searchReq.SearchCategories.RoomEvents.Filter.Limit == 0 {
 		searchReq.SearchCategories.RoomEvents.Filter.Limit = 5
 	}
@@ -230,7 +241,7 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 			profileInfos[userID.String()] = profile
 		}
 
-		clientEvent, err := synctypes.ToClientEvent(event, synctypes.FormatAll, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+		clientEvent, err := synctypes.ToClientEvent(event, eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 			return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 		})
 		if err != nil {
@@ -242,10 +253,10 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 			Context: SearchContextResponse{
 				Start: startToken.String(),
 				End:   endToken.String(),
-				EventsAfter: synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(eventsAfter), synctypes.FormatSync, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+				EventsAfter: synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(eventsAfter), contextFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 					return rsAPI.QueryUserIDForSender(req.Context(), roomID, senderID)
 				}),
-				EventsBefore: synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(eventsBefore), synctypes.FormatSync, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+				EventsBefore: synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(eventsBefore), contextFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 					return rsAPI.QueryUserIDForSender(req.Context(), roomID, senderID)
 				}),
 				ProfileInfo: profileInfos,
@@ -266,12 +277,15 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 					JSON: spec.InternalServerError{},
 				}
 			}
-			stateForRooms[event.RoomID().String()] = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(state), synctypes.FormatSync, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+			stateForRooms[event.RoomID().String()] = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(state), contextFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 				return rsAPI.QueryUserIDForSender(req.Context(), roomID, senderID)
 			})
+			synctypes.ApplyEventFields(stateForRooms[event.RoomID().String()], eventFields)
 		}
 	}
 
+	formatSearchResults(ctx, snapshot, rsAPI, device, results, eventFormat, eventFields)
+
 	var nextBatchResult *string = nil
 	if int(result.Total) > nextBatch+len(results) {
 		nb := strconv.Itoa(len(results) + nextBatch)
@@ -304,6 +318,43 @@ func Search(req *http.Request, device *api.Device, syncDB storage.Database, fts
 	}
 }
 
+// formatSearchResults adds bundled aggregations, such as the latest edit, to
+// the search results and limits the events to the requested event_fields. The
+// results are grouped by room so that the aggregations for each room are
+// looked up at once.
+func formatSearchResults(
+	ctx context.Context, snapshot storage.DatabaseTransaction, rsAPI roomserverAPI.SyncRoomserverAPI,
+	device *api.Device, results []Result, eventFormat synctypes.ClientEventFormat, eventFields []string,
+) {
+	for i := range results {
+		synctypes.ApplyEventFields(results[i].Context.EventsBefore, eventFields)
+		synctypes.ApplyEventFields(results[i].Context.EventsAfter, eventFields)
+	}
+	userID, err := spec.NewUserID(device.UserID, true)
+	if err != nil {
+		logrus.WithError(err).Error("invalid device user ID")
+	}
+	byRoom := make(map[string][]int)
+	for i, result := range results {
+		byRoom[result.Result.RoomID] = append(byRoom[result.Result.RoomID], i)
+	}
+	for roomID, indexes := range byRoom {
+		events := make([]synctypes.ClientEvent, 0, len(indexes))
+		for _, i := range indexes {
+			events = append(events, results[i].Result)
+		}
+		if userID != nil {
+			if err = internal.BundleAggregations(ctx, snapshot, rsAPI, *userID, roomID, events, eventFormat); err != nil {
+				logrus.WithError(err).WithField("room_id", roomID).Warn("failed to bundle aggregations")
+			}
+		}
+		synctypes.ApplyEventFields(events, eventFields)
+		for j, i := range indexes {
+			results[i].Result = events[j]
+		}
+	}
+}
+
 // contextEvents returns the events around a given eventID
 func contextEvents(
 	ctx context.Context,
@@ -0,0 +1,173 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/roomserver/api"
+	rstypes "github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/syncapi/internal"
+	"github.com/neilalexander/harmony/syncapi/storage"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
+	"github.com/neilalexander/harmony/syncapi/types"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+type ThreadsResponse struct {
+	Chunk     []synctypes.ClientEvent `json:"chunk"`
+	NextBatch string                  `json:"next_batch,omitempty"`
+}
+
+// Threads implements GET /_matrix/client/v1/rooms/{roomId}/threads
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1roomsroomidthreads
+// Threads are ordered by their most recent event, newest first. The pagination
+// tokens are positions in the relations stream, as with /relations.
+func Threads(
+	req *http.Request, device *userapi.Device,
+	syncDB storage.Database,
+	rsAPI api.SyncRoomserverAPI,
+	rawRoomID string,
+) util.JSONResponse {
+	roomID, err := spec.NewRoomID(rawRoomID)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("invalid room ID"),
+		}
+	}
+
+	userID, err := spec.NewUserID(device.UserID, true)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("device.UserID invalid")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.Unknown("internal server error"),
+		}
+	}
+
+	var from types.StreamPosition
+	limit := 50
+	if f := req.URL.Query().Get("from"); f != "" {
+		if from, err = types.NewStreamPositionFromString(f); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("invalid from parameter"),
+			}
+		}
+	}
+	if l := req.URL.Query().Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("invalid limit parameter"),
+			}
+		}
+		if limit > 50 {
+			limit = 50
+		}
+	}
+
+	res := &ThreadsResponse{
+		Chunk: []synctypes.ClientEvent{},
+	}
+
+	// If only the threads that the user participated in were requested then we
+	// need to know which sender ID the user has in this room. If they don't have
+	// one then they can't have participated in any threads.
+	var participantSenderID string
+	switch req.URL.Query().Get("include") {
+	case "", "all":
+	case "participated":
+		senderID, queryErr := rsAPI.QuerySenderIDForUser(req.Context(), *roomID, *userID)
+		if queryErr != nil {
+			util.GetLogger(req.Context()).WithError(queryErr).Error("rsAPI.QuerySenderIDForUser failed")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+		if senderID == nil {
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: res,
+			}
+		}
+		participantSenderID = string(*senderID)
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("include must be either 'all' or 'participated'"),
+		}
+	}
+
+	snapshot, err := syncDB.NewDatabaseSnapshot(req.Context())
+	if err != nil {
+		logrus.WithError(err).Error("Failed to get snapshot for threads")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	var succeeded bool
+	defer sqlutil.EndTransactionWithCheck(snapshot, &succeeded, &err)
+
+	var events []types.StreamEvent
+	events, res.NextBatch, err = snapshot.ThreadsFor(
+		req.Context(), roomID.String(), participantSenderID, from, limit,
+	)
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	headeredEvents := make([]*rstypes.HeaderedEvent, 0, len(events))
+	for _, event := range events {
+		headeredEvents = append(headeredEvents, event.HeaderedEvent)
+	}
+
+	// Apply history visibility to the thread roots.
+	filteredEvents, err := internal.ApplyHistoryVisibilityFilter(req.Context(), snapshot, rsAPI, headeredEvents, nil, *userID, "threads")
+	if err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	for _, event := range filteredEvents {
+		clientEvent, err := synctypes.ToClientEvent(event.PDU, synctypes.FormatAll, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+			return rsAPI.QueryUserIDForSender(req.Context(), roomID, senderID)
+		})
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).WithField("senderID", event.SenderID()).WithField("roomID", *roomID).Error("Failed converting to ClientEvent")
+			continue
+		}
+		res.Chunk = append(res.Chunk, *clientEvent)
+	}
+
+	// Every thread root gets a thread summary in its bundled aggregations.
+	if err = internal.BundleAggregations(req.Context(), snapshot, rsAPI, *userID, roomID.String(), res.Chunk, synctypes.FormatAll); err != nil {
+		return util.ErrorResponse(err)
+	}
+
+	succeeded = true
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
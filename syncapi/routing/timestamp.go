@@ -0,0 +1,410 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/roomserver/api"
+	rstypes "github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/syncapi/internal"
+	"github.com/neilalexander/harmony/syncapi/storage"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+const (
+	// maxTimestampToEventServers is the number of other servers in the room
+	// that are asked for an event when we can't find one locally.
+	maxTimestampToEventServers = 5
+	// timestampToEventRemoteTimeout is how long to wait for each of them.
+	timestampToEventRemoteTimeout = 10 * time.Second
+	// maxTimestampToEventBackfills is the number of times that we backfill
+	// while trying to reach an event returned by another server.
+	maxTimestampToEventBackfills = 5
+	// timestampToEventBackfillLimit is the number of events to ask for in
+	// each backfill.
+	timestampToEventBackfillLimit = 100
+)
+
+// TimestampToEvent implements
+//
+//	GET /_matrix/client/v1/rooms/{roomId}/timestamp_to_event
+//
+// If the closest event that we know about is next to a gap in our copy of the
+// room, or we don't know of one at all, then the other servers in the room are
+// asked and we backfill up to the event that they return.
+// https://spec.matrix.org/v1.11/client-server-api/#get_matrixclientv1roomsroomidtimestamp_to_event
+func TimestampToEvent(
+	req *http.Request,
+	device *userapi.Device,
+	roomID string,
+	cfg *config.SyncAPI,
+	syncDB storage.Database,
+	rsAPI api.SyncRoomserverAPI,
+	fedClient fclient.FederationClient,
+) util.JSONResponse {
+	ts, backwards, resErr := parseTimestampToEventRequest(req)
+	if resErr != nil {
+		return *resErr
+	}
+
+	userID, err := spec.NewUserID(device.UserID, true)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("Device UserID is invalid"),
+		}
+	}
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithFields(logrus.Fields{
+		"room_id": roomID,
+		"ts":      ts,
+	})
+	membershipRes := api.QueryMembershipForUserResponse{}
+	membershipReq := api.QueryMembershipForUserRequest{UserID: *userID, RoomID: roomID}
+	if err = rsAPI.QueryMembershipForUser(ctx, &membershipReq, &membershipRes); err != nil {
+		logger.WithError(err).Error("unable to query membership")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if !membershipRes.RoomExists {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("room does not exist"),
+		}
+	}
+
+	local, gap, servers, err := localTimestampToEvent(ctx, syncDB, cfg, roomID, ts, backwards)
+	if err != nil {
+		logger.WithError(err).Error("unable to look up event for timestamp")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+
+	result := local
+	if gap {
+		remote := remoteTimestampToEvent(ctx, fedClient, device.UserDomain(), servers, roomID, ts, backwards, local)
+		if remote.EventID != "" {
+			var known bool
+			known, err = backfillToEvent(ctx, syncDB, rsAPI, cfg.Matrix.ServerName, device.UserDomain(), roomID, remote.EventID)
+			switch {
+			case err != nil:
+				logger.WithError(err).WithField("event_id", remote.EventID).Warn("unable to backfill to event for timestamp")
+			case known:
+				result = remote
+			}
+		}
+	}
+
+	if result.EventID == "" {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(fmt.Sprintf("Unable to find event from %d in direction %s", ts, req.URL.Query().Get("dir"))),
+		}
+	}
+
+	snapshot, err := syncDB.NewDatabaseSnapshot(ctx)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get snapshot for timestamp to event")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	defer snapshot.Rollback() // nolint: errcheck
+
+	events, err := snapshot.Events(ctx, []string{result.EventID})
+	if err != nil {
+		logger.WithError(err).Error("unable to fetch event for timestamp")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	filteredEvents, err := internal.ApplyHistoryVisibilityFilter(ctx, snapshot, rsAPI, events, nil, *userID, "timestamp_to_event")
+	if err != nil {
+		logger.WithError(err).Error("unable to apply history visibility filter")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if len(filteredEvents) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("User is not allowed to see this event"),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: result,
+	}
+}
+
+// TimestampToEventForFederation implements
+//
+//	GET /_matrix/federation/v1/timestamp_to_event/{roomId}
+//
+// Only events that we already know about are returned, so that remote servers
+// can't make us go looking for events on their behalf.
+// https://spec.matrix.org/v1.11/server-server-api/#get_matrixfederationv1timestamp_to_eventroomid
+func TimestampToEventForFederation(
+	req *http.Request,
+	origin spec.ServerName,
+	roomID string,
+	syncDB storage.Database,
+) util.JSONResponse {
+	ts, backwards, resErr := parseTimestampToEventRequest(req)
+	if resErr != nil {
+		return *resErr
+	}
+
+	ctx := req.Context()
+	logger := util.GetLogger(ctx).WithFields(logrus.Fields{
+		"room_id": roomID,
+		"origin":  origin,
+		"ts":      ts,
+	})
+	snapshot, err := syncDB.NewDatabaseSnapshot(ctx)
+	if err != nil {
+		logger.WithError(err).Error("Failed to get snapshot for timestamp to event")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	defer snapshot.Rollback() // nolint: errcheck
+
+	joined, err := snapshot.AllJoinedUsersInRoom(ctx, []string{roomID})
+	if err != nil {
+		logger.WithError(err).Error("unable to get joined users for room")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	var originJoined bool
+	for _, userID := range joined[roomID] {
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err == nil && domain == origin {
+			originJoined = true
+			break
+		}
+	}
+	if !originJoined {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: spec.Forbidden("The origin server is not joined to the room"),
+		}
+	}
+
+	eventID, originServerTS, err := snapshot.EventIDForTimestamp(ctx, roomID, ts, backwards)
+	if err != nil {
+		logger.WithError(err).Error("unable to look up event for timestamp")
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: spec.InternalServerError{},
+		}
+	}
+	if eventID == "" {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: spec.NotFound(fmt.Sprintf("Unable to find event from %d in direction %s", ts, req.URL.Query().Get("dir"))),
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: fclient.RespTimestampToEvent{
+			EventID:        eventID,
+			OriginServerTS: originServerTS,
+		},
+	}
+}
+
+// parseTimestampToEventRequest returns the timestamp and direction of the request.
+func parseTimestampToEventRequest(req *http.Request) (spec.Timestamp, bool, *util.JSONResponse) {
+	query := req.URL.Query()
+	ts, err := strconv.ParseUint(query.Get("ts"), 10, 64)
+	if err != nil {
+		return 0, false, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("ts must be a timestamp in milliseconds"),
+		}
+	}
+	switch query.Get("dir") {
+	case "f":
+		return spec.Timestamp(ts), false, nil
+	case "b":
+		return spec.Timestamp(ts), true, nil
+	default:
+		return 0, false, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.InvalidParam("dir must be one of f or b"),
+		}
+	}
+}
+
+// localTimestampToEvent looks up the closest event to the timestamp that we know about.
+// Returns whether the event may not be the closest one, because we don't have any event
+// or the event is at a backwards extremity, along with the other servers in the room
+// which could be asked instead.
+func localTimestampToEvent(
+	ctx context.Context, syncDB storage.Database, cfg *config.SyncAPI,
+	roomID string, ts spec.Timestamp, backwards bool,
+) (res fclient.RespTimestampToEvent, gap bool, servers []spec.ServerName, err error) {
+	snapshot, err := syncDB.NewDatabaseSnapshot(ctx)
+	if err != nil {
+		return res, false, nil, err
+	}
+	defer snapshot.Rollback() // nolint: errcheck
+
+	res.EventID, res.OriginServerTS, err = snapshot.EventIDForTimestamp(ctx, roomID, ts, backwards)
+	if err != nil {
+		return res, false, nil, fmt.Errorf("snapshot.EventIDForTimestamp: %w", err)
+	}
+	if res.EventID != "" {
+		extremities, err := snapshot.BackwardExtremitiesForRoom(ctx, roomID)
+		if err != nil {
+			return res, false, nil, fmt.Errorf("snapshot.BackwardExtremitiesForRoom: %w", err)
+		}
+		if _, gap = extremities[res.EventID]; !gap {
+			return res, false, nil, nil
+		}
+	}
+
+	joined, err := snapshot.AllJoinedUsersInRoom(ctx, []string{roomID})
+	if err != nil {
+		return res, false, nil, fmt.Errorf("snapshot.AllJoinedUsersInRoom: %w", err)
+	}
+	seen := map[spec.ServerName]struct{}{}
+	for _, userID := range joined[roomID] {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || cfg.Matrix.IsLocalServerName(domain) {
+			continue
+		}
+		if _, ok := seen[domain]; !ok {
+			seen[domain] = struct{}{}
+			servers = append(servers, domain)
+		}
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i] < servers[j]
+	})
+	if len(servers) > maxTimestampToEventServers {
+		servers = servers[:maxTimestampToEventServers]
+	}
+	return res, true, servers, nil
+}
+
+// remoteTimestampToEvent asks the given servers for the closest event to the timestamp,
+// returning the first one that is closer than the event we already know about, if any.
+func remoteTimestampToEvent(
+	ctx context.Context, fedClient fclient.FederationClient, origin spec.ServerName, servers []spec.ServerName,
+	roomID string, ts spec.Timestamp, backwards bool, local fclient.RespTimestampToEvent,
+) fclient.RespTimestampToEvent {
+	dir := "f"
+	if backwards {
+		dir = "b"
+	}
+	for _, server := range servers {
+		reqCtx, cancel := context.WithTimeout(ctx, timestampToEventRemoteTimeout)
+		res, err := fedClient.LookupTimestampToEvent(reqCtx, origin, server, roomID, ts, dir)
+		cancel()
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("server", server).Debug("Failed to look up event for timestamp over federation")
+			continue
+		}
+		if res.EventID == "" || !closerToTimestamp(res.OriginServerTS, local, ts, backwards) {
+			continue
+		}
+		return res
+	}
+	return fclient.RespTimestampToEvent{}
+}
+
+// closerToTimestamp returns whether an event at candidate is in the right direction
+// from the timestamp and closer to it than the current event.
+func closerToTimestamp(candidate spec.Timestamp, current fclient.RespTimestampToEvent, ts spec.Timestamp, backwards bool) bool {
+	if backwards {
+		return candidate <= ts && (current.EventID == "" || candidate > current.OriginServerTS)
+	}
+	return candidate >= ts && (current.EventID == "" || candidate < current.OriginServerTS)
+}
+
+// backfillToEvent backfills the room until we know about the given event, or
+// until backfilling doesn't return anything new. Returns whether we know about
+// the event.
+func backfillToEvent(
+	ctx context.Context, syncDB storage.Database, rsAPI api.SyncRoomserverAPI,
+	serverName, virtualHost spec.ServerName, roomID, eventID string,
+) (bool, error) {
+	for i := 0; ; i++ {
+		known, extremities, err := eventKnown(ctx, syncDB, roomID, eventID)
+		if err != nil || known {
+			return known, err
+		}
+		if i == maxTimestampToEventBackfills || len(extremities) == 0 {
+			return false, nil
+		}
+		var events []*rstypes.HeaderedEvent
+		events, err = backfillEvents(ctx, syncDB, rsAPI, serverName, virtualHost, roomID, extremities, timestampToEventBackfillLimit)
+		if err != nil {
+			return false, err
+		}
+		if len(events) == 0 {
+			return false, nil
+		}
+	}
+}
+
+// eventKnown returns whether we know about the event, and if not, the backwards
+// extremities of the room to backfill from.
+func eventKnown(ctx context.Context, syncDB storage.Database, roomID, eventID string) (bool, map[string][]string, error) {
+	snapshot, err := syncDB.NewDatabaseSnapshot(ctx)
+	if err != nil {
+		return false, nil, err
+	}
+	defer snapshot.Rollback() // nolint: errcheck
+
+	events, err := snapshot.Events(ctx, []string{eventID})
+	if err != nil {
+		return false, nil, fmt.Errorf("snapshot.Events: %w", err)
+	}
+	if len(events) > 0 {
+		return true, nil, nil
+	}
+	extremities, err := snapshot.BackwardExtremitiesForRoom(ctx, roomID)
+	if err != nil {
+		return false, nil, fmt.Errorf("snapshot.BackwardExtremitiesForRoom: %w", err)
+	}
+	return false, extremities, nil
+}
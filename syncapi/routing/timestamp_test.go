@@ -0,0 +1,71 @@
+package routing
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+)
+
+func Test_parseTimestampToEventRequest(t *testing.T) {
+	tests := []struct {
+		query         string
+		wantTS        spec.Timestamp
+		wantBackwards bool
+		wantErr       bool
+	}{
+		{query: "ts=1000&dir=f", wantTS: 1000},
+		{query: "ts=1000&dir=b", wantTS: 1000, wantBackwards: true},
+		{query: "dir=f", wantErr: true},
+		{query: "ts=-1&dir=f", wantErr: true},
+		{query: "ts=1000", wantErr: true},
+		{query: "ts=1000&dir=x", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "https://localhost/_matrix/client/v1/rooms/!room:localhost/timestamp_to_event?"+tt.query, nil)
+			ts, backwards, resErr := parseTimestampToEventRequest(req)
+			if (resErr != nil) != tt.wantErr {
+				t.Fatalf("expected error %v, got %+v", tt.wantErr, resErr)
+			}
+			if resErr != nil {
+				if resErr.Code != http.StatusBadRequest {
+					t.Fatalf("expected status %d, got %d", http.StatusBadRequest, resErr.Code)
+				}
+				return
+			}
+			if ts != tt.wantTS || backwards != tt.wantBackwards {
+				t.Fatalf("got ts=%d backwards=%v, want ts=%d backwards=%v", ts, backwards, tt.wantTS, tt.wantBackwards)
+			}
+		})
+	}
+}
+
+func Test_closerToTimestamp(t *testing.T) {
+	none := fclient.RespTimestampToEvent{}
+	local := fclient.RespTimestampToEvent{EventID: "$local", OriginServerTS: 2000}
+	tests := []struct {
+		name      string
+		candidate spec.Timestamp
+		current   fclient.RespTimestampToEvent
+		backwards bool
+		want      bool
+	}{
+		{name: "forwards without local event", candidate: 1500, current: none, want: true},
+		{name: "forwards in wrong direction", candidate: 500, current: none, want: false},
+		{name: "forwards closer than local event", candidate: 1500, current: local, want: true},
+		{name: "forwards further than local event", candidate: 2500, current: local, want: false},
+		{name: "backwards without local event", candidate: 500, current: none, backwards: true, want: true},
+		{name: "backwards in wrong direction", candidate: 1500, current: none, backwards: true, want: false},
+		{name: "backwards closer than local event", candidate: 900, current: fclient.RespTimestampToEvent{EventID: "$local", OriginServerTS: 500}, backwards: true, want: true},
+		{name: "backwards same as local event", candidate: 500, current: fclient.RespTimestampToEvent{EventID: "$local", OriginServerTS: 500}, backwards: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := closerToTimestamp(tt.candidate, tt.current, 1000, tt.backwards); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -37,6 +37,7 @@ type DatabaseTransaction interface {
 	MaxStreamPositionForPDUs(ctx context.Context) (types.StreamPosition, error)
 	MaxStreamPositionForReceipts(ctx context.Context) (types.StreamPosition, error)
 	MaxStreamPositionForInvites(ctx context.Context) (types.StreamPosition, error)
+	MaxStreamPositionForKnocks(ctx context.Context) (types.StreamPosition, error)
 	MaxStreamPositionForAccountData(ctx context.Context) (types.StreamPosition, error)
 	MaxStreamPositionForSendToDeviceMessages(ctx context.Context) (types.StreamPosition, error)
 	MaxStreamPositionForNotificationData(ctx context.Context) (types.StreamPosition, error)
@@ -53,6 +54,7 @@ type DatabaseTransaction interface {
 	GetBackwardTopologyPos(ctx context.Context, events []*rstypes.HeaderedEvent) (types.TopologyToken, error)
 	PositionInTopology(ctx context.Context, eventID string) (pos types.StreamPosition, spos types.StreamPosition, err error)
 	InviteEventsInRange(ctx context.Context, targetUserID string, r types.Range) (map[string]*rstypes.HeaderedEvent, map[string]*rstypes.HeaderedEvent, types.StreamPosition, error)
+	KnockEventsInRange(ctx context.Context, targetUserID string, r types.Range) (map[string]*rstypes.HeaderedEvent, map[string]*rstypes.HeaderedEvent, types.StreamPosition, error)
 	RoomReceiptsAfter(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []types.OutputReceiptEvent, error)
 	// AllJoinedUsersInRooms returns a map of room ID to a list of all joined user IDs.
 	AllJoinedUsersInRooms(ctx context.Context) (map[string][]string, error)
@@ -100,6 +102,9 @@ type DatabaseTransaction interface {
 	SelectContextBeforeEvent(ctx context.Context, id int, roomID string, filter *synctypes.RoomEventFilter) ([]*rstypes.HeaderedEvent, error)
 	SelectContextAfterEvent(ctx context.Context, id int, roomID string, filter *synctypes.RoomEventFilter) (int, []*rstypes.HeaderedEvent, error)
 	StreamToTopologicalPosition(ctx context.Context, roomID string, streamPos types.StreamPosition, backwardOrdering bool) (types.TopologyToken, error)
+	// EventIDForTimestamp returns the ID and timestamp of the event in the room which is closest to the given
+	// timestamp in the given direction. Returns an empty event ID if there is no such event.
+	EventIDForTimestamp(ctx context.Context, roomID string, ts spec.Timestamp, backwards bool) (eventID string, originServerTS spec.Timestamp, err error)
 	IgnoresForUser(ctx context.Context, userID string) (*types.IgnoredUsers, error)
 	// SelectMembershipForUser returns the membership of the user before and including the given position. If no membership can be found
 	// returns "leave", the topological position and no error. If an error occurs, other than sql.ErrNoRows, returns that and an empty
@@ -110,6 +115,15 @@ type DatabaseTransaction interface {
 	GetPresences(ctx context.Context, userID []string) ([]*types.PresenceInternal, error)
 	PresenceAfter(ctx context.Context, after types.StreamPosition, filter synctypes.EventFilter) (map[string]*types.PresenceInternal, error)
 	RelationsFor(ctx context.Context, roomID, eventID, relType, eventType string, from, to types.StreamPosition, backwards bool, limit int) (events []types.StreamEvent, prevBatch, nextBatch string, err error)
+	// ThreadsFor returns the thread root events in the room, ordered by most recent activity first. If
+	// a sender ID is given then only threads that the sender participated in are returned.
+	ThreadsFor(ctx context.Context, roomID, participantSenderID string, from types.StreamPosition, limit int) (events []types.StreamEvent, nextBatch string, err error)
+	// ThreadSummaries returns a map of thread root event ID -> summary for any of the given event IDs
+	// which are thread roots. Participation is calculated for the given sender ID.
+	ThreadSummaries(ctx context.Context, roomID string, eventIDs []string, senderID string) (map[string]*types.ThreadSummary, error)
+	// RelationsForEvents returns a map of event ID -> relType -> []entry for the relations of the given
+	// types which refer to any of the given event IDs, in the order they were stored.
+	RelationsForEvents(ctx context.Context, roomID string, eventIDs, relTypes []string) (map[string]map[string][]types.RelationEntry, error)
 }
 
 type Database interface {
@@ -151,6 +165,13 @@ type Database interface {
 	// RetireInviteEvent removes an old invite event from the database. Returns the new position of the retired invite.
 	// Returns an error if there was a problem communicating with the database.
 	RetireInviteEvent(ctx context.Context, inviteEventID string) (types.StreamPosition, error)
+	// AddKnockEvent stores a new knock event for a user.
+	// If the knock was successfully stored this returns the stream ID it was stored at.
+	// Returns an error if there was a problem communicating with the database.
+	AddKnockEvent(ctx context.Context, knockEvent *rstypes.HeaderedEvent) (types.StreamPosition, error)
+	// RetireKnockEvent removes an old knock from the database. Returns the new position of the retired knock.
+	// Returns an error if there was a problem communicating with the database.
+	RetireKnockEvent(ctx context.Context, roomID, targetUserID string) (types.StreamPosition, error)
 	// StoreNewSendForDeviceMessage stores a new send-to-device event for a user's device.
 	StoreNewSendForDeviceMessage(ctx context.Context, userID, deviceID string, event gomatrixserverlib.SendToDeviceEvent) (types.StreamPosition, error)
 	// CleanSendToDeviceUpdates removes all send-to-device messages BEFORE the specified
@@ -167,7 +188,7 @@ type Database interface {
 	// RedactEvent wipes an event in the database and sets the unsigned.redacted_because key to the redaction event
 	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *rstypes.HeaderedEvent, querier api.QuerySenderIDAPI) error
 	// StoreReceipt stores new receipt events
-	StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp spec.Timestamp) (pos types.StreamPosition, err error)
+	StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId, threadId string, timestamp spec.Timestamp) (pos types.StreamPosition, err error)
 	UpdateIgnoresForUser(ctx context.Context, userID string, ignores *types.IgnoredUsers) error
 	ReIndex(ctx context.Context, limit, afterID int64) (map[int64]rstypes.HeaderedEvent, error)
 	UpdateRelations(ctx context.Context, event *rstypes.HeaderedEvent) error
@@ -190,6 +211,7 @@ type SharedUsers interface {
 }
 
 type Notifications interface {
-	// UpsertRoomUnreadNotificationCounts updates the notification statistics about a (user, room) key.
-	UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int) (types.StreamPosition, error)
+	// UpsertRoomUnreadNotificationCounts updates the notification statistics about a (user, room) key,
+	// including the statistics of each thread in the room.
+	UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int, threadCounts map[string]eventutil.ThreadNotificationData) (types.StreamPosition, error)
 }
@@ -0,0 +1,48 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpAddReceiptsThreadID adds the thread ID to receipts, so that a user can
+// have one receipt of each type per thread in a room. Unthreaded receipts
+// have an empty thread ID.
+func UpAddReceiptsThreadID(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		ALTER TABLE syncapi_receipts ADD COLUMN IF NOT EXISTS thread_id TEXT NOT NULL DEFAULT '';
+		ALTER TABLE syncapi_receipts DROP CONSTRAINT IF EXISTS syncapi_receipts_unique;
+		ALTER TABLE syncapi_receipts ADD CONSTRAINT syncapi_receipts_unique UNIQUE (room_id, receipt_type, user_id, thread_id);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+// UpAddNotificationDataThreadCounts adds the per-thread notification counts
+// to the notification data.
+func UpAddNotificationDataThreadCounts(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		ALTER TABLE syncapi_notification_data ADD COLUMN IF NOT EXISTS thread_counts TEXT NOT NULL DEFAULT '{}';
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
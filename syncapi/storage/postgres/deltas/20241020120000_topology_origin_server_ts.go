@@ -0,0 +1,50 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package deltas
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// UpAddTopologyOriginServerTS adds the origin_server_ts of events to the
+// topology, so that events can be looked up by timestamp.
+func UpAddTopologyOriginServerTS(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		ALTER TABLE syncapi_output_room_events_topology ADD COLUMN IF NOT EXISTS origin_server_ts BIGINT NOT NULL DEFAULT 0;
+		CREATE INDEX IF NOT EXISTS syncapi_event_topology_origin_server_ts_idx ON syncapi_output_room_events_topology(room_id, origin_server_ts);
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
+
+// UpSetTopologyOriginServerTS sets the origin_server_ts of already stored events
+// in the topology. Requires output_room_events and output_room_events_topology
+// to be created.
+func UpSetTopologyOriginServerTS(ctx context.Context, tx *sql.Tx) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE syncapi_output_room_events_topology t
+		SET origin_server_ts = COALESCE((e.headered_event_json::jsonb->>'origin_server_ts')::BIGINT, 0)
+		FROM syncapi_output_room_events e
+		WHERE e.event_id = t.event_id AND t.origin_server_ts = 0;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to execute upgrade: %w", err)
+	}
+	return nil
+}
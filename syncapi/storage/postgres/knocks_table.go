@@ -0,0 +1,190 @@
+// Copyright 2023 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	rstypes "github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/syncapi/storage/tables"
+	"github.com/neilalexander/harmony/syncapi/types"
+)
+
+const knockEventsSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_knock_events (
+	id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_stream_id'),
+	event_id TEXT NOT NULL,
+	room_id TEXT NOT NULL,
+	target_user_id TEXT NOT NULL,
+	headered_event_json TEXT NOT NULL,
+	deleted BOOL NOT NULL
+);
+
+-- For looking up the knocks for a given user.
+CREATE INDEX IF NOT EXISTS syncapi_knocks_target_user_id_idx
+	ON syncapi_knock_events (target_user_id, id);
+
+-- For retiring old knocks
+CREATE INDEX IF NOT EXISTS syncapi_knocks_room_id_target_user_id_idx
+	ON syncapi_knock_events (room_id, target_user_id);
+`
+
+const insertKnockEventSQL = "" +
+	"INSERT INTO syncapi_knock_events (" +
+	" room_id, event_id, target_user_id, headered_event_json, deleted" +
+	") VALUES ($1, $2, $3, $4, FALSE) RETURNING id"
+
+const deleteKnockEventSQL = "" +
+	"UPDATE syncapi_knock_events SET deleted=TRUE, id=nextval('syncapi_stream_id')" +
+	" WHERE room_id = $1 AND target_user_id = $2 AND deleted=FALSE RETURNING id"
+
+const selectKnockEventsInRangeSQL = "" +
+	"SELECT id, room_id, headered_event_json, deleted FROM syncapi_knock_events" +
+	" WHERE target_user_id = $1 AND id > $2 AND id <= $3" +
+	" ORDER BY id DESC"
+
+const selectMaxKnockIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_knock_events"
+
+const purgeKnocksSQL = "" +
+	"DELETE FROM syncapi_knock_events WHERE room_id = $1"
+
+type knockEventsStatements struct {
+	insertKnockEventStmt         *sql.Stmt
+	selectKnockEventsInRangeStmt *sql.Stmt
+	deleteKnockEventStmt         *sql.Stmt
+	selectMaxKnockIDStmt         *sql.Stmt
+	purgeKnocksStmt              *sql.Stmt
+}
+
+func NewPostgresKnocksTable(db *sql.DB) (tables.Knocks, error) {
+	s := &knockEventsStatements{}
+	_, err := db.Exec(knockEventsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertKnockEventStmt, insertKnockEventSQL},
+		{&s.selectKnockEventsInRangeStmt, selectKnockEventsInRangeSQL},
+		{&s.deleteKnockEventStmt, deleteKnockEventSQL},
+		{&s.selectMaxKnockIDStmt, selectMaxKnockIDSQL},
+		{&s.purgeKnocksStmt, purgeKnocksSQL},
+	}.Prepare(db)
+}
+
+func (s *knockEventsStatements) InsertKnockEvent(
+	ctx context.Context, txn *sql.Tx, knockEvent *rstypes.HeaderedEvent,
+) (streamPos types.StreamPosition, err error) {
+	var headeredJSON []byte
+	headeredJSON, err = json.Marshal(knockEvent)
+	if err != nil {
+		return
+	}
+
+	err = sqlutil.TxStmt(txn, s.insertKnockEventStmt).QueryRowContext(
+		ctx,
+		knockEvent.RoomID().String(),
+		knockEvent.EventID(),
+		knockEvent.UserID.String(),
+		headeredJSON,
+	).Scan(&streamPos)
+	return
+}
+
+// DeleteKnockEvent marks the active knock for the target user in the room as
+// retired, returning the new stream position of the retired knock.
+func (s *knockEventsStatements) DeleteKnockEvent(
+	ctx context.Context, txn *sql.Tx, roomID, targetUserID string,
+) (sp types.StreamPosition, err error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteKnockEventStmt)
+	err = stmt.QueryRowContext(ctx, roomID, targetUserID).Scan(&sp)
+	return
+}
+
+// SelectKnockEventsInRange returns a map of room ID to knock event for the
+// active knocks for the target user ID in the supplied range.
+func (s *knockEventsStatements) SelectKnockEventsInRange(
+	ctx context.Context, txn *sql.Tx, targetUserID string, r types.Range,
+) (map[string]*rstypes.HeaderedEvent, map[string]*rstypes.HeaderedEvent, types.StreamPosition, error) {
+	var lastPos types.StreamPosition
+	stmt := sqlutil.TxStmt(txn, s.selectKnockEventsInRangeStmt)
+	rows, err := stmt.QueryContext(ctx, targetUserID, r.Low(), r.High())
+	if err != nil {
+		return nil, nil, lastPos, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectKnockEventsInRange: rows.close() failed")
+	result := map[string]*rstypes.HeaderedEvent{}
+	retired := map[string]*rstypes.HeaderedEvent{}
+	for rows.Next() {
+		var (
+			id        types.StreamPosition
+			roomID    string
+			eventJSON []byte
+			deleted   bool
+		)
+		if err = rows.Scan(&id, &roomID, &eventJSON, &deleted); err != nil {
+			return nil, nil, lastPos, err
+		}
+		if id > lastPos {
+			lastPos = id
+		}
+
+		// if we have seen this room before, it has a higher stream position and hence takes priority
+		// because the query is ORDER BY id DESC so drop them
+		_, isRetired := retired[roomID]
+		_, isKnocked := result[roomID]
+		if isRetired || isKnocked {
+			continue
+		}
+
+		var event *rstypes.HeaderedEvent
+		if err := json.Unmarshal(eventJSON, &event); err != nil {
+			return nil, nil, lastPos, err
+		}
+
+		if deleted {
+			retired[roomID] = event
+		} else {
+			result[roomID] = event
+		}
+	}
+	if lastPos == 0 {
+		lastPos = r.To
+	}
+	return result, retired, lastPos, rows.Err()
+}
+
+func (s *knockEventsStatements) SelectMaxKnockID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := sqlutil.TxStmt(txn, s.selectMaxKnockIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
+
+func (s *knockEventsStatements) PurgeKnocks(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	_, err := sqlutil.TxStmt(txn, s.purgeKnocksStmt).ExecContext(ctx, roomID)
+	return err
+}
@@ -19,8 +19,10 @@ import (
 	"database/sql"
 
 	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	rstypes "github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/syncapi/storage/postgres/deltas"
 	"github.com/neilalexander/harmony/syncapi/storage/tables"
 	"github.com/neilalexander/harmony/syncapi/types"
 )
@@ -35,16 +37,18 @@ CREATE TABLE IF NOT EXISTS syncapi_output_room_events_topology (
 	topological_position BIGINT NOT NULL,
 	stream_position BIGINT NOT NULL,
     -- The 'room_id' key for the event.
-    room_id TEXT NOT NULL
+    room_id TEXT NOT NULL,
+	-- The 'origin_server_ts' of the event, used to look up events by timestamp.
+	origin_server_ts BIGINT NOT NULL DEFAULT 0
 );
 -- The topological order will be used in events selection and ordering
 CREATE UNIQUE INDEX IF NOT EXISTS syncapi_event_topological_position_idx ON syncapi_output_room_events_topology(topological_position, stream_position, room_id);
 `
 
 const insertEventInTopologySQL = "" +
-	"INSERT INTO syncapi_output_room_events_topology (event_id, topological_position, room_id, stream_position)" +
-	" VALUES ($1, $2, $3, $4)" +
-	" ON CONFLICT (topological_position, stream_position, room_id) DO UPDATE SET event_id = $1" +
+	"INSERT INTO syncapi_output_room_events_topology (event_id, topological_position, room_id, stream_position, origin_server_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (topological_position, stream_position, room_id) DO UPDATE SET event_id = $1, origin_server_ts = $5" +
 	" RETURNING topological_position"
 
 const selectEventIDsInRangeASCSQL = "" +
@@ -71,6 +75,16 @@ const selectStreamToTopologicalPositionAscSQL = "" +
 const selectStreamToTopologicalPositionDescSQL = "" +
 	"SELECT topological_position FROM syncapi_output_room_events_topology WHERE room_id = $1 AND stream_position <= $2 ORDER BY topological_position DESC LIMIT 1;"
 
+const selectEventIDForTimestampForwardsSQL = "" +
+	"SELECT event_id, origin_server_ts FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1 AND origin_server_ts >= $2" +
+	" ORDER BY origin_server_ts ASC, topological_position ASC, stream_position ASC LIMIT 1"
+
+const selectEventIDForTimestampBackwardsSQL = "" +
+	"SELECT event_id, origin_server_ts FROM syncapi_output_room_events_topology" +
+	" WHERE room_id = $1 AND origin_server_ts <= $2" +
+	" ORDER BY origin_server_ts DESC, topological_position DESC, stream_position DESC LIMIT 1"
+
 const purgeEventsTopologySQL = "" +
 	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1"
 
@@ -81,6 +95,8 @@ type outputRoomEventsTopologyStatements struct {
 	selectPositionInTopologyStmt              *sql.Stmt
 	selectStreamToTopologicalPositionAscStmt  *sql.Stmt
 	selectStreamToTopologicalPositionDescStmt *sql.Stmt
+	selectEventIDForTimestampForwardsStmt     *sql.Stmt
+	selectEventIDForTimestampBackwardsStmt    *sql.Stmt
 	purgeEventsTopologyStmt                   *sql.Stmt
 }
 
@@ -90,6 +106,16 @@ func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
 	if err != nil {
 		return nil, err
 	}
+	m := sqlutil.NewMigrator(db)
+	m.AddMigrations(
+		sqlutil.Migration{
+			Version: "syncapi: add origin_server_ts to topology",
+			Up:      deltas.UpAddTopologyOriginServerTS,
+		},
+	)
+	if err = m.Up(context.Background()); err != nil {
+		return nil, err
+	}
 	return s, sqlutil.StatementList{
 		{&s.insertEventInTopologyStmt, insertEventInTopologySQL},
 		{&s.selectEventIDsInRangeASCStmt, selectEventIDsInRangeASCSQL},
@@ -97,6 +123,8 @@ func NewPostgresTopologyTable(db *sql.DB) (tables.Topology, error) {
 		{&s.selectPositionInTopologyStmt, selectPositionInTopologySQL},
 		{&s.selectStreamToTopologicalPositionAscStmt, selectStreamToTopologicalPositionAscSQL},
 		{&s.selectStreamToTopologicalPositionDescStmt, selectStreamToTopologicalPositionDescSQL},
+		{&s.selectEventIDForTimestampForwardsStmt, selectEventIDForTimestampForwardsSQL},
+		{&s.selectEventIDForTimestampBackwardsStmt, selectEventIDForTimestampBackwardsSQL},
 		{&s.purgeEventsTopologyStmt, purgeEventsTopologySQL},
 	}.Prepare(db)
 }
@@ -107,7 +135,7 @@ func (s *outputRoomEventsTopologyStatements) InsertEventInTopology(
 	ctx context.Context, txn *sql.Tx, event *rstypes.HeaderedEvent, pos types.StreamPosition,
 ) (topoPos types.StreamPosition, err error) {
 	err = sqlutil.TxStmt(txn, s.insertEventInTopologyStmt).QueryRowContext(
-		ctx, event.EventID(), event.Depth(), event.RoomID().String(), pos,
+		ctx, event.EventID(), event.Depth(), event.RoomID().String(), pos, event.OriginServerTS(),
 	).Scan(&topoPos)
 	return
 }
@@ -188,3 +216,17 @@ func (s *outputRoomEventsTopologyStatements) PurgeEventsTopology(
 	_, err := sqlutil.TxStmt(txn, s.purgeEventsTopologyStmt).ExecContext(ctx, roomID)
 	return err
 }
+
+// SelectEventIDForTimestamp returns the event in the room which is closest to
+// the given timestamp, looking forwards or backwards in time from it. Returns
+// sql.ErrNoRows if there is no such event.
+func (s *outputRoomEventsTopologyStatements) SelectEventIDForTimestamp(
+	ctx context.Context, txn *sql.Tx, roomID string, ts spec.Timestamp, backwards bool,
+) (eventID string, originServerTS spec.Timestamp, err error) {
+	stmt := s.selectEventIDForTimestampForwardsStmt
+	if backwards {
+		stmt = s.selectEventIDForTimestampBackwardsStmt
+	}
+	err = sqlutil.TxStmt(txn, stmt).QueryRowContext(ctx, roomID, ts).Scan(&eventID, &originServerTS)
+	return
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/lib/pq"
 	"github.com/neilalexander/harmony/internal"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/syncapi/storage/tables"
@@ -66,12 +67,43 @@ const selectRelationsInRangeDescSQL = "" +
 const selectMaxRelationIDSQL = "" +
 	"SELECT COALESCE(MAX(id), 0) FROM syncapi_relations"
 
+// A user has participated in a thread if they sent the thread root or any
+// of the events in the thread.
+const threadParticipatedSQL = "" +
+	"(EXISTS (SELECT 1 FROM syncapi_output_room_events e WHERE e.event_id = r.event_id AND e.sender = $2)" +
+	" OR EXISTS (SELECT 1 FROM syncapi_relations t" +
+	"  JOIN syncapi_output_room_events e ON e.event_id = t.child_event_id" +
+	"  WHERE t.room_id = r.room_id AND t.event_id = r.event_id AND t.rel_type = 'm.thread' AND e.sender = $2))"
+
+const selectThreadsSQL = "" +
+	"SELECT r.event_id, MAX(r.id) AS latest_id FROM syncapi_relations r" +
+	" WHERE r.room_id = $1 AND r.rel_type = 'm.thread'" +
+	" AND ( $2 = '' OR " + threadParticipatedSQL + " )" +
+	" GROUP BY r.event_id" +
+	" HAVING ( $3 = 0 OR MAX(r.id) < $3 )" +
+	" ORDER BY latest_id DESC LIMIT $4"
+
+const selectThreadSummariesSQL = "" +
+	"SELECT r.event_id, COUNT(*), (ARRAY_AGG(r.child_event_id ORDER BY r.id DESC))[1], " +
+	threadParticipatedSQL +
+	" FROM syncapi_relations r" +
+	" WHERE r.room_id = $1 AND r.event_id = ANY($3) AND r.rel_type = 'm.thread'" +
+	" GROUP BY r.room_id, r.event_id"
+
+const selectRelationsForEventsSQL = "" +
+	"SELECT event_id, id, child_event_id, rel_type FROM syncapi_relations" +
+	" WHERE room_id = $1 AND event_id = ANY($2) AND rel_type = ANY($3)" +
+	" ORDER BY id ASC"
+
 type relationsStatements struct {
 	insertRelationStmt             *sql.Stmt
 	selectRelationsInRangeAscStmt  *sql.Stmt
 	selectRelationsInRangeDescStmt *sql.Stmt
 	deleteRelationStmt             *sql.Stmt
 	selectMaxRelationIDStmt        *sql.Stmt
+	selectThreadsStmt              *sql.Stmt
+	selectThreadSummariesStmt      *sql.Stmt
+	selectRelationsForEventsStmt   *sql.Stmt
 }
 
 func NewPostgresRelationsTable(db *sql.DB) (tables.Relations, error) {
@@ -86,6 +118,9 @@ func NewPostgresRelationsTable(db *sql.DB) (tables.Relations, error) {
 		{&s.selectRelationsInRangeDescStmt, selectRelationsInRangeDescSQL},
 		{&s.deleteRelationStmt, deleteRelationSQL},
 		{&s.selectMaxRelationIDStmt, selectMaxRelationIDSQL},
+		{&s.selectThreadsStmt, selectThreadsSQL},
+		{&s.selectThreadSummariesStmt, selectThreadSummariesSQL},
+		{&s.selectRelationsForEventsStmt, selectRelationsForEventsSQL},
 	}.Prepare(db)
 }
 
@@ -156,3 +191,75 @@ func (s *relationsStatements) SelectMaxRelationID(
 	err = stmt.QueryRowContext(ctx).Scan(&id)
 	return
 }
+
+// SelectThreads returns the thread roots in the room, ordered by the position
+// of the most recent event in each thread, newest first.
+func (s *relationsStatements) SelectThreads(
+	ctx context.Context, txn *sql.Tx, roomID, participantSenderID string,
+	from types.StreamPosition, limit int,
+) ([]types.RelationEntry, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectThreadsStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, participantSenderID, from, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectThreads: rows.close() failed")
+	var result []types.RelationEntry
+	for rows.Next() {
+		var entry types.RelationEntry
+		if err = rows.Scan(&entry.EventID, &entry.Position); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
+// SelectThreadSummaries returns a map of thread root event ID -> summary for
+// those of the given event IDs which are thread roots.
+func (s *relationsStatements) SelectThreadSummaries(
+	ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string, senderID string,
+) (map[string]*types.ThreadSummary, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectThreadSummariesStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, senderID, pq.StringArray(eventIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectThreadSummaries: rows.close() failed")
+	result := map[string]*types.ThreadSummary{}
+	for rows.Next() {
+		var eventID string
+		summary := &types.ThreadSummary{}
+		if err = rows.Scan(&eventID, &summary.Count, &summary.LatestEventID, &summary.Participated); err != nil {
+			return nil, err
+		}
+		result[eventID] = summary
+	}
+	return result, rows.Err()
+}
+
+// SelectRelationsForEvents returns a map of event ID -> rel_type -> []entry
+// for the relations of the given types which refer to any of the given events.
+func (s *relationsStatements) SelectRelationsForEvents(
+	ctx context.Context, txn *sql.Tx, roomID string, eventIDs, relTypes []string,
+) (map[string]map[string][]types.RelationEntry, error) {
+	stmt := sqlutil.TxStmt(txn, s.selectRelationsForEventsStmt)
+	rows, err := stmt.QueryContext(ctx, roomID, pq.StringArray(eventIDs), pq.StringArray(relTypes))
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRelationsForEvents: rows.close() failed")
+	result := map[string]map[string][]types.RelationEntry{}
+	for rows.Next() {
+		var eventID, relType string
+		var entry types.RelationEntry
+		if err = rows.Scan(&eventID, &entry.Position, &entry.EventID, &relType); err != nil {
+			return nil, err
+		}
+		if result[eventID] == nil {
+			result[eventID] = map[string][]types.RelationEntry{}
+		}
+		result[eventID][relType] = append(result[eventID][relType], entry)
+	}
+	return result, rows.Err()
+}
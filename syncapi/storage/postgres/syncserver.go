@@ -58,6 +58,10 @@ func NewDatabase(ctx context.Context, cm *sqlutil.Connections, dbProperties *con
 	if err != nil {
 		return nil, err
 	}
+	knocks, err := NewPostgresKnocksTable(d.db)
+	if err != nil {
+		return nil, err
+	}
 	topology, err := NewPostgresTopologyTable(d.db)
 	if err != nil {
 		return nil, err
@@ -106,6 +110,10 @@ func NewDatabase(ctx context.Context, cm *sqlutil.Connections, dbProperties *con
 			Version: "syncapi: set history visibility for existing events",
 			Up:      deltas.UpSetHistoryVisibility, // Requires current_room_state and output_room_events to be created.
 		},
+		sqlutil.Migration{
+			Version: "syncapi: set origin_server_ts for existing events in topology",
+			Up:      deltas.UpSetTopologyOriginServerTS, // Requires output_room_events and output_room_events_topology to be created.
+		},
 	)
 	err = m.Up(ctx)
 	if err != nil {
@@ -116,6 +124,7 @@ func NewDatabase(ctx context.Context, cm *sqlutil.Connections, dbProperties *con
 		DB:                  d.db,
 		Writer:              d.writer,
 		Invites:             invites,
+		Knocks:              knocks,
 		AccountData:         accountData,
 		OutputEvents:        events,
 		Topology:            topology,
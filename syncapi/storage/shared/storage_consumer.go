@@ -41,6 +41,7 @@ type Database struct {
 	DB                  *sql.DB
 	Writer              sqlutil.Writer
 	Invites             tables.Invites
+	Knocks              tables.Knocks
 	AccountData         tables.AccountData
 	OutputEvents        tables.Events
 	Topology            tables.Topology
@@ -158,6 +159,31 @@ func (d *Database) RetireInviteEvent(
 	return
 }
 
+// AddKnockEvent stores a new knock event for a user.
+// If the knock was successfully stored this returns the stream ID it was stored at.
+// Returns an error if there was a problem communicating with the database.
+func (d *Database) AddKnockEvent(
+	ctx context.Context, knockEvent *rstypes.HeaderedEvent,
+) (sp types.StreamPosition, err error) {
+	_ = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		sp, err = d.Knocks.InsertKnockEvent(ctx, txn, knockEvent)
+		return err
+	})
+	return
+}
+
+// RetireKnockEvent removes an old knock from the database.
+// Returns an error if there was a problem communicating with the database.
+func (d *Database) RetireKnockEvent(
+	ctx context.Context, roomID, targetUserID string,
+) (sp types.StreamPosition, err error) {
+	_ = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		sp, err = d.Knocks.DeleteKnockEvent(ctx, txn, roomID, targetUserID)
+		return err
+	})
+	return
+}
+
 // UpsertAccountData keeps track of new or updated account data, by saving the type
 // of the new/updated data, and the user ID and room ID the data is related to (empty)
 // room ID means the data isn't specific to any room)
@@ -482,17 +508,17 @@ func getMembershipFromEvent(ctx context.Context, ev gomatrixserverlib.PDU, userI
 }
 
 // StoreReceipt stores user receipts
-func (d *Database) StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId string, timestamp spec.Timestamp) (pos types.StreamPosition, err error) {
+func (d *Database) StoreReceipt(ctx context.Context, roomId, receiptType, userId, eventId, threadId string, timestamp spec.Timestamp) (pos types.StreamPosition, err error) {
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		pos, err = d.Receipts.UpsertReceipt(ctx, txn, roomId, receiptType, userId, eventId, timestamp)
+		pos, err = d.Receipts.UpsertReceipt(ctx, txn, roomId, receiptType, userId, eventId, threadId, timestamp)
 		return err
 	})
 	return
 }
 
-func (d *Database) UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int) (pos types.StreamPosition, err error) {
+func (d *Database) UpsertRoomUnreadNotificationCounts(ctx context.Context, userID, roomID string, notificationCount, highlightCount int, threadCounts map[string]eventutil.ThreadNotificationData) (pos types.StreamPosition, err error) {
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		pos, err = d.NotificationData.UpsertRoomUnreadCounts(ctx, txn, userID, roomID, notificationCount, highlightCount)
+		pos, err = d.NotificationData.UpsertRoomUnreadCounts(ctx, txn, userID, roomID, notificationCount, highlightCount, threadCounts)
 		return err
 	})
 	return
@@ -61,6 +61,14 @@ func (d *DatabaseTransaction) MaxStreamPositionForInvites(ctx context.Context) (
 	return types.StreamPosition(id), nil
 }
 
+func (d *DatabaseTransaction) MaxStreamPositionForKnocks(ctx context.Context) (types.StreamPosition, error) {
+	id, err := d.Knocks.SelectMaxKnockID(ctx, d.txn)
+	if err != nil {
+		return 0, fmt.Errorf("d.Knocks.SelectMaxKnockID: %w", err)
+	}
+	return types.StreamPosition(id), nil
+}
+
 func (d *DatabaseTransaction) MaxStreamPositionForSendToDeviceMessages(ctx context.Context) (types.StreamPosition, error) {
 	id, err := d.SendToDevice.SelectMaxSendToDeviceMessageID(ctx, d.txn)
 	if err != nil {
@@ -166,6 +174,10 @@ func (d *DatabaseTransaction) InviteEventsInRange(ctx context.Context, targetUse
 	return d.Invites.SelectInviteEventsInRange(ctx, d.txn, targetUserID, r)
 }
 
+func (d *DatabaseTransaction) KnockEventsInRange(ctx context.Context, targetUserID string, r types.Range) (map[string]*rstypes.HeaderedEvent, map[string]*rstypes.HeaderedEvent, types.StreamPosition, error) {
+	return d.Knocks.SelectKnockEventsInRange(ctx, d.txn, targetUserID, r)
+}
+
 func (d *DatabaseTransaction) RoomReceiptsAfter(ctx context.Context, roomIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []types.OutputReceiptEvent, error) {
 	return d.Receipts.SelectRoomReceiptsAfter(ctx, d.txn, roomIDs, streamPos)
 }
@@ -279,6 +291,16 @@ func (d *DatabaseTransaction) EventPositionInTopology(
 	return types.TopologyToken{Depth: depth, PDUPosition: stream}, nil
 }
 
+func (d *DatabaseTransaction) EventIDForTimestamp(
+	ctx context.Context, roomID string, ts spec.Timestamp, backwards bool,
+) (string, spec.Timestamp, error) {
+	eventID, originServerTS, err := d.Topology.SelectEventIDForTimestamp(ctx, d.txn, roomID, ts, backwards)
+	if err == sql.ErrNoRows {
+		return "", 0, nil
+	}
+	return eventID, originServerTS, err
+}
+
 func (d *DatabaseTransaction) StreamToTopologicalPosition(
 	ctx context.Context, roomID string, streamPos types.StreamPosition, backwardOrdering bool,
 ) (types.TopologyToken, error) {
@@ -612,6 +634,9 @@ func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
 		if err := d.Invites.PurgeInvites(ctx, txn, roomID); err != nil {
 			return fmt.Errorf("failed to purge invites: %w", err)
 		}
+		if err := d.Knocks.PurgeKnocks(ctx, txn, roomID); err != nil {
+			return fmt.Errorf("failed to purge knocks: %w", err)
+		}
 		if err := d.Memberships.PurgeMemberships(ctx, txn, roomID); err != nil {
 			return fmt.Errorf("failed to purge memberships: %w", err)
 		}
@@ -747,3 +772,45 @@ func (d *DatabaseTransaction) RelationsFor(ctx context.Context, roomID, eventID,
 
 	return events, prevBatch, nextBatch, nil
 }
+
+func (d *DatabaseTransaction) ThreadsFor(ctx context.Context, roomID, participantSenderID string, from types.StreamPosition, limit int) (
+	events []types.StreamEvent, nextBatch string, err error,
+) {
+	// As with relations, we request one more thread than the limit so that we know
+	// whether or not to provide a "next_batch" in the response.
+	entries, err := d.Relations.SelectThreads(ctx, d.txn, roomID, participantSenderID, from, limit+1)
+	if err != nil {
+		return nil, "", fmt.Errorf("d.Relations.SelectThreads: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, "", nil
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		nextBatch = fmt.Sprintf("%d", entries[len(entries)-1].Position)
+	}
+
+	eventIDs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		eventIDs = append(eventIDs, entry.EventID)
+	}
+	events, err = d.OutputEvents.SelectEvents(ctx, d.txn, eventIDs, nil, true)
+	if err != nil {
+		return nil, "", fmt.Errorf("d.OutputEvents.SelectEvents: %w", err)
+	}
+	return events, nextBatch, nil
+}
+
+func (d *DatabaseTransaction) ThreadSummaries(ctx context.Context, roomID string, eventIDs []string, senderID string) (map[string]*types.ThreadSummary, error) {
+	if len(eventIDs) == 0 {
+		return map[string]*types.ThreadSummary{}, nil
+	}
+	return d.Relations.SelectThreadSummaries(ctx, d.txn, roomID, eventIDs, senderID)
+}
+
+func (d *DatabaseTransaction) RelationsForEvents(ctx context.Context, roomID string, eventIDs, relTypes []string) (map[string]map[string][]types.RelationEntry, error) {
+	if len(eventIDs) == 0 || len(relTypes) == 0 {
+		return map[string]map[string][]types.RelationEntry{}, nil
+	}
+	return d.Relations.SelectRelationsForEvents(ctx, d.txn, roomID, eventIDs, relTypes)
+}
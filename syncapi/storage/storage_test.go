@@ -1066,3 +1066,114 @@ func TestRedaction(t *testing.T) {
 		}
 	})
 }
+
+func TestThreads(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": "join"}, test.WithStateKey(bob.ID))
+
+	threadReply := func(root *rstypes.HeaderedEvent) map[string]interface{} {
+		return map[string]interface{}{
+			"body": "reply",
+			"m.relates_to": map[string]interface{}{
+				"rel_type": "m.thread",
+				"event_id": root.EventID(),
+			},
+		}
+	}
+	root1 := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "root 1"})
+	root2 := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "root 2"})
+	room.CreateAndInsert(t, bob, "m.room.message", threadReply(root1))
+	latest2 := room.CreateAndInsert(t, bob, "m.room.message", threadReply(root2))
+	latest1 := room.CreateAndInsert(t, bob, "m.room.message", threadReply(root1))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		t.Cleanup(close)
+		MustWriteEvents(t, db, room.Events())
+		for _, ev := range room.Events() {
+			if err := db.UpdateRelations(ctx, ev); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		WithSnapshot(t, db, func(snapshot storage.DatabaseTransaction) {
+			// Threads are ordered by their most recent reply, so root1 comes first.
+			events, nextBatch, err := snapshot.ThreadsFor(ctx, room.ID, "", 0, 1)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(events))
+			assert.Equal(t, root1.EventID(), events[0].EventID())
+			assert.NotEqual(t, "", nextBatch)
+
+			from, err := types.NewStreamPositionFromString(nextBatch)
+			assert.NoError(t, err)
+			events, nextBatch, err = snapshot.ThreadsFor(ctx, room.ID, "", from, 1)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(events))
+			assert.Equal(t, root2.EventID(), events[0].EventID())
+			assert.Equal(t, "", nextBatch)
+
+			// Alice only participated in the first thread, by sending the root.
+			events, _, err = snapshot.ThreadsFor(ctx, room.ID, alice.ID, 0, 10)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, len(events))
+			assert.Equal(t, root1.EventID(), events[0].EventID())
+
+			summaries, err := snapshot.ThreadSummaries(ctx, room.ID, []string{root1.EventID(), root2.EventID(), latest1.EventID()}, alice.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]*types.ThreadSummary{
+				root1.EventID(): {Count: 2, LatestEventID: latest1.EventID(), Participated: true},
+				root2.EventID(): {Count: 1, LatestEventID: latest2.EventID(), Participated: false},
+			}, summaries)
+		})
+	})
+}
+
+func TestRelationsForEvents(t *testing.T) {
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+
+	relatesTo := func(relType string, target *rstypes.HeaderedEvent) map[string]interface{} {
+		return map[string]interface{}{
+			"body": "related",
+			"m.relates_to": map[string]interface{}{
+				"rel_type": relType,
+				"event_id": target.EventID(),
+			},
+		}
+	}
+	original := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "original"})
+	other := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "other"})
+	edit1 := room.CreateAndInsert(t, alice, "m.room.message", relatesTo("m.replace", original))
+	edit2 := room.CreateAndInsert(t, alice, "m.room.message", relatesTo("m.replace", original))
+	reference := room.CreateAndInsert(t, alice, "m.room.message", relatesTo("m.reference", other))
+	room.CreateAndInsert(t, alice, "m.reaction", relatesTo("m.annotation", original))
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := MustCreateDatabase(t, dbType)
+		t.Cleanup(close)
+		MustWriteEvents(t, db, room.Events())
+		for _, ev := range room.Events() {
+			if err := db.UpdateRelations(ctx, ev); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		WithSnapshot(t, db, func(snapshot storage.DatabaseTransaction) {
+			relations, err := snapshot.RelationsForEvents(ctx, room.ID, []string{original.EventID(), other.EventID()}, []string{"m.replace", "m.reference"})
+			assert.NoError(t, err)
+			assert.Equal(t, 2, len(relations))
+
+			edits := relations[original.EventID()]["m.replace"]
+			assert.Equal(t, 2, len(edits))
+			assert.Equal(t, edit1.EventID(), edits[0].EventID)
+			assert.Equal(t, edit2.EventID(), edits[1].EventID)
+			assert.Equal(t, 0, len(relations[original.EventID()]["m.annotation"]))
+
+			references := relations[other.EventID()]["m.reference"]
+			assert.Equal(t, 1, len(references))
+			assert.Equal(t, reference.EventID(), references[0].EventID)
+		})
+	})
+}
@@ -45,6 +45,16 @@ type Invites interface {
 	PurgeInvites(ctx context.Context, txn *sql.Tx, roomID string) error
 }
 
+type Knocks interface {
+	InsertKnockEvent(ctx context.Context, txn *sql.Tx, knockEvent *rstypes.HeaderedEvent) (streamPos types.StreamPosition, err error)
+	DeleteKnockEvent(ctx context.Context, txn *sql.Tx, roomID, targetUserID string) (types.StreamPosition, error)
+	// SelectKnockEventsInRange returns a map of room ID to knock events. If multiple knock/retired knocks exist in the given range, return the latest value
+	// for the room.
+	SelectKnockEventsInRange(ctx context.Context, txn *sql.Tx, targetUserID string, r types.Range) (knocks map[string]*rstypes.HeaderedEvent, retired map[string]*rstypes.HeaderedEvent, maxID types.StreamPosition, err error)
+	SelectMaxKnockID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+	PurgeKnocks(ctx context.Context, txn *sql.Tx, roomID string) error
+}
+
 type Events interface {
 	SelectStateInRange(ctx context.Context, txn *sql.Tx, r types.Range, stateFilter *synctypes.StateFilter, roomIDs []string) (map[string]map[string]bool, map[string]types.StreamEvent, error)
 	SelectMaxEventID(ctx context.Context, txn *sql.Tx) (id int64, err error)
@@ -88,6 +98,10 @@ type Topology interface {
 	SelectPositionInTopology(ctx context.Context, txn *sql.Tx, eventID string) (depth, spos types.StreamPosition, err error)
 	// SelectStreamToTopologicalPosition converts a stream position to a topological position by finding the nearest topological position in the room.
 	SelectStreamToTopologicalPosition(ctx context.Context, txn *sql.Tx, roomID string, streamPos types.StreamPosition, forward bool) (topoPos types.StreamPosition, err error)
+	// SelectEventIDForTimestamp returns the ID and timestamp of the event in the room whose origin_server_ts is
+	// closest to the given timestamp, at or after it when looking forwards and at or before it when looking backwards.
+	// Returns sql.ErrNoRows if there is no such event.
+	SelectEventIDForTimestamp(ctx context.Context, txn *sql.Tx, roomID string, ts spec.Timestamp, backwards bool) (eventID string, originServerTS spec.Timestamp, err error)
 	PurgeEventsTopology(ctx context.Context, txn *sql.Tx, roomID string) error
 }
 
@@ -175,7 +189,7 @@ type Filter interface {
 }
 
 type Receipts interface {
-	UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId string, timestamp spec.Timestamp) (pos types.StreamPosition, err error)
+	UpsertReceipt(ctx context.Context, txn *sql.Tx, roomId, receiptType, userId, eventId, threadId string, timestamp spec.Timestamp) (pos types.StreamPosition, err error)
 	SelectRoomReceiptsAfter(ctx context.Context, txn *sql.Tx, roomIDs []string, streamPos types.StreamPosition) (types.StreamPosition, []types.OutputReceiptEvent, error)
 	SelectMaxReceiptID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 	PurgeReceipts(ctx context.Context, txn *sql.Tx, roomID string) error
@@ -194,7 +208,7 @@ type Memberships interface {
 }
 
 type NotificationData interface {
-	UpsertRoomUnreadCounts(ctx context.Context, txn *sql.Tx, userID, roomID string, notificationCount, highlightCount int) (types.StreamPosition, error)
+	UpsertRoomUnreadCounts(ctx context.Context, txn *sql.Tx, userID, roomID string, notificationCount, highlightCount int, threadCounts map[string]eventutil.ThreadNotificationData) (types.StreamPosition, error)
 	SelectUserUnreadCountsForRooms(ctx context.Context, txn *sql.Tx, userID string, roomIDs []string) (map[string]*eventutil.NotificationData, error)
 	SelectMaxID(ctx context.Context, txn *sql.Tx) (int64, error)
 	PurgeNotificationData(ctx context.Context, txn *sql.Tx, roomID string) error
@@ -229,4 +243,15 @@ type Relations interface {
 	// should be if there are no boundaries supplied (i.e. we want to work backwards but don't have a
 	// "from" or want to work forwards and don't have a "to").
 	SelectMaxRelationID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+	// SelectThreads returns the thread roots in the room as entries, where the position is that of the
+	// most recent event in the thread. Threads are ordered newest first and only include threads whose
+	// most recent event is before the "from" position, unless it is 0. If a sender ID is specified then
+	// only threads that the sender has participated in are returned.
+	SelectThreads(ctx context.Context, txn *sql.Tx, roomID, participantSenderID string, from types.StreamPosition, limit int) ([]types.RelationEntry, error)
+	// SelectThreadSummaries returns a map of thread root event ID -> summary for any of the given event
+	// IDs which are thread roots. Participation is calculated for the given sender ID.
+	SelectThreadSummaries(ctx context.Context, txn *sql.Tx, roomID string, eventIDs []string, senderID string) (map[string]*types.ThreadSummary, error)
+	// SelectRelationsForEvents returns the relations of the given types which refer to any of the given
+	// event IDs. The map is event ID -> relType -> []entry, with the entries in the order they were stored.
+	SelectRelationsForEvents(ctx context.Context, txn *sql.Tx, roomID string, eventIDs, relTypes []string) (map[string]map[string][]types.RelationEntry, error)
 }
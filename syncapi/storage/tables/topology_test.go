@@ -5,8 +5,11 @@ import (
 	"database/sql"
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
+	rstypes "github.com/neilalexander/harmony/roomserver/types"
 	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/syncapi/storage/postgres"
 	"github.com/neilalexander/harmony/syncapi/storage/tables"
@@ -96,3 +99,46 @@ func TestTopologyTable(t *testing.T) {
 		}
 	})
 }
+
+func TestTopologyTable_EventIDForTimestamp(t *testing.T) {
+	ctx := context.Background()
+	alice := test.NewUser(t)
+	room := test.NewRoom(t, alice)
+	base := time.UnixMilli(1_000_000)
+	first := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "first"}, test.WithTimestamp(base.Add(time.Minute)))
+	second := room.CreateAndInsert(t, alice, "m.room.message", map[string]interface{}{"body": "second"}, test.WithTimestamp(base.Add(2*time.Minute)))
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		tab, db, close := newTopologyTable(t, dbType)
+		defer close()
+		err := sqlutil.WithTransaction(db, func(txn *sql.Tx) error {
+			for i, ev := range []*rstypes.HeaderedEvent{first, second} {
+				if _, err := tab.InsertEventInTopology(ctx, txn, ev, types.StreamPosition(i)); err != nil {
+					return fmt.Errorf("failed to InsertEventInTopology: %s", err)
+				}
+			}
+			between := spec.AsTimestamp(base.Add(90 * time.Second))
+
+			eventID, ts, err := tab.SelectEventIDForTimestamp(ctx, txn, room.ID, between, false)
+			assert.NoError(t, err)
+			assert.Equal(t, second.EventID(), eventID)
+			assert.Equal(t, second.OriginServerTS(), ts)
+
+			eventID, ts, err = tab.SelectEventIDForTimestamp(ctx, txn, room.ID, between, true)
+			assert.NoError(t, err)
+			assert.Equal(t, first.EventID(), eventID)
+			assert.Equal(t, first.OriginServerTS(), ts)
+
+			// An exact match is returned in both directions
+			eventID, _, err = tab.SelectEventIDForTimestamp(ctx, txn, room.ID, first.OriginServerTS(), false)
+			assert.NoError(t, err)
+			assert.Equal(t, first.EventID(), eventID)
+
+			_, _, err = tab.SelectEventIDForTimestamp(ctx, txn, room.ID, spec.AsTimestamp(base.Add(time.Hour)), false)
+			assert.ErrorIs(t, err, sql.ErrNoRows)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package streams
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+
+	"github.com/neilalexander/harmony/roomserver/api"
+	"github.com/neilalexander/harmony/syncapi/storage"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
+	"github.com/neilalexander/harmony/syncapi/types"
+)
+
+type KnockStreamProvider struct {
+	DefaultStreamProvider
+	rsAPI api.SyncRoomserverAPI
+}
+
+func (p *KnockStreamProvider) Setup(
+	ctx context.Context, snapshot storage.DatabaseTransaction,
+) {
+	p.DefaultStreamProvider.Setup(ctx, snapshot)
+
+	p.latestMutex.Lock()
+	defer p.latestMutex.Unlock()
+
+	id, err := snapshot.MaxStreamPositionForKnocks(ctx)
+	if err != nil {
+		panic(err)
+	}
+	p.latest = id
+}
+
+func (p *KnockStreamProvider) CompleteSync(
+	ctx context.Context,
+	snapshot storage.DatabaseTransaction,
+	req *types.SyncRequest,
+) types.StreamPosition {
+	return p.IncrementalSync(ctx, snapshot, req, 0, p.LatestPosition(ctx))
+}
+
+func (p *KnockStreamProvider) IncrementalSync(
+	ctx context.Context,
+	snapshot storage.DatabaseTransaction,
+	req *types.SyncRequest,
+	from, to types.StreamPosition,
+) types.StreamPosition {
+	r := types.Range{
+		From: from,
+		To:   to,
+	}
+
+	knocks, retiredKnocks, maxID, err := snapshot.KnockEventsInRange(
+		ctx, req.Device.UserID, r,
+	)
+	if err != nil {
+		req.Log.WithError(err).Error("p.DB.KnockEventsInRange failed")
+		return from
+	}
+
+	eventFormat := synctypes.FormatSync
+	if req.Filter.EventFormat == synctypes.EventFormatFederation {
+		eventFormat = synctypes.FormatSyncFederation
+	}
+
+	for roomID, knockEvent := range knocks {
+		kr, err := types.NewKnockResponse(ctx, p.rsAPI, knockEvent, eventFormat)
+		if err != nil {
+			req.Log.WithError(err).Error("failed creating knock response")
+			continue
+		}
+		req.Response.Rooms.Knock[roomID] = kr
+	}
+
+	// When doing an initial sync, we don't want to add retired knocks, as this
+	// can add rooms we knocked on, but have since left.
+	if from == 0 {
+		return to
+	}
+	for roomID := range retiredKnocks {
+		// If the knock was retired because we were invited or joined, or
+		// because it was rejected, then another stream will already have told
+		// the client about the new membership.
+		if _, ok := req.Response.Rooms.Join[roomID]; ok {
+			continue
+		}
+		if _, ok := req.Response.Rooms.Invite[roomID]; ok {
+			continue
+		}
+		if _, ok := req.Response.Rooms.Leave[roomID]; ok {
+			continue
+		}
+		membership, _, err := snapshot.SelectMembershipForUser(ctx, roomID, req.Device.UserID, math.MaxInt64)
+		// Skip if the user is an existing member of the room.
+		// Otherwise, the NewLeaveResponse will eject the user from the room unintentionally
+		if membership == spec.Join || membership == spec.Invite ||
+			err != nil {
+			continue
+		}
+
+		lr := types.NewLeaveResponse()
+		h := sha256.Sum256(append([]byte(roomID), []byte(strconv.FormatInt(int64(to), 10))...))
+		lr.Timeline.Events = append(lr.Timeline.Events, synctypes.ClientEvent{
+			// fake event ID which muxes in the to position
+			EventID:        "$" + base64.RawURLEncoding.EncodeToString(h[:]),
+			OriginServerTS: spec.AsTimestamp(time.Now()),
+			RoomID:         roomID,
+			Sender:         req.Device.UserID,
+			StateKey:       &req.Device.UserID,
+			Type:           "m.room.member",
+			Content:        spec.RawJSON(`{"membership":"leave"}`),
+		})
+		req.Response.Rooms.Leave[roomID] = lr
+	}
+
+	return maxID
+}
@@ -60,6 +60,29 @@ func (p *NotificationDataStreamProvider) IncrementalSync(
 			HighlightCount:    counts.UnreadHighlightCount,
 			NotificationCount: counts.UnreadNotificationCount,
 		}
+		// If the client asked for the counts to be split by thread then the
+		// main timeline counts go into unread_notifications and the rest into
+		// unread_thread_notifications. Counts stored before threads were
+		// tracked have no split, so those are left as they are.
+		if req.Filter.Room.Timeline.UnreadThreadNotifications && len(counts.Threads) > 0 {
+			main := counts.Threads[eventutil.MainThreadID]
+			jr.UnreadNotifications = &types.UnreadNotifications{
+				HighlightCount:    main.UnreadHighlightCount,
+				NotificationCount: main.UnreadNotificationCount,
+			}
+			for threadID, threadCounts := range counts.Threads {
+				if threadID == eventutil.MainThreadID {
+					continue
+				}
+				if jr.UnreadThreadNotifications == nil {
+					jr.UnreadThreadNotifications = map[string]*types.UnreadNotifications{}
+				}
+				jr.UnreadThreadNotifications[threadID] = &types.UnreadNotifications{
+					HighlightCount:    threadCounts.UnreadHighlightCount,
+					NotificationCount: threadCounts.UnreadNotificationCount,
+				}
+			}
+		}
 		req.Response.Rooms.Join[roomID] = jr
 	}
 
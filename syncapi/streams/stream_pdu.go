@@ -406,6 +406,7 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 		jr.Timeline.Events = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(events), eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 			return p.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 		})
+		p.bundleAggregations(ctx, snapshot, device, delta.RoomID, jr.Timeline.Events, eventFormat)
 		// If we are limited by the filter AND the history visibility filter
 		// didn't "remove" events, return that the response is limited.
 		jr.Timeline.Limited = (limited && len(events) == len(recentEvents)) || delta.NewlyJoined
@@ -423,6 +424,7 @@ func (p *PDUStreamProvider) addRoomDeltaToResponse(
 		lr.Timeline.Events = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(events), eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 			return p.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 		})
+		p.bundleAggregations(ctx, snapshot, device, delta.RoomID, lr.Timeline.Events, eventFormat)
 		// If we are limited by the filter AND the history visibility filter
 		// didn't "remove" events, return that the response is limited.
 		lr.Timeline.Limited = limited && len(events) == len(recentEvents)
@@ -583,6 +585,7 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	jr.Timeline.Events = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(events), eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
 		return p.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
 	})
+	p.bundleAggregations(ctx, snapshot, device, roomID, jr.Timeline.Events, eventFormat)
 	// If we are limited by the filter AND the history visibility filter
 	// didn't "remove" events, return that the response is limited.
 	jr.Timeline.Limited = limited && len(events) == len(recentEvents)
@@ -592,6 +595,22 @@ func (p *PDUStreamProvider) getJoinResponseForCompleteSync(
 	return jr, nil
 }
 
+// bundleAggregations adds bundled aggregations to the timeline events of a
+// room. Failing to do so isn't fatal to the sync, so errors are only logged.
+func (p *PDUStreamProvider) bundleAggregations(
+	ctx context.Context, snapshot storage.DatabaseTransaction, device *userapi.Device,
+	roomID string, events []synctypes.ClientEvent, eventFormat synctypes.ClientEventFormat,
+) {
+	userID, err := spec.NewUserID(device.UserID, true)
+	if err != nil {
+		logrus.WithError(err).Error("invalid device user ID")
+		return
+	}
+	if err = internal.BundleAggregations(ctx, snapshot, p.rsAPI, *userID, roomID, events, eventFormat); err != nil {
+		logrus.WithError(err).WithField("room_id", roomID).Warn("failed to bundle aggregations")
+	}
+}
+
 func (p *PDUStreamProvider) lazyLoadMembers(
 	ctx context.Context, snapshot storage.DatabaseTransaction, roomID string,
 	incremental, limited bool, stateFilter *synctypes.StateFilter,
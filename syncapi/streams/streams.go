@@ -17,6 +17,7 @@ type Streams struct {
 	TypingStreamProvider           StreamProvider
 	ReceiptStreamProvider          StreamProvider
 	InviteStreamProvider           StreamProvider
+	KnockStreamProvider            StreamProvider
 	SendToDeviceStreamProvider     StreamProvider
 	AccountDataStreamProvider      StreamProvider
 	DeviceListStreamProvider       StreamProvider
@@ -47,6 +48,10 @@ func NewSyncStreamProviders(
 			DefaultStreamProvider: DefaultStreamProvider{DB: d},
 			rsAPI:                 rsAPI,
 		},
+		KnockStreamProvider: &KnockStreamProvider{
+			DefaultStreamProvider: DefaultStreamProvider{DB: d},
+			rsAPI:                 rsAPI,
+		},
 		SendToDeviceStreamProvider: &SendToDeviceStreamProvider{
 			DefaultStreamProvider: DefaultStreamProvider{DB: d},
 		},
@@ -80,6 +85,7 @@ func NewSyncStreamProviders(
 	streams.TypingStreamProvider.Setup(ctx, snapshot)
 	streams.ReceiptStreamProvider.Setup(ctx, snapshot)
 	streams.InviteStreamProvider.Setup(ctx, snapshot)
+	streams.KnockStreamProvider.Setup(ctx, snapshot)
 	streams.SendToDeviceStreamProvider.Setup(ctx, snapshot)
 	streams.AccountDataStreamProvider.Setup(ctx, snapshot)
 	streams.NotificationDataStreamProvider.Setup(ctx, snapshot)
@@ -96,6 +102,7 @@ func (s *Streams) Latest(ctx context.Context) types.StreamingToken {
 		TypingPosition:           s.TypingStreamProvider.LatestPosition(ctx),
 		ReceiptPosition:          s.ReceiptStreamProvider.LatestPosition(ctx),
 		InvitePosition:           s.InviteStreamProvider.LatestPosition(ctx),
+		KnockPosition:            s.KnockStreamProvider.LatestPosition(ctx),
 		SendToDevicePosition:     s.SendToDeviceStreamProvider.LatestPosition(ctx),
 		AccountDataPosition:      s.AccountDataStreamProvider.LatestPosition(ctx),
 		NotificationDataPosition: s.NotificationDataStreamProvider.LatestPosition(ctx),
@@ -53,6 +53,8 @@ type RequestPool struct {
 	Notifier *notifier.Notifier
 	producer PresencePublisher
 	consumer PresenceConsumer
+	// user ID + device ID + conn ID -> *slidingConnection
+	slidingConns *sync.Map
 }
 
 type PresencePublisher interface {
@@ -87,8 +89,11 @@ func NewRequestPool(
 		Notifier: notifier,
 		producer: producer,
 		consumer: consumer,
+
+		slidingConns: &sync.Map{},
 	}
 	go rp.cleanLastSeen()
+	go rp.cleanSlidingConnections()
 	go rp.cleanPresence(db, time.Minute*5)
 	return rp
 }
@@ -362,6 +367,14 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 						)
 					},
 				),
+				KnockPosition: withTransaction(
+					syncReq.Since.KnockPosition,
+					func(txn storage.DatabaseTransaction) types.StreamPosition {
+						return rp.streams.KnockStreamProvider.CompleteSync(
+							syncReq.Context, txn, syncReq,
+						)
+					},
+				),
 				SendToDevicePosition: withTransaction(
 					syncReq.Since.SendToDevicePosition,
 					func(txn storage.DatabaseTransaction) types.StreamPosition {
@@ -434,6 +447,15 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 						)
 					},
 				),
+				KnockPosition: withTransaction(
+					syncReq.Since.KnockPosition,
+					func(txn storage.DatabaseTransaction) types.StreamPosition {
+						return rp.streams.KnockStreamProvider.IncrementalSync(
+							syncReq.Context, txn, syncReq,
+							syncReq.Since.KnockPosition, rp.Notifier.CurrentPosition().KnockPosition,
+						)
+					},
+				),
 				SendToDevicePosition: withTransaction(
 					syncReq.Since.SendToDevicePosition,
 					func(txn storage.DatabaseTransaction) types.StreamPosition {
@@ -503,6 +525,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *userapi.
 			}
 		}
 
+		syncReq.Response.ApplyEventFields(syncReq.Filter.EventFields)
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: syncReq.Response,
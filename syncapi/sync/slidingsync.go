@@ -0,0 +1,429 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
+	"github.com/neilalexander/harmony/syncapi/types"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+// slidingConnectionExpiry is how long a sliding sync connection is kept
+// after its last request. Clients which come back later are told to start
+// a new connection.
+const slidingConnectionExpiry = time.Hour
+
+// maxSlidingTimelineLimit caps the timeline_limit of sliding sync requests.
+const maxSlidingTimelineLimit = 100
+
+// maxSlidingConnectionsPerDevice caps the number of sliding sync connections
+// kept for each device, as the conn_id is chosen by the client. Once a device
+// has this many, starting another replaces the least recently used one.
+const maxSlidingConnectionsPerDevice = 10
+
+// slidingDevice holds the sliding sync connections of a device by conn_id.
+type slidingDevice struct {
+	sync.Mutex
+	conns map[string]*slidingConnection
+}
+
+func newSlidingDevice() *slidingDevice {
+	return &slidingDevice{conns: map[string]*slidingConnection{}}
+}
+
+func (d *slidingDevice) connection(connID string) (*slidingConnection, bool) {
+	d.Lock()
+	defer d.Unlock()
+	conn, ok := d.conns[connID]
+	return conn, ok
+}
+
+// store stores the connection, replacing any existing connection with the
+// same conn_id, or the least recently used one if there are too many.
+func (d *slidingDevice) store(connID string, conn *slidingConnection) {
+	d.Lock()
+	defer d.Unlock()
+	if _, ok := d.conns[connID]; !ok && len(d.conns) >= maxSlidingConnectionsPerDevice {
+		var oldestID string
+		var oldest time.Time
+		for id, c := range d.conns {
+			if lastUsed := c.lastUsedAt(); oldestID == "" || lastUsed.Before(oldest) {
+				oldestID, oldest = id, lastUsed
+			}
+		}
+		delete(d.conns, oldestID)
+	}
+	d.conns[connID] = conn
+}
+
+// clean removes the expired connections, and returns true if there are
+// none left.
+func (d *slidingDevice) clean() bool {
+	d.Lock()
+	defer d.Unlock()
+	for id, conn := range d.conns {
+		if conn.expired() {
+			delete(d.conns, id)
+		}
+	}
+	return len(d.conns) == 0
+}
+
+// slidingConnection holds the positions handed out on a sliding sync
+// connection, which is identified by the device and the conn_id of the
+// request. Clients may retry a request with a position they have
+// used before, so positions are only forgotten once the client has moved
+// on from them.
+type slidingConnection struct {
+	sync.Mutex
+	nextPos   int64
+	positions map[int64]*slidingPosition
+	lastUsed  time.Time
+}
+
+// slidingPosition records what the client had been sent as of a position.
+type slidingPosition struct {
+	since types.StreamingToken
+	rooms map[string]slidingRoomState
+	lists map[string]int
+}
+
+// slidingRoomState is what the client knows about a room.
+type slidingRoomState struct {
+	membership        string
+	config            string
+	timelineLimit     int
+	notificationCount int
+	highlightCount    int
+}
+
+func newSlidingPosition() *slidingPosition {
+	return &slidingPosition{
+		rooms: map[string]slidingRoomState{},
+		lists: map[string]int{},
+	}
+}
+
+// position returns the state of the connection as of the given position.
+func (c *slidingConnection) position(pos int64) (*slidingPosition, bool) {
+	c.Lock()
+	defer c.Unlock()
+	p, ok := c.positions[pos]
+	if ok {
+		c.lastUsed = time.Now()
+	}
+	return p, ok
+}
+
+// advance stores the next position of the connection. The client has seen
+// the position it sent, so any older positions are no longer needed.
+func (c *slidingConnection) advance(from int64, next *slidingPosition) int64 {
+	c.Lock()
+	defer c.Unlock()
+	for pos := range c.positions {
+		if pos < from {
+			delete(c.positions, pos)
+		}
+	}
+	c.nextPos++
+	c.positions[c.nextPos] = next
+	c.lastUsed = time.Now()
+	return c.nextPos
+}
+
+func (c *slidingConnection) lastUsedAt() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.lastUsed
+}
+
+func (c *slidingConnection) expired() bool {
+	c.Lock()
+	defer c.Unlock()
+	return time.Since(c.lastUsed) > slidingConnectionExpiry
+}
+
+func (rp *RequestPool) cleanSlidingConnections() {
+	for {
+		rp.slidingConns.Range(func(key interface{}, value interface{}) bool {
+			if value.(*slidingDevice).clean() {
+				rp.slidingConns.Delete(key)
+			}
+			return true
+		})
+		time.Sleep(time.Minute)
+	}
+}
+
+// OnIncomingSlidingSyncRequest is called when a client makes a simplified sliding
+// sync (MSC4186) request. Like /sync, this blocks until there is something to
+// return to the client or the timeout is reached.
+func (rp *RequestPool) OnIncomingSlidingSyncRequest(req *http.Request, device *userapi.Device) util.JSONResponse {
+	var ssReq types.SlidingSyncRequest
+	if err := json.NewDecoder(req.Body).Decode(&ssReq); err != nil && err != io.EOF {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: spec.BadJSON("The request body could not be decoded into valid JSON. " + err.Error()),
+		}
+	}
+	if toDevice := ssReq.Extensions.ToDevice; toDevice != nil && toDevice.Since != "" {
+		if _, err := strconv.ParseInt(toDevice.Since, 10, 64); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.InvalidParam("invalid to_device since token"),
+			}
+		}
+	}
+	for _, list := range ssReq.Lists {
+		for _, r := range list.Ranges {
+			if r[0] < 0 || r[1] < r[0] {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: spec.InvalidParam("invalid list range"),
+				}
+			}
+		}
+	}
+
+	d, _ := rp.slidingConns.LoadOrStore(device.UserID+"|"+device.ID, newSlidingDevice())
+	deviceConns := d.(*slidingDevice)
+	from := newSlidingPosition()
+	var conn *slidingConnection
+	var fromPos int64
+	if posStr := req.URL.Query().Get("pos"); posStr != "" {
+		var ok bool
+		if c, found := deviceConns.connection(ssReq.ConnID); found {
+			conn = c
+			if pos, err := strconv.ParseInt(posStr, 10, 64); err == nil {
+				fromPos = pos
+				from, ok = conn.position(pos)
+			}
+		}
+		if !ok {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: spec.MatrixError{
+					ErrCode: "M_UNKNOWN_POS",
+					Err:     "Unknown position, the connection must be restarted",
+				},
+			}
+		}
+	} else {
+		conn = &slidingConnection{
+			positions: map[int64]*slidingPosition{},
+			lastUsed:  time.Now(),
+		}
+		deviceConns.store(ssReq.ConnID, conn)
+	}
+
+	filter := synctypes.DefaultFilter()
+	filter.AccountData.Limit = math.MaxInt32
+	filter.Room.AccountData.Limit = math.MaxInt32
+	timeout := getTimeout(req.URL.Query().Get("timeout"))
+	syncReq := &types.SyncRequest{
+		Context: req.Context(),
+		Log: util.GetLogger(req.Context()).WithFields(logrus.Fields{
+			"user_id":   device.UserID,
+			"device_id": device.ID,
+			"conn_id":   ssReq.ConnID,
+			"pos":       fromPos,
+			"timeout":   timeout,
+		}),
+		Device:            device,
+		Response:          types.NewResponse(),
+		Filter:            filter,
+		Since:             from.since,
+		Timeout:           timeout,
+		Rooms:             make(map[string]string),
+		MembershipChanges: make(map[string]struct{}),
+	}
+
+	activeSyncRequests.Inc()
+	defer activeSyncRequests.Dec()
+
+	rp.updateLastSeen(req, device)
+	rp.updatePresence(rp.db, req.FormValue("set_presence"), device.UserID)
+
+	for {
+		startTime := time.Now()
+
+		// Only wait for new data if the client already has an up-to-date
+		// position, otherwise there is something to send straight away.
+		currentPos := rp.Notifier.CurrentPosition()
+		if !from.since.IsEmpty() && !currentPos.IsAfter(from.since) && timeout > 0 {
+			if gaveUp := rp.waitForSlidingSync(syncReq, from.since, timeout); gaveUp {
+				return util.JSONResponse{
+					Code: http.StatusOK,
+					JSON: &types.SlidingSyncResponse{
+						Pos:   strconv.FormatInt(fromPos, 10),
+						Lists: listResponses(from.lists),
+						Rooms: map[string]*types.SlidingRoomResponse{},
+					},
+				}
+			}
+		}
+
+		res, next, err := rp.slidingSync(syncReq, &ssReq, from)
+		if err != nil {
+			syncReq.Log.WithError(err).Error("Failed to process sliding sync request")
+			return util.JSONResponse{
+				Code: http.StatusInternalServerError,
+				JSON: spec.InternalServerError{},
+			}
+		}
+
+		// As with /sync, don't return a no-op response if the client is happy
+		// to wait. The next position is used so that the same positions don't
+		// wake us up again.
+		if !from.since.IsEmpty() && timeout > 0 && !res.HasUpdates() && !listsChanged(from.lists, next.lists) {
+			from = next
+			syncReq.Since = next.since
+			if timeout -= time.Since(startTime); timeout > 0 {
+				continue
+			}
+		}
+
+		res.Pos = strconv.FormatInt(conn.advance(fromPos, next), 10)
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: res,
+		}
+	}
+}
+
+// waitForSlidingSync blocks until there are new events for the device or
+// the timeout expires. Returns true if the client went away.
+func (rp *RequestPool) waitForSlidingSync(syncReq *types.SyncRequest, since types.StreamingToken, timeout time.Duration) bool {
+	waitingSyncRequests.Inc()
+	defer waitingSyncRequests.Dec()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	userStreamListener := rp.Notifier.GetListener(*syncReq)
+	defer userStreamListener.Close()
+
+	select {
+	case <-syncReq.Context.Done():
+		return true
+	case <-timer.C:
+	case <-userStreamListener.GetNotifyChannel(since):
+	}
+	return false
+}
+
+// slidingSync works out the response for the request, along with what the
+// client will know once it has received it.
+func (rp *RequestPool) slidingSync(
+	syncReq *types.SyncRequest, ssReq *types.SlidingSyncRequest, from *slidingPosition,
+) (res *types.SlidingSyncResponse, next *slidingPosition, err error) {
+	ctx := syncReq.Context
+	snapshot, err := rp.db.NewDatabaseSnapshot(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	var succeeded bool
+	defer sqlutil.EndTransactionWithCheck(snapshot, &succeeded, &err)
+
+	to := rp.Notifier.CurrentPosition()
+	ignores, err := snapshot.IgnoresForUser(ctx, syncReq.Device.UserID)
+	switch {
+	case err == nil:
+		syncReq.IgnoredUsers = *ignores
+	case errors.Is(err, sql.ErrNoRows):
+	default:
+		return nil, nil, err
+	}
+
+	rooms, err := rp.slidingRooms(ctx, snapshot, syncReq, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	for roomID, room := range rooms {
+		syncReq.Rooms[roomID] = room.membership
+	}
+
+	res = &types.SlidingSyncResponse{
+		Lists: map[string]types.SlidingListResponse{},
+		Rooms: map[string]*types.SlidingRoomResponse{},
+	}
+	next = &slidingPosition{
+		since: to,
+		rooms: map[string]slidingRoomState{},
+		lists: map[string]int{},
+	}
+
+	window, err := rp.slidingWindow(ctx, snapshot, ssReq, rooms, next)
+	if err != nil {
+		return nil, nil, err
+	}
+	res.Lists = listResponses(next.lists)
+
+	initialRooms, err := rp.slidingRoomResponses(ctx, snapshot, syncReq, rooms, window, from, next, res)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = rp.slidingExtensions(ctx, snapshot, syncReq, ssReq, rooms, window, initialRooms, from.since, to, res); err != nil {
+		return nil, nil, err
+	}
+
+	succeeded = true
+	return res, next, nil
+}
+
+func listResponses(counts map[string]int) map[string]types.SlidingListResponse {
+	lists := make(map[string]types.SlidingListResponse, len(counts))
+	for name, count := range counts {
+		lists[name] = types.SlidingListResponse{Count: count}
+	}
+	return lists
+}
+
+func listsChanged(a, b map[string]int) bool {
+	if len(a) != len(b) {
+		return true
+	}
+	for name, count := range a {
+		if other, ok := b[name]; !ok || other != count {
+			return true
+		}
+	}
+	return false
+}
+
+// senderUserID returns a function which looks up the user IDs of the senders
+// of events, for converting them into client events.
+func (rp *RequestPool) senderUserID(ctx context.Context) spec.UserIDForSender {
+	return func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+		return rp.rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/syncapi/storage"
+	"github.com/neilalexander/harmony/syncapi/streams"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
+	"github.com/neilalexander/harmony/syncapi/types"
+)
+
+// slidingExtensions adds the enabled extensions to the response. The
+// extensions are worked out by the same stream providers as /sync, using a
+// request which only covers the rooms that the extension applies to.
+func (rp *RequestPool) slidingExtensions(
+	ctx context.Context, snapshot storage.DatabaseTransaction,
+	syncReq *types.SyncRequest, ssReq *types.SlidingSyncRequest,
+	rooms map[string]*slidingRoom, window *slidingWindow, initialRooms map[string]struct{},
+	since, to types.StreamingToken, res *types.SlidingSyncResponse,
+) error {
+	ext := ssReq.Extensions
+
+	if ext.ToDevice != nil && ext.ToDevice.Enabled {
+		// The client acknowledges to-device messages by sending the since
+		// token of the extension, at which point they can be deleted.
+		from, _ := strconv.ParseInt(ext.ToDevice.Since, 10, 64) // checked when decoding the request
+		if from > 0 {
+			if err := rp.db.CleanSendToDeviceUpdates(ctx, syncReq.Device.UserID, syncReq.Device.ID, types.StreamPosition(from)); err != nil {
+				syncReq.Log.WithError(err).Error("p.DB.CleanSendToDeviceUpdates failed")
+			}
+		}
+		r := slidingExtensionRequest(syncReq, nil)
+		pos := rp.streams.SendToDeviceStreamProvider.IncrementalSync(ctx, snapshot, r, types.StreamPosition(from), to.SendToDevicePosition)
+		events := r.Response.ToDevice.Events
+		if events == nil {
+			events = []gomatrixserverlib.SendToDeviceEvent{}
+		}
+		res.Extensions.ToDevice = &types.SlidingToDeviceResponse{
+			NextBatch: strconv.FormatInt(int64(pos), 10),
+			Events:    events,
+		}
+	}
+
+	if ext.E2EE != nil && ext.E2EE.Enabled {
+		// Device list changes are partly worked out from the memberships in the
+		// timelines, so give the provider the timelines that we're sending.
+		r := slidingExtensionRequest(syncReq, nil)
+		for roomID, roomRes := range res.Rooms {
+			room, ok := rooms[roomID]
+			switch {
+			case !ok:
+				r.Response.Rooms.Leave[roomID] = types.NewLeaveResponse()
+			case room.membership == spec.Join:
+				jr := types.NewJoinResponse()
+				jr.Timeline.Events = roomRes.Timeline
+				r.Response.Rooms.Join[roomID] = jr
+			}
+		}
+		if since.IsEmpty() {
+			rp.streams.DeviceListStreamProvider.CompleteSync(ctx, snapshot, r)
+		} else {
+			rp.streams.DeviceListStreamProvider.IncrementalSync(ctx, snapshot, r, since.DeviceListPosition, to.DeviceListPosition)
+		}
+		res.Extensions.E2EE = &types.SlidingE2EEResponse{
+			DeviceOneTimeKeysCount:       r.Response.DeviceListsOTKCount,
+			DeviceUnusedFallbackKeyTypes: r.Response.DeviceListsUnusedFallbackAlgorithms,
+		}
+		if len(r.Response.DeviceLists.Changed) > 0 || len(r.Response.DeviceLists.Left) > 0 {
+			res.Extensions.E2EE.DeviceLists = r.Response.DeviceLists
+		}
+	}
+
+	if ext.AccountData != nil && ext.AccountData.Enabled {
+		scoped := extensionRooms(ext.AccountData, window, rooms)
+		accountData := &types.SlidingAccountDataResponse{
+			Rooms: map[string][]synctypes.ClientEvent{},
+		}
+		r := slidingExtensionRequest(syncReq, scoped)
+		rp.streams.AccountDataStreamProvider.IncrementalSync(ctx, snapshot, r, since.AccountDataPosition, to.AccountDataPosition)
+		accountData.Global = r.Response.AccountData.Events
+		for roomID, jr := range r.Response.Rooms.Join {
+			if _, ok := scoped[roomID]; ok && len(jr.AccountData.Events) > 0 {
+				accountData.Rooms[roomID] = jr.AccountData.Events
+			}
+		}
+		// Rooms that are sent in full need all of their account data, not
+		// just what has changed since the last position.
+		if initial := intersect(scoped, initialRooms); !since.IsEmpty() && len(initial) > 0 {
+			r = slidingExtensionRequest(syncReq, initial)
+			rp.streams.AccountDataStreamProvider.IncrementalSync(ctx, snapshot, r, 0, to.AccountDataPosition)
+			for roomID, jr := range r.Response.Rooms.Join {
+				if _, ok := initial[roomID]; ok && len(jr.AccountData.Events) > 0 {
+					accountData.Rooms[roomID] = jr.AccountData.Events
+				}
+			}
+		}
+		res.Extensions.AccountData = accountData
+	}
+
+	if ext.Receipts != nil && ext.Receipts.Enabled {
+		res.Extensions.Receipts = rp.slidingEphemeral(
+			ctx, snapshot, syncReq, rp.streams.ReceiptStreamProvider, spec.MReceipt,
+			extensionRooms(ext.Receipts, window, rooms), initialRooms, since.ReceiptPosition, to.ReceiptPosition,
+		)
+	}
+
+	if ext.Typing != nil && ext.Typing.Enabled {
+		res.Extensions.Typing = rp.slidingEphemeral(
+			ctx, snapshot, syncReq, rp.streams.TypingStreamProvider, spec.MTyping,
+			extensionRooms(ext.Typing, window, rooms), initialRooms, since.TypingPosition, to.TypingPosition,
+		)
+	}
+	return nil
+}
+
+// slidingEphemeral returns the ephemeral events of the given type from the
+// provider for the scoped rooms. Rooms that are sent in full get everything,
+// whereas the other rooms only get what has changed since the last position.
+func (rp *RequestPool) slidingEphemeral(
+	ctx context.Context, snapshot storage.DatabaseTransaction, syncReq *types.SyncRequest,
+	provider streams.StreamProvider, evType string,
+	scoped, initialRooms map[string]struct{}, from, to types.StreamPosition,
+) *types.SlidingEphemeralResponse {
+	ephemeral := &types.SlidingEphemeralResponse{
+		Rooms: map[string]synctypes.ClientEvent{},
+	}
+	collect := func(r *types.SyncRequest) {
+		for roomID, jr := range r.Response.Rooms.Join {
+			if _, ok := r.Rooms[roomID]; !ok {
+				continue
+			}
+			for _, ev := range jr.Ephemeral.Events {
+				if ev.Type == evType {
+					ephemeral.Rooms[roomID] = ev
+				}
+			}
+		}
+	}
+
+	initial := intersect(scoped, initialRooms)
+	if len(initial) > 0 {
+		r := slidingExtensionRequest(syncReq, initial)
+		provider.IncrementalSync(ctx, snapshot, r, 0, to)
+		collect(r)
+	}
+	incremental := map[string]struct{}{}
+	for roomID := range scoped {
+		if _, ok := initial[roomID]; !ok {
+			incremental[roomID] = struct{}{}
+		}
+	}
+	if len(incremental) > 0 {
+		r := slidingExtensionRequest(syncReq, incremental)
+		provider.IncrementalSync(ctx, snapshot, r, from, to)
+		collect(r)
+	}
+	return ephemeral
+}
+
+// slidingExtensionRequest returns a copy of the sync request with an empty
+// response, which only covers the given joined rooms.
+func slidingExtensionRequest(syncReq *types.SyncRequest, roomIDs map[string]struct{}) *types.SyncRequest {
+	r := *syncReq
+	r.Response = types.NewResponse()
+	r.Rooms = make(map[string]string, len(roomIDs))
+	for roomID := range roomIDs {
+		r.Rooms[roomID] = spec.Join
+	}
+	return &r
+}
+
+// extensionRooms returns the joined rooms that an extension applies to. If
+// the extension isn't limited to any lists or rooms, it applies to every room
+// in the window.
+func extensionRooms(ext *types.SlidingExtensionRequest, window *slidingWindow, rooms map[string]*slidingRoom) map[string]struct{} {
+	scoped := map[string]struct{}{}
+	add := func(roomID string) {
+		if room, ok := rooms[roomID]; ok && room.membership == spec.Join {
+			scoped[roomID] = struct{}{}
+		}
+	}
+	addAll := func(roomIDs map[string]struct{}) {
+		for roomID := range roomIDs {
+			add(roomID)
+		}
+	}
+
+	if ext.Lists == nil && ext.Rooms == nil {
+		for _, list := range window.lists {
+			addAll(list)
+		}
+		addAll(window.subscriptions)
+		return scoped
+	}
+	for _, name := range ext.Lists {
+		if name != types.SlidingWildcard {
+			addAll(window.lists[name])
+			continue
+		}
+		for _, list := range window.lists {
+			addAll(list)
+		}
+	}
+	for _, roomID := range ext.Rooms {
+		if roomID == types.SlidingWildcard {
+			addAll(window.subscriptions)
+		} else {
+			add(roomID)
+		}
+	}
+	return scoped
+}
+
+func intersect(a, b map[string]struct{}) map[string]struct{} {
+	both := map[string]struct{}{}
+	for k := range a {
+		if _, ok := b[k]; ok {
+			both[k] = struct{}{}
+		}
+	}
+	return both
+}
@@ -0,0 +1,824 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	rstypes "github.com/neilalexander/harmony/roomserver/types"
+	"github.com/neilalexander/harmony/syncapi/internal"
+	"github.com/neilalexander/harmony/syncapi/storage"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
+	"github.com/neilalexander/harmony/syncapi/types"
+	userapi "github.com/neilalexander/harmony/userapi/api"
+)
+
+// slidingBumpEventTypes are the event types which move a room to the top of
+// a list sorted by recency. Other events, e.g. most state changes, don't.
+var slidingBumpEventTypes = []string{
+	spec.MRoomCreate,
+	"m.room.message",
+	"m.room.encrypted",
+	"m.sticker",
+	"m.call.invite",
+	"m.poll.start",
+	"m.beacon_info",
+}
+
+// slidingRoom is a room that the user is joined or invited to, along with
+// everything needed to filter and sort it.
+type slidingRoom struct {
+	roomID            string
+	membership        string
+	inviteState       []json.RawMessage
+	name              string
+	avatar            string
+	roomType          *string
+	encrypted         bool
+	isDM              bool
+	bumpStamp         types.StreamPosition
+	notificationCount int
+	highlightCount    int
+}
+
+func (r *slidingRoom) applyState(evType string, content []byte) {
+	switch evType {
+	case spec.MRoomCreate:
+		if roomType := gjson.GetBytes(content, "type"); roomType.Type == gjson.String {
+			r.roomType = &roomType.Str
+		}
+	case spec.MRoomName:
+		r.name = gjson.GetBytes(content, "name").Str
+	case spec.MRoomAvatar:
+		r.avatar = gjson.GetBytes(content, "url").Str
+	case spec.MRoomEncryption:
+		r.encrypted = true
+	}
+}
+
+// recency returns the position used to sort rooms by recency. Invites don't
+// have a position in the room stream, so they always come first.
+func (r *slidingRoom) recency() types.StreamPosition {
+	if r.membership == spec.Invite {
+		return math.MaxInt64
+	}
+	return r.bumpStamp
+}
+
+// slidingRoomConfig is the combined room config of all of the lists and room
+// subscriptions that a room appears in.
+type slidingRoomConfig struct {
+	requiredState [][2]string
+	timelineLimit int
+}
+
+func (c *slidingRoomConfig) merge(other types.SlidingRoomConfig) {
+	if other.TimelineLimit > c.timelineLimit {
+		c.timelineLimit = other.TimelineLimit
+	}
+	if c.timelineLimit > maxSlidingTimelineLimit {
+		c.timelineLimit = maxSlidingTimelineLimit
+	}
+	for _, rs := range other.RequiredState {
+		found := false
+		for _, existing := range c.requiredState {
+			if existing == rs {
+				found = true
+				break
+			}
+		}
+		if !found {
+			c.requiredState = append(c.requiredState, rs)
+		}
+	}
+}
+
+// key returns a string which only changes when the config does, so that we
+// can tell whether the client needs to be sent the room again in full.
+func (c *slidingRoomConfig) key() string {
+	parts := make([]string, 0, len(c.requiredState))
+	for _, rs := range c.requiredState {
+		parts = append(parts, rs[0]+"\x00"+rs[1])
+	}
+	sort.Strings(parts)
+	return fmt.Sprintf("%d\x01%s", c.timelineLimit, strings.Join(parts, "\x01"))
+}
+
+// wantsState returns whether the state event with the given type and state
+// key was asked for. The lazy set contains the users whose memberships are
+// wanted by "$LAZY".
+func (c *slidingRoomConfig) wantsState(evType, stateKey, userID string, lazy map[string]struct{}) bool {
+	for _, rs := range c.requiredState {
+		if rs[0] != types.SlidingWildcard && rs[0] != evType {
+			continue
+		}
+		switch rs[1] {
+		case types.SlidingWildcard:
+			return true
+		case types.SlidingStateKeyMe:
+			if stateKey == userID {
+				return true
+			}
+		case types.SlidingStateKeyLazy:
+			if _, ok := lazy[stateKey]; ok && evType == spec.MRoomMember {
+				return true
+			}
+		default:
+			if rs[1] == stateKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lazyMembers returns whether the memberships of timeline senders were asked for.
+func (c *slidingRoomConfig) lazyMembers() bool {
+	for _, rs := range c.requiredState {
+		if rs[0] == spec.MRoomMember && rs[1] == types.SlidingStateKeyLazy {
+			return true
+		}
+	}
+	return false
+}
+
+// slidingWindow is the set of rooms that the client is interested in: the
+// requested ranges of each list, and the room subscriptions.
+type slidingWindow struct {
+	configs       map[string]*slidingRoomConfig
+	lists         map[string]map[string]struct{}
+	subscriptions map[string]struct{}
+}
+
+func (w *slidingWindow) add(roomID string, cfg types.SlidingRoomConfig) {
+	c, ok := w.configs[roomID]
+	if !ok {
+		c = &slidingRoomConfig{}
+		w.configs[roomID] = c
+	}
+	c.merge(cfg)
+}
+
+// slidingRooms returns all of the rooms that the user is joined or invited to.
+func (rp *RequestPool) slidingRooms(
+	ctx context.Context, snapshot storage.DatabaseTransaction,
+	syncReq *types.SyncRequest, to types.StreamingToken,
+) (map[string]*slidingRoom, error) {
+	userID := syncReq.Device.UserID
+	directRooms, err := rp.directRooms(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	joinedRoomIDs, err := snapshot.RoomIDsWithMembership(ctx, userID, spec.Join)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot.RoomIDsWithMembership: %w", err)
+	}
+	rooms := make(map[string]*slidingRoom, len(joinedRoomIDs))
+	memberships := make(map[string]string, len(joinedRoomIDs))
+	for _, roomID := range joinedRoomIDs {
+		room := &slidingRoom{
+			roomID:     roomID,
+			membership: spec.Join,
+		}
+		_, room.isDM = directRooms[roomID]
+		stateFilter := synctypes.DefaultStateFilter()
+		stateFilter.Types = &[]string{spec.MRoomCreate, spec.MRoomName, spec.MRoomAvatar, spec.MRoomEncryption}
+		stateEvents, err := snapshot.CurrentState(ctx, roomID, &stateFilter, nil)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot.CurrentState: %w", err)
+		}
+		for _, ev := range stateEvents {
+			if ev.StateKeyEquals("") {
+				room.applyState(ev.Type(), ev.Content())
+			}
+		}
+		rooms[roomID] = room
+		memberships[roomID] = spec.Join
+	}
+
+	if len(joinedRoomIDs) > 0 {
+		// Work out the bump stamps from the most recent event of a bumping type,
+		// falling back to the most recent event of any type, e.g. for rooms which
+		// were joined over federation and don't have their create event.
+		filter := synctypes.DefaultRoomEventFilter()
+		filter.Limit = 1
+		filter.Types = &slidingBumpEventTypes
+		latest := types.Range{From: to.PDUPosition, Backwards: true}
+		recent, err := snapshot.RecentEvents(ctx, joinedRoomIDs, latest, &filter, true, true)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot.RecentEvents: %w", err)
+		}
+		var missing []string
+		for _, roomID := range joinedRoomIDs {
+			if events := recent[roomID].Events; len(events) > 0 {
+				rooms[roomID].bumpStamp = events[len(events)-1].StreamPosition
+			} else {
+				missing = append(missing, roomID)
+			}
+		}
+		if len(missing) > 0 {
+			filter.Types = nil
+			recent, err = snapshot.RecentEvents(ctx, missing, latest, &filter, true, true)
+			if err != nil {
+				return nil, fmt.Errorf("snapshot.RecentEvents: %w", err)
+			}
+			for _, roomID := range missing {
+				if events := recent[roomID].Events; len(events) > 0 {
+					rooms[roomID].bumpStamp = events[len(events)-1].StreamPosition
+				}
+			}
+		}
+
+		counts, err := snapshot.GetUserUnreadNotificationCountsForRooms(ctx, userID, memberships)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot.GetUserUnreadNotificationCountsForRooms: %w", err)
+		}
+		for roomID, count := range counts {
+			if room, ok := rooms[roomID]; ok {
+				room.notificationCount = count.UnreadNotificationCount
+				room.highlightCount = count.UnreadHighlightCount
+			}
+		}
+	}
+
+	invites, _, _, err := snapshot.InviteEventsInRange(ctx, userID, types.Range{To: to.InvitePosition})
+	if err != nil {
+		return nil, fmt.Errorf("snapshot.InviteEventsInRange: %w", err)
+	}
+	for roomID, inviteEvent := range invites {
+		if _, ok := rooms[roomID]; ok {
+			continue
+		}
+		sender, err := rp.rsAPI.QueryUserIDForSender(ctx, inviteEvent.RoomID(), inviteEvent.SenderID())
+		if err == nil && sender != nil {
+			if _, ok := syncReq.IgnoredUsers.List[sender.String()]; ok {
+				continue
+			}
+		}
+		ir, err := types.NewInviteResponse(ctx, rp.rsAPI, inviteEvent, synctypes.FormatSync)
+		if err != nil {
+			syncReq.Log.WithError(err).Error("failed creating invite response")
+			continue
+		}
+		room := &slidingRoom{
+			roomID:      roomID,
+			membership:  spec.Invite,
+			inviteState: ir.InviteState.Events,
+			isDM:        gjson.GetBytes(inviteEvent.Content(), "is_direct").Bool(),
+		}
+		for _, ev := range ir.InviteState.Events {
+			if gjson.GetBytes(ev, "state_key").Str == "" {
+				room.applyState(gjson.GetBytes(ev, "type").Str, []byte(gjson.GetBytes(ev, "content").Raw))
+			}
+		}
+		rooms[roomID] = room
+	}
+	return rooms, nil
+}
+
+// directRooms returns the rooms marked as direct messages in the m.direct
+// account data of the user.
+func (rp *RequestPool) directRooms(ctx context.Context, userID string) (map[string]struct{}, error) {
+	dataReq := userapi.QueryAccountDataRequest{
+		UserID:   userID,
+		DataType: "m.direct",
+	}
+	dataRes := userapi.QueryAccountDataResponse{}
+	if err := rp.userAPI.QueryAccountData(ctx, &dataReq, &dataRes); err != nil {
+		return nil, fmt.Errorf("rp.userAPI.QueryAccountData: %w", err)
+	}
+	directRooms := map[string]struct{}{}
+	var direct map[string][]string
+	if data, ok := dataRes.GlobalAccountData["m.direct"]; ok {
+		if err := json.Unmarshal(data, &direct); err != nil {
+			return directRooms, nil
+		}
+	}
+	for _, roomIDs := range direct {
+		for _, roomID := range roomIDs {
+			directRooms[roomID] = struct{}{}
+		}
+	}
+	return directRooms, nil
+}
+
+// slidingWindow filters and sorts the rooms of each list, and works out
+// which rooms are in the requested ranges. The list counts are stored in the
+// next position.
+func (rp *RequestPool) slidingWindow(
+	ctx context.Context, snapshot storage.DatabaseTransaction,
+	ssReq *types.SlidingSyncRequest, rooms map[string]*slidingRoom, next *slidingPosition,
+) (*slidingWindow, error) {
+	window := &slidingWindow{
+		configs:       map[string]*slidingRoomConfig{},
+		lists:         map[string]map[string]struct{}{},
+		subscriptions: map[string]struct{}{},
+	}
+
+	spaceChildren := map[string]map[string]struct{}{}
+	for _, list := range ssReq.Lists {
+		if list.Filters == nil {
+			continue
+		}
+		for _, spaceID := range list.Filters.Spaces {
+			if _, ok := spaceChildren[spaceID]; ok {
+				continue
+			}
+			children, err := spaceChildRooms(ctx, snapshot, spaceID)
+			if err != nil {
+				return nil, err
+			}
+			spaceChildren[spaceID] = children
+		}
+	}
+
+	for name, list := range ssReq.Lists {
+		matched := make([]*slidingRoom, 0, len(rooms))
+		for _, room := range rooms {
+			if matchesFilters(room, list.Filters, spaceChildren) {
+				matched = append(matched, room)
+			}
+		}
+		sortSlidingRooms(matched, list.Sort)
+		next.lists[name] = len(matched)
+
+		window.lists[name] = map[string]struct{}{}
+		for _, r := range list.Ranges {
+			for i := r[0]; i <= r[1] && i < len(matched); i++ {
+				window.add(matched[i].roomID, list.SlidingRoomConfig)
+				window.lists[name][matched[i].roomID] = struct{}{}
+			}
+		}
+	}
+
+	for roomID, sub := range ssReq.RoomSubscriptions {
+		if _, ok := rooms[roomID]; !ok {
+			continue
+		}
+		window.add(roomID, sub)
+		window.subscriptions[roomID] = struct{}{}
+	}
+	return window, nil
+}
+
+// spaceChildRooms returns the rooms which are children of the given space.
+func spaceChildRooms(ctx context.Context, snapshot storage.DatabaseTransaction, spaceID string) (map[string]struct{}, error) {
+	filter := synctypes.DefaultStateFilter()
+	filter.Types = &[]string{spec.MSpaceChild}
+	stateEvents, err := snapshot.GetStateEventsForRoom(ctx, spaceID, &filter)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot.GetStateEventsForRoom: %w", err)
+	}
+	children := make(map[string]struct{}, len(stateEvents))
+	for _, ev := range stateEvents {
+		// Removed children have their content emptied.
+		if ev.StateKey() != nil && gjson.GetBytes(ev.Content(), "via").IsArray() {
+			children[*ev.StateKey()] = struct{}{}
+		}
+	}
+	return children, nil
+}
+
+// matchesFilters returns whether the room should be included in a list with
+// the given filters.
+func matchesFilters(room *slidingRoom, filters *types.SlidingListFilters, spaceChildren map[string]map[string]struct{}) bool {
+	if filters == nil {
+		return true
+	}
+	if filters.IsDM != nil && *filters.IsDM != room.isDM {
+		return false
+	}
+	if filters.IsEncrypted != nil && *filters.IsEncrypted != room.encrypted {
+		return false
+	}
+	if filters.IsInvite != nil && *filters.IsInvite != (room.membership == spec.Invite) {
+		return false
+	}
+	if filters.RoomTypes != nil && !containsRoomType(filters.RoomTypes, room.roomType) {
+		return false
+	}
+	if containsRoomType(filters.NotRoomTypes, room.roomType) {
+		return false
+	}
+	if len(filters.Spaces) > 0 {
+		inSpace := false
+		for _, spaceID := range filters.Spaces {
+			if _, ok := spaceChildren[spaceID][room.roomID]; ok {
+				inSpace = true
+				break
+			}
+		}
+		if !inSpace {
+			return false
+		}
+	}
+	if filters.RoomNameLike != "" && !strings.Contains(strings.ToLower(room.name), strings.ToLower(filters.RoomNameLike)) {
+		return false
+	}
+	return true
+}
+
+// containsRoomType returns whether the room type is in the list, where a nil
+// entry matches rooms without a type.
+func containsRoomType(roomTypes []*string, roomType *string) bool {
+	for _, t := range roomTypes {
+		switch {
+		case t == nil && roomType == nil:
+			return true
+		case t != nil && roomType != nil && *t == *roomType:
+			return true
+		}
+	}
+	return false
+}
+
+// sortSlidingRooms sorts the rooms by the given sort orders in turn, then by
+// recency and finally by room ID so that the order is stable.
+func sortSlidingRooms(rooms []*slidingRoom, sortBy []string) {
+	orders := make([]string, 0, len(sortBy)+1)
+	orders = append(orders, sortBy...)
+	orders = append(orders, types.SlidingSortByRecency)
+	sort.SliceStable(rooms, func(i, j int) bool {
+		a, b := rooms[i], rooms[j]
+		for _, order := range orders {
+			switch order {
+			case types.SlidingSortByRecency:
+				if a.recency() != b.recency() {
+					return a.recency() > b.recency()
+				}
+			case types.SlidingSortByName:
+				// Rooms without a name sort after rooms with one.
+				if (a.name == "") != (b.name == "") {
+					return a.name != ""
+				}
+				if an, bn := strings.ToLower(a.name), strings.ToLower(b.name); an != bn {
+					return an < bn
+				}
+			case types.SlidingSortByNotificationLevel:
+				if a.highlightCount != b.highlightCount {
+					return a.highlightCount > b.highlightCount
+				}
+				if a.notificationCount != b.notificationCount {
+					return a.notificationCount > b.notificationCount
+				}
+			}
+		}
+		return a.roomID < b.roomID
+	})
+}
+
+// slidingRoomResponses adds the rooms in the window which the client needs
+// to hear about to the response, and records them in the next position.
+// Rooms that the client hasn't been sent before, or whose config has changed,
+// are sent in full. Returns the rooms that were sent in full.
+// nolint:gocyclo
+func (rp *RequestPool) slidingRoomResponses(
+	ctx context.Context, snapshot storage.DatabaseTransaction, syncReq *types.SyncRequest,
+	rooms map[string]*slidingRoom, window *slidingWindow,
+	from, next *slidingPosition, res *types.SlidingSyncResponse,
+) (map[string]struct{}, error) {
+	initialRooms := map[string]struct{}{}
+	initialByLimit := map[int][]string{}
+	incrementalByLimit := map[int][]string{}
+	for roomID, cfg := range window.configs {
+		room := rooms[roomID]
+		key := cfg.key()
+		prev, seen := from.rooms[roomID]
+		next.rooms[roomID] = slidingRoomState{
+			membership:        room.membership,
+			config:            key,
+			timelineLimit:     cfg.timelineLimit,
+			notificationCount: room.notificationCount,
+			highlightCount:    room.highlightCount,
+		}
+		switch {
+		case !seen || prev.config != key || prev.membership != room.membership:
+			initialRooms[roomID] = struct{}{}
+			if room.membership == spec.Join {
+				initialByLimit[cfg.timelineLimit] = append(initialByLimit[cfg.timelineLimit], roomID)
+			} else {
+				res.Rooms[roomID] = &types.SlidingRoomResponse{
+					Name:        room.name,
+					Avatar:      room.avatar,
+					IsDM:        room.isDM,
+					Initial:     true,
+					InviteState: room.inviteState,
+				}
+			}
+		case room.membership == spec.Join:
+			incrementalByLimit[cfg.timelineLimit] = append(incrementalByLimit[cfg.timelineLimit], roomID)
+		}
+	}
+
+	// Rooms which the client was sent that the user is no longer in are sent
+	// once more so that the client sees the leave, and then forgotten about.
+	leftRooms := map[string]*slidingRoomConfig{}
+	for roomID, prev := range from.rooms {
+		if _, ok := rooms[roomID]; ok || prev.membership != spec.Join {
+			continue
+		}
+		// The timeline must have room for the leave event.
+		limit := prev.timelineLimit
+		if limit < 1 {
+			limit = 1
+		}
+		leftRooms[roomID] = &slidingRoomConfig{timelineLimit: limit}
+		incrementalByLimit[limit] = append(incrementalByLimit[limit], roomID)
+	}
+
+	var notSenders []string
+	for userID := range syncReq.IgnoredUsers.List {
+		notSenders = append(notSenders, userID)
+	}
+	recentEvents := func(byLimit map[int][]string, r types.Range) (map[string]types.RecentEvents, error) {
+		recent := map[string]types.RecentEvents{}
+		for limit, roomIDs := range byLimit {
+			filter := synctypes.DefaultRoomEventFilter()
+			// Always look for at least one event, so that we can tell whether
+			// there were any changes to the room.
+			filter.Limit = limit
+			if filter.Limit < 1 {
+				filter.Limit = 1
+			}
+			if len(notSenders) > 0 {
+				filter.NotSenders = &notSenders
+			}
+			events, err := snapshot.RecentEvents(ctx, roomIDs, r, &filter, true, true)
+			if err != nil {
+				return nil, fmt.Errorf("snapshot.RecentEvents: %w", err)
+			}
+			for roomID, ev := range events {
+				recent[roomID] = ev
+			}
+		}
+		return recent, nil
+	}
+
+	initialRecent, err := recentEvents(initialByLimit, types.Range{From: next.since.PDUPosition, Backwards: true})
+	if err != nil {
+		return nil, err
+	}
+	for _, roomIDs := range initialByLimit {
+		for _, roomID := range roomIDs {
+			roomRes, err := rp.slidingRoomResponse(ctx, snapshot, syncReq, rooms[roomID], window.configs[roomID], true, initialRecent[roomID], from.since.PDUPosition)
+			if err != nil {
+				return nil, err
+			}
+			res.Rooms[roomID] = roomRes
+		}
+	}
+
+	if from.since.IsEmpty() {
+		return initialRooms, nil
+	}
+	incrementalRecent, err := recentEvents(incrementalByLimit, types.Range{From: from.since.PDUPosition, To: next.since.PDUPosition})
+	if err != nil {
+		return nil, err
+	}
+	for _, roomIDs := range incrementalByLimit {
+		for _, roomID := range roomIDs {
+			room, cfg := rooms[roomID], window.configs[roomID]
+			if leftCfg, ok := leftRooms[roomID]; ok {
+				room = &slidingRoom{roomID: roomID, membership: spec.Leave}
+				cfg = leftCfg
+			}
+			recent := incrementalRecent[roomID]
+			if len(recent.Events) == 0 {
+				// There's nothing new in the room, but the client still needs
+				// to hear about changes to the notification counts.
+				prev := from.rooms[roomID]
+				if room.membership == spec.Join && (prev.notificationCount != room.notificationCount || prev.highlightCount != room.highlightCount) {
+					res.Rooms[roomID] = &types.SlidingRoomResponse{
+						NotificationCount: room.notificationCount,
+						HighlightCount:    room.highlightCount,
+						BumpStamp:         room.bumpStamp,
+					}
+				}
+				continue
+			}
+			roomRes, err := rp.slidingRoomResponse(ctx, snapshot, syncReq, room, cfg, false, recent, from.since.PDUPosition)
+			if err != nil {
+				return nil, err
+			}
+			res.Rooms[roomID] = roomRes
+		}
+	}
+	return initialRooms, nil
+}
+
+// slidingRoomResponse builds the response for a joined or left room from the
+// recent events in the room.
+func (rp *RequestPool) slidingRoomResponse(
+	ctx context.Context, snapshot storage.DatabaseTransaction, syncReq *types.SyncRequest,
+	room *slidingRoom, cfg *slidingRoomConfig, initial bool, recent types.RecentEvents, since types.StreamPosition,
+) (*types.SlidingRoomResponse, error) {
+	userID := syncReq.Device.UserID
+	roomRes := &types.SlidingRoomResponse{
+		Name:              room.name,
+		Avatar:            room.avatar,
+		IsDM:              room.isDM,
+		Initial:           initial,
+		NotificationCount: room.notificationCount,
+		HighlightCount:    room.highlightCount,
+		BumpStamp:         room.bumpStamp,
+	}
+
+	streamEvents := recent.Events
+	limited := recent.Limited
+	if len(streamEvents) > cfg.timelineLimit {
+		streamEvents = streamEvents[len(streamEvents)-cfg.timelineLimit:]
+		limited = true
+	}
+	positions := make(map[string]types.StreamPosition, len(streamEvents))
+	for _, ev := range streamEvents {
+		positions[ev.EventID()] = ev.StreamPosition
+	}
+	recentEvents := snapshot.StreamEventsToEvents(ctx, syncReq.Device, streamEvents, rp.rsAPI)
+	parsedUserID, err := spec.NewUserID(userID, true)
+	if err != nil {
+		return nil, err
+	}
+	events, err := internal.ApplyHistoryVisibilityFilter(ctx, snapshot, rp.rsAPI, recentEvents, map[string]struct{}{}, *parsedUserID, "sliding_sync")
+	if err != nil {
+		syncReq.Log.WithError(err).Error("unable to apply history visibility filter")
+	}
+	roomRes.Limited = limited && len(events) == len(recentEvents)
+	if len(events) > 0 {
+		prevBatch, err := snapshot.GetBackwardTopologyPos(ctx, events)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot.GetBackwardTopologyPos: %w", err)
+		}
+		roomRes.PrevBatch = &prevBatch
+	}
+
+	lazy := map[string]struct{}{}
+	if initial {
+		lazy[userID] = struct{}{}
+	}
+	hasMembershipChange := false
+	for _, ev := range events {
+		lazy[string(ev.SenderID())] = struct{}{}
+		if positions[ev.EventID()] > since && since > 0 {
+			roomRes.NumLive++
+		}
+		if ev.Type() == spec.MRoomMember {
+			hasMembershipChange = true
+		}
+	}
+	roomRes.Timeline = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(events), synctypes.FormatSync, rp.senderUserID(ctx))
+	if err = internal.BundleAggregations(ctx, snapshot, rp.rsAPI, *parsedUserID, room.roomID, roomRes.Timeline, synctypes.FormatSync); err != nil {
+		syncReq.Log.WithError(err).WithField("room_id", room.roomID).Warn("failed to bundle aggregations")
+	}
+
+	var stateEvents []*rstypes.HeaderedEvent
+	if initial || roomRes.Limited {
+		if stateEvents, err = rp.slidingRequiredState(ctx, snapshot, room.roomID, cfg, userID, lazy); err != nil {
+			return nil, err
+		}
+	} else {
+		// The client already has the rest of the required state, so only
+		// changes to it in the timeline, and the memberships of any senders
+		// it might not know about, need to be sent.
+		for _, ev := range events {
+			if ev.StateKey() != nil && cfg.wantsState(ev.Type(), *ev.StateKey(), userID, lazy) {
+				stateEvents = append(stateEvents, ev)
+			}
+		}
+		if cfg.lazyMembers() {
+			for sender := range lazy {
+				ev, err := snapshot.GetStateEvent(ctx, room.roomID, spec.MRoomMember, sender)
+				if err != nil {
+					return nil, fmt.Errorf("snapshot.GetStateEvent: %w", err)
+				}
+				if ev != nil {
+					stateEvents = append(stateEvents, ev)
+				}
+			}
+		}
+	}
+	roomRes.RequiredState = synctypes.ToClientEvents(gomatrixserverlib.ToPDUs(dedupeEvents(stateEvents)), synctypes.FormatSync, rp.senderUserID(ctx))
+
+	if (initial || hasMembershipChange) && room.membership == spec.Join {
+		summary, err := snapshot.GetRoomSummary(ctx, room.roomID, userID)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot.GetRoomSummary: %w", err)
+		}
+		roomRes.JoinedCount = summary.JoinedMemberCount
+		roomRes.InvitedCount = summary.InvitedMemberCount
+		if room.name == "" {
+			for _, hero := range summary.Heroes {
+				h := types.SlidingRoomHero{UserID: hero}
+				ev, err := snapshot.GetStateEvent(ctx, room.roomID, spec.MRoomMember, hero)
+				if err != nil {
+					return nil, fmt.Errorf("snapshot.GetStateEvent: %w", err)
+				}
+				if ev != nil {
+					h.DisplayName = gjson.GetBytes(ev.Content(), "displayname").Str
+					h.AvatarURL = gjson.GetBytes(ev.Content(), "avatar_url").Str
+				}
+				roomRes.Heroes = append(roomRes.Heroes, h)
+			}
+		}
+	}
+	return roomRes, nil
+}
+
+// slidingRequiredState returns the current state events of the room which
+// match the required_state of the config. Memberships are looked up one by
+// one unless all of them were asked for, as rooms can have lots of members.
+func (rp *RequestPool) slidingRequiredState(
+	ctx context.Context, snapshot storage.DatabaseTransaction,
+	roomID string, cfg *slidingRoomConfig, userID string, lazy map[string]struct{},
+) ([]*rstypes.HeaderedEvent, error) {
+	var stateTypes []string
+	allTypes, allMembers := false, false
+	memberKeys := map[string]struct{}{}
+	for _, rs := range cfg.requiredState {
+		switch rs[0] {
+		case types.SlidingWildcard:
+			allTypes = true
+		case spec.MRoomMember:
+			switch rs[1] {
+			case types.SlidingWildcard:
+				allMembers = true
+			case types.SlidingStateKeyMe:
+				memberKeys[userID] = struct{}{}
+			case types.SlidingStateKeyLazy:
+				for sender := range lazy {
+					memberKeys[sender] = struct{}{}
+				}
+			default:
+				memberKeys[rs[1]] = struct{}{}
+			}
+		default:
+			stateTypes = append(stateTypes, rs[0])
+		}
+	}
+
+	var stateEvents []*rstypes.HeaderedEvent
+	if allTypes || allMembers || len(stateTypes) > 0 {
+		filter := synctypes.DefaultStateFilter()
+		if !allTypes {
+			if allMembers {
+				stateTypes = append(stateTypes, spec.MRoomMember)
+			}
+			filter.Types = &stateTypes
+		}
+		current, err := snapshot.CurrentState(ctx, roomID, &filter, nil)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot.CurrentState: %w", err)
+		}
+		for _, ev := range current {
+			if ev.StateKey() != nil && cfg.wantsState(ev.Type(), *ev.StateKey(), userID, lazy) {
+				stateEvents = append(stateEvents, ev)
+			}
+		}
+	}
+	if !allTypes && !allMembers {
+		for stateKey := range memberKeys {
+			ev, err := snapshot.GetStateEvent(ctx, roomID, spec.MRoomMember, stateKey)
+			if err != nil {
+				return nil, fmt.Errorf("snapshot.GetStateEvent: %w", err)
+			}
+			if ev != nil {
+				stateEvents = append(stateEvents, ev)
+			}
+		}
+	}
+	return stateEvents, nil
+}
+
+func dedupeEvents(events []*rstypes.HeaderedEvent) []*rstypes.HeaderedEvent {
+	seen := make(map[string]struct{}, len(events))
+	deduped := events[:0]
+	for _, ev := range events {
+		if _, ok := seen[ev.EventID()]; ok {
+			continue
+		}
+		seen[ev.EventID()] = struct{}{}
+		deduped = append(deduped, ev)
+	}
+	return deduped
+}
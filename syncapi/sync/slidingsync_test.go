@@ -0,0 +1,172 @@
+package sync
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/syncapi/types"
+)
+
+func TestSlidingSync_FilterAndSortRooms(t *testing.T) {
+	space := "m.space"
+	rooms := []*slidingRoom{
+		{roomID: "!old:test", membership: spec.Join, name: "Zebra", bumpStamp: 1},
+		{roomID: "!new:test", membership: spec.Join, name: "apple", bumpStamp: 10, encrypted: true},
+		{roomID: "!dm:test", membership: spec.Join, bumpStamp: 5, isDM: true, highlightCount: 1},
+		{roomID: "!space:test", membership: spec.Join, name: "Space", bumpStamp: 3, roomType: &space},
+		{roomID: "!invite:test", membership: spec.Invite, name: "Invite"},
+	}
+	ids := func(rooms []*slidingRoom) (roomIDs []string) {
+		for _, room := range rooms {
+			roomIDs = append(roomIDs, room.roomID)
+		}
+		return
+	}
+	filter := func(filters *types.SlidingListFilters) (matched []*slidingRoom) {
+		children := map[string]map[string]struct{}{
+			"!parent:test": {"!old:test": {}},
+		}
+		for _, room := range rooms {
+			if matchesFilters(room, filters, children) {
+				matched = append(matched, room)
+			}
+		}
+		return
+	}
+	yes, no := true, false
+
+	// Invites always come first when sorting by recency
+	matched := filter(nil)
+	sortSlidingRooms(matched, nil)
+	assert.Equal(t, []string{"!invite:test", "!new:test", "!dm:test", "!space:test", "!old:test"}, ids(matched))
+
+	// Rooms without a name come last when sorting by name
+	sortSlidingRooms(matched, []string{types.SlidingSortByName})
+	assert.Equal(t, []string{"!new:test", "!invite:test", "!space:test", "!old:test", "!dm:test"}, ids(matched))
+
+	sortSlidingRooms(matched, []string{types.SlidingSortByNotificationLevel})
+	assert.Equal(t, "!dm:test", matched[0].roomID)
+
+	assert.Equal(t, []string{"!dm:test"}, ids(filter(&types.SlidingListFilters{IsDM: &yes})))
+	assert.Equal(t, []string{"!new:test"}, ids(filter(&types.SlidingListFilters{IsEncrypted: &yes})))
+	assert.Equal(t, []string{"!invite:test"}, ids(filter(&types.SlidingListFilters{IsInvite: &yes})))
+	assert.Len(t, filter(&types.SlidingListFilters{IsInvite: &no}), 4)
+	assert.Equal(t, []string{"!space:test"}, ids(filter(&types.SlidingListFilters{RoomTypes: []*string{&space}})))
+	assert.Len(t, filter(&types.SlidingListFilters{NotRoomTypes: []*string{&space}}), 4)
+	assert.Len(t, filter(&types.SlidingListFilters{RoomTypes: []*string{nil}}), 4)
+	assert.Equal(t, []string{"!old:test"}, ids(filter(&types.SlidingListFilters{Spaces: []string{"!parent:test"}})))
+	assert.Equal(t, []string{"!new:test"}, ids(filter(&types.SlidingListFilters{RoomNameLike: "APP"})))
+}
+
+func TestSlidingSync_RequiredState(t *testing.T) {
+	cfg := &slidingRoomConfig{}
+	cfg.merge(types.SlidingRoomConfig{
+		TimelineLimit: 5,
+		RequiredState: [][2]string{{"m.room.name", ""}, {"m.room.member", "$LAZY"}},
+	})
+	cfg.merge(types.SlidingRoomConfig{
+		TimelineLimit: 1000,
+		RequiredState: [][2]string{{"m.room.member", "$ME"}, {"m.room.name", ""}, {"*", "state_key"}},
+	})
+	assert.Equal(t, maxSlidingTimelineLimit, cfg.timelineLimit)
+	assert.Len(t, cfg.requiredState, 4)
+	assert.True(t, cfg.lazyMembers())
+
+	lazy := map[string]struct{}{"@bob:test": {}}
+	assert.True(t, cfg.wantsState("m.room.name", "", "@alice:test", lazy))
+	assert.False(t, cfg.wantsState("m.room.topic", "", "@alice:test", lazy))
+	assert.True(t, cfg.wantsState("m.room.member", "@alice:test", "@alice:test", lazy))
+	assert.True(t, cfg.wantsState("m.room.member", "@bob:test", "@alice:test", lazy))
+	assert.False(t, cfg.wantsState("m.room.member", "@charlie:test", "@alice:test", lazy))
+	assert.True(t, cfg.wantsState("m.custom", "state_key", "@alice:test", lazy))
+
+	// The order of the required state doesn't change the key
+	other := &slidingRoomConfig{timelineLimit: cfg.timelineLimit}
+	for i := len(cfg.requiredState) - 1; i >= 0; i-- {
+		other.requiredState = append(other.requiredState, cfg.requiredState[i])
+	}
+	assert.Equal(t, cfg.key(), other.key())
+	other.timelineLimit = 1
+	assert.NotEqual(t, cfg.key(), other.key())
+}
+
+func TestSlidingSync_ConnectionPositions(t *testing.T) {
+	conn := &slidingConnection{positions: map[int64]*slidingPosition{}}
+	first := conn.advance(0, newSlidingPosition())
+	second := conn.advance(first, newSlidingPosition())
+
+	// The client may retry with the position it last sent
+	_, ok := conn.position(first)
+	assert.True(t, ok)
+
+	// Once the client moves on, older positions are forgotten
+	third := conn.advance(second, newSlidingPosition())
+	_, ok = conn.position(first)
+	assert.False(t, ok)
+	_, ok = conn.position(second)
+	assert.True(t, ok)
+	_, ok = conn.position(third)
+	assert.True(t, ok)
+	assert.False(t, conn.expired())
+}
+
+func TestSlidingSync_ExtensionRooms(t *testing.T) {
+	rooms := map[string]*slidingRoom{
+		"!a:test":      {roomID: "!a:test", membership: spec.Join},
+		"!b:test":      {roomID: "!b:test", membership: spec.Join},
+		"!c:test":      {roomID: "!c:test", membership: spec.Join},
+		"!invite:test": {roomID: "!invite:test", membership: spec.Invite},
+	}
+	window := &slidingWindow{
+		lists: map[string]map[string]struct{}{
+			"all":     {"!a:test": {}, "!invite:test": {}},
+			"encrypt": {"!b:test": {}},
+		},
+		subscriptions: map[string]struct{}{"!c:test": {}},
+	}
+
+	assert.Len(t, extensionRooms(&types.SlidingExtensionRequest{Enabled: true}, window, rooms), 3)
+	assert.Equal(t, map[string]struct{}{"!b:test": {}}, extensionRooms(&types.SlidingExtensionRequest{
+		Enabled: true, Lists: []string{"encrypt"},
+	}, window, rooms))
+	assert.Equal(t, map[string]struct{}{"!a:test": {}, "!b:test": {}, "!c:test": {}}, extensionRooms(&types.SlidingExtensionRequest{
+		Enabled: true, Lists: []string{"*"}, Rooms: []string{"*"},
+	}, window, rooms))
+	assert.Empty(t, extensionRooms(&types.SlidingExtensionRequest{
+		Enabled: true, Rooms: []string{"!unknown:test"},
+	}, window, rooms))
+}
+
+func TestSlidingSync_ConnectionLimit(t *testing.T) {
+	device := newSlidingDevice()
+	newConn := func(lastUsed time.Time) *slidingConnection {
+		return &slidingConnection{positions: map[int64]*slidingPosition{}, lastUsed: lastUsed}
+	}
+	now := time.Now()
+	for i := 0; i < maxSlidingConnectionsPerDevice; i++ {
+		device.store(fmt.Sprintf("conn%d", i), newConn(now.Add(time.Duration(i)*time.Second)))
+	}
+
+	// Replacing an existing connection doesn't evict another one
+	device.store("conn5", newConn(now.Add(time.Minute)))
+	_, ok := device.connection("conn0")
+	assert.True(t, ok)
+
+	// A new connection replaces the least recently used one
+	device.store("new", newConn(now.Add(time.Minute)))
+	assert.Len(t, device.conns, maxSlidingConnectionsPerDevice)
+	_, ok = device.connection("conn0")
+	assert.False(t, ok)
+	_, ok = device.connection("new")
+	assert.True(t, ok)
+
+	// Expired connections are cleaned up
+	device.store("expired", newConn(now.Add(-2*slidingConnectionExpiry)))
+	assert.False(t, device.clean())
+	_, ok = device.connection("expired")
+	assert.False(t, ok)
+}
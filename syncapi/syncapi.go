@@ -18,12 +18,15 @@ import (
 	"context"
 
 	"github.com/neilalexander/harmony/internal/fulltext"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
 	"github.com/neilalexander/harmony/internal/httputil"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/setup/config"
 	"github.com/neilalexander/harmony/setup/process"
 	"github.com/sirupsen/logrus"
 
+	federationAPI "github.com/neilalexander/harmony/federationapi/api"
 	"github.com/neilalexander/harmony/internal/caching"
 
 	"github.com/neilalexander/harmony/roomserver/api"
@@ -50,6 +53,9 @@ func AddPublicRoutes(
 	userAPI userapi.SyncUserAPI,
 	rsAPI api.SyncRoomserverAPI,
 	caches caching.LazyLoadCache,
+	fedClient fclient.FederationClient,
+	keyRing gomatrixserverlib.JSONVerifier,
+	fedAPI federationAPI.FederationInternalAPI,
 	enableMetrics bool,
 ) {
 	js, natsClient := natsInstance.Prepare(processContext, &dendriteCfg.Global.JetStream)
@@ -102,7 +108,7 @@ func AddPublicRoutes(
 
 	roomConsumer := consumers.NewOutputRoomEventConsumer(
 		processContext, &dendriteCfg.SyncAPI, js, syncDB, notifier, streams.PDUStreamProvider,
-		streams.InviteStreamProvider, rsAPI, fts,
+		streams.InviteStreamProvider, streams.KnockStreamProvider, rsAPI, fts,
 	)
 	if err = roomConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start room server consumer")
@@ -147,8 +153,8 @@ func AddPublicRoutes(
 	rateLimits := httputil.NewRateLimits(&dendriteCfg.ClientAPI.RateLimiting)
 
 	routing.Setup(
-		routers.Client, requestPool, syncDB, userAPI,
+		routers.Client, routers.Federation, requestPool, syncDB, userAPI,
 		rsAPI, &dendriteCfg.SyncAPI, caches, fts,
-		rateLimits,
+		rateLimits, fedClient, keyRing, fedAPI,
 	)
 }
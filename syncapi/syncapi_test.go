@@ -143,7 +143,7 @@ func testSyncAccessTokens(t *testing.T, dbType test.DBType) {
 	jsctx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
 	defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
 	msgs := toNATSMsgs(t, cfg, room.Events()...)
-	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, caches, caching.DisableMetrics)
+	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, caches, nil, nil, nil, caching.DisableMetrics)
 	testrig.MustPublishMsgs(t, jsctx, msgs...)
 
 	testCases := []struct {
@@ -243,7 +243,7 @@ func testSyncEventFormatPowerLevels(t *testing.T, dbType test.DBType) {
 	jsctx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
 	defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
 	msgs := toNATSMsgs(t, cfg, room.Events()...)
-	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, caches, caching.DisableMetrics)
+	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, caches, nil, nil, nil, caching.DisableMetrics)
 	testrig.MustPublishMsgs(t, jsctx, msgs...)
 
 	testCases := []struct {
@@ -396,7 +396,7 @@ func testSyncAPICreateRoomSyncEarly(t *testing.T, dbType test.DBType) {
 	// m.room.history_visibility
 	msgs := toNATSMsgs(t, cfg, room.Events()...)
 	sinceTokens := make([]string, len(msgs))
-	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, caches, caching.DisableMetrics)
+	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{rooms: []*test.Room{room}}, caches, nil, nil, nil, caching.DisableMetrics)
 	for i, msg := range msgs {
 		testrig.MustPublishMsgs(t, jsctx, msg)
 		time.Sleep(100 * time.Millisecond)
@@ -484,7 +484,7 @@ func testSyncAPIUpdatePresenceImmediately(t *testing.T, dbType test.DBType) {
 
 	jsctx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
 	defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
-	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{}, caches, caching.DisableMetrics)
+	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{}, caches, nil, nil, nil, caching.DisableMetrics)
 	w := httptest.NewRecorder()
 	routers.Client.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
 		"access_token": alice.AccessToken,
@@ -606,7 +606,7 @@ func testHistoryVisibility(t *testing.T, dbType test.DBType) {
 		// Use the actual internal roomserver API
 		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
-		AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, caches, caching.DisableMetrics)
+		AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, caches, nil, nil, nil, caching.DisableMetrics)
 
 		for _, tc := range testCases {
 			testname := fmt.Sprintf("%s - %s", tc.historyVisibility, userType)
@@ -876,7 +876,7 @@ func TestGetMembership(t *testing.T) {
 		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
 		rsAPI.SetFederationAPI(nil, nil)
 
-		AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, caches, caching.DisableMetrics)
+		AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{aliceDev, bobDev}}, rsAPI, caches, nil, nil, nil, caching.DisableMetrics)
 
 		for _, tc := range testCases {
 			t.Run(tc.name, func(t *testing.T) {
@@ -923,6 +923,147 @@ func TestGetMembership(t *testing.T) {
 	})
 }
 
+func TestSyncAPIKnocks(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	bobDev := userapi.Device{
+		ID:          "BOBID",
+		UserID:      bob.ID,
+		AccessToken: "BOB_BEARER_TOKEN",
+	}
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		cfg, processCtx, close := testrig.CreateConfig(t, dbType)
+		routers := httputil.NewRouters()
+		cm := sqlutil.NewConnectionManager(processCtx, cfg.Global.DatabaseOptions)
+		caches := caching.NewRistrettoCache(128*1024*1024, time.Hour, caching.DisableMetrics)
+		defer close()
+		natsInstance := jetstream.NATSInstance{}
+		jsctx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
+		defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
+
+		// Use an actual roomserver, so that it tells us about new and retired knocks
+		rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
+		rsAPI.SetFederationAPI(nil, nil)
+
+		AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{bobDev}}, rsAPI, caches, nil, nil, nil, caching.DisableMetrics)
+
+		// syncSinceUntil syncs until checkFunc is satisfied and returns the response.
+		syncSinceUntil := func(t *testing.T, since string, checkFunc func(syncBody string) bool) string {
+			t.Helper()
+			deadline := time.Now().Add(time.Second * 5)
+			for time.Now().Before(deadline) {
+				params := map[string]string{
+					"access_token": bobDev.AccessToken,
+					"timeout":      "1000",
+				}
+				if since != "" {
+					params["since"] = since
+				}
+				w := httptest.NewRecorder()
+				routers.Client.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(params)))
+				if w.Code == http.StatusOK && checkFunc(w.Body.String()) {
+					return w.Body.String()
+				}
+			}
+			t.Fatalf("Timed out waiting for sync")
+			return ""
+		}
+
+		// knock creates a room that Bob knocks on, and returns the sync
+		// token from when the knock came down sync.
+		knock := func(t *testing.T) (*test.Room, string) {
+			t.Helper()
+			room := test.NewRoom(t, alice)
+			room.CreateAndInsert(t, alice, spec.MRoomJoinRules, map[string]interface{}{
+				"join_rule": spec.Knock,
+			}, test.WithStateKey(""))
+			knockEvent := room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+				"membership": spec.Knock,
+			}, test.WithStateKey(bob.ID), test.WithUnsigned(map[string]interface{}{
+				"knock_room_state": []map[string]interface{}{{
+					"type":      spec.MRoomJoinRules,
+					"state_key": "",
+					"sender":    alice.ID,
+					"content":   map[string]interface{}{"join_rule": spec.Knock},
+				}},
+			}))
+			if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, room.Events(), "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+
+			knockPath := fmt.Sprintf("rooms.knock.%s", gjson.Escape(room.ID))
+			body := syncSinceUntil(t, "", func(syncBody string) bool {
+				return gjson.Get(syncBody, knockPath).Exists()
+			})
+			knockState := gjson.Get(body, knockPath+".knock_state.events")
+			if !knockState.Get(`#(type=="m.room.join_rules")`).Exists() {
+				t.Fatalf("knock state is missing the stripped state: %s", knockState.Raw)
+			}
+			if got := knockState.Get(`#(type=="m.room.member").event_id`).Str; got != knockEvent.EventID() {
+				t.Fatalf("knock state has knock event %q, want %q: %s", got, knockEvent.EventID(), knockState.Raw)
+			}
+			return room, gjson.Get(body, "next_batch").Str
+		}
+
+		// assertKnockRemoved checks that an initial sync no longer reports the knock.
+		assertKnockRemoved := func(t *testing.T, room *test.Room) {
+			t.Helper()
+			w := httptest.NewRecorder()
+			routers.Client.ServeHTTP(w, test.NewRequest(t, "GET", "/_matrix/client/v3/sync", test.WithQueryParams(map[string]string{
+				"access_token": bobDev.AccessToken,
+			})))
+			if gjson.Get(w.Body.String(), fmt.Sprintf("rooms.knock.%s", gjson.Escape(room.ID))).Exists() {
+				t.Fatalf("knock still reported after it was retired: %s", w.Body.String())
+			}
+		}
+
+		t.Run("knock is removed after leaving", func(t *testing.T) {
+			room, since := knock(t)
+			leaveEvent := room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+				"membership": spec.Leave,
+			}, test.WithStateKey(bob.ID))
+			if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, []*rstypes.HeaderedEvent{leaveEvent}, "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+
+			roomID := gjson.Escape(room.ID)
+			body := syncSinceUntil(t, since, func(syncBody string) bool {
+				return gjson.Get(syncBody, "rooms.leave."+roomID).Exists()
+			})
+			if gjson.Get(body, "rooms.knock."+roomID).Exists() {
+				t.Fatalf("knock reported alongside the leave: %s", body)
+			}
+			assertKnockRemoved(t, room)
+		})
+
+		t.Run("knock is removed after joining", func(t *testing.T) {
+			room, since := knock(t)
+			inviteEvent := room.CreateAndInsert(t, alice, spec.MRoomMember, map[string]interface{}{
+				"membership": spec.Invite,
+			}, test.WithStateKey(bob.ID))
+			joinEvent := room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{
+				"membership": spec.Join,
+			}, test.WithStateKey(bob.ID))
+			if err := api.SendEvents(context.Background(), rsAPI, api.KindNew, []*rstypes.HeaderedEvent{inviteEvent, joinEvent}, "test", "test", "test", nil, false); err != nil {
+				t.Fatalf("failed to send events: %v", err)
+			}
+
+			roomID := gjson.Escape(room.ID)
+			body := syncSinceUntil(t, since, func(syncBody string) bool {
+				return gjson.Get(syncBody, "rooms.join."+roomID).Exists()
+			})
+			if gjson.Get(body, "rooms.knock."+roomID).Exists() {
+				t.Fatalf("knock reported alongside the join: %s", body)
+			}
+			if gjson.Get(body, "rooms.leave."+roomID).Exists() {
+				t.Fatalf("retired knock reported as a leave after joining: %s", body)
+			}
+			assertKnockRemoved(t, room)
+		})
+	})
+}
+
 func TestSendToDevice(t *testing.T) {
 	test.WithAllDatabases(t, testSendToDevice)
 }
@@ -946,7 +1087,7 @@ func testSendToDevice(t *testing.T, dbType test.DBType) {
 
 	jsctx, _ := natsInstance.Prepare(processCtx, &cfg.Global.JetStream)
 	defer jetstream.DeleteAllStreams(jsctx, &cfg.Global.JetStream)
-	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{}, caches, caching.DisableMetrics)
+	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, &syncRoomserverAPI{}, caches, nil, nil, nil, caching.DisableMetrics)
 
 	producer := producers.SyncAPIProducer{
 		TopicSendToDeviceEvent: cfg.Global.JetStream.Prefixed(jetstream.OutputSendToDeviceEvent),
@@ -1169,7 +1310,7 @@ func testContext(t *testing.T, dbType test.DBType) {
 	rsAPI := roomserver.NewInternalAPI(processCtx, cfg, cm, &natsInstance, caches, caching.DisableMetrics)
 	rsAPI.SetFederationAPI(nil, nil)
 
-	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, rsAPI, caches, caching.DisableMetrics)
+	AddPublicRoutes(processCtx, routers, cfg, cm, &natsInstance, &syncUserAPI{accounts: []userapi.Device{alice}}, rsAPI, caches, nil, nil, nil, caching.DisableMetrics)
 
 	room := test.NewRoom(t, user)
 
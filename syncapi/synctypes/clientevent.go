@@ -71,6 +71,19 @@ type ClientEvent struct {
 
 	// Only sent to clients when `event_format` == `federation`.
 	ClientFederationFields
+
+	// fields, if set, are the only fields of the event that are sent to the
+	// client. See ApplyEventFields.
+	fields [][]string
+}
+
+func (ce ClientEvent) MarshalJSON() ([]byte, error) {
+	type alias ClientEvent
+	b, err := json.Marshal(alias(ce))
+	if err != nil || ce.fields == nil {
+		return b, err
+	}
+	return projectEventFields(b, ce.fields)
 }
 
 // ToClientEvents converts server events to client events.
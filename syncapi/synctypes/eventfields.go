@@ -0,0 +1,98 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package synctypes
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// ApplyEventFields limits the fields of the events that are sent to the client
+// to the given event_fields of a filter, which are dot-separated paths such as
+// "content.body". A literal dot in a field name can be escaped with a backslash.
+// The events are only trimmed when they are encoded, so the rest of the event
+// can still be used until then. If no fields are given, all fields are sent.
+// https://spec.matrix.org/v1.11/client-server-api/#filtering
+func ApplyEventFields(events []ClientEvent, eventFields []string) {
+	if len(eventFields) == 0 {
+		return
+	}
+	fields := make([][]string, 0, len(eventFields))
+	for _, field := range eventFields {
+		if path := splitEventField(field); len(path) > 0 {
+			fields = append(fields, path)
+		}
+	}
+	for i := range events {
+		events[i].fields = fields
+	}
+}
+
+// splitEventField splits an event field into the keys of its path.
+func splitEventField(field string) []string {
+	var path []string
+	var key strings.Builder
+	for i := 0; i < len(field); i++ {
+		switch {
+		case field[i] == '\\' && i+1 < len(field):
+			i++
+			key.WriteByte(field[i])
+		case field[i] == '.':
+			path = append(path, key.String())
+			key.Reset()
+		default:
+			key.WriteByte(field[i])
+		}
+	}
+	return append(path, key.String())
+}
+
+// projectEventFields returns the encoded event with only the given fields.
+// Fields which don't exist in the event are ignored.
+func projectEventFields(event []byte, fields [][]string) ([]byte, error) {
+	var src map[string]json.RawMessage
+	if err := json.Unmarshal(event, &src); err != nil {
+		return nil, err
+	}
+	dst := map[string]interface{}{}
+	for _, path := range fields {
+		selectEventField(src, dst, path)
+	}
+	return json.Marshal(dst)
+}
+
+func selectEventField(src map[string]json.RawMessage, dst map[string]interface{}, path []string) {
+	value, ok := src[path[0]]
+	if !ok {
+		return
+	}
+	if len(path) == 1 {
+		dst[path[0]] = value
+		return
+	}
+	sub, ok := dst[path[0]].(map[string]interface{})
+	if !ok {
+		if _, selected := dst[path[0]]; selected {
+			return // the whole value has already been selected
+		}
+		sub = map[string]interface{}{}
+	}
+	var child map[string]json.RawMessage
+	if err := json.Unmarshal(value, &child); err != nil {
+		return // not an object, so there's nothing to select
+	}
+	dst[path[0]] = sub
+	selectEventField(child, sub, path[1:])
+}
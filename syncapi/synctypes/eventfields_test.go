@@ -0,0 +1,98 @@
+package synctypes
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestApplyEventFields(t *testing.T) {
+	stateKey := ""
+	ev := ClientEvent{
+		Content:        []byte(`{"body":"hello","m.relates_to":{"rel_type":"m.thread"},"info":{"w":1,"h":2}}`),
+		EventID:        "$event",
+		OriginServerTS: 1234,
+		Sender:         "@alice:test",
+		StateKey:       &stateKey,
+		Type:           "m.room.message",
+		Unsigned:       []byte(`{"age":10}`),
+	}
+
+	tests := []struct {
+		name   string
+		fields []string
+		want   string
+	}{
+		{
+			name: "no fields",
+			want: `{"content":{"body":"hello","m.relates_to":{"rel_type":"m.thread"},"info":{"w":1,"h":2}},"event_id":"$event","origin_server_ts":1234,"sender":"@alice:test","state_key":"","type":"m.room.message","unsigned":{"age":10}}`,
+		},
+		{
+			name:   "top level and nested fields",
+			fields: []string{"type", "content.body", "content.info.w"},
+			want:   `{"content":{"body":"hello","info":{"w":1}},"type":"m.room.message"}`,
+		},
+		{
+			name:   "escaped dots",
+			fields: []string{`content.m\.relates_to.rel_type`},
+			want:   `{"content":{"m.relates_to":{"rel_type":"m.thread"}}}`,
+		},
+		{
+			name:   "whole object wins over nested fields",
+			fields: []string{"content.body", "content", "content.info.w"},
+			want:   `{"content":{"body":"hello","m.relates_to":{"rel_type":"m.thread"},"info":{"w":1,"h":2}}}`,
+		},
+		{
+			name:   "missing and non-object fields are ignored",
+			fields: []string{"event_id", "redacts", "type.foo", "content.missing"},
+			want:   `{"content":{},"event_id":"$event"}`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			events := []ClientEvent{ev}
+			ApplyEventFields(events, tc.fields)
+			got, err := json.Marshal(events[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var gotJSON, wantJSON interface{}
+			if err = json.Unmarshal(got, &gotJSON); err != nil {
+				t.Fatal(err)
+			}
+			if err = json.Unmarshal([]byte(tc.want), &wantJSON); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gotJSON, wantJSON) {
+				t.Fatalf("got %s, want %s", got, tc.want)
+			}
+		})
+	}
+
+	// The events are only trimmed when they are encoded.
+	events := []ClientEvent{ev}
+	ApplyEventFields(events, []string{"type"})
+	if events[0].Sender != ev.Sender {
+		t.Fatalf("expected the sender to be kept, got %q", events[0].Sender)
+	}
+}
+
+func TestRoomEventFilterValidate(t *testing.T) {
+	for eventFormat, valid := range map[string]bool{
+		"":                    true,
+		EventFormatClient:     true,
+		EventFormatFederation: true,
+		"bogus":               false,
+	} {
+		filter := RoomEventFilter{EventFormat: eventFormat}
+		if err := filter.Validate(); (err == nil) != valid {
+			t.Errorf("event_format %q: expected valid=%v, got err=%v", eventFormat, valid, err)
+		}
+	}
+	if format := FormatFor(EventFormatFederation, FormatAll); format != FormatSyncFederation {
+		t.Errorf("expected federation format, got %v", format)
+	}
+	if format := FormatFor(EventFormatClient, FormatSync); format != FormatSync {
+		t.Errorf("expected sync format, got %v", format)
+	}
+}
@@ -76,6 +76,10 @@ type RoomEventFilter struct {
 	Rooms                     *[]string `json:"rooms,omitempty"`
 	UnreadThreadNotifications bool      `json:"unread_thread_notifications,omitempty"`
 	ContainsURL               *bool     `json:"contains_url,omitempty"`
+	// NOTSPEC: event_fields and event_format are only part of the top-level filter
+	// in the spec, but we also honour them on /messages, /context and /search.
+	EventFields []string `json:"event_fields,omitempty"`
+	EventFormat string   `json:"event_format,omitempty"`
 }
 
 const (
@@ -85,12 +89,30 @@ const (
 
 // Validate checks if the filter contains valid property values
 func (filter *Filter) Validate() error {
-	if filter.EventFormat != "" && filter.EventFormat != EventFormatClient && filter.EventFormat != EventFormatFederation {
+	return validateEventFormat(filter.EventFormat)
+}
+
+// Validate checks if the filter contains valid property values
+func (filter *RoomEventFilter) Validate() error {
+	return validateEventFormat(filter.EventFormat)
+}
+
+func validateEventFormat(eventFormat string) error {
+	if eventFormat != "" && eventFormat != EventFormatClient && eventFormat != EventFormatFederation {
 		return errors.New("Bad event_format value. Must be one of [\"client\", \"federation\"]")
 	}
 	return nil
 }
 
+// FormatFor returns the client event format for the event_format of a filter.
+// Events are returned in the given format unless federation events were asked for.
+func FormatFor(eventFormat string, format ClientEventFormat) ClientEventFormat {
+	if eventFormat == EventFormatFederation {
+		return FormatSyncFederation
+	}
+	return format
+}
+
 // DefaultFilter returns the default filter used by the Matrix server if no filter is provided in
 // the request
 func DefaultFilter() Filter {
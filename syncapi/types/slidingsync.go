@@ -0,0 +1,184 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
+)
+
+// Sort orders which can be requested for a sliding sync list.
+const (
+	SlidingSortByRecency           = "by_recency"
+	SlidingSortByName              = "by_name"
+	SlidingSortByNotificationLevel = "by_notification_level"
+)
+
+// Special values which can be used in the required_state of a sliding sync
+// request. They are replaced by the user ID of the syncing user and by the
+// senders of the timeline events respectively.
+const (
+	SlidingStateKeyMe   = "$ME"
+	SlidingStateKeyLazy = "$LAZY"
+	SlidingWildcard     = "*"
+)
+
+// SlidingSyncRequest is the body of a simplified sliding sync request (MSC4186).
+type SlidingSyncRequest struct {
+	ConnID            string                       `json:"conn_id"`
+	Lists             map[string]SlidingListConfig `json:"lists"`
+	RoomSubscriptions map[string]SlidingRoomConfig `json:"room_subscriptions"`
+	Extensions        SlidingExtensionsRequest     `json:"extensions"`
+}
+
+// SlidingRoomConfig describes what should be returned for each room in a list
+// or room subscription.
+type SlidingRoomConfig struct {
+	RequiredState [][2]string `json:"required_state"`
+	TimelineLimit int         `json:"timeline_limit"`
+}
+
+// SlidingListConfig describes a list of rooms, the window of the list that the
+// client is interested in and how the rooms should be filtered and sorted.
+type SlidingListConfig struct {
+	SlidingRoomConfig
+	Ranges  [][2]int            `json:"ranges"`
+	Sort    []string            `json:"sort,omitempty"`
+	Filters *SlidingListFilters `json:"filters,omitempty"`
+}
+
+// SlidingListFilters restricts the rooms in a list. Unset filters are ignored.
+type SlidingListFilters struct {
+	IsDM         *bool     `json:"is_dm,omitempty"`
+	IsEncrypted  *bool     `json:"is_encrypted,omitempty"`
+	IsInvite     *bool     `json:"is_invite,omitempty"`
+	RoomTypes    []*string `json:"room_types,omitempty"`
+	NotRoomTypes []*string `json:"not_room_types,omitempty"`
+	Spaces       []string  `json:"spaces,omitempty"`
+	RoomNameLike string    `json:"room_name_like,omitempty"`
+}
+
+// SlidingExtensionsRequest contains the extensions requested by the client.
+type SlidingExtensionsRequest struct {
+	ToDevice    *SlidingToDeviceRequest  `json:"to_device,omitempty"`
+	E2EE        *SlidingExtensionRequest `json:"e2ee,omitempty"`
+	AccountData *SlidingExtensionRequest `json:"account_data,omitempty"`
+	Receipts    *SlidingExtensionRequest `json:"receipts,omitempty"`
+	Typing      *SlidingExtensionRequest `json:"typing,omitempty"`
+}
+
+// SlidingExtensionRequest enables an extension. Extensions which return data
+// for rooms can be scoped to some lists and room subscriptions, where "*"
+// means all of them. If neither is given, the extension covers every room in
+// the response window.
+type SlidingExtensionRequest struct {
+	Enabled bool     `json:"enabled"`
+	Lists   []string `json:"lists,omitempty"`
+	Rooms   []string `json:"rooms,omitempty"`
+}
+
+// SlidingToDeviceRequest enables the to-device extension, which has its own
+// position so that messages are only deleted once the client has seen them.
+type SlidingToDeviceRequest struct {
+	SlidingExtensionRequest
+	Since string `json:"since,omitempty"`
+}
+
+// SlidingSyncResponse is the response to a simplified sliding sync request.
+type SlidingSyncResponse struct {
+	Pos        string                          `json:"pos"`
+	Lists      map[string]SlidingListResponse  `json:"lists"`
+	Rooms      map[string]*SlidingRoomResponse `json:"rooms"`
+	Extensions SlidingExtensionsResponse       `json:"extensions"`
+}
+
+// HasUpdates returns whether the response contains anything other than the
+// one-time key counts, which are always included.
+func (r *SlidingSyncResponse) HasUpdates() bool {
+	e := r.Extensions
+	return len(r.Rooms) > 0 ||
+		(e.ToDevice != nil && len(e.ToDevice.Events) > 0) ||
+		(e.E2EE != nil && e.E2EE.DeviceLists != nil && (len(e.E2EE.DeviceLists.Changed) > 0 || len(e.E2EE.DeviceLists.Left) > 0)) ||
+		(e.AccountData != nil && (len(e.AccountData.Global) > 0 || len(e.AccountData.Rooms) > 0)) ||
+		(e.Receipts != nil && len(e.Receipts.Rooms) > 0) ||
+		(e.Typing != nil && len(e.Typing.Rooms) > 0)
+}
+
+// SlidingListResponse contains the number of rooms matching the list filters.
+type SlidingListResponse struct {
+	Count int `json:"count"`
+}
+
+// SlidingRoomResponse contains the changes to a room since the previous
+// position, or everything the client asked for if Initial is set.
+type SlidingRoomResponse struct {
+	Name              string                  `json:"name,omitempty"`
+	Avatar            string                  `json:"avatar,omitempty"`
+	Heroes            []SlidingRoomHero       `json:"heroes,omitempty"`
+	IsDM              bool                    `json:"is_dm,omitempty"`
+	Initial           bool                    `json:"initial,omitempty"`
+	RequiredState     []synctypes.ClientEvent `json:"required_state,omitempty"`
+	Timeline          []synctypes.ClientEvent `json:"timeline,omitempty"`
+	PrevBatch         *TopologyToken          `json:"prev_batch,omitempty"`
+	Limited           bool                    `json:"limited,omitempty"`
+	NumLive           int                     `json:"num_live,omitempty"`
+	JoinedCount       *int                    `json:"joined_count,omitempty"`
+	InvitedCount      *int                    `json:"invited_count,omitempty"`
+	NotificationCount int                     `json:"notification_count"`
+	HighlightCount    int                     `json:"highlight_count"`
+	BumpStamp         StreamPosition          `json:"bump_stamp,omitempty"`
+	InviteState       []json.RawMessage       `json:"invite_state,omitempty"`
+}
+
+// SlidingRoomHero is a member of a room without a name, which clients use
+// to work out the display name of the room.
+type SlidingRoomHero struct {
+	UserID      string `json:"user_id"`
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+// SlidingExtensionsResponse contains the responses of the enabled extensions.
+type SlidingExtensionsResponse struct {
+	ToDevice    *SlidingToDeviceResponse    `json:"to_device,omitempty"`
+	E2EE        *SlidingE2EEResponse        `json:"e2ee,omitempty"`
+	AccountData *SlidingAccountDataResponse `json:"account_data,omitempty"`
+	Receipts    *SlidingEphemeralResponse   `json:"receipts,omitempty"`
+	Typing      *SlidingEphemeralResponse   `json:"typing,omitempty"`
+}
+
+type SlidingToDeviceResponse struct {
+	NextBatch string                                `json:"next_batch"`
+	Events    []gomatrixserverlib.SendToDeviceEvent `json:"events"`
+}
+
+type SlidingE2EEResponse struct {
+	DeviceLists                  *DeviceLists   `json:"device_lists,omitempty"`
+	DeviceOneTimeKeysCount       map[string]int `json:"device_one_time_keys_count,omitempty"`
+	DeviceUnusedFallbackKeyTypes []string       `json:"device_unused_fallback_key_types"`
+}
+
+type SlidingAccountDataResponse struct {
+	Global []synctypes.ClientEvent            `json:"global,omitempty"`
+	Rooms  map[string][]synctypes.ClientEvent `json:"rooms,omitempty"`
+}
+
+// SlidingEphemeralResponse contains one ephemeral event per room, which is
+// used by both the receipts and typing extensions.
+type SlidingEphemeralResponse struct {
+	Rooms map[string]synctypes.ClientEvent `json:"rooms,omitempty"`
+}
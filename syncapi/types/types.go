@@ -123,6 +123,7 @@ type StreamingToken struct {
 	DeviceListPosition       StreamPosition
 	NotificationDataPosition StreamPosition
 	PresencePosition         StreamPosition
+	KnockPosition            StreamPosition
 }
 
 // This will be used as a fallback by json.Marshal.
@@ -138,12 +139,12 @@ func (s *StreamingToken) UnmarshalText(text []byte) (err error) {
 
 func (t StreamingToken) String() string {
 	posStr := fmt.Sprintf(
-		"s%d_%d_%d_%d_%d_%d_%d_%d_%d",
+		"s%d_%d_%d_%d_%d_%d_%d_%d_%d_%d",
 		t.PDUPosition, t.TypingPosition,
 		t.ReceiptPosition, t.SendToDevicePosition,
 		t.InvitePosition, t.AccountDataPosition,
 		t.DeviceListPosition, t.NotificationDataPosition,
-		t.PresencePosition,
+		t.PresencePosition, t.KnockPosition,
 	)
 	return posStr
 }
@@ -169,12 +170,14 @@ func (t *StreamingToken) IsAfter(other StreamingToken) bool {
 		return true
 	case t.PresencePosition > other.PresencePosition:
 		return true
+	case t.KnockPosition > other.KnockPosition:
+		return true
 	}
 	return false
 }
 
 func (t *StreamingToken) IsEmpty() bool {
-	return t == nil || t.PDUPosition+t.TypingPosition+t.ReceiptPosition+t.SendToDevicePosition+t.InvitePosition+t.AccountDataPosition+t.DeviceListPosition+t.NotificationDataPosition+t.PresencePosition == 0
+	return t == nil || t.PDUPosition+t.TypingPosition+t.ReceiptPosition+t.SendToDevicePosition+t.InvitePosition+t.AccountDataPosition+t.DeviceListPosition+t.NotificationDataPosition+t.PresencePosition+t.KnockPosition == 0
 }
 
 // WithUpdates returns a copy of the StreamingToken with updates applied from another StreamingToken.
@@ -218,6 +221,9 @@ func (t *StreamingToken) ApplyUpdates(other StreamingToken) {
 	if other.PresencePosition > t.PresencePosition {
 		t.PresencePosition = other.PresencePosition
 	}
+	if other.KnockPosition > t.KnockPosition {
+		t.KnockPosition = other.KnockPosition
+	}
 }
 
 type TopologyToken struct {
@@ -313,7 +319,7 @@ func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 	// s478_0_0_0_0_13.dl-0-2 but we have now removed partitioned stream positions
 	tok = strings.Split(tok, ".")[0]
 	parts := strings.Split(tok[1:], "_")
-	var positions [9]StreamPosition
+	var positions [10]StreamPosition
 	for i, p := range parts {
 		if i >= len(positions) {
 			break
@@ -336,6 +342,7 @@ func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 		DeviceListPosition:       positions[6],
 		NotificationDataPosition: positions[7],
 		PresencePosition:         positions[8],
+		KnockPosition:            positions[9],
 	}
 	return token, nil
 }
@@ -349,6 +356,7 @@ type RoomsResponse struct {
 	Join   map[string]*JoinResponse   `json:"join,omitempty"`
 	Invite map[string]*InviteResponse `json:"invite,omitempty"`
 	Leave  map[string]*LeaveResponse  `json:"leave,omitempty"`
+	Knock  map[string]*KnockResponse  `json:"knock,omitempty"`
 }
 
 type ToDeviceResponse struct {
@@ -382,8 +390,8 @@ func (r Response) MarshalJSON() ([]byte, error) {
 		}
 	}
 	if r.Rooms != nil {
-		if len(r.Rooms.Join) == 0 &&
-			len(r.Rooms.Invite) == 0 && len(r.Rooms.Leave) == 0 {
+		if len(r.Rooms.Join) == 0 && len(r.Rooms.Invite) == 0 &&
+			len(r.Rooms.Leave) == 0 && len(r.Rooms.Knock) == 0 {
 			a.Rooms = nil
 		}
 	}
@@ -400,11 +408,36 @@ func (r *Response) HasUpdates() bool {
 		len(r.Rooms.Invite) > 0 ||
 		len(r.Rooms.Join) > 0 ||
 		len(r.Rooms.Leave) > 0 ||
+		len(r.Rooms.Knock) > 0 ||
 		len(r.ToDevice.Events) > 0 ||
 		len(r.DeviceLists.Changed) > 0 ||
 		len(r.DeviceLists.Left) > 0)
 }
 
+// ApplyEventFields limits the fields of the room state and timeline events in
+// the response to the given event_fields of the sync filter.
+func (r *Response) ApplyEventFields(fields []string) {
+	if len(fields) == 0 || r.Rooms == nil {
+		return
+	}
+	for _, jr := range r.Rooms.Join {
+		if jr.State != nil {
+			synctypes.ApplyEventFields(jr.State.Events, fields)
+		}
+		if jr.Timeline != nil {
+			synctypes.ApplyEventFields(jr.Timeline.Events, fields)
+		}
+	}
+	for _, lr := range r.Rooms.Leave {
+		if lr.State != nil {
+			synctypes.ApplyEventFields(lr.State.Events, fields)
+		}
+		if lr.Timeline != nil {
+			synctypes.ApplyEventFields(lr.Timeline.Events, fields)
+		}
+	}
+}
+
 // NewResponse creates an empty response with initialised maps.
 func NewResponse() *Response {
 	res := Response{}
@@ -414,6 +447,7 @@ func NewResponse() *Response {
 		Join:   map[string]*JoinResponse{},
 		Invite: map[string]*InviteResponse{},
 		Leave:  map[string]*LeaveResponse{},
+		Knock:  map[string]*KnockResponse{},
 	}
 
 	// Also pre-intialise empty slices or else we'll insert 'null' instead of '[]' for the value.
@@ -436,6 +470,7 @@ func (r *Response) IsEmpty() bool {
 	return len(r.Rooms.Join) == 0 &&
 		len(r.Rooms.Invite) == 0 &&
 		len(r.Rooms.Leave) == 0 &&
+		len(r.Rooms.Knock) == 0 &&
 		len(r.AccountData.Events) == 0 &&
 		len(r.Presence.Events) == 0 &&
 		len(r.ToDevice.Events) == 0
@@ -470,6 +505,10 @@ type JoinResponse struct {
 	Ephemeral            *ClientEvents `json:"ephemeral,omitempty"`
 	AccountData          *ClientEvents `json:"account_data,omitempty"`
 	*UnreadNotifications `json:"unread_notifications,omitempty"`
+	// UnreadThreadNotifications contains the notification counts of each
+	// thread in the room, keyed by thread root event ID. It is only populated
+	// when the filter asks for unread thread notifications.
+	UnreadThreadNotifications map[string]*UnreadNotifications `json:"unread_thread_notifications,omitempty"`
 }
 
 func (jr JoinResponse) MarshalJSON() ([]byte, error) {
@@ -507,6 +546,7 @@ func (jr JoinResponse) MarshalJSON() ([]byte, error) {
 		// if everything else is nil, also remove UnreadNotifications
 		if a.State == nil && a.Ephemeral == nil && a.AccountData == nil && a.Timeline == nil && a.Summary == nil {
 			a.UnreadNotifications = nil
+			a.UnreadThreadNotifications = nil
 		}
 	}
 	return json.Marshal(a)
@@ -578,6 +618,49 @@ func NewInviteResponse(ctx context.Context, rsAPI api.QuerySenderIDAPI, event *t
 	return &res, nil
 }
 
+// KnockResponse represents a /sync response for a room which is under the 'knock' key.
+type KnockResponse struct {
+	KnockState struct {
+		Events []json.RawMessage `json:"events"`
+	} `json:"knock_state"`
+}
+
+// NewKnockResponse creates a response containing the stripped state of the
+// knocked room, followed by the knock event itself.
+func NewKnockResponse(ctx context.Context, rsAPI api.QuerySenderIDAPI, event *types.HeaderedEvent, eventFormat synctypes.ClientEventFormat) (*KnockResponse, error) {
+	res := KnockResponse{}
+	res.KnockState.Events = []json.RawMessage{}
+
+	// First see if there's knock_room_state in the unsigned key of the knock.
+	// If there is then unmarshal it into the response. This will contain the
+	// partial room state such as join rules, room name etc.
+	if knockRoomState := gjson.GetBytes(event.Unsigned(), "knock_room_state"); knockRoomState.Exists() {
+		_ = json.Unmarshal([]byte(knockRoomState.Raw), &res.KnockState.Events)
+	}
+
+	// Clear unsigned so that the stripped state isn't repeated in the knock event.
+	eventNoUnsigned, err := event.SetUnsigned(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	knockEvent, err := synctypes.ToClientEvent(eventNoUnsigned, eventFormat, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+		return rsAPI.QueryUserIDForSender(ctx, roomID, senderID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Ensure unsigned field is empty so it isn't marshalled into the final JSON
+	knockEvent.Unsigned = nil
+
+	if ev, err := json.Marshal(*knockEvent); err == nil {
+		res.KnockState.Events = append(res.KnockState.Events, ev)
+	}
+
+	return &res, nil
+}
+
 // LeaveResponse represents a /sync response for a room which is under the 'leave' key.
 type LeaveResponse struct {
 	State    *ClientEvents `json:"state,omitempty"`
@@ -618,6 +701,7 @@ type OutputReceiptEvent struct {
 	RoomID    string         `json:"room_id"`
 	EventID   string         `json:"event_id"`
 	Type      string         `json:"type"`
+	ThreadID  string         `json:"thread_id,omitempty"`
 	Timestamp spec.Timestamp `json:"timestamp"`
 }
 
@@ -638,3 +722,11 @@ type RelationEntry struct {
 	Position StreamPosition
 	EventID  string
 }
+
+// ThreadSummary contains the information needed to bundle an "m.thread"
+// aggregation into a thread root event.
+type ThreadSummary struct {
+	Count         int
+	LatestEventID string
+	Participated  bool
+}
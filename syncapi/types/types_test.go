@@ -30,12 +30,12 @@ func (f *FakeRoomserverAPI) QuerySenderIDForUser(ctx context.Context, roomID spe
 
 func TestSyncTokens(t *testing.T) {
 	shouldPass := map[string]string{
-		"s4_0_0_0_0_0_0_0_3": StreamingToken{4, 0, 0, 0, 0, 0, 0, 0, 3}.String(),
-		"s3_1_0_0_0_0_2_0_5": StreamingToken{3, 1, 0, 0, 0, 0, 2, 0, 5}.String(),
-		"s3_1_2_3_5_0_0_0_6": StreamingToken{3, 1, 2, 3, 5, 0, 0, 0, 6}.String(),
-		"t3_1":               TopologyToken{3, 1}.String(),
+		"s4_0_0_0_0_0_0_0_3_0": StreamingToken{4, 0, 0, 0, 0, 0, 0, 0, 3, 0}.String(),
+		"s3_1_0_0_0_0_2_0_5_0": StreamingToken{3, 1, 0, 0, 0, 0, 2, 0, 5, 0}.String(),
+		"s3_1_2_3_5_0_0_0_6_7": StreamingToken{3, 1, 2, 3, 5, 0, 0, 0, 6, 7}.String(),
+		"t3_1":                 TopologyToken{3, 1}.String(),
 		"t9223372036854775807_9223372036854775807": TopologyToken{Depth: math.MaxInt64, PDUPosition: math.MaxInt64}.String(),
-		"s9223372036854775807_1_2_3_5_0_0_0_6":     StreamingToken{math.MaxInt64, 1, 2, 3, 5, 0, 0, 0, 6}.String(),
+		"s9223372036854775807_1_2_3_5_0_0_0_6_0":   StreamingToken{math.MaxInt64, 1, 2, 3, 5, 0, 0, 0, 6, 0}.String(),
 	}
 
 	for a, b := range shouldPass {
@@ -105,6 +105,30 @@ func TestNewInviteResponse(t *testing.T) {
 	}
 }
 
+func TestNewKnockResponse(t *testing.T) {
+	event := `{"auth_events":["$SbSsh09j26UAXnjd3RZqf2lyA3Kw2sY_VZJVZQAV9yA","$EwL53onrLwQ5gL8Dv3VrOOCvHiueXu2ovLdzqkNi3lo"],"content":{"membership":"knock","reason":"let me in"},"depth":9,"hashes":{"sha256":"8p+Ur4f8vLFX6mkIXhxI0kegPG7X3tWy56QmvBkExAg"},"origin_server_ts":1602087113066,"prev_events":["$1v-O6tNwhOZcA8bvCYY-Dnj1V2ZDE58lLPxtlV97S28"],"room_id":"!XbeXirGWSPXbEaGokF:matrix.org","sender":"@neilalexander:dendrite.neilalexander.dev","signatures":{},"state_key":"@neilalexander:dendrite.neilalexander.dev","type":"m.room.member","unsigned":{"knock_room_state":[{"content":{"join_rule":"knock"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.join_rules"},{"content":{"name":"Test room"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.name"}]}}`
+	expected := `{"knock_state":{"events":[{"content":{"join_rule":"knock"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.join_rules"},{"content":{"name":"Test room"},"sender":"@neilalexander:matrix.org","state_key":"","type":"m.room.name"},{"content":{"membership":"knock","reason":"let me in"},"event_id":"$9yLCN9EWJx39aM9v_Iq28cQdANcV7mUBF81gjWaxRP8","origin_server_ts":1602087113066,"sender":"@neilalexander:dendrite.neilalexander.dev","state_key":"@neilalexander:dendrite.neilalexander.dev","type":"m.room.member"}]}}`
+
+	ev, err := gomatrixserverlib.MustGetRoomVersion(gomatrixserverlib.RoomVersionV10).NewEventFromTrustedJSON([]byte(event), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsAPI := FakeRoomserverAPI{}
+	res, err := NewKnockResponse(context.Background(), &rsAPI, &types.HeaderedEvent{PDU: ev}, synctypes.FormatSync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := json.Marshal(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(j) != expected {
+		t.Fatalf("Knock response didn't contain correct info, \nexpected: %s \ngot: %s", expected, string(j))
+	}
+}
+
 func TestJoinResponse_MarshalJSON(t *testing.T) {
 	type fields struct {
 		Summary             *Summary
@@ -113,6 +137,7 @@ func TestJoinResponse_MarshalJSON(t *testing.T) {
 		Ephemeral           *ClientEvents
 		AccountData         *ClientEvents
 		UnreadNotifications *UnreadNotifications
+		UnreadThreads       map[string]*UnreadNotifications
 	}
 	tests := []struct {
 		name    string
@@ -170,6 +195,23 @@ func TestJoinResponse_MarshalJSON(t *testing.T) {
 			},
 			want: []byte(`{"state":{"events":[{"content":{},"type":""}]},"unread_notifications":{"highlight_count":0,"notification_count":1}}`),
 		},
+		{
+			name: "unread thread notifications are removed, if everything else is empty",
+			fields: fields{
+				UnreadNotifications: &UnreadNotifications{},
+				UnreadThreads:       map[string]*UnreadNotifications{"$thread": {NotificationCount: 1}},
+			},
+			want: []byte("{}"),
+		},
+		{
+			name: "unread thread notifications are NOT removed, if state is set",
+			fields: fields{
+				State:               &ClientEvents{Events: []synctypes.ClientEvent{{Content: []byte("{}")}}},
+				UnreadNotifications: &UnreadNotifications{},
+				UnreadThreads:       map[string]*UnreadNotifications{"$thread": {NotificationCount: 1}},
+			},
+			want: []byte(`{"state":{"events":[{"content":{},"type":""}]},"unread_notifications":{"highlight_count":0,"notification_count":0},"unread_thread_notifications":{"$thread":{"highlight_count":0,"notification_count":1}}}`),
+		},
 		{
 			name: "roomID is removed from EDUs",
 			fields: fields{
@@ -185,12 +227,13 @@ func TestJoinResponse_MarshalJSON(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			jr := JoinResponse{
-				Summary:             tt.fields.Summary,
-				State:               tt.fields.State,
-				Timeline:            tt.fields.Timeline,
-				Ephemeral:           tt.fields.Ephemeral,
-				AccountData:         tt.fields.AccountData,
-				UnreadNotifications: tt.fields.UnreadNotifications,
+				Summary:                   tt.fields.Summary,
+				State:                     tt.fields.State,
+				Timeline:                  tt.fields.Timeline,
+				Ephemeral:                 tt.fields.Ephemeral,
+				AccountData:               tt.fields.AccountData,
+				UnreadNotifications:       tt.fields.UnreadNotifications,
+				UnreadThreadNotifications: tt.fields.UnreadThreads,
 			}
 			got, err := jr.MarshalJSON()
 			if (err != nil) != tt.wantErr {
@@ -39,7 +39,6 @@ type UserInternalAPI interface {
 	FederationUserAPI
 
 	QuerySearchProfilesAPI // used by p2p demos
-	QueryAccountByLocalpart(ctx context.Context, req *QueryAccountByLocalpartRequest, res *QueryAccountByLocalpartResponse) (err error)
 }
 
 // api functions required by the appservice api
@@ -84,6 +83,7 @@ type SyncUserAPI interface {
 type ClientUserAPI interface {
 	QueryAcccessTokenAPI
 	LoginTokenInternalAPI
+	UIASessionAPI
 	UserLoginAPI
 	ClientKeyAPI
 	ProfileAPI
@@ -94,6 +94,9 @@ type ClientUserAPI interface {
 	QueryPushers(ctx context.Context, req *QueryPushersRequest, res *QueryPushersResponse) error
 	QueryPushRules(ctx context.Context, userID string) (*pushrules.AccountRuleSets, error)
 	QueryAccountAvailability(ctx context.Context, req *QueryAccountAvailabilityRequest, res *QueryAccountAvailabilityResponse) error
+	QueryAccountByLocalpart(ctx context.Context, req *QueryAccountByLocalpartRequest, res *QueryAccountByLocalpartResponse) (err error)
+	QueryExternalID(ctx context.Context, req *QueryExternalIDRequest, res *QueryExternalIDResponse) error
+	PerformExternalIDLink(ctx context.Context, req *PerformExternalIDLinkRequest, res *struct{}) error
 	PerformAdminCreateRegistrationToken(ctx context.Context, registrationToken *clientapi.RegistrationToken) (bool, error)
 	PerformAdminListRegistrationTokens(ctx context.Context, returnAll bool, valid bool) ([]clientapi.RegistrationToken, error)
 	PerformAdminGetRegistrationToken(ctx context.Context, tokenString string) (*clientapi.RegistrationToken, error)
@@ -103,11 +106,14 @@ type ClientUserAPI interface {
 	PerformDeviceCreation(ctx context.Context, req *PerformDeviceCreationRequest, res *PerformDeviceCreationResponse) error
 	PerformDeviceUpdate(ctx context.Context, req *PerformDeviceUpdateRequest, res *PerformDeviceUpdateResponse) error
 	PerformDeviceDeletion(ctx context.Context, req *PerformDeviceDeletionRequest, res *PerformDeviceDeletionResponse) error
+	PerformTokenRefresh(ctx context.Context, req *PerformTokenRefreshRequest, res *PerformTokenRefreshResponse) error
 	PerformPasswordUpdate(ctx context.Context, req *PerformPasswordUpdateRequest, res *PerformPasswordUpdateResponse) error
 	PerformPusherDeletion(ctx context.Context, req *PerformPusherDeletionRequest, res *struct{}) error
 	PerformPusherSet(ctx context.Context, req *PerformPusherSetRequest, res *struct{}) error
 	PerformPushRulesPut(ctx context.Context, userID string, ruleSets *pushrules.AccountRuleSets) error
 	PerformAccountDeactivation(ctx context.Context, req *PerformAccountDeactivationRequest, res *PerformAccountDeactivationResponse) error
+	QueryAdminAccounts(ctx context.Context, req *QueryAdminAccountsRequest, res *QueryAdminAccountsResponse) error
+	PerformAdminUpdateAccount(ctx context.Context, req *PerformAdminUpdateAccountRequest, res *struct{}) error
 	QueryNotifications(ctx context.Context, req *QueryNotificationsRequest, res *QueryNotificationsResponse) error
 	InputAccountData(ctx context.Context, req *InputAccountDataRequest, res *InputAccountDataResponse) error
 }
@@ -271,6 +277,12 @@ type QueryAccessTokenRequest struct {
 type QueryAccessTokenResponse struct {
 	Device *Device
 	Err    string // e.g ErrorForbidden
+	// Expired is true if the access token is known but has expired, in which
+	// case Device is nil. The client can use its refresh token to get a new one.
+	Expired bool
+	// Locked is true if the account of the device has been locked by a server
+	// admin. The device is still returned, so that the user can log out.
+	Locked bool
 }
 
 // QueryAccountDataRequest is the request for QueryAccountData
@@ -376,18 +388,68 @@ type PerformDeviceCreationRequest struct {
 	// FromRegistration determines if this request comes from registering a new account
 	// and is in most cases false.
 	FromRegistration bool
+
+	// RefreshToken determines whether the client supports refresh tokens. If so, the
+	// access token expires and a refresh token is returned to get a new one.
+	RefreshToken bool
 }
 
 // PerformDeviceCreationResponse is the response for PerformDeviceCreation
 type PerformDeviceCreationResponse struct {
 	DeviceCreated bool
 	Device        *Device
+	// RefreshToken is only set if one was requested.
+	RefreshToken string
+}
+
+// PerformTokenRefreshRequest is the request for PerformTokenRefresh
+type PerformTokenRefreshRequest struct {
+	RefreshToken string
+	// The new access token for the device.
+	AccessToken string
+}
+
+// PerformTokenRefreshResponse is the response for PerformTokenRefresh
+type PerformTokenRefreshResponse struct {
+	// Device is the device with the new access token, or nil if the refresh
+	// token is unknown or has already been used.
+	Device       *Device
+	RefreshToken string
 }
 
 // PerformAccountDeactivationRequest is the request for PerformAccountDeactivation
 type PerformAccountDeactivationRequest struct {
 	Localpart  string
 	ServerName spec.ServerName // optional: if blank, default server name used
+	// Erase also removes the display name and avatar of the user.
+	Erase bool
+}
+
+// QueryAdminAccountsRequest is the request for QueryAdminAccounts
+type QueryAdminAccountsRequest struct {
+	// Search matches the localpart or the display name of the accounts, and
+	// is ignored if empty.
+	Search             string
+	IncludeDeactivated bool
+	From               int64
+	Limit              int64
+}
+
+// QueryAdminAccountsResponse is the response for QueryAdminAccounts
+type QueryAdminAccountsResponse struct {
+	Accounts []AdminAccount
+	// The total number of accounts matching the request.
+	Total int64
+}
+
+// PerformAdminUpdateAccountRequest is the request for PerformAdminUpdateAccount.
+// Settings which are nil are left unchanged.
+type PerformAdminUpdateAccountRequest struct {
+	Localpart    string
+	ServerName   spec.ServerName
+	Admin        *bool
+	Locked       *bool
+	ShadowBanned *bool
 }
 
 // PerformAccountDeactivationResponse is the response for PerformAccountDeactivation
@@ -414,6 +476,12 @@ type Device struct {
 	// this is the appservice ID.
 	AppserviceID string
 	AccountType  AccountType
+	// When the access token expires, as a unix timestamp in milliseconds.
+	// This is 0 if the access token never expires.
+	AccessTokenExpiresTS int64
+	// Whether the account of the device is shadow-banned, in which case its
+	// events must not be sent to other users.
+	ShadowBanned bool
 }
 
 func (d *Device) UserDomain() spec.ServerName {
@@ -435,9 +503,24 @@ type Account struct {
 	ServerName   spec.ServerName
 	AppServiceID string
 	AccountType  AccountType
+	// When the account was created, as a unix timestamp in milliseconds.
+	CreatedTS   int64
+	Deactivated bool
+	// Locked accounts can't log in or use their access tokens.
+	Locked bool
+	// The events of shadow-banned accounts are accepted but never sent to
+	// other users.
+	ShadowBanned bool
 	// TODO: Associations (e.g. with application services)
 }
 
+// AdminAccount is an account along with its profile, as listed to server admins.
+type AdminAccount struct {
+	Account
+	DisplayName string
+	AvatarURL   string
+}
+
 // ErrorForbidden is an error indicating that the supplied access token is forbidden
 type ErrorForbidden struct {
 	Message string
@@ -521,6 +604,17 @@ const (
 	HTTPKind  PusherKind = "http"
 )
 
+// EmailDigest is a notification email which is waiting to be sent to a user.
+type EmailDigest struct {
+	Localpart  string
+	ServerName spec.ServerName
+	// Since is the timestamp of the first notification in the digest.
+	Since     spec.Timestamp
+	Addresses []string
+	// RoomNames maps room IDs to the names used for them in the email.
+	RoomNames map[string]string
+}
+
 type QueryNotificationsRequest struct {
 	Localpart  string          `json:"localpart"`   // Required.
 	ServerName spec.ServerName `json:"server_name"` // Required.
@@ -560,6 +654,28 @@ type QueryAccountAvailabilityResponse struct {
 	Available bool
 }
 
+// QueryExternalIDRequest is the request for QueryExternalID
+type QueryExternalIDRequest struct {
+	AuthProvider string // Required: the ID of the identity provider
+	ExternalID   string // Required: the ID of the user at the identity provider
+}
+
+// QueryExternalIDResponse is the response for QueryExternalID
+type QueryExternalIDResponse struct {
+	// The account that the external user logs in as, or empty if they
+	// haven't logged in before.
+	Localpart  string
+	ServerName spec.ServerName
+}
+
+// PerformExternalIDLinkRequest is the request for PerformExternalIDLink
+type PerformExternalIDLinkRequest struct {
+	AuthProvider string          // Required: the ID of the identity provider
+	ExternalID   string          // Required: the ID of the user at the identity provider
+	Localpart    string          // Required: the account to log in as
+	ServerName   spec.ServerName // Required: the server name of the account
+}
+
 type QueryAccountByPasswordRequest struct {
 	Localpart         string
 	ServerName        spec.ServerName
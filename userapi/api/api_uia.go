@@ -0,0 +1,79 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// DefaultUIASessionLifetime is how long a user-interactive auth session is
+// kept for after it was started or a stage was last completed.
+const DefaultUIASessionLifetime = 5 * time.Minute
+
+type UIASessionAPI interface {
+	// PerformUIASessionCreation stores a new user-interactive auth session.
+	PerformUIASessionCreation(ctx context.Context, session *UIASession) error
+
+	// PerformUIASessionStageCompletion records that a stage of the session has been
+	// completed, and extends the lifetime of the session.
+	PerformUIASessionStageCompletion(ctx context.Context, sessionID, stage string) error
+
+	// PerformUIASessionDataUpdate replaces the data of the session, and extends
+	// the lifetime of the session.
+	PerformUIASessionDataUpdate(ctx context.Context, sessionID string, data json.RawMessage) error
+
+	// PerformUIASessionDeletion removes the session once its flow has been
+	// completed. Only one request can remove a session: sql.ErrNoRows is
+	// returned if the session doesn't exist, has expired or was already removed.
+	PerformUIASessionDeletion(ctx context.Context, sessionID string) error
+
+	// QueryUIASession returns the session with the given ID. If the session
+	// doesn't exist or has expired, success is returned with a nil session.
+	QueryUIASession(ctx context.Context, sessionID string) (*UIASession, error)
+}
+
+// UIASession is a user-interactive auth session. Sessions are stored by the
+// user API so that they survive restarts and can be shared between instances.
+type UIASession struct {
+	SessionID string
+	// RequestHash identifies the request that started the session, so that
+	// the session can't be used to complete a different request.
+	RequestHash string
+	// Data is kept for the endpoint that started the session, e.g. the
+	// parameters of a registration, so that it can be picked up by later
+	// requests in the session.
+	Data json.RawMessage
+	// Completed are the stages that have been completed, in order.
+	Completed  []UIACompletedStage
+	CreatedAt  time.Time
+	Expiration time.Time
+}
+
+// UIACompletedStage is a stage that has been completed in a session.
+type UIACompletedStage struct {
+	Stage       string
+	CompletedAt time.Time
+}
+
+// CompletedStages returns the names of the completed stages of the session.
+func (s *UIASession) CompletedStages() []string {
+	stages := make([]string, 0, len(s.Completed))
+	for _, c := range s.Completed {
+		stages = append(stages, c.Stage)
+	}
+	return stages
+}
@@ -35,18 +35,19 @@ import (
 )
 
 type OutputRoomEventConsumer struct {
-	ctx          context.Context
-	cfg          *config.UserAPI
-	rsAPI        rsapi.UserRoomserverAPI
-	jetstream    nats.JetStreamContext
-	durable      string
-	db           storage.UserDatabase
-	topic        string
-	pgClient     pushgateway.Client
-	syncProducer *producers.SyncAPI
-	lastUpdate   time.Time
-	countsLock   sync.Mutex
-	serverName   spec.ServerName
+	ctx           context.Context
+	cfg           *config.UserAPI
+	rsAPI         rsapi.UserRoomserverAPI
+	jetstream     nats.JetStreamContext
+	durable       string
+	db            storage.UserDatabase
+	topic         string
+	pgClient      pushgateway.Client
+	emailNotifier *util.EmailNotifier
+	syncProducer  *producers.SyncAPI
+	lastUpdate    time.Time
+	countsLock    sync.Mutex
+	serverName    spec.ServerName
 }
 
 func NewOutputRoomEventConsumer(
@@ -55,22 +56,24 @@ func NewOutputRoomEventConsumer(
 	js nats.JetStreamContext,
 	store storage.UserDatabase,
 	pgClient pushgateway.Client,
+	emailNotifier *util.EmailNotifier,
 	rsAPI rsapi.UserRoomserverAPI,
 	syncProducer *producers.SyncAPI,
 ) *OutputRoomEventConsumer {
 	return &OutputRoomEventConsumer{
-		ctx:          process.Context(),
-		cfg:          cfg,
-		jetstream:    js,
-		db:           store,
-		durable:      cfg.Matrix.JetStream.Durable("UserAPIRoomServerConsumer"),
-		topic:        cfg.Matrix.JetStream.Prefixed(jetstream.OutputRoomEvent),
-		pgClient:     pgClient,
-		rsAPI:        rsAPI,
-		syncProducer: syncProducer,
-		lastUpdate:   time.Now(),
-		countsLock:   sync.Mutex{},
-		serverName:   cfg.Matrix.ServerName,
+		ctx:           process.Context(),
+		cfg:           cfg,
+		jetstream:     js,
+		db:            store,
+		durable:       cfg.Matrix.JetStream.Durable("UserAPIRoomServerConsumer"),
+		topic:         cfg.Matrix.JetStream.Prefixed(jetstream.OutputRoomEvent),
+		pgClient:      pgClient,
+		emailNotifier: emailNotifier,
+		rsAPI:         rsAPI,
+		syncProducer:  syncProducer,
+		lastUpdate:    time.Now(),
+		countsLock:    sync.Mutex{},
+		serverName:    cfg.Matrix.ServerName,
 	}
 }
 
@@ -502,7 +505,7 @@ func (s *OutputRoomEventConsumer) notifyLocal(ctx context.Context, event *rstype
 		RoomID:     event.RoomID().String(),
 		TS:         spec.AsTimestamp(time.Now()),
 	}
-	if err = s.db.InsertNotification(ctx, mem.Localpart, mem.Domain, event.EventID(), streamPos, tweaks, n); err != nil {
+	if err = s.db.InsertNotification(ctx, mem.Localpart, mem.Domain, event.EventID(), eventutil.ThreadID(event.Content()), streamPos, tweaks, n); err != nil {
 		return fmt.Errorf("s.db.InsertNotification: %w", err)
 	}
 
@@ -524,6 +527,22 @@ func (s *OutputRoomEventConsumer) notifyLocal(ctx context.Context, event *rstype
 		"num_unread": userNumUnreadNotifs,
 	}).Trace("Notifying single member")
 
+	// Email pushers don't get notified straight away. Instead the
+	// notification is added to a digest which is sent later on, if
+	// the user hasn't read it by then. Email addresses aren't verified,
+	// so they're only used if the server admin allows email pushers.
+	if emailDevices := devicesByURLAndFormat[util.EmailPusherURL]; len(emailDevices) > 0 && s.emailNotifier != nil && s.cfg.Email.AllowEmailPushers {
+		var addresses []string
+		for _, devices := range emailDevices {
+			for _, dev := range devices {
+				addresses = append(addresses, dev.PushKey)
+			}
+		}
+		if err = s.emailNotifier.Schedule(ctx, mem.Localpart, mem.Domain, addresses, n, roomName); err != nil {
+			log.WithField("localpart", mem.Localpart).WithError(err).Error("Unable to schedule notification email")
+		}
+	}
+
 	// Push gateways are out of our control, and we cannot risk
 	// looking up the server on a misbehaving push gateway. Each user
 	// receives a goroutine now that all internal API calls have been
@@ -539,7 +558,7 @@ func (s *OutputRoomEventConsumer) notifyLocal(ctx context.Context, event *rstype
 		var rejected []*pushgateway.Device
 		for url, fmts := range devicesByURLAndFormat {
 			for format, devices := range fmts {
-				// TODO: support "email".
+				// Email pushers are handled by the email notifier above.
 				if !strings.HasPrefix(url, "http") {
 					continue
 				}
@@ -672,6 +691,21 @@ func (rse *ruleSetEvalContext) HasPowerLevel(senderID spec.SenderID, levelKey st
 	return true, nil
 }
 
+func (rse *ruleSetEvalContext) RelatedEvent(eventID string) (gomatrixserverlib.PDU, error) {
+	req := &rsapi.QueryEventsByIDRequest{
+		RoomID:   rse.roomID,
+		EventIDs: []string{eventID},
+	}
+	var res rsapi.QueryEventsByIDResponse
+	if err := rse.rsAPI.QueryEventsByID(rse.ctx, req, &res); err != nil {
+		return nil, err
+	}
+	if len(res.Events) == 0 {
+		return nil, nil
+	}
+	return res.Events[0].PDU, nil
+}
+
 // localPushDevices pushes to the configured devices of a local
 // user. The map keys are [url][format].
 func (s *OutputRoomEventConsumer) localPushDevices(ctx context.Context, localpart string, serverName spec.ServerName, tweaks map[string]interface{}) (map[string]map[string][]*pushgateway.Device, string, error) {
@@ -0,0 +1,55 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"github.com/neilalexander/harmony/userapi/api"
+)
+
+// PerformUIASessionCreation stores a new user-interactive auth session.
+func (a *UserInternalAPI) PerformUIASessionCreation(ctx context.Context, session *api.UIASession) error {
+	return a.DB.CreateUIASession(ctx, session)
+}
+
+// PerformUIASessionStageCompletion records that a stage of the session has been completed.
+func (a *UserInternalAPI) PerformUIASessionStageCompletion(ctx context.Context, sessionID, stage string) error {
+	return a.DB.AddUIASessionStage(ctx, sessionID, stage)
+}
+
+// PerformUIASessionDataUpdate replaces the data of the session.
+func (a *UserInternalAPI) PerformUIASessionDataUpdate(ctx context.Context, sessionID string, data json.RawMessage) error {
+	return a.DB.SetUIASessionData(ctx, sessionID, data)
+}
+
+// PerformUIASessionDeletion removes the session, returning sql.ErrNoRows if
+// it was already removed.
+func (a *UserInternalAPI) PerformUIASessionDeletion(ctx context.Context, sessionID string) error {
+	return a.DB.RemoveUIASession(ctx, sessionID)
+}
+
+// QueryUIASession returns the session with the given ID. If the session
+// doesn't exist or has expired, success is returned with a nil session.
+func (a *UserInternalAPI) QueryUIASession(ctx context.Context, sessionID string) (*api.UIASession, error) {
+	session, err := a.DB.GetUIASession(ctx, sessionID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return session, err
+}
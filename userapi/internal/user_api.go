@@ -309,6 +309,12 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 	}
 	res.DeviceCreated = true
 	res.Device = dev
+	if req.RefreshToken {
+		expiresTS := time.Now().UnixMilli() + a.Config.AccessTokenLifetimeMS
+		if res.RefreshToken, err = a.DB.CreateRefreshToken(ctx, dev, expiresTS); err != nil {
+			return fmt.Errorf("a.DB.CreateRefreshToken: %w", err)
+		}
+	}
 	if req.NoDeviceListUpdate || isExisting {
 		return nil
 	}
@@ -316,6 +322,22 @@ func (a *UserInternalAPI) PerformDeviceCreation(ctx context.Context, req *api.Pe
 	return a.deviceListUpdate(dev.UserID, []string{dev.ID}, req.FromRegistration)
 }
 
+// PerformTokenRefresh exchanges a refresh token for a new access token and
+// refresh token. Each refresh token can only be used once.
+func (a *UserInternalAPI) PerformTokenRefresh(ctx context.Context, req *api.PerformTokenRefreshRequest, res *api.PerformTokenRefreshResponse) error {
+	expiresTS := time.Now().UnixMilli() + a.Config.AccessTokenLifetimeMS
+	dev, refreshToken, err := a.DB.RefreshAccessToken(ctx, req.RefreshToken, req.AccessToken, expiresTS)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+	res.Device = dev
+	res.RefreshToken = refreshToken
+	return nil
+}
+
 func (a *UserInternalAPI) PerformDeviceDeletion(ctx context.Context, req *api.PerformDeviceDeletionRequest, res *api.PerformDeviceDeletionResponse) error {
 	util.GetLogger(ctx).WithField("user_id", req.UserID).WithField("devices", req.DeviceIDs).Info("PerformDeviceDeletion")
 	local, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
@@ -566,6 +588,10 @@ func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAc
 		}
 		return err
 	}
+	if device.AccessTokenExpiresTS > 0 && device.AccessTokenExpiresTS <= time.Now().UnixMilli() {
+		res.Expired = true
+		return nil
+	}
 	localPart, domain, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
 		return err
@@ -578,7 +604,9 @@ func (a *UserInternalAPI) QueryAccessToken(ctx context.Context, req *api.QueryAc
 		return err
 	}
 	device.AccountType = acc.AccountType
+	device.ShadowBanned = acc.ShadowBanned
 	res.Device = device
+	res.Locked = acc.Locked
 	return nil
 }
 
@@ -618,11 +646,55 @@ func (a *UserInternalAPI) PerformAccountDeactivation(ctx context.Context, req *a
 		return err
 	}
 
+	if req.Erase {
+		if _, _, err = a.DB.SetDisplayName(ctx, req.Localpart, serverName, ""); err != nil {
+			return err
+		}
+		if _, _, err = a.DB.SetAvatarURL(ctx, req.Localpart, serverName, ""); err != nil {
+			return err
+		}
+	}
+
 	err = a.DB.DeactivateAccount(ctx, req.Localpart, serverName)
 	res.AccountDeactivated = err == nil
 	return err
 }
 
+// QueryAdminAccounts returns a page of the accounts on this server, optionally
+// filtered by a search term.
+func (a *UserInternalAPI) QueryAdminAccounts(ctx context.Context, req *api.QueryAdminAccountsRequest, res *api.QueryAdminAccountsResponse) (err error) {
+	res.Accounts, res.Total, err = a.DB.GetAccounts(ctx, req.Search, req.IncludeDeactivated, req.From, req.Limit)
+	return
+}
+
+// PerformAdminUpdateAccount changes whether the account is an admin account,
+// is locked or is shadow-banned.
+func (a *UserInternalAPI) PerformAdminUpdateAccount(ctx context.Context, req *api.PerformAdminUpdateAccountRequest, res *struct{}) error {
+	if !a.Config.Matrix.IsLocalServerName(req.ServerName) {
+		return fmt.Errorf("server name %q not locally configured", req.ServerName)
+	}
+	if req.Admin != nil {
+		accountType := api.AccountTypeUser
+		if *req.Admin {
+			accountType = api.AccountTypeAdmin
+		}
+		if err := a.DB.SetAccountType(ctx, req.Localpart, req.ServerName, accountType); err != nil {
+			return fmt.Errorf("a.DB.SetAccountType: %w", err)
+		}
+	}
+	if req.Locked != nil {
+		if err := a.DB.SetAccountLocked(ctx, req.Localpart, req.ServerName, *req.Locked); err != nil {
+			return fmt.Errorf("a.DB.SetAccountLocked: %w", err)
+		}
+	}
+	if req.ShadowBanned != nil {
+		if err := a.DB.SetAccountShadowBanned(ctx, req.Localpart, req.ServerName, *req.ShadowBanned); err != nil {
+			return fmt.Errorf("a.DB.SetAccountShadowBanned: %w", err)
+		}
+	}
+	return nil
+}
+
 func (a *UserInternalAPI) DeleteKeyBackup(ctx context.Context, userID, version string) (bool, error) {
 	return a.DB.DeleteKeyBackup(ctx, userID, version)
 }
@@ -839,6 +911,23 @@ func (a *UserInternalAPI) QueryAccountAvailability(ctx context.Context, req *api
 	return err
 }
 
+func (a *UserInternalAPI) QueryExternalID(ctx context.Context, req *api.QueryExternalIDRequest, res *api.QueryExternalIDResponse) error {
+	localpart, serverName, err := a.DB.GetLocalpartForExternalID(ctx, req.AuthProvider, req.ExternalID)
+	switch err {
+	case nil:
+		res.Localpart, res.ServerName = localpart, serverName
+		return nil
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return err
+	}
+}
+
+func (a *UserInternalAPI) PerformExternalIDLink(ctx context.Context, req *api.PerformExternalIDLinkRequest, res *struct{}) error {
+	return a.DB.LinkExternalID(ctx, req.AuthProvider, req.ExternalID, req.Localpart, req.ServerName)
+}
+
 func (a *UserInternalAPI) QueryAccountByPassword(ctx context.Context, req *api.QueryAccountByPasswordRequest, res *api.QueryAccountByPasswordResponse) error {
 	acc, err := a.DB.GetAccountByPassword(ctx, req.Localpart, req.ServerName, req.PlaintextPassword)
 	switch err {
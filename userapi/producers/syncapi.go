@@ -66,16 +66,24 @@ func (p *SyncAPI) GetAndSendNotificationData(ctx context.Context, userID, roomID
 		return err
 	}
 
-	ntotal, nhighlight, err := p.db.GetRoomNotificationCounts(ctx, localpart, domain, roomID)
+	counts, err := p.db.GetRoomThreadNotificationCounts(ctx, localpart, domain, roomID)
 	if err != nil {
 		return err
 	}
 
-	return p.sendNotificationData(userID, &eventutil.NotificationData{
-		RoomID:                  roomID,
-		UnreadHighlightCount:    int(nhighlight),
-		UnreadNotificationCount: int(ntotal),
-	})
+	data := &eventutil.NotificationData{
+		RoomID:  roomID,
+		Threads: make(map[string]eventutil.ThreadNotificationData, len(counts)),
+	}
+	for threadID, count := range counts {
+		data.UnreadHighlightCount += int(count.Highlight)
+		data.UnreadNotificationCount += int(count.Total)
+		data.Threads[threadID] = eventutil.ThreadNotificationData{
+			UnreadHighlightCount:    int(count.Highlight),
+			UnreadNotificationCount: int(count.Total),
+		}
+	}
+	return p.sendNotificationData(userID, data)
 }
 
 // sendNotificationData sends data about unread notifications to the Sync API server.
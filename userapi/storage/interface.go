@@ -58,6 +58,18 @@ type Account interface {
 	GetAccountByLocalpart(ctx context.Context, localpart string, serverName spec.ServerName) (*api.Account, error)
 	DeactivateAccount(ctx context.Context, localpart string, serverName spec.ServerName) (err error)
 	SetPassword(ctx context.Context, localpart string, serverName spec.ServerName, plaintextPassword string) error
+	// GetAccounts returns a page of accounts, and the total number of accounts
+	// whose localpart or display name contains the search term.
+	GetAccounts(ctx context.Context, search string, includeDeactivated bool, from, limit int64) ([]api.AdminAccount, int64, error)
+	SetAccountType(ctx context.Context, localpart string, serverName spec.ServerName, accountType api.AccountType) error
+	SetAccountLocked(ctx context.Context, localpart string, serverName spec.ServerName, locked bool) error
+	SetAccountShadowBanned(ctx context.Context, localpart string, serverName spec.ServerName, shadowBanned bool) error
+	// GetLocalpartForExternalID returns the account that the user of an external
+	// identity provider logs in as. Returns sql.ErrNoRows if there isn't one.
+	GetLocalpartForExternalID(ctx context.Context, authProvider, externalID string) (string, spec.ServerName, error)
+	// LinkExternalID makes the user of an external identity provider log in as
+	// the given account from now on.
+	LinkExternalID(ctx context.Context, authProvider, externalID, localpart string, serverName spec.ServerName) error
 }
 
 type AccountData interface {
@@ -88,6 +100,13 @@ type Device interface {
 	RemoveDevices(ctx context.Context, localpart string, serverName spec.ServerName, devices []string) error
 	// RemoveAllDevices deleted all devices for this user. Returns the devices deleted.
 	RemoveAllDevices(ctx context.Context, localpart string, serverName spec.ServerName, exceptDeviceID string) (devices []api.Device, err error)
+	// CreateRefreshToken makes the access token of the device expire at the given
+	// time, and returns a refresh token which can be exchanged for a new one.
+	CreateRefreshToken(ctx context.Context, dev *api.Device, accessTokenExpiresTS int64) (string, error)
+	// RefreshAccessToken replaces the refresh token, and the access token of the
+	// device that it was issued to. Refresh tokens can only be used once.
+	// Returns sql.ErrNoRows if the refresh token is unknown.
+	RefreshAccessToken(ctx context.Context, refreshToken, accessToken string, accessTokenExpiresTS int64) (*api.Device, string, error)
 }
 
 type KeyBackup interface {
@@ -113,6 +132,28 @@ type LoginToken interface {
 	GetLoginTokenDataByToken(ctx context.Context, token string) (*api.LoginTokenData, error)
 }
 
+type UIASession interface {
+	// CreateUIASession stores a new user-interactive auth session. The creation
+	// and expiration times of the session are set by the database.
+	CreateUIASession(ctx context.Context, session *api.UIASession) error
+
+	// AddUIASessionStage records a completed stage of the session and extends its
+	// lifetime. Returns sql.ErrNoRows if the session doesn't exist or has expired.
+	AddUIASessionStage(ctx context.Context, sessionID, stage string) error
+
+	// SetUIASessionData replaces the data of the session and extends its lifetime.
+	// Returns sql.ErrNoRows if the session doesn't exist or has expired.
+	SetUIASessionData(ctx context.Context, sessionID string, data json.RawMessage) error
+
+	// RemoveUIASession removes the session. Returns sql.ErrNoRows if the session
+	// doesn't exist or has expired.
+	RemoveUIASession(ctx context.Context, sessionID string) error
+
+	// GetUIASession returns the session with its completed stages.
+	// May return sql.ErrNoRows.
+	GetUIASession(ctx context.Context, sessionID string) (*api.UIASession, error)
+}
+
 type Pusher interface {
 	UpsertPusher(ctx context.Context, p api.Pusher, localpart string, serverName spec.ServerName) error
 	GetPushers(ctx context.Context, localpart string, serverName spec.ServerName) ([]api.Pusher, error)
@@ -121,25 +162,38 @@ type Pusher interface {
 }
 
 type Notification interface {
-	InsertNotification(ctx context.Context, localpart string, serverName spec.ServerName, eventID string, pos uint64, tweaks map[string]interface{}, n *api.Notification) error
+	InsertNotification(ctx context.Context, localpart string, serverName spec.ServerName, eventID, threadID string, pos uint64, tweaks map[string]interface{}, n *api.Notification) error
 	DeleteNotificationsUpTo(ctx context.Context, localpart string, serverName spec.ServerName, roomID string, pos uint64) (affected bool, err error)
-	SetNotificationsRead(ctx context.Context, localpart string, serverName spec.ServerName, roomID string, pos uint64, read bool) (affected bool, err error)
+	SetNotificationsRead(ctx context.Context, localpart string, serverName spec.ServerName, roomID, threadID string, pos uint64, read bool) (affected bool, err error)
 	GetNotifications(ctx context.Context, localpart string, serverName spec.ServerName, fromID int64, limit int, filter tables.NotificationFilter) ([]*api.Notification, int64, error)
 	GetNotificationCount(ctx context.Context, localpart string, serverName spec.ServerName, filter tables.NotificationFilter) (int64, error)
 	GetRoomNotificationCounts(ctx context.Context, localpart string, serverName spec.ServerName, roomID string) (total int64, highlight int64, _ error)
+	GetRoomThreadNotificationCounts(ctx context.Context, localpart string, serverName spec.ServerName, roomID string) (map[string]tables.NotificationCounts, error)
 	DeleteOldNotifications(ctx context.Context) error
 }
 
+type EmailDigest interface {
+	// StoreEmailDigest stores the pending notification email of a user,
+	// replacing any that is already stored.
+	StoreEmailDigest(ctx context.Context, digest *api.EmailDigest) error
+	// RemoveEmailDigest removes the pending notification email of a user.
+	RemoveEmailDigest(ctx context.Context, localpart string, serverName spec.ServerName) error
+	// GetEmailDigests returns the pending notification emails of all users.
+	GetEmailDigests(ctx context.Context) ([]*api.EmailDigest, error)
+}
+
 type UserDatabase interface {
 	Account
 	AccountData
 	Device
+	EmailDigest
 	KeyBackup
 	LoginToken
 	Notification
 	Profile
 	Pusher
 	RegistrationTokens
+	UIASession
 }
 
 type KeyChangeDatabase interface {
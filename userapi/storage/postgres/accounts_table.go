@@ -18,9 +18,11 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/neilalexander/harmony/clientapi/userutil"
+	"github.com/neilalexander/harmony/internal"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/userapi/api"
@@ -45,7 +47,11 @@ CREATE TABLE IF NOT EXISTS userapi_accounts (
     -- If the account is currently active
     is_deactivated BOOLEAN DEFAULT FALSE,
 	-- The account_type (user = 1, guest = 2, admin = 3, appservice = 4)
-	account_type SMALLINT NOT NULL
+	account_type SMALLINT NOT NULL,
+    -- If the account has been locked by a server admin
+    is_locked BOOLEAN NOT NULL DEFAULT FALSE,
+    -- If the events of the account are silently dropped
+    is_shadow_banned BOOLEAN NOT NULL DEFAULT FALSE
     -- TODO:
     -- upgraded_ts, devices, any email reset stuff?
 );
@@ -63,7 +69,33 @@ const deactivateAccountSQL = "" +
 	"UPDATE userapi_accounts SET is_deactivated = TRUE WHERE localpart = $1 AND server_name = $2"
 
 const selectAccountByLocalpartSQL = "" +
-	"SELECT localpart, server_name, appservice_id, account_type FROM userapi_accounts WHERE localpart = $1 AND server_name = $2"
+	"SELECT " + accountColumnsSQL + " FROM userapi_accounts WHERE localpart = $1 AND server_name = $2"
+
+const accountColumnsSQL = "" +
+	"userapi_accounts.localpart, userapi_accounts.server_name, created_ts, appservice_id, account_type, COALESCE(is_deactivated, FALSE), is_locked, is_shadow_banned"
+
+// The search term matches the localpart or the display name of the account.
+const accountsFilterSQL = "" +
+	" FROM userapi_accounts LEFT JOIN userapi_profiles" +
+	" ON userapi_accounts.localpart = userapi_profiles.localpart AND userapi_accounts.server_name = userapi_profiles.server_name" +
+	" WHERE ($1 = '' OR userapi_accounts.localpart ILIKE $1 OR userapi_profiles.display_name ILIKE $1)" +
+	" AND ($2 OR is_deactivated = FALSE)"
+
+const selectAccountsSQL = "" +
+	"SELECT " + accountColumnsSQL + ", COALESCE(display_name, ''), COALESCE(avatar_url, '')" + accountsFilterSQL +
+	" ORDER BY userapi_accounts.server_name, userapi_accounts.localpart OFFSET $3 LIMIT $4"
+
+const selectAccountCountSQL = "" +
+	"SELECT COUNT(*)" + accountsFilterSQL
+
+const updateAccountTypeSQL = "" +
+	"UPDATE userapi_accounts SET account_type = $3 WHERE localpart = $1 AND server_name = $2"
+
+const updateAccountLockedSQL = "" +
+	"UPDATE userapi_accounts SET is_locked = $3 WHERE localpart = $1 AND server_name = $2"
+
+const updateAccountShadowBannedSQL = "" +
+	"UPDATE userapi_accounts SET is_shadow_banned = $3 WHERE localpart = $1 AND server_name = $2"
 
 const selectPasswordHashSQL = "" +
 	"SELECT password_hash FROM userapi_accounts WHERE localpart = $1 AND server_name = $2 AND is_deactivated = FALSE"
@@ -78,6 +110,11 @@ type accountsStatements struct {
 	selectAccountByLocalpartStmt  *sql.Stmt
 	selectPasswordHashStmt        *sql.Stmt
 	selectNewNumericLocalpartStmt *sql.Stmt
+	selectAccountsStmt            *sql.Stmt
+	selectAccountCountStmt        *sql.Stmt
+	updateAccountTypeStmt         *sql.Stmt
+	updateAccountLockedStmt       *sql.Stmt
+	updateAccountShadowBannedStmt *sql.Stmt
 	serverName                    spec.ServerName
 }
 
@@ -101,6 +138,11 @@ func NewPostgresAccountsTable(db *sql.DB, serverName spec.ServerName) (tables.Ac
 			Up:      deltas.UpAddAccountType,
 			Down:    deltas.DownAddAccountType,
 		},
+		{
+			Version: "userapi: add account lock and shadow-ban",
+			Up:      deltas.UpAccountModeration,
+			Down:    deltas.DownAccountModeration,
+		},
 	}...)
 	err = m.Up(context.Background())
 	if err != nil {
@@ -113,6 +155,11 @@ func NewPostgresAccountsTable(db *sql.DB, serverName spec.ServerName) (tables.Ac
 		{&s.selectAccountByLocalpartStmt, selectAccountByLocalpartSQL},
 		{&s.selectPasswordHashStmt, selectPasswordHashSQL},
 		{&s.selectNewNumericLocalpartStmt, selectNewNumericLocalpartSQL},
+		{&s.selectAccountsStmt, selectAccountsSQL},
+		{&s.selectAccountCountStmt, selectAccountCountSQL},
+		{&s.updateAccountTypeStmt, updateAccountTypeSQL},
+		{&s.updateAccountLockedStmt, updateAccountLockedSQL},
+		{&s.updateAccountShadowBannedStmt, updateAccountShadowBannedSQL},
 	}.Prepare(db)
 }
 
@@ -143,6 +190,7 @@ func (s *accountsStatements) InsertAccount(
 		ServerName:   serverName,
 		AppServiceID: appserviceID,
 		AccountType:  accountType,
+		CreatedTS:    createdTimeMS,
 	}, nil
 }
 
@@ -171,25 +219,94 @@ func (s *accountsStatements) SelectPasswordHash(
 func (s *accountsStatements) SelectAccountByLocalpart(
 	ctx context.Context, localpart string, serverName spec.ServerName,
 ) (*api.Account, error) {
-	var appserviceIDPtr sql.NullString
-	var acc api.Account
-
 	stmt := s.selectAccountByLocalpartStmt
-	err := stmt.QueryRowContext(ctx, localpart, serverName).Scan(&acc.Localpart, &acc.ServerName, &appserviceIDPtr, &acc.AccountType)
+	acc, err := scanAccount(stmt.QueryRowContext(ctx, localpart, serverName))
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.WithError(err).Error("Unable to retrieve user from the db")
 		}
 		return nil, err
 	}
-	if appserviceIDPtr.Valid {
-		acc.AppServiceID = appserviceIDPtr.String
+	return acc, nil
+}
+
+func (s *accountsStatements) SelectAccounts(
+	ctx context.Context, search string, includeDeactivated bool, from, limit int64,
+) ([]api.AdminAccount, error) {
+	rows, err := s.selectAccountsStmt.QueryContext(ctx, searchPattern(search), includeDeactivated, from, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAccountsStmt: rows.close() failed")
+
+	var accounts []api.AdminAccount
+	for rows.Next() {
+		var acc api.AdminAccount
+		var appserviceID sql.NullString
+		if err = rows.Scan(
+			&acc.Localpart, &acc.ServerName, &acc.CreatedTS, &appserviceID, &acc.AccountType,
+			&acc.Deactivated, &acc.Locked, &acc.ShadowBanned, &acc.DisplayName, &acc.AvatarURL,
+		); err != nil {
+			return nil, err
+		}
+		acc.AppServiceID = appserviceID.String
+		acc.UserID = userutil.MakeUserID(acc.Localpart, acc.ServerName)
+		accounts = append(accounts, acc)
 	}
+	return accounts, rows.Err()
+}
+
+func (s *accountsStatements) SelectAccountCount(
+	ctx context.Context, search string, includeDeactivated bool,
+) (count int64, err error) {
+	err = s.selectAccountCountStmt.QueryRowContext(ctx, searchPattern(search), includeDeactivated).Scan(&count)
+	return
+}
+
+func (s *accountsStatements) UpdateAccountType(
+	ctx context.Context, localpart string, serverName spec.ServerName, accountType api.AccountType,
+) (err error) {
+	_, err = s.updateAccountTypeStmt.ExecContext(ctx, localpart, serverName, accountType)
+	return
+}
+
+func (s *accountsStatements) UpdateAccountLocked(
+	ctx context.Context, localpart string, serverName spec.ServerName, locked bool,
+) (err error) {
+	_, err = s.updateAccountLockedStmt.ExecContext(ctx, localpart, serverName, locked)
+	return
+}
 
+func (s *accountsStatements) UpdateAccountShadowBanned(
+	ctx context.Context, localpart string, serverName spec.ServerName, shadowBanned bool,
+) (err error) {
+	_, err = s.updateAccountShadowBannedStmt.ExecContext(ctx, localpart, serverName, shadowBanned)
+	return
+}
+
+func scanAccount(row *sql.Row) (*api.Account, error) {
+	var acc api.Account
+	var appserviceID sql.NullString
+	if err := row.Scan(
+		&acc.Localpart, &acc.ServerName, &acc.CreatedTS, &appserviceID, &acc.AccountType,
+		&acc.Deactivated, &acc.Locked, &acc.ShadowBanned,
+	); err != nil {
+		return nil, err
+	}
+	acc.AppServiceID = appserviceID.String
 	acc.UserID = userutil.MakeUserID(acc.Localpart, acc.ServerName)
 	return &acc, nil
 }
 
+// searchPattern turns the search term into an ILIKE pattern which matches
+// values containing the term.
+func searchPattern(search string) string {
+	if search == "" {
+		return ""
+	}
+	return "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(search) + "%"
+}
+
 func (s *accountsStatements) SelectNewNumericLocalpart(
 	ctx context.Context, txn *sql.Tx, serverName spec.ServerName,
 ) (id int64, err error) {
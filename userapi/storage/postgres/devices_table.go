@@ -61,7 +61,10 @@ CREATE TABLE IF NOT EXISTS userapi_devices (
 	-- The last seen IP address of this device
 	ip TEXT,
 	-- User agent of this device
-	user_agent TEXT
+	user_agent TEXT,
+	-- When the access token expires, as a unix timestamp (ms resolution). Access
+	-- tokens which were issued without a refresh token never expire and have 0.
+	access_token_expires_ts BIGINT NOT NULL DEFAULT 0
                                           
     -- TODO: device keys, device display names, token restrictions (if 3rd-party OAuth app)
 );
@@ -75,7 +78,7 @@ const insertDeviceSQL = "" +
 	" RETURNING session_id"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart, server_name FROM userapi_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart, server_name, access_token_expires_ts FROM userapi_devices WHERE access_token = $1"
 
 const selectDeviceByIDSQL = "" +
 	"SELECT display_name, last_seen_ts, ip FROM userapi_devices WHERE localpart = $1 AND server_name = $2 AND device_id = $3"
@@ -101,6 +104,9 @@ const selectDevicesByIDSQL = "" +
 const updateDeviceLastSeen = "" +
 	"UPDATE userapi_devices SET last_seen_ts = $1, ip = $2, user_agent = $3 WHERE localpart = $4 AND server_name = $5 AND device_id = $6"
 
+const updateAccessTokenSQL = "" +
+	"UPDATE userapi_devices SET access_token = $1, access_token_expires_ts = $2 WHERE session_id = $3"
+
 type devicesStatements struct {
 	insertDeviceStmt             *sql.Stmt
 	selectDeviceByTokenStmt      *sql.Stmt
@@ -109,6 +115,7 @@ type devicesStatements struct {
 	selectDevicesByIDStmt        *sql.Stmt
 	updateDeviceNameStmt         *sql.Stmt
 	updateDeviceLastSeenStmt     *sql.Stmt
+	updateAccessTokenStmt        *sql.Stmt
 	deleteDeviceStmt             *sql.Stmt
 	deleteDevicesByLocalpartStmt *sql.Stmt
 	deleteDevicesStmt            *sql.Stmt
@@ -127,6 +134,10 @@ func NewPostgresDevicesTable(db *sql.DB, serverName spec.ServerName) (tables.Dev
 	m.AddMigrations(sqlutil.Migration{
 		Version: "userapi: add last_seen_ts",
 		Up:      deltas.UpLastSeenTSIP,
+	}, sqlutil.Migration{
+		Version: "userapi: add access_token_expires_ts",
+		Up:      deltas.UpAccessTokenExpiry,
+		Down:    deltas.DownAccessTokenExpiry,
 	})
 	err = m.Up(context.Background())
 	if err != nil {
@@ -143,6 +154,7 @@ func NewPostgresDevicesTable(db *sql.DB, serverName spec.ServerName) (tables.Dev
 		{&s.deleteDevicesStmt, deleteDevicesSQL},
 		{&s.selectDevicesByIDStmt, selectDevicesByIDSQL},
 		{&s.updateDeviceLastSeenStmt, updateDeviceLastSeen},
+		{&s.updateAccessTokenStmt, updateAccessTokenSQL},
 	}.Prepare(db)
 }
 
@@ -234,7 +246,7 @@ func (s *devicesStatements) SelectDeviceByToken(
 	var localpart string
 	var serverName spec.ServerName
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &serverName)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &serverName, &dev.AccessTokenExpiresTS)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, serverName)
 		dev.AccessToken = accessToken
@@ -348,3 +360,23 @@ func (s *devicesStatements) UpdateDeviceLastSeen(ctx context.Context, txn *sql.T
 	_, err := stmt.ExecContext(ctx, lastSeenTs, ipAddr, userAgent, localpart, serverName, deviceID)
 	return err
 }
+
+// UpdateAccessToken replaces the access token of the device session, and sets
+// when the new access token expires. Returns sql.ErrNoRows if the session no
+// longer exists.
+func (s *devicesStatements) UpdateAccessToken(
+	ctx context.Context, txn *sql.Tx, sessionID int64,
+	accessToken string, expiresTS int64,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.updateAccessTokenStmt)
+	res, err := stmt.ExecContext(ctx, accessToken, expiresTS, sessionID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
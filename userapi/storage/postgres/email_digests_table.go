@@ -0,0 +1,117 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/userapi/api"
+	"github.com/neilalexander/harmony/userapi/storage/tables"
+)
+
+const emailDigestsSchema = `
+-- Stores the notification emails which are waiting to be sent, so that they
+-- are still sent after a restart.
+CREATE TABLE IF NOT EXISTS userapi_email_digests (
+	localpart TEXT NOT NULL,
+	server_name TEXT NOT NULL,
+	-- The timestamp of the first notification in the digest
+	since_ts BIGINT NOT NULL,
+	-- The JSON encoded addresses that the digest is sent to
+	addresses TEXT NOT NULL,
+	-- The JSON encoded names of the notified rooms
+	room_names TEXT NOT NULL,
+	PRIMARY KEY(localpart, server_name)
+);
+`
+
+const upsertEmailDigestSQL = "" +
+	"INSERT INTO userapi_email_digests(localpart, server_name, since_ts, addresses, room_names) VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT (localpart, server_name) DO UPDATE SET since_ts = $3, addresses = $4, room_names = $5"
+
+const deleteEmailDigestSQL = "" +
+	"DELETE FROM userapi_email_digests WHERE localpart = $1 AND server_name = $2"
+
+const selectEmailDigestsSQL = "" +
+	"SELECT localpart, server_name, since_ts, addresses, room_names FROM userapi_email_digests"
+
+type emailDigestsStatements struct {
+	upsertStmt *sql.Stmt
+	deleteStmt *sql.Stmt
+	selectStmt *sql.Stmt
+}
+
+func NewPostgresEmailDigestsTable(db *sql.DB) (tables.EmailDigestsTable, error) {
+	s := &emailDigestsStatements{}
+	_, err := db.Exec(emailDigestsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.upsertStmt, upsertEmailDigestSQL},
+		{&s.deleteStmt, deleteEmailDigestSQL},
+		{&s.selectStmt, selectEmailDigestsSQL},
+	}.Prepare(db)
+}
+
+func (s *emailDigestsStatements) UpsertEmailDigest(ctx context.Context, txn *sql.Tx, digest *api.EmailDigest) error {
+	addresses, err := json.Marshal(digest.Addresses)
+	if err != nil {
+		return err
+	}
+	roomNames, err := json.Marshal(digest.RoomNames)
+	if err != nil {
+		return err
+	}
+	stmt := sqlutil.TxStmt(txn, s.upsertStmt)
+	_, err = stmt.ExecContext(ctx, digest.Localpart, digest.ServerName, digest.Since, string(addresses), string(roomNames))
+	return err
+}
+
+func (s *emailDigestsStatements) DeleteEmailDigest(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteStmt)
+	_, err := stmt.ExecContext(ctx, localpart, serverName)
+	return err
+}
+
+func (s *emailDigestsStatements) SelectEmailDigests(ctx context.Context, txn *sql.Tx) ([]*api.EmailDigest, error) {
+	rows, err := sqlutil.TxStmt(txn, s.selectStmt).QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectEmailDigests: rows.close() failed")
+
+	var digests []*api.EmailDigest
+	for rows.Next() {
+		var addresses, roomNames string
+		digest := &api.EmailDigest{}
+		if err = rows.Scan(&digest.Localpart, &digest.ServerName, &digest.Since, &addresses, &roomNames); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(addresses), &digest.Addresses); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(roomNames), &digest.RoomNames); err != nil {
+			return nil, err
+		}
+		digests = append(digests, digest)
+	}
+	return digests, rows.Err()
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/userapi/storage/tables"
+)
+
+const externalIDsSchema = `
+-- Stores which local accounts the users of external identity providers, such
+-- as OpenID Connect providers, log in as.
+CREATE TABLE IF NOT EXISTS userapi_external_ids (
+	-- The ID of the identity provider in the config
+	auth_provider TEXT NOT NULL,
+	-- The ID of the user at the identity provider
+	external_id TEXT NOT NULL,
+	-- The local account of the user
+	localpart TEXT NOT NULL,
+	server_name TEXT NOT NULL,
+	PRIMARY KEY(auth_provider, external_id)
+);
+
+CREATE INDEX IF NOT EXISTS userapi_external_ids_localpart_idx ON userapi_external_ids(localpart, server_name);
+`
+
+const insertExternalIDSQL = "" +
+	"INSERT INTO userapi_external_ids(auth_provider, external_id, localpart, server_name) VALUES ($1, $2, $3, $4)"
+
+const selectExternalIDSQL = "" +
+	"SELECT localpart, server_name FROM userapi_external_ids WHERE auth_provider = $1 AND external_id = $2"
+
+type externalIDsStatements struct {
+	insertStmt *sql.Stmt
+	selectStmt *sql.Stmt
+}
+
+func NewPostgresExternalIDsTable(db *sql.DB) (tables.ExternalIDsTable, error) {
+	s := &externalIDsStatements{}
+	_, err := db.Exec(externalIDsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertStmt, insertExternalIDSQL},
+		{&s.selectStmt, selectExternalIDSQL},
+	}.Prepare(db)
+}
+
+func (s *externalIDsStatements) InsertExternalID(
+	ctx context.Context, txn *sql.Tx, authProvider, externalID string,
+	localpart string, serverName spec.ServerName,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertStmt)
+	_, err := stmt.ExecContext(ctx, authProvider, externalID, localpart, serverName)
+	return err
+}
+
+// SelectExternalID returns the local account that the external user logs in
+// as. Returns sql.ErrNoRows if the external user is unknown.
+func (s *externalIDsStatements) SelectExternalID(
+	ctx context.Context, txn *sql.Tx, authProvider, externalID string,
+) (localpart string, serverName spec.ServerName, err error) {
+	stmt := sqlutil.TxStmt(txn, s.selectStmt)
+	err = stmt.QueryRowContext(ctx, authProvider, externalID).Scan(&localpart, &serverName)
+	return
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/userapi/storage/tables"
+)
+
+const refreshTokensSchema = `
+-- Stores the refresh tokens which can be exchanged for a new access token.
+CREATE TABLE IF NOT EXISTS userapi_refresh_tokens (
+	-- The random value of the refresh token
+	token TEXT NOT NULL PRIMARY KEY,
+	-- The device session that the refresh token was issued to. Creating a
+	-- device with the same device ID starts a new session, which makes the
+	-- old refresh tokens unusable.
+	session_id BIGINT NOT NULL,
+	-- The device that the refresh token was issued to
+	localpart TEXT NOT NULL,
+	server_name TEXT NOT NULL,
+	device_id TEXT NOT NULL,
+	-- When the refresh token was issued, as a unix timestamp (ms resolution)
+	created_ts BIGINT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS userapi_refresh_tokens_device_idx ON userapi_refresh_tokens(localpart, server_name, device_id);
+`
+
+const insertRefreshTokenSQL = "" +
+	"INSERT INTO userapi_refresh_tokens(token, session_id, localpart, server_name, device_id, created_ts) VALUES ($1, $2, $3, $4, $5, $6)"
+
+const deleteRefreshTokenSQL = "" +
+	"DELETE FROM userapi_refresh_tokens WHERE token = $1 RETURNING session_id, localpart, server_name, device_id"
+
+const deleteRefreshTokensByDevicesSQL = "" +
+	"DELETE FROM userapi_refresh_tokens WHERE localpart = $1 AND server_name = $2 AND device_id = ANY($3)"
+
+const deleteRefreshTokensByLocalpartSQL = "" +
+	"DELETE FROM userapi_refresh_tokens WHERE localpart = $1 AND server_name = $2 AND device_id != $3"
+
+type refreshTokensStatements struct {
+	insertStmt            *sql.Stmt
+	deleteStmt            *sql.Stmt
+	deleteByDevicesStmt   *sql.Stmt
+	deleteByLocalpartStmt *sql.Stmt
+}
+
+func NewPostgresRefreshTokensTable(db *sql.DB) (tables.RefreshTokensTable, error) {
+	s := &refreshTokensStatements{}
+	_, err := db.Exec(refreshTokensSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertStmt, insertRefreshTokenSQL},
+		{&s.deleteStmt, deleteRefreshTokenSQL},
+		{&s.deleteByDevicesStmt, deleteRefreshTokensByDevicesSQL},
+		{&s.deleteByLocalpartStmt, deleteRefreshTokensByLocalpartSQL},
+	}.Prepare(db)
+}
+
+func (s *refreshTokensStatements) InsertRefreshToken(
+	ctx context.Context, txn *sql.Tx, token string, sessionID int64,
+	localpart string, serverName spec.ServerName, deviceID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.insertStmt)
+	_, err := stmt.ExecContext(ctx, token, sessionID, localpart, serverName, deviceID, time.Now().UnixMilli())
+	return err
+}
+
+// DeleteRefreshToken removes the refresh token, so that it can only ever be
+// used once. Returns sql.ErrNoRows if the token is unknown.
+func (s *refreshTokensStatements) DeleteRefreshToken(
+	ctx context.Context, txn *sql.Tx, token string,
+) (sessionID int64, localpart string, serverName spec.ServerName, deviceID string, err error) {
+	stmt := sqlutil.TxStmt(txn, s.deleteStmt)
+	err = stmt.QueryRowContext(ctx, token).Scan(&sessionID, &localpart, &serverName, &deviceID)
+	return
+}
+
+func (s *refreshTokensStatements) DeleteRefreshTokensByDevices(
+	ctx context.Context, txn *sql.Tx,
+	localpart string, serverName spec.ServerName, deviceIDs []string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteByDevicesStmt)
+	_, err := stmt.ExecContext(ctx, localpart, serverName, pq.Array(deviceIDs))
+	return err
+}
+
+func (s *refreshTokensStatements) DeleteRefreshTokensByLocalpart(
+	ctx context.Context, txn *sql.Tx,
+	localpart string, serverName spec.ServerName, exceptDeviceID string,
+) error {
+	stmt := sqlutil.TxStmt(txn, s.deleteByLocalpartStmt)
+	_, err := stmt.ExecContext(ctx, localpart, serverName, exceptDeviceID)
+	return err
+}
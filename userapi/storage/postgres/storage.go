@@ -81,6 +81,22 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresLoginTokenTable: %w", err)
 	}
+	uiaSessionsTable, err := NewPostgresUIASessionsTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresUIASessionsTable: %w", err)
+	}
+	refreshTokensTable, err := NewPostgresRefreshTokensTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresRefreshTokensTable: %w", err)
+	}
+	externalIDsTable, err := NewPostgresExternalIDsTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresExternalIDsTable: %w", err)
+	}
+	emailDigestsTable, err := NewPostgresEmailDigestsTable(db)
+	if err != nil {
+		return nil, fmt.Errorf("NewPostgresEmailDigestsTable: %w", err)
+	}
 	profilesTable, err := NewPostgresProfilesTable(db, serverNoticesLocalpart)
 	if err != nil {
 		return nil, fmt.Errorf("NewPostgresProfilesTable: %w", err)
@@ -112,6 +128,10 @@ func NewDatabase(ctx context.Context, conMan *sqlutil.Connections, dbProperties
 		KeyBackups:         keyBackupTable,
 		KeyBackupVersions:  keyBackupVersionTable,
 		LoginTokens:        loginTokenTable,
+		UIASessions:        uiaSessionsTable,
+		RefreshTokens:      refreshTokensTable,
+		ExternalIDs:        externalIDsTable,
+		EmailDigests:       emailDigestsTable,
 		Profiles:           profilesTable,
 		Pushers:            pusherTable,
 		Notifications:      notificationsTable,
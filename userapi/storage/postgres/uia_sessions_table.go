@@ -0,0 +1,193 @@
+// Copyright 2024 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/neilalexander/harmony/internal"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/userapi/api"
+	"github.com/neilalexander/harmony/userapi/storage/tables"
+)
+
+const uiaSessionsSchema = `
+CREATE TABLE IF NOT EXISTS userapi_uia_sessions (
+	-- The session ID given to the client
+	session_id TEXT NOT NULL PRIMARY KEY,
+	-- Identifies the request that started the session
+	request_hash TEXT NOT NULL,
+	-- Data kept for the endpoint that started the session, as JSON
+	data TEXT NOT NULL DEFAULT '',
+	-- When the session was started
+	created_at TIMESTAMP NOT NULL,
+	-- When the session expires, unless another stage is completed
+	expires_at TIMESTAMP NOT NULL
+);
+
+-- This index allows efficient garbage collection of expired sessions.
+CREATE INDEX IF NOT EXISTS userapi_uia_sessions_expiration_idx ON userapi_uia_sessions(expires_at);
+
+CREATE TABLE IF NOT EXISTS userapi_uia_session_stages (
+	-- The session that the stage was completed in
+	session_id TEXT NOT NULL REFERENCES userapi_uia_sessions(session_id) ON DELETE CASCADE,
+	-- The auth type of the stage, e.g. m.login.password
+	stage TEXT NOT NULL,
+	-- When the stage was completed
+	completed_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (session_id, stage)
+);
+`
+
+const insertUIASessionSQL = "" +
+	"INSERT INTO userapi_uia_sessions(session_id, request_hash, data, created_at, expires_at) VALUES ($1, $2, $3, $4, $5)"
+
+const selectUIASessionSQL = "" +
+	"SELECT request_hash, data, created_at, expires_at FROM userapi_uia_sessions WHERE session_id = $1 AND expires_at > $2"
+
+const selectUIASessionStagesSQL = "" +
+	"SELECT stage, completed_at FROM userapi_uia_session_stages WHERE session_id = $1 ORDER BY completed_at ASC"
+
+const insertUIASessionStageSQL = "" +
+	"INSERT INTO userapi_uia_session_stages(session_id, stage, completed_at) VALUES ($1, $2, $3)" +
+	" ON CONFLICT (session_id, stage) DO NOTHING"
+
+const updateUIASessionExpirationSQL = "" +
+	"UPDATE userapi_uia_sessions SET expires_at = $2 WHERE session_id = $1 AND expires_at > $3"
+
+const updateUIASessionDataSQL = "" +
+	"UPDATE userapi_uia_sessions SET data = $2, expires_at = $3 WHERE session_id = $1 AND expires_at > $4"
+
+const deleteUIASessionSQL = "" +
+	"DELETE FROM userapi_uia_sessions WHERE session_id = $1 AND expires_at > $2 RETURNING session_id"
+
+const deleteExpiredUIASessionsSQL = "" +
+	"DELETE FROM userapi_uia_sessions WHERE expires_at <= $1"
+
+type uiaSessionsStatements struct {
+	insertSessionStmt           *sql.Stmt
+	selectSessionStmt           *sql.Stmt
+	selectSessionStagesStmt     *sql.Stmt
+	insertSessionStageStmt      *sql.Stmt
+	updateSessionExpirationStmt *sql.Stmt
+	updateSessionDataStmt       *sql.Stmt
+	deleteSessionStmt           *sql.Stmt
+	deleteExpiredSessionsStmt   *sql.Stmt
+}
+
+func NewPostgresUIASessionsTable(db *sql.DB) (tables.UIASessionsTable, error) {
+	s := &uiaSessionsStatements{}
+	_, err := db.Exec(uiaSessionsSchema)
+	if err != nil {
+		return nil, err
+	}
+	return s, sqlutil.StatementList{
+		{&s.insertSessionStmt, insertUIASessionSQL},
+		{&s.selectSessionStmt, selectUIASessionSQL},
+		{&s.selectSessionStagesStmt, selectUIASessionStagesSQL},
+		{&s.insertSessionStageStmt, insertUIASessionStageSQL},
+		{&s.updateSessionExpirationStmt, updateUIASessionExpirationSQL},
+		{&s.updateSessionDataStmt, updateUIASessionDataSQL},
+		{&s.deleteSessionStmt, deleteUIASessionSQL},
+		{&s.deleteExpiredSessionsStmt, deleteExpiredUIASessionsSQL},
+	}.Prepare(db)
+}
+
+func (s *uiaSessionsStatements) InsertUIASession(ctx context.Context, txn *sql.Tx, session *api.UIASession) error {
+	stmt := sqlutil.TxStmt(txn, s.insertSessionStmt)
+	_, err := stmt.ExecContext(ctx, session.SessionID, session.RequestHash, string(session.Data), session.CreatedAt.UTC(), session.Expiration.UTC())
+	return err
+}
+
+// SelectUIASession returns the session along with its completed stages. Returns
+// sql.ErrNoRows if the session doesn't exist or has expired.
+func (s *uiaSessionsStatements) SelectUIASession(ctx context.Context, txn *sql.Tx, sessionID string) (*api.UIASession, error) {
+	session := &api.UIASession{SessionID: sessionID}
+	var data string
+	err := sqlutil.TxStmt(txn, s.selectSessionStmt).QueryRowContext(ctx, sessionID, time.Now().UTC()).Scan(
+		&session.RequestHash, &data, &session.CreatedAt, &session.Expiration,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if data != "" {
+		session.Data = json.RawMessage(data)
+	}
+	rows, err := sqlutil.TxStmt(txn, s.selectSessionStagesStmt).QueryContext(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "SelectUIASession: rows.close() failed")
+	for rows.Next() {
+		var stage api.UIACompletedStage
+		if err = rows.Scan(&stage.Stage, &stage.CompletedAt); err != nil {
+			return nil, err
+		}
+		session.Completed = append(session.Completed, stage)
+	}
+	return session, rows.Err()
+}
+
+// InsertUIASessionStage records a completed stage and extends the expiration of
+// the session. Returns sql.ErrNoRows if the session doesn't exist or has expired.
+func (s *uiaSessionsStatements) InsertUIASessionStage(ctx context.Context, txn *sql.Tx, sessionID, stage string, completedAt, expiration time.Time) error {
+	res, err := sqlutil.TxStmt(txn, s.updateSessionExpirationStmt).ExecContext(ctx, sessionID, expiration.UTC(), completedAt.UTC())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	_, err = sqlutil.TxStmt(txn, s.insertSessionStageStmt).ExecContext(ctx, sessionID, stage, completedAt.UTC())
+	return err
+}
+
+// UpdateUIASessionData replaces the data of the session and extends its
+// expiration. Returns sql.ErrNoRows if the session doesn't exist or has expired.
+func (s *uiaSessionsStatements) UpdateUIASessionData(ctx context.Context, txn *sql.Tx, sessionID string, data json.RawMessage, updatedAt, expiration time.Time) error {
+	res, err := sqlutil.TxStmt(txn, s.updateSessionDataStmt).ExecContext(ctx, sessionID, string(data), expiration.UTC(), updatedAt.UTC())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteUIASession removes the session. Returns sql.ErrNoRows if the session
+// doesn't exist or has expired, so that only one caller can remove a session.
+func (s *uiaSessionsStatements) DeleteUIASession(ctx context.Context, txn *sql.Tx, sessionID string) error {
+	var deleted string
+	return sqlutil.TxStmt(txn, s.deleteSessionStmt).QueryRowContext(ctx, sessionID, time.Now().UTC()).Scan(&deleted)
+}
+
+// DeleteExpiredUIASessions garbage-collects the sessions which were never
+// completed.
+func (s *uiaSessionsStatements) DeleteExpiredUIASessions(ctx context.Context, txn *sql.Tx) error {
+	_, err := sqlutil.TxStmt(txn, s.deleteExpiredSessionsStmt).ExecContext(ctx, time.Now().UTC())
+	return err
+}
@@ -52,6 +52,10 @@ type Database struct {
 	KeyBackupVersions  tables.KeyBackupVersionTable
 	Devices            tables.DevicesTable
 	LoginTokens        tables.LoginTokenTable
+	UIASessions        tables.UIASessionsTable
+	RefreshTokens      tables.RefreshTokensTable
+	ExternalIDs        tables.ExternalIDsTable
+	EmailDigests       tables.EmailDigestsTable
 	Notifications      tables.NotificationTable
 	Pushers            tables.PusherTable
 	LoginTokenLifetime time.Duration
@@ -75,6 +79,8 @@ const (
 	// The length of generated device IDs
 	deviceIDByteLength   = 6
 	loginTokenByteLength = 32
+	// The length of generated refresh tokens
+	refreshTokenByteLength = 32
 )
 
 func (d *Database) RegistrationTokenExists(ctx context.Context, token string) (bool, error) {
@@ -273,6 +279,7 @@ func (d *Database) QueryPushRules(
 	if err := json.Unmarshal(data, &pushRules); err != nil {
 		return nil, err
 	}
+	pushRules.Global.AddMissingDefaults(localpart, serverName)
 
 	return &pushRules, nil
 }
@@ -351,6 +358,20 @@ func (d *Database) GetAccountByLocalpart(ctx context.Context, localpart string,
 	return acc, err
 }
 
+// GetLocalpartForExternalID returns the account that the user of an external
+// identity provider logs in as. Returns sql.ErrNoRows if there isn't one.
+func (d *Database) GetLocalpartForExternalID(ctx context.Context, authProvider, externalID string) (string, spec.ServerName, error) {
+	return d.ExternalIDs.SelectExternalID(ctx, nil, authProvider, externalID)
+}
+
+// LinkExternalID makes the user of an external identity provider log in as the
+// given account from now on.
+func (d *Database) LinkExternalID(ctx context.Context, authProvider, externalID, localpart string, serverName spec.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.ExternalIDs.InsertExternalID(ctx, txn, authProvider, externalID, localpart, serverName)
+	})
+}
+
 // SearchProfiles returns all profiles where the provided localpart or display name
 // match any part of the profiles in the database.
 func (d *Database) SearchProfiles(ctx context.Context, searchString string, limit int,
@@ -365,6 +386,40 @@ func (d *Database) DeactivateAccount(ctx context.Context, localpart string, serv
 	})
 }
 
+// GetAccounts returns a page of accounts, and the total number of accounts
+// whose localpart or display name contains the search term.
+func (d *Database) GetAccounts(
+	ctx context.Context, search string, includeDeactivated bool, from, limit int64,
+) ([]api.AdminAccount, int64, error) {
+	accounts, err := d.Accounts.SelectAccounts(ctx, search, includeDeactivated, from, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := d.Accounts.SelectAccountCount(ctx, search, includeDeactivated)
+	if err != nil {
+		return nil, 0, err
+	}
+	return accounts, total, nil
+}
+
+func (d *Database) SetAccountType(ctx context.Context, localpart string, serverName spec.ServerName, accountType api.AccountType) error {
+	return d.Writer.Do(nil, nil, func(txn *sql.Tx) error {
+		return d.Accounts.UpdateAccountType(ctx, localpart, serverName, accountType)
+	})
+}
+
+func (d *Database) SetAccountLocked(ctx context.Context, localpart string, serverName spec.ServerName, locked bool) error {
+	return d.Writer.Do(nil, nil, func(txn *sql.Tx) error {
+		return d.Accounts.UpdateAccountLocked(ctx, localpart, serverName, locked)
+	})
+}
+
+func (d *Database) SetAccountShadowBanned(ctx context.Context, localpart string, serverName spec.ServerName, shadowBanned bool) error {
+	return d.Writer.Do(nil, nil, func(txn *sql.Tx) error {
+		return d.Accounts.UpdateAccountShadowBanned(ctx, localpart, serverName, shadowBanned)
+	})
+}
+
 func (d *Database) CreateKeyBackup(
 	ctx context.Context, userID, algorithm string, authData json.RawMessage,
 ) (version string, err error) {
@@ -642,10 +697,10 @@ func (d *Database) RemoveDevices(
 	devices []string,
 ) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		if err := d.Devices.DeleteDevices(ctx, txn, localpart, serverName, devices); err != sql.ErrNoRows {
+		if err := d.Devices.DeleteDevices(ctx, txn, localpart, serverName, devices); err != nil && err != sql.ErrNoRows {
 			return err
 		}
-		return nil
+		return d.RefreshTokens.DeleteRefreshTokensByDevices(ctx, txn, localpart, serverName, devices)
 	})
 }
 
@@ -662,10 +717,10 @@ func (d *Database) RemoveAllDevices(
 		if err != nil {
 			return err
 		}
-		if err := d.Devices.DeleteDevicesByLocalpart(ctx, txn, localpart, serverName, exceptDeviceID); err != sql.ErrNoRows {
+		if err := d.Devices.DeleteDevicesByLocalpart(ctx, txn, localpart, serverName, exceptDeviceID); err != nil && err != sql.ErrNoRows {
 			return err
 		}
-		return nil
+		return d.RefreshTokens.DeleteRefreshTokensByLocalpart(ctx, txn, localpart, serverName, exceptDeviceID)
 	})
 	return
 }
@@ -677,6 +732,73 @@ func (d *Database) UpdateDeviceLastSeen(ctx context.Context, localpart string, s
 	})
 }
 
+// CreateRefreshToken makes the access token of the device session expire at
+// the given time, and returns a refresh token which can be exchanged for a new
+// access token with RefreshAccessToken.
+func (d *Database) CreateRefreshToken(
+	ctx context.Context, dev *api.Device, accessTokenExpiresTS int64,
+) (string, error) {
+	localpart, serverName, err := gomatrixserverlib.SplitID('@', dev.UserID)
+	if err != nil {
+		return "", err
+	}
+	token, err := generateRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		if err := d.Devices.UpdateAccessToken(ctx, txn, dev.SessionID, dev.AccessToken, accessTokenExpiresTS); err != nil {
+			return fmt.Errorf("d.Devices.UpdateAccessToken: %w", err)
+		}
+		return d.RefreshTokens.InsertRefreshToken(ctx, txn, token, dev.SessionID, localpart, serverName, dev.ID)
+	})
+	if err != nil {
+		return "", err
+	}
+	dev.AccessTokenExpiresTS = accessTokenExpiresTS
+	return token, nil
+}
+
+// RefreshAccessToken exchanges a refresh token for a new refresh token, and
+// replaces the access token of the device session that it was issued to. The
+// old refresh token and access token can't be used again. Returns
+// sql.ErrNoRows if the refresh token is unknown, has already been used or if
+// the device session no longer exists.
+func (d *Database) RefreshAccessToken(
+	ctx context.Context, refreshToken, accessToken string, accessTokenExpiresTS int64,
+) (*api.Device, string, error) {
+	newRefreshToken, err := generateRefreshToken()
+	if err != nil {
+		return nil, "", err
+	}
+	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		sessionID, localpart, serverName, deviceID, err := d.RefreshTokens.DeleteRefreshToken(ctx, txn, refreshToken)
+		if err != nil {
+			return err
+		}
+		if err = d.Devices.UpdateAccessToken(ctx, txn, sessionID, accessToken, accessTokenExpiresTS); err != nil {
+			return err
+		}
+		return d.RefreshTokens.InsertRefreshToken(ctx, txn, newRefreshToken, sessionID, localpart, serverName, deviceID)
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	dev, err := d.Devices.SelectDeviceByToken(ctx, accessToken)
+	if err != nil {
+		return nil, "", err
+	}
+	return dev, newRefreshToken, nil
+}
+
+func generateRefreshToken() (string, error) {
+	b := make([]byte, refreshTokenByteLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 // CreateLoginToken generates a token, stores and returns it. The lifetime is
 // determined by the loginTokenLifetime given to the Database constructor.
 func (d *Database) CreateLoginToken(ctx context.Context, data *api.LoginTokenData) (*api.LoginTokenMetadata, error) {
@@ -721,9 +843,76 @@ func (d *Database) GetLoginTokenDataByToken(ctx context.Context, token string) (
 	return d.LoginTokens.SelectLoginToken(ctx, token)
 }
 
-func (d *Database) InsertNotification(ctx context.Context, localpart string, serverName spec.ServerName, eventID string, pos uint64, tweaks map[string]interface{}, n *api.Notification) error {
+// CreateUIASession stores a new user-interactive auth session, which expires
+// after api.DefaultUIASessionLifetime unless a stage is completed.
+func (d *Database) CreateUIASession(ctx context.Context, session *api.UIASession) error {
+	session.CreatedAt = time.Now()
+	session.Expiration = session.CreatedAt.Add(api.DefaultUIASessionLifetime)
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		return d.Notifications.Insert(ctx, txn, localpart, serverName, eventID, pos, pushrules.BoolTweakOr(tweaks, pushrules.HighlightTweak, false), n)
+		// Creating a session also garbage-collects any expired sessions.
+		if err := d.UIASessions.DeleteExpiredUIASessions(ctx, txn); err != nil {
+			return err
+		}
+		return d.UIASessions.InsertUIASession(ctx, txn, session)
+	})
+}
+
+// AddUIASessionStage records a completed stage of the session and extends its
+// lifetime. Returns sql.ErrNoRows if the session doesn't exist or has expired.
+func (d *Database) AddUIASessionStage(ctx context.Context, sessionID, stage string) error {
+	now := time.Now()
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.UIASessions.InsertUIASessionStage(ctx, txn, sessionID, stage, now, now.Add(api.DefaultUIASessionLifetime))
+	})
+}
+
+// SetUIASessionData replaces the data of the session and extends its lifetime.
+// Returns sql.ErrNoRows if the session doesn't exist or has expired.
+func (d *Database) SetUIASessionData(ctx context.Context, sessionID string, data json.RawMessage) error {
+	now := time.Now()
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.UIASessions.UpdateUIASessionData(ctx, txn, sessionID, data, now, now.Add(api.DefaultUIASessionLifetime))
+	})
+}
+
+// RemoveUIASession removes the session. Returns sql.ErrNoRows if the session
+// doesn't exist or has expired, e.g. because it was already removed by another
+// request.
+func (d *Database) RemoveUIASession(ctx context.Context, sessionID string) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.UIASessions.DeleteUIASession(ctx, txn, sessionID)
+	})
+}
+
+// GetUIASession returns the session with its completed stages.
+// May return sql.ErrNoRows.
+func (d *Database) GetUIASession(ctx context.Context, sessionID string) (*api.UIASession, error) {
+	return d.UIASessions.SelectUIASession(ctx, nil, sessionID)
+}
+
+// StoreEmailDigest stores the pending notification email of a user,
+// replacing any that is already stored.
+func (d *Database) StoreEmailDigest(ctx context.Context, digest *api.EmailDigest) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.EmailDigests.UpsertEmailDigest(ctx, txn, digest)
+	})
+}
+
+// RemoveEmailDigest removes the pending notification email of a user.
+func (d *Database) RemoveEmailDigest(ctx context.Context, localpart string, serverName spec.ServerName) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.EmailDigests.DeleteEmailDigest(ctx, txn, localpart, serverName)
+	})
+}
+
+// GetEmailDigests returns the pending notification emails of all users.
+func (d *Database) GetEmailDigests(ctx context.Context) ([]*api.EmailDigest, error) {
+	return d.EmailDigests.SelectEmailDigests(ctx, nil)
+}
+
+func (d *Database) InsertNotification(ctx context.Context, localpart string, serverName spec.ServerName, eventID, threadID string, pos uint64, tweaks map[string]interface{}, n *api.Notification) error {
+	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
+		return d.Notifications.Insert(ctx, txn, localpart, serverName, eventID, threadID, pos, pushrules.BoolTweakOr(tweaks, pushrules.HighlightTweak, false), n)
 	})
 }
 
@@ -735,9 +924,12 @@ func (d *Database) DeleteNotificationsUpTo(ctx context.Context, localpart string
 	return
 }
 
-func (d *Database) SetNotificationsRead(ctx context.Context, localpart string, serverName spec.ServerName, roomID string, pos uint64, b bool) (affected bool, err error) {
+// SetNotificationsRead marks the notifications in the room up to the given
+// position as read. If a thread ID is given then only the notifications in
+// that thread are marked as read.
+func (d *Database) SetNotificationsRead(ctx context.Context, localpart string, serverName spec.ServerName, roomID, threadID string, pos uint64, b bool) (affected bool, err error) {
 	err = d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
-		affected, err = d.Notifications.UpdateRead(ctx, txn, localpart, serverName, roomID, pos, b)
+		affected, err = d.Notifications.UpdateRead(ctx, txn, localpart, serverName, roomID, threadID, pos, b)
 		return err
 	})
 	return
@@ -755,6 +947,10 @@ func (d *Database) GetRoomNotificationCounts(ctx context.Context, localpart stri
 	return d.Notifications.SelectRoomCounts(ctx, nil, localpart, serverName, roomID)
 }
 
+func (d *Database) GetRoomThreadNotificationCounts(ctx context.Context, localpart string, serverName spec.ServerName, roomID string) (map[string]tables.NotificationCounts, error) {
+	return d.Notifications.SelectRoomThreadCounts(ctx, nil, localpart, serverName, roomID)
+}
+
 func (d *Database) DeleteOldNotifications(ctx context.Context) error {
 	return d.Writer.Do(d.DB, nil, func(txn *sql.Tx) error {
 		return d.Notifications.Clean(ctx, txn)
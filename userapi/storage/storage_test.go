@@ -3,6 +3,7 @@ package storage_test
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"reflect"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/util"
+	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
@@ -155,6 +157,63 @@ func Test_Accounts(t *testing.T) {
 	})
 }
 
+// Tests listing accounts and the admin account flags
+func Test_AdminAccounts(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+		domain := spec.ServerName("localhost")
+
+		for _, localpart := range []string{"alice", "bob", "charlie"} {
+			_, err := db.CreateAccount(ctx, localpart, domain, "", "", api.AccountTypeUser)
+			assert.NoError(t, err)
+		}
+		_, _, err := db.SetDisplayName(ctx, "charlie", domain, "Al_ice's friend")
+		assert.NoError(t, err)
+
+		accounts, total, err := db.GetAccounts(ctx, "", false, 0, 2)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), total)
+		assert.Equal(t, 2, len(accounts))
+		assert.Equal(t, "alice", accounts[0].Localpart)
+		assert.Equal(t, "bob", accounts[1].Localpart)
+
+		// Searches match display names too, and wildcards are escaped
+		accounts, total, err = db.GetAccounts(ctx, "al_i", false, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), total)
+		assert.Equal(t, "charlie", accounts[0].Localpart)
+		assert.Equal(t, "Al_ice's friend", accounts[0].DisplayName)
+
+		err = db.SetAccountType(ctx, "alice", domain, api.AccountTypeAdmin)
+		assert.NoError(t, err)
+		err = db.SetAccountLocked(ctx, "alice", domain, true)
+		assert.NoError(t, err)
+		err = db.SetAccountShadowBanned(ctx, "bob", domain, true)
+		assert.NoError(t, err)
+
+		acc, err := db.GetAccountByLocalpart(ctx, "alice", domain)
+		assert.NoError(t, err)
+		assert.Equal(t, api.AccountTypeAdmin, acc.AccountType)
+		assert.True(t, acc.Locked)
+		assert.False(t, acc.ShadowBanned)
+		acc, err = db.GetAccountByLocalpart(ctx, "bob", domain)
+		assert.NoError(t, err)
+		assert.True(t, acc.ShadowBanned)
+
+		// Deactivated accounts are only listed when asked for
+		err = db.DeactivateAccount(ctx, "bob", domain)
+		assert.NoError(t, err)
+		_, total, err = db.GetAccounts(ctx, "", false, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), total)
+		accounts, total, err = db.GetAccounts(ctx, "", true, 0, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), total)
+		assert.True(t, accounts[1].Deactivated)
+	})
+}
+
 func Test_Devices(t *testing.T) {
 	alice := test.NewUser(t)
 	localpart, domain, err := gomatrixserverlib.SplitID('@', alice.ID)
@@ -347,6 +406,73 @@ func Test_LoginToken(t *testing.T) {
 	})
 }
 
+func Test_UIASession(t *testing.T) {
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+
+		session := &api.UIASession{SessionID: "session", RequestHash: "hash"}
+		err := db.CreateUIASession(ctx, session)
+		assert.NoError(t, err, "unable to create UIA session")
+
+		// complete a stage, completing it again is a no-op
+		assert.NoError(t, db.AddUIASessionStage(ctx, session.SessionID, "m.login.password"))
+		assert.NoError(t, db.AddUIASessionStage(ctx, session.SessionID, "m.login.password"))
+		assert.ErrorIs(t, db.AddUIASessionStage(ctx, "unknown", "m.login.password"), sql.ErrNoRows)
+
+		got, err := db.GetUIASession(ctx, session.SessionID)
+		assert.NoError(t, err, "unable to get UIA session")
+		assert.Equal(t, "hash", got.RequestHash)
+		assert.Equal(t, []string{"m.login.password"}, got.CompletedStages())
+		assert.False(t, got.Completed[0].CompletedAt.IsZero())
+		assert.Empty(t, got.Data)
+
+		// store data with the session
+		assert.NoError(t, db.SetUIASessionData(ctx, session.SessionID, json.RawMessage(`{"username":"alice"}`)))
+		assert.ErrorIs(t, db.SetUIASessionData(ctx, "unknown", json.RawMessage(`{}`)), sql.ErrNoRows)
+		got, err = db.GetUIASession(ctx, session.SessionID)
+		assert.NoError(t, err, "unable to get UIA session")
+		assert.JSONEq(t, `{"username":"alice"}`, string(got.Data))
+
+		// remove the session again, which can only be done once
+		assert.NoError(t, db.RemoveUIASession(ctx, session.SessionID))
+		assert.ErrorIs(t, db.RemoveUIASession(ctx, session.SessionID), sql.ErrNoRows)
+		_, err = db.GetUIASession(ctx, session.SessionID)
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+	})
+}
+
+func Test_ExternalIDs(t *testing.T) {
+	alice := test.NewUser(t)
+	aliceLocalpart, aliceDomain, err := gomatrixserverlib.SplitID('@', alice.ID)
+	assert.NoError(t, err)
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		db, close := mustCreateUserDatabase(t, dbType)
+		defer close()
+
+		// unknown external users aren't linked to any account
+		_, _, err = db.GetLocalpartForExternalID(ctx, "oidc", "1234")
+		assert.Equal(t, sql.ErrNoRows, err)
+
+		err = db.LinkExternalID(ctx, "oidc", "1234", aliceLocalpart, aliceDomain)
+		assert.NoError(t, err, "unable to link external ID")
+
+		gotLocalpart, gotDomain, err := db.GetLocalpartForExternalID(ctx, "oidc", "1234")
+		assert.NoError(t, err, "unable to get external ID")
+		assert.Equal(t, aliceLocalpart, gotLocalpart)
+		assert.Equal(t, aliceDomain, gotDomain)
+
+		// the same subject at another identity provider is a different user
+		_, _, err = db.GetLocalpartForExternalID(ctx, "other", "1234")
+		assert.Equal(t, sql.ErrNoRows, err)
+
+		// an external user can only be linked to one account
+		err = db.LinkExternalID(ctx, "oidc", "1234", "bob", aliceDomain)
+		assert.Error(t, err, "expected an error, but got none")
+	})
+}
+
 func Test_Profile(t *testing.T) {
 	alice := test.NewUser(t)
 	aliceLocalpart, aliceDomain, err := gomatrixserverlib.SplitID('@', alice.ID)
@@ -460,12 +586,16 @@ func Test_Notification(t *testing.T) {
 		for i := 0; i < 10; i++ {
 			eventID := util.RandomString(16)
 			roomID := room.ID
+			threadID := eventutil.MainThreadID
 			ts := time.Now()
 			if i > 5 {
 				roomID = room2.ID
 				// create some old notifications to test DeleteOldNotifications
 				ts = ts.AddDate(0, -2, 0)
 			}
+			if i == 9 {
+				threadID = "$thread"
+			}
 			notification := &api.Notification{
 				Actions: []*pushrules.Action{
 					{},
@@ -477,7 +607,7 @@ func Test_Notification(t *testing.T) {
 				RoomID: roomID,
 				TS:     spec.AsTimestamp(ts),
 			}
-			err = db.InsertNotification(ctx, aliceLocalpart, aliceDomain, eventID, uint64(i+1), nil, notification)
+			err = db.InsertNotification(ctx, aliceLocalpart, aliceDomain, eventID, threadID, uint64(i+1), nil, notification)
 			assert.NoError(t, err, "unable to insert notification")
 		}
 
@@ -495,7 +625,7 @@ func Test_Notification(t *testing.T) {
 		assert.Equal(t, int64(4), total)
 
 		// mark notification as read
-		affected, err := db.SetNotificationsRead(ctx, aliceLocalpart, aliceDomain, room2.ID, 7, true)
+		affected, err := db.SetNotificationsRead(ctx, aliceLocalpart, aliceDomain, room2.ID, "", 7, true)
 		assert.NoError(t, err, "unable to set notifications read")
 		assert.True(t, affected)
 
@@ -508,6 +638,24 @@ func Test_Notification(t *testing.T) {
 		assert.NoError(t, err, "unable to get notifications for room")
 		assert.Equal(t, int64(2), total)
 
+		// the remaining notifications are split between the main timeline and a thread
+		threadCounts, err := db.GetRoomThreadNotificationCounts(ctx, aliceLocalpart, aliceDomain, room2.ID)
+		assert.NoError(t, err, "unable to get thread notification counts for room")
+		assert.Equal(t, map[string]tables.NotificationCounts{
+			eventutil.MainThreadID: {Total: 1},
+			"$thread":              {Total: 1},
+		}, threadCounts)
+
+		// marking the thread as read leaves the main timeline alone
+		affected, err = db.SetNotificationsRead(ctx, aliceLocalpart, aliceDomain, room2.ID, "$thread", 10, true)
+		assert.NoError(t, err, "unable to set thread notifications read")
+		assert.True(t, affected)
+		threadCounts, err = db.GetRoomThreadNotificationCounts(ctx, aliceLocalpart, aliceDomain, room2.ID)
+		assert.NoError(t, err, "unable to get thread notification counts for room")
+		assert.Equal(t, map[string]tables.NotificationCounts{
+			eventutil.MainThreadID: {Total: 1},
+		}, threadCounts)
+
 		// delete old notifications
 		err = db.DeleteOldNotifications(ctx)
 		assert.NoError(t, err)
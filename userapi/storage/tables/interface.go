@@ -18,6 +18,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"time"
 
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/fclient"
@@ -51,6 +52,11 @@ type AccountsTable interface {
 	SelectPasswordHash(ctx context.Context, localpart string, serverName spec.ServerName) (hash string, err error)
 	SelectAccountByLocalpart(ctx context.Context, localpart string, serverName spec.ServerName) (*api.Account, error)
 	SelectNewNumericLocalpart(ctx context.Context, txn *sql.Tx, serverName spec.ServerName) (id int64, err error)
+	SelectAccounts(ctx context.Context, search string, includeDeactivated bool, from, limit int64) ([]api.AdminAccount, error)
+	SelectAccountCount(ctx context.Context, search string, includeDeactivated bool) (int64, error)
+	UpdateAccountType(ctx context.Context, localpart string, serverName spec.ServerName, accountType api.AccountType) error
+	UpdateAccountLocked(ctx context.Context, localpart string, serverName spec.ServerName, locked bool) error
+	UpdateAccountShadowBanned(ctx context.Context, localpart string, serverName spec.ServerName, shadowBanned bool) error
 }
 
 type DevicesTable interface {
@@ -65,6 +71,29 @@ type DevicesTable interface {
 	SelectDevicesByLocalpart(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, exceptDeviceID string) ([]api.Device, error)
 	SelectDevicesByID(ctx context.Context, deviceIDs []string) ([]api.Device, error)
 	UpdateDeviceLastSeen(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceID, ipAddr, userAgent string) error
+	UpdateAccessToken(ctx context.Context, txn *sql.Tx, sessionID int64, accessToken string, expiresTS int64) error
+}
+
+type RefreshTokensTable interface {
+	InsertRefreshToken(ctx context.Context, txn *sql.Tx, token string, sessionID int64, localpart string, serverName spec.ServerName, deviceID string) error
+	// DeleteRefreshToken removes the refresh token and returns the device
+	// session that it was issued to. Returns sql.ErrNoRows if the token is unknown.
+	DeleteRefreshToken(ctx context.Context, txn *sql.Tx, token string) (sessionID int64, localpart string, serverName spec.ServerName, deviceID string, err error)
+	DeleteRefreshTokensByDevices(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, deviceIDs []string) error
+	DeleteRefreshTokensByLocalpart(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, exceptDeviceID string) error
+}
+
+type ExternalIDsTable interface {
+	InsertExternalID(ctx context.Context, txn *sql.Tx, authProvider, externalID string, localpart string, serverName spec.ServerName) error
+	// SelectExternalID returns the local account that the external user logs
+	// in as. Returns sql.ErrNoRows if the external user is unknown.
+	SelectExternalID(ctx context.Context, txn *sql.Tx, authProvider, externalID string) (localpart string, serverName spec.ServerName, err error)
+}
+
+type EmailDigestsTable interface {
+	UpsertEmailDigest(ctx context.Context, txn *sql.Tx, digest *api.EmailDigest) error
+	DeleteEmailDigest(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName) error
+	SelectEmailDigests(ctx context.Context, txn *sql.Tx) ([]*api.EmailDigest, error)
 }
 
 type KeyBackupTable interface {
@@ -90,6 +119,15 @@ type LoginTokenTable interface {
 	SelectLoginToken(ctx context.Context, token string) (*api.LoginTokenData, error)
 }
 
+type UIASessionsTable interface {
+	InsertUIASession(ctx context.Context, txn *sql.Tx, session *api.UIASession) error
+	SelectUIASession(ctx context.Context, txn *sql.Tx, sessionID string) (*api.UIASession, error)
+	InsertUIASessionStage(ctx context.Context, txn *sql.Tx, sessionID, stage string, completedAt, expiration time.Time) error
+	UpdateUIASessionData(ctx context.Context, txn *sql.Tx, sessionID string, data json.RawMessage, updatedAt, expiration time.Time) error
+	DeleteUIASession(ctx context.Context, txn *sql.Tx, sessionID string) error
+	DeleteExpiredUIASessions(ctx context.Context, txn *sql.Tx) error
+}
+
 type ProfileTable interface {
 	InsertProfile(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName) error
 	SelectProfileByLocalpart(ctx context.Context, localpart string, serverName spec.ServerName) (*authtypes.Profile, error)
@@ -107,12 +145,20 @@ type PusherTable interface {
 
 type NotificationTable interface {
 	Clean(ctx context.Context, txn *sql.Tx) error
-	Insert(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, eventID string, pos uint64, highlight bool, n *api.Notification) error
+	Insert(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, eventID, threadID string, pos uint64, highlight bool, n *api.Notification) error
 	DeleteUpTo(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string, pos uint64) (affected bool, _ error)
-	UpdateRead(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string, pos uint64, v bool) (affected bool, _ error)
+	UpdateRead(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID, threadID string, pos uint64, v bool) (affected bool, _ error)
 	Select(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, fromID int64, limit int, filter NotificationFilter) ([]*api.Notification, int64, error)
 	SelectCount(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, filter NotificationFilter) (int64, error)
 	SelectRoomCounts(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string) (total int64, highlight int64, _ error)
+	SelectRoomThreadCounts(ctx context.Context, txn *sql.Tx, localpart string, serverName spec.ServerName, roomID string) (map[string]NotificationCounts, error)
+}
+
+// NotificationCounts contains the number of unread notifications and the
+// number of unread highlights.
+type NotificationCounts struct {
+	Total     int64
+	Highlight int64
 }
 
 type NotificationFilter uint32
@@ -20,6 +20,7 @@ import (
 	fedsenderapi "github.com/neilalexander/harmony/federationapi/api"
 	"github.com/neilalexander/harmony/federationapi/statistics"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/mailer"
 	"github.com/neilalexander/harmony/internal/pushgateway"
 	"github.com/neilalexander/harmony/internal/sqlutil"
 	"github.com/neilalexander/harmony/setup/config"
@@ -33,6 +34,7 @@ import (
 	"github.com/neilalexander/harmony/userapi/internal"
 	"github.com/neilalexander/harmony/userapi/producers"
 	"github.com/neilalexander/harmony/userapi/storage"
+	"github.com/neilalexander/harmony/userapi/util"
 )
 
 // NewInternalAPI returns a concrete implementation of the internal API. Callers
@@ -133,8 +135,20 @@ func NewInternalAPI(
 		logrus.WithError(err).Panic("failed to start user API receipt consumer")
 	}
 
+	var emailNotifier *util.EmailNotifier
+	if dendriteCfg.UserAPI.Email.Enabled {
+		mailClient, err := mailer.NewSMTPClient(&dendriteCfg.UserAPI.Email)
+		if err != nil {
+			logrus.WithError(err).Panic("failed to create SMTP client")
+		}
+		emailNotifier, err = util.NewEmailNotifier(processContext.Context(), &dendriteCfg.UserAPI.Email, db, mailClient)
+		if err != nil {
+			logrus.WithError(err).Panic("failed to create email notifier")
+		}
+	}
+
 	eventConsumer := consumers.NewOutputRoomEventConsumer(
-		processContext, &dendriteCfg.UserAPI, js, db, pgClient, rsAPI, syncProducer,
+		processContext, &dendriteCfg.UserAPI, js, db, pgClient, emailNotifier, rsAPI, syncProducer,
 	)
 	if err := eventConsumer.Start(); err != nil {
 		logrus.WithError(err).Panic("failed to start user API streamed event consumer")
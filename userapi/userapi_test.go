@@ -664,3 +664,101 @@ func TestDeviceIDReuse(t *testing.T) {
 		})
 	})
 }
+
+func TestRefreshTokens(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		intAPI, _, close := MustMakeInternalAPI(t, apiTestOpts{serverName: "test"}, dbType, nil)
+		defer close()
+
+		deviceID := util.RandomString(8)
+		req := api.PerformDeviceCreationRequest{
+			Localpart: "alice", ServerName: "test", DeviceID: &deviceID,
+			AccessToken: util.RandomString(16), NoDeviceListUpdate: true, RefreshToken: true,
+		}
+		res := api.PerformDeviceCreationResponse{}
+		if err := intAPI.PerformDeviceCreation(ctx, &req, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.RefreshToken == "" || res.Device.AccessTokenExpiresTS == 0 {
+			t.Fatalf("expected a refresh token and an expiring access token, got %q and %d", res.RefreshToken, res.Device.AccessTokenExpiresTS)
+		}
+
+		queryRes := api.QueryAccessTokenResponse{}
+		if err := intAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: req.AccessToken}, &queryRes); err != nil {
+			t.Fatal(err)
+		}
+		if queryRes.Device == nil || queryRes.Expired {
+			t.Fatalf("expected the access token to be valid")
+		}
+
+		// Refreshing replaces both tokens.
+		refreshReq := api.PerformTokenRefreshRequest{RefreshToken: res.RefreshToken, AccessToken: util.RandomString(16)}
+		refreshRes := api.PerformTokenRefreshResponse{}
+		if err := intAPI.PerformTokenRefresh(ctx, &refreshReq, &refreshRes); err != nil {
+			t.Fatal(err)
+		}
+		if refreshRes.Device == nil || refreshRes.Device.ID != deviceID || refreshRes.Device.AccessToken != refreshReq.AccessToken {
+			t.Fatalf("unexpected device after refresh: %+v", refreshRes.Device)
+		}
+		if refreshRes.RefreshToken == "" || refreshRes.RefreshToken == res.RefreshToken {
+			t.Fatalf("expected a new refresh token")
+		}
+		queryRes = api.QueryAccessTokenResponse{}
+		if err := intAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: req.AccessToken}, &queryRes); err != nil {
+			t.Fatal(err)
+		}
+		if queryRes.Device != nil {
+			t.Fatalf("expected the old access token to be invalid")
+		}
+
+		// The old refresh token can't be used again.
+		reuseRes := api.PerformTokenRefreshResponse{}
+		if err := intAPI.PerformTokenRefresh(ctx, &api.PerformTokenRefreshRequest{RefreshToken: res.RefreshToken, AccessToken: util.RandomString(16)}, &reuseRes); err != nil {
+			t.Fatal(err)
+		}
+		if reuseRes.Device != nil {
+			t.Fatalf("expected the old refresh token to be rejected")
+		}
+
+		// Logging in again with the same device ID invalidates the refresh token.
+		res2 := api.PerformDeviceCreationResponse{}
+		req.AccessToken = util.RandomString(16)
+		if err := intAPI.PerformDeviceCreation(ctx, &req, &res2); err != nil {
+			t.Fatal(err)
+		}
+		reuseRes = api.PerformTokenRefreshResponse{}
+		if err := intAPI.PerformTokenRefresh(ctx, &api.PerformTokenRefreshRequest{RefreshToken: refreshRes.RefreshToken, AccessToken: util.RandomString(16)}, &reuseRes); err != nil {
+			t.Fatal(err)
+		}
+		if reuseRes.Device != nil {
+			t.Fatalf("expected the refresh token of the old session to be rejected")
+		}
+	})
+}
+
+func TestExpiredAccessToken(t *testing.T) {
+	ctx := context.Background()
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		intAPI, _, close := MustMakeInternalAPI(t, apiTestOpts{serverName: "test"}, dbType, nil)
+		defer close()
+		intAPI.(*internal.UserInternalAPI).Config.AccessTokenLifetimeMS = 1
+
+		req := api.PerformDeviceCreationRequest{
+			Localpart: "alice", ServerName: "test", AccessToken: util.RandomString(16),
+			NoDeviceListUpdate: true, RefreshToken: true,
+		}
+		if err := intAPI.PerformDeviceCreation(ctx, &req, &api.PerformDeviceCreationResponse{}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		res := api.QueryAccessTokenResponse{}
+		if err := intAPI.QueryAccessToken(ctx, &api.QueryAccessTokenRequest{AccessToken: req.AccessToken}, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Device != nil || !res.Expired {
+			t.Fatalf("expected the access token to have expired")
+		}
+	})
+}
@@ -11,6 +11,10 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// EmailPusherURL is the URL of the push devices of email pushers. The email
+// address is the push key of the device.
+const EmailPusherURL = "mailto:"
+
 type PusherDevice struct {
 	Device pushgateway.Device
 	Pusher *api.Pusher
@@ -31,7 +35,7 @@ func GetPushDevices(ctx context.Context, localpart string, serverName spec.Serve
 		data := pusher.Data
 		switch pusher.Kind {
 		case api.EmailKind:
-			url = "mailto:"
+			url = EmailPusherURL
 
 		case api.HTTPKind:
 			// TODO: The spec says only event_id_only is supported,
@@ -0,0 +1,317 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"net/url"
+	"path/filepath"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/tidwall/gjson"
+
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/mailer"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/userapi/api"
+	"github.com/neilalexander/harmony/userapi/storage"
+	"github.com/neilalexander/harmony/userapi/storage/tables"
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed templates
+var defaultTemplates embed.FS
+
+const (
+	textTemplateName = "notif_mail.txt"
+	htmlTemplateName = "notif_mail.html"
+
+	// maxDigestNotifications is the maximum number of notifications that are
+	// included in a single digest email.
+	maxDigestNotifications = 50
+)
+
+// EmailNotifier batches the notifications of local users with email pushers
+// into digest emails. A digest is sent once the configured delay has passed
+// since the first notification, and only contains the notifications which
+// are still unread by then.
+type EmailNotifier struct {
+	ctx     context.Context
+	cfg     *config.EmailNotifications
+	db      storage.UserDatabase
+	client  mailer.Client
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+	delay   time.Duration
+	mu      sync.Mutex
+	pending map[string]*pendingDigest // user ID -> digest
+}
+
+type pendingDigest struct {
+	timer     *time.Timer
+	since     spec.Timestamp
+	addresses map[string]struct{}
+	roomNames map[string]string
+}
+
+// NewEmailNotifier creates a new email notifier which sends emails with the
+// given client. The templates are loaded from the configured template
+// directory if there is one, otherwise the built-in templates are used.
+func NewEmailNotifier(ctx context.Context, cfg *config.EmailNotifications, db storage.UserDatabase, client mailer.Client) (*EmailNotifier, error) {
+	n := &EmailNotifier{
+		ctx:     ctx,
+		cfg:     cfg,
+		db:      db,
+		client:  client,
+		delay:   time.Duration(cfg.DigestDelaySeconds) * time.Second,
+		pending: map[string]*pendingDigest{},
+	}
+	var err error
+	if cfg.TemplateDir != "" {
+		dir := string(cfg.TemplateDir)
+		n.text, err = texttemplate.ParseFiles(filepath.Join(dir, textTemplateName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse text email template: %w", err)
+		}
+		n.html, err = htmltemplate.ParseFiles(filepath.Join(dir, htmlTemplateName))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse HTML email template: %w", err)
+		}
+	} else {
+		n.text, err = texttemplate.ParseFS(defaultTemplates, "templates/"+textTemplateName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse text email template: %w", err)
+		}
+		n.html, err = htmltemplate.ParseFS(defaultTemplates, "templates/"+htmlTemplateName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse HTML email template: %w", err)
+		}
+	}
+
+	// Pick up the digests which were still pending when we last shut down.
+	// Any that are overdue are sent straight away.
+	digests, err := db.GetEmailDigests(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("db.GetEmailDigests: %w", err)
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, stored := range digests {
+		digest := &pendingDigest{
+			since:     stored.Since,
+			addresses: map[string]struct{}{},
+			roomNames: stored.RoomNames,
+		}
+		if digest.roomNames == nil {
+			digest.roomNames = map[string]string{}
+		}
+		for _, address := range stored.Addresses {
+			digest.addresses[address] = struct{}{}
+		}
+		delay := time.Until(stored.Since.Time().Add(n.delay))
+		n.startDigest(stored.Localpart, stored.ServerName, digest, delay)
+	}
+	return n, nil
+}
+
+// Schedule adds a notification to the next digest email of the user, which is
+// sent to the given addresses. The digest is sent after the configured delay
+// if it isn't already pending. The digest is stored in the database, so that
+// it is still sent if the server restarts in the meantime.
+func (n *EmailNotifier) Schedule(ctx context.Context, localpart string, serverName spec.ServerName, addresses []string, notification *api.Notification, roomName string) error {
+	userID := fmt.Sprintf("@%s:%s", localpart, serverName)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	digest, ok := n.pending[userID]
+	if !ok {
+		digest = &pendingDigest{
+			since:     notification.TS,
+			addresses: map[string]struct{}{},
+			roomNames: map[string]string{},
+		}
+		n.startDigest(localpart, serverName, digest, n.delay)
+	}
+	for _, address := range addresses {
+		digest.addresses[address] = struct{}{}
+	}
+	if roomName != "" {
+		digest.roomNames[notification.RoomID] = roomName
+	}
+
+	stored := &api.EmailDigest{
+		Localpart:  localpart,
+		ServerName: serverName,
+		Since:      digest.since,
+		RoomNames:  digest.roomNames,
+	}
+	for address := range digest.addresses {
+		stored.Addresses = append(stored.Addresses, address)
+	}
+	if err := n.db.StoreEmailDigest(ctx, stored); err != nil {
+		return fmt.Errorf("n.db.StoreEmailDigest: %w", err)
+	}
+	return nil
+}
+
+// startDigest makes the digest pending, and sends it once the delay has
+// passed. The caller must hold n.mu.
+func (n *EmailNotifier) startDigest(localpart string, serverName spec.ServerName, digest *pendingDigest, delay time.Duration) {
+	userID := fmt.Sprintf("@%s:%s", localpart, serverName)
+	n.pending[userID] = digest
+	digest.timer = time.AfterFunc(delay, func() {
+		if err := n.SendDigest(n.ctx, localpart, serverName); err != nil {
+			log.WithField("user_id", userID).WithError(err).Error("Failed to send notification email")
+		}
+	})
+}
+
+// SendDigest sends the pending digest email of the user straight away, if
+// there is one. Nothing is sent if all of the notifications have been read.
+func (n *EmailNotifier) SendDigest(ctx context.Context, localpart string, serverName spec.ServerName) error {
+	userID := fmt.Sprintf("@%s:%s", localpart, serverName)
+
+	// The stored digest is removed along with the pending one, so that it
+	// can't replace a digest that is scheduled while this one is sending.
+	n.mu.Lock()
+	digest, ok := n.pending[userID]
+	delete(n.pending, userID)
+	err := n.db.RemoveEmailDigest(ctx, localpart, serverName)
+	n.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("n.db.RemoveEmailDigest: %w", err)
+	}
+	if !ok || len(digest.addresses) == 0 {
+		return nil
+	}
+	digest.timer.Stop()
+
+	// Only the notifications which are still unread are returned, so a user
+	// who has caught up on another device doesn't get an email.
+	var notifications []*api.Notification
+	var fromID int64
+	for len(notifications) < maxDigestNotifications {
+		page, maxID, err := n.db.GetNotifications(ctx, localpart, serverName, fromID, maxDigestNotifications, tables.AllNotifications)
+		if err != nil {
+			return fmt.Errorf("n.db.GetNotifications: %w", err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, notification := range page {
+			if notification.TS >= digest.since && len(notifications) < maxDigestNotifications {
+				notifications = append(notifications, notification)
+			}
+		}
+		fromID = maxID
+	}
+	if len(notifications) == 0 {
+		return nil
+	}
+
+	data := n.templateData(userID, digest, notifications)
+	var text, html bytes.Buffer
+	if err := n.text.Execute(&text, data); err != nil {
+		return fmt.Errorf("n.text.Execute: %w", err)
+	}
+	if err := n.html.Execute(&html, data); err != nil {
+		return fmt.Errorf("n.html.Execute: %w", err)
+	}
+
+	for address := range digest.addresses {
+		if err := n.client.Send(ctx, &mailer.Message{
+			From:    n.cfg.From,
+			To:      []string{address},
+			Subject: data.Subject,
+			Text:    text.String(),
+			HTML:    html.String(),
+		}); err != nil {
+			return fmt.Errorf("n.client.Send: %w", err)
+		}
+	}
+	return nil
+}
+
+type emailTemplateData struct {
+	AppName string
+	UserID  string
+	Subject string
+	Count   int
+	Rooms   []*emailRoom
+}
+
+type emailRoom struct {
+	ID            string
+	Name          string
+	Link          string
+	Notifications []*emailNotification
+}
+
+type emailNotification struct {
+	Sender string
+	Body   string
+	TS     spec.Timestamp
+}
+
+// templateData groups the notifications by room, in the order that the rooms
+// were first notified about.
+func (n *EmailNotifier) templateData(userID string, digest *pendingDigest, notifications []*api.Notification) *emailTemplateData {
+	data := &emailTemplateData{
+		AppName: n.cfg.AppName,
+		UserID:  userID,
+		Count:   len(notifications),
+	}
+	rooms := map[string]*emailRoom{}
+	for _, notification := range notifications {
+		room, ok := rooms[notification.RoomID]
+		if !ok {
+			room = &emailRoom{
+				ID:   notification.RoomID,
+				Name: digest.roomNames[notification.RoomID],
+			}
+			if room.Name == "" {
+				room.Name = notification.RoomID
+			}
+			if n.cfg.ClientBaseURL != "" {
+				room.Link = n.cfg.ClientBaseURL + "/#/room/" + url.PathEscape(notification.RoomID)
+			}
+			rooms[notification.RoomID] = room
+			data.Rooms = append(data.Rooms, room)
+		}
+		room.Notifications = append(room.Notifications, &emailNotification{
+			Sender: notification.Event.Sender,
+			Body:   notificationBody(notification),
+			TS:     notification.TS,
+		})
+	}
+
+	switch {
+	case len(data.Rooms) == 1 && data.Count == 1:
+		data.Subject = fmt.Sprintf("[%s] New message in %s", n.cfg.AppName, data.Rooms[0].Name)
+	case len(data.Rooms) == 1:
+		data.Subject = fmt.Sprintf("[%s] %d new messages in %s", n.cfg.AppName, data.Count, data.Rooms[0].Name)
+	default:
+		data.Subject = fmt.Sprintf("[%s] %d new messages in %d rooms", n.cfg.AppName, data.Count, len(data.Rooms))
+	}
+	return data
+}
+
+// notificationBody returns a short description of the notified event.
+func notificationBody(notification *api.Notification) string {
+	switch notification.Event.Type {
+	case spec.MRoomMember:
+		if gjson.GetBytes(notification.Event.Content, "membership").Str == spec.Invite {
+			return "invited you to the room"
+		}
+	case "m.room.encrypted":
+		return "sent an encrypted message"
+	}
+	if body := gjson.GetBytes(notification.Event.Content, "body").Str; body != "" {
+		return body
+	}
+	return "sent an event of type " + notification.Event.Type
+}
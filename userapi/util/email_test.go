@@ -0,0 +1,161 @@
+package util_test
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/neilalexander/harmony/internal/eventutil"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
+	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
+	"github.com/neilalexander/harmony/internal/mailer"
+	"github.com/neilalexander/harmony/internal/sqlutil"
+	"github.com/neilalexander/harmony/setup/config"
+	"github.com/neilalexander/harmony/syncapi/synctypes"
+	"github.com/neilalexander/harmony/test"
+	"github.com/neilalexander/harmony/userapi/api"
+	"github.com/neilalexander/harmony/userapi/storage"
+	userUtil "github.com/neilalexander/harmony/userapi/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type fakeMailer struct {
+	sync.Mutex
+	messages []*mailer.Message
+}
+
+func (m *fakeMailer) Send(ctx context.Context, msg *mailer.Message) error {
+	m.Lock()
+	defer m.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+func TestEmailNotifierDigest(t *testing.T) {
+	alice := test.NewUser(t)
+	bob := test.NewUser(t)
+	aliceLocalpart, serverName, err := gomatrixserverlib.SplitID('@', alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	room := test.NewRoom(t, alice)
+	room.CreateAndInsert(t, bob, spec.MRoomMember, map[string]interface{}{"membership": "join"}, test.WithStateKey(bob.ID))
+	message := room.CreateAndInsert(t, bob, "m.room.message", map[string]interface{}{"body": "Hello Alice"})
+
+	test.WithAllDatabases(t, func(t *testing.T, dbType test.DBType) {
+		connStr, close := test.PrepareDBConnectionString(t, dbType)
+		defer close()
+		cm := sqlutil.NewConnectionManager(nil, config.DatabaseOptions{})
+		db, err := storage.NewUserDatabase(ctx, cm, &config.DatabaseOptions{
+			ConnectionString: config.DataSource(connStr),
+		}, "test", bcrypt.MinCost, 0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client := &fakeMailer{}
+		// The delay is long enough that the digests are only ever sent by
+		// calling SendDigest.
+		notifier, err := userUtil.NewEmailNotifier(ctx, &config.EmailNotifications{
+			From:               "noreply@example.com",
+			AppName:            "Harmony",
+			ClientBaseURL:      "https://client.example.com",
+			DigestDelaySeconds: 3600,
+		}, db, client)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ev, err := synctypes.ToClientEvent(message, synctypes.FormatSync, func(roomID spec.RoomID, senderID spec.SenderID) (*spec.UserID, error) {
+			return queryUserIDForSender(senderID)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		notify := func(pos uint64) {
+			n := &api.Notification{
+				Event:  *ev,
+				RoomID: room.ID,
+				TS:     spec.AsTimestamp(time.Now()),
+			}
+			if err = db.InsertNotification(ctx, aliceLocalpart, serverName, message.EventID(), eventutil.MainThreadID, pos, nil, n); err != nil {
+				t.Fatal(err)
+			}
+			if err = notifier.Schedule(ctx, aliceLocalpart, serverName, []string{"alice@example.com"}, n, "Test room"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		t.Run("unread notifications are sent in a digest", func(t *testing.T) {
+			notify(1)
+			notify(2)
+			if err = notifier.SendDigest(ctx, aliceLocalpart, serverName); err != nil {
+				t.Fatal(err)
+			}
+			if len(client.messages) != 1 {
+				t.Fatalf("expected 1 email, got %d", len(client.messages))
+			}
+			msg := client.messages[0]
+			if len(msg.To) != 1 || msg.To[0] != "alice@example.com" {
+				t.Fatalf("unexpected recipients %v", msg.To)
+			}
+			if msg.Subject != "[Harmony] 2 new messages in Test room" {
+				t.Fatalf("unexpected subject %q", msg.Subject)
+			}
+			for _, body := range []string{msg.Text, msg.HTML} {
+				if !strings.Contains(body, "Hello Alice") || !strings.Contains(body, bob.ID) {
+					t.Fatalf("email doesn't contain the message:\n%s", body)
+				}
+				if !strings.Contains(body, "https://client.example.com/#/room/") {
+					t.Fatalf("email doesn't contain a link to the room:\n%s", body)
+				}
+			}
+		})
+
+		t.Run("nothing is sent without a pending digest", func(t *testing.T) {
+			if err = notifier.SendDigest(ctx, aliceLocalpart, serverName); err != nil {
+				t.Fatal(err)
+			}
+			if len(client.messages) != 1 {
+				t.Fatalf("expected no more emails, got %d", len(client.messages))
+			}
+		})
+
+		t.Run("read notifications are not sent", func(t *testing.T) {
+			notify(3)
+			if _, err = db.SetNotificationsRead(ctx, aliceLocalpart, serverName, room.ID, "", uint64(spec.AsTimestamp(time.Now())), true); err != nil {
+				t.Fatal(err)
+			}
+			if err = notifier.SendDigest(ctx, aliceLocalpart, serverName); err != nil {
+				t.Fatal(err)
+			}
+			if len(client.messages) != 1 {
+				t.Fatalf("expected no more emails, got %d", len(client.messages))
+			}
+		})
+
+		t.Run("pending digests are sent after a restart", func(t *testing.T) {
+			notify(4)
+			restarted, err := userUtil.NewEmailNotifier(ctx, &config.EmailNotifications{
+				From:               "noreply@example.com",
+				AppName:            "Harmony",
+				DigestDelaySeconds: 3600,
+			}, db, client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = restarted.SendDigest(ctx, aliceLocalpart, serverName); err != nil {
+				t.Fatal(err)
+			}
+			if len(client.messages) != 2 {
+				t.Fatalf("expected 1 more email, got %d", len(client.messages)-1)
+			}
+			if subject := client.messages[1].Subject; subject != "[Harmony] New message in Test room" {
+				t.Fatalf("unexpected subject %q", subject)
+			}
+		})
+	})
+}
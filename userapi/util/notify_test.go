@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/util"
+	"github.com/neilalexander/harmony/internal/eventutil"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib"
 	"github.com/neilalexander/harmony/internal/gomatrixserverlib/spec"
 	"github.com/neilalexander/harmony/internal/sqlutil"
@@ -114,7 +115,7 @@ func TestNotifyUserCountsAsync(t *testing.T) {
 		if err != nil {
 			t.Error(err)
 		}
-		if err := db.InsertNotification(ctx, aliceLocalpart, serverName, dummyEvent.EventID(), 0, nil, &api.Notification{
+		if err := db.InsertNotification(ctx, aliceLocalpart, serverName, dummyEvent.EventID(), eventutil.MainThreadID, 0, nil, &api.Notification{
 			Event: *ev,
 		}); err != nil {
 			t.Error(err)